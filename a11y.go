@@ -0,0 +1,227 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// With A11Y_AUDIT=true, a development setting, every page rendered is
+// checked for common accessibility mistakes and the problems are logged.
+// a11y_test.go renders each page and fails on them. The checks are a small
+// subset of what tools such as axe-core do, made without a browser:
+//
+//	img-alt       images need an alt attribute ("" for decorative ones)
+//	label         form controls need a label, aria-label or aria-labelledby
+//	button-name   buttons need text or an aria-label
+//	heading-order headings may not skip levels going down, e.g. h2 to h4
+//	html-lang     the page must declare its language
+
+// a11yProblem is an accessibility problem found in a page.
+type a11yProblem struct {
+	Rule   string
+	Detail string
+}
+
+func (p a11yProblem) String() string {
+	return p.Rule + ": " + p.Detail
+}
+
+// htmlTag is a start or end tag found by scanTags.
+type htmlTag struct {
+	name  string
+	end   bool
+	attrs map[string]string
+}
+
+// has reports whether the tag has the attribute name.
+func (t *htmlTag) has(name string) bool {
+	_, ok := t.attrs[name]
+	return ok
+}
+
+// scanTags calls tag with each tag of page, and text with the text between
+// them, skipping comments and the contents of scripts and styles. It only
+// understands the well-formed HTML that html/template produces.
+func scanTags(page string, tag func(*htmlTag), text func(string)) {
+	for len(page) > 0 {
+		i := strings.IndexByte(page, '<')
+		if i < 0 {
+			text(page)
+			return
+		}
+		text(page[:i])
+		page = page[i:]
+		switch {
+		case strings.HasPrefix(page, "<!--"):
+			if j := strings.Index(page, "-->"); j >= 0 {
+				page = page[j+3:]
+				continue
+			}
+			return
+		case strings.HasPrefix(page, "<!"):
+			if j := strings.IndexByte(page, '>'); j >= 0 {
+				page = page[j+1:]
+				continue
+			}
+			return
+		}
+		t, rest := parseTag(page[1:])
+		page = rest
+		if t.name == "" {
+			continue
+		}
+		tag(t)
+		if !t.end && (t.name == "script" || t.name == "style") {
+			j := strings.Index(strings.ToLower(page), "</"+t.name)
+			if j < 0 {
+				return
+			}
+			page = page[j:]
+		}
+	}
+}
+
+// parseTag parses the tag at the start of s, just after its "<", and
+// returns it with the rest of s.
+func parseTag(s string) (*htmlTag, string) {
+	t := &htmlTag{attrs: make(map[string]string)}
+	if strings.HasPrefix(s, "/") {
+		t.end, s = true, s[1:]
+	}
+	word := func(stop string) string {
+		i := strings.IndexAny(s, stop)
+		if i < 0 {
+			i = len(s)
+		}
+		w := s[:i]
+		s = s[i:]
+		return strings.ToLower(w)
+	}
+	t.name = word(" \t\r\n/>")
+	for {
+		s = strings.TrimLeft(s, " \t\r\n/")
+		if s == "" {
+			return t, s
+		}
+		if s[0] == '>' {
+			return t, s[1:]
+		}
+		name := word(" \t\r\n/>=")
+		if name == "" {
+			s = s[1:]
+			continue
+		}
+		s = strings.TrimLeft(s, " \t\r\n")
+		if !strings.HasPrefix(s, "=") {
+			t.attrs[name] = ""
+			continue
+		}
+		s = strings.TrimLeft(s[1:], " \t\r\n")
+		var value string
+		if s != "" && (s[0] == '"' || s[0] == '\'') {
+			q := s[0]
+			j := strings.IndexByte(s[1:], q)
+			if j < 0 {
+				return t, ""
+			}
+			value, s = s[1:j+1], s[j+2:]
+		} else {
+			i := strings.IndexAny(s, " \t\r\n>")
+			if i < 0 {
+				i = len(s)
+			}
+			value, s = s[:i], s[i:]
+		}
+		t.attrs[name] = value
+	}
+}
+
+// auditHTML returns the accessibility problems in page, see the list of
+// checks above.
+func auditHTML(page string) []a11yProblem {
+	var problems []a11yProblem
+	report := func(rule, format string, args ...interface{}) {
+		problems = append(problems, a11yProblem{rule, fmt.Sprintf(format, args...)})
+	}
+
+	var (
+		labelDepth int
+		labelFor   = make(map[string]bool)
+		unlabelled []*htmlTag // controls labelled only if a label names them.
+		button     *htmlTag   // the button being read, if any.
+		named      bool       // whether button has a name.
+		lastLevel  int
+	)
+	describe := func(t *htmlTag) string {
+		for _, a := range []string{"id", "name", "src", "class"} {
+			if v := t.attrs[a]; v != "" {
+				return fmt.Sprintf("<%s %s=%q>", t.name, a, v)
+			}
+		}
+		return "<" + t.name + ">"
+	}
+	scanTags(page, func(t *htmlTag) {
+		labelled := t.attrs["aria-label"] != "" || t.attrs["aria-labelledby"] != ""
+		switch t.name {
+		case "html":
+			if !t.end && t.attrs["lang"] == "" {
+				report("html-lang", "<html> has no lang attribute")
+			}
+		case "label":
+			if t.end {
+				labelDepth--
+			} else {
+				labelDepth++
+				if f := t.attrs["for"]; f != "" {
+					labelFor[f] = true
+				}
+			}
+		case "img":
+			if !t.has("alt") {
+				report("img-alt", "%s has no alt attribute", describe(t))
+			}
+			if button != nil && t.attrs["alt"] != "" {
+				named = true
+			}
+		case "input", "select", "textarea":
+			if t.end {
+				break
+			}
+			switch t.attrs["type"] {
+			case "hidden", "submit", "reset", "button", "image":
+			default:
+				if !labelled && labelDepth == 0 && !t.has("title") {
+					unlabelled = append(unlabelled, t)
+				}
+			}
+		case "button":
+			if !t.end {
+				button, named = t, labelled || t.has("title")
+				break
+			}
+			if button != nil && !named {
+				report("button-name", "%s has no text or aria-label", describe(button))
+			}
+			button = nil
+		case "h1", "h2", "h3", "h4", "h5", "h6":
+			if t.end {
+				break
+			}
+			level := int(t.name[1] - '0')
+			if lastLevel > 0 && level > lastLevel+1 {
+				report("heading-order", "<%s> follows <h%d>, skipping a level", t.name, lastLevel)
+			}
+			lastLevel = level
+		}
+	}, func(text string) {
+		if button != nil && strings.TrimSpace(text) != "" {
+			named = true
+		}
+	})
+	for _, t := range unlabelled {
+		if id := t.attrs["id"]; id == "" || !labelFor[id] {
+			report("label", "%s has no label", describe(t))
+		}
+	}
+	return problems
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestAuditHTML(t *testing.T) {
+	tests := []struct {
+		name, page string
+		want       []string // rules broken
+	}{
+		{"clean", `<html lang="en"><h1>A</h1><h2>B</h2><label for="q">Q</label><input id="q"><button>Go</button></html>`, nil},
+		{"img without alt", `<html lang="en"><img src="a.png"></html>`, []string{"img-alt"}},
+		{"decorative img", `<html lang="en"><img src="a.png" alt=""></html>`, nil},
+		{"unlabelled input", `<html lang="en"><input name="q"></html>`, []string{"label"}},
+		{"label after input", `<html lang="en"><input id="q"><label for="q">Q</label></html>`, nil},
+		{"wrapped input", `<html lang="en"><label><input type="checkbox"> Q</label></html>`, nil},
+		{"aria-label", `<html lang="en"><select aria-label="Q"></select></html>`, nil},
+		{"hidden input", `<html lang="en"><input type="hidden" name="q"></html>`, nil},
+		{"empty button", `<html lang="en"><button><i class="glyphicon"></i></button></html>`, []string{"button-name"}},
+		{"skipped heading", `<html lang="en"><h2>A</h2><h4>B</h4><h3>C</h3></html>`, []string{"heading-order"}},
+		{"no lang", `<html><p>A</p></html>`, []string{"html-lang"}},
+		{"script ignored", `<html lang="en"><script>if (a <img) {}</script></html>`, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, p := range auditHTML(tt.page) {
+				got = append(got, p.Rule)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("auditHTML() = %v, want rules %v", auditHTML(tt.page), tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("auditHTML() = %v, want rules %v", auditHTML(tt.page), tt.want)
+				}
+			}
+		})
+	}
+}
+
+// TestPagesAccessible renders each page, as an admin so that admin-only
+// parts are included, and fails on the problems auditHTML finds.
+func TestPagesAccessible(t *testing.T) {
+	shelf, db := newTestShelf(t, withAdmin("admin@example.com"), withAllDatabases())
+	ctx := context.Background()
+	if _, err := db.AddLocation(ctx, &Location{Name: "Kitchen", Timezone: "UTC"}); err != nil {
+		t.Fatal(err)
+	}
+	id, err := db.AddTreat(ctx, &Treat{
+		Title:       "Brownie",
+		Author:      "Erica",
+		AltText:     "A square of fudge brownie",
+		ImageURL:    "https://example.com/brownie.jpg",
+		Quantity:    intp(3),
+		Price:       &Price{Amount: 250, Currency: "USD"},
+		Nutrition:   &Nutrition{ServingSize: 50, Calories: 200},
+		Allergens:   []string{"eggs"},
+		Tags:        []string{"chocolate"},
+		LocationID:  "1",
+		Description: "Fudgy.",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pages := []struct {
+		name string
+		h    appHandler
+	}{
+		{"list", shelf.listHandler},
+		{"detail", shelf.detailHandler},
+		{"add", shelf.addFormHandler},
+		{"edit", shelf.editFormHandler},
+		{"about", shelf.addAboutHandler},
+		{"locations", shelf.locationsHandler},
+		{"settings", shelf.settingsHandler},
+		{"tokens", shelf.tokensHandler},
+		{"profile", shelf.profileHandler},
+		{"signIns", shelf.signInsHandler},
+		{"allTreats", shelf.allTreatsHandler},
+		{"tags", shelf.tagsAdminHandler},
+		{"dashboard", shelf.dashboardHandler},
+		{"review", shelf.reviewQueueHandler},
+		{"offline", shelf.offlineHandler},
+	}
+	for _, p := range pages {
+		t.Run(p.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.Header.Set(iapEmailHeader, "accounts.google.com:admin@example.com")
+			r = mux.SetURLVars(r, map[string]string{"id": id})
+			w := httptest.NewRecorder()
+			p.h.ServeHTTP(w, r)
+			if w.Code != 200 {
+				t.Fatalf("status %d: %s", w.Code, w.Body)
+			}
+			for _, problem := range auditHTML(w.Body.String()) {
+				t.Error(problem)
+			}
+		})
+	}
+}
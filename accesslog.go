@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/handlers"
+	"github.com/gorilla/mux"
+)
+
+// AccessLog configures request logging, see logRequests.
+type AccessLog struct {
+	// Apache logs requests in the Apache combined format rather than as
+	// Cloud Logging structured entries (ACCESS_LOG_FORMAT=apache).
+	Apache bool
+
+	// SampleRate is the fraction of successful requests to log, between 0
+	// and 1 (ACCESS_LOG_SAMPLE). Requests that fail are always logged.
+	SampleRate float64
+}
+
+// defaultAccessLog logs every request as a structured entry.
+var defaultAccessLog = AccessLog{SampleRate: 1}
+
+// accessLogEntry is a Cloud Logging structured log entry for a request. See
+// https://cloud.google.com/logging/docs/structured-logging.
+type accessLogEntry struct {
+	Severity    string          `json:"severity"`
+	Message     string          `json:"message"`
+	HTTPRequest accessLogRecord `json:"httpRequest"`
+	Trace       string          `json:"logging.googleapis.com/trace,omitempty"`
+	RequestID   string          `json:"requestId"`
+	Route       string          `json:"route,omitempty"`
+	User        string          `json:"user,omitempty"`
+	Instance    string          `json:"instance,omitempty"`
+}
+
+// accessLogRecord is the HttpRequest part of an accessLogEntry.
+type accessLogRecord struct {
+	RequestMethod string `json:"requestMethod"`
+	RequestURL    string `json:"requestUrl"`
+	Status        int    `json:"status"`
+	ResponseSize  int64  `json:"responseSize,string"`
+	UserAgent     string `json:"userAgent,omitempty"`
+	RemoteIP      string `json:"remoteIp,omitempty"`
+	Referer       string `json:"referer,omitempty"`
+	Latency       string `json:"latency"`
+}
+
+// loggingResponseWriter records the status and size of a response.
+type loggingResponseWriter struct {
+	http.ResponseWriter
+	status int
+	size   int64
+}
+
+func (lw *loggingResponseWriter) WriteHeader(code int) {
+	if lw.status == 0 {
+		lw.status = code
+	}
+	lw.ResponseWriter.WriteHeader(code)
+}
+
+func (lw *loggingResponseWriter) Write(b []byte) (int, error) {
+	if lw.status == 0 {
+		lw.status = http.StatusOK
+	}
+	n, err := lw.ResponseWriter.Write(b)
+	lw.size += int64(n)
+	return n, err
+}
+
+// Flush lets streaming handlers flush through the logger.
+func (lw *loggingResponseWriter) Flush() {
+	if f, ok := lw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// routeKey is the context key for the *string that recordRoute fills in.
+type routeKey struct{}
+
+// recordRoute is mux middleware that tells logRequests which route served
+// the request: its name if it has one, or else its path template. It must
+// run inside the router, where mux.CurrentRoute is set.
+func recordRoute(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if p, ok := r.Context().Value(routeKey{}).(*string); ok {
+			if route := mux.CurrentRoute(r); route != nil {
+				*p = route.GetName()
+				if *p == "" {
+					*p, _ = route.GetPathTemplate()
+				}
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// logRequests wraps h to log requests to t.logWriter, as configured by
+// t.accessLog. Use recordRoute in the router to log route names.
+func (t *Treatshelf) logRequests(h http.Handler) http.Handler {
+	if t.accessLog.Apache {
+		return handlers.CombinedLoggingHandler(t.logWriter, h)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Fix the request ID now, so that error responses and reports use
+		// the same one as the log.
+		id := requestID(r)
+		if r.Header.Get("X-Cloud-Trace-Context") == "" {
+			r.Header.Set("X-Request-Id", id)
+		}
+		var route string
+		r = r.WithContext(context.WithValue(r.Context(), routeKey{}, &route))
+
+		start := time.Now()
+		lw := &loggingResponseWriter{ResponseWriter: w}
+		h.ServeHTTP(lw, r)
+		latency := time.Since(start)
+
+		if lw.status == 0 {
+			lw.status = http.StatusOK
+		}
+		if lw.status < 400 && rand.Float64() >= t.accessLog.SampleRate {
+			return
+		}
+		t.writeAccessLog(r, id, route, lw, latency)
+	})
+}
+
+// writeAccessLog writes the structured log entry for a request.
+func (t *Treatshelf) writeAccessLog(r *http.Request, id, route string, lw *loggingResponseWriter, latency time.Duration) {
+	e := accessLogEntry{
+		Severity: "INFO",
+		Message:  fmt.Sprintf("%s %s %d", r.Method, r.URL.RequestURI(), lw.status),
+		HTTPRequest: accessLogRecord{
+			RequestMethod: r.Method,
+			RequestURL:    r.URL.RequestURI(),
+			Status:        lw.status,
+			ResponseSize:  lw.size,
+			UserAgent:     r.UserAgent(),
+			RemoteIP:      remoteIP(r),
+			Referer:       r.Referer(),
+			Latency:       fmt.Sprintf("%.3fs", latency.Seconds()),
+		},
+		RequestID: id,
+		Route:     route,
+		User:      t.currentUser(r),
+		Instance:  t.instance,
+	}
+	switch {
+	case lw.status >= 500:
+		e.Severity = "ERROR"
+	case lw.status >= 400:
+		e.Severity = "WARNING"
+	}
+	if r.Header.Get("X-Cloud-Trace-Context") != "" && t.projectID != "" {
+		e.Trace = "projects/" + t.projectID + "/traces/" + id
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		fmt.Fprintf(t.logWriter, "Could not log request: %v\n", err)
+		return
+	}
+	t.logWriter.Write(append(b, '\n'))
+}
+
+// remoteIP returns the client's address, as forwarded by the App Engine
+// front end if there is one. The front end appends the address it saw to
+// X-Forwarded-For, after any the client sent, so only the last is
+// trusted.
+func remoteIP(r *http.Request) string {
+	if f := r.Header.Get("X-Forwarded-For"); f != "" {
+		return strings.TrimSpace(f[strings.LastIndex(f, ",")+1:])
+	}
+	if i := strings.LastIndex(r.RemoteAddr, ":"); i >= 0 {
+		return r.RemoteAddr[:i]
+	}
+	return r.RemoteAddr
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// The app watches its own error rate and latency, as countRequests
+// measures them, and notifies (see notify.go) when either crosses a
+// threshold:
+//
+//	ALERT_ERROR_RATE=0.05    // more than 5% of requests fail with a 5xx.
+//	ALERT_P95_LATENCY=2500ms // more than 5% of requests take over 2.5s.
+//	ALERT_COOLDOWN=30m       // at most one alert of each kind per 30m.
+//
+// The latency threshold must be one of latencyBounds, so that requests
+// can be counted exactly rather than estimated from the histogram. Both
+// are measured over the last alertWindow of requests to this
+// instance, and only once there have been alertMinRequests, so that one
+// failure on a quiet night doesn't page anyone. There are no alerts unless
+// a threshold is set.
+
+// Bounds of the request window and alerting loop.
+const (
+	alertWindow          = 5 * time.Minute
+	alertWindowBuckets   = 10
+	alertInterval        = 30 * time.Second
+	alertMinRequests     = 20
+	defaultAlertCooldown = 30 * time.Minute
+)
+
+// latencyBounds are the upper bounds of the latency histogram of a
+// requestWindow. Latencies beyond the last fall in one more bucket.
+var latencyBounds = []time.Duration{
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+	30 * time.Second,
+}
+
+// alertConfig holds the thresholds set by the ALERT_ variables above.
+// Zero thresholds are off.
+type alertConfig struct {
+	ErrorRate float64
+	// P95 is one of latencyBounds.
+	P95      time.Duration
+	Cooldown time.Duration
+}
+
+// requestWindow counts requests, failures and latencies over a rolling
+// window, in a ring of buckets each covering an equal span of time.
+type requestWindow struct {
+	mu      sync.Mutex
+	span    time.Duration
+	buckets []requestBucket
+}
+
+// requestBucket counts the requests that started in one span of a
+// requestWindow.
+type requestBucket struct {
+	start    time.Time
+	requests int
+	errors   int
+	latency  []int // by latencyBounds.
+}
+
+// newRequestWindow returns a requestWindow over window, in n buckets.
+func newRequestWindow(window time.Duration, n int) *requestWindow {
+	return &requestWindow{span: window / time.Duration(n), buckets: make([]requestBucket, n)}
+}
+
+// observe counts a request answered at now with status after latency.
+// Statuses of 500 and above are failures.
+func (w *requestWindow) observe(now time.Time, status int, latency time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	start := now.Truncate(w.span)
+	b := &w.buckets[int(start.UnixNano()/int64(w.span))%len(w.buckets)]
+	if !b.start.Equal(start) {
+		*b = requestBucket{start: start, latency: make([]int, len(latencyBounds)+1)}
+	}
+	b.requests++
+	if status >= 500 {
+		b.errors++
+	}
+	i := 0
+	for i < len(latencyBounds) && latency > latencyBounds[i] {
+		i++
+	}
+	b.latency[i]++
+}
+
+// requestSummary sums the buckets of a requestWindow.
+type requestSummary struct {
+	Requests int
+	Errors   int
+	latency  []int
+}
+
+// summary sums the buckets of the window ending at now.
+func (w *requestWindow) summary(now time.Time) requestSummary {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	s := requestSummary{latency: make([]int, len(latencyBounds)+1)}
+	oldest := now.Truncate(w.span).Add(-w.span * time.Duration(len(w.buckets)-1))
+	for _, b := range w.buckets {
+		if b.start.Before(oldest) || b.start.After(now) {
+			continue
+		}
+		s.Requests += b.requests
+		s.Errors += b.errors
+		for i, n := range b.latency {
+			s.latency[i] += n
+		}
+	}
+	return s
+}
+
+// errorRate returns the fraction of requests that failed.
+func (s requestSummary) errorRate() float64 {
+	if s.Requests == 0 {
+		return 0
+	}
+	return float64(s.Errors) / float64(s.Requests)
+}
+
+// latencyBound returns the index of d in latencyBounds, or -1.
+func latencyBound(d time.Duration) int {
+	for i, b := range latencyBounds {
+		if b == d {
+			return i
+		}
+	}
+	return -1
+}
+
+// slowerThan returns how many requests took longer than d, which must be
+// one of latencyBounds.
+func (s requestSummary) slowerThan(d time.Duration) int {
+	n := 0
+	for _, c := range s.latency[latencyBound(d)+1:] {
+		n += c
+	}
+	return n
+}
+
+// runAlerts checks the thresholds every alertInterval until ctx is done.
+func (t *Treatshelf) runAlerts(ctx context.Context) {
+	for {
+		select {
+		case <-t.after(alertInterval):
+		case <-ctx.Done():
+			return
+		}
+		t.checkAlerts(ctx)
+	}
+}
+
+// checkAlerts notifies of the thresholds the requests of the window cross,
+// unless they were notified of within the cooldown.
+func (t *Treatshelf) checkAlerts(ctx context.Context) {
+	now := t.now()
+	s := t.requests.summary(now)
+	if s.Requests < alertMinRequests {
+		return
+	}
+	if rate := s.errorRate(); t.alerts.ErrorRate > 0 && rate > t.alerts.ErrorRate {
+		t.alert(ctx, now, "error rate", fmt.Sprintf("%.1f%% of the last %d requests failed, over the threshold of %.1f%%.",
+			100*rate, s.Requests, 100*t.alerts.ErrorRate))
+	}
+	// The 95th percentile is over the threshold when more than 5% of
+	// requests are.
+	if slow := s.slowerThan(t.alerts.P95); t.alerts.P95 > 0 && slow*20 > s.Requests {
+		t.alert(ctx, now, "latency", fmt.Sprintf("%d of the last %d requests took over %v, so the 95th percentile latency is over the threshold.",
+			slow, s.Requests, t.alerts.P95))
+	}
+}
+
+// alert notifies of an alert of kind, unless one was sent within the
+// cooldown.
+func (t *Treatshelf) alert(ctx context.Context, now time.Time, kind, body string) {
+	if last, ok := t.alerted[kind]; ok && now.Sub(last) < t.alerts.Cooldown {
+		return
+	}
+	if err := t.notifier.Notify(ctx, "Alert: "+kind, body); err != nil {
+		fmt.Fprintf(t.logWriter, "Could not send %s alert: %v\n", kind, err)
+		return
+	}
+	if t.alerted == nil {
+		t.alerted = make(map[string]time.Time)
+	}
+	t.alerted[kind] = now
+}
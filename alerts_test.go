@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestRequestWindow(t *testing.T) {
+	w := newRequestWindow(alertWindow, alertWindowBuckets)
+	now := testEpoch
+	for i := 0; i < 90; i++ {
+		w.observe(now, 200, 20*time.Millisecond)
+	}
+	for i := 0; i < 10; i++ {
+		w.observe(now, 503, 3*time.Second)
+	}
+	s := w.summary(now)
+	if s.Requests != 100 || s.errorRate() != 0.1 {
+		t.Errorf("summary = %+v, want 100 requests, 10%% failed", s)
+	}
+	if n := s.slowerThan(25 * time.Millisecond); n != 10 {
+		t.Errorf("slowerThan(25ms) = %d, want 10", n)
+	}
+	if n := s.slowerThan(2500 * time.Millisecond); n != 10 {
+		t.Errorf("slowerThan(2.5s) = %d, want 10", n)
+	}
+	if n := s.slowerThan(5 * time.Second); n != 0 {
+		t.Errorf("slowerThan(5s) = %d, want 0", n)
+	}
+
+	// Requests drop out of the window as it moves on.
+	later := now.Add(alertWindow)
+	w.observe(later, 200, time.Millisecond)
+	if s := w.summary(later); s.Requests != 1 {
+		t.Errorf("summary after the window = %+v, want 1 request", s)
+	}
+}
+
+func TestCheckAlerts(t *testing.T) {
+	var log bytes.Buffer
+	c := newFakeClock()
+	shelf := &Treatshelf{
+		clock:    c,
+		notifier: &logNotifier{w: &log},
+		requests: newRequestWindow(alertWindow, alertWindowBuckets),
+		alerts:   alertConfig{ErrorRate: 0.05, P95: time.Second, Cooldown: 10 * time.Minute},
+	}
+	ctx := context.Background()
+	for i := 0; i < alertMinRequests; i++ {
+		shelf.requests.observe(c.Now(), 500, 10*time.Millisecond)
+	}
+	shelf.checkAlerts(ctx)
+	if got := log.String(); !strings.Contains(got, "Alert: error rate") || strings.Contains(got, "Alert: latency") {
+		t.Fatalf("got notifications %q, want an error rate alert only", got)
+	}
+
+	// Within the cooldown, the alert isn't repeated.
+	log.Reset()
+	c.Advance(time.Minute)
+	shelf.requests.observe(c.Now(), 500, 10*time.Millisecond)
+	shelf.checkAlerts(ctx)
+	if log.Len() != 0 {
+		t.Errorf("got notifications %q within the cooldown, want none", log.String())
+	}
+
+	c.Advance(10 * time.Minute)
+	for i := 0; i < alertMinRequests; i++ {
+		shelf.requests.observe(c.Now(), 500, 10*time.Millisecond)
+	}
+	shelf.checkAlerts(ctx)
+	if !strings.Contains(log.String(), "Alert: error rate") {
+		t.Errorf("got notifications %q after the cooldown, want an error rate alert", log.String())
+	}
+}
+
+func TestLatencyAlert(t *testing.T) {
+	var log bytes.Buffer
+	c := newFakeClock()
+	shelf := &Treatshelf{
+		clock:    c,
+		notifier: &logNotifier{w: &log},
+		requests: newRequestWindow(alertWindow, alertWindowBuckets),
+		alerts:   alertConfig{P95: time.Second},
+	}
+	// At most 5% of requests over the threshold is within it, however slow
+	// they were.
+	for i := 0; i < 95; i++ {
+		shelf.requests.observe(c.Now(), 200, 100*time.Millisecond)
+	}
+	for i := 0; i < 5; i++ {
+		shelf.requests.observe(c.Now(), 200, 20*time.Second)
+	}
+	shelf.checkAlerts(context.Background())
+	if log.Len() != 0 {
+		t.Fatalf("got notifications %q, want none", log.String())
+	}
+	shelf.requests.observe(c.Now(), 200, 1100*time.Millisecond)
+	shelf.checkAlerts(context.Background())
+	if !strings.Contains(log.String(), "Alert: latency") {
+		t.Errorf("got notifications %q, want a latency alert", log.String())
+	}
+}
+
+func TestCountRequestsSkipsStreams(t *testing.T) {
+	shelf := &Treatshelf{
+		clock:    newFakeClock(),
+		requests: newRequestWindow(alertWindow, alertWindowBuckets),
+	}
+	r := mux.NewRouter()
+	r.Use(shelf.countRequests)
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	r.Path("/events").Handler(ok).Name("events")
+	r.Path("/treats").Handler(ok).Name("treats")
+	for _, path := range []string{"/events", "/treats"} {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+	if s := shelf.requests.summary(shelf.now()); s.Requests != 1 {
+		t.Errorf("summary = %+v, want only the request to /treats", s)
+	}
+}
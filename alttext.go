@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Pictures are described by their treat's AltText, which screen readers
+// read in their place, and may have a Caption, which everyone sees under
+// them. Pictures that add nothing to the title may go undescribed, unless
+// REQUIRE_ALT_TEXT=true, when the edit form refuses pictures uploaded
+// without a description.
+//
+// Treats added before then can be given a description by the alttext
+// operation, which describes each picture without one by its treat's
+// title. That is a placeholder, better than nothing for a screen reader,
+// until someone describes the picture properly.
+
+// errAltTextRequired is returned for pictures uploaded without a
+// description when requireAltText is set.
+var errAltTextRequired = errors.New("describe the picture for people using screen readers")
+
+// checkAltText returns errAltTextRequired if t requires descriptions and
+// r, an edit form, uploads a picture without one. It is checked before
+// the picture is stored.
+func (t *Treatshelf) checkAltText(r *http.Request) error {
+	if !t.requireAltText || strings.TrimSpace(r.FormValue("altText")) != "" {
+		return nil
+	}
+	f, _, err := r.FormFile("image")
+	if err != nil {
+		// No picture, or one uploadPictureFromForm will report.
+		return nil
+	}
+	f.Close()
+	return errAltTextRequired
+}
+
+// placeholderAltText returns the description backfillAltText gives the
+// picture of treat.
+func placeholderAltText(treat *Treat) string {
+	alt := "Picture of " + treat.Title
+	if r := []rune(alt); len(r) > maxAltText {
+		alt = string(r[:maxAltText])
+	}
+	return alt
+}
+
+// backfillAltText gives each treat with a picture but no AltText a
+// placeholder description, maxBatchWrites at a time.
+func (t *Treatshelf) backfillAltText(ctx context.Context, run *operationRun) error {
+	treats, err := t.DB.ListTreats(ctx, allTreatsOptions)
+	if err != nil {
+		return fmt.Errorf("ListTreats: %v", err)
+	}
+	run.setTotal(len(treats))
+	described := 0
+	var batch []*Treat
+	flush := func(handled int) error {
+		if len(batch) > 0 {
+			if err := t.DB.SaveTreats(ctx, batch); err != nil {
+				return fmt.Errorf("described %d pictures: SaveTreats: %v", described, err)
+			}
+			described += len(batch)
+			batch = nil
+		}
+		run.processed(handled)
+		return nil
+	}
+	handled := 0
+	for _, treat := range treats {
+		if treat.ImageURL != "" && treat.AltText == "" {
+			treat.AltText = placeholderAltText(treat)
+			batch = append(batch, treat)
+		}
+		handled++
+		if len(batch) == maxBatchWrites || handled == maxBatchWrites {
+			if err := flush(handled); err != nil {
+				return err
+			}
+			handled = 0
+		}
+	}
+	if err := flush(handled); err != nil {
+		return err
+	}
+	run.setResult("Described %d of %d treats' pictures.", described, len(treats))
+	return nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"mime/multipart"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCheckAltText(t *testing.T) {
+	shelf := &Treatshelf{requireAltText: true}
+	form := func(altText string, picture bool) error {
+		var body bytes.Buffer
+		w := multipart.NewWriter(&body)
+		w.WriteField("altText", altText)
+		if picture {
+			f, err := w.CreateFormFile("image", "cake.png")
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.Write(testPNG(t, 2, 2))
+		}
+		w.Close()
+		r := httptest.NewRequest("POST", "/treats", &body)
+		r.Header.Set("Content-Type", w.FormDataContentType())
+		return shelf.checkAltText(r)
+	}
+	if err := form(" ", true); err != errAltTextRequired {
+		t.Errorf("picture without a description: got %v, want errAltTextRequired", err)
+	}
+	if err := form("A slice of cake", true); err != nil {
+		t.Errorf("described picture: %v", err)
+	}
+	if err := form("", false); err != nil {
+		t.Errorf("no picture: %v", err)
+	}
+	shelf.requireAltText = false
+	if err := form("", true); err != nil {
+		t.Errorf("descriptions not required: %v", err)
+	}
+}
+
+func TestBackfillAltText(t *testing.T) {
+	shelf := goldenShelf(t)
+	ctx := context.Background()
+	run := &operationRun{}
+	if err := shelf.backfillAltText(ctx, run); err != nil {
+		t.Fatal(err)
+	}
+	treats, err := shelf.DB.ListTreats(ctx, allTreatsOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, treat := range treats {
+		if treat.ImageURL != "" && treat.AltText == "" {
+			t.Errorf("treat %s: picture still undescribed", treat.ID)
+		}
+		if treat.ImageURL == "" && treat.AltText != "" {
+			t.Errorf("treat %s: described a missing picture as %q", treat.ID, treat.AltText)
+		}
+	}
+	if run.op.Processed != len(treats) {
+		t.Errorf("processed %d of %d treats", run.op.Processed, len(treats))
+	}
+}
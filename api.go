@@ -0,0 +1,304 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// registerAPIHandlers adds the JSON API under /api/v1 and its later
+// versions (see apiversion.go) to r.
+//
+// The API exchanges Treats as JSON objects with the same field names as the
+// Treat struct. Writes accept an Idempotency-Key header (see idempotency.go),
+// and writes of a single treat an If-Match header with its ETag (see
+// conditional.go). Requests may be made with a personal API token (see
+// tokens.go).
+// The API is described in openapi.yaml; keep it in sync with these routes
+// (openapi_test.go checks the routes and the Treat schema).
+func (t *Treatshelf) registerAPIHandlers(r *mux.Router) {
+	// Describe the API for integrators, see openapi.yaml.
+	static := withCache(cacheStatic)
+	r.Methods("GET").Path("/api/openapi.yaml").
+		Handler(static(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/yaml")
+			http.ServeFile(w, r, "openapi.yaml")
+		}))).Name("openAPI")
+	r.Methods("GET").Path("/api/docs").
+		Handler(static(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.ServeFile(w, r, "templates/apidocs.html")
+		}))).Name("apiDocs")
+	// The JSON Schemas request bodies are checked against, see schema.go.
+	r.Methods("GET").Path("/api/schemas/{name:[a-z\\-]+}.json").
+		Handler(static(appHandler(t.apiSchemaHandler))).Name("apiSchema")
+
+	for _, v := range apiVersions {
+		t.registerAPIVersion(r, v)
+	}
+}
+
+// registerAPIVersion adds version v of the JSON API to r, see apiversion.go.
+func (t *Treatshelf) registerAPIVersion(r *mux.Router, v *apiVersion) {
+	api := r.PathPrefix("/api/" + v.Name).Subrouter()
+	api.Use(t.withAPIVersion(v), t.apiTokens, t.authorize(v.policy(apiRoutePolicy), nil))
+
+	api.Methods("GET").Path("/treats").
+		Handler(appHandler(t.apiListHandler)).Name(v.routeName("apiListTreats"))
+	api.Methods("GET").Path("/treats:window").
+		Handler(appHandler(t.apiWindowHandler)).Name(v.routeName("apiWindowTreats"))
+	api.Methods("GET").Path("/treats/{id:[0-9a-zA-Z_\\-]+}").
+		Handler(appHandler(t.apiGetHandler)).Name(v.routeName("apiGetTreat"))
+	api.Methods("POST").Path("/treats").
+		Handler(t.idempotent(appHandler(t.apiCreateHandler))).Name(v.routeName("apiCreateTreat"))
+	api.Methods("POST").Path("/treats:batchCreate").
+		Handler(t.idempotent(appHandler(t.apiBatchCreateHandler))).Name(v.routeName("apiBatchCreateTreats"))
+	api.Methods("POST").Path("/treats:batchUpdate").
+		Handler(t.idempotent(appHandler(t.apiBatchUpdateHandler))).Name(v.routeName("apiBatchUpdateTreats"))
+	api.Methods("PUT").Path("/treats/{id:[0-9a-zA-Z_\\-]+}").
+		Handler(t.idempotent(appHandler(t.apiUpdateHandler))).Name(v.routeName("apiUpdateTreat"))
+	api.Methods("PATCH").Path("/treats/{id:[0-9a-zA-Z_\\-]+}").
+		Handler(t.idempotent(appHandler(t.apiPatchHandler))).Name(v.routeName("apiPatchTreat"))
+	api.Methods("DELETE").Path("/treats/{id:[0-9a-zA-Z_\\-]+}").
+		Handler(appHandler(t.apiDeleteHandler)).Name(v.routeName("apiDeleteTreat"))
+	api.Methods("GET").Path("/commands").
+		Handler(appHandler(t.apiCommandsHandler)).Name(v.routeName("apiCommands"))
+	api.Methods("DELETE").Path("/recent").
+		Handler(appHandler(t.apiClearRecentHandler)).Name(v.routeName("apiClearRecent"))
+
+	// Smart shelves, see shelves.go.
+	shelves := api.PathPrefix("/shelves").Subrouter()
+	shelves.Use(guard(t.requireSavedSearches))
+	shelves.Methods("GET").Path("").
+		Handler(appHandler(t.apiListShelvesHandler)).Name(v.routeName("apiListShelves"))
+	shelves.Methods("POST").Path("").
+		Handler(appHandler(t.apiCreateShelfHandler)).Name(v.routeName("apiCreateShelf"))
+	shelves.Methods("GET").Path("/{id:[0-9a-zA-Z_\\-]+}/treats").
+		Handler(appHandler(t.apiShelfTreatsHandler)).Name(v.routeName("apiShelfTreats"))
+	shelves.Methods("DELETE").Path("/{id:[0-9a-zA-Z_\\-]+}").
+		Handler(appHandler(t.apiDeleteShelfHandler)).Name(v.routeName("apiDeleteShelf"))
+
+	// Statistics for admins, see stats.go.
+	api.Methods("GET").Path("/stats").
+		Handler(guard(t.requireStats)(appHandler(t.apiStatsHandler))).Name(v.routeName("apiStats"))
+
+	// Long-running operations, see operations.go.
+	ops := guard(t.requireOperations)
+	api.Methods("POST").Path("/treats:import").
+		Handler(ops(t.idempotent(t.apiStartOperationHandler(opImport)))).Name(v.routeName("apiImportTreats"))
+	api.Methods("POST").Path("/treats:reindex").
+		Handler(ops(t.idempotent(t.apiStartOperationHandler(opReindex)))).Name(v.routeName("apiReindexTreats"))
+	api.Methods("POST").Path("/treats:backup").
+		Handler(ops(t.idempotent(t.apiStartOperationHandler(opBackup)))).Name(v.routeName("apiBackupTreats"))
+	api.Methods("POST").Path("/treats:backfillAltText").
+		Handler(ops(t.idempotent(t.apiStartOperationHandler(opAltText)))).Name(v.routeName("apiBackfillAltText"))
+	api.Methods("GET").Path("/operations").
+		Handler(ops(appHandler(t.apiListOperationsHandler))).Name(v.routeName("apiListOperations"))
+	api.Methods("GET").Path("/operations/{id:[0-9a-zA-Z_\\-]+}").
+		Handler(ops(appHandler(t.apiGetOperationHandler))).Name(v.routeName("apiGetOperation"))
+}
+
+// Bounds for the pageSize parameter of list calls.
+const (
+	defaultAPIPageSize = 50
+	maxAPIPageSize     = 200
+)
+
+// writeJSON writes v as the JSON response body with the given status code.
+func writeJSON(w http.ResponseWriter, code int, v interface{}) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	return json.NewEncoder(w).Encode(v)
+}
+
+// apiListHandler lists a page of treats, accepting the same query parameters
+// as the list page, "fields" (see fields.go) and the paging parameters
+// described in paging.go. The Link header points to the pages around it.
+func (t *Treatshelf) apiListHandler(w http.ResponseWriter, r *http.Request) *appError {
+	fields, err := fieldsFromRequest(r)
+	if err != nil {
+		return t.appErrorCodef(r, http.StatusBadRequest, err, "%v", err)
+	}
+	opts, err := t.listOptionsFromRequest(r, t.preferences(r))
+	if err != nil {
+		return t.appErrorCodef(r, http.StatusBadRequest, err, "invalid list options: %v", err)
+	}
+	treats, err := t.DB.ListTreats(r.Context(), opts)
+	if err != nil {
+		return t.appErrorf(r, err, "could not list treats: %v", err)
+	}
+	return t.writeTreatPage(w, r, treats, fields)
+}
+
+// apiGetHandler returns a given treat, or the "fields" of it asked for,
+// with its ETag (see conditional.go).
+func (t *Treatshelf) apiGetHandler(w http.ResponseWriter, r *http.Request) *appError {
+	fields, err := fieldsFromRequest(r)
+	if err != nil {
+		return t.appErrorCodef(r, http.StatusBadRequest, err, "%v", err)
+	}
+	treat, e := t.visibleTreat(r)
+	if e != nil {
+		return e
+	}
+	setETag(w, treat)
+	if notModified(r, treat) {
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+	v, err := sparseTreat(apiVersionOf(r), treat, fields)
+	if err != nil {
+		return t.appErrorf(r, err, "could not select fields: %v", err)
+	}
+	writeJSON(w, http.StatusOK, v)
+	return nil
+}
+
+// visibleTreat returns the treat named by r's "id" variable, or a 404
+// appError if it doesn't exist or r may not see it.
+func (t *Treatshelf) visibleTreat(r *http.Request) (*Treat, *appError) {
+	treat, err := t.treatFromRequest(r)
+	if err != nil {
+		return nil, t.appErrorCodef(r, http.StatusNotFound, err, "%v", err)
+	}
+	if (!treat.VisibleAt(t.now()) && !t.previewing(r)) || !t.maySee(r, treat) {
+		err := fmt.Errorf("treat %q is not visible", treat.ID)
+		return nil, t.appErrorCodef(r, http.StatusNotFound, err, "%v", err)
+	}
+	return treat, nil
+}
+
+// treatFromJSON decodes a Treat from the request body, checked against
+// treatSchema, and validates it as the edit form does. Fields the server
+// maintains are cleared; Archived is set only when the treat expires, so
+// the handlers fill it in.
+func (t *Treatshelf) treatFromJSON(r *http.Request) (*Treat, *appError) {
+	treat := &Treat{}
+	if e := t.decodeJSON(r, treatSchema, treat); e != nil {
+		return nil, e
+	}
+	if err := checkAPITreat(treat); err != nil {
+		return nil, t.appErrorCodef(r, http.StatusBadRequest, err, "%v", err)
+	}
+	return treat, nil
+}
+
+// checkAPITreat validates a treat decoded from an API request, as
+// treatFromJSON describes.
+func checkAPITreat(treat *Treat) error {
+	if treat.Title == "" {
+		return errors.New("title is required")
+	}
+	if err := treat.validate(); err != nil {
+		return err
+	}
+	treat.Archived = false
+	treat.DeletedAt, treat.UndoToken = time.Time{}, ""
+	treat.Review, treat.ReviewReason = "", ""
+	return nil
+}
+
+// keepServerFields copies the fields the server maintains, which API
+// updates can't change, from old to treat.
+func keepServerFields(treat, old *Treat) {
+	treat.Archived = old.Archived
+	treat.CreatedBy = old.CreatedBy
+	treat.InternalNotes = old.InternalNotes
+	treat.Review, treat.ReviewReason = old.Review, old.ReviewReason
+	treat.Reports = old.Reports
+}
+
+// unarchive clears treat's Archived flag unless it is still expired at now,
+// so moving ExpiresAt into the future, or clearing it, brings an archived
+// treat back to lists.
+func unarchive(treat *Treat, now time.Time) {
+	if !treat.ExpiredAt(now) {
+		treat.Archived = false
+	}
+}
+
+// apiCreateHandler adds the treat in the request body and returns it.
+func (t *Treatshelf) apiCreateHandler(w http.ResponseWriter, r *http.Request) *appError {
+	if e := t.checkAPICaptcha(w, r); e != nil {
+		return e
+	}
+	treat, e := t.treatFromJSON(r)
+	if e != nil {
+		return e
+	}
+	treat.ID = ""
+	treat.CreatedBy = t.currentUser(r)
+	t.submitForReview(r, treat)
+	if _, err := t.DB.AddTreat(r.Context(), treat); err != nil {
+		return t.appErrorf(r, err, "could not save treat: %v", err)
+	}
+	w.Header().Set("Location", t.apiURL(r, "apiGetTreat", "id", treat.ID))
+	setETag(w, treat)
+	return t.writeTreat(w, r, http.StatusCreated, treat)
+}
+
+// apiUpdateHandler replaces a given treat with the one in the request body,
+// if it matches If-Match.
+func (t *Treatshelf) apiUpdateHandler(w http.ResponseWriter, r *http.Request) *appError {
+	old, err := t.treatFromRequest(r)
+	if err != nil {
+		return t.appErrorCodef(r, http.StatusNotFound, err, "%v", err)
+	}
+	// Fail early, before reading the body; ChangeTreat checks again.
+	if e := t.ifMatchError(r, t.ifMatch(r, old)); e != nil {
+		return e
+	}
+	treat, e := t.treatFromJSON(r)
+	if e != nil {
+		return e
+	}
+	treat.ID = old.ID
+	updated, err := t.DB.ChangeTreat(r.Context(), old.ID, func(current *Treat) ([]string, error) {
+		if err := t.ifMatch(r, current); err != nil {
+			return nil, err
+		}
+		keepServerFields(treat, current)
+		unarchive(treat, t.now())
+		t.submitForReview(r, treat)
+		*current = *treat
+		return nil, nil
+	})
+	if e := t.ifMatchError(r, err); e != nil {
+		return e
+	}
+	if err != nil {
+		return t.appErrorf(r, err, "UpdateTreat: %v", err)
+	}
+	setETag(w, updated)
+	return t.writeTreat(w, r, http.StatusOK, updated)
+}
+
+// apiDeleteHandler deletes a treat, if it matches If-Match. Like deletes
+// from the web UI, it can be undone from the list page until the undo
+// window has passed.
+func (t *Treatshelf) apiDeleteHandler(w http.ResponseWriter, r *http.Request) *appError {
+	treat, err := t.treatFromRequest(r)
+	if err != nil {
+		return t.appErrorCodef(r, http.StatusNotFound, err, "%v", err)
+	}
+	token := newUndoToken()
+	_, err = t.DB.ChangeTreat(r.Context(), treat.ID, func(current *Treat) ([]string, error) {
+		if err := t.ifMatch(r, current); err != nil {
+			return nil, err
+		}
+		current.DeletedAt, current.UndoToken = t.now(), token
+		return []string{"DeletedAt", "UndoToken"}, nil
+	})
+	if e := t.ifMatchError(r, err); e != nil {
+		return e
+	}
+	if err != nil {
+		return t.appErrorf(r, err, "DeleteTreat: %v", err)
+	}
+	t.schedulePurge()
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
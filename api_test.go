@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestPatchExpiryUnarchives(t *testing.T) {
+	tests := []struct {
+		name      string
+		expiresAt string
+		want      bool
+	}{
+		{"cleared", "", false},
+		{"future", testEpoch.Add(24 * time.Hour).Format(time.RFC3339), false},
+		{"still past", testEpoch.Add(-time.Hour).Format(time.RFC3339), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			shelf, db := newTestShelf(t)
+			ctx := context.Background()
+			err := db.UpdateTreat(ctx, &Treat{ID: "1", Title: "Brownie", ExpiresAt: testEpoch.Add(-2 * time.Hour), Archived: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			body := "{}"
+			if tt.expiresAt != "" {
+				body = `{"ExpiresAt": "` + tt.expiresAt + `"}`
+			}
+			r := httptest.NewRequest("PATCH", "/api/v1/treats/1?updateMask=ExpiresAt", strings.NewReader(body))
+			r.Header.Set("If-Match", "*")
+			r = mux.SetURLVars(r, map[string]string{"id": "1"})
+			if e := shelf.apiPatchHandler(httptest.NewRecorder(), r); e != nil {
+				t.Fatalf("PATCH failed: %d %s", e.code, e.message)
+			}
+			got, err := db.GetTreat(ctx, "1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Archived != tt.want {
+				t.Errorf("Archived = %v, want %v", got.Archived, tt.want)
+			}
+		})
+	}
+}
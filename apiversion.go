@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// The API is served in every version of apiVersions at once, under
+// /api/<version>, by the same handlers. A version is a set of differences
+// in what clients see, applied by its encodeTreat and by writeTreatPage, so
+// that handlers, and Treat itself, can change without breaking clients of
+// older versions: a change to Treat that would break them, such as
+// renaming a field, is undone in their encodeTreat.
+//
+// v2 differs from v1 in that
+//   - lists are always in the envelope v1 returns for ?envelope=1, see
+//     paging.go, and
+//   - unset Treat fields, such as zero times, are left out, as in proto3
+//     JSON, rather than sent as null, "" or 0001-01-01T00:00:00Z.
+//
+// Older versions are deprecated: their responses have a Deprecation
+// header, a Link to the same URL in the current version, and, once
+// API_SUNSET is set, a Sunset header with that date, after which they
+// answer 410 Gone.
+
+// apiVersion is a version of the API.
+type apiVersion struct {
+	Name string
+	// deprecated versions are answered with deprecation headers.
+	deprecated bool
+	// envelope wraps every list in a treatPage.
+	envelope bool
+	// omitEmpty leaves unset fields out of treats.
+	omitEmpty bool
+}
+
+var (
+	apiV1 = &apiVersion{Name: "v1", deprecated: true}
+	apiV2 = &apiVersion{Name: "v2", envelope: true, omitEmpty: true}
+
+	// apiVersions are the versions served, oldest first.
+	apiVersions = []*apiVersion{apiV1, apiV2}
+	// currentAPIVersion is the one deprecated versions point clients to.
+	currentAPIVersion = apiV2
+)
+
+// routeName returns the name of the route in version v of the API route
+// with the given name. v1's routes keep the names they had before there
+// were versions.
+func (v *apiVersion) routeName(name string) string {
+	if v == apiV1 {
+		return name
+	}
+	return name + strings.ToUpper(v.Name)
+}
+
+// policy returns apiRoutePolicy for the routes of version v.
+func (v *apiVersion) policy(policy map[string]Rule) map[string]Rule {
+	p := make(map[string]Rule, len(policy))
+	for name, rule := range policy {
+		p[v.routeName(name)] = rule
+	}
+	return p
+}
+
+// allVersionsPolicy returns apiRoutePolicy for the routes of every
+// version, which the app's router leaves to the API's.
+func allVersionsPolicy() map[string]Rule {
+	p := make(map[string]Rule)
+	for _, v := range apiVersions {
+		for name, rule := range v.policy(apiRoutePolicy) {
+			p[name] = rule
+		}
+	}
+	return p
+}
+
+// encodeTreat returns treat as version v represents it.
+func (v *apiVersion) encodeTreat(treat *Treat) (map[string]json.RawMessage, error) {
+	b, err := json.Marshal(treat)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+	if v.omitEmpty {
+		for k, raw := range m {
+			switch string(raw) {
+			case "null", `""`, "[]", "{}", "0", "false", `"0001-01-01T00:00:00Z"`:
+				delete(m, k)
+			}
+		}
+	}
+	return m, nil
+}
+
+// apiVersionKey is the context key of the API version of a request.
+type apiVersionKey struct{}
+
+// apiVersionOf returns the API version r was made to, v1 if it wasn't made
+// to the API.
+func apiVersionOf(r *http.Request) *apiVersion {
+	if v, ok := r.Context().Value(apiVersionKey{}).(*apiVersion); ok {
+		return v
+	}
+	return apiV1
+}
+
+// withAPIVersion returns mux middleware recording that requests were made
+// to version v, and adding deprecation headers if it is deprecated.
+func (t *Treatshelf) withAPIVersion(v *apiVersion) mux.MiddlewareFunc {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r = r.WithContext(context.WithValue(r.Context(), apiVersionKey{}, v))
+			if v.deprecated {
+				if !t.apiSunset.IsZero() && t.now().After(t.apiSunset) {
+					err := fmt.Errorf("API %s was retired on %s; use %s", v.Name, t.apiSunset.Format("2006-01-02"), currentAPIVersion.Name)
+					serveError(w, r, t.appErrorCodef(r, http.StatusGone, err, "%v", err).withProblemType("api-version-retired"))
+					return
+				}
+				w.Header().Set("Deprecation", "true")
+				if !t.apiSunset.IsZero() {
+					w.Header().Set("Sunset", t.apiSunset.UTC().Format(http.TimeFormat))
+				}
+				successor := strings.Replace(r.URL.Path, "/api/"+v.Name+"/", "/api/"+currentAPIVersion.Name+"/", 1)
+				w.Header().Add("Link", fmt.Sprintf("<%s>; rel=\"successor-version\"", successor))
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+// apiURL returns the URL of the named API route in the version r was made
+// to.
+func (t *Treatshelf) apiURL(r *http.Request, name string, pairs ...string) string {
+	return t.routeURL(apiVersionOf(r).routeName(name), pairs...)
+}
+
+// writeTreat writes treat as the API version r was made to represents it.
+func (t *Treatshelf) writeTreat(w http.ResponseWriter, r *http.Request, code int, treat *Treat) *appError {
+	v, err := sparseTreat(apiVersionOf(r), treat, nil)
+	if err != nil {
+		return t.appErrorf(r, err, "could not encode treat: %v", err)
+	}
+	writeJSON(w, code, v)
+	return nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+// The files in staticDir are served under names that include a hash of
+// their contents, such as static/app.1f2e3d4c.css, so that browsers and
+// proxies may keep them for a year: a deploy that changes a file changes
+// its URL. Templates link to them by their logical name with the asset
+// helper, {{asset "app.css"}}.
+//
+// The names come from the asset manifest, staticDir/assets.json, which
+// "asset-manifest" writes at build time. Without one, the files are hashed
+// at startup. Files are still served under their logical names, with
+// cacheStatic, for those whose URL mustn't change, such as the service
+// worker.
+
+// assetManifestFile is the asset manifest in staticDir.
+const assetManifestFile = "assets.json"
+
+// assetManifest maps the logical names of the files in staticDir to their
+// hashed names.
+type assetManifest map[string]string
+
+// buildAssetManifest hashes the files in dir.
+func buildAssetManifest(dir string) (assetManifest, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	m := make(assetManifest)
+	for _, fi := range files {
+		name := fi.Name()
+		if fi.IsDir() || name == assetManifestFile || strings.HasPrefix(name, ".") {
+			continue
+		}
+		b, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		m[name] = hashedAssetName(name, b)
+	}
+	return m, nil
+}
+
+// hashedAssetName returns name with the start of the SHA-256 of b before
+// its extension: app.css becomes app.1f2e3d4c.css.
+func hashedAssetName(name string, b []byte) string {
+	sum := sha256.Sum256(b)
+	ext := path.Ext(name)
+	return strings.TrimSuffix(name, ext) + "." + hex.EncodeToString(sum[:4]) + ext
+}
+
+// loadAssetManifest reads the asset manifest in dir, or builds one if
+// there is none.
+func loadAssetManifest(dir string) (assetManifest, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, assetManifestFile))
+	if os.IsNotExist(err) {
+		return buildAssetManifest(dir)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var m assetManifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("%s: %v", assetManifestFile, err)
+	}
+	return m, nil
+}
+
+// writeAssetManifest builds the asset manifest of dir and writes it there,
+// for "asset-manifest".
+func writeAssetManifest(dir string) (assetManifest, error) {
+	if err := os.Remove(filepath.Join(dir, assetManifestFile)); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	m, err := buildAssetManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return m, ioutil.WriteFile(filepath.Join(dir, assetManifestFile), append(b, '\n'), 0644)
+}
+
+// logical returns the logical name of the file with the given hashed
+// name, or false if there is none.
+func (m assetManifest) logical(hashed string) (string, bool) {
+	for name, h := range m {
+		if h == hashed {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// staticAssets holds the asset manifest, set by Handler, for asset, which
+// like route is shared by every Treatshelf.
+var staticAssets atomic.Value // assetManifest
+
+// assets returns t's asset manifest, loading it the first time, which is
+// when Handler sets up the routes.
+func (t *Treatshelf) assets() assetManifest {
+	if t.assetManifest == nil {
+		m, err := loadAssetManifest(staticDir)
+		if err != nil {
+			// The files are still served under their logical names.
+			fmt.Fprintf(t.logWriter, "Static files won't be cached for long: %v\n", err)
+			m = assetManifest{}
+		}
+		t.assetManifest = m
+	}
+	return t.assetManifest
+}
+
+// asset returns the URL of the named file in staticDir, by its hashed
+// name: {{asset "app.css"}}. It fails for files that aren't there, so that
+// typos show up when the template is executed.
+func asset(name string) (string, error) {
+	m, _ := staticAssets.Load().(assetManifest)
+	hashed, ok := m[name]
+	if !ok {
+		if len(m) > 0 {
+			return "", fmt.Errorf("asset: no static file %q", name)
+		}
+		// The manifest couldn't be loaded: link to the file as it is.
+		hashed = name
+	}
+	dir, err := route("static")
+	if err != nil {
+		return "", err
+	}
+	return dir + hashed, nil
+}
+
+// faviconHandler redirects the browsers that ask for /favicon.ico, ahead
+// of reading the page's <link rel="icon">, to the icon.
+func (t *Treatshelf) faviconHandler(w http.ResponseWriter, r *http.Request) {
+	name := "icon.svg"
+	if hashed, ok := t.assets()[name]; ok {
+		name = hashed
+	}
+	http.Redirect(w, r, t.url("/static/"+name), http.StatusMovedPermanently)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAssetManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "assets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "app.css"), []byte("body {}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	built, err := loadAssetManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashed := built["app.css"]
+	if !strings.HasPrefix(hashed, "app.") || !strings.HasSuffix(hashed, ".css") || len(hashed) != len("app.12345678.css") {
+		t.Errorf("app.css is named %q, want app.<hash>.css", hashed)
+	}
+	if name, ok := built.logical(hashed); !ok || name != "app.css" {
+		t.Errorf("logical(%q) = %q, %v; want app.css", hashed, name, ok)
+	}
+
+	// A written manifest is read rather than built again, and doesn't list
+	// itself.
+	if _, err := writeAssetManifest(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "app.css"), []byte("body { color: red }"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	read, err := loadAssetManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(read) != 1 || read["app.css"] != hashed {
+		t.Errorf("read manifest %v, want app.css as %q", read, hashed)
+	}
+}
+
+func TestStaticCaching(t *testing.T) {
+	shelf := goldenShelf(t)
+	h := shelf.Handler()
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+
+	url, err := asset("app.css")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if url == "static/app.css" || !strings.HasPrefix(url, "static/app.") {
+		t.Fatalf("asset(app.css) = %q, want a hashed name under static/", url)
+	}
+	if _, err := asset("nope.css"); err == nil {
+		t.Error("asset of a missing file succeeded")
+	}
+
+	w := get("/" + url)
+	if w.Code != http.StatusOK || w.Header().Get("Cache-Control") != cacheImmutable || !strings.Contains(w.Body.String(), ".palette") {
+		t.Errorf("hashed name: got status %d, Cache-Control %q", w.Code, w.Header().Get("Cache-Control"))
+	}
+	w = get("/static/sw.js")
+	if w.Code != http.StatusOK || w.Header().Get("Cache-Control") != cacheStatic {
+		t.Errorf("logical name: got status %d, Cache-Control %q", w.Code, w.Header().Get("Cache-Control"))
+	}
+	w = get("/favicon.ico")
+	if w.Code != http.StatusMovedPermanently || !strings.HasPrefix(w.Header().Get("Location"), "/static/icon.") {
+		t.Errorf("favicon: got status %d to %q", w.Code, w.Header().Get("Location"))
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"google.golang.org/api/idtoken"
+)
+
+// Headers set by Identity-Aware Proxy, see
+// https://cloud.google.com/iap/docs/signed-headers-howto.
+const (
+	// iapJWTHeader carries a JWT signed by IAP asserting the user's identity.
+	iapJWTHeader = "X-Goog-IAP-JWT-Assertion"
+
+	// iapEmailHeader carries the signed-in user's email in the form
+	// "accounts.google.com:user@example.com". It is not signed, so anyone
+	// who can reach the app without going through IAP can set it.
+	iapEmailHeader = "X-Goog-Authenticated-User-Email"
+)
+
+// currentUser returns the email address of the signed-in user, or "" if the
+// request is anonymous. It is the user an admin is viewing the app as, if
+// they are, see impersonation.go.
+func (t *Treatshelf) currentUser(r *http.Request) string {
+	u := t.authenticatedUser(r)
+	if v := t.impersonationBy(r, u); v != nil {
+		return v.User
+	}
+	return u
+}
+
+// authenticatedUser returns the email address of the user who made the
+// request, or "" if it is anonymous. API requests made with a token are
+// made by the token's user, see apiTokens. Otherwise the user signed in
+// through IAP comes first, see iapUser, then people who signed in with an
+// AuthProvider and are remembered in a cookie, see loginUser.
+func (t *Treatshelf) authenticatedUser(r *http.Request) string {
+	if tok := tokenFrom(r); tok != nil {
+		return tok.User
+	}
+	iap, login := t.signedInUsers(r)
+	if iap != "" {
+		return iap
+	}
+	return login
+}
+
+// sessionUsers are the users a request's browser is signed in as, through
+// IAP and through an AuthProvider. They are resolved once, the first time
+// they are needed, since checking an IAP assertion is slow.
+type sessionUsers struct {
+	once       sync.Once
+	iap, login string
+}
+
+// sessionUsersKey is the context key for a request's *sessionUsers.
+type sessionUsersKey struct{}
+
+// withSessionUsers is middleware giving each request its sessionUsers, so
+// that currentUser and isAdmin don't check the request's credentials
+// again every time they are called. It wraps logRequests, which logs the
+// user too.
+func withSessionUsers(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), sessionUsersKey{}, &sessionUsers{})
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// signedInUsers returns the users signed in through IAP and through an
+// AuthProvider, resolving them if the request has no sessionUsers, as when
+// handlers are called directly.
+func (t *Treatshelf) signedInUsers(r *http.Request) (iap, login string) {
+	s, ok := r.Context().Value(sessionUsersKey{}).(*sessionUsers)
+	if !ok {
+		return t.verifyIAPUser(r), t.loginUser(r)
+	}
+	s.once.Do(func() {
+		s.iap, s.login = t.verifyIAPUser(r), t.loginUser(r)
+	})
+	return s.iap, s.login
+}
+
+// iapUser returns the email address of the user signed in through IAP, or
+// "" if there is none.
+func (t *Treatshelf) iapUser(r *http.Request) string {
+	iap, _ := t.signedInUsers(r)
+	return iap
+}
+
+// verifyIAPUser checks the request's IAP credentials, see iapUser.
+//
+// If t.iapAudience is set (IAP_AUDIENCE), the user comes from the signed
+// JWT assertion. Otherwise the plain email header is used only if
+// t.trustIAPHeader is set (TRUST_IAP_HEADER=true), for local development
+// or deployments where the app is unreachable except through IAP.
+func (t *Treatshelf) verifyIAPUser(r *http.Request) string {
+	switch {
+	case t.iapAudience != "":
+		jwt := r.Header.Get(iapJWTHeader)
+		if jwt == "" {
+			return ""
+		}
+		p, err := idtoken.Validate(r.Context(), jwt, t.iapAudience)
+		if err != nil {
+			fmt.Fprintf(t.logWriter, "Invalid IAP assertion: %v\n", err)
+			return ""
+		}
+		email, _ := p.Claims["email"].(string)
+		return strings.ToLower(email)
+	case t.trustIAPHeader:
+		email := r.Header.Get(iapEmailHeader)
+		if i := strings.LastIndex(email, ":"); i >= 0 {
+			email = email[i+1:]
+		}
+		return strings.ToLower(email)
+	}
+	return ""
+}
+
+// isAdmin reports whether the request was made by an administrator, with
+// the admin scope if it was made with an API token.
+func (t *Treatshelf) isAdmin(r *http.Request) bool {
+	if tok := tokenFrom(r); tok != nil && !tok.Has(scopeAdmin) {
+		return false
+	}
+	return t.adminEmail(r, t.currentUser(r))
+}
+
+// adminEmail reports whether u, a user of r, is in ADMIN_EMAILS. Behind
+// IAP, admins must have signed in through it: an AuthProvider may vouch
+// for addresses the organisation doesn't control. Tokens only carry the
+// admin scope if an admin created them, see createTokenHandler.
+func (t *Treatshelf) adminEmail(r *http.Request, u string) bool {
+	if u == "" || !t.admins[u] {
+		return false
+	}
+	if t.iapAudience == "" && !t.trustIAPHeader || tokenFrom(r) != nil {
+		return true
+	}
+	return t.iapUser(r) != ""
+}
+
+// parseAdmins parses a comma-separated list of administrator emails.
+func parseAdmins(s string) map[string]bool {
+	admins := make(map[string]bool)
+	for _, email := range strings.Split(s, ",") {
+		if email = strings.ToLower(strings.TrimSpace(email)); email != "" {
+			admins[email] = true
+		}
+	}
+	return admins
+}
+
+// requireAdmin returns a 403 appError unless the request was made by an
+// administrator. It enforces ruleAdmin, see policy.go.
+func (t *Treatshelf) requireAdmin(r *http.Request) *appError {
+	if t.isAdmin(r) {
+		return nil
+	}
+	err := errors.New("admin access required")
+	return t.appErrorCodef(r, http.StatusForbidden, err, "%v", err)
+}
+
+// requireCron returns a 403 appError unless the request came from App Engine
+// cron, which sets a header that is stripped from external requests. It
+// enforces ruleCron, see policy.go.
+func (t *Treatshelf) requireCron(r *http.Request) *appError {
+	if r.Header.Get("X-Appengine-Cron") == "true" {
+		return nil
+	}
+	err := errors.New("not a cron request")
+	return t.appErrorCodef(r, http.StatusForbidden, err, "%v", err)
+}
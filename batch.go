@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// The API can create or replace up to maxBatchWrites treats in one request,
+// at /api/v1/treats:batchCreate and :batchUpdate:
+//
+//	{"Treats": [{"Title": "Brownie"}, ...]}
+//
+// Each treat is checked as the single-treat endpoints would, and those that
+// pass are written in one Firestore batch. Rather than failing the whole
+// request for one bad treat, the response has a result per treat, in
+// request order, with the status code the single-treat endpoint would have
+// returned:
+//
+//	{"Results": [{"Status": 201, "Treat": {...}}, {"Status": 400, "Error": "title is required"}]}
+//
+// A treat that fails batchSchema has a 400 result with the InvalidParams a
+// single-treat request would have had, see schema.go.
+//
+// The request as a whole fails only if the body can't be read or the
+// batch can't be written, in which case no treat was saved.
+
+// batchRequest is the body of a batch request.
+type batchRequest struct {
+	Treats []*Treat
+	// invalid holds, by index, what is wrong with the treats that failed
+	// batchSchema.
+	invalid map[int][]invalidParam
+}
+
+// batchResult is the outcome for one treat of a batch request.
+type batchResult struct {
+	Status        int
+	Error         string         `json:",omitempty"`
+	InvalidParams []invalidParam `json:",omitempty"`
+	Treat         *Treat         `json:"-"`
+	// TreatJSON is Treat as the API version represents it, set by
+	// saveBatch.
+	TreatJSON interface{} `json:"Treat,omitempty"`
+}
+
+// batchFromJSON decodes a batch request from the body of r. The request
+// fails if the batch itself is invalid; problems with its treats are kept
+// in invalid, for their results.
+func (t *Treatshelf) batchFromJSON(r *http.Request) (*batchRequest, *appError) {
+	var raw json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&raw); err != nil {
+		return nil, t.appErrorCodef(r, http.StatusBadRequest, err, "invalid JSON: %v", err)
+	}
+	b := &batchRequest{invalid: make(map[int][]invalidParam)}
+	var whole []invalidParam
+	for _, p := range batchSchema.check(raw) {
+		// Problems with the treat at index i are named "Treats[i]..."; the
+		// treat's result names them as a single-treat request would.
+		var i int
+		if n, _ := fmt.Sscanf(p.Name, "Treats[%d]", &i); n == 1 {
+			p.Name = strings.TrimPrefix(strings.TrimPrefix(p.Name, fmt.Sprintf("Treats[%d]", i)), ".")
+			if p.Name == "" {
+				p.Name = "body"
+			}
+			b.invalid[i] = append(b.invalid[i], p)
+			continue
+		}
+		whole = append(whole, p)
+	}
+	if len(whole) > 0 {
+		return nil, t.validationError(r, whole)
+	}
+	// Decode the treats one at a time, as those that failed the schema
+	// may not decode at all.
+	var body struct{ Treats []json.RawMessage }
+	if err := json.Unmarshal(raw, &body); err != nil {
+		return nil, t.appErrorCodef(r, http.StatusBadRequest, err, "invalid JSON: %v", err)
+	}
+	b.Treats = make([]*Treat, len(body.Treats))
+	for i, item := range body.Treats {
+		if b.invalid[i] != nil {
+			continue
+		}
+		if err := json.Unmarshal(item, &b.Treats[i]); err != nil {
+			return nil, t.appErrorCodef(r, http.StatusBadRequest, err, "invalid JSON: %v", err)
+		}
+	}
+	return b, nil
+}
+
+// invalidResult returns the result for a treat that failed batchSchema.
+func invalidResult(ps []invalidParam) *batchResult {
+	reasons := make([]string, len(ps))
+	for i, p := range ps {
+		reasons[i] = p.Name + " " + p.Reason
+	}
+	return &batchResult{Status: http.StatusBadRequest, Error: strings.Join(reasons, "; "), InvalidParams: ps}
+}
+
+// apiBatchCreateHandler adds the valid treats of a batch request.
+func (t *Treatshelf) apiBatchCreateHandler(w http.ResponseWriter, r *http.Request) *appError {
+	if e := t.checkAPICaptcha(w, r); e != nil {
+		return e
+	}
+	b, e := t.batchFromJSON(r)
+	if e != nil {
+		return e
+	}
+	results := make([]*batchResult, len(b.Treats))
+	for i, treat := range b.Treats {
+		if ps := b.invalid[i]; ps != nil {
+			results[i] = invalidResult(ps)
+			continue
+		}
+		if err := checkAPITreat(treat); err != nil {
+			results[i] = &batchResult{Status: http.StatusBadRequest, Error: err.Error()}
+			continue
+		}
+		treat.ID = ""
+		treat.CreatedBy = t.currentUser(r)
+		t.submitForReview(r, treat)
+		results[i] = &batchResult{Status: http.StatusCreated, Treat: treat}
+	}
+	return t.saveBatch(w, r, results)
+}
+
+// apiBatchUpdateHandler replaces the treats of a batch request that exist
+// and r may change, see mayChange.
+func (t *Treatshelf) apiBatchUpdateHandler(w http.ResponseWriter, r *http.Request) *appError {
+	b, e := t.batchFromJSON(r)
+	if e != nil {
+		return e
+	}
+	var ids []string
+	for _, treat := range b.Treats {
+		if treat != nil && treat.ID != "" {
+			ids = append(ids, treat.ID)
+		}
+	}
+	olds, err := t.DB.GetTreats(r.Context(), ids)
+	if err != nil {
+		return t.appErrorf(r, err, "GetTreats: %v", err)
+	}
+	existing := make(map[string]*Treat, len(olds))
+	for _, old := range olds {
+		if old != nil {
+			existing[old.ID] = old
+		}
+	}
+	results := make([]*batchResult, len(b.Treats))
+	seen := make(map[string]bool)
+	for i, treat := range b.Treats {
+		var old *Treat
+		if treat != nil {
+			old = existing[treat.ID]
+		}
+		switch {
+		case b.invalid[i] != nil:
+			results[i] = invalidResult(b.invalid[i])
+			continue
+		case treat == nil || treat.ID == "":
+			results[i] = &batchResult{Status: http.StatusBadRequest, Error: "ID is required"}
+			continue
+		case seen[treat.ID]:
+			results[i] = &batchResult{Status: http.StatusBadRequest, Error: fmt.Sprintf("treat %q is in the batch more than once", treat.ID)}
+			continue
+		case old == nil || old.Deleted():
+			results[i] = &batchResult{Status: http.StatusNotFound, Error: fmt.Sprintf("could not find treat %q", treat.ID)}
+			continue
+		case !t.mayChange(r, old):
+			results[i] = &batchResult{Status: http.StatusForbidden, Error: "only the person who added this treat, or an admin, can change it"}
+			continue
+		}
+		seen[treat.ID] = true
+		if err := checkAPITreat(treat); err != nil {
+			results[i] = &batchResult{Status: http.StatusBadRequest, Error: err.Error()}
+			continue
+		}
+		keepServerFields(treat, old)
+		t.submitForReview(r, treat)
+		results[i] = &batchResult{Status: http.StatusOK, Treat: treat}
+	}
+	return t.saveBatch(w, r, results)
+}
+
+// saveBatch saves the treats of the successful results in one batch and
+// writes the results.
+func (t *Treatshelf) saveBatch(w http.ResponseWriter, r *http.Request, results []*batchResult) *appError {
+	var treats []*Treat
+	for _, res := range results {
+		if res.Treat != nil {
+			treats = append(treats, res.Treat)
+		}
+	}
+	if len(treats) > 0 {
+		if err := t.DB.SaveTreats(r.Context(), treats); err != nil {
+			return t.appErrorf(r, err, "SaveTreats: %v", err)
+		}
+	}
+	for _, res := range results {
+		if res.Treat == nil {
+			continue
+		}
+		var err error
+		if res.TreatJSON, err = sparseTreat(apiVersionOf(r), res.Treat, nil); err != nil {
+			return t.appErrorf(r, err, "could not encode treat: %v", err)
+		}
+	}
+	writeJSON(w, http.StatusOK, struct{ Results []*batchResult }{results})
+	return nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// The benchmarks below cover the hot paths of the web UI and the API, to
+// catch regressions; compare runs with benchstat:
+//
+//	go test -run NONE -bench . -benchmem -count 10 > new.txt
+
+// benchTreats is how many treats benchShelf holds.
+const benchTreats = 200
+
+// benchShelf returns a test shelf holding benchTreats treats, whose
+// handlers are called directly.
+func benchShelf(b *testing.B) *Treatshelf {
+	t, db := newTestShelf(b)
+	ctx := context.Background()
+	for i := 0; i < benchTreats; i++ {
+		_, err := db.AddTreat(ctx, &Treat{
+			Title:       fmt.Sprintf("Brownie #%d", i),
+			Author:      "bench",
+			Description: "Fudgy, with walnuts.",
+			Tags:        []string{"chocolate", "nuts"},
+			Quantity:    intp(1 + i%12),
+			Price:       &Price{Amount: int64(100 + i), Currency: "GBP"},
+			Nutrition:   &Nutrition{ServingSize: 50, Calories: 200, Sugar: 10, Fat: 5},
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	return t
+}
+
+func BenchmarkTreatFromForm(b *testing.B) {
+	t := benchShelf(b)
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for k, v := range map[string]string{
+		"title":         "Brownies",
+		"author":        "bench",
+		"description":   "Fudgy, with walnuts.",
+		"tags":          "chocolate, nuts",
+		"quantity":      "12",
+		"price":         "2.50",
+		"currency":      "GBP",
+		"servingSize":   "50",
+		"calories":      "200",
+		"expiresAt":     "2030-01-02T15:04",
+		"publishedDate": "2020-01-02",
+	} {
+		mw.WriteField(k, v)
+	}
+	mw.Close()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r := httptest.NewRequest("POST", "/treats", bytes.NewReader(body.Bytes()))
+		r.Header.Set("Content-Type", mw.FormDataContentType())
+		if _, err := t.treatFromForm(r); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkListTemplate renders the treat list, mostly the cost of
+// executing list.html.
+func BenchmarkListTemplate(b *testing.B) {
+	t := benchShelf(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w := httptest.NewRecorder()
+		if err := t.listHandler(w, httptest.NewRequest("GET", "/treats", nil)); err != nil {
+			b.Fatal(err.err)
+		}
+	}
+}
+
+// BenchmarkListTreatsJSON lists treats through the API, mostly the cost of
+// serializing them.
+func BenchmarkListTreatsJSON(b *testing.B) {
+	t := benchShelf(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w := httptest.NewRecorder()
+		if err := t.apiListHandler(w, httptest.NewRequest("GET", "/api/v1/treats?pageSize=100", nil)); err != nil {
+			b.Fatal(err.err)
+		}
+		if w.Code != http.StatusOK {
+			b.Fatalf("got status %d", w.Code)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+)
+
+// defaultBucketLocation is where bootstrap creates buckets unless
+// BUCKET_LOCATION is set.
+const defaultBucketLocation = "US"
+
+// checkBuckets makes sure every bucket t uses exists and is accessible. A
+// missing bucket is created if t.buckets.Create is set (BOOTSTRAP=true);
+// otherwise the error explains how to fix it.
+//
+// Firestore needs no bootstrapping: collections are created on first write,
+// and every query in db_firestore.go is served by the single-field indexes
+// Firestore maintains automatically. Queries that need a composite index
+// should be listed here when they are added.
+func (t *Treatshelf) checkBuckets(ctx context.Context) error {
+	type bucket struct {
+		env, name string
+		h         *storage.BucketHandle
+		public    bool
+	}
+	t.mu.RLock()
+	if t.storageClient == nil {
+		// Already degraded; recoverStorage checks again once there is a client.
+		t.mu.RUnlock()
+		return nil
+	}
+	cfg := t.buckets
+	buckets := []bucket{
+		{"STORAGE_BUCKET", t.StorageBucketName, t.StorageBucket, true},
+		{"THUMBNAIL_BUCKET", t.ThumbnailBucketName, t.ThumbnailBucket, true},
+		{"BACKUP_BUCKET", t.BackupBucketName, t.BackupBucket, false},
+	}
+	t.mu.RUnlock()
+
+	checked := make(map[string]bool)
+	for _, b := range buckets {
+		if checked[b.name] {
+			continue
+		}
+		checked[b.name] = true
+		if err := t.checkBucket(ctx, b.env, b.name, b.h, b.public, cfg.Create, cfg.Location); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkBucket checks a single bucket, configured by the env variable, as
+// described by checkBuckets. Objects in public buckets are readable by
+// anyone.
+func (t *Treatshelf) checkBucket(ctx context.Context, env, name string, h *storage.BucketHandle, public, create bool, location string) error {
+	_, err := h.Attrs(ctx)
+	if err == nil {
+		return nil
+	}
+	if e, ok := err.(*googleapi.Error); ok && e.Code == http.StatusForbidden {
+		return fmt.Errorf("no access to bucket %q (%s): grant this app's service account "+
+			"roles/storage.objectAdmin on it, or set %s to a bucket it can use: %v", name, env, env, err)
+	}
+	if err != storage.ErrBucketNotExist {
+		return fmt.Errorf("could not check bucket %q (%s): %v", name, env, err)
+	}
+	if !create {
+		msg := fmt.Sprintf("bucket %q (%s) does not exist: create it with\n"+
+			"    gsutil mb -l %s gs://%s\n", name, env, location, name)
+		if public {
+			msg += fmt.Sprintf("    gsutil defacl set public-read gs://%s\n", name)
+		}
+		return fmt.Errorf("%sor restart with BOOTSTRAP=true to create it automatically", msg)
+	}
+
+	fmt.Fprintf(t.logWriter, "Creating bucket %q in %s\n", name, location)
+	attrs := &storage.BucketAttrs{Location: location}
+	if public {
+		attrs.PredefinedDefaultObjectACL = "publicRead"
+	}
+	if err := h.Create(ctx, t.projectID, attrs); err != nil {
+		return fmt.Errorf("could not create bucket %q (%s): %v", name, env, err)
+	}
+	return nil
+}
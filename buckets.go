@@ -0,0 +1,63 @@
+package main
+
+import "os"
+
+// Buckets names the Cloud Storage buckets used for each kind of object.
+// Thumbnails and Backups default to the Originals bucket when empty.
+type Buckets struct {
+	Originals  string // uploaded treat pictures.
+	Thumbnails string // resized treat pictures.
+	Backups    string // exports and archived treats.
+
+	// Create is set to create missing buckets in Location, see checkBuckets.
+	Create   bool
+	Location string
+}
+
+// bucketsFromEnv reads bucket names from STORAGE_BUCKET, THUMBNAIL_BUCKET
+// and BACKUP_BUCKET. STORAGE_BUCKET defaults to "<projectID>_bucket".
+// Missing buckets are created if BOOTSTRAP=true, in BUCKET_LOCATION.
+func bucketsFromEnv(projectID string) Buckets {
+	b := Buckets{
+		Originals:  os.Getenv("STORAGE_BUCKET"),
+		Thumbnails: os.Getenv("THUMBNAIL_BUCKET"),
+		Backups:    os.Getenv("BACKUP_BUCKET"),
+		Create:     os.Getenv("BOOTSTRAP") == "true",
+		Location:   os.Getenv("BUCKET_LOCATION"),
+	}
+	if b.Originals == "" {
+		b.Originals = projectID + "_bucket"
+	}
+	if b.Location == "" {
+		b.Location = defaultBucketLocation
+	}
+	return b
+}
+
+// setBuckets points t at the given buckets.
+func (t *Treatshelf) setBuckets(b Buckets) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.setBucketsLocked(b)
+}
+
+// setBucketsLocked is setBuckets for callers holding t.mu. Bucket handles
+// stay nil while storage is degraded.
+func (t *Treatshelf) setBucketsLocked(b Buckets) {
+	t.buckets = b
+	if b.Thumbnails == "" {
+		b.Thumbnails = b.Originals
+	}
+	if b.Backups == "" {
+		b.Backups = b.Originals
+	}
+	t.StorageBucketName = b.Originals
+	t.ThumbnailBucketName = b.Thumbnails
+	t.BackupBucketName = b.Backups
+	if t.storageClient == nil {
+		return
+	}
+	t.StorageBucket = t.storageClient.Bucket(b.Originals)
+	t.ThumbnailBucket = t.storageClient.Bucket(b.Thumbnails)
+	t.BackupBucket = t.storageClient.Bucket(b.Backups)
+}
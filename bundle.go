@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"path"
+	"strings"
+)
+
+// Scripts and styles that grow beyond what fits in a template are written
+// as modules in web/ and bundled by esbuild (https://esbuild.github.io)
+// into static/app.bundle.js and static/app.bundle.css, minified, which are
+// then served like the other static files. Bundle before deploying:
+//
+//	go generate && go run . asset-manifest
+//
+// or set DEV_BUNDLE=true to bundle at startup while developing. The
+// bundles aren't checked in, and pages link to them only if they have been
+// built, so everything in them must be an enhancement.
+
+//go:generate esbuild web/app.js --bundle --minify --sourcemap --target=es2017 --outfile=static/app.bundle.js
+
+// bundleArgs are the arguments esbuild is run with, as by the go:generate
+// directive above.
+var bundleArgs = []string{"web/app.js", "--bundle", "--minify", "--sourcemap", "--target=es2017", "--outfile=" + staticDir + "/app" + bundleSuffix + ".js"}
+
+// bundleSuffix marks the names of the bundles in staticDir.
+const bundleSuffix = ".bundle"
+
+// runBundler bundles web/ with esbuild, which must be on the PATH, writing
+// its output to w.
+func runBundler(ctx context.Context, w io.Writer) error {
+	esbuild, err := exec.LookPath("esbuild")
+	if err != nil {
+		return fmt.Errorf("esbuild is not installed: %v", err)
+	}
+	cmd := exec.CommandContext(ctx, esbuild, bundleArgs...)
+	cmd.Stdout, cmd.Stderr = w, w
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("esbuild %s: %v", strings.Join(bundleArgs, " "), err)
+	}
+	return nil
+}
+
+// bundle returns the URL of the bundle built from web/ with the given
+// name's extension, "app.js" or "app.css", or "" if it hasn't been built:
+// {{with bundle "app.js"}}<script src="{{.}}" defer></script>{{end}}.
+func bundle(name string) (string, error) {
+	ext := path.Ext(name)
+	out := strings.TrimSuffix(name, ext) + bundleSuffix + ext
+	m, _ := staticAssets.Load().(assetManifest)
+	if _, ok := m[out]; !ok {
+		return "", nil
+	}
+	return asset(out)
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestBundleArgsMatchGenerate(t *testing.T) {
+	b, err := ioutil.ReadFile("bundle.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "//go:generate esbuild " + strings.Join(bundleArgs, " ") + "\n"
+	if !strings.Contains(string(b), want) {
+		t.Errorf("bundle.go has no directive %q: keep it in step with bundleArgs", want)
+	}
+}
+
+func TestBundle(t *testing.T) {
+	goldenShelf(t)
+	defer staticAssets.Store(staticAssets.Load())
+
+	staticAssets.Store(assetManifest{"app.css": "app.1.css"})
+	if url, err := bundle("app.js"); err != nil || url != "" {
+		t.Errorf("bundle before it is built = %q, %v; want \"\"", url, err)
+	}
+	staticAssets.Store(assetManifest{"app.bundle.js": "app.bundle.2.js"})
+	if url, err := bundle("app.js"); err != nil || url != "static/app.bundle.2.js" {
+		t.Errorf("bundle = %q, %v; want static/app.bundle.2.js", url, err)
+	}
+}
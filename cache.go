@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// Cache-Control policies. Handler picks one per route with withCache;
+// cacheDefaults covers the rest.
+const (
+	// cacheImmutable is for content whose URL changes with it, such as
+	// uploaded pictures, which are stored under random names.
+	cacheImmutable = "public, max-age=31536000, immutable"
+
+	// cacheStatic is for files that change only when the app is deployed.
+	cacheStatic = "public, max-age=300"
+
+	// cacheImages is for resized pictures, which change only if their
+	// preset does, see presets.go.
+	cacheImages = "public, max-age=86400"
+
+	// cacheList lets shared caches serve the list page for a short time.
+	// The page depends on the session cookie, so responses vary by it.
+	cacheList = "public, max-age=0, s-maxage=30"
+
+	// cachePrivate is the default for pages: the browser may keep them but
+	// must revalidate.
+	cachePrivate = "private, no-cache"
+
+	// cacheNoStore is for forms, writes and errors, which must never be
+	// replayed from a cache.
+	cacheNoStore = "no-store"
+)
+
+// cacheDefaults is mux middleware that sets the default Cache-Control
+// header: cachePrivate for reads and cacheNoStore for writes. Routes
+// override it with withCache.
+func cacheDefaults(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		policy := cachePrivate
+		if r.Method != "GET" && r.Method != "HEAD" {
+			policy = cacheNoStore
+		}
+		w.Header().Set("Cache-Control", policy)
+		h.ServeHTTP(w, r)
+	})
+}
+
+// withCache returns middleware that sets the given Cache-Control policy for
+// a route.
+func withCache(policy string) mux.MiddlewareFunc {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Cache-Control", policy)
+			if policy == cacheList {
+				w.Header().Add("Vary", "Cookie")
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
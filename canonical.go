@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Every page has one canonical URL, so that analytics and caches don't see
+// duplicates: requests for other spellings of it are redirected there with
+// a 301. canonicalHost covers the host (CANONICAL_HOST), and notFound the
+// path: no trailing or doubled slashes, and the fixed parts of routes in
+// lower case. Treat IDs are case sensitive, so they are left alone.
+
+// canonicalHost is middleware redirecting reads made through another host
+// name, such as the appspot.com one, to t.canonicalHostName, if set. Writes
+// aren't redirected, since browsers would follow with a GET, nor are cron
+// tasks and health checks, which App Engine sends to its own host names.
+func (t *Treatshelf) canonicalHost(h http.Handler) http.Handler {
+	if t.canonicalHostName == "" {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method != "GET" && r.Method != "HEAD",
+			strings.EqualFold(r.Host, t.canonicalHostName),
+			strings.HasPrefix(r.URL.Path, t.url("/tasks/")),
+			r.URL.Path == t.url("/healthz"),
+			strings.HasPrefix(r.URL.Path, "/_ah/"):
+			h.ServeHTTP(w, r)
+			return
+		}
+		scheme := "https"
+		if r.TLS == nil && r.Header.Get("X-Forwarded-Proto") == "http" {
+			scheme = "http"
+		}
+		http.Redirect(w, r, scheme+"://"+t.canonicalHostName+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
+
+// notFound serves requests that match no route. Reads of a non-canonical
+// path whose canonical form is routed are redirected there; anything else
+// is a 404.
+func (t *Treatshelf) notFound(w http.ResponseWriter, r *http.Request) *appError {
+	if r.Method == "GET" || r.Method == "HEAD" {
+		if p := t.canonicalPath(r.URL.Path); p != r.URL.Path && t.routed(r, p) {
+			u := *r.URL
+			u.Path = p
+			http.Redirect(w, r, u.RequestURI(), http.StatusMovedPermanently)
+			return nil
+		}
+	}
+	err := errors.New("page not found")
+	return t.appErrorCodef(r, http.StatusNotFound, err, "%v", err)
+}
+
+// canonicalPath cleans p and, if it then matches a GET route ignoring case,
+// spells the fixed segments of that route as the route does.
+func (t *Treatshelf) canonicalPath(p string) string {
+	p = path.Clean("/" + p)
+	segs := strings.Split(p, "/")
+	found := ""
+	t.routes.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		if found != "" {
+			return nil
+		}
+		if methods, err := route.GetMethods(); err != nil || !contains(methods, "GET") {
+			return nil
+		}
+		tpl, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		if c, ok := matchFold(strings.Split(tpl, "/"), segs); ok {
+			found = c
+		}
+		return nil
+	})
+	if found != "" {
+		return found
+	}
+	return p
+}
+
+// matchFold reports whether the path segments segs match the route template
+// segments tpl, comparing fixed segments without case, and returns the path
+// with the fixed segments spelled as in tpl. Segments with a variable are
+// kept as they are; mux checks their patterns when the path is routed.
+func matchFold(tpl, segs []string) (string, bool) {
+	if len(tpl) != len(segs) {
+		return "", false
+	}
+	out := make([]string, len(segs))
+	for i, s := range tpl {
+		switch {
+		case strings.Contains(s, "{"):
+			out[i] = segs[i]
+		case strings.EqualFold(s, segs[i]):
+			out[i] = s
+		default:
+			return "", false
+		}
+	}
+	return strings.Join(out, "/"), true
+}
+
+// routed reports whether a request like r for path p would match a route.
+func (t *Treatshelf) routed(r *http.Request, p string) bool {
+	u := *r.URL
+	u.Path = p
+	u.RawPath = ""
+	r2 := r.WithContext(r.Context())
+	r2.URL = &u
+	var m mux.RouteMatch
+	return t.routes.Match(r2, &m) && m.MatchErr == nil
+}
+
+// contains reports whether list contains s.
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// CaptchaVerifier checks that forms were filled in by a person. Anonymous
+// visitors adding treats must pass a challenge when one is configured
+// (CAPTCHA_PROVIDER); signed-in users skip it. API clients can't show a
+// challenge, so they need a token to add treats then, see
+// checkAPICaptcha.
+type CaptchaVerifier interface {
+	// Widget describes the challenge forms show.
+	Widget() *CaptchaWidget
+
+	// Verify checks the response the widget added to the form, from a
+	// visitor at remoteIP. It returns errCaptchaFailed if the visitor
+	// didn't pass.
+	Verify(ctx context.Context, response, remoteIP string) error
+}
+
+// CaptchaWidget is what templates need to show a challenge, see
+// templates/partials/captcha.html.
+type CaptchaWidget struct {
+	// Script is the provider's JavaScript, which turns elements of Class
+	// with a data-sitekey of SiteKey into challenges.
+	Script  string
+	Class   string
+	SiteKey string
+	// Field is the form field the widget puts its response in.
+	Field string
+}
+
+// errCaptchaFailed is returned when a challenge wasn't passed.
+var errCaptchaFailed = errors.New("please complete the challenge to show you're not a robot")
+
+// siteVerifier verifies challenges with a provider's siteverify endpoint,
+// which reCAPTCHA and Turnstile share.
+type siteVerifier struct {
+	widget    CaptchaWidget
+	verifyURL string
+	// secret may name a secret, resolved by secrets.
+	secret  string
+	secrets *secretCache
+	client  *http.Client
+}
+
+// newCaptchaVerifier returns the verifier for provider, "recaptcha" or
+// "turnstile", with the given keys. The secret may name a secret, see
+// secrets.go.
+func newCaptchaVerifier(provider, siteKey, secret string, secrets *secretCache, client *http.Client) (CaptchaVerifier, error) {
+	if siteKey == "" || secret == "" {
+		return nil, errors.New("the site key and secret must both be set")
+	}
+	v := &siteVerifier{secret: secret, secrets: secrets, client: client}
+	switch provider {
+	case "recaptcha":
+		// See https://developers.google.com/recaptcha/docs/verify.
+		v.widget = CaptchaWidget{
+			Script: "https://www.google.com/recaptcha/api.js",
+			Class:  "g-recaptcha",
+			Field:  "g-recaptcha-response",
+		}
+		v.verifyURL = "https://www.google.com/recaptcha/api/siteverify"
+	case "turnstile":
+		// See https://developers.cloudflare.com/turnstile/get-started/server-side-validation/.
+		v.widget = CaptchaWidget{
+			Script: "https://challenges.cloudflare.com/turnstile/v0/api.js",
+			Class:  "cf-turnstile",
+			Field:  "cf-turnstile-response",
+		}
+		v.verifyURL = "https://challenges.cloudflare.com/turnstile/v0/siteverify"
+	default:
+		return nil, fmt.Errorf("unknown provider %q, want recaptcha or turnstile", provider)
+	}
+	v.widget.SiteKey = siteKey
+	return v, nil
+}
+
+// Widget describes the challenge forms show.
+func (v *siteVerifier) Widget() *CaptchaWidget {
+	return &v.widget
+}
+
+// Verify checks response with the provider.
+func (v *siteVerifier) Verify(ctx context.Context, response, remoteIP string) error {
+	if response == "" {
+		return errCaptchaFailed
+	}
+	secret, err := v.secrets.resolve(ctx, v.secret)
+	if err != nil {
+		return fmt.Errorf("captcha: %v", err)
+	}
+	form := url.Values{
+		"secret":   {secret},
+		"response": {response},
+		"remoteip": {remoteIP},
+	}
+	req, err := http.NewRequest("POST", v.verifyURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := v.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("captcha: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		Success bool     `json:"success"`
+		Errors  []string `json:"error-codes"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return fmt.Errorf("captcha: could not decode response: %v", err)
+	}
+	if body.Success {
+		return nil
+	}
+	for _, code := range body.Errors {
+		if strings.HasSuffix(code, "-secret") {
+			// The fault is ours, not the visitor's.
+			return fmt.Errorf("captcha: %s", code)
+		}
+	}
+	return errCaptchaFailed
+}
+
+// captchaWidget returns the challenge to show on forms for r, or nil if
+// there is none, because none is configured or someone is signed in.
+func (t *Treatshelf) captchaWidget(r *http.Request) *CaptchaWidget {
+	if t.captcha == nil || t.currentUser(r) != "" {
+		return nil
+	}
+	return t.captcha.Widget()
+}
+
+// checkCaptcha returns an appError unless the form posted with r passed its
+// challenge, or needn't have shown one.
+func (t *Treatshelf) checkCaptcha(r *http.Request) *appError {
+	w := t.captchaWidget(r)
+	if w == nil {
+		return nil
+	}
+	err := t.captcha.Verify(r.Context(), r.FormValue(w.Field), remoteIP(r))
+	if err == nil {
+		return nil
+	}
+	if err == errCaptchaFailed {
+		return t.appErrorCodef(r, http.StatusForbidden, err, "%v", err)
+	}
+	return t.appErrorCodef(r, http.StatusBadGateway, err, "could not check the challenge: %v", err)
+}
+
+// checkAPICaptcha returns a 401 appError if r, an API request adding
+// treats, is anonymous while a challenge is configured, which would
+// otherwise let robots skip it.
+func (t *Treatshelf) checkAPICaptcha(w http.ResponseWriter, r *http.Request) *appError {
+	if t.captcha == nil || t.currentUser(r) != "" {
+		return nil
+	}
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	err := errors.New("an API token is required to add treats, create one at /settings/tokens")
+	return t.appErrorCodef(r, http.StatusUnauthorized, err, "%v", err)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// passingCaptcha is a CaptchaVerifier that every response passes.
+type passingCaptcha struct{}
+
+func (passingCaptcha) Widget() *CaptchaWidget {
+	return &CaptchaWidget{Class: "test-captcha", SiteKey: "key", Field: "captcha"}
+}
+
+func (passingCaptcha) Verify(context.Context, string, string) error { return nil }
+
+func TestAPICreateNeedsUserWithCaptcha(t *testing.T) {
+	shelf, _, _ := policyShelf(t)
+	shelf.captcha = passingCaptcha{}
+	h := shelf.Handler()
+	tests := []struct {
+		path, body, user string
+		status           int
+	}{
+		{"/api/v2/treats", `{"Title": "Brownie"}`, "", http.StatusUnauthorized},
+		{"/api/v2/treats:batchCreate", `{"Treats": [{"Title": "Brownie"}]}`, "", http.StatusUnauthorized},
+		{"/api/v2/treats", `{"Title": "Brownie"}`, "someone@example.com", http.StatusCreated},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", tt.path, strings.NewReader(tt.body))
+		r.Header.Set("Content-Type", "application/json")
+		if tt.user != "" {
+			r.Header.Set(iapEmailHeader, "accounts.google.com:"+tt.user)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tt.status {
+			t.Errorf("POST %s as %q: got status %d, want %d: %s", tt.path, tt.user, w.Code, tt.status, w.Body)
+		}
+	}
+}
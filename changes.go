@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ChangeKind is what happened to a treat, see TreatChange.
+type ChangeKind string
+
+const (
+	TreatAdded    ChangeKind = "added"
+	TreatModified ChangeKind = "modified"
+	TreatRemoved  ChangeKind = "removed"
+)
+
+// TreatChange is a change to a treat seen by a ChangeWatcher.
+type TreatChange struct {
+	Kind ChangeKind
+	ID   string
+	// Treat is the treat after the change, or nil if it was removed.
+	Treat *Treat
+}
+
+// ChangeWatcher is implemented by databases that can stream changes to
+// treats as they are committed, by any instance.
+type ChangeWatcher interface {
+	// WatchTreats calls fn with each change to a Treat, in commit order,
+	// until ctx is done or watching fails. Treats that exist when it starts
+	// are not reported.
+	WatchTreats(ctx context.Context, fn func(TreatChange)) error
+}
+
+// changeHub fans changes out to everything derived from the treats, such as
+// the /events stream, so that they stay up to date without polling.
+type changeHub struct {
+	mu   sync.RWMutex
+	subs map[int]func(TreatChange)
+	next int
+}
+
+func newChangeHub() *changeHub {
+	return &changeHub{subs: make(map[int]func(TreatChange))}
+}
+
+// Subscribe calls fn with every change until cancel is called. fn is called
+// from the watcher's goroutine and must not block.
+func (h *changeHub) Subscribe(fn func(TreatChange)) (cancel func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	id := h.next
+	h.next++
+	h.subs[id] = fn
+	return func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		delete(h.subs, id)
+	}
+}
+
+// publish passes c to every subscriber.
+func (h *changeHub) publish(c TreatChange) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for _, fn := range h.subs {
+		fn(c)
+	}
+}
+
+// maxWatchBackoff bounds the wait before watchChanges restarts a watch.
+const maxWatchBackoff = time.Minute
+
+// watchChanges passes the changes seen by w to publish, usually
+// t.changes.publish, until ctx is done, restarting the watch with backoff
+// whenever it fails. Subscribers may miss changes made while it restarts.
+func (t *Treatshelf) watchChanges(ctx context.Context, w ChangeWatcher, publish func(TreatChange)) {
+	backoff := time.Second
+	for ctx.Err() == nil {
+		start := t.now()
+		err := w.WatchTreats(ctx, publish)
+		if ctx.Err() != nil {
+			return
+		}
+		fmt.Fprintf(t.logWriter, "Watching treats failed, restarting in %v: %v\n", backoff, err)
+		if t.now().Sub(start) > maxWatchBackoff {
+			backoff = time.Second
+		}
+		select {
+		case <-t.after(backoff):
+		case <-ctx.Done():
+			return
+		}
+		if backoff *= 2; backoff > maxWatchBackoff {
+			backoff = maxWatchBackoff
+		}
+	}
+}
+
+const (
+	// eventBuffer is how many changes an /events client may fall behind by
+	// before changes are dropped for it.
+	eventBuffer = 16
+
+	// eventKeepAlive is how often /events writes a comment, so that
+	// proxies don't close idle streams.
+	eventKeepAlive = 30 * time.Second
+)
+
+// eventsHandler streams changes to treats as server-sent events, for pages
+// to offer a reload when the shelf changes. Events carry only the kind of
+// change and the treat ID, since clients may not be allowed to see the
+// treat. The stream ends with the request, e.g. at REQUEST_TIMEOUT, and
+// browsers reconnect by themselves.
+func (t *Treatshelf) eventsHandler(w http.ResponseWriter, r *http.Request) *appError {
+	flush := flusher(w)
+	events := make(chan TreatChange, eventBuffer)
+	cancel := t.changes.Subscribe(func(c TreatChange) {
+		select {
+		case events <- c:
+		default:
+		}
+	})
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", cacheNoStore)
+	fmt.Fprint(w, ": watching treats\n\n")
+	flush()
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case c := <-events:
+			b, _ := json.Marshal(struct {
+				Kind ChangeKind `json:"kind"`
+				ID   string     `json:"id"`
+			}{c.Kind, c.ID})
+			fmt.Fprintf(w, "event: treat\ndata: %s\n\n", b)
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case <-r.Context().Done():
+			return nil
+		}
+		flush()
+	}
+}
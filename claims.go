@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Claim records someone taking a number of portions of a treat.
+type Claim struct {
+	ID       string
+	TreatID  string
+	Name     string
+	Portions int
+	Created  time.Time
+
+	// ClaimedBy is the signed-in user who made the claim, if any, and
+	// Session the ID of the session they made it in. Only they, or an
+	// admin, may release it; see mayRelease.
+	ClaimedBy string
+	Session   string
+}
+
+// errNotEnoughPortions is returned by ClaimTreat and AdjustQuantity when
+// asked for more portions than remain.
+var errNotEnoughPortions = errors.New("not enough portions left")
+
+// claimFromForm populates the fields of a Claim made at the given time
+// from form values (see templates/detail.html).
+func claimFromForm(r *http.Request, now time.Time) (*Claim, error) {
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" {
+		return nil, errors.New("please say who is claiming the treat")
+	}
+	portions, err := intFromForm(r, "portions")
+	if err != nil {
+		return nil, err
+	}
+	if portions == 0 {
+		portions = 1
+	}
+	return &Claim{
+		Name:     name,
+		Portions: portions,
+		Created:  now,
+	}, nil
+}
+
+// claimHandler claims portions of a given treat. Like reports, claims of a
+// treat the request may not see fail with 404.
+func (t *Treatshelf) claimHandler(w http.ResponseWriter, r *http.Request) *appError {
+	ctx := r.Context()
+	treat, err := t.treatFromRequest(r)
+	if err != nil || !t.maySee(r, treat) || !treat.VisibleAt(t.now()) {
+		err := errors.New("treat not found")
+		return t.appErrorCodef(r, http.StatusNotFound, err, "%v", err)
+	}
+	id := treat.ID
+	c, err := claimFromForm(r, t.now())
+	if err != nil {
+		return t.appErrorCodef(r, http.StatusBadRequest, err, "could not parse claim from form: %v", err)
+	}
+	s := t.session(r)
+	if err := t.saveSession(w, s); err != nil {
+		return t.appErrorf(r, err, "could not save session: %v", err)
+	}
+	c.ClaimedBy, c.Session = t.currentUser(r), s.ID
+	_, err = t.DB.ClaimTreat(ctx, id, c)
+	if err == errNotEnoughPortions {
+		return t.appErrorCodef(r, http.StatusConflict, err, "could not claim treat: %v", err)
+	}
+	if err != nil {
+		return t.appErrorf(r, err, "could not claim treat: %v", err)
+	}
+	t.kickOutbox()
+	http.Redirect(w, r, t.routeURL("treat", "id", id), http.StatusFound)
+	return nil
+}
+
+// mayRelease reports whether the request's user may release c: an admin,
+// or whoever made the claim, signed in as the same user or in the same
+// session.
+func (t *Treatshelf) mayRelease(r *http.Request, c *Claim) bool {
+	switch {
+	case t.isAdmin(r):
+		return true
+	case c.ClaimedBy != "" && c.ClaimedBy == t.currentUser(r):
+		return true
+	}
+	return c.Session != "" && c.Session == t.session(r).ID
+}
+
+// releaseClaimHandler releases a claim, returning its portions to the treat.
+func (t *Treatshelf) releaseClaimHandler(w http.ResponseWriter, r *http.Request) *appError {
+	ctx := r.Context()
+	vars := mux.Vars(r)
+	claims, err := t.DB.ListClaims(ctx, vars["id"])
+	if err != nil {
+		return t.appErrorf(r, err, "could not list claims: %v", err)
+	}
+	var claim *Claim
+	for _, c := range claims {
+		if c.ID == vars["claimID"] {
+			claim = c
+		}
+	}
+	if claim == nil {
+		err := errors.New("claim not found")
+		return t.appErrorCodef(r, http.StatusNotFound, err, "%v", err)
+	}
+	if !t.mayRelease(r, claim) {
+		err := errors.New("only whoever made a claim, or an admin, can release it")
+		return t.appErrorCodef(r, http.StatusForbidden, err, "%v", err)
+	}
+	if err := t.DB.ReleaseClaim(ctx, vars["id"], vars["claimID"]); err != nil {
+		return t.appErrorf(r, err, "could not release claim: %v", err)
+	}
+	http.Redirect(w, r, t.routeURL("treat", "id", vars["id"]), http.StatusFound)
+	return nil
+}
@@ -0,0 +1,315 @@
+// Package client is a Go client for the Treatshelf JSON API (see
+// openapi.yaml in the repository root).
+//
+//	c, err := client.New("https://treats.example.com", client.WithHTTPClient(iapClient))
+//	it := c.ListTreats(ctx, &client.ListOptions{Available: true})
+//	for {
+//		t, err := it.Next()
+//		if err == iterator.Done {
+//			break
+//		}
+//		...
+//	}
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gofrs/uuid"
+)
+
+// Client calls the Treatshelf API.
+type Client struct {
+	base  *url.URL
+	hc    *http.Client
+	token func(ctx context.Context) (string, error)
+	retry RetryPolicy
+}
+
+// An Option configures a Client.
+type Option func(*Client)
+
+// WithHTTPClient sets the HTTP client used for requests. Use it to
+// authenticate through Identity-Aware Proxy, e.g. with a client from
+// google.golang.org/api/idtoken.NewClient.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) { c.hc = hc }
+}
+
+// WithBearerToken sets a function that returns a token to send in the
+// Authorization header of every request.
+func WithBearerToken(token func(ctx context.Context) (string, error)) Option {
+	return func(c *Client) { c.token = token }
+}
+
+// WithRetryPolicy sets how failed requests are retried.
+func WithRetryPolicy(p RetryPolicy) Option {
+	return func(c *Client) { c.retry = p }
+}
+
+// New returns a Client for the Treatshelf at baseURL, e.g.
+// "https://treats.example.com".
+func New(baseURL string, opts ...Option) (*Client, error) {
+	u, err := url.Parse(strings.TrimSuffix(baseURL, "/") + "/api/v1/")
+	if err != nil {
+		return nil, fmt.Errorf("client: invalid base URL: %v", err)
+	}
+	c := &Client{
+		base:  u,
+		hc:    http.DefaultClient,
+		retry: DefaultRetryPolicy,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c, nil
+}
+
+// GetTreat returns a given treat.
+func (c *Client) GetTreat(ctx context.Context, id string) (*Treat, error) {
+	t := &Treat{}
+	resp, err := c.do(ctx, "GET", "treats/"+url.PathEscape(id), nil, t)
+	if err != nil {
+		return nil, err
+	}
+	t.ETag = resp.Header.Get("ETag")
+	return t, nil
+}
+
+// CreateTreat creates a treat and returns it with its assigned ID. Retries
+// are safe: they share an idempotency key, so at most one treat is created.
+func (c *Client) CreateTreat(ctx context.Context, t *Treat) (*Treat, error) {
+	created := &Treat{}
+	resp, err := c.do(ctx, "POST", "treats", t, created)
+	if err != nil {
+		return nil, err
+	}
+	created.ETag = resp.Header.Get("ETag")
+	return created, nil
+}
+
+// UpdateTreat replaces the treat with ID t.ID and returns the result. It
+// fails with a 412 Error if the treat has changed since t was fetched, and
+// with a 428 Error if t.ETag is empty, unless the server doesn't require
+// it. Set t.ETag to "*" to replace the treat whatever its version.
+func (c *Client) UpdateTreat(ctx context.Context, t *Treat) (*Treat, error) {
+	if t.ID == "" {
+		return nil, fmt.Errorf("client: UpdateTreat needs a treat ID")
+	}
+	updated := &Treat{}
+	resp, err := c.doHeader(ctx, "PUT", "treats/"+url.PathEscape(t.ID), ifMatch(t.ETag), t, updated)
+	if err != nil {
+		return nil, err
+	}
+	updated.ETag = resp.Header.Get("ETag")
+	return updated, nil
+}
+
+// PatchTreat sets the given fields of the treat with ID t.ID to their values
+// in t, clearing those that are zero, and returns the result. Field names
+// are those of Treat. It checks t.ETag as UpdateTreat does.
+func (c *Client) PatchTreat(ctx context.Context, t *Treat, fields ...string) (*Treat, error) {
+	if t.ID == "" {
+		return nil, fmt.Errorf("client: PatchTreat needs a treat ID")
+	}
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("client: PatchTreat needs fields to set")
+	}
+	q := url.Values{"updateMask": {strings.Join(fields, ",")}}
+	updated := &Treat{}
+	resp, err := c.doHeader(ctx, "PATCH", "treats/"+url.PathEscape(t.ID)+"?"+q.Encode(), ifMatch(t.ETag), t, updated)
+	if err != nil {
+		return nil, err
+	}
+	updated.ETag = resp.Header.Get("ETag")
+	return updated, nil
+}
+
+// DeleteTreat deletes the treat with the given ID, whatever its version. A
+// delete that is retried after it succeeded fails with a 404.
+func (c *Client) DeleteTreat(ctx context.Context, id string) error {
+	_, err := c.doHeader(ctx, "DELETE", "treats/"+url.PathEscape(id), ifMatch("*"), nil, nil)
+	return err
+}
+
+// DeleteTreatIf deletes t, failing with a 412 Error if it has changed
+// since it was fetched, as UpdateTreat does.
+func (c *Client) DeleteTreatIf(ctx context.Context, t *Treat) error {
+	_, err := c.doHeader(ctx, "DELETE", "treats/"+url.PathEscape(t.ID), ifMatch(t.ETag), nil, nil)
+	return err
+}
+
+// ifMatch returns an If-Match header for etag, or nil if it is empty.
+func ifMatch(etag string) http.Header {
+	if etag == "" {
+		return nil
+	}
+	return http.Header{"If-Match": {etag}}
+}
+
+// BatchResult is the outcome for one treat of BatchCreateTreats or
+// BatchUpdateTreats.
+type BatchResult struct {
+	// Status is the HTTP status the single-treat call would have returned.
+	Status int
+	// Error says why the treat wasn't saved, if it wasn't.
+	Error string
+	// Treat is the saved treat, or nil if it wasn't saved.
+	Treat *Treat
+}
+
+// BatchCreateTreats creates up to 500 treats at once. Treats that are
+// invalid don't stop the others; the results, in the order of treats, say
+// which were created.
+func (c *Client) BatchCreateTreats(ctx context.Context, treats []*Treat) ([]*BatchResult, error) {
+	return c.batch(ctx, "batchCreate", treats)
+}
+
+// BatchUpdateTreats replaces up to 500 treats at once, each by its ID, as
+// BatchCreateTreats creates them.
+func (c *Client) BatchUpdateTreats(ctx context.Context, treats []*Treat) ([]*BatchResult, error) {
+	return c.batch(ctx, "batchUpdate", treats)
+}
+
+func (c *Client) batch(ctx context.Context, method string, treats []*Treat) ([]*BatchResult, error) {
+	var out struct{ Results []*BatchResult }
+	// "./" keeps the colon from reading as a URL scheme.
+	if _, err := c.do(ctx, "POST", "./treats:"+method, struct{ Treats []*Treat }{treats}, &out); err != nil {
+		return nil, err
+	}
+	return out.Results, nil
+}
+
+// do sends a request with an optional JSON body, decoding the JSON response
+// into out. Writes are sent with an Idempotency-Key so they can be retried.
+func (c *Client) do(ctx context.Context, method, path string, in, out interface{}) (*http.Response, error) {
+	return c.doHeader(ctx, method, path, nil, in, out)
+}
+
+// doHeader is do, sending the extra headers in h.
+func (c *Client) doHeader(ctx context.Context, method, path string, h http.Header, in, out interface{}) (*http.Response, error) {
+	rel, err := url.Parse(path)
+	if err != nil {
+		return nil, err
+	}
+	return c.doURL(ctx, method, c.base.ResolveReference(rel), h, in, out)
+}
+
+func (c *Client) doURL(ctx context.Context, method string, u *url.URL, h http.Header, in, out interface{}) (*http.Response, error) {
+	var body []byte
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return nil, fmt.Errorf("client: could not encode request: %v", err)
+		}
+		body = b
+	}
+	var key string
+	if method == "POST" || method == "PUT" || method == "PATCH" {
+		key = uuid.Must(uuid.NewV4()).String()
+	}
+
+	for attempt := 1; ; attempt++ {
+		resp, err := c.send(ctx, method, u, h, body, key)
+		if err == nil && resp.StatusCode < 300 {
+			defer resp.Body.Close()
+			if out != nil {
+				if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+					return nil, fmt.Errorf("client: could not decode response: %v", err)
+				}
+			}
+			return resp, nil
+		}
+		if err == nil {
+			err = errorFromResponse(resp)
+		}
+		if attempt >= c.retry.MaxAttempts || !retryable(err) {
+			return nil, err
+		}
+		select {
+		case <-time.After(c.retry.backoff(attempt)):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// send makes a single attempt at a request, with the extra headers in h.
+func (c *Client) send(ctx context.Context, method string, u *url.URL, h http.Header, body []byte, key string) (*http.Response, error) {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, u.String(), r)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	for k, vs := range h {
+		req.Header[k] = vs
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if key != "" {
+		req.Header.Set("Idempotency-Key", key)
+	}
+	if c.token != nil {
+		tok, err := c.token(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("client: could not get token: %v", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+tok)
+	}
+	return c.hc.Do(req)
+}
+
+// Error is an error response from the API, decoded from its RFC 7807
+// problem details.
+type Error struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Detail    string `json:"detail"`
+	Instance  string `json:"instance"`
+	RequestID string `json:"requestId"`
+}
+
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("treatshelf: %d %s", e.Status, e.Title)
+	if e.Detail != "" {
+		msg += ": " + e.Detail
+	}
+	if e.RequestID != "" {
+		msg += " (request ID " + e.RequestID + ")"
+	}
+	return msg
+}
+
+// errorFromResponse reads an error response and closes its body.
+func errorFromResponse(resp *http.Response) error {
+	defer resp.Body.Close()
+	b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<16))
+	e := &Error{}
+	if err := json.Unmarshal(b, e); err != nil || e.Status == 0 {
+		e = &Error{
+			Status: resp.StatusCode,
+			Title:  http.StatusText(resp.StatusCode),
+			Detail: strings.TrimSpace(string(b)),
+		}
+	}
+	if e.RequestID == "" {
+		e.RequestID = resp.Header.Get("X-Request-Id")
+	}
+	return e
+}
@@ -0,0 +1,208 @@
+package client
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/api/iterator"
+)
+
+// Treat is a treat on the shelf. See the Treat schema in openapi.yaml.
+type Treat struct {
+	ID            string
+	Title         string
+	Author        string
+	PublishedDate string
+	ImageURL      string
+	AltText       string
+	Caption       string
+	ThumbnailURL  string
+	Description   string
+
+	Nutrition *Nutrition
+	Allergens []string
+	Tags      []string
+
+	// Quantity is nil if the treat's portions aren't counted, see Int.
+	Quantity          *int
+	LowStockThreshold int
+
+	Price      *Price
+	LocationID string
+	Place      *Place
+
+	ExpiresAt    time.Time
+	Archived     bool
+	DeletedAt    time.Time
+	VisibleFrom  time.Time
+	VisibleUntil time.Time
+
+	Review       string
+	ReviewReason string
+
+	// ETag is the version of the treat when it was fetched, see
+	// UpdateTreat. It is empty for treats from ListTreats.
+	ETag string `json:"-"`
+}
+
+// Int returns a pointer to n, for Treat.Quantity.
+func Int(n int) *int {
+	return &n
+}
+
+// Nutrition holds nutrition facts for a single serving. Masses are in grams.
+type Nutrition struct {
+	ServingSize float64
+	Calories    float64
+	Sugar       float64
+	Fat         float64
+}
+
+// Price is an amount of money in minor units of an ISO 4217 currency.
+type Price struct {
+	Amount   int64
+	Currency string
+}
+
+// Place is where a treat can be picked up.
+type Place struct {
+	Address  string
+	Lat, Lng float64
+	Geohash  string
+}
+
+// ListOptions filters and orders the treats returned by ListTreats. The zero
+// value lists every visible, unexpired treat by title.
+type ListOptions struct {
+	Available      bool
+	IncludeExpired bool
+	IncludeHidden  bool // admins only.
+	LocationID     string
+	Tag            string
+
+	// Near and RadiusKm restrict the list to treats picked up nearby.
+	Near     *[2]float64 // lat, lng.
+	RadiusKm float64
+
+	Currency           string
+	MinPrice, MaxPrice string // decimal amounts in Currency, e.g. "1.50".
+
+	// Sort is "title", "price" or "-price".
+	Sort string
+
+	// PageSize is how many treats to fetch per request.
+	PageSize int
+
+	// Fields, if set, are the only fields fetched, such as "Title" and
+	// "ThumbnailURL"; ID is always fetched. The other fields of the treats
+	// listed are zero, so don't update them.
+	Fields []string
+}
+
+func (o *ListOptions) values() url.Values {
+	v := url.Values{}
+	if o == nil {
+		return v
+	}
+	set := func(k, s string) {
+		if s != "" {
+			v.Set(k, s)
+		}
+	}
+	if o.Available {
+		v.Set("available", "1")
+	}
+	if o.IncludeExpired {
+		v.Set("expired", "1")
+	}
+	if o.IncludeHidden {
+		v.Set("preview", "1")
+	}
+	set("location", o.LocationID)
+	set("tag", o.Tag)
+	if o.Near != nil {
+		v.Set("near", strconv.FormatFloat(o.Near[0], 'f', -1, 64)+","+strconv.FormatFloat(o.Near[1], 'f', -1, 64))
+	}
+	if o.RadiusKm > 0 {
+		v.Set("radius", strconv.FormatFloat(o.RadiusKm, 'f', -1, 64))
+	}
+	set("currency", o.Currency)
+	set("minPrice", o.MinPrice)
+	set("maxPrice", o.MaxPrice)
+	set("sort", o.Sort)
+	if o.PageSize > 0 {
+		v.Set("pageSize", strconv.Itoa(o.PageSize))
+	}
+	set("fields", strings.Join(o.Fields, ","))
+	return v
+}
+
+// ListTreats lists the treats matching opts, fetching pages as needed.
+func (c *Client) ListTreats(ctx context.Context, opts *ListOptions) *TreatIterator {
+	u := c.base.ResolveReference(&url.URL{Path: "treats"})
+	u.RawQuery = opts.values().Encode()
+	return &TreatIterator{ctx: ctx, c: c, next: u}
+}
+
+// TreatIterator iterates over the results of ListTreats.
+type TreatIterator struct {
+	ctx  context.Context
+	c    *Client
+	buf  []*Treat
+	next *url.URL // next page to fetch, nil after the last.
+	err  error
+}
+
+// Next returns the next treat. It returns iterator.Done when there are no
+// more treats.
+func (it *TreatIterator) Next() (*Treat, error) {
+	for len(it.buf) == 0 {
+		if it.err != nil {
+			return nil, it.err
+		}
+		if it.next == nil {
+			return nil, iterator.Done
+		}
+		it.fetch()
+	}
+	t := it.buf[0]
+	it.buf = it.buf[1:]
+	return t, nil
+}
+
+// fetch fetches the next page, following the Link headers to the one after.
+// There may be several, such as v1's link to its successor version.
+func (it *TreatIterator) fetch() {
+	var page []*Treat
+	resp, err := it.c.doURL(it.ctx, "GET", it.next, nil, nil, &page)
+	if err != nil {
+		it.err = err
+		return
+	}
+	it.buf = page
+	it.next = nil
+	if rel := nextLink(strings.Join(resp.Header["Link"], ",")); rel != "" {
+		if u, err := it.c.base.Parse(rel); err == nil {
+			it.next = u
+		}
+	}
+}
+
+// nextLink returns the rel="next" target of a Link header, or "".
+func nextLink(header string) string {
+	for _, link := range strings.Split(header, ",") {
+		parts := strings.Split(link, ";")
+		if len(parts) < 2 {
+			continue
+		}
+		for _, p := range parts[1:] {
+			if strings.TrimSpace(p) == `rel="next"` {
+				return strings.Trim(strings.TrimSpace(parts[0]), "<>")
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,40 @@
+package main
+
+import "time"
+
+// Clock tells the time. Treatshelf, the databases and their decorators read
+// it from the Clock they were given rather than calling time.Now, so that
+// tests can control what scheduled publishing (VisibleFrom and
+// VisibleUntil), expiry, undo windows, digests and the like see. It is
+// the system clock unless a test sets another.
+type Clock interface {
+	Now() time.Time
+	// After is time.After on this clock.
+	After(d time.Duration) <-chan time.Time
+}
+
+// systemClock is the real time.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                         { return time.Now() }
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// orSystemClock returns c, or the system clock if c is nil, so that values
+// built without a clock, such as a Treatshelf in a test, still tell the
+// time.
+func orSystemClock(c Clock) Clock {
+	if c == nil {
+		return systemClock{}
+	}
+	return c
+}
+
+// now returns the time on t's clock.
+func (t *Treatshelf) now() time.Time {
+	return orSystemClock(t.clock).Now()
+}
+
+// after is time.After on t's clock.
+func (t *Treatshelf) after(d time.Duration) <-chan time.Time {
+	return orSystemClock(t.clock).After(d)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a Clock for tests, which stands still until advanced.
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []fakeWaiter
+}
+
+// fakeWaiter is a channel returned by fakeClock.After, and when to send on
+// it.
+type fakeWaiter struct {
+	at time.Time
+	c  chan time.Time
+}
+
+// testEpoch is the time fake clocks start at.
+var testEpoch = time.Date(2024, 3, 14, 12, 0, 0, 0, time.UTC)
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: testEpoch}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	c.waiters = append(c.waiters, fakeWaiter{at: c.now.Add(d), c: ch})
+	return ch
+}
+
+// Advance moves the clock on by d, firing the channels returned by After
+// that are due.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	waiting := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.at.After(c.now) {
+			waiting = append(waiting, w)
+			continue
+		}
+		w.c <- c.now
+	}
+	c.waiters = waiting
+}
+
+// useFakeClock sets a fake clock on shelf and the memoryDB behind it, and
+// returns it.
+func useFakeClock(shelf *Treatshelf, db *memoryDB) *fakeClock {
+	c := newFakeClock()
+	shelf.clock, db.clock = c, c
+	return c
+}
+
+func TestFakeClockAfter(t *testing.T) {
+	c := newFakeClock()
+	soon, later := c.After(time.Second), c.After(time.Minute)
+	c.Advance(30 * time.Second)
+	select {
+	case at := <-soon:
+		if want := testEpoch.Add(30 * time.Second); !at.Equal(want) {
+			t.Errorf("After fired at %v, want %v", at, want)
+		}
+	default:
+		t.Error("After(1s) didn't fire after 30s")
+	}
+	select {
+	case <-later:
+		t.Error("After(1m) fired after 30s")
+	default:
+	}
+}
+
+func TestScheduledPublishing(t *testing.T) {
+	db := newMemoryDB()
+	shelf := &Treatshelf{DB: db, logWriter: ioutil.Discard}
+	clock := useFakeClock(shelf, db)
+	ctx := context.Background()
+	_, err := db.AddTreat(ctx, &Treat{
+		Title:        "Hot cross bun",
+		VisibleFrom:  testEpoch.Add(time.Hour),
+		VisibleUntil: testEpoch.Add(2 * time.Hour),
+		ExpiresAt:    testEpoch.Add(3 * time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		after                    time.Duration
+		listed, listedWithHidden bool
+	}{
+		{after: 0, listed: false, listedWithHidden: true},
+		{after: time.Hour, listed: true, listedWithHidden: true},
+		{after: 2 * time.Hour, listed: false, listedWithHidden: true},
+		// Expired treats are left out even with the hidden ones.
+		{after: 3 * time.Hour, listed: false, listedWithHidden: false},
+	}
+	elapsed := time.Duration(0)
+	for _, tt := range tests {
+		clock.Advance(tt.after - elapsed)
+		elapsed = tt.after
+		for _, includeHidden := range []bool{false, true} {
+			treats, err := db.ListTreats(ctx, ListOptions{IncludeHidden: includeHidden})
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := tt.listed
+			if includeHidden {
+				want = tt.listedWithHidden
+			}
+			if got := len(treats) == 1; got != want {
+				t.Errorf("%v in, IncludeHidden %v: listed %v, want %v", tt.after, includeHidden, got, want)
+			}
+		}
+	}
+}
+
+func TestUndoWindow(t *testing.T) {
+	shelf := goldenShelf(t)
+	shelf.undoWindow = defaultUndoWindow
+	clock := shelf.clock.(*fakeClock)
+	h := shelf.Handler()
+	ctx := context.Background()
+	undo := func(token string) {
+		r := httptest.NewRequest("POST", "/undo", strings.NewReader("token="+token))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != http.StatusFound {
+			t.Fatalf("undo: got status %d, want %d: %s", w.Code, http.StatusFound, w.Body)
+		}
+	}
+
+	token, err := shelf.softDelete(ctx, []string{"brownie"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(defaultUndoWindow - time.Second)
+	undo(token)
+	if treat, err := shelf.DB.GetTreat(ctx, "brownie"); err != nil || treat.Deleted() {
+		t.Fatalf("undo within the window left %+v, %v", treat, err)
+	}
+
+	token, err = shelf.softDelete(ctx, []string{"brownie"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(defaultUndoWindow + time.Second)
+	undo(token)
+	if treat, err := shelf.DB.GetTreat(ctx, "brownie"); err == nil && !treat.Deleted() {
+		t.Error("undo after the window restored the treat")
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/gorilla/mux"
+	"google.golang.org/api/iterator"
+)
+
+// Treats leave the hot collection for cold storage, JSON lines files in the
+// backup bucket, when they have been archived for longer than t.coldAfter
+// or when their undo window has passed after deletion. Admins can restore
+// them from /admin/cold-storage.
+
+// defaultColdAfter is how long after expiring archived treats are moved to
+// cold storage, unless COLD_STORAGE_AFTER_YEARS is set.
+const defaultColdAfter = 2 * 365 * 24 * time.Hour
+
+// coldPrefix is the folder of the backup bucket holding cold storage files.
+const coldPrefix = "cold/"
+
+// writeCold writes treats to a new cold storage file and returns its name,
+// without coldPrefix. reason ends up in the name, e.g. "archived".
+func (t *Treatshelf) writeCold(ctx context.Context, reason string, treats []*Treat) (string, error) {
+	bucket, err := t.backupBucket()
+	if err != nil {
+		return "", err
+	}
+	name := t.now().UTC().Format("20060102T150405.000000000Z") + "-" + reason + ".jsonl"
+	w := privateWriter(ctx, bucket.Object(coldPrefix+name).If(storage.Conditions{DoesNotExist: true}))
+	w.ContentType = "application/x-ndjson"
+	w.StorageClass = "COLDLINE"
+
+	if err := t.encodeCold(ctx, w, treats); err != nil {
+		w.Close()
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", fmt.Errorf("could not write %s%s: %v", coldPrefix, name, err)
+	}
+	return name, nil
+}
+
+// readCold calls fn with each treat in a cold storage file.
+func (t *Treatshelf) readCold(ctx context.Context, name string, fn func(*Treat) error) error {
+	bucket, err := t.backupBucket()
+	if err != nil {
+		return err
+	}
+	rd, err := bucket.Object(coldPrefix + name).NewReader(ctx)
+	if err != nil {
+		return fmt.Errorf("could not read %s%s: %v", coldPrefix, name, err)
+	}
+	defer rd.Close()
+	if err := t.decodeCold(ctx, bufio.NewReader(rd), fn); err != nil {
+		return fmt.Errorf("could not read %s%s: %v", coldPrefix, name, err)
+	}
+	return nil
+}
+
+// coldTreat is a treat as stored in cold storage files. Unlike the API's
+// JSON, it keeps the fields only the server sees, so that restored treats
+// keep their owner, notes and reports.
+type coldTreat struct {
+	*Treat
+	CreatedBy     string
+	InternalNotes string
+	Reports       int
+}
+
+// encodeCold writes treats to w as JSON lines of coldTreat. Sensitive
+// fields stay encrypted if t.encrypted is set.
+func (t *Treatshelf) encodeCold(ctx context.Context, w io.Writer, treats []*Treat) error {
+	enc := json.NewEncoder(w)
+	for _, treat := range treats {
+		if t.encrypted != nil {
+			var err error
+			if treat, err = t.encrypted.encryptTreat(ctx, treat); err != nil {
+				return err
+			}
+		}
+		if err := enc.Encode(coldTreat{treat, treat.CreatedBy, treat.InternalNotes, treat.Reports}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodeCold calls fn with each treat encodeCold wrote to r.
+func (t *Treatshelf) decodeCold(ctx context.Context, r io.Reader, fn func(*Treat) error) error {
+	dec := json.NewDecoder(r)
+	for dec.More() {
+		ct := coldTreat{Treat: &Treat{}}
+		if err := dec.Decode(&ct); err != nil {
+			return fmt.Errorf("could not decode treat: %v", err)
+		}
+		treat := ct.Treat
+		treat.CreatedBy, treat.InternalNotes, treat.Reports = ct.CreatedBy, ct.InternalNotes, ct.Reports
+		if t.encrypted != nil {
+			if err := t.encrypted.decryptTreat(ctx, treat); err != nil {
+				return err
+			}
+		}
+		if err := fn(treat); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// coldStorageHandler moves treats archived for longer than t.coldAfter to
+// cold storage. It is run by App Engine cron, see cron.yaml.
+func (t *Treatshelf) coldStorageHandler(w http.ResponseWriter, r *http.Request) *appError {
+	ctx := r.Context()
+	cutoff := t.now().Add(-t.coldAfter)
+	var old []*Treat
+	err := t.DB.EachTreat(ctx, allTreatsOptions, func(treat *Treat) error {
+		if treat.Archived && !treat.ExpiresAt.IsZero() && treat.ExpiresAt.Before(cutoff) {
+			old = append(old, treat)
+		}
+		return nil
+	})
+	if err != nil {
+		return t.appErrorf(r, err, "could not list archived treats: %v", err)
+	}
+	if len(old) == 0 {
+		fmt.Fprintln(w, "No treats to move to cold storage")
+		return nil
+	}
+
+	name, err := t.writeCold(ctx, "archived", old)
+	if err != nil {
+		return t.appErrorf(r, err, "could not write cold storage: %v", err)
+	}
+	// The file is written, so a failure here leaves treats in both places;
+	// the next run moves them again.
+	for i, treat := range old {
+		if err := t.DB.DeleteTreat(ctx, treat.ID); err != nil {
+			return t.appErrorf(r, err, "moved %d of %d treats to %s: DeleteTreat: %v", i, len(old), name, err)
+		}
+	}
+	fmt.Fprintf(t.logWriter, "Moved %d archived treats to cold storage in %s\n", len(old), name)
+	fmt.Fprintf(w, "Moved %d archived treats to cold storage in %s\n", len(old), name)
+	return nil
+}
+
+// coldFile describes a cold storage file on the admin page.
+type coldFile struct {
+	Name    string
+	Size    int64
+	Created time.Time
+}
+
+// coldStorageAdminHandler lists the cold storage files, newest first, with
+// forms to restore treats from them.
+func (t *Treatshelf) coldStorageAdminHandler(w http.ResponseWriter, r *http.Request) *appError {
+	bucket, err := t.backupBucket()
+	if err != nil {
+		return t.appErrorCodef(r, http.StatusServiceUnavailable, err, "%v", err)
+	}
+	var files []coldFile
+	it := bucket.Objects(r.Context(), &storage.Query{Prefix: coldPrefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return t.appErrorf(r, err, "could not list cold storage: %v", err)
+		}
+		files = append(files, coldFile{
+			Name:    strings.TrimPrefix(attrs.Name, coldPrefix),
+			Size:    attrs.Size,
+			Created: attrs.Created,
+		})
+	}
+	// Names start with the time they were written.
+	for i, j := 0, len(files)-1; i < j; i, j = i+1, j-1 {
+		files[i], files[j] = files[j], files[i]
+	}
+	return coldStorageTmpl.Execute(t, w, r, struct {
+		Files []coldFile
+	}{files})
+}
+
+// coldRestoreHandler restores treats from a cold storage file: the one with
+// the posted "id", or every treat in the file if there is none. Treats whose
+// ID is back in the hot collection already are left alone, so restoring
+// twice doesn't overwrite later edits.
+func (t *Treatshelf) coldRestoreHandler(w http.ResponseWriter, r *http.Request) *appError {
+	ctx := r.Context()
+	name := mux.Vars(r)["name"]
+	id := strings.TrimSpace(r.FormValue("id"))
+
+	var treats []*Treat
+	err := t.readCold(ctx, name, func(treat *Treat) error {
+		if id == "" || treat.ID == id {
+			treats = append(treats, treat)
+		}
+		return nil
+	})
+	if err != nil {
+		return t.appErrorf(r, err, "%v", err)
+	}
+	if len(treats) == 0 {
+		err := fmt.Errorf("no treat %q in %s", id, name)
+		return t.appErrorCodef(r, http.StatusNotFound, err, "%v", err)
+	}
+
+	ids := make([]string, len(treats))
+	for i, treat := range treats {
+		ids[i] = treat.ID
+	}
+	existing, err := t.DB.GetTreats(ctx, ids)
+	if err != nil {
+		return t.appErrorf(r, err, "GetTreats: %v", err)
+	}
+	restored := 0
+	for i, treat := range treats {
+		if existing[i] != nil {
+			continue
+		}
+		// Deleted treats come back undeleted; archived ones stay archived.
+		treat.DeletedAt, treat.UndoToken = time.Time{}, ""
+		if err := t.DB.UpdateTreat(ctx, treat); err != nil {
+			return t.appErrorf(r, err, "restored %d treats from %s: UpdateTreat: %v", restored, name, err)
+		}
+		restored++
+	}
+
+	msg := fmt.Sprintf("Restored %d treats from %s.", restored, name)
+	if skipped := len(treats) - restored; skipped > 0 {
+		msg += fmt.Sprintf(" %d were already on the shelf.", skipped)
+	}
+	fmt.Fprintln(t.logWriter, msg)
+	setFlash(w, &flash{Message: msg})
+	http.Redirect(w, r, t.routeURL("coldStorage"), http.StatusFound)
+	return nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestColdStorageKeepsServerFields(t *testing.T) {
+	tests := []struct {
+		name    string
+		encrypt bool
+	}{
+		{"plain", false},
+		{"encrypted", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			shelf, _ := newTestShelf(t)
+			if tt.encrypt {
+				w := &localWrapper{primary: "test", keys: map[string][]byte{"test": make([]byte, 32)}}
+				shelf.encrypted = newEncryptedDB(shelf.DB, w)
+			}
+			ctx := context.Background()
+			archived := &Treat{
+				ID:            "1",
+				Title:         "Brownie",
+				Archived:      true,
+				CreatedBy:     "owner@example.com",
+				InternalNotes: "Supplier: Bakery Ltd",
+				Reports:       2,
+			}
+			var file bytes.Buffer
+			if err := shelf.encodeCold(ctx, &file, []*Treat{archived}); err != nil {
+				t.Fatal(err)
+			}
+			if tt.encrypt && strings.Contains(file.String(), archived.InternalNotes) {
+				t.Errorf("cold storage file holds the notes in plain text: %s", file.String())
+			}
+
+			var restored []*Treat
+			err := shelf.decodeCold(ctx, &file, func(treat *Treat) error {
+				restored = append(restored, treat)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(restored) != 1 {
+				t.Fatalf("restored %d treats, want 1", len(restored))
+			}
+			got := restored[0]
+			if got.CreatedBy != archived.CreatedBy {
+				t.Errorf("CreatedBy = %q, want %q", got.CreatedBy, archived.CreatedBy)
+			}
+			if got.InternalNotes != archived.InternalNotes {
+				t.Errorf("InternalNotes = %q, want %q", got.InternalNotes, archived.InternalNotes)
+			}
+			if got.Reports != archived.Reports {
+				t.Errorf("Reports = %d, want %d", got.Reports, archived.Reports)
+			}
+			if got.Title != archived.Title || !got.Archived {
+				t.Errorf("restored %+v, want %+v", got, archived)
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// The command palette (templates/partials/palette.html), opened with
+// Ctrl+K or "?", lists what the current user can do from anywhere, and
+// keyboard shortcuts run the common commands directly. Commands are listed
+// by the server, at /api/v1/commands, so that the palette only offers what
+// the policy allows.
+
+// Command is an action the palette offers.
+type Command struct {
+	ID    string
+	Title string
+	// URL is where the command goes. Commands with a Method other than GET
+	// submit a form there instead.
+	URL    string
+	Method string `json:",omitempty"`
+	// Param, if set, is the query parameter the palette fills with what
+	// was typed, such as "q" for searches.
+	Param string `json:",omitempty"`
+	// Shortcut is the key sequence that runs the command, such as "g t".
+	Shortcut string `json:",omitempty"`
+}
+
+// commands returns the commands r's user may run, those used most first.
+func (t *Treatshelf) commands(r *http.Request) []*Command {
+	cmds := []*Command{
+		{ID: "search", Title: "Search treats", URL: t.routeURL("treats"), Param: "q", Shortcut: "/"},
+		{ID: "treats", Title: "Go to treats", URL: t.routeURL("treats"), Shortcut: "g t"},
+		{ID: "addTreat", Title: "Add a treat", URL: t.routeURL("addTreat"), Shortcut: "n"},
+		{ID: "toggleTheme", Title: "Toggle dark theme", URL: t.routeURL("toggleTheme"), Method: "POST", Shortcut: "shift+t"},
+		{ID: "settings", Title: "Go to settings", URL: t.routeURL("settings"), Shortcut: "g s"},
+		{ID: "locations", Title: "Go to locations", URL: t.routeURL("locations"), Shortcut: "g l"},
+	}
+	for _, s := range t.savedSearches(r) {
+		cmds = append(cmds, &Command{ID: "shelf:" + s.ID, Title: fmt.Sprintf("Go to shelf %q", s.Name), URL: t.routeURL("shelf", "id", s.ID)})
+	}
+	if t.currentUser(r) != "" {
+		if t.Profiles != nil {
+			cmds = append(cmds, &Command{ID: "profile", Title: "Go to your profile", URL: t.routeURL("profile"), Shortcut: "g p"})
+		}
+		if t.Tokens != nil {
+			cmds = append(cmds, &Command{ID: "tokens", Title: "Manage API tokens", URL: t.routeURL("tokens")})
+		}
+	}
+	if t.isAdmin(r) {
+		cmds = append(cmds,
+			&Command{ID: "allTreats", Title: "Admin: all treats", URL: t.routeURL("allTreats"), Shortcut: "g a"},
+			&Command{ID: "reviewQueue", Title: "Admin: review queue", URL: t.routeURL("reviewQueue"), Shortcut: "g r"},
+			&Command{ID: "tags", Title: "Admin: tags", URL: t.routeURL("tags")},
+		)
+	}
+	_, login := t.signedInUsers(r)
+	switch {
+	case len(t.authProviders) == 0:
+	case login != "":
+		cmds = append(cmds, &Command{ID: "logout", Title: "Sign out", URL: t.routeURL("logout"), Method: "POST"})
+	case t.currentUser(r) == "":
+		cmds = append(cmds, &Command{ID: "login", Title: "Sign in", URL: t.routeURL("login")})
+	}
+	cmds = append(cmds, &Command{ID: "apiDocs", Title: "API documentation", URL: t.routeURL("apiDocs")})
+	return cmds
+}
+
+// apiCommandsHandler returns the commands the current user may run.
+func (t *Treatshelf) apiCommandsHandler(w http.ResponseWriter, r *http.Request) *appError {
+	writeJSON(w, http.StatusOK, t.commands(r))
+	return nil
+}
+
+// toggleThemeHandler switches between the light and dark themes, keeping
+// the other preferences, and returns to the "next" path.
+func (t *Treatshelf) toggleThemeHandler(w http.ResponseWriter, r *http.Request) *appError {
+	p := t.preferences(r)
+	if p.Theme == "dark" {
+		p.Theme = "light"
+	} else {
+		p.Theme = "dark"
+	}
+	// As in saveSettingsHandler, anonymous preferences are keyed by a
+	// session the browser must keep.
+	s := t.session(r)
+	if err := t.saveSession(w, s); err != nil {
+		return t.appErrorf(r, err, "could not save session: %v", err)
+	}
+	key := "session:" + s.ID
+	if u := t.currentUser(r); u != "" {
+		key = "user:" + u
+	}
+	if err := t.Preferences.SetPreferences(r.Context(), key, p); err != nil {
+		return t.appErrorf(r, err, "could not save settings: %v", err)
+	}
+	next := safeNext(r.FormValue("next"))
+	if next == "" {
+		next = t.routeURL("treats")
+	}
+	http.Redirect(w, r, next, http.StatusFound)
+	return nil
+}
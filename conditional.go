@@ -0,0 +1,92 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// API GETs of a treat return its version as an ETag. Clients send it back
+// in If-Match when they replace or delete the treat, which fails with 412
+// Precondition Failed if someone changed it since, rather than silently
+// overwriting their change. Writes without If-Match fail with 428, unless
+// REQUIRE_IF_MATCH is false; clients that mean to overwrite whatever is
+// there send "If-Match: *".
+//
+// Treats don't store a version, so the ETag is a hash of the treat as the
+// API returns it. It is compared inside the write (see ChangeTreat), so a
+// write landing in between fails the check rather than being overwritten.
+
+// treatETag returns the ETag of treat's current version.
+func treatETag(treat *Treat) string {
+	b, err := json.Marshal(treat)
+	if err != nil {
+		// Treats always marshal; an ETag that matches nothing is safe.
+		return `"invalid"`
+	}
+	sum := sha256.Sum256(b)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// setETag sets the ETag header to treat's.
+func setETag(w http.ResponseWriter, treat *Treat) {
+	w.Header().Set("ETag", treatETag(treat))
+}
+
+var (
+	errIfMatchRequired = errors.New("send the treat's ETag in If-Match")
+	errETagMismatch    = errors.New("the treat was changed since you fetched it; fetch it again")
+)
+
+// ifMatch returns errETagMismatch unless r's If-Match header names the
+// current version of treat, or is "*". A missing header fails with
+// errIfMatchRequired unless t.optionalIfMatch is set.
+func (t *Treatshelf) ifMatch(r *http.Request, treat *Treat) error {
+	h := strings.TrimSpace(r.Header.Get("If-Match"))
+	if h == "" {
+		if t.optionalIfMatch {
+			return nil
+		}
+		return errIfMatchRequired
+	}
+	current := treatETag(treat)
+	for _, tag := range strings.Split(h, ",") {
+		// If-Match compares strongly, so weak tags never match.
+		if tag = strings.TrimSpace(tag); tag == "*" || tag == current {
+			return nil
+		}
+	}
+	return errETagMismatch
+}
+
+// ifMatchError returns the appError for an error returned by ifMatch, or
+// nil if err isn't one.
+func (t *Treatshelf) ifMatchError(r *http.Request, err error) *appError {
+	switch err {
+	case errIfMatchRequired:
+		return t.appErrorCodef(r, http.StatusPreconditionRequired, err, "%v", err).withProblemType("if-match-required")
+	case errETagMismatch:
+		return t.appErrorCodef(r, http.StatusPreconditionFailed, err, "%v", err).withProblemType("etag-mismatch")
+	}
+	return nil
+}
+
+// notModified reports whether r's If-None-Match header names the current
+// version of treat, in which case a GET can answer 304.
+func notModified(r *http.Request, treat *Treat) bool {
+	h := r.Header.Get("If-None-Match")
+	if h == "" {
+		return false
+	}
+	current := treatETag(treat)
+	for _, tag := range strings.Split(h, ",") {
+		// If-None-Match compares weakly.
+		if tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/"); tag == "*" || tag == current {
+			return true
+		}
+	}
+	return false
+}
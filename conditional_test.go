@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestIfMatch(t *testing.T) {
+	current := treatETag(&Treat{ID: "1", Title: "Brownie"})
+	tests := []struct {
+		name     string
+		ifMatch  string
+		optional bool
+		want     int
+	}{
+		{"missing", "", false, http.StatusPreconditionRequired},
+		{"missing but optional", "", true, http.StatusOK},
+		{"current", current, false, http.StatusOK},
+		{"any", "*", false, http.StatusOK},
+		{"one of several", `"stale", ` + current, false, http.StatusOK},
+		{"stale", `"stale"`, false, http.StatusPreconditionFailed},
+		{"weak", "W/" + current, false, http.StatusPreconditionFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			shelf := brownieShelf(t)
+			shelf.optionalIfMatch = tt.optional
+			r := httptest.NewRequest("PATCH", "/api/v1/treats/1?updateMask=Title", strings.NewReader(`{"Title": "Fudge brownie"}`))
+			if tt.ifMatch != "" {
+				r.Header.Set("If-Match", tt.ifMatch)
+			}
+			r = mux.SetURLVars(r, map[string]string{"id": "1"})
+			w := httptest.NewRecorder()
+			got := http.StatusOK
+			if e := shelf.apiPatchHandler(w, r); e != nil {
+				got = e.code
+			}
+			if got != tt.want {
+				t.Errorf("PATCH with If-Match %q: got status %d, want %d", tt.ifMatch, got, tt.want)
+			}
+		})
+	}
+}
+
+// racingDB changes a treat just before ChangeTreat reads it, as a request
+// landing between a handler's own read and its write would.
+type racingDB struct {
+	TreatDatabase
+}
+
+func (db racingDB) ChangeTreat(ctx context.Context, id string, change func(*Treat) ([]string, error)) (*Treat, error) {
+	if err := db.UpdateTreat(ctx, &Treat{ID: id, Title: "Blondie"}); err != nil {
+		return nil, err
+	}
+	return db.TreatDatabase.ChangeTreat(ctx, id, change)
+}
+
+func TestIfMatchChecksWhatItReplaces(t *testing.T) {
+	etag := treatETag(&Treat{ID: "1", Title: "Brownie"})
+	tests := []struct {
+		method  string
+		body    string
+		handler func(*Treatshelf) func(http.ResponseWriter, *http.Request) *appError
+	}{
+		{"PUT", `{"Title": "Fudge brownie"}`, func(t *Treatshelf) func(http.ResponseWriter, *http.Request) *appError { return t.apiUpdateHandler }},
+		{"PATCH", `{"Title": "Fudge brownie"}`, func(t *Treatshelf) func(http.ResponseWriter, *http.Request) *appError { return t.apiPatchHandler }},
+		{"DELETE", "", func(t *Treatshelf) func(http.ResponseWriter, *http.Request) *appError { return t.apiDeleteHandler }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method, func(t *testing.T) {
+			shelf := brownieShelf(t)
+			db := shelf.DB
+			shelf.DB = racingDB{db}
+			r := httptest.NewRequest(tt.method, "/api/v1/treats/1?updateMask=Title", strings.NewReader(tt.body))
+			r.Header.Set("If-Match", etag)
+			r = mux.SetURLVars(r, map[string]string{"id": "1"})
+			e := tt.handler(shelf)(httptest.NewRecorder(), r)
+			if e == nil || e.code != http.StatusPreconditionFailed {
+				t.Fatalf("%s of a treat changed since its ETag was read = %v, want 412", tt.method, e)
+			}
+			got, err := db.GetTreat(context.Background(), "1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Title != "Blondie" || got.Deleted() {
+				t.Errorf("%s overwrote the other change: %+v", tt.method, got)
+			}
+		})
+	}
+}
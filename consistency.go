@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Consistency is how up to date reads of treats must be.
+type Consistency int
+
+const (
+	// ConsistencyStrong reads see every committed write. It is the
+	// default.
+	ConsistencyStrong Consistency = iota
+
+	// ConsistencyEventual reads may be served by a replica that lags
+	// behind by a few seconds, if the database has one.
+	ConsistencyEventual
+)
+
+// consistencyKey is the context key for the Consistency of a request's
+// reads, see withConsistency.
+type consistencyKey struct{}
+
+// withConsistency returns a copy of ctx in which GetTreat reads with the
+// given consistency. Lists take theirs from ListOptions.Consistency.
+func withConsistency(ctx context.Context, c Consistency) context.Context {
+	return context.WithValue(ctx, consistencyKey{}, c)
+}
+
+// consistencyFrom returns the consistency set by withConsistency, or
+// ConsistencyStrong.
+func consistencyFrom(ctx context.Context) Consistency {
+	c, _ := ctx.Value(consistencyKey{}).(Consistency)
+	return c
+}
+
+const (
+	// wroteCookie marks a browser that has just written, see
+	// readConsistency.
+	wroteCookie = "treatshelf_wrote"
+
+	// wroteWindow is how long reads stay strong after a write: longer than
+	// a replica is expected to lag.
+	wroteWindow = 10 * time.Second
+)
+
+// readConsistency is mux middleware choosing the consistency of page reads.
+// Pages read eventually, so they can be served by a nearby replica, except
+// for a short while after the browser writes, so that the redirect after a
+// write shows it. API reads are always strong.
+func (t *Treatshelf) readConsistency(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method != "GET" && r.Method != "HEAD":
+			http.SetCookie(w, &http.Cookie{
+				Name:     wroteCookie,
+				Value:    "1",
+				Path:     "/",
+				MaxAge:   int(wroteWindow / time.Second),
+				HttpOnly: true,
+				SameSite: http.SameSiteLaxMode,
+			})
+		case strings.HasPrefix(r.URL.Path, t.url("/api/")):
+		default:
+			if _, err := r.Cookie(wroteCookie); err != nil {
+				r = r.WithContext(withConsistency(r.Context(), ConsistencyEventual))
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// strongReads wraps h to read with strong consistency, for pages such as the
+// edit form whose reads are written back.
+func strongReads(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(w, r.WithContext(withConsistency(r.Context(), ConsistencyStrong)))
+	})
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cjnorman87/cloudTings/client"
+	"google.golang.org/api/iterator"
+)
+
+// The tests below check that the client package and the API agree, by
+// using every client method against the app serving a memoryDB. The
+// exchanges on the wire are compared with those in testdata/contract, so
+// that a change to either side that alters the contract shows up in
+// review. After an intended change, rewrite them with
+//
+//	go test -run TestContract -update
+//
+// and check the diff, remembering that clients already released still
+// send and expect the old exchanges.
+
+// contractHeaders are the headers recorded in exchanges.
+var contractHeaders = []string{"Content-Type", "If-Match", "ETag", "Location", "Link", "Deprecation"}
+
+// exchange is a request made by the client and the API's response to it.
+type exchange struct {
+	Request  message
+	Response message
+}
+
+type message struct {
+	Method string            `json:",omitempty"`
+	URL    string            `json:",omitempty"`
+	Status int               `json:",omitempty"`
+	Header map[string]string `json:",omitempty"`
+	Body   interface{}       `json:",omitempty"`
+}
+
+// recorder is an http.RoundTripper that signs requests in as email, through
+// the IAP header, and records the exchanges.
+type recorder struct {
+	email     string
+	exchanges []exchange
+}
+
+func (rec *recorder) RoundTrip(r *http.Request) (*http.Response, error) {
+	r.Header.Set(iapEmailHeader, "accounts.google.com:"+rec.email)
+	var x exchange
+	x.Request = message{Method: r.Method, URL: r.URL.RequestURI(), Header: recordedHeader(r.Header)}
+	if r.Body != nil {
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return nil, err
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(b))
+		x.Request.Body = recordedBody(b)
+	}
+	resp, err := http.DefaultTransport.RoundTrip(r)
+	if err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(b))
+	x.Response = message{Status: resp.StatusCode, Header: recordedHeader(resp.Header), Body: recordedBody(b)}
+	rec.exchanges = append(rec.exchanges, x)
+	return resp, nil
+}
+
+func recordedHeader(h http.Header) map[string]string {
+	m := make(map[string]string)
+	for _, k := range contractHeaders {
+		if vs := h[k]; len(vs) > 0 {
+			m[k] = strings.Join(vs, ", ")
+		}
+	}
+	return m
+}
+
+// recordedBody decodes a JSON body, replacing the request IDs of problem
+// details, which differ on every run.
+func recordedBody(b []byte) interface{} {
+	if len(bytes.TrimSpace(b)) == 0 {
+		return nil
+	}
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return string(b)
+	}
+	if m, ok := v.(map[string]interface{}); ok && m["requestId"] != nil {
+		m["requestId"] = "<request ID>"
+	}
+	return v
+}
+
+// contractClient starts the app with goldenShelf's treats and returns a
+// client signed in as admin@example.com, its recorder and the server, for
+// the caller to close.
+func contractClient(t *testing.T) (*client.Client, *recorder, *httptest.Server) {
+	srv := httptest.NewServer(goldenShelf(t).Handler())
+	rec := &recorder{email: "admin@example.com"}
+	c, err := client.New(srv.URL, client.WithHTTPClient(&http.Client{Transport: rec}))
+	if err != nil {
+		srv.Close()
+		t.Fatal(err)
+	}
+	return c, rec, srv
+}
+
+// checkContract compares the exchanges rec recorded with
+// testdata/contract/<name>.json, or rewrites that file with -update.
+func checkContract(t *testing.T, name string, rec *recorder) {
+	got, err := contractJSON(rec.exchanges)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join("testdata", "contract", name+".json")
+	if *update {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v; run with -update to create it", err)
+	}
+	var gotX, wantX []exchange
+	json.Unmarshal(got, &gotX)
+	if err := json.Unmarshal(want, &wantX); err != nil {
+		t.Fatalf("%s: %v", path, err)
+	}
+	for i := 0; i < len(gotX) || i < len(wantX); i++ {
+		var g, w []byte
+		if i < len(gotX) {
+			g, _ = contractJSON(gotX[i])
+		}
+		if i < len(wantX) {
+			w, _ = contractJSON(wantX[i])
+		}
+		if !bytes.Equal(g, w) {
+			t.Fatalf("exchange %d differs from %s:\ngot:  %s\nwant: %s\nRun with -update if the change is intended.", i, path, g, w)
+		}
+	}
+}
+
+// contractJSON encodes v for testdata/contract, indented and without
+// escaping the angle brackets of Link headers.
+func contractJSON(v interface{}) ([]byte, error) {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	err := enc.Encode(v)
+	return b.Bytes(), err
+}
+
+// wantError fails t unless err is a *client.Error with the given status
+// and problem type, "about:blank" if slug is empty.
+func wantError(t *testing.T, err error, status int, slug string) {
+	t.Helper()
+	e, ok := err.(*client.Error)
+	if !ok {
+		t.Fatalf("got error %v, want a *client.Error", err)
+	}
+	typ := "about:blank"
+	if slug != "" {
+		typ = problemTypeBase + slug
+	}
+	if e.Status != status || e.Type != typ || e.RequestID == "" {
+		t.Fatalf("got %+v, want status %d, type %s and a request ID", e, status, typ)
+	}
+}
+
+func TestClientTreatMatchesAPI(t *testing.T) {
+	api, c := jsonFields(reflect.TypeOf(Treat{})), jsonFields(reflect.TypeOf(client.Treat{}))
+	for name, typ := range api {
+		if c[name] == "" {
+			t.Errorf("client.Treat lacks %s, which the API sends", name)
+		} else if c[name] != typ {
+			t.Errorf("client.Treat.%s is a %s, but the API sends a %s", name, c[name], typ)
+		}
+	}
+	for name := range c {
+		if api[name] == "" {
+			t.Errorf("client.Treat has %s, which the API doesn't send", name)
+		}
+	}
+}
+
+// jsonFields returns the jsonKind of each field typ encodes, by name.
+func jsonFields(typ reflect.Type) map[string]string {
+	fields := make(map[string]string)
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		if f.PkgPath != "" || f.Tag.Get("json") == "-" {
+			continue
+		}
+		fields[f.Name] = jsonKind(f.Type)
+	}
+	return fields
+}
+
+// jsonKind describes the JSON that values of typ encode to, such as "int"
+// or "{Amount:int Currency:string}".
+func jsonKind(typ reflect.Type) string {
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	switch {
+	case typ == reflect.TypeOf(time.Time{}):
+		return "time"
+	case typ.Kind() == reflect.Struct:
+		var fields []string
+		for name, kind := range jsonFields(typ) {
+			fields = append(fields, name+":"+kind)
+		}
+		sort.Strings(fields)
+		return "{" + strings.Join(fields, " ") + "}"
+	case typ.Kind() == reflect.Slice:
+		return "[]" + jsonKind(typ.Elem())
+	case typ.Kind() >= reflect.Int && typ.Kind() <= reflect.Int64:
+		return "int"
+	}
+	return typ.Kind().String()
+}
+
+func TestContractCreateAndGet(t *testing.T) {
+	c, rec, srv := contractClient(t)
+	defer srv.Close()
+	ctx := context.Background()
+	want := &client.Treat{
+		Title:         "Carrot cake",
+		Author:        "Sam",
+		PublishedDate: "2021-04-01",
+		ImageURL:      "https://example.com/cake.jpg",
+		AltText:       "A slice of carrot cake",
+		Description:   "With cream cheese frosting.",
+		Nutrition:     &client.Nutrition{ServingSize: 80, Calories: 320, Sugar: 30, Fat: 15},
+		Allergens:     []string{"dairy", "eggs", "gluten"},
+		Tags:          []string{"cake"},
+		Quantity:      client.Int(8),
+		Price:         &client.Price{Amount: 300, Currency: "GBP"},
+		LocationID:    "1",
+		Place:         &client.Place{Address: "1 Main St", Lat: 51.5, Lng: -0.12},
+		ExpiresAt:     time.Date(2099, 6, 1, 12, 0, 0, 0, time.UTC),
+	}
+	created, err := c.CreateTreat(ctx, want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.ID == "" || created.ETag == "" {
+		t.Fatalf("created treat has ID %q and ETag %q", created.ID, created.ETag)
+	}
+	got, err := c.GetTreat(ctx, created.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ETag != created.ETag {
+		t.Errorf("GetTreat ETag %s, CreateTreat gave %s", got.ETag, created.ETag)
+	}
+	// The server fills in the geohash.
+	want.ID, want.ETag, want.Place.Geohash = got.ID, got.ETag, got.Place.Geohash
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("GetTreat after CreateTreat:\ngot  %+v\nwant %+v", got, want)
+	}
+
+	_, err = c.CreateTreat(ctx, &client.Treat{Title: "Cake", Quantity: client.Int(-1)})
+	wantError(t, err, http.StatusBadRequest, "validation-failed")
+	_, err = c.GetTreat(ctx, "nope")
+	wantError(t, err, http.StatusNotFound, "")
+	checkContract(t, "create-and-get", rec)
+}
+
+func TestContractUpdate(t *testing.T) {
+	c, rec, srv := contractClient(t)
+	defer srv.Close()
+	ctx := context.Background()
+	treat, err := c.GetTreat(ctx, "pie")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale := *treat
+	treat.Quantity = client.Int(4)
+	updated, err := c.UpdateTreat(ctx, treat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.Quantity == nil || *updated.Quantity != 4 || updated.ETag == stale.ETag {
+		t.Errorf("UpdateTreat gave %+v", updated)
+	}
+	_, err = c.UpdateTreat(ctx, &stale)
+	wantError(t, err, http.StatusPreconditionFailed, "etag-mismatch")
+
+	updated.Tags, updated.Quantity = []string{"Apple", "apple", " fruit "}, client.Int(99)
+	patched, err := c.PatchTreat(ctx, updated, "Tags")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(patched.Tags, []string{"apple", "fruit"}) || patched.Quantity == nil || *patched.Quantity != 4 {
+		t.Errorf("PatchTreat of Tags gave tags %q and quantity %v", patched.Tags, patched.Quantity)
+	}
+	_, err = c.PatchTreat(ctx, patched, "Nope")
+	wantError(t, err, http.StatusBadRequest, "")
+	checkContract(t, "update", rec)
+}
+
+func TestContractDelete(t *testing.T) {
+	c, rec, srv := contractClient(t)
+	defer srv.Close()
+	ctx := context.Background()
+	treat, err := c.GetTreat(ctx, "pie")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale := *treat
+	stale.ETag = `"stale"`
+	wantError(t, c.DeleteTreatIf(ctx, &stale), http.StatusPreconditionFailed, "etag-mismatch")
+	if err := c.DeleteTreatIf(ctx, treat); err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.GetTreat(ctx, "pie")
+	wantError(t, err, http.StatusNotFound, "")
+	wantError(t, c.DeleteTreat(ctx, "pie"), http.StatusNotFound, "")
+	checkContract(t, "delete", rec)
+}
+
+func TestContractList(t *testing.T) {
+	c, rec, srv := contractClient(t)
+	defer srv.Close()
+	ctx := context.Background()
+	for _, title := range []string{"Cookie", "Flapjack", "Scone"} {
+		if _, err := c.CreateTreat(ctx, &client.Treat{Title: title, Tags: []string{"baked"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	list := func(opts *client.ListOptions) []string {
+		var titles []string
+		it := c.ListTreats(ctx, opts)
+		for {
+			treat, err := it.Next()
+			if err == iterator.Done {
+				return titles
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			titles = append(titles, treat.Title)
+		}
+	}
+	all := []string{`Apple pie "à la mode"`, "Brownie", "Cookie", "Flapjack", "Scone"}
+	if got := list(&client.ListOptions{PageSize: 2}); !reflect.DeepEqual(got, all) {
+		t.Errorf("ListTreats in pages of 2 gave %q, want %q", got, all)
+	}
+	if got := list(&client.ListOptions{Tag: "baked", Fields: []string{"Title"}}); !reflect.DeepEqual(got, all[2:]) {
+		t.Errorf("ListTreats of tag baked gave %q", got)
+	}
+	it := c.ListTreats(ctx, &client.ListOptions{Sort: "nope"})
+	_, err := it.Next()
+	wantError(t, err, http.StatusBadRequest, "")
+	checkContract(t, "list", rec)
+}
+
+func TestContractBatch(t *testing.T) {
+	c, rec, srv := contractClient(t)
+	defer srv.Close()
+	ctx := context.Background()
+	results, err := c.BatchCreateTreats(ctx, []*client.Treat{{Title: "Cookie"}, {Title: ""}, {Title: "Scone", Quantity: client.Int(2)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var statuses []int
+	for _, res := range results {
+		statuses = append(statuses, res.Status)
+	}
+	if want := []int{201, 400, 201}; !reflect.DeepEqual(statuses, want) || results[0].Treat == nil || results[1].Error == "" {
+		t.Fatalf("BatchCreateTreats gave statuses %d, want %d: %+v", statuses, want, results)
+	}
+	scone := results[2].Treat
+	scone.Quantity = client.Int(1)
+	results, err = c.BatchUpdateTreats(ctx, []*client.Treat{scone, {ID: "nope", Title: "Nope"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 || results[0].Status != 200 || *results[0].Treat.Quantity != 1 || results[1].Status != 404 {
+		t.Fatalf("BatchUpdateTreats gave %+v", results)
+	}
+	checkContract(t, "batch", rec)
+}
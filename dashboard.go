@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// The admin dashboard at /admin charts the statistics served at
+// /api/v2/stats (see stats.go): treats added each month, over a range of
+// months, and the most used tags. The page draws the charts from the JSON
+// itself; /admin/stats.csv serves the same series for spreadsheets:
+//
+//	GET /admin/stats.csv?series=added&months=12
+//	GET /admin/stats.csv?series=tags
+//
+// Views of treats aren't counted anywhere, so there is no chart of them.
+
+// dashboardMonths are the ranges, in months, the dashboard offers for
+// additions; 0 is every month with additions.
+var dashboardMonths = []int{3, 12, 24, 0}
+
+// dashboardTopTags is how many tags the top tags chart and CSV show.
+const dashboardTopTags = 10
+
+// statsPoint is one point of a series charted on the dashboard.
+type statsPoint struct {
+	Label string
+	Count int
+}
+
+// addedSeries returns the number of treats added in each of the last
+// months months, up to the month s was computed in, oldest first. Months
+// without additions are included. If months is 0, the series starts at
+// the first month with additions.
+func (s *TreatStats) addedSeries(months int) []statsPoint {
+	end := s.Computed.UTC()
+	end = time.Date(end.Year(), end.Month(), 1, 0, 0, 0, 0, time.UTC)
+	start := end.AddDate(0, 1-months, 0)
+	if months <= 0 {
+		start = end
+		for m := range s.AddedByMonth {
+			if t, err := time.Parse(statsMonth, m); err == nil && t.Before(start) {
+				start = t
+			}
+		}
+	}
+	var series []statsPoint
+	for m := start; !m.After(end); m = m.AddDate(0, 1, 0) {
+		label := m.Format(statsMonth)
+		series = append(series, statsPoint{label, s.AddedByMonth[label]})
+	}
+	return series
+}
+
+// topTags returns the n tags on the most treats, most first, ties by name.
+func (s *TreatStats) topTags(n int) []statsPoint {
+	var series []statsPoint
+	for tag, count := range s.ByTag {
+		series = append(series, statsPoint{tag, count})
+	}
+	sort.Slice(series, func(i, j int) bool {
+		if series[i].Count != series[j].Count {
+			return series[i].Count > series[j].Count
+		}
+		return series[i].Label < series[j].Label
+	})
+	if len(series) > n {
+		series = series[:n]
+	}
+	return series
+}
+
+// dashboardHandler shows the admin dashboard.
+func (t *Treatshelf) dashboardHandler(w http.ResponseWriter, r *http.Request) *appError {
+	return dashboardTmpl.Execute(t, w, r, struct {
+		Months  []int
+		TopTags int
+	}{dashboardMonths, dashboardTopTags})
+}
+
+// statsCSVHandler downloads a series charted on the dashboard as CSV, see
+// above.
+func (t *Treatshelf) statsCSVHandler(w http.ResponseWriter, r *http.Request) *appError {
+	q := r.URL.Query()
+	months := 0
+	if v := q.Get("months"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			err := fmt.Errorf("invalid months %q", v)
+			return t.appErrorCodef(r, http.StatusBadRequest, err, "%v", err)
+		}
+		months = n
+	}
+	s, err := t.treatStats(r.Context())
+	if err != nil {
+		return t.appErrorf(r, err, "could not compute statistics: %v", err)
+	}
+	name := q.Get("series")
+	var header []string
+	var series []statsPoint
+	switch name {
+	case "added":
+		header = []string{"month", "added"}
+		series = s.addedSeries(months)
+	case "tags":
+		header = []string{"tag", "treats"}
+		series = s.topTags(dashboardTopTags)
+	default:
+		err := fmt.Errorf("unknown series %q", name)
+		return t.appErrorCodef(r, http.StatusBadRequest, err, "%v", err)
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.csv"`, name))
+	cw := csv.NewWriter(w)
+	cw.Write(header)
+	for _, p := range series {
+		cw.Write([]string{p.Label, strconv.Itoa(p.Count)})
+	}
+	cw.Flush()
+	return nil
+}
@@ -2,8 +2,12 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"log"
+	"sort"
+	"time"
 
 	"cloud.google.com/go/firestore"
 	"google.golang.org/api/iterator"
@@ -12,19 +16,128 @@ import (
 // firestoreDB persists books to Cloud Firestore.
 // See https://cloud.google.com/firestore/docs.
 type firestoreDB struct {
-	client     *firestore.Client
-	collection string
+	client *firestore.Client
+
+	// collection holds treats. locations, preferences, idempotency, outbox,
+	// locks, config, tokens, profiles, signIns, signInFailures,
+	// savedSearches, operations, deliveries and uploads hold the other
+	// entities. All are prefixed by the environment prefix, see
+	// newFirestoreDB.
+	collection  string
+	locations   string
+	preferences string
+	idempotency string
+	outbox      string
+	locks       string
+	config      string
+	tokens      string
+	profiles    string
+	signIns     string
+	failures    string
+	searches    string
+	operations  string
+	deliveries  string
+	uploads     string
+
+	// replica, if set, is a nearer database that GetTreat and ListTreats
+	// read from when eventual consistency is allowed. It must be kept in
+	// sync with client's database.
+	replica *firestore.Client
+
+	clock Clock // tells the time, see clock.go.
+	// ids names new documents, see ids.go. Firestore does if it is nil.
+	ids IDGenerator
 }
 
-// Ensure firestoreDB conforms to the TreatDatabase interface.
-var _ TreatDatabase = &firestoreDB{}
+// maxBatchWrites is the most writes Firestore accepts in one batch.
+const maxBatchWrites = 500
+
+// Ensure firestoreDB conforms to the database interfaces.
+var (
+	_ TreatDatabase       = &firestoreDB{}
+	_ LocationDatabase    = &firestoreDB{}
+	_ PreferencesDatabase = &firestoreDB{}
+	_ IdempotencyDatabase = &firestoreDB{}
+	_ OutboxDatabase      = &firestoreDB{}
+	_ LockDatabase        = &firestoreDB{}
+	_ DualConfigStore     = &firestoreDB{}
+	_ KeyringConfigStore  = &firestoreDB{}
+	_ TokenDatabase       = &firestoreDB{}
+	_ ProfileDatabase     = &firestoreDB{}
+	_ SignInDatabase      = &firestoreDB{}
+	_ ReportDatabase      = &firestoreDB{}
+	_ SavedSearchDatabase = &firestoreDB{}
+	_ OperationDatabase   = &firestoreDB{}
+	_ DeliveryDatabase    = &firestoreDB{}
+	_ SheetSyncStore      = &firestoreDB{}
+	_ UploadDatabase      = &firestoreDB{}
+	_ StatsDatabase       = &firestoreDB{}
+)
+
+// Collections holding entities, before the environment prefix is added.
+const (
+	// defaultTreatsCollection is the historical name of the treats
+	// collection, kept so that existing data is found. Set
+	// FIRESTORE_COLLECTION to use another, see copyCollection.
+	defaultTreatsCollection = "books"
+
+	locationsCollection   = "locations"
+	preferencesCollection = "preferences"
+
+	// idempotencyCollection should have a TTL policy on ExpiresAt so that
+	// Firestore deletes old requests, see
+	// https://cloud.google.com/firestore/docs/ttl.
+	idempotencyCollection = "idempotencyKeys"
+
+	// outboxCollection holds events waiting to be sent, see outbox.go.
+	outboxCollection = "outbox"
+
+	// locksCollection holds leases, see region.go.
+	locksCollection = "locks"
+
+	// configCollection holds settings shared by every instance, such as
+	// the DualConfig, the KeyringConfig and the SheetSync.
+	configCollection = "config"
+
+	// tokensCollection holds API tokens by the hash of the token.
+	tokensCollection = "apiTokens"
+
+	// profilesCollection holds Profiles by user.
+	profilesCollection = "profiles"
+
+	// signInsCollection should have a TTL policy on ExpiresAt, see
+	// signInKeep. Listing a user's sign-ins needs a composite index on
+	// User and At (descending).
+	signInsCollection = "signIns"
+
+	// signInFailuresCollection counts failed sign-ins by key, see
+	// SignInDatabase.
+	signInFailuresCollection = "signInFailures"
+
+	// savedSearchesCollection holds SavedSearches by ID.
+	savedSearchesCollection = "savedSearches"
+
+	// operationsCollection holds Operations by ID.
+	operationsCollection = "operations"
+
+	// deliveriesCollection records inbound webhook Deliveries. It should
+	// have a TTL policy on ExpiresAt, see deliveryKeep.
+	deliveriesCollection = "deliveries"
+
+	// uploadsCollection indexes stored pictures by hash, see dedup.go.
+	uploadsCollection = "uploads"
+)
 
 // [START getting_started_bookshelf_firestore]
 
 // newFirestoreDB creates a new BookDatabase backed by Cloud Firestore.
 // See the firestore package for details on creating a suitable
 // firestore.Client: https://godoc.org/cloud.google.com/go/firestore.
-func newFirestoreDB(client *firestore.Client) (*firestoreDB, error) {
+//
+// Treats are stored in the given collection, or defaultTreatsCollection if
+// it is empty. Every collection name is prefixed with prefix, such as
+// "dev_", so that environments can share a database.
+func newFirestoreDB(client *firestore.Client, prefix, collection string) (*firestoreDB, error) {
 	ctx := context.Background()
 	// Verify that we can communicate and authenticate with the Firestore
 	// service.
@@ -34,20 +147,75 @@ func newFirestoreDB(client *firestore.Client) (*firestoreDB, error) {
 	if err != nil {
 		return nil, fmt.Errorf("firestoredb: could not connect: %v", err)
 	}
+	if collection == "" {
+		collection = defaultTreatsCollection
+	}
 	return &firestoreDB{
-		client:     client,
-		collection: "books",
+		client:      client,
+		collection:  prefix + collection,
+		locations:   prefix + locationsCollection,
+		preferences: prefix + preferencesCollection,
+		idempotency: prefix + idempotencyCollection,
+		outbox:      prefix + outboxCollection,
+		locks:       prefix + locksCollection,
+		config:      prefix + configCollection,
+		tokens:      prefix + tokensCollection,
+		profiles:    prefix + profilesCollection,
+		signIns:     prefix + signInsCollection,
+		failures:    prefix + signInFailuresCollection,
+		searches:    prefix + savedSearchesCollection,
+		operations:  prefix + operationsCollection,
+		deliveries:  prefix + deliveriesCollection,
+		uploads:     prefix + uploadsCollection,
+		clock:       systemClock{},
 	}, nil
 }
 
 // Close closes the database.
 func (db *firestoreDB) Close(context.Context) error {
+	if db.replica != nil {
+		db.replica.Close()
+	}
 	return db.client.Close()
 }
 
+// GetTreats retrieves the treats with the given IDs in a single call, nil
+// for those that don't exist.
+func (db *firestoreDB) GetTreats(ctx context.Context, ids []string) ([]*Treat, error) {
+	client := db.reader(consistencyFrom(ctx))
+	refs := make([]*firestore.DocumentRef, len(ids))
+	for i, id := range ids {
+		refs[i] = client.Collection(db.collection).Doc(id)
+	}
+	docs, err := client.GetAll(ctx, refs)
+	if err != nil {
+		return nil, fmt.Errorf("firestoredb: GetAll: %v", err)
+	}
+	treats := make([]*Treat, len(docs))
+	for i, ds := range docs {
+		if !ds.Exists() {
+			continue
+		}
+		t := &Treat{}
+		if err := ds.DataTo(t); err != nil {
+			return nil, fmt.Errorf("firestoredb: could not decode treat %q: %v", ids[i], err)
+		}
+		treats[i] = t
+	}
+	return treats, nil
+}
+
+// reader returns the client to read with the given consistency.
+func (db *firestoreDB) reader(c Consistency) *firestore.Client {
+	if c == ConsistencyEventual && db.replica != nil {
+		return db.replica
+	}
+	return db.client
+}
+
 // Book retrieves a book by its ID.
 func (db *firestoreDB) GetTreat(ctx context.Context, id string) (*Treat, error) {
-	ds, err := db.client.Collection(db.collection).Doc(id).Get(ctx)
+	ds, err := db.reader(consistencyFrom(ctx)).Collection(db.collection).Doc(id).Get(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("firestoredb: Get: %v", err)
 	}
@@ -60,7 +228,7 @@ func (db *firestoreDB) GetTreat(ctx context.Context, id string) (*Treat, error)
 
 // AddBook saves a given book, assigning it a new ID.
 func (db *firestoreDB) AddTreat(ctx context.Context, t *Treat) (id string, err error) {
-	ref := db.client.Collection(db.collection).NewDoc()
+	ref := db.newDoc(db.client.Collection(db.collection), "treats")
 	t.ID = ref.ID
 	if _, err := ref.Create(ctx, t); err != nil {
 		return "", fmt.Errorf("Create: %v", err)
@@ -68,9 +236,18 @@ func (db *firestoreDB) AddTreat(ctx context.Context, t *Treat) (id string, err e
 	return ref.ID, nil
 }
 
-// DeleteBook removes a given book by its ID.
+// DeleteBook removes a given book by its ID, along with its claims.
 func (db *firestoreDB) DeleteTreat(ctx context.Context, id string) error {
-	if _, err := db.client.Collection(db.collection).Doc(id).Delete(ctx); err != nil {
+	claims, err := db.claimRefs(ctx, id)
+	if err != nil {
+		return err
+	}
+	batch := db.client.Batch()
+	batch.Delete(db.client.Collection(db.collection).Doc(id))
+	for _, ref := range claims {
+		batch.Delete(ref)
+	}
+	if _, err := batch.Commit(ctx); err != nil {
 		return fmt.Errorf("firestore: Delete: %v", err)
 	}
 	return nil
@@ -84,10 +261,211 @@ func (db *firestoreDB) UpdateTreat(ctx context.Context, t *Treat) error {
 	return nil
 }
 
-// ListTreats returns a list of treats, ordered by title.
-func (db *firestoreDB) ListTreats(ctx context.Context) ([]*Treat, error) {
+// SaveTreats adds or replaces the given treats in a single batch.
+func (db *firestoreDB) SaveTreats(ctx context.Context, treats []*Treat) error {
+	if len(treats) > maxBatchWrites {
+		return fmt.Errorf("firestoredb: cannot save more than %d treats at once", maxBatchWrites)
+	}
+	batch := db.client.Batch()
+	for _, t := range treats {
+		if t.ID == "" {
+			ref := db.newDoc(db.client.Collection(db.collection), "treats")
+			t.ID = ref.ID
+			batch.Create(ref, t)
+			continue
+		}
+		batch.Set(db.client.Collection(db.collection).Doc(t.ID), t)
+	}
+	if _, err := batch.Commit(ctx); err != nil {
+		return fmt.Errorf("firestoredb: could not save treats: %v", err)
+	}
+	return nil
+}
+
+// UpdateTreatFields updates only the given fields of t, whose names are
+// their Firestore paths. Update fails if the treat doesn't exist.
+func (db *firestoreDB) UpdateTreatFields(ctx context.Context, t *Treat, fields []string) error {
+	updates := make([]firestore.Update, len(fields))
+	for i, f := range fields {
+		updates[i] = firestore.Update{Path: f, Value: treatFieldValue(t, f)}
+	}
+	if _, err := db.client.Collection(db.collection).Doc(t.ID).Update(ctx, updates); err != nil {
+		return fmt.Errorf("firestoredb: Update: %v", err)
+	}
+	return nil
+}
+
+// AdjustQuantity adds delta to the Quantity of a given treat in a single
+// transaction, failing with errNotEnoughPortions rather than going below zero.
+func (db *firestoreDB) AdjustQuantity(ctx context.Context, id string, delta int) (*Treat, error) {
+	ref := db.client.Collection(db.collection).Doc(id)
+	t := &Treat{}
+	err := db.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		ds, err := tx.Get(ref)
+		if err != nil {
+			return err
+		}
+		if err := ds.DataTo(t); err != nil {
+			return err
+		}
+		if err := t.takePortions(-delta); err != nil {
+			return err
+		}
+		if err := tx.Update(ref, []firestore.Update{
+			{Path: "Quantity", Value: t.Quantity},
+		}); err != nil {
+			return err
+		}
+		return db.addEvent(tx, ranOutEvent(db.clock.Now(), t, -delta))
+	})
+	if err == errNotEnoughPortions {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("firestoredb: AdjustQuantity: %v", err)
+	}
+	return t, nil
+}
+
+// ChangeTreat lets change modify a given treat, and writes the fields it
+// returns, or the whole treat, in a single transaction, so that change sees
+// the version it replaces.
+func (db *firestoreDB) ChangeTreat(ctx context.Context, id string, change func(*Treat) ([]string, error)) (*Treat, error) {
+	ref := db.client.Collection(db.collection).Doc(id)
+	var t *Treat
+	var changeErr error
+	err := db.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		ds, err := tx.Get(ref)
+		if err != nil {
+			return err
+		}
+		t = &Treat{}
+		if err := ds.DataTo(t); err != nil {
+			return err
+		}
+		fields, err := change(t)
+		if err != nil {
+			changeErr = err
+			return err
+		}
+		t.ID = id
+		if len(fields) == 0 {
+			return tx.Set(ref, t)
+		}
+		updates := make([]firestore.Update, len(fields))
+		for i, f := range fields {
+			updates[i] = firestore.Update{Path: f, Value: treatFieldValue(t, f)}
+		}
+		return tx.Update(ref, updates)
+	})
+	if changeErr != nil && err == changeErr {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("firestoredb: ChangeTreat: %v", err)
+	}
+	return t, nil
+}
+
+// ListTreats returns a list of treats matching opts, ordered by opts.Sort.
+func (db *firestoreDB) ListTreats(ctx context.Context, opts ListOptions) ([]*Treat, error) {
+	if opts.Near != nil {
+		return db.listNear(ctx, opts)
+	}
+
+	treats := make([]*Treat, 0)
+	q := db.reader(opts.Consistency).Collection(db.collection).Query.OrderBy("Title", firestore.Asc)
+	treats, err := db.appendMatching(treats, q.Documents(ctx), opts)
+	if err != nil {
+		return nil, err
+	}
+	// Firestore orders titles by code point, so "Éclair" would follow
+	// "Zabaglione"; treats are sorted here, by collation, and in other
+	// orders rather than requiring a composite index per sort order.
+	opts.sortTreats(treats)
+
+	return treats, nil
+}
+
+// EachTreat calls fn with each treat matching opts, ordered by title, as
+// the documents arrive.
+func (db *firestoreDB) EachTreat(ctx context.Context, opts ListOptions, fn func(*Treat) error) error {
+	iter := db.reader(opts.Consistency).Collection(db.collection).OrderBy("Title", firestore.Asc).Documents(ctx)
+	defer iter.Stop()
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("firestoredb: could not list treats: %v", err)
+		}
+		t := &Treat{}
+		doc.DataTo(t)
+		if !opts.matches(t, db.clock.Now()) {
+			continue
+		}
+		if err := fn(t); err != nil {
+			return err
+		}
+	}
+}
+
+// WatchTreats calls fn with each change to a treat by listening to
+// snapshots of the collection. The first snapshot holds every existing
+// treat and is skipped.
+func (db *firestoreDB) WatchTreats(ctx context.Context, fn func(TreatChange)) error {
+	iter := db.client.Collection(db.collection).Snapshots(ctx)
+	defer iter.Stop()
+	for first := true; ; first = false {
+		snap, err := iter.Next()
+		if err != nil {
+			return fmt.Errorf("firestoredb: could not watch treats: %v", err)
+		}
+		if first {
+			continue
+		}
+		for _, ch := range snap.Changes {
+			c := TreatChange{ID: ch.Doc.Ref.ID}
+			switch ch.Kind {
+			case firestore.DocumentAdded:
+				c.Kind = TreatAdded
+			case firestore.DocumentModified:
+				c.Kind = TreatModified
+			case firestore.DocumentRemoved:
+				c.Kind = TreatRemoved
+			}
+			if c.Kind != TreatRemoved {
+				c.Treat = &Treat{}
+				if err := ch.Doc.DataTo(c.Treat); err != nil {
+					return fmt.Errorf("firestoredb: could not read treat %q: %v", c.ID, err)
+				}
+			}
+			fn(c)
+		}
+	}
+}
+
+// listNear lists treats within opts.RadiusKm of opts.Near by querying the
+// geohash ranges covering the search area.
+func (db *firestoreDB) listNear(ctx context.Context, opts ListOptions) ([]*Treat, error) {
 	treats := make([]*Treat, 0)
-	iter := db.client.Collection(db.collection).Query.OrderBy("Title", firestore.Asc).Documents(ctx)
+	for _, gr := range geohashRanges(*opts.Near, opts.RadiusKm) {
+		q := db.reader(opts.Consistency).Collection(db.collection).
+			OrderBy("Place.Geohash", firestore.Asc).
+			StartAt(gr.start).
+			EndAt(gr.end)
+		var err error
+		if treats, err = db.appendMatching(treats, q.Documents(ctx), opts); err != nil {
+			return nil, err
+		}
+	}
+	opts.sortTreats(treats)
+	return treats, nil
+}
+
+// appendMatching appends the treats yielded by iter that match opts.
+func (db *firestoreDB) appendMatching(treats []*Treat, iter *firestore.DocumentIterator, opts ListOptions) ([]*Treat, error) {
 	defer iter.Stop()
 	for {
 		doc, err := iter.Next()
@@ -95,13 +473,1439 @@ func (db *firestoreDB) ListTreats(ctx context.Context) ([]*Treat, error) {
 			break
 		}
 		if err != nil {
-			return nil, fmt.Errorf("firestoredb: could not list books: %v", err)
+			return nil, fmt.Errorf("firestoredb: could not list treats: %v", err)
 		}
 		t := &Treat{}
 		doc.DataTo(t)
 		log.Printf("Treat %q ID: %q", t.Title, t.ID)
+		if !opts.matches(t, db.clock.Now()) {
+			continue
+		}
 		treats = append(treats, t)
 	}
-
 	return treats, nil
-}
\ No newline at end of file
+}
+
+// ArchiveExpired archives all treats that expired before now. Treats that
+// never expire store the zero time, so they are excluded by the lower bound.
+func (db *firestoreDB) ArchiveExpired(ctx context.Context, now time.Time) (int, error) {
+	iter := db.client.Collection(db.collection).
+		Where("ExpiresAt", ">", time.Time{}).
+		Where("ExpiresAt", "<=", now).
+		Documents(ctx)
+	defer iter.Stop()
+
+	n, pending := 0, 0
+	batch := db.client.Batch()
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return n, fmt.Errorf("firestoredb: could not list expired treats: %v", err)
+		}
+		if archived, _ := doc.DataAt("Archived"); archived == true {
+			continue
+		}
+		batch.Update(doc.Ref, []firestore.Update{{Path: "Archived", Value: true}})
+		if pending++; pending == maxBatchWrites {
+			if _, err := batch.Commit(ctx); err != nil {
+				return n, fmt.Errorf("firestoredb: could not archive expired treats: %v", err)
+			}
+			n += pending
+			pending, batch = 0, db.client.Batch()
+		}
+	}
+	if pending > 0 {
+		if _, err := batch.Commit(ctx); err != nil {
+			return n, fmt.Errorf("firestoredb: could not archive expired treats: %v", err)
+		}
+		n += pending
+	}
+	return n, nil
+}
+
+// SoftDeleteTreats marks the given treats deleted at the given time. All
+// treats are updated in a single batch, so either all or none are deleted.
+func (db *firestoreDB) SoftDeleteTreats(ctx context.Context, ids []string, token string, at time.Time) error {
+	if len(ids) > maxBatchWrites {
+		return fmt.Errorf("firestoredb: cannot delete more than %d treats at once", maxBatchWrites)
+	}
+	batch := db.client.Batch()
+	for _, id := range ids {
+		batch.Update(db.client.Collection(db.collection).Doc(id), []firestore.Update{
+			{Path: "DeletedAt", Value: at},
+			{Path: "UndoToken", Value: token},
+		})
+	}
+	if _, err := batch.Commit(ctx); err != nil {
+		return fmt.Errorf("firestoredb: could not delete treats: %v", err)
+	}
+	return nil
+}
+
+// RestoreTreats restores the treats soft-deleted with token after the given
+// time. DeletedAt is checked here rather than in the query, which would need
+// a composite index.
+func (db *firestoreDB) RestoreTreats(ctx context.Context, token string, after time.Time) (int, error) {
+	if token == "" {
+		return 0, nil
+	}
+	iter := db.client.Collection(db.collection).Where("UndoToken", "==", token).Documents(ctx)
+	defer iter.Stop()
+
+	batch := db.client.Batch()
+	n := 0
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return 0, fmt.Errorf("firestoredb: could not list deleted treats: %v", err)
+		}
+		if at, _ := doc.DataAt("DeletedAt"); at == nil || !at.(time.Time).After(after) {
+			continue
+		}
+		batch.Update(doc.Ref, []firestore.Update{
+			{Path: "DeletedAt", Value: time.Time{}},
+			{Path: "UndoToken", Value: ""},
+		})
+		n++
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	if _, err := batch.Commit(ctx); err != nil {
+		return 0, fmt.Errorf("firestoredb: could not restore treats: %v", err)
+	}
+	return n, nil
+}
+
+// ListDeletedTreats returns the treats soft-deleted before the given time.
+func (db *firestoreDB) ListDeletedTreats(ctx context.Context, before time.Time) ([]*Treat, error) {
+	iter := db.client.Collection(db.collection).
+		Where("DeletedAt", ">", time.Time{}).
+		Where("DeletedAt", "<=", before).
+		Documents(ctx)
+	defer iter.Stop()
+
+	var treats []*Treat
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			return treats, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("firestoredb: could not list deleted treats: %v", err)
+		}
+		t := &Treat{}
+		if err := doc.DataTo(t); err != nil {
+			return nil, fmt.Errorf("firestoredb: could not read treat %q: %v", doc.Ref.ID, err)
+		}
+		treats = append(treats, t)
+	}
+}
+
+// PurgeDeletedTreats removes treats soft-deleted before the given time.
+// Claims on purged treats are left behind, as with DeleteTreat.
+func (db *firestoreDB) PurgeDeletedTreats(ctx context.Context, before time.Time) (int, error) {
+	iter := db.client.Collection(db.collection).
+		Where("DeletedAt", ">", time.Time{}).
+		Where("DeletedAt", "<=", before).
+		Documents(ctx)
+	defer iter.Stop()
+
+	// pending counts the writes in batch, and treats the treats they purge.
+	n, pending, treats := 0, 0, 0
+	batch := db.client.Batch()
+	commit := func() error {
+		if _, err := batch.Commit(ctx); err != nil {
+			return fmt.Errorf("firestoredb: could not purge deleted treats: %v", err)
+		}
+		n += treats
+		pending, treats, batch = 0, 0, db.client.Batch()
+		return nil
+	}
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return n, fmt.Errorf("firestoredb: could not list deleted treats: %v", err)
+		}
+		// Each treat is purged in the same batch as its claims.
+		refs, err := db.claimRefs(ctx, doc.Ref.ID)
+		if err != nil {
+			return n, err
+		}
+		refs = append(refs, doc.Ref)
+		if pending+len(refs) > maxBatchWrites {
+			if err := commit(); err != nil {
+				return n, err
+			}
+		}
+		for _, ref := range refs {
+			batch.Delete(ref)
+		}
+		pending += len(refs)
+		treats++
+	}
+	if pending > 0 {
+		if err := commit(); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// maxArrayContainsAny is the most values an array-contains-any filter takes.
+const maxArrayContainsAny = 10
+
+// ReplaceTags replaces every tag in from with to across all treats, writing
+// in batches and reporting progress after each batch.
+func (db *firestoreDB) ReplaceTags(ctx context.Context, from []string, to string, progress func(done, total int)) (int, error) {
+	type change struct {
+		ref  *firestore.DocumentRef
+		tags []string
+	}
+	var changes []change
+	seen := make(map[string]bool)
+	for start := 0; start < len(from); start += maxArrayContainsAny {
+		end := start + maxArrayContainsAny
+		if end > len(from) {
+			end = len(from)
+		}
+		values := make([]interface{}, 0, end-start)
+		for _, f := range from[start:end] {
+			values = append(values, f)
+		}
+		iter := db.client.Collection(db.collection).Where("Tags", "array-contains-any", values).Documents(ctx)
+		for {
+			doc, err := iter.Next()
+			if err == iterator.Done {
+				break
+			}
+			if err != nil {
+				iter.Stop()
+				return 0, fmt.Errorf("firestoredb: could not list tagged treats: %v", err)
+			}
+			if seen[doc.Ref.ID] {
+				continue
+			}
+			seen[doc.Ref.ID] = true
+			t := &Treat{}
+			doc.DataTo(t)
+			if tags, changed := replaceTags(t.Tags, from, to); changed {
+				changes = append(changes, change{ref: doc.Ref, tags: tags})
+			}
+		}
+		iter.Stop()
+	}
+
+	done := 0
+	for done < len(changes) {
+		end := done + maxBatchWrites
+		if end > len(changes) {
+			end = len(changes)
+		}
+		batch := db.client.Batch()
+		for _, c := range changes[done:end] {
+			batch.Update(c.ref, []firestore.Update{{Path: "Tags", Value: c.tags}})
+		}
+		if _, err := batch.Commit(ctx); err != nil {
+			return done, fmt.Errorf("firestoredb: could not update tags: %v", err)
+		}
+		done = end
+		if progress != nil {
+			progress(done, len(changes))
+		}
+	}
+	return done, nil
+}
+
+// claims returns the collection of claims on a given treat.
+func (db *firestoreDB) claims(treatID string) *firestore.CollectionRef {
+	return db.client.Collection(db.collection).Doc(treatID).Collection("claims")
+}
+
+// claimRefs returns the claims of a treat, for deleting in the batch that
+// deletes the treat. Firestore doesn't delete subcollections with their
+// document. Claims that wouldn't fit in that batch are deleted first.
+func (db *firestoreDB) claimRefs(ctx context.Context, treatID string) ([]*firestore.DocumentRef, error) {
+	refs, err := db.claims(treatID).DocumentRefs(ctx).GetAll()
+	if err != nil {
+		return nil, fmt.Errorf("firestoredb: could not list claims: %v", err)
+	}
+	for len(refs) >= maxBatchWrites {
+		batch := db.client.Batch()
+		for _, ref := range refs[:maxBatchWrites] {
+			batch.Delete(ref)
+		}
+		if _, err := batch.Commit(ctx); err != nil {
+			return nil, fmt.Errorf("firestoredb: could not delete claims: %v", err)
+		}
+		refs = refs[maxBatchWrites:]
+	}
+	return refs, nil
+}
+
+// newDoc returns a reference to a new document, of the given kind, in c.
+func (db *firestoreDB) newDoc(c *firestore.CollectionRef, kind string) *firestore.DocumentRef {
+	if db.ids == nil {
+		return c.NewDoc()
+	}
+	return c.Doc(db.ids.NewID(kind))
+}
+
+// ListClaims returns the claims on a given treat, oldest first.
+func (db *firestoreDB) ListClaims(ctx context.Context, treatID string) ([]*Claim, error) {
+	claims := make([]*Claim, 0)
+	iter := db.claims(treatID).OrderBy("Created", firestore.Asc).Documents(ctx)
+	defer iter.Stop()
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("firestoredb: could not list claims: %v", err)
+		}
+		c := &Claim{}
+		doc.DataTo(c)
+		claims = append(claims, c)
+	}
+	return claims, nil
+}
+
+// ClaimTreat takes c.Portions from a given treat and records the claim in a
+// single transaction, so concurrent claims cannot over-claim.
+func (db *firestoreDB) ClaimTreat(ctx context.Context, treatID string, c *Claim) (id string, err error) {
+	treatRef := db.client.Collection(db.collection).Doc(treatID)
+	claimRef := db.newDoc(db.claims(treatID), "claims")
+	c.ID = claimRef.ID
+	c.TreatID = treatID
+
+	err = db.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		ds, err := tx.Get(treatRef)
+		if err != nil {
+			return err
+		}
+		t := &Treat{}
+		if err := ds.DataTo(t); err != nil {
+			return err
+		}
+		if err := t.takePortions(c.Portions); err != nil {
+			return err
+		}
+		if err := tx.Update(treatRef, []firestore.Update{
+			{Path: "Quantity", Value: t.Quantity},
+		}); err != nil {
+			return err
+		}
+		if err := db.addEvent(tx, ranOutEvent(db.clock.Now(), t, c.Portions)); err != nil {
+			return err
+		}
+		return tx.Create(claimRef, c)
+	})
+	if err == errNotEnoughPortions {
+		return "", err
+	}
+	if err != nil {
+		return "", fmt.Errorf("firestoredb: ClaimTreat: %v", err)
+	}
+	return c.ID, nil
+}
+
+// ReleaseClaim removes a claim and returns its portions to the treat in a
+// single transaction.
+func (db *firestoreDB) ReleaseClaim(ctx context.Context, treatID, claimID string) error {
+	treatRef := db.client.Collection(db.collection).Doc(treatID)
+	claimRef := db.claims(treatID).Doc(claimID)
+
+	err := db.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		ds, err := tx.Get(claimRef)
+		if err != nil {
+			return err
+		}
+		c := &Claim{}
+		if err := ds.DataTo(c); err != nil {
+			return err
+		}
+		// Incrementing would start counting the portions of treats whose
+		// portions aren't counted.
+		ts, err := tx.Get(treatRef)
+		if err != nil {
+			return err
+		}
+		t := &Treat{}
+		if err := ts.DataTo(t); err != nil {
+			return err
+		}
+		t.takePortions(-c.Portions)
+		if err := tx.Update(treatRef, []firestore.Update{
+			{Path: "Quantity", Value: t.Quantity},
+		}); err != nil {
+			return err
+		}
+		return tx.Delete(claimRef)
+	})
+	if err != nil {
+		return fmt.Errorf("firestoredb: ReleaseClaim: %v", err)
+	}
+	return nil
+}
+
+// reports returns the subcollection holding the open reports of a treat, by
+// Report.ID.
+func (db *firestoreDB) reports(treatID string) *firestore.CollectionRef {
+	return db.client.Collection(db.collection).Doc(treatID).Collection("reports")
+}
+
+// AnonymizeClaims replaces the name on every claim user made with name, and
+// forgets who made them. It needs a collection group index on the
+// ClaimedBy field of claims.
+func (db *firestoreDB) AnonymizeClaims(ctx context.Context, user, name string) (int, error) {
+	iter := db.client.CollectionGroup("claims").Where("ClaimedBy", "==", user).Documents(ctx)
+	defer iter.Stop()
+
+	n, pending := 0, 0
+	batch := db.client.Batch()
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return n, fmt.Errorf("firestoredb: could not list claims: %v", err)
+		}
+		// Other treat collections, such as a dual-write target, have claims
+		// too.
+		if doc.Ref.Parent.Parent.Parent.ID != db.collection {
+			continue
+		}
+		batch.Update(doc.Ref, []firestore.Update{
+			{Path: "Name", Value: name},
+			{Path: "ClaimedBy", Value: ""},
+			{Path: "Session", Value: ""},
+		})
+		if pending++; pending == maxBatchWrites {
+			if _, err := batch.Commit(ctx); err != nil {
+				return n, fmt.Errorf("firestoredb: could not anonymize claims: %v", err)
+			}
+			n += pending
+			pending, batch = 0, db.client.Batch()
+		}
+	}
+	if pending > 0 {
+		if _, err := batch.Commit(ctx); err != nil {
+			return n, fmt.Errorf("firestoredb: could not anonymize claims: %v", err)
+		}
+		n += pending
+	}
+	return n, nil
+}
+
+// ReportTreat records rep and counts it on the treat in a single
+// transaction, holding the treat for review once hideAt reports are open.
+func (db *firestoreDB) ReportTreat(ctx context.Context, treatID string, rep *Report, hideAt int) (open int, err error) {
+	treatRef := db.client.Collection(db.collection).Doc(treatID)
+	reportRef := db.reports(treatID).Doc(rep.ID)
+	rep.TreatID = treatID
+
+	err = db.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		ds, err := tx.Get(treatRef)
+		if err != nil {
+			return err
+		}
+		t := &Treat{}
+		if err := ds.DataTo(t); err != nil {
+			return err
+		}
+		ds, err = tx.Get(reportRef)
+		if ds == nil || ds.Exists() {
+			if err != nil {
+				return err
+			}
+			return errAlreadyReported
+		}
+		open = t.Reports + 1
+		updates := []firestore.Update{{Path: "Reports", Value: open}}
+		if open >= hideAt && t.Review == "" {
+			updates = append(updates, firestore.Update{Path: "Review", Value: reviewPending})
+		}
+		if err := tx.Update(treatRef, updates); err != nil {
+			return err
+		}
+		return tx.Create(reportRef, rep)
+	})
+	if err == errAlreadyReported {
+		return 0, err
+	}
+	if err != nil {
+		return 0, fmt.Errorf("firestoredb: ReportTreat: %v", err)
+	}
+	return open, nil
+}
+
+// ListReports returns the open reports of a treat, oldest first.
+func (db *firestoreDB) ListReports(ctx context.Context, treatID string) ([]*Report, error) {
+	reports := make([]*Report, 0)
+	iter := db.reports(treatID).OrderBy("Created", firestore.Asc).Documents(ctx)
+	defer iter.Stop()
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("firestoredb: could not list reports: %v", err)
+		}
+		rep := &Report{}
+		doc.DataTo(rep)
+		reports = append(reports, rep)
+	}
+	return reports, nil
+}
+
+// ClearReports deletes the reports of a treat and resets its count. The
+// count is reset with the last batch of deletes.
+func (db *firestoreDB) ClearReports(ctx context.Context, treatID string) error {
+	iter := db.reports(treatID).Documents(ctx)
+	defer iter.Stop()
+
+	pending := 0
+	batch := db.client.Batch()
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("firestoredb: could not list reports: %v", err)
+		}
+		batch.Delete(doc.Ref)
+		// Leave room for the count in the last batch.
+		if pending++; pending == maxBatchWrites-1 {
+			if _, err := batch.Commit(ctx); err != nil {
+				return fmt.Errorf("firestoredb: could not clear reports: %v", err)
+			}
+			pending, batch = 0, db.client.Batch()
+		}
+	}
+	batch.Update(db.client.Collection(db.collection).Doc(treatID), []firestore.Update{
+		{Path: "Reports", Value: 0},
+	})
+	if _, err := batch.Commit(ctx); err != nil {
+		return fmt.Errorf("firestoredb: could not clear reports: %v", err)
+	}
+	return nil
+}
+
+// ListLocations returns a list of locations, ordered by name.
+func (db *firestoreDB) ListLocations(ctx context.Context) ([]*Location, error) {
+	locations := make([]*Location, 0)
+	iter := db.client.Collection(db.locations).OrderBy("Name", firestore.Asc).Documents(ctx)
+	defer iter.Stop()
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("firestoredb: could not list locations: %v", err)
+		}
+		l := &Location{}
+		doc.DataTo(l)
+		locations = append(locations, l)
+	}
+	return locations, nil
+}
+
+// GetLocation retrieves a location by its ID.
+func (db *firestoreDB) GetLocation(ctx context.Context, id string) (*Location, error) {
+	ds, err := db.client.Collection(db.locations).Doc(id).Get(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("firestoredb: Get: %v", err)
+	}
+	l := &Location{}
+	ds.DataTo(l)
+	return l, nil
+}
+
+// AddLocation saves a given location, assigning it a new ID.
+func (db *firestoreDB) AddLocation(ctx context.Context, l *Location) (id string, err error) {
+	ref := db.newDoc(db.client.Collection(db.locations), "locations")
+	l.ID = ref.ID
+	if _, err := ref.Create(ctx, l); err != nil {
+		return "", fmt.Errorf("firestoredb: Create: %v", err)
+	}
+	return ref.ID, nil
+}
+
+// DeleteLocation removes a given location by its ID.
+func (db *firestoreDB) DeleteLocation(ctx context.Context, id string) error {
+	if _, err := db.client.Collection(db.locations).Doc(id).Delete(ctx); err != nil {
+		return fmt.Errorf("firestoredb: Delete: %v", err)
+	}
+	return nil
+}
+
+// GetPreferences retrieves the preferences stored under key, or nil if there
+// are none.
+func (db *firestoreDB) GetPreferences(ctx context.Context, key string) (*Preferences, error) {
+	ds, err := db.client.Collection(db.preferences).Doc(key).Get(ctx)
+	if ds != nil && !ds.Exists() {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("firestoredb: Get: %v", err)
+	}
+	p := &Preferences{}
+	ds.DataTo(p)
+	return p, nil
+}
+
+// SetPreferences stores preferences under key.
+func (db *firestoreDB) SetPreferences(ctx context.Context, key string, p *Preferences) error {
+	if _, err := db.client.Collection(db.preferences).Doc(key).Set(ctx, p); err != nil {
+		return fmt.Errorf("firestoredb: Set: %v", err)
+	}
+	return nil
+}
+
+// DeletePreferences removes the preferences stored under key, if any.
+func (db *firestoreDB) DeletePreferences(ctx context.Context, key string) error {
+	if _, err := db.client.Collection(db.preferences).Doc(key).Delete(ctx); err != nil {
+		return fmt.Errorf("firestoredb: Delete: %v", err)
+	}
+	return nil
+}
+
+// idempotencyDoc returns the document for a given idempotency key. Keys are
+// hashed since they may contain characters not allowed in document IDs.
+func (db *firestoreDB) idempotencyDoc(key string) *firestore.DocumentRef {
+	sum := sha256.Sum256([]byte(key))
+	return db.client.Collection(db.idempotency).Doc(hex.EncodeToString(sum[:]))
+}
+
+// ReserveIdempotencyKey stores req unless an unexpired request with the same
+// key exists, in which case that request is returned instead.
+func (db *firestoreDB) ReserveIdempotencyKey(ctx context.Context, req *IdempotentRequest) (*IdempotentRequest, error) {
+	ref := db.idempotencyDoc(req.Key)
+	var prev *IdempotentRequest
+	err := db.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		prev = nil
+		ds, err := tx.Get(ref)
+		if ds != nil && !ds.Exists() {
+			return tx.Set(ref, req)
+		}
+		if err != nil {
+			return err
+		}
+		p := &IdempotentRequest{}
+		if err := ds.DataTo(p); err != nil {
+			return err
+		}
+		if db.clock.Now().After(p.ExpiresAt) {
+			return tx.Set(ref, req)
+		}
+		prev = p
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("firestoredb: could not reserve idempotency key: %v", err)
+	}
+	return prev, nil
+}
+
+// CompleteIdempotencyKey stores the response recorded in req.
+func (db *firestoreDB) CompleteIdempotencyKey(ctx context.Context, req *IdempotentRequest) error {
+	if _, err := db.idempotencyDoc(req.Key).Set(ctx, req); err != nil {
+		return fmt.Errorf("firestoredb: Set: %v", err)
+	}
+	return nil
+}
+
+// ReleaseIdempotencyKey forgets the request stored under key.
+func (db *firestoreDB) ReleaseIdempotencyKey(ctx context.Context, key string) error {
+	if _, err := db.idempotencyDoc(key).Delete(ctx); err != nil {
+		return fmt.Errorf("firestoredb: Delete: %v", err)
+	}
+	return nil
+}
+
+// copyCollection copies every treat in the collection from into the
+// collection to, with their claims, overwriting treats already there, and
+// returns how many treats were copied. Names are used as given, without the
+// environment prefix. Nothing is deleted: point FIRESTORE_COLLECTION at the
+// new collection, check it, then delete the old one.
+func (db *firestoreDB) copyCollection(ctx context.Context, from, to string) (int, error) {
+	iter := db.client.Collection(from).Documents(ctx)
+	defer iter.Stop()
+
+	batch, pending, n := db.client.Batch(), 0, 0
+	write := func(ref *firestore.DocumentRef, data map[string]interface{}) error {
+		batch.Set(ref, data)
+		if pending++; pending == maxBatchWrites {
+			if _, err := batch.Commit(ctx); err != nil {
+				return fmt.Errorf("firestoredb: could not copy treats: %v", err)
+			}
+			batch, pending = db.client.Batch(), 0
+		}
+		return nil
+	}
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return n, fmt.Errorf("firestoredb: could not list treats in %q: %v", from, err)
+		}
+		dst := db.client.Collection(to).Doc(doc.Ref.ID)
+		if err := write(dst, doc.Data()); err != nil {
+			return n, err
+		}
+		claims, err := doc.Ref.Collection("claims").Documents(ctx).GetAll()
+		if err != nil {
+			return n, fmt.Errorf("firestoredb: could not list claims of %q: %v", doc.Ref.ID, err)
+		}
+		for _, c := range claims {
+			if err := write(dst.Collection("claims").Doc(c.Ref.ID), c.Data()); err != nil {
+				return n, err
+			}
+		}
+		n++
+	}
+	if pending > 0 {
+		if _, err := batch.Commit(ctx); err != nil {
+			return n, fmt.Errorf("firestoredb: could not copy treats: %v", err)
+		}
+	}
+	return n, nil
+}
+
+// addEvent adds ev to the outbox as part of tx, if it isn't nil.
+func (db *firestoreDB) addEvent(tx *firestore.Transaction, ev *Event) error {
+	if ev == nil {
+		return nil
+	}
+	ref := db.newDoc(db.client.Collection(db.outbox), "events")
+	ev.ID = ref.ID
+	return tx.Create(ref, ev)
+}
+
+// AddEvent adds an event to the outbox.
+func (db *firestoreDB) AddEvent(ctx context.Context, ev *Event) (id string, err error) {
+	ref := db.newDoc(db.client.Collection(db.outbox), "events")
+	ev.ID = ref.ID
+	if _, err := ref.Create(ctx, ev); err != nil {
+		return "", fmt.Errorf("firestoredb: could not add event: %v", err)
+	}
+	return ev.ID, nil
+}
+
+// PendingEvents returns up to limit events due by now, earliest due first.
+// Delivered and dead-lettered events have a null NextAttempt, which the
+// range filter leaves out.
+func (db *firestoreDB) PendingEvents(ctx context.Context, now time.Time, limit int) ([]*Event, error) {
+	docs, err := db.client.Collection(db.outbox).
+		Where("NextAttempt", "<=", now).
+		OrderBy("NextAttempt", firestore.Asc).
+		Limit(limit).
+		Documents(ctx).GetAll()
+	if err != nil {
+		return nil, fmt.Errorf("firestoredb: could not list pending events: %v", err)
+	}
+	return eventsFrom(docs)
+}
+
+// eventsFrom decodes event documents.
+func eventsFrom(docs []*firestore.DocumentSnapshot) ([]*Event, error) {
+	events := make([]*Event, 0, len(docs))
+	for _, doc := range docs {
+		ev := &Event{}
+		if err := doc.DataTo(ev); err != nil {
+			return nil, fmt.Errorf("firestoredb: could not read event %q: %v", doc.Ref.ID, err)
+		}
+		events = append(events, ev)
+	}
+	return events, nil
+}
+
+// updateEvent applies updates to an event, describing what for errors.
+func (db *firestoreDB) updateEvent(ctx context.Context, id, what string, updates []firestore.Update) error {
+	if _, err := db.client.Collection(db.outbox).Doc(id).Update(ctx, updates); err != nil {
+		return fmt.Errorf("firestoredb: could not %s event %q: %v", what, id, err)
+	}
+	return nil
+}
+
+// MarkEventDelivered records that an event was sent.
+func (db *firestoreDB) MarkEventDelivered(ctx context.Context, id string, at time.Time) error {
+	return db.updateEvent(ctx, id, "mark delivered", []firestore.Update{
+		{Path: "Delivered", Value: at},
+		{Path: "NextAttempt", Value: nil},
+	})
+}
+
+// RecordEventFailure saves the state of an event after a failed delivery.
+func (db *firestoreDB) RecordEventFailure(ctx context.Context, ev *Event) error {
+	return db.updateEvent(ctx, ev.ID, "record failure of", []firestore.Update{
+		{Path: "Attempts", Value: ev.Attempts},
+		{Path: "LastError", Value: ev.LastError},
+		{Path: "NextAttempt", Value: ev.NextAttempt},
+		{Path: "DeadLettered", Value: ev.DeadLettered},
+	})
+}
+
+// ReplayEvents marks the events created since the given time pending again.
+func (db *firestoreDB) ReplayEvents(ctx context.Context, since time.Time) (int, error) {
+	iter := db.client.Collection(db.outbox).Where("Created", ">=", since).Documents(ctx)
+	defer iter.Stop()
+
+	now := db.clock.Now()
+	n, pending := 0, 0
+	batch := db.client.Batch()
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return n, fmt.Errorf("firestoredb: could not list events: %v", err)
+		}
+		batch.Update(doc.Ref, []firestore.Update{
+			{Path: "Delivered", Value: time.Time{}},
+			{Path: "DeadLettered", Value: time.Time{}},
+			{Path: "NextAttempt", Value: now},
+			{Path: "Attempts", Value: 0},
+			{Path: "LastError", Value: ""},
+		})
+		if pending++; pending == maxBatchWrites {
+			if _, err := batch.Commit(ctx); err != nil {
+				return n, fmt.Errorf("firestoredb: could not replay events: %v", err)
+			}
+			n += pending
+			pending, batch = 0, db.client.Batch()
+		}
+	}
+	if pending > 0 {
+		if _, err := batch.Commit(ctx); err != nil {
+			return n, fmt.Errorf("firestoredb: could not replay events: %v", err)
+		}
+		n += pending
+	}
+	return n, nil
+}
+
+// DeadEvents returns the dead-lettered events, most recent first.
+func (db *firestoreDB) DeadEvents(ctx context.Context) ([]*Event, error) {
+	docs, err := db.client.Collection(db.outbox).
+		Where("DeadLettered", ">", time.Time{}).
+		OrderBy("DeadLettered", firestore.Desc).
+		Documents(ctx).GetAll()
+	if err != nil {
+		return nil, fmt.Errorf("firestoredb: could not list dead-lettered events: %v", err)
+	}
+	return eventsFrom(docs)
+}
+
+// RedriveEvent makes a dead-lettered event due now.
+func (db *firestoreDB) RedriveEvent(ctx context.Context, id string) error {
+	return db.updateEvent(ctx, id, "redrive", []firestore.Update{
+		{Path: "DeadLettered", Value: time.Time{}},
+		{Path: "NextAttempt", Value: db.clock.Now()},
+		{Path: "Attempts", Value: 0},
+	})
+}
+
+// DiscardEvent deletes an event.
+func (db *firestoreDB) DiscardEvent(ctx context.Context, id string) error {
+	if _, err := db.client.Collection(db.outbox).Doc(id).Delete(ctx); err != nil {
+		return fmt.Errorf("firestoredb: could not discard event %q: %v", id, err)
+	}
+	return nil
+}
+
+// lease is a lock document.
+type lease struct {
+	Holder  string
+	Expires time.Time
+}
+
+// AcquireLock takes the named lock for holder in a transaction, unless
+// another holder has an unexpired lease on it.
+func (db *firestoreDB) AcquireLock(ctx context.Context, name, holder string, ttl time.Duration) (bool, error) {
+	ref := db.client.Collection(db.locks).Doc(name)
+	acquired := false
+	err := db.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		acquired = false
+		ds, err := tx.Get(ref)
+		exists := ds == nil || ds.Exists()
+		if err != nil && exists {
+			return err
+		}
+		now := db.clock.Now()
+		if exists {
+			l := &lease{}
+			if err := ds.DataTo(l); err != nil {
+				return err
+			}
+			if l.Holder != holder && l.Expires.After(now) {
+				return nil
+			}
+		}
+		acquired = true
+		return tx.Set(ref, &lease{Holder: holder, Expires: now.Add(ttl)})
+	})
+	if err != nil {
+		return false, fmt.Errorf("firestoredb: could not acquire lock %q: %v", name, err)
+	}
+	return acquired, nil
+}
+
+// GetDualConfig returns the dual-write configuration, or the zero
+// configuration if none was saved.
+func (db *firestoreDB) GetDualConfig(ctx context.Context) (DualConfig, error) {
+	var c DualConfig
+	ds, err := db.client.Collection(db.config).Doc("dualWrite").Get(ctx)
+	if ds != nil && !ds.Exists() {
+		return c, nil
+	}
+	if err != nil {
+		return c, fmt.Errorf("firestoredb: Get: %v", err)
+	}
+	if err := ds.DataTo(&c); err != nil {
+		return c, fmt.Errorf("firestoredb: could not read dual-write config: %v", err)
+	}
+	return c, nil
+}
+
+// SetDualConfig saves the dual-write configuration.
+func (db *firestoreDB) SetDualConfig(ctx context.Context, c DualConfig) error {
+	if _, err := db.client.Collection(db.config).Doc("dualWrite").Set(ctx, c); err != nil {
+		return fmt.Errorf("firestoredb: Set: %v", err)
+	}
+	return nil
+}
+
+// GetKeyringConfig returns the keyring configuration, or the zero
+// configuration if none was saved.
+func (db *firestoreDB) GetKeyringConfig(ctx context.Context) (KeyringConfig, error) {
+	var c KeyringConfig
+	ds, err := db.client.Collection(db.config).Doc("keyring").Get(ctx)
+	if ds != nil && !ds.Exists() {
+		return c, nil
+	}
+	if err != nil {
+		return c, fmt.Errorf("firestoredb: Get: %v", err)
+	}
+	if err := ds.DataTo(&c); err != nil {
+		return c, fmt.Errorf("firestoredb: could not read keyring config: %v", err)
+	}
+	return c, nil
+}
+
+// SetKeyringConfig saves the keyring configuration.
+func (db *firestoreDB) SetKeyringConfig(ctx context.Context, c KeyringConfig) error {
+	if _, err := db.client.Collection(db.config).Doc("keyring").Set(ctx, c); err != nil {
+		return fmt.Errorf("firestoredb: Set: %v", err)
+	}
+	return nil
+}
+
+// GetSheetSync returns the linked sheet, or the zero SheetSync if none was
+// saved.
+func (db *firestoreDB) GetSheetSync(ctx context.Context) (SheetSync, error) {
+	var s SheetSync
+	ds, err := db.client.Collection(db.config).Doc("sheetSync").Get(ctx)
+	if ds != nil && !ds.Exists() {
+		return s, nil
+	}
+	if err != nil {
+		return s, fmt.Errorf("firestoredb: Get: %v", err)
+	}
+	if err := ds.DataTo(&s); err != nil {
+		return s, fmt.Errorf("firestoredb: could not read sheet sync: %v", err)
+	}
+	return s, nil
+}
+
+// SetSheetSync saves the linked sheet.
+func (db *firestoreDB) SetSheetSync(ctx context.Context, s SheetSync) error {
+	if _, err := db.client.Collection(db.config).Doc("sheetSync").Set(ctx, s); err != nil {
+		return fmt.Errorf("firestoredb: Set: %v", err)
+	}
+	return nil
+}
+
+// AddToken stores tok under tok.ID.
+func (db *firestoreDB) AddToken(ctx context.Context, tok *APIToken) error {
+	if _, err := db.client.Collection(db.tokens).Doc(tok.ID).Create(ctx, tok); err != nil {
+		return fmt.Errorf("firestoredb: Create: %v", err)
+	}
+	return nil
+}
+
+// GetToken returns the token with the given ID, or nil if there is none.
+func (db *firestoreDB) GetToken(ctx context.Context, id string) (*APIToken, error) {
+	ds, err := db.client.Collection(db.tokens).Doc(id).Get(ctx)
+	if ds != nil && !ds.Exists() {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("firestoredb: Get: %v", err)
+	}
+	tok := &APIToken{}
+	if err := ds.DataTo(tok); err != nil {
+		return nil, fmt.Errorf("firestoredb: could not read token: %v", err)
+	}
+	return tok, nil
+}
+
+// ListTokens returns the tokens of user, newest first. They are sorted here
+// rather than in the query, which would need a composite index.
+func (db *firestoreDB) ListTokens(ctx context.Context, user string) ([]*APIToken, error) {
+	var tokens []*APIToken
+	iter := db.client.Collection(db.tokens).Where("User", "==", user).Documents(ctx)
+	defer iter.Stop()
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("firestoredb: could not list tokens: %v", err)
+		}
+		tok := &APIToken{}
+		doc.DataTo(tok)
+		tokens = append(tokens, tok)
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].Created.After(tokens[j].Created) })
+	return tokens, nil
+}
+
+// TouchToken records that the token was used at the given time.
+func (db *firestoreDB) TouchToken(ctx context.Context, id string, at time.Time) error {
+	_, err := db.client.Collection(db.tokens).Doc(id).Update(ctx, []firestore.Update{
+		{Path: "LastUsed", Value: at},
+	})
+	if err != nil {
+		return fmt.Errorf("firestoredb: Update: %v", err)
+	}
+	return nil
+}
+
+// DeleteToken revokes a token of user.
+func (db *firestoreDB) DeleteToken(ctx context.Context, user, id string) error {
+	tok, err := db.GetToken(ctx, id)
+	if err != nil || tok == nil || tok.User != user {
+		return err
+	}
+	if _, err := db.client.Collection(db.tokens).Doc(id).Delete(ctx); err != nil {
+		return fmt.Errorf("firestoredb: Delete: %v", err)
+	}
+	return nil
+}
+
+// GetProfile returns the profile of user, or nil if there is none.
+func (db *firestoreDB) GetProfile(ctx context.Context, user string) (*Profile, error) {
+	ds, err := db.client.Collection(db.profiles).Doc(user).Get(ctx)
+	if ds != nil && !ds.Exists() {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("firestoredb: Get: %v", err)
+	}
+	p := &Profile{}
+	if err := ds.DataTo(p); err != nil {
+		return nil, fmt.Errorf("firestoredb: could not read profile: %v", err)
+	}
+	return p, nil
+}
+
+// SetProfile stores the profile of user.
+func (db *firestoreDB) SetProfile(ctx context.Context, user string, p *Profile) error {
+	if _, err := db.client.Collection(db.profiles).Doc(user).Set(ctx, p); err != nil {
+		return fmt.Errorf("firestoredb: Set: %v", err)
+	}
+	return nil
+}
+
+// DeleteProfile removes the profile of user, if any.
+func (db *firestoreDB) DeleteProfile(ctx context.Context, user string) error {
+	if _, err := db.client.Collection(db.profiles).Doc(user).Delete(ctx); err != nil {
+		return fmt.Errorf("firestoredb: Delete: %v", err)
+	}
+	return nil
+}
+
+// AddSavedSearch stores s under s.ID.
+func (db *firestoreDB) AddSavedSearch(ctx context.Context, s *SavedSearch) error {
+	if _, err := db.client.Collection(db.searches).Doc(s.ID).Create(ctx, s); err != nil {
+		return fmt.Errorf("firestoredb: Create: %v", err)
+	}
+	return nil
+}
+
+// GetSavedSearch returns the saved search of user with the given ID, or nil
+// if user has none.
+func (db *firestoreDB) GetSavedSearch(ctx context.Context, user, id string) (*SavedSearch, error) {
+	ds, err := db.client.Collection(db.searches).Doc(id).Get(ctx)
+	if ds != nil && !ds.Exists() {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("firestoredb: Get: %v", err)
+	}
+	s := &SavedSearch{}
+	if err := ds.DataTo(s); err != nil {
+		return nil, fmt.Errorf("firestoredb: could not read saved search: %v", err)
+	}
+	if s.User != user {
+		return nil, nil
+	}
+	return s, nil
+}
+
+// ListSavedSearches returns the saved searches of user, by name. They are
+// sorted here rather than in the query, which would need a composite index.
+func (db *firestoreDB) ListSavedSearches(ctx context.Context, user string) ([]*SavedSearch, error) {
+	docs, err := db.client.Collection(db.searches).Where("User", "==", user).Documents(ctx).GetAll()
+	if err != nil {
+		return nil, fmt.Errorf("firestoredb: could not list saved searches: %v", err)
+	}
+	saved := make([]*SavedSearch, 0, len(docs))
+	for _, doc := range docs {
+		s := &SavedSearch{}
+		if err := doc.DataTo(s); err != nil {
+			return nil, fmt.Errorf("firestoredb: could not read saved search: %v", err)
+		}
+		saved = append(saved, s)
+	}
+	sort.Slice(saved, func(i, j int) bool { return saved[i].Name < saved[j].Name })
+	return saved, nil
+}
+
+// DeleteSavedSearch removes a saved search of user.
+func (db *firestoreDB) DeleteSavedSearch(ctx context.Context, user, id string) error {
+	s, err := db.GetSavedSearch(ctx, user, id)
+	if err != nil || s == nil {
+		return err
+	}
+	if _, err := db.client.Collection(db.searches).Doc(id).Delete(ctx); err != nil {
+		return fmt.Errorf("firestoredb: Delete: %v", err)
+	}
+	return nil
+}
+
+// SetOperation stores op under op.ID, replacing any earlier version.
+func (db *firestoreDB) SetOperation(ctx context.Context, op *Operation) error {
+	if _, err := db.client.Collection(db.operations).Doc(op.ID).Set(ctx, op); err != nil {
+		return fmt.Errorf("firestoredb: Set: %v", err)
+	}
+	return nil
+}
+
+// GetOperation returns the operation with the given ID, or nil if there is
+// none.
+func (db *firestoreDB) GetOperation(ctx context.Context, id string) (*Operation, error) {
+	ds, err := db.client.Collection(db.operations).Doc(id).Get(ctx)
+	if ds != nil && !ds.Exists() {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("firestoredb: Get: %v", err)
+	}
+	op := &Operation{}
+	if err := ds.DataTo(op); err != nil {
+		return nil, fmt.Errorf("firestoredb: could not read operation: %v", err)
+	}
+	return op, nil
+}
+
+// ListOperations returns the most recently started operations, newest
+// first, at most limit.
+func (db *firestoreDB) ListOperations(ctx context.Context, limit int) ([]*Operation, error) {
+	docs, err := db.client.Collection(db.operations).OrderBy("Started", firestore.Desc).Limit(limit).Documents(ctx).GetAll()
+	if err != nil {
+		return nil, fmt.Errorf("firestoredb: could not list operations: %v", err)
+	}
+	ops := make([]*Operation, 0, len(docs))
+	for _, doc := range docs {
+		op := &Operation{}
+		if err := doc.DataTo(op); err != nil {
+			return nil, fmt.Errorf("firestoredb: could not read operation: %v", err)
+		}
+		ops = append(ops, op)
+	}
+	return ops, nil
+}
+
+// AddDelivery records a delivery, assigning it a new ID.
+func (db *firestoreDB) AddDelivery(ctx context.Context, d *Delivery) error {
+	ref := db.newDoc(db.client.Collection(db.deliveries), "deliveries")
+	d.ID = ref.ID
+	if _, err := ref.Create(ctx, d); err != nil {
+		return fmt.Errorf("firestoredb: Create: %v", err)
+	}
+	return nil
+}
+
+// ListDeliveries returns up to limit deliveries, newest first.
+func (db *firestoreDB) ListDeliveries(ctx context.Context, limit int) ([]*Delivery, error) {
+	docs, err := db.client.Collection(db.deliveries).OrderBy("At", firestore.Desc).Limit(limit).Documents(ctx).GetAll()
+	if err != nil {
+		return nil, fmt.Errorf("firestoredb: could not list deliveries: %v", err)
+	}
+	deliveries := make([]*Delivery, 0, len(docs))
+	for _, doc := range docs {
+		d := &Delivery{}
+		if err := doc.DataTo(d); err != nil {
+			return nil, fmt.Errorf("firestoredb: could not read delivery %q: %v", doc.Ref.ID, err)
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, nil
+}
+
+// AddSignIn records an attempt, assigning it a new ID.
+func (db *firestoreDB) AddSignIn(ctx context.Context, s *SignIn) error {
+	ref := db.newDoc(db.client.Collection(db.signIns), "signIns")
+	s.ID = ref.ID
+	if _, err := ref.Create(ctx, s); err != nil {
+		return fmt.Errorf("firestoredb: Create: %v", err)
+	}
+	return nil
+}
+
+// ListSignIns returns up to limit attempts of user, or of everyone if user
+// is "", newest first.
+func (db *firestoreDB) ListSignIns(ctx context.Context, user string, limit int) ([]*SignIn, error) {
+	q := db.client.Collection(db.signIns).Query
+	if user != "" {
+		q = q.Where("User", "==", user)
+	}
+	docs, err := q.OrderBy("At", firestore.Desc).Limit(limit).Documents(ctx).GetAll()
+	if err != nil {
+		return nil, fmt.Errorf("firestoredb: could not list sign-ins: %v", err)
+	}
+	signIns := make([]*SignIn, 0, len(docs))
+	for _, doc := range docs {
+		s := &SignIn{}
+		if err := doc.DataTo(s); err != nil {
+			return nil, fmt.Errorf("firestoredb: could not read sign-in %q: %v", doc.Ref.ID, err)
+		}
+		signIns = append(signIns, s)
+	}
+	return signIns, nil
+}
+
+// DeleteSignIns deletes the attempts of user.
+func (db *firestoreDB) DeleteSignIns(ctx context.Context, user string) error {
+	iter := db.client.Collection(db.signIns).Where("User", "==", user).Documents(ctx)
+	defer iter.Stop()
+
+	pending := 0
+	batch := db.client.Batch()
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("firestoredb: could not list sign-ins: %v", err)
+		}
+		batch.Delete(doc.Ref)
+		if pending++; pending == maxBatchWrites {
+			if _, err := batch.Commit(ctx); err != nil {
+				return fmt.Errorf("firestoredb: could not delete sign-ins: %v", err)
+			}
+			pending, batch = 0, db.client.Batch()
+		}
+	}
+	if pending > 0 {
+		if _, err := batch.Commit(ctx); err != nil {
+			return fmt.Errorf("firestoredb: could not delete sign-ins: %v", err)
+		}
+	}
+	return nil
+}
+
+// failureDoc returns the document counting failures against key. Keys are
+// hashed since they may contain characters not allowed in document IDs.
+func (db *firestoreDB) failureDoc(key string) *firestore.DocumentRef {
+	sum := sha256.Sum256([]byte(key))
+	return db.client.Collection(db.failures).Doc(hex.EncodeToString(sum[:]))
+}
+
+// AddSignInFailure counts a failure against key and returns the number of
+// failures within the window.
+func (db *firestoreDB) AddSignInFailure(ctx context.Context, key string, at time.Time, window time.Duration) (int, error) {
+	ref := db.failureDoc(key)
+	var c signInFailureCount
+	err := db.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		c = signInFailureCount{}
+		ds, err := tx.Get(ref)
+		exists := ds == nil || ds.Exists()
+		if err != nil && exists {
+			return err
+		}
+		if exists {
+			if err := ds.DataTo(&c); err != nil {
+				return err
+			}
+		}
+		if at.Sub(c.Since) > window {
+			c = signInFailureCount{Since: at}
+		}
+		c.Failures++
+		return tx.Set(ref, &c)
+	})
+	if err != nil {
+		return 0, fmt.Errorf("firestoredb: could not count sign-in failure: %v", err)
+	}
+	return c.Failures, nil
+}
+
+// SignInFailures returns the number of failures counted against key within
+// the window.
+func (db *firestoreDB) SignInFailures(ctx context.Context, key string, at time.Time, window time.Duration) (int, error) {
+	ds, err := db.failureDoc(key).Get(ctx)
+	if ds != nil && !ds.Exists() {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("firestoredb: Get: %v", err)
+	}
+	var c signInFailureCount
+	if err := ds.DataTo(&c); err != nil {
+		return 0, fmt.Errorf("firestoredb: could not read sign-in failures: %v", err)
+	}
+	if at.Sub(c.Since) > window {
+		return 0, nil
+	}
+	return c.Failures, nil
+}
+
+// ResetSignInFailures clears the failures counted against key.
+func (db *firestoreDB) ResetSignInFailures(ctx context.Context, key string) error {
+	if _, err := db.failureDoc(key).Delete(ctx); err != nil {
+		return fmt.Errorf("firestoredb: Delete: %v", err)
+	}
+	return nil
+}
+
+// RefUpload counts another reference to the upload with the given hash and
+// returns it, or nil if there is none.
+func (db *firestoreDB) RefUpload(ctx context.Context, hash string) (*Upload, error) {
+	ref := db.client.Collection(db.uploads).Doc(hash)
+	var u *Upload
+	err := db.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		u = nil
+		ds, err := tx.Get(ref)
+		if ds != nil && !ds.Exists() {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		u = &Upload{}
+		if err := ds.DataTo(u); err != nil {
+			return err
+		}
+		u.Refs++
+		return tx.Set(ref, u)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("firestoredb: could not reference upload: %v", err)
+	}
+	return u, nil
+}
+
+// AddUpload records u with one reference, unless an upload with its hash
+// is recorded already, in which case it counts another reference to that
+// one. It returns the upload recorded.
+func (db *firestoreDB) AddUpload(ctx context.Context, u *Upload) (*Upload, error) {
+	ref := db.client.Collection(db.uploads).Doc(u.Hash)
+	var rec *Upload
+	err := db.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		ds, err := tx.Get(ref)
+		exists := ds == nil || ds.Exists()
+		if err != nil && exists {
+			return err
+		}
+		c := *u
+		rec = &c
+		if exists {
+			if err := ds.DataTo(rec); err != nil {
+				return err
+			}
+			rec.Refs++
+		} else {
+			rec.Refs = 1
+		}
+		return tx.Set(ref, rec)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("firestoredb: could not add upload: %v", err)
+	}
+	return rec, nil
+}
+
+// UnrefUpload counts one fewer reference to the upload with the given
+// hash, removing it at none, and returns the references left.
+func (db *firestoreDB) UnrefUpload(ctx context.Context, hash string) (int, error) {
+	ref := db.client.Collection(db.uploads).Doc(hash)
+	refs := 0
+	err := db.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		refs = 0
+		ds, err := tx.Get(ref)
+		if ds != nil && !ds.Exists() {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		u := &Upload{}
+		if err := ds.DataTo(u); err != nil {
+			return err
+		}
+		if u.Refs--; u.Refs <= 0 {
+			return tx.Delete(ref)
+		}
+		refs = u.Refs
+		return tx.Set(ref, u)
+	})
+	if err != nil {
+		return 0, fmt.Errorf("firestoredb: could not unreference upload: %v", err)
+	}
+	return refs, nil
+}
+
+// TreatStats returns statistics of the treats that aren't deleted, reading
+// only the fields they need. Documents know when they were created, so
+// every treat is dated.
+func (db *firestoreDB) TreatStats(ctx context.Context, now time.Time) (*TreatStats, error) {
+	iter := db.client.Collection(db.collection).Select("Author", "Tags", "DeletedAt").Documents(ctx)
+	defer iter.Stop()
+	s := newTreatStats(now)
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			return s, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("firestoredb: could not compute statistics: %v", err)
+		}
+		t := &Treat{}
+		if err := doc.DataTo(t); err != nil {
+			return nil, fmt.Errorf("firestoredb: treat %s: %v", doc.Ref.ID, err)
+		}
+		s.add(t, doc.CreateTime)
+	}
+}
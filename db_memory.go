@@ -5,23 +5,174 @@ import (
 	"errors"
 	"fmt"
 	"sort"
-	"strconv"
 	"sync"
+	"time"
 )
 
-var _ TreatDatabase = &memoryDB{}
+var (
+	_ TreatDatabase       = &memoryDB{}
+	_ LocationDatabase    = &memoryDB{}
+	_ PreferencesDatabase = &memoryDB{}
+	_ IdempotencyDatabase = &memoryDB{}
+	_ OutboxDatabase      = &memoryDB{}
+	_ LockDatabase        = &memoryDB{}
+	_ TokenDatabase       = &memoryDB{}
+	_ ProfileDatabase     = &memoryDB{}
+	_ SignInDatabase      = &memoryDB{}
+	_ ReportDatabase      = &memoryDB{}
+	_ SavedSearchDatabase = &memoryDB{}
+	_ OperationDatabase   = &memoryDB{}
+	_ DeliveryDatabase    = &memoryDB{}
+	_ SheetSyncStore      = &memoryDB{}
+	_ UploadDatabase      = &memoryDB{}
+	_ StatsDatabase       = &memoryDB{}
+)
 
-// memoryDB is a simple in-memory persistence layer for treats.
+// memoryDB is a simple in-memory persistence layer for treats. Like the
+// other databases, it stores and returns copies, so callers can change
+// what they pass in or get back without racing with other requests.
 type memoryDB struct {
-	mu     sync.Mutex
-	nextID int64            // next ID to assign to a treat.
-	treats  map[string]*Treat // maps from Treat ID to Treat.
+	mu    sync.Mutex
+	clock Clock       // tells the time, see clock.go.
+	ids   IDGenerator // makes IDs, see ids.go.
+
+	treats map[string]*Treat // maps from Treat ID to Treat.
+
+	created map[string]time.Time // maps from Treat ID to when it was added.
+
+	claims map[string][]*Claim // maps from Treat ID to its claims.
+
+	reports map[string][]*Report // maps from Treat ID to its open reports.
+
+	locations map[string]*Location // maps from Location ID to Location.
+
+	preferences map[string]*Preferences // maps from preferences key.
+
+	idempotency map[string]*IdempotentRequest // maps from idempotency key.
+
+	events map[string]*Event // maps from Event ID to Event.
+
+	locks map[string]memoryLease // maps from lock name.
+
+	tokens map[string]*APIToken // maps from APIToken ID.
+
+	profiles map[string]*Profile // maps from user.
+
+	searches map[string]*SavedSearch // maps from SavedSearch ID.
+
+	operations map[string]*Operation // maps from Operation ID.
+
+	deliveries []*Delivery // oldest first.
+
+	sheetSync SheetSync // the linked sheet.
+
+	signIns        []*SignIn                     // oldest first.
+	signInFailures map[string]signInFailureCount // maps from failure key.
+
+	uploads map[string]*Upload // maps from Upload hash.
+}
+
+// copyTreat returns a copy of t that shares no memory with it, or nil if t
+// is nil.
+func copyTreat(t *Treat) *Treat {
+	if t == nil {
+		return nil
+	}
+	c := *t
+	if t.Nutrition != nil {
+		n := *t.Nutrition
+		c.Nutrition = &n
+	}
+	if t.Quantity != nil {
+		q := *t.Quantity
+		c.Quantity = &q
+	}
+	if t.Price != nil {
+		p := *t.Price
+		c.Price = &p
+	}
+	if t.Place != nil {
+		p := *t.Place
+		c.Place = &p
+	}
+	c.Allergens = copyStrings(t.Allergens)
+	c.Tags = copyStrings(t.Tags)
+	return &c
+}
+
+// copyPreferences returns a copy of p that shares no memory with it, or
+// nil if p is nil.
+func copyPreferences(p *Preferences) *Preferences {
+	if p == nil {
+		return nil
+	}
+	c := *p
+	c.HiddenAllergens = copyStrings(p.HiddenAllergens)
+	return &c
+}
+
+// copyStrings returns a copy of s, keeping nil and empty slices apart.
+func copyStrings(s []string) []string {
+	if s == nil {
+		return nil
+	}
+	return append(make([]string, 0, len(s)), s...)
+}
+
+// memoryLease is a held lock, see AcquireLock.
+type memoryLease struct {
+	holder  string
+	expires time.Time
 }
 
 func newMemoryDB() *memoryDB {
-	return &memoryDB{
-		treats:  make(map[string]*Treat),
-		nextID: 1,
+	db := &memoryDB{clock: systemClock{}, ids: newSequenceIDs()}
+	db.init()
+	return db
+}
+
+// init empties db. Callers other than newMemoryDB must hold db.mu.
+func (db *memoryDB) init() {
+	db.treats = make(map[string]*Treat)
+	db.created = make(map[string]time.Time)
+	db.claims = make(map[string][]*Claim)
+	db.reports = make(map[string][]*Report)
+
+	db.locations = make(map[string]*Location)
+
+	db.preferences = make(map[string]*Preferences)
+	db.idempotency = make(map[string]*IdempotentRequest)
+
+	db.events = make(map[string]*Event)
+
+	db.locks = make(map[string]memoryLease)
+
+	db.tokens = make(map[string]*APIToken)
+	db.profiles = make(map[string]*Profile)
+	db.searches = make(map[string]*SavedSearch)
+
+	db.operations = make(map[string]*Operation)
+
+	db.deliveries = nil
+
+	db.sheetSync = SheetSync{}
+
+	db.signIns = nil
+	db.signInFailures = make(map[string]signInFailureCount)
+
+	db.uploads = make(map[string]*Upload)
+}
+
+// reset empties db, and numbers new records from 1 again if its
+// IDGenerator counts, so that tests can start again from a known state with
+// the same IDs, see testhooks.go.
+func (db *memoryDB) reset() {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.init()
+	if ids, ok := db.ids.(resetter); ok {
+		ids.reset()
 	}
 }
 
@@ -44,7 +195,20 @@ func (db *memoryDB) GetTreat(_ context.Context, id string) (*Treat, error) {
 	if !ok {
 		return nil, fmt.Errorf("memorydb: treat not found with ID %q", id)
 	}
-	return treat, nil
+	return copyTreat(treat), nil
+}
+
+// GetTreats retrieves the treats with the given IDs, nil for those that
+// don't exist.
+func (db *memoryDB) GetTreats(_ context.Context, ids []string) ([]*Treat, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	treats := make([]*Treat, len(ids))
+	for i, id := range ids {
+		treats[i] = copyTreat(db.treats[id])
+	}
+	return treats, nil
 }
 
 // AddTreat saves a given treat, assigning it a new ID.
@@ -52,10 +216,9 @@ func (db *memoryDB) AddTreat(_ context.Context, t *Treat) (id string, err error)
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
-	t.ID = strconv.FormatInt(db.nextID, 10)
-	db.treats[t.ID] = t
-
-	db.nextID++
+	t.ID = db.ids.NewID("treats")
+	db.treats[t.ID] = copyTreat(t)
+	db.created[t.ID] = db.clock.Now()
 
 	return t.ID, nil
 }
@@ -73,6 +236,8 @@ func (db *memoryDB) DeleteTreat(_ context.Context, id string) error {
 		return fmt.Errorf("memorydb: could not delete treat with ID %q, does not exist", id)
 	}
 	delete(db.treats, id)
+	delete(db.created, id)
+	delete(db.claims, id)
 	return nil
 }
 
@@ -85,22 +250,986 @@ func (db *memoryDB) UpdateTreat(_ context.Context, t *Treat) error {
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
-	db.treats[t.ID] = t
+	db.treats[t.ID] = copyTreat(t)
+	return nil
+}
+
+// SaveTreats adds or replaces the given treats.
+func (db *memoryDB) SaveTreats(_ context.Context, treats []*Treat) error {
+	if len(treats) > maxBatchWrites {
+		return fmt.Errorf("memorydb: cannot save more than %d treats at once", maxBatchWrites)
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for _, t := range treats {
+		if t.ID == "" {
+			t.ID = db.ids.NewID("treats")
+		}
+		if _, ok := db.treats[t.ID]; !ok {
+			db.created[t.ID] = db.clock.Now()
+		}
+		db.treats[t.ID] = copyTreat(t)
+	}
+	return nil
+}
+
+// UpdateTreatFields sets the given fields of the stored treat to those of t.
+func (db *memoryDB) UpdateTreatFields(_ context.Context, t *Treat, fields []string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	stored, ok := db.treats[t.ID]
+	if !ok {
+		return fmt.Errorf("memorydb: could not update treat with ID %q, does not exist", t.ID)
+	}
+	c := copyTreat(stored)
+	copyTreatFields(c, copyTreat(t), fields)
+	db.treats[t.ID] = c
 	return nil
 }
 
-// ListBooks returns a list of books, ordered by title.
-func (db *memoryDB) ListTreats(_ context.Context) ([]*Treat, error) {
+// AdjustQuantity adds delta to the Quantity of a given treat.
+func (db *memoryDB) AdjustQuantity(_ context.Context, id string, delta int) (*Treat, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	t, ok := db.treats[id]
+	if !ok {
+		return nil, fmt.Errorf("memorydb: treat not found with ID %q", id)
+	}
+	if err := t.takePortions(-delta); err != nil {
+		return nil, err
+	}
+	db.addEventLocked(ranOutEvent(db.clock.Now(), t, -delta))
+	return copyTreat(t), nil
+}
+
+// ChangeTreat lets change modify a given treat, and writes the fields it
+// returns, or the whole treat, holding the lock throughout.
+func (db *memoryDB) ChangeTreat(_ context.Context, id string, change func(*Treat) ([]string, error)) (*Treat, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	stored, ok := db.treats[id]
+	if !ok {
+		return nil, fmt.Errorf("memorydb: treat not found with ID %q", id)
+	}
+	t := copyTreat(stored)
+	fields, err := change(t)
+	if err != nil {
+		return nil, err
+	}
+	t.ID = id
+	if len(fields) > 0 {
+		c := copyTreat(stored)
+		copyTreatFields(c, t, fields)
+		t = c
+	}
+	db.treats[id] = copyTreat(t)
+	return t, nil
+}
+
+// ListTreats returns a list of treats matching opts, ordered by opts.Sort.
+func (db *memoryDB) ListTreats(_ context.Context, opts ListOptions) ([]*Treat, error) {
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
 	var treats []*Treat
 	for _, t := range db.treats {
-		treats = append(treats, t)
+		if !opts.matches(t, db.clock.Now()) {
+			continue
+		}
+		treats = append(treats, copyTreat(t))
 	}
 
-	sort.Slice(treats, func(i, j int) bool {
-		return treats[i].Title < treats[j].Title
-	})
+	opts.sortTreats(treats)
 	return treats, nil
-}
\ No newline at end of file
+}
+
+// EachTreat calls fn with each treat matching opts, ordered by title. The
+// treats are in memory anyway, so it simply lists them.
+func (db *memoryDB) EachTreat(ctx context.Context, opts ListOptions, fn func(*Treat) error) error {
+	opts.Sort = sortByTitle
+	treats, err := db.ListTreats(ctx, opts)
+	if err != nil {
+		return err
+	}
+	for _, t := range treats {
+		if err := fn(t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ArchiveExpired archives all treats that expired before now.
+func (db *memoryDB) ArchiveExpired(_ context.Context, now time.Time) (int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	n := 0
+	for _, t := range db.treats {
+		if t.Archived || t.ExpiresAt.IsZero() || t.ExpiresAt.After(now) {
+			continue
+		}
+		t.Archived = true
+		n++
+	}
+	return n, nil
+}
+
+// SoftDeleteTreats marks the given treats deleted at the given time.
+func (db *memoryDB) SoftDeleteTreats(_ context.Context, ids []string, token string, at time.Time) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for _, id := range ids {
+		if _, ok := db.treats[id]; !ok {
+			return fmt.Errorf("memorydb: could not delete treat with ID %q, does not exist", id)
+		}
+	}
+	for _, id := range ids {
+		t := db.treats[id]
+		t.DeletedAt = at
+		t.UndoToken = token
+	}
+	return nil
+}
+
+// RestoreTreats restores the treats soft-deleted with token after the given
+// time.
+func (db *memoryDB) RestoreTreats(_ context.Context, token string, after time.Time) (int, error) {
+	if token == "" {
+		return 0, nil
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	n := 0
+	for _, t := range db.treats {
+		if t.UndoToken != token || !t.DeletedAt.After(after) {
+			continue
+		}
+		t.DeletedAt = time.Time{}
+		t.UndoToken = ""
+		n++
+	}
+	return n, nil
+}
+
+// ListDeletedTreats returns the treats soft-deleted before the given time.
+func (db *memoryDB) ListDeletedTreats(_ context.Context, before time.Time) ([]*Treat, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var treats []*Treat
+	for _, t := range db.treats {
+		if t.Deleted() && !t.DeletedAt.After(before) {
+			treats = append(treats, copyTreat(t))
+		}
+	}
+	return treats, nil
+}
+
+// PurgeDeletedTreats removes treats soft-deleted before the given time.
+func (db *memoryDB) PurgeDeletedTreats(_ context.Context, before time.Time) (int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	n := 0
+	for id, t := range db.treats {
+		if !t.Deleted() || t.DeletedAt.After(before) {
+			continue
+		}
+		delete(db.treats, id)
+		delete(db.created, id)
+		delete(db.claims, id)
+		n++
+	}
+	return n, nil
+}
+
+// ReplaceTags replaces every tag in from with to across all treats.
+func (db *memoryDB) ReplaceTags(_ context.Context, from []string, to string, progress func(done, total int)) (int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	n := 0
+	for _, t := range db.treats {
+		tags, changed := replaceTags(t.Tags, from, to)
+		if !changed {
+			continue
+		}
+		t.Tags = tags
+		n++
+	}
+	if progress != nil {
+		progress(n, n)
+	}
+	return n, nil
+}
+
+// ListClaims returns the claims on a given treat, oldest first.
+func (db *memoryDB) ListClaims(_ context.Context, treatID string) ([]*Claim, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var claims []*Claim
+	for _, c := range db.claims[treatID] {
+		cp := *c
+		claims = append(claims, &cp)
+	}
+	return claims, nil
+}
+
+// ClaimTreat takes c.Portions from a given treat and records the claim.
+func (db *memoryDB) ClaimTreat(_ context.Context, treatID string, c *Claim) (id string, err error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	t, ok := db.treats[treatID]
+	if !ok {
+		return "", fmt.Errorf("memorydb: treat not found with ID %q", treatID)
+	}
+	if err := t.takePortions(c.Portions); err != nil {
+		return "", err
+	}
+	db.addEventLocked(ranOutEvent(db.clock.Now(), t, c.Portions))
+
+	c.ID = db.ids.NewID("claims")
+	c.TreatID = treatID
+	cp := *c
+	db.claims[treatID] = append(db.claims[treatID], &cp)
+
+	return c.ID, nil
+}
+
+// ReleaseClaim removes a claim and returns its portions to the treat.
+func (db *memoryDB) ReleaseClaim(_ context.Context, treatID, claimID string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	claims := db.claims[treatID]
+	for i, c := range claims {
+		if c.ID != claimID {
+			continue
+		}
+		db.claims[treatID] = append(claims[:i:i], claims[i+1:]...)
+		if t, ok := db.treats[treatID]; ok {
+			t.takePortions(-c.Portions)
+		}
+		return nil
+	}
+	return fmt.Errorf("memorydb: claim %q not found on treat %q", claimID, treatID)
+}
+
+// AnonymizeClaims replaces the name on every claim user made with name, and
+// forgets who made them.
+func (db *memoryDB) AnonymizeClaims(_ context.Context, user, name string) (int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	n := 0
+	for _, claims := range db.claims {
+		for _, c := range claims {
+			if c.ClaimedBy == user {
+				c.Name, c.ClaimedBy, c.Session = name, "", ""
+				n++
+			}
+		}
+	}
+	return n, nil
+}
+
+// ReportTreat records rep and counts it on the treat, holding the treat for
+// review once hideAt reports are open.
+func (db *memoryDB) ReportTreat(_ context.Context, treatID string, rep *Report, hideAt int) (open int, err error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	t, ok := db.treats[treatID]
+	if !ok {
+		return 0, fmt.Errorf("memorydb: treat not found with ID %q", treatID)
+	}
+	for _, r := range db.reports[treatID] {
+		if r.ID == rep.ID {
+			return 0, errAlreadyReported
+		}
+	}
+	rep.TreatID = treatID
+	cp := *rep
+	db.reports[treatID] = append(db.reports[treatID], &cp)
+	t.Reports++
+	if t.Reports >= hideAt && t.Review == "" {
+		t.Review = reviewPending
+	}
+	return t.Reports, nil
+}
+
+// ListReports returns the open reports of a treat, oldest first.
+func (db *memoryDB) ListReports(_ context.Context, treatID string) ([]*Report, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var reports []*Report
+	for _, r := range db.reports[treatID] {
+		cp := *r
+		reports = append(reports, &cp)
+	}
+	return reports, nil
+}
+
+// ClearReports deletes the reports of a treat and resets its count.
+func (db *memoryDB) ClearReports(_ context.Context, treatID string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	delete(db.reports, treatID)
+	if t, ok := db.treats[treatID]; ok {
+		t.Reports = 0
+	}
+	return nil
+}
+
+// ListLocations returns a list of locations, ordered by name.
+func (db *memoryDB) ListLocations(_ context.Context) ([]*Location, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var locations []*Location
+	for _, l := range db.locations {
+		c := *l
+		locations = append(locations, &c)
+	}
+	sort.Slice(locations, func(i, j int) bool {
+		return locations[i].Name < locations[j].Name
+	})
+	return locations, nil
+}
+
+// GetLocation retrieves a location by its ID.
+func (db *memoryDB) GetLocation(_ context.Context, id string) (*Location, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	l, ok := db.locations[id]
+	if !ok {
+		return nil, fmt.Errorf("memorydb: location not found with ID %q", id)
+	}
+	c := *l
+	return &c, nil
+}
+
+// AddLocation saves a given location, assigning it a new ID.
+func (db *memoryDB) AddLocation(_ context.Context, l *Location) (id string, err error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	l.ID = db.ids.NewID("locations")
+	c := *l
+	db.locations[l.ID] = &c
+	return l.ID, nil
+}
+
+// DeleteLocation removes a given location by its ID.
+func (db *memoryDB) DeleteLocation(_ context.Context, id string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, ok := db.locations[id]; !ok {
+		return fmt.Errorf("memorydb: could not delete location with ID %q, does not exist", id)
+	}
+	delete(db.locations, id)
+	return nil
+}
+
+// GetPreferences retrieves the preferences stored under key.
+func (db *memoryDB) GetPreferences(_ context.Context, key string) (*Preferences, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return copyPreferences(db.preferences[key]), nil
+}
+
+// SetPreferences stores preferences under key.
+func (db *memoryDB) SetPreferences(_ context.Context, key string, p *Preferences) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.preferences[key] = copyPreferences(p)
+	return nil
+}
+
+// DeletePreferences removes the preferences stored under key, if any.
+func (db *memoryDB) DeletePreferences(_ context.Context, key string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	delete(db.preferences, key)
+	return nil
+}
+
+// ReserveIdempotencyKey stores req unless an unexpired request with the same
+// key exists, in which case that request is returned instead.
+func (db *memoryDB) ReserveIdempotencyKey(_ context.Context, req *IdempotentRequest) (*IdempotentRequest, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if prev, ok := db.idempotency[req.Key]; ok && db.clock.Now().Before(prev.ExpiresAt) {
+		cp := *prev
+		return &cp, nil
+	}
+	cp := *req
+	db.idempotency[req.Key] = &cp
+	return nil, nil
+}
+
+// CompleteIdempotencyKey stores the response recorded in req.
+func (db *memoryDB) CompleteIdempotencyKey(_ context.Context, req *IdempotentRequest) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	cp := *req
+	db.idempotency[req.Key] = &cp
+	return nil
+}
+
+// ReleaseIdempotencyKey forgets the request stored under key.
+func (db *memoryDB) ReleaseIdempotencyKey(_ context.Context, key string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	delete(db.idempotency, key)
+	return nil
+}
+
+// addEventLocked adds ev to the outbox, if it isn't nil. db.mu must be held.
+func (db *memoryDB) addEventLocked(ev *Event) string {
+	if ev == nil {
+		return ""
+	}
+	ev.ID = db.ids.NewID("events")
+	db.events[ev.ID] = ev
+	return ev.ID
+}
+
+// AddEvent adds an event to the outbox.
+func (db *memoryDB) AddEvent(_ context.Context, ev *Event) (id string, err error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return db.addEventLocked(ev), nil
+}
+
+// PendingEvents returns up to limit events due by now, earliest due first.
+func (db *memoryDB) PendingEvents(_ context.Context, now time.Time, limit int) ([]*Event, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var events []*Event
+	for _, ev := range db.events {
+		if ev.NextAttempt != nil && !ev.NextAttempt.After(now) {
+			e := *ev
+			events = append(events, &e)
+		}
+	}
+	sortEvents(events)
+	if len(events) > limit {
+		events = events[:limit]
+	}
+	return events, nil
+}
+
+// eventLocked returns the event with the given ID. db.mu must be held.
+func (db *memoryDB) eventLocked(id string) (*Event, error) {
+	ev, ok := db.events[id]
+	if !ok {
+		return nil, fmt.Errorf("memorydb: event not found with ID %q", id)
+	}
+	return ev, nil
+}
+
+// MarkEventDelivered records that an event was sent.
+func (db *memoryDB) MarkEventDelivered(_ context.Context, id string, at time.Time) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	ev, err := db.eventLocked(id)
+	if err != nil {
+		return err
+	}
+	ev.Delivered, ev.NextAttempt = at, nil
+	return nil
+}
+
+// RecordEventFailure saves the state of an event after a failed delivery.
+func (db *memoryDB) RecordEventFailure(_ context.Context, failed *Event) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	ev, err := db.eventLocked(failed.ID)
+	if err != nil {
+		return err
+	}
+	ev.Attempts, ev.LastError = failed.Attempts, failed.LastError
+	ev.NextAttempt, ev.DeadLettered = failed.NextAttempt, failed.DeadLettered
+	return nil
+}
+
+// ReplayEvents marks the events created since the given time pending again.
+func (db *memoryDB) ReplayEvents(_ context.Context, since time.Time) (int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	now := db.clock.Now()
+	n := 0
+	for _, ev := range db.events {
+		if ev.Created.Before(since) {
+			continue
+		}
+		ev.Delivered, ev.DeadLettered, ev.NextAttempt = time.Time{}, time.Time{}, &now
+		ev.Attempts, ev.LastError = 0, ""
+		n++
+	}
+	return n, nil
+}
+
+// DeadEvents returns the dead-lettered events, most recent first.
+func (db *memoryDB) DeadEvents(_ context.Context) ([]*Event, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var events []*Event
+	for _, ev := range db.events {
+		if !ev.DeadLettered.IsZero() {
+			e := *ev
+			events = append(events, &e)
+		}
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].DeadLettered.After(events[j].DeadLettered)
+	})
+	return events, nil
+}
+
+// RedriveEvent makes a dead-lettered event due now.
+func (db *memoryDB) RedriveEvent(_ context.Context, id string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	ev, err := db.eventLocked(id)
+	if err != nil {
+		return err
+	}
+	now := db.clock.Now()
+	ev.DeadLettered, ev.NextAttempt, ev.Attempts = time.Time{}, &now, 0
+	return nil
+}
+
+// DiscardEvent deletes an event.
+func (db *memoryDB) DiscardEvent(_ context.Context, id string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, err := db.eventLocked(id); err != nil {
+		return err
+	}
+	delete(db.events, id)
+	return nil
+}
+
+// AcquireLock takes the named lock for holder, unless another holder has an
+// unexpired lease on it.
+func (db *memoryDB) AcquireLock(_ context.Context, name, holder string, ttl time.Duration) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	now := db.clock.Now()
+	if l, ok := db.locks[name]; ok && l.holder != holder && l.expires.After(now) {
+		return false, nil
+	}
+	db.locks[name] = memoryLease{holder: holder, expires: now.Add(ttl)}
+	return true, nil
+}
+
+// AddToken stores tok under tok.ID.
+func (db *memoryDB) AddToken(_ context.Context, tok *APIToken) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	c := *tok
+	db.tokens[tok.ID] = &c
+	return nil
+}
+
+// GetToken returns the token with the given ID, or nil if there is none.
+func (db *memoryDB) GetToken(_ context.Context, id string) (*APIToken, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	tok, ok := db.tokens[id]
+	if !ok {
+		return nil, nil
+	}
+	c := *tok
+	return &c, nil
+}
+
+// ListTokens returns the tokens of user, newest first.
+func (db *memoryDB) ListTokens(_ context.Context, user string) ([]*APIToken, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var tokens []*APIToken
+	for _, tok := range db.tokens {
+		if tok.User == user {
+			c := *tok
+			tokens = append(tokens, &c)
+		}
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].Created.After(tokens[j].Created) })
+	return tokens, nil
+}
+
+// TouchToken records that the token was used at the given time.
+func (db *memoryDB) TouchToken(_ context.Context, id string, at time.Time) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if tok, ok := db.tokens[id]; ok {
+		tok.LastUsed = at
+	}
+	return nil
+}
+
+// DeleteToken revokes a token of user.
+func (db *memoryDB) DeleteToken(_ context.Context, user, id string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if tok, ok := db.tokens[id]; ok && tok.User == user {
+		delete(db.tokens, id)
+	}
+	return nil
+}
+
+// GetProfile returns the profile of user, or nil if there is none.
+func (db *memoryDB) GetProfile(_ context.Context, user string) (*Profile, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	p, ok := db.profiles[user]
+	if !ok {
+		return nil, nil
+	}
+	c := *p
+	return &c, nil
+}
+
+// SetProfile stores the profile of user.
+func (db *memoryDB) SetProfile(_ context.Context, user string, p *Profile) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	c := *p
+	db.profiles[user] = &c
+	return nil
+}
+
+// DeleteProfile removes the profile of user, if any.
+func (db *memoryDB) DeleteProfile(_ context.Context, user string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	delete(db.profiles, user)
+	return nil
+}
+
+// AddSavedSearch stores s under s.ID.
+func (db *memoryDB) AddSavedSearch(_ context.Context, s *SavedSearch) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	c := *s
+	db.searches[s.ID] = &c
+	return nil
+}
+
+// GetSavedSearch returns the saved search of user with the given ID, or nil
+// if user has none.
+func (db *memoryDB) GetSavedSearch(_ context.Context, user, id string) (*SavedSearch, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	s, ok := db.searches[id]
+	if !ok || s.User != user {
+		return nil, nil
+	}
+	c := *s
+	return &c, nil
+}
+
+// ListSavedSearches returns the saved searches of user, by name.
+func (db *memoryDB) ListSavedSearches(_ context.Context, user string) ([]*SavedSearch, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var saved []*SavedSearch
+	for _, s := range db.searches {
+		if s.User == user {
+			c := *s
+			saved = append(saved, &c)
+		}
+	}
+	sort.Slice(saved, func(i, j int) bool { return saved[i].Name < saved[j].Name })
+	return saved, nil
+}
+
+// DeleteSavedSearch removes a saved search of user.
+func (db *memoryDB) DeleteSavedSearch(_ context.Context, user, id string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if s, ok := db.searches[id]; ok && s.User == user {
+		delete(db.searches, id)
+	}
+	return nil
+}
+
+// SetOperation stores op under op.ID, replacing any earlier version.
+func (db *memoryDB) SetOperation(_ context.Context, op *Operation) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	c := *op
+	c.Errors = append([]string(nil), op.Errors...)
+	db.operations[op.ID] = &c
+	return nil
+}
+
+// GetOperation returns the operation with the given ID, or nil if there is
+// none.
+func (db *memoryDB) GetOperation(_ context.Context, id string) (*Operation, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	op, ok := db.operations[id]
+	if !ok {
+		return nil, nil
+	}
+	c := *op
+	c.Errors = append([]string(nil), op.Errors...)
+	return &c, nil
+}
+
+// ListOperations returns the most recently started operations, newest
+// first, at most limit.
+func (db *memoryDB) ListOperations(_ context.Context, limit int) ([]*Operation, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var ops []*Operation
+	for _, op := range db.operations {
+		c := *op
+		c.Errors = append([]string(nil), op.Errors...)
+		ops = append(ops, &c)
+	}
+	sort.Slice(ops, func(i, j int) bool { return ops[i].Started.After(ops[j].Started) })
+	if len(ops) > limit {
+		ops = ops[:limit]
+	}
+	return ops, nil
+}
+
+// AddDelivery records a delivery, assigning it a new ID.
+func (db *memoryDB) AddDelivery(_ context.Context, d *Delivery) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	d.ID = db.ids.NewID("deliveries")
+	c := *d
+	db.deliveries = append(db.deliveries, &c)
+	return nil
+}
+
+// ListDeliveries returns up to limit deliveries, newest first.
+func (db *memoryDB) ListDeliveries(_ context.Context, limit int) ([]*Delivery, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var deliveries []*Delivery
+	for i := len(db.deliveries) - 1; i >= 0 && len(deliveries) < limit; i-- {
+		c := *db.deliveries[i]
+		deliveries = append(deliveries, &c)
+	}
+	return deliveries, nil
+}
+
+// AddSignIn records an attempt, assigning it a new ID.
+func (db *memoryDB) AddSignIn(_ context.Context, s *SignIn) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	s.ID = db.ids.NewID("signIns")
+	c := *s
+	db.signIns = append(db.signIns, &c)
+	return nil
+}
+
+// ListSignIns returns up to limit attempts of user, or of everyone if user
+// is "", newest first.
+func (db *memoryDB) ListSignIns(_ context.Context, user string, limit int) ([]*SignIn, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var signIns []*SignIn
+	for i := len(db.signIns) - 1; i >= 0 && len(signIns) < limit; i-- {
+		if s := db.signIns[i]; user == "" || s.User == user {
+			c := *s
+			signIns = append(signIns, &c)
+		}
+	}
+	return signIns, nil
+}
+
+// DeleteSignIns deletes the attempts of user.
+func (db *memoryDB) DeleteSignIns(_ context.Context, user string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	kept := db.signIns[:0]
+	for _, s := range db.signIns {
+		if s.User != user {
+			kept = append(kept, s)
+		}
+	}
+	db.signIns = kept
+	return nil
+}
+
+// AddSignInFailure counts a failure against key and returns the number of
+// failures within the window.
+func (db *memoryDB) AddSignInFailure(_ context.Context, key string, at time.Time, window time.Duration) (int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	c := db.signInFailures[key]
+	if at.Sub(c.Since) > window {
+		c = signInFailureCount{Since: at}
+	}
+	c.Failures++
+	db.signInFailures[key] = c
+	return c.Failures, nil
+}
+
+// SignInFailures returns the number of failures counted against key within
+// the window.
+func (db *memoryDB) SignInFailures(_ context.Context, key string, at time.Time, window time.Duration) (int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	c := db.signInFailures[key]
+	if at.Sub(c.Since) > window {
+		return 0, nil
+	}
+	return c.Failures, nil
+}
+
+// ResetSignInFailures clears the failures counted against key.
+func (db *memoryDB) ResetSignInFailures(_ context.Context, key string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	delete(db.signInFailures, key)
+	return nil
+}
+
+// GetSheetSync returns the linked sheet.
+func (db *memoryDB) GetSheetSync(_ context.Context) (SheetSync, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	s := db.sheetSync
+	s.Conflicts = append([]string(nil), s.Conflicts...)
+	s.Errors = append([]string(nil), s.Errors...)
+	return s, nil
+}
+
+// SetSheetSync saves the linked sheet.
+func (db *memoryDB) SetSheetSync(_ context.Context, s SheetSync) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	s.Conflicts = append([]string(nil), s.Conflicts...)
+	s.Errors = append([]string(nil), s.Errors...)
+	db.sheetSync = s
+	return nil
+}
+
+// RefUpload counts another reference to the upload with the given hash and
+// returns it, or nil if there is none.
+func (db *memoryDB) RefUpload(_ context.Context, hash string) (*Upload, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	u, ok := db.uploads[hash]
+	if !ok {
+		return nil, nil
+	}
+	u.Refs++
+	c := *u
+	return &c, nil
+}
+
+// AddUpload records u with one reference, unless an upload with its hash
+// is recorded already, in which case it counts another reference to that
+// one. It returns the upload recorded.
+func (db *memoryDB) AddUpload(_ context.Context, u *Upload) (*Upload, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	old, ok := db.uploads[u.Hash]
+	if ok {
+		old.Refs++
+		c := *old
+		return &c, nil
+	}
+	c := *u
+	c.Refs = 1
+	db.uploads[u.Hash] = &c
+	r := c
+	return &r, nil
+}
+
+// UnrefUpload counts one fewer reference to the upload with the given
+// hash, removing it at none, and returns the references left.
+func (db *memoryDB) UnrefUpload(_ context.Context, hash string) (int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	u, ok := db.uploads[hash]
+	if !ok {
+		return 0, nil
+	}
+	u.Refs--
+	if u.Refs <= 0 {
+		delete(db.uploads, hash)
+		return 0, nil
+	}
+	return u.Refs, nil
+}
+
+// TreatStats returns statistics of the treats that aren't deleted.
+func (db *memoryDB) TreatStats(_ context.Context, now time.Time) (*TreatStats, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	s := newTreatStats(now)
+	for id, t := range db.treats {
+		s.add(t, db.created[id])
+	}
+	return s, nil
+}
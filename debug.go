@@ -0,0 +1,58 @@
+package main
+
+import (
+	"expvar"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+
+	"cloud.google.com/go/profiler"
+	"github.com/gorilla/mux"
+)
+
+// startProfiler starts the Cloud Profiler agent, which samples CPU and heap
+// profiles of running instances. See https://cloud.google.com/profiler.
+func startProfiler(projectID string) error {
+	service := os.Getenv("GAE_SERVICE")
+	if service == "" {
+		service = "treatshelf"
+	}
+	return profiler.Start(profiler.Config{
+		Service:        service,
+		ServiceVersion: os.Getenv("GAE_VERSION"),
+		ProjectID:      projectID,
+		MutexProfiling: true,
+	})
+}
+
+// registerDebugHandlers adds the net/http/pprof handlers under /debug/pprof,
+// for admins and requests from this machine only (ruleDebug).
+func (t *Treatshelf) registerDebugHandlers(r *mux.Router) {
+	r.Methods("GET").Path("/debug/pprof/cmdline").Handler(http.HandlerFunc(pprof.Cmdline)).Name("pprofCmdline")
+	r.Methods("GET").Path("/debug/pprof/profile").Handler(http.HandlerFunc(pprof.Profile)).Name("pprofProfile")
+	r.Methods("GET", "POST").Path("/debug/pprof/symbol").Handler(http.HandlerFunc(pprof.Symbol)).Name("pprofSymbol")
+	r.Methods("GET").Path("/debug/pprof/trace").Handler(http.HandlerFunc(pprof.Trace)).Name("pprofTrace")
+	// Request counts and latencies, see countRequests.
+	r.Methods("GET").Path("/debug/vars").Handler(expvar.Handler()).Name("debugVars")
+	// Database faults to inject, see faults.go.
+	r.Methods("GET", "POST").Path("/debug/faults").Handler(withCache(cacheNoStore)(appHandler(t.faultsHandler))).Name("faults")
+	// Resetting between end-to-end tests, see testhooks.go.
+	r.Methods("POST").Path("/debug/reset").Handler(withCache(cacheNoStore)(appHandler(t.resetHandler))).Name("testReset")
+	// Index also serves the named profiles, e.g. /debug/pprof/heap.
+	r.Methods("GET").PathPrefix("/debug/pprof/").Handler(http.HandlerFunc(pprof.Index)).Name("pprof")
+}
+
+// isLocalRequest reports whether r came directly from this machine rather
+// than through a proxy such as the App Engine front end.
+func isLocalRequest(r *http.Request) bool {
+	if r.Header.Get("X-Forwarded-For") != "" {
+		return false
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
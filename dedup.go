@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"expvar"
+	"fmt"
+	"io"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// The same picture is often uploaded many times, such as a shop's photo
+// of a treat added every week, or an avatar also used for a treat. Each
+// upload's contents are hashed, and an upload identical to a stored one
+// gets the stored one's URL rather than being stored again. Stored
+// pictures are indexed by hash in the Uploads database, which counts the
+// references to each, and carry their hash in their metadata, so that
+// deleteUpload only deletes a picture once nothing refers to it.
+//
+// Pictures stored before the index, and seed pictures, which are named by
+// their contents already, aren't shared.
+
+// Upload is a stored picture, by the SHA-256 of its contents.
+type Upload struct {
+	// Hash is the hex SHA-256 of the picture.
+	Hash string
+	// Name is the picture's object in the picture bucket, and URL its URL.
+	Name        string
+	URL         string
+	ContentType string
+	Size        int64
+	// Refs counts the uploads that were given URL.
+	Refs    int
+	Created time.Time
+}
+
+// UploadDatabase indexes stored pictures by hash.
+type UploadDatabase interface {
+	// RefUpload counts another reference to the upload with the given
+	// hash and returns it, or nil if there is none.
+	RefUpload(ctx context.Context, hash string) (*Upload, error)
+
+	// AddUpload records u with one reference, unless an upload with its
+	// hash is recorded already, in which case it counts another reference
+	// to that one. It returns the upload recorded.
+	AddUpload(ctx context.Context, u *Upload) (*Upload, error)
+
+	// UnrefUpload counts one fewer reference to the upload with the given
+	// hash, removing it at none, and returns the references left. It
+	// returns 0 if there is no such upload.
+	UnrefUpload(ctx context.Context, hash string) (refs int, err error)
+}
+
+// uploadHashKey is the metadata key of the hash of stored pictures.
+const uploadHashKey = "sha256"
+
+// dedupedUploads counts uploads given the URL of an identical picture.
+var dedupedUploads = expvar.NewInt("dedupedUploads")
+
+// hashFile returns the hex SHA-256 and size of f, and rewinds it.
+func hashFile(f io.ReadSeeker) (hash string, size int64, err error) {
+	h := sha256.New()
+	size, err = io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), size, nil
+}
+
+// putUpload stores f as the picture with the given name, unless an
+// identical picture is stored already, and returns the URL of the one
+// stored.
+func (t *Treatshelf) putUpload(ctx context.Context, f io.ReadSeeker, name, contentType string) (url string, err error) {
+	hash, size, err := hashFile(f)
+	if err != nil {
+		return "", err
+	}
+	u, err := t.Uploads.RefUpload(ctx, hash)
+	if err != nil {
+		return "", err
+	}
+	if u != nil {
+		dedupedUploads.Add(1)
+		return u.URL, nil
+	}
+
+	url, err = t.putPicture(ctx, f, name, contentType, map[string]string{uploadHashKey: hash})
+	if err != nil {
+		return "", err
+	}
+	u, err = t.Uploads.AddUpload(ctx, &Upload{
+		Hash:        hash,
+		Name:        name,
+		URL:         url,
+		ContentType: contentType,
+		Size:        size,
+		Created:     t.now(),
+	})
+	if err != nil {
+		// The picture is stored, only not shared.
+		fmt.Fprintf(t.logWriter, "Could not index upload %q: %v\n", name, err)
+		return url, nil
+	}
+	if u.Name != name {
+		// An identical picture was stored meanwhile: use that one. Ours
+		// isn't indexed, so delete it directly rather than with
+		// deleteUpload, which would count one fewer reference to theirs.
+		dedupedUploads.Add(1)
+		if bucket, _, err := t.pictureBucket(); err == nil {
+			if err := bucket.Object(name).Delete(ctx); err != nil {
+				fmt.Fprintf(t.logWriter, "Could not delete duplicate upload %q: %v\n", name, err)
+			}
+		}
+		return u.URL, nil
+	}
+	return url, nil
+}
+
+// unrefUpload counts one fewer reference to the stored picture obj, and
+// reports whether it may be deleted: whether nothing else refers to it.
+func (t *Treatshelf) unrefUpload(ctx context.Context, obj *storage.ObjectHandle) bool {
+	if t.Uploads == nil {
+		return true
+	}
+	attrs, err := obj.Attrs(ctx)
+	if err != nil {
+		fmt.Fprintf(t.logWriter, "Could not read upload %q: %v\n", obj.ObjectName(), err)
+		return false
+	}
+	hash := attrs.Metadata[uploadHashKey]
+	if hash == "" {
+		return true
+	}
+	refs, err := t.Uploads.UnrefUpload(ctx, hash)
+	if err != nil {
+		fmt.Fprintf(t.logWriter, "Could not unreference upload %q: %v\n", obj.ObjectName(), err)
+		return false
+	}
+	return refs == 0
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestUploadRefs(t *testing.T) {
+	db := newMemoryDB()
+	ctx := context.Background()
+	hash, size, err := hashFile(strings.NewReader("picture"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != int64(len("picture")) {
+		t.Errorf("hashFile size = %d, want %d", size, len("picture"))
+	}
+
+	if u, err := db.RefUpload(ctx, hash); err != nil || u != nil {
+		t.Fatalf("RefUpload before any upload = %+v, %v; want nil", u, err)
+	}
+	u, err := db.AddUpload(ctx, &Upload{Hash: hash, Name: "1.png", URL: "u/1.png"})
+	if err != nil || u.Name != "1.png" || u.Refs != 1 {
+		t.Fatalf("AddUpload = %+v, %v; want 1.png with 1 reference", u, err)
+	}
+	// An identical picture stored meanwhile gets the first one.
+	u, err = db.AddUpload(ctx, &Upload{Hash: hash, Name: "2.png", URL: "u/2.png"})
+	if err != nil || u.Name != "1.png" || u.Refs != 2 {
+		t.Fatalf("AddUpload of a duplicate = %+v, %v; want 1.png with 2 references", u, err)
+	}
+	if u, err := db.RefUpload(ctx, hash); err != nil || u == nil || u.URL != "u/1.png" || u.Refs != 3 {
+		t.Fatalf("RefUpload = %+v, %v; want u/1.png with 3 references", u, err)
+	}
+
+	for _, want := range []int{2, 1, 0} {
+		if refs, err := db.UnrefUpload(ctx, hash); err != nil || refs != want {
+			t.Fatalf("UnrefUpload = %d, %v; want %d", refs, err, want)
+		}
+	}
+	if u, err := db.RefUpload(ctx, hash); err != nil || u != nil {
+		t.Errorf("RefUpload after the last reference went = %+v, %v; want nil", u, err)
+	}
+	if refs, err := db.UnrefUpload(ctx, hash); err != nil || refs != 0 {
+		t.Errorf("UnrefUpload of no upload = %d, %v; want 0", refs, err)
+	}
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// dualDB is a TreatDatabase for migrating between databases without
+// downtime. Writes go to the primary and are mirrored to the secondary;
+// reads go to either, as set by DualConfig.ReadPercent, and may be compared
+// in the background. Once the secondary has been serving every read
+// without divergences, it can be made the primary.
+//
+// The primary assigns IDs and its results are returned. Failed mirror
+// writes are logged as divergences rather than failing the request. Claims
+// are mirrored by replaying them, so their IDs differ between databases.
+type dualDB struct {
+	primary, secondary TreatDatabase
+
+	cfg   atomic.Value // DualConfig
+	log   io.Writer
+	clock Clock // tells the time, see clock.go.
+}
+
+// DualConfig controls a dualDB at runtime. It is shared by every instance
+// through a DualConfigStore and changed at /admin/dual-write.
+type DualConfig struct {
+	// ReadPercent is the share of reads served by the secondary, from 0
+	// to 100.
+	ReadPercent int
+
+	// Compare reads from the other database too and logs differences.
+	Compare bool
+}
+
+// DualConfigStore persists the DualConfig.
+type DualConfigStore interface {
+	GetDualConfig(ctx context.Context) (DualConfig, error)
+	SetDualConfig(ctx context.Context, c DualConfig) error
+}
+
+// dualDivergences counts differences found by dualDB, and failed mirror
+// writes, by operation. Served at /debug/vars.
+var dualDivergences = expvar.NewMap("dualWriteDivergences")
+
+// dualConfigRefresh is how often instances reload the DualConfig.
+const dualConfigRefresh = 30 * time.Second
+
+// compareTimeout bounds the background read of a comparison.
+const compareTimeout = 10 * time.Second
+
+var _ TreatDatabase = &dualDB{}
+
+func newDualDB(primary, secondary TreatDatabase, log io.Writer) *dualDB {
+	db := &dualDB{primary: primary, secondary: secondary, log: log, clock: systemClock{}}
+	db.cfg.Store(DualConfig{})
+	return db
+}
+
+// config returns the current configuration.
+func (db *dualDB) config() DualConfig {
+	return db.cfg.Load().(DualConfig)
+}
+
+// setConfig applies c on this instance.
+func (db *dualDB) setConfig(c DualConfig) {
+	db.cfg.Store(c)
+}
+
+// refreshConfig reloads the configuration from store every
+// dualConfigRefresh until ctx is done.
+func (db *dualDB) refreshConfig(ctx context.Context, store DualConfigStore) {
+	for {
+		if c, err := store.GetDualConfig(ctx); err != nil {
+			fmt.Fprintf(db.log, "Could not load dual-write config: %v\n", err)
+		} else {
+			db.setConfig(c)
+		}
+		select {
+		case <-db.clock.After(dualConfigRefresh):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// reader picks the database to read from, and the other one.
+func (db *dualDB) reader() (read, other TreatDatabase) {
+	if rand.Intn(100) < db.config().ReadPercent {
+		return db.secondary, db.primary
+	}
+	return db.primary, db.secondary
+}
+
+// diverged logs a difference found by op.
+func (db *dualDB) diverged(op string, format string, v ...interface{}) {
+	dualDivergences.Add(op, 1)
+	fmt.Fprintf(db.log, "Dual-write divergence in %s: %s\n", op, fmt.Sprintf(format, v...))
+}
+
+// compare calls get on the other database in the background, if comparing,
+// and logs a divergence if its result differs from got. got is encoded
+// before compare returns, since the caller may go on to change it.
+func (db *dualDB) compare(op string, other TreatDatabase, got interface{}, get func(context.Context, TreatDatabase) (interface{}, error)) {
+	if !db.config().Compare {
+		return
+	}
+	a, _ := json.Marshal(got)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), compareTimeout)
+		defer cancel()
+		want, err := get(ctx, other)
+		if err != nil {
+			db.diverged(op, "other database failed: %v", err)
+			return
+		}
+		b, _ := json.Marshal(want)
+		if string(a) != string(b) {
+			db.diverged(op, "got %s, other database has %s", a, b)
+		}
+	}()
+}
+
+// mirror logs a divergence if a mirrored write failed.
+func (db *dualDB) mirror(op string, err error) {
+	if err != nil {
+		db.diverged(op, "mirror write failed: %v", err)
+	}
+}
+
+// mirrorCount logs a divergence if a mirrored bulk write failed or changed
+// a different number of treats.
+func (db *dualDB) mirrorCount(op string, want, got int, err error) {
+	if err != nil {
+		db.mirror(op, err)
+		return
+	}
+	if got != want {
+		db.diverged(op, "changed %d treats, mirror changed %d", want, got)
+	}
+}
+
+func (db *dualDB) ListTreats(ctx context.Context, opts ListOptions) ([]*Treat, error) {
+	read, other := db.reader()
+	treats, err := read.ListTreats(ctx, opts)
+	if err == nil {
+		db.compare("ListTreats", other, treats, func(ctx context.Context, o TreatDatabase) (interface{}, error) {
+			return o.ListTreats(ctx, opts)
+		})
+	}
+	return treats, err
+}
+
+// EachTreat reads from one database without comparing, since its results
+// are streamed.
+func (db *dualDB) EachTreat(ctx context.Context, opts ListOptions, fn func(*Treat) error) error {
+	read, _ := db.reader()
+	return read.EachTreat(ctx, opts, fn)
+}
+
+func (db *dualDB) GetTreat(ctx context.Context, id string) (*Treat, error) {
+	read, other := db.reader()
+	treat, err := read.GetTreat(ctx, id)
+	if err == nil {
+		db.compare("GetTreat", other, treat, func(ctx context.Context, o TreatDatabase) (interface{}, error) {
+			return o.GetTreat(ctx, id)
+		})
+	}
+	return treat, err
+}
+
+func (db *dualDB) GetTreats(ctx context.Context, ids []string) ([]*Treat, error) {
+	read, other := db.reader()
+	treats, err := read.GetTreats(ctx, ids)
+	if err == nil {
+		db.compare("GetTreats", other, treats, func(ctx context.Context, o TreatDatabase) (interface{}, error) {
+			return o.GetTreats(ctx, ids)
+		})
+	}
+	return treats, err
+}
+
+func (db *dualDB) ListClaims(ctx context.Context, treatID string) ([]*Claim, error) {
+	read, _ := db.reader()
+	return read.ListClaims(ctx, treatID)
+}
+
+func (db *dualDB) ListDeletedTreats(ctx context.Context, before time.Time) ([]*Treat, error) {
+	return db.primary.ListDeletedTreats(ctx, before)
+}
+
+// AddTreat adds t to the primary, then to the secondary under the same ID.
+func (db *dualDB) AddTreat(ctx context.Context, t *Treat) (string, error) {
+	id, err := db.primary.AddTreat(ctx, t)
+	if err != nil {
+		return "", err
+	}
+	mirrored := *t
+	mirrored.ID = id
+	db.mirror("AddTreat", db.secondary.UpdateTreat(ctx, &mirrored))
+	return id, nil
+}
+
+func (db *dualDB) DeleteTreat(ctx context.Context, id string) error {
+	if err := db.primary.DeleteTreat(ctx, id); err != nil {
+		return err
+	}
+	db.mirror("DeleteTreat", db.secondary.DeleteTreat(ctx, id))
+	return nil
+}
+
+func (db *dualDB) UpdateTreat(ctx context.Context, t *Treat) error {
+	if err := db.primary.UpdateTreat(ctx, t); err != nil {
+		return err
+	}
+	db.mirror("UpdateTreat", db.secondary.UpdateTreat(ctx, t))
+	return nil
+}
+
+// SaveTreats saves treats to the primary, then to the secondary under the
+// IDs the primary assigned.
+func (db *dualDB) SaveTreats(ctx context.Context, treats []*Treat) error {
+	if err := db.primary.SaveTreats(ctx, treats); err != nil {
+		return err
+	}
+	mirrored := make([]*Treat, len(treats))
+	for i, t := range treats {
+		m := *t
+		mirrored[i] = &m
+	}
+	db.mirror("SaveTreats", db.secondary.SaveTreats(ctx, mirrored))
+	return nil
+}
+
+func (db *dualDB) UpdateTreatFields(ctx context.Context, t *Treat, fields []string) error {
+	if err := db.primary.UpdateTreatFields(ctx, t, fields); err != nil {
+		return err
+	}
+	db.mirror("UpdateTreatFields", db.secondary.UpdateTreatFields(ctx, t, fields))
+	return nil
+}
+
+// AdjustQuantity adjusts the primary, then copies the result to the
+// secondary rather than replaying the delta, so that drift doesn't build
+// up.
+func (db *dualDB) AdjustQuantity(ctx context.Context, id string, delta int) (*Treat, error) {
+	t, err := db.primary.AdjustQuantity(ctx, id, delta)
+	if err != nil {
+		return nil, err
+	}
+	mirrored := *t
+	db.mirror("AdjustQuantity", db.secondary.UpdateTreat(ctx, &mirrored))
+	return t, nil
+}
+
+// ChangeTreat changes the primary, then copies the result to the secondary,
+// as AdjustQuantity does.
+func (db *dualDB) ChangeTreat(ctx context.Context, id string, change func(*Treat) ([]string, error)) (*Treat, error) {
+	t, err := db.primary.ChangeTreat(ctx, id, change)
+	if err != nil {
+		return nil, err
+	}
+	mirrored := *t
+	db.mirror("ChangeTreat", db.secondary.UpdateTreat(ctx, &mirrored))
+	return t, nil
+}
+
+func (db *dualDB) ClaimTreat(ctx context.Context, treatID string, c *Claim) (string, error) {
+	id, err := db.primary.ClaimTreat(ctx, treatID, c)
+	if err != nil {
+		return "", err
+	}
+	mirrored := *c
+	_, err = db.secondary.ClaimTreat(ctx, treatID, &mirrored)
+	db.mirror("ClaimTreat", err)
+	return id, nil
+}
+
+func (db *dualDB) ReleaseClaim(ctx context.Context, treatID, claimID string) error {
+	if err := db.primary.ReleaseClaim(ctx, treatID, claimID); err != nil {
+		return err
+	}
+	db.mirror("ReleaseClaim", db.secondary.ReleaseClaim(ctx, treatID, claimID))
+	return nil
+}
+
+func (db *dualDB) AnonymizeClaims(ctx context.Context, user, name string) (int, error) {
+	n, err := db.primary.AnonymizeClaims(ctx, user, name)
+	if err != nil {
+		return n, err
+	}
+	m, err := db.secondary.AnonymizeClaims(ctx, user, name)
+	db.mirrorCount("AnonymizeClaims", n, m, err)
+	return n, nil
+}
+
+func (db *dualDB) ArchiveExpired(ctx context.Context, now time.Time) (int, error) {
+	n, err := db.primary.ArchiveExpired(ctx, now)
+	if err != nil {
+		return n, err
+	}
+	m, err := db.secondary.ArchiveExpired(ctx, now)
+	db.mirrorCount("ArchiveExpired", n, m, err)
+	return n, nil
+}
+
+func (db *dualDB) ReplaceTags(ctx context.Context, from []string, to string, progress func(done, total int)) (int, error) {
+	n, err := db.primary.ReplaceTags(ctx, from, to, progress)
+	if err != nil {
+		return n, err
+	}
+	m, err := db.secondary.ReplaceTags(ctx, from, to, nil)
+	db.mirrorCount("ReplaceTags", n, m, err)
+	return n, nil
+}
+
+func (db *dualDB) SoftDeleteTreats(ctx context.Context, ids []string, token string, at time.Time) error {
+	if err := db.primary.SoftDeleteTreats(ctx, ids, token, at); err != nil {
+		return err
+	}
+	db.mirror("SoftDeleteTreats", db.secondary.SoftDeleteTreats(ctx, ids, token, at))
+	return nil
+}
+
+func (db *dualDB) RestoreTreats(ctx context.Context, token string, after time.Time) (int, error) {
+	n, err := db.primary.RestoreTreats(ctx, token, after)
+	if err != nil {
+		return n, err
+	}
+	m, err := db.secondary.RestoreTreats(ctx, token, after)
+	db.mirrorCount("RestoreTreats", n, m, err)
+	return n, nil
+}
+
+func (db *dualDB) PurgeDeletedTreats(ctx context.Context, before time.Time) (int, error) {
+	n, err := db.primary.PurgeDeletedTreats(ctx, before)
+	if err != nil {
+		return n, err
+	}
+	m, err := db.secondary.PurgeDeletedTreats(ctx, before)
+	db.mirrorCount("PurgeDeletedTreats", n, m, err)
+	return n, nil
+}
+
+// dualWriteHandler shows the dual-write configuration and, when posted,
+// changes it for every instance.
+func (t *Treatshelf) dualWriteHandler(w http.ResponseWriter, r *http.Request) *appError {
+	if t.dual == nil {
+		err := fmt.Errorf("dual-write is off: set DUAL_WRITE_COLLECTION to migrate")
+		return t.appErrorCodef(r, http.StatusNotFound, err, "%v", err)
+	}
+	if r.Method == "POST" {
+		percent, err := strconv.Atoi(r.FormValue("readPercent"))
+		if err != nil || percent < 0 || percent > 100 {
+			err := fmt.Errorf("read percent must be a whole number from 0 to 100, got %q", r.FormValue("readPercent"))
+			return t.appErrorCodef(r, http.StatusBadRequest, err, "%v", err)
+		}
+		c := DualConfig{ReadPercent: percent, Compare: r.FormValue("compare") != ""}
+		if err := t.dualConfig.SetDualConfig(r.Context(), c); err != nil {
+			return t.appErrorf(r, err, "SetDualConfig: %v", err)
+		}
+		t.dual.setConfig(c)
+		setFlash(w, &flash{Message: fmt.Sprintf("Other instances pick this up within %v.", dualConfigRefresh)})
+		http.Redirect(w, r, t.routeURL("dualWrite"), http.StatusFound)
+		return nil
+	}
+	return dualWriteTmpl.Execute(t, w, r, struct {
+		DualConfig
+		Divergences string
+	}{t.dual.config(), dualDivergences.String()})
+}
@@ -0,0 +1,323 @@
+//go:build e2e
+// +build e2e
+
+package main
+
+// The end-to-end tests drive headless Chrome through the app's pages, the
+// way people use them, against a server backed by a memoryDB and a fake
+// Cloud Storage. They need Chrome or Chromium, and are left out of the
+// other tests by the e2e build tag:
+//
+//	go test -tags e2e -run E2E -v
+//
+// Like the fuzz tests, they need Go 1.18 or later, see go.mod. Set
+// CHROME_PATH if the browser isn't on the PATH under a usual name. Each
+// flow starts from the seed data, see testhooks.go.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/chromedp/cdproto/network"
+	"github.com/chromedp/chromedp"
+	"google.golang.org/api/option"
+)
+
+// e2eTimeout bounds each flow, browser start included.
+const e2eTimeout = 2 * time.Minute
+
+// e2eBucket is the fake picture bucket.
+const e2eBucket = "e2e-pictures"
+
+// fakeGCS is the part of the Cloud Storage JSON API the app uses to store
+// pictures: getting a bucket's attributes and uploading objects small
+// enough to be sent in one multipart request.
+type fakeGCS struct {
+	mu      sync.Mutex
+	objects map[string][]byte // maps from bucket/name to contents.
+}
+
+func (f *fakeGCS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch p := strings.Split(strings.Trim(r.URL.Path, "/"), "/"); {
+	case r.Method == "GET" && len(p) == 4 && p[0] == "storage" && p[2] == "b":
+		json.NewEncoder(w).Encode(map[string]string{"kind": "storage#bucket", "name": p[3]})
+	case r.Method == "POST" && len(p) == 6 && p[0] == "upload" && p[3] == "b" && p[5] == "o":
+		name, b, err := readUpload(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.mu.Lock()
+		f.objects[p[4]+"/"+name] = b
+		f.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]interface{}{"kind": "storage#object", "bucket": p[4], "name": name, "size": fmt.Sprint(len(b))})
+	default:
+		http.Error(w, "fakeGCS: unsupported request "+r.Method+" "+r.URL.Path, http.StatusNotImplemented)
+	}
+}
+
+// readUpload returns the name and contents of the object in a multipart
+// upload: its metadata, then its contents.
+func readUpload(r *http.Request) (name string, b []byte, err error) {
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return "", nil, err
+	}
+	mr := multipart.NewReader(r.Body, params["boundary"])
+	part, err := mr.NextPart()
+	if err != nil {
+		return "", nil, err
+	}
+	var meta struct{ Name string }
+	if err := json.NewDecoder(part).Decode(&meta); err != nil {
+		return "", nil, fmt.Errorf("metadata: %v", err)
+	}
+	if part, err = mr.NextPart(); err != nil {
+		return "", nil, err
+	}
+	b, err = ioutil.ReadAll(part)
+	return meta.Name, b, err
+}
+
+// object returns the contents of the named object in the picture bucket.
+func (f *fakeGCS) object(name string) ([]byte, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	b, ok := f.objects[e2eBucket+"/"+name]
+	return b, ok
+}
+
+// e2eApp is a Treatshelf served for end-to-end tests.
+type e2eApp struct {
+	shelf *Treatshelf
+	gcs   *fakeGCS
+	url   string // base URL of the app.
+	close func()
+}
+
+// e2eServer serves a Treatshelf backed by a memoryDB and a fake Cloud
+// Storage, with test hooks on and admin@example.com as its admin. Callers
+// close it.
+func e2eServer(t *testing.T) *e2eApp {
+	gcs := &fakeGCS{objects: make(map[string][]byte)}
+	gcsServer := httptest.NewServer(gcs)
+	storageClient, err := storage.NewClient(context.Background(),
+		option.WithEndpoint(gcsServer.URL+"/storage/v1/"),
+		option.WithoutAuthentication())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	shelf, db := newTestShelf(t, withAdmin("admin@example.com"), withAllDatabases(), withSystemClock())
+	shelf.renders = newRenderCache(shelf.clock)
+	shelf.testHooks = true
+	shelf.storageClient = storageClient
+	// Pictures are numbered, like treats.
+	shelf.ids = db.ids
+	shelf.setBuckets(Buckets{Originals: e2eBucket})
+	srv := httptest.NewServer(shelf.Handler())
+	return &e2eApp{
+		shelf: shelf,
+		gcs:   gcs,
+		url:   srv.URL,
+		close: func() {
+			srv.Close()
+			gcsServer.Close()
+		},
+	}
+}
+
+// reset resets the app through its test hook, as a harness running
+// against a separate server would.
+func (a *e2eApp) reset(t *testing.T) {
+	req, err := http.NewRequest("POST", a.url+a.shelf.routeURL("testReset"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(iapEmailHeader, "accounts.google.com:admin@example.com")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		t.Fatalf("reset: %s: %s", resp.Status, b)
+	}
+}
+
+// chromePath returns the browser to drive, or skips the test if there is
+// none.
+func chromePath(t *testing.T) string {
+	if p := os.Getenv("CHROME_PATH"); p != "" {
+		return p
+	}
+	for _, name := range []string{"google-chrome", "google-chrome-stable", "chromium", "chromium-browser", "headless-shell"} {
+		if p, err := exec.LookPath(name); err == nil {
+			return p
+		}
+	}
+	t.Skip("no Chrome or Chromium found: install one or set CHROME_PATH")
+	return ""
+}
+
+// browser starts headless Chrome, sized and sandboxed for CI containers,
+// signed in as user through the IAP header. Callers cancel the context.
+func browser(t *testing.T, user string) (context.Context, context.CancelFunc) {
+	opts := append(chromedp.DefaultExecAllocatorOptions[:],
+		chromedp.ExecPath(chromePath(t)),
+		chromedp.WindowSize(1280, 800),
+		chromedp.DisableGPU,
+		// Containers often run as root, where Chrome's sandbox can't start.
+		chromedp.NoSandbox,
+	)
+	ctx, cancelTimeout := context.WithTimeout(context.Background(), e2eTimeout)
+	ctx, cancelAlloc := chromedp.NewExecAllocator(ctx, opts...)
+	ctx, cancelBrowser := chromedp.NewContext(ctx, chromedp.WithLogf(t.Logf))
+	cancel := func() {
+		cancelBrowser()
+		cancelAlloc()
+		cancelTimeout()
+	}
+	err := chromedp.Run(ctx,
+		network.Enable(),
+		network.SetExtraHTTPHeaders(network.Headers{iapEmailHeader: "accounts.google.com:" + user}),
+	)
+	if err != nil {
+		cancel()
+		t.Fatalf("starting the browser: %v", err)
+	}
+	return ctx, cancel
+}
+
+func TestE2EAddEditDelete(t *testing.T) {
+	app := e2eServer(t)
+	defer app.close()
+	app.reset(t)
+	shelf := app.shelf
+	ctx, cancel := browser(t, "admin@example.com")
+	defer cancel()
+
+	picture, err := filepath.Abs(filepath.Join(seedDir, "cookie.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Treats added after a reset are numbered from 1.
+	const id = "1"
+	detail := app.url + shelf.routeURL("treat", "id", id)
+
+	// Add a treat with a picture.
+	var location, title string
+	err = chromedp.Run(ctx,
+		chromedp.Navigate(app.url+shelf.routeURL("addTreat")),
+		chromedp.WaitVisible(`#title`, chromedp.ByQuery),
+		chromedp.SendKeys(`#title`, "Ginger biscuit", chromedp.ByQuery),
+		chromedp.SendKeys(`#author`, "Erica", chromedp.ByQuery),
+		chromedp.SendKeys(`#description`, "Snaps when you break it.", chromedp.ByQuery),
+		chromedp.SetUploadFiles(`#image`, []string{picture}, chromedp.ByQuery),
+		chromedp.Click(`form button.btn-success`, chromedp.ByQuery),
+		chromedp.WaitVisible(`.media-body h4`, chromedp.ByQuery),
+		chromedp.Location(&location),
+		chromedp.Text(`.media-body h4`, &title, chromedp.ByQuery),
+	)
+	if err != nil {
+		t.Fatalf("adding: %v", err)
+	}
+	if location != detail {
+		t.Errorf("after adding, at %s; want %s", location, detail)
+	}
+	if !strings.HasPrefix(title, "Ginger biscuit") {
+		t.Errorf("after adding, title %q", title)
+	}
+	treat, err := shelf.DB.GetTreat(context.Background(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := ioutil.ReadFile(picture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if treat.ImageURL != fmt.Sprintf(publicURL, e2eBucket, "1.png") {
+		t.Errorf("picture uploaded as %s, want 1.png", treat.ImageURL)
+	}
+	if got, ok := app.gcs.object(path.Base(treat.ImageURL)); !ok || string(got) != string(want) {
+		t.Errorf("picture %s not uploaded", treat.ImageURL)
+	}
+
+	// Edit it.
+	err = chromedp.Run(ctx,
+		chromedp.Click(`a[href="`+shelf.routeURL("editTreat", "id", id)+`"]`, chromedp.ByQuery),
+		chromedp.WaitVisible(`#title`, chromedp.ByQuery),
+		chromedp.SetValue(`#title`, "Ginger snap", chromedp.ByQuery),
+		chromedp.Click(`form button.btn-success`, chromedp.ByQuery),
+		chromedp.WaitVisible(`.media-body h4`, chromedp.ByQuery),
+		chromedp.Location(&location),
+		chromedp.Text(`.media-body h4`, &title, chromedp.ByQuery),
+	)
+	if err != nil {
+		t.Fatalf("editing: %v", err)
+	}
+	if location != detail || !strings.HasPrefix(title, "Ginger snap") {
+		t.Errorf("after editing, at %s with title %q; want %s with title Ginger snap", location, title, detail)
+	}
+	if edited, err := shelf.DB.GetTreat(context.Background(), id); err != nil || edited.ImageURL != treat.ImageURL {
+		t.Errorf("editing without a picture changed it: %+v, %v", edited, err)
+	}
+
+	// Delete it.
+	var message string
+	err = chromedp.Run(ctx,
+		chromedp.Click(`form button.btn-danger`, chromedp.ByQuery),
+		chromedp.WaitVisible(`.alert-info span`, chromedp.ByQuery),
+		chromedp.Location(&location),
+		chromedp.Text(`.alert-info span`, &message, chromedp.ByQuery),
+	)
+	if err != nil {
+		t.Fatalf("deleting: %v", err)
+	}
+	if location != app.url+shelf.routeURL("treats") || message != `Deleted "Ginger snap".` {
+		t.Errorf("after deleting, at %s with message %q", location, message)
+	}
+	if deleted, err := shelf.DB.GetTreat(context.Background(), id); err == nil && !deleted.Deleted() {
+		t.Errorf("treat %s not deleted", id)
+	}
+}
+
+func TestE2ESeededList(t *testing.T) {
+	app := e2eServer(t)
+	defer app.close()
+	app.reset(t)
+	shelf := app.shelf
+	ctx, cancel := browser(t, "someone@example.com")
+	defer cancel()
+
+	var title string
+	err := chromedp.Run(ctx,
+		chromedp.Navigate(app.url+shelf.routeURL("treats")),
+		chromedp.Click(`a[href="`+shelf.routeURL("treat", "id", "seed-brownie")+`"]`, chromedp.ByQuery),
+		chromedp.WaitVisible(`.media-body h4`, chromedp.ByQuery),
+		chromedp.Text(`.media-body h4`, &title, chromedp.ByQuery),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(title, "Fudge brownie") {
+		t.Errorf("seeded treat has title %q", title)
+	}
+}
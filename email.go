@@ -0,0 +1,199 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Mailing a photo to the shelf's address adds it as a draft treat: the
+// subject is its title, the body its description and the first attached
+// picture its picture. Drafts are held for review whether or not
+// MODERATION is on, as anyone can send mail. They belong to the sender,
+// who sees them when signed in with that address, only if SendGrid found
+// the mail passed SPF and was DKIM-signed by the sender's domain, since
+// the From address is otherwise anyone's to forge; see senderVerified.
+//
+// Mail is received by SendGrid Inbound Parse, or anything posting the same
+// multipart form, configured to post to
+//
+//	https://APP/integrations/email?token=TOKEN
+//
+// where TOKEN is EMAIL_IN_TOKEN, which may name a secret, see secrets.go.
+// SendGrid retries mail it couldn't post for days, so mail that can't
+// become a treat is logged and answered 200 rather than refused, and a
+// message's treat has an ID derived from its Message-ID, so retries don't
+// add it twice.
+
+const (
+	// maxEmailBytes bounds the size of inbound mail, attachments included.
+	maxEmailBytes = 32 << 20
+	// maxEmailAttachments bounds the attachments looked at for a picture.
+	maxEmailAttachments = 20
+)
+
+// dkimResultPattern matches a domain and its result in SendGrid's dkim
+// field, e.g. "{@example.com : pass}".
+var dkimResultPattern = regexp.MustCompile(`@([^\s:{},]+)\s*:\s*(\w+)`)
+
+// subjectPrefixPattern matches reply and forward prefixes of subjects.
+var subjectPrefixPattern = regexp.MustCompile(`(?i)^\s*((re|fw|fwd|aw|wg)\s*:\s*)+`)
+
+// requireEmailIn returns a 404 appError unless email-in is enabled. The
+// email route uses it through guard.
+func (t *Treatshelf) requireEmailIn(r *http.Request) *appError {
+	if t.emailInToken == "" {
+		err := errors.New("email-in is not enabled")
+		return t.appErrorCodef(r, http.StatusNotFound, err, "%v", err)
+	}
+	return nil
+}
+
+// senderVerified reports whether SendGrid's checks of the message in r
+// vouch for sender: the mail passed SPF, and a signature by the sender's
+// domain passed DKIM.
+func senderVerified(r *http.Request, sender string) bool {
+	if !strings.EqualFold(r.FormValue("SPF"), "pass") {
+		return false
+	}
+	domain := sender[strings.LastIndex(sender, "@")+1:]
+	for _, m := range dkimResultPattern.FindAllStringSubmatch(r.FormValue("dkim"), -1) {
+		if strings.EqualFold(m[1], domain) && strings.EqualFold(m[2], "pass") {
+			return true
+		}
+	}
+	return false
+}
+
+// emailBody returns the description in the plain-text body of a message,
+// without its signature or quoted replies.
+func emailBody(text string) string {
+	text = strings.Replace(text, "\r\n", "\n", -1)
+	if i := strings.Index(text, "\n-- \n"); i >= 0 {
+		text = text[:i]
+	}
+	var lines []string
+	for _, l := range strings.Split(text, "\n") {
+		if !strings.HasPrefix(l, ">") {
+			lines = append(lines, l)
+		}
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
+
+// emailTreatID returns the ID of the treat added from a message, by its
+// Message-ID, or by its contents if it has none.
+func emailTreatID(messageID, from, subject, text string) string {
+	key := messageID
+	if key == "" {
+		key = from + "\x00" + subject + "\x00" + text
+	}
+	sum := sha256.Sum256([]byte(key))
+	return "email-" + hex.EncodeToString(sum[:8])
+}
+
+// messageID returns the Message-ID in the raw headers of a message.
+func messageID(headers string) string {
+	m, err := mail.ReadMessage(strings.NewReader(strings.TrimRight(headers, "\r\n") + "\r\n\r\n"))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(m.Header.Get("Message-Id"))
+}
+
+// emailInHandler adds the draft treat in a message posted by SendGrid
+// Inbound Parse.
+func (t *Treatshelf) emailInHandler(w http.ResponseWriter, r *http.Request) *appError {
+	ctx := r.Context()
+	token, err := t.secrets.resolve(ctx, t.emailInToken)
+	if err != nil {
+		return t.appErrorf(r, err, "could not read EMAIL_IN_TOKEN: %v", err)
+	}
+	if subtle.ConstantTimeCompare([]byte(r.URL.Query().Get("token")), []byte(token)) != 1 {
+		err := errors.New("invalid email-in token")
+		return t.appErrorCodef(r, http.StatusUnauthorized, err, "%v", err)
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxEmailBytes)
+	if err := r.ParseMultipartForm(maxEmailBytes); err != nil {
+		return t.appErrorCodef(r, http.StatusBadRequest, err, "could not parse mail: %v", err)
+	}
+
+	reject := func(from, reason string) *appError {
+		fmt.Fprintf(t.logWriter, "Email-in: ignoring mail from %s: %s\n", from, reason)
+		writeJSON(w, http.StatusOK, struct{ Rejected string }{reason})
+		return nil
+	}
+	from, err := mail.ParseAddress(r.FormValue("from"))
+	if err != nil {
+		return reject(r.FormValue("from"), "no valid sender")
+	}
+	sender := strings.ToLower(from.Address)
+	if strings.EqualFold(r.FormValue("SPF"), "fail") {
+		return reject(sender, "the sender's domain does not allow it to send from there")
+	}
+	subject := subjectPrefixPattern.ReplaceAllString(r.FormValue("subject"), "")
+	if strings.TrimSpace(subject) == "" {
+		return reject(sender, "no subject to use as the title")
+	}
+	treat := &Treat{
+		Title:       subject,
+		Description: emailBody(r.FormValue("text")),
+	}
+	if senderVerified(r, sender) {
+		treat.CreatedBy = sender
+	}
+	if err := treat.validate(); err != nil {
+		return reject(sender, err.Error())
+	}
+	treat.ID = emailTreatID(messageID(r.FormValue("headers")), sender, subject, r.FormValue("text"))
+	olds, err := t.DB.GetTreats(ctx, []string{treat.ID})
+	if err != nil {
+		return t.appErrorf(r, err, "GetTreats: %v", err)
+	}
+	if olds[0] != nil {
+		writeJSON(w, http.StatusOK, struct{ TreatID string }{treat.ID})
+		return nil
+	}
+
+	if field := emailPicture(r); field != "" {
+		treat.ImageURL, treat.ThumbnailURL, err = t.uploadPictureFromForm(ctx, r, field)
+		if m, ok := err.(malwareError); ok {
+			t.recordMalware(r, sender, m)
+			return reject(sender, m.Error())
+		}
+		if err != nil {
+			return t.appErrorf(r, err, "could not upload picture: %v", err)
+		}
+	}
+	treat.Review = reviewPending
+	if err := t.DB.UpdateTreat(ctx, treat); err != nil {
+		return t.appErrorf(r, err, "UpdateTreat: %v", err)
+	}
+	fmt.Fprintf(t.logWriter, "Email-in: %s added draft treat %s %q\n", sender, treat.ID, treat.Title)
+	writeJSON(w, http.StatusOK, struct{ TreatID string }{treat.ID})
+	return nil
+}
+
+// emailPicture returns the form field of the first picture attached to the
+// message in r, or "" if none is.
+func emailPicture(r *http.Request) string {
+	n, _ := strconv.Atoi(r.FormValue("attachments"))
+	if n > maxEmailAttachments {
+		n = maxEmailAttachments
+	}
+	for i := 1; i <= n; i++ {
+		field := "attachment" + strconv.Itoa(i)
+		fhs := r.MultipartForm.File[field]
+		if len(fhs) > 0 && strings.HasPrefix(fhs[0].Header.Get("Content-Type"), "image/") {
+			return field
+		}
+	}
+	return ""
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestSenderVerified(t *testing.T) {
+	tests := []struct {
+		spf, dkim string
+		want      bool
+	}{
+		{"pass", "{@example.com : pass}", true},
+		{"Pass", "{@sendgrid.net : pass, @Example.com : pass}", true},
+		{"pass", "", false},
+		{"pass", "{@example.com : fail}", false},
+		// Signed, but by another domain.
+		{"pass", "{@example.org : pass}", false},
+		{"pass", "{@notexample.com : pass}", false},
+		{"softfail", "{@example.com : pass}", false},
+		{"", "{@example.com : pass}", false},
+	}
+	for _, tt := range tests {
+		form := url.Values{"SPF": {tt.spf}, "dkim": {tt.dkim}}
+		r := httptest.NewRequest("POST", "/integrations/email", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if got := senderVerified(r, "someone@example.com"); got != tt.want {
+			t.Errorf("senderVerified with SPF %q, dkim %q = %v, want %v", tt.spf, tt.dkim, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,512 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	cloudkms "google.golang.org/api/cloudkms/v1"
+)
+
+// Sensitive fields of treats, such as InternalNotes, are encrypted before
+// they are stored, by encryptedDB, so that they can't be read from backups
+// or the Firestore console. Values are sealed with AES-GCM under a data key,
+// which is itself wrapped by a KeyWrapper: a key in Cloud KMS
+// (FIELD_ENCRYPTION_KMS_KEY) or, for development, local keys
+// (FIELD_ENCRYPTION_KEYS).
+//
+// Each value records the key that wrapped its data key, so keys can be
+// rotated: new values are written under the primary key, and older ones
+// are read with whichever key wrapped them until "reencrypt-fields"
+// rewrites them. Values stored before encryption was enabled are read as
+// they are.
+
+// encryptedPrefix starts encrypted values, which continue with the key ID,
+// the wrapped data key and the sealed value, separated by colons.
+const encryptedPrefix = "enc:v1:"
+
+// dataKeyLifetime is how long an instance seals values with one data key
+// before making another. Sharing data keys saves a KMS call per write.
+const dataKeyLifetime = time.Hour
+
+// sensitiveFields returns the fields of t that are encrypted at rest.
+func sensitiveFields(t *Treat) []*string {
+	return []*string{&t.InternalNotes}
+}
+
+// KeyWrapper encrypts the data keys that encrypt sensitive fields.
+type KeyWrapper interface {
+	// WrapKey encrypts dek with the primary key, returning that key's ID
+	// along with the wrapped data key.
+	WrapKey(ctx context.Context, dek []byte) (keyID string, wrapped []byte, err error)
+
+	// UnwrapKey decrypts a data key wrapped by WrapKey with the key keyID.
+	UnwrapKey(ctx context.Context, keyID string, wrapped []byte) ([]byte, error)
+}
+
+// kmsWrapper wraps data keys with a key in Cloud KMS, which rotates its
+// versions itself. It connects on first use.
+// See https://cloud.google.com/kms/docs/envelope-encryption.
+type kmsWrapper struct {
+	// key is the resource name of the CryptoKey.
+	key string
+
+	once sync.Once
+	svc  *cloudkms.Service
+	err  error
+}
+
+func (k *kmsWrapper) keys() (*cloudkms.ProjectsLocationsKeyRingsCryptoKeysService, error) {
+	k.once.Do(func() {
+		k.svc, k.err = cloudkms.NewService(context.Background())
+	})
+	if k.err != nil {
+		return nil, fmt.Errorf("could not connect to Cloud KMS: %v", k.err)
+	}
+	return k.svc.Projects.Locations.KeyRings.CryptoKeys, nil
+}
+
+// WrapKey encrypts dek with the primary version of the key. The key ID is
+// the name of that version.
+func (k *kmsWrapper) WrapKey(ctx context.Context, dek []byte) (string, []byte, error) {
+	keys, err := k.keys()
+	if err != nil {
+		return "", nil, err
+	}
+	req := &cloudkms.EncryptRequest{Plaintext: base64.StdEncoding.EncodeToString(dek)}
+	resp, err := keys.Encrypt(k.key, req).Context(ctx).Do()
+	if err != nil {
+		return "", nil, fmt.Errorf("kms: Encrypt: %v", err)
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(resp.Ciphertext)
+	if err != nil {
+		return "", nil, fmt.Errorf("kms: could not decode ciphertext: %v", err)
+	}
+	keyID := resp.Name
+	if keyID == "" {
+		keyID = k.key
+	}
+	return keyID, wrapped, nil
+}
+
+// UnwrapKey decrypts a data key with the key that keyID is a version of,
+// which needn't be the configured key.
+func (k *kmsWrapper) UnwrapKey(ctx context.Context, keyID string, wrapped []byte) ([]byte, error) {
+	keys, err := k.keys()
+	if err != nil {
+		return nil, err
+	}
+	if i := strings.Index(keyID, "/cryptoKeyVersions/"); i >= 0 {
+		keyID = keyID[:i]
+	}
+	req := &cloudkms.DecryptRequest{Ciphertext: base64.StdEncoding.EncodeToString(wrapped)}
+	resp, err := keys.Decrypt(keyID, req).Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("kms: Decrypt: %v", err)
+	}
+	return base64.StdEncoding.DecodeString(resp.Plaintext)
+}
+
+// localWrapper wraps data keys with AES-256 keys held by the app. The
+// first key is the primary one.
+type localWrapper struct {
+	primary string
+	keys    map[string][]byte
+}
+
+// parseLocalKeys parses FIELD_ENCRYPTION_KEYS: comma-separated ID:KEY
+// pairs, where KEY is 32 base64-encoded bytes. The first is the primary
+// key; the others only decrypt, until nothing uses them.
+func parseLocalKeys(s string) (*localWrapper, error) {
+	ids, keys, err := parseKeyPairs(s)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		if len(keys[id]) != 32 {
+			return nil, fmt.Errorf("key %q must be 32 bytes", id)
+		}
+	}
+	return &localWrapper{primary: ids[0], keys: keys}, nil
+}
+
+// WrapKey seals dek with the primary key.
+func (w *localWrapper) WrapKey(ctx context.Context, dek []byte) (string, []byte, error) {
+	wrapped, err := seal(w.keys[w.primary], dek)
+	return w.primary, wrapped, err
+}
+
+// UnwrapKey opens a data key sealed with the key keyID.
+func (w *localWrapper) UnwrapKey(ctx context.Context, keyID string, wrapped []byte) ([]byte, error) {
+	key, ok := w.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", keyID)
+	}
+	return open(key, wrapped)
+}
+
+// seal encrypts plaintext with AES-GCM under key, prefixed by the nonce.
+func seal(key, plaintext []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// open decrypts what seal returned.
+func open(key, sealed []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("sealed value is too short")
+	}
+	n := aead.NonceSize()
+	return aead.Open(nil, sealed[:n], sealed[n:], nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// fieldCipher encrypts and decrypts field values, caching data keys.
+type fieldCipher struct {
+	wrapper KeyWrapper
+	// clock times data keys, see clock.go.
+	clock Clock
+
+	mu sync.Mutex
+	// dek is the data key values are sealed with, wrapped by keyID.
+	dek     []byte
+	keyID   string
+	wrapped string
+	made    time.Time
+	// unwrapped caches data keys by key ID and wrapped data key.
+	unwrapped map[string][]byte
+}
+
+// maxUnwrappedKeys bounds the data keys a fieldCipher caches.
+const maxUnwrappedKeys = 1000
+
+func newFieldCipher(w KeyWrapper) *fieldCipher {
+	return &fieldCipher{wrapper: w, clock: systemClock{}, unwrapped: make(map[string][]byte)}
+}
+
+// dataKey returns the data key to seal values with, making one if there is
+// none or it has been in use for dataKeyLifetime.
+func (c *fieldCipher) dataKey(ctx context.Context) (dek []byte, keyID, wrapped string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.dek != nil && c.clock.Now().Sub(c.made) < dataKeyLifetime {
+		return c.dek, c.keyID, c.wrapped, nil
+	}
+	dek = make([]byte, 32)
+	if _, err := rand.Read(dek); err != nil {
+		return nil, "", "", err
+	}
+	keyID, w, err := c.wrapper.WrapKey(ctx, dek)
+	if err != nil {
+		return nil, "", "", err
+	}
+	c.dek, c.keyID, c.wrapped, c.made = dek, keyID, base64.RawURLEncoding.EncodeToString(w), c.clock.Now()
+	return c.dek, c.keyID, c.wrapped, nil
+}
+
+// rotate makes the next value sealed use a new data key, wrapped by the
+// primary key.
+func (c *fieldCipher) rotate() {
+	c.mu.Lock()
+	c.dek = nil
+	c.mu.Unlock()
+}
+
+// encrypt returns value encrypted, or "" if it is empty.
+func (c *fieldCipher) encrypt(ctx context.Context, value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	dek, keyID, wrapped, err := c.dataKey(ctx)
+	if err != nil {
+		return "", err
+	}
+	sealed, err := seal(dek, []byte(value))
+	if err != nil {
+		return "", err
+	}
+	return encryptedPrefix + keyID + ":" + wrapped + ":" + base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// decrypt returns the value encrypted by encrypt, or value itself if it
+// isn't encrypted.
+func (c *fieldCipher) decrypt(ctx context.Context, value string) (string, error) {
+	if !strings.HasPrefix(value, encryptedPrefix) {
+		return value, nil
+	}
+	parts := strings.Split(strings.TrimPrefix(value, encryptedPrefix), ":")
+	if len(parts) != 3 {
+		return "", errors.New("malformed encrypted value")
+	}
+	keyID, wrapped := parts[0], parts[1]
+	sealed, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", fmt.Errorf("malformed encrypted value: %v", err)
+	}
+
+	cacheKey := keyID + ":" + wrapped
+	c.mu.Lock()
+	dek, ok := c.unwrapped[cacheKey]
+	c.mu.Unlock()
+	if !ok {
+		w, err := base64.RawURLEncoding.DecodeString(wrapped)
+		if err != nil {
+			return "", fmt.Errorf("malformed encrypted value: %v", err)
+		}
+		if dek, err = c.wrapper.UnwrapKey(ctx, keyID, w); err != nil {
+			return "", fmt.Errorf("could not unwrap data key: %v", err)
+		}
+		c.mu.Lock()
+		if len(c.unwrapped) >= maxUnwrappedKeys {
+			c.unwrapped = make(map[string][]byte)
+		}
+		c.unwrapped[cacheKey] = dek
+		c.mu.Unlock()
+	}
+	plaintext, err := open(dek, sealed)
+	if err != nil {
+		return "", fmt.Errorf("could not decrypt value: %v", err)
+	}
+	return string(plaintext), nil
+}
+
+// encryptedDB is a TreatDatabase that encrypts the sensitive fields of
+// treats on their way to the database it wraps, and decrypts them on their
+// way back. Operations that only change other fields pass stored values
+// through as they are.
+type encryptedDB struct {
+	TreatDatabase
+	// cipher seals the fields, and its clock tells the time.
+	cipher *fieldCipher
+}
+
+var _ TreatDatabase = &encryptedDB{}
+
+func newEncryptedDB(db TreatDatabase, w KeyWrapper) *encryptedDB {
+	return &encryptedDB{TreatDatabase: db, cipher: newFieldCipher(w)}
+}
+
+// encryptTreat returns a copy of t with its sensitive fields encrypted.
+func (db *encryptedDB) encryptTreat(ctx context.Context, t *Treat) (*Treat, error) {
+	enc := *t
+	for _, f := range sensitiveFields(&enc) {
+		v, err := db.cipher.encrypt(ctx, *f)
+		if err != nil {
+			return nil, fmt.Errorf("encryptedDB: could not encrypt treat %q: %v", t.ID, err)
+		}
+		*f = v
+	}
+	return &enc, nil
+}
+
+// decryptTreat decrypts the sensitive fields of t in place.
+func (db *encryptedDB) decryptTreat(ctx context.Context, t *Treat) error {
+	if t == nil {
+		return nil
+	}
+	for _, f := range sensitiveFields(t) {
+		v, err := db.cipher.decrypt(ctx, *f)
+		if err != nil {
+			return fmt.Errorf("encryptedDB: could not decrypt treat %q: %v", t.ID, err)
+		}
+		*f = v
+	}
+	return nil
+}
+
+func (db *encryptedDB) decryptTreats(ctx context.Context, treats []*Treat) error {
+	for _, t := range treats {
+		if err := db.decryptTreat(ctx, t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *encryptedDB) ListTreats(ctx context.Context, opts ListOptions) ([]*Treat, error) {
+	treats, err := db.TreatDatabase.ListTreats(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	return treats, db.decryptTreats(ctx, treats)
+}
+
+func (db *encryptedDB) EachTreat(ctx context.Context, opts ListOptions, fn func(*Treat) error) error {
+	return db.TreatDatabase.EachTreat(ctx, opts, func(t *Treat) error {
+		if err := db.decryptTreat(ctx, t); err != nil {
+			return err
+		}
+		return fn(t)
+	})
+}
+
+func (db *encryptedDB) GetTreat(ctx context.Context, id string) (*Treat, error) {
+	t, err := db.TreatDatabase.GetTreat(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return t, db.decryptTreat(ctx, t)
+}
+
+func (db *encryptedDB) GetTreats(ctx context.Context, ids []string) ([]*Treat, error) {
+	treats, err := db.TreatDatabase.GetTreats(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	return treats, db.decryptTreats(ctx, treats)
+}
+
+func (db *encryptedDB) ListDeletedTreats(ctx context.Context, before time.Time) ([]*Treat, error) {
+	treats, err := db.TreatDatabase.ListDeletedTreats(ctx, before)
+	if err != nil {
+		return nil, err
+	}
+	return treats, db.decryptTreats(ctx, treats)
+}
+
+// AddTreat adds a copy of t with its sensitive fields encrypted, then sets
+// the ID of t, as the databases it wraps do.
+func (db *encryptedDB) AddTreat(ctx context.Context, t *Treat) (string, error) {
+	enc, err := db.encryptTreat(ctx, t)
+	if err != nil {
+		return "", err
+	}
+	id, err := db.TreatDatabase.AddTreat(ctx, enc)
+	if err != nil {
+		return "", err
+	}
+	t.ID = enc.ID
+	return id, nil
+}
+
+func (db *encryptedDB) UpdateTreat(ctx context.Context, t *Treat) error {
+	enc, err := db.encryptTreat(ctx, t)
+	if err != nil {
+		return err
+	}
+	return db.TreatDatabase.UpdateTreat(ctx, enc)
+}
+
+// SaveTreats saves copies of treats with their sensitive fields encrypted,
+// then sets the IDs of treats.
+func (db *encryptedDB) SaveTreats(ctx context.Context, treats []*Treat) error {
+	enc := make([]*Treat, len(treats))
+	for i, t := range treats {
+		e, err := db.encryptTreat(ctx, t)
+		if err != nil {
+			return err
+		}
+		enc[i] = e
+	}
+	if err := db.TreatDatabase.SaveTreats(ctx, enc); err != nil {
+		return err
+	}
+	for i, t := range treats {
+		t.ID = enc[i].ID
+	}
+	return nil
+}
+
+func (db *encryptedDB) UpdateTreatFields(ctx context.Context, t *Treat, fields []string) error {
+	enc, err := db.encryptTreat(ctx, t)
+	if err != nil {
+		return err
+	}
+	return db.TreatDatabase.UpdateTreatFields(ctx, enc, fields)
+}
+
+func (db *encryptedDB) AdjustQuantity(ctx context.Context, id string, delta int) (*Treat, error) {
+	t, err := db.TreatDatabase.AdjustQuantity(ctx, id, delta)
+	if err != nil {
+		return nil, err
+	}
+	return t, db.decryptTreat(ctx, t)
+}
+
+func (db *encryptedDB) ChangeTreat(ctx context.Context, id string, change func(*Treat) ([]string, error)) (*Treat, error) {
+	t, err := db.TreatDatabase.ChangeTreat(ctx, id, func(t *Treat) ([]string, error) {
+		if err := db.decryptTreat(ctx, t); err != nil {
+			return nil, err
+		}
+		fields, err := change(t)
+		if err != nil {
+			return nil, err
+		}
+		enc, err := db.encryptTreat(ctx, t)
+		if err != nil {
+			return nil, err
+		}
+		*t = *enc
+		return fields, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return t, db.decryptTreat(ctx, t)
+}
+
+// reencrypt rewrites every treat with a sensitive field set, so that they
+// are all encrypted under a new data key wrapped by the primary key. Run
+// it after rotating keys, before retiring the old ones, and after enabling
+// encryption, to encrypt the values stored before. It returns how many
+// treats it rewrote.
+func (db *encryptedDB) reencrypt(ctx context.Context) (int, error) {
+	opts := allTreatsOptions
+	opts.Consistency = ConsistencyStrong
+	var treats []*Treat
+	err := db.EachTreat(ctx, opts, func(t *Treat) error {
+		treats = append(treats, t)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	// Deleted treats can still be restored, with their fields.
+	deleted, err := db.ListDeletedTreats(ctx, db.cipher.clock.Now().Add(time.Hour))
+	if err != nil {
+		return 0, err
+	}
+	treats = append(treats, deleted...)
+
+	db.cipher.rotate()
+	n := 0
+	for _, t := range treats {
+		set := false
+		for _, f := range sensitiveFields(t) {
+			set = set || *f != ""
+		}
+		if !set {
+			continue
+		}
+		if err := db.UpdateTreat(ctx, t); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
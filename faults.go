@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"reflect"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// faultInjectingDB is a TreatDatabase that makes calls to the database it
+// wraps fail, or slow down, at a given rate per method, to check how the
+// app behaves when the database does: error pages, timeouts, the health
+// check and background jobs. It is installed only if FAULT_INJECTION is
+// set, and injects nothing until configured at /debug/faults (ruleDebug),
+// which isn't linked from anywhere:
+//
+//	curl -X POST 'localhost:8080/debug/faults?method=GetTreat&errorRate=0.5'
+//	curl -X POST 'localhost:8080/debug/faults?method=*&latency=2s&latencyRate=0.1'
+//	curl -X POST 'localhost:8080/debug/faults?clear=1'
+//
+// Unlike DualConfig, the configuration is kept by each instance, so a test
+// against a deployed version should pin it to one instance.
+type faultInjectingDB struct {
+	TreatDatabase
+
+	faults atomic.Value // FaultConfig
+	// roll returns a number in [0, 1) to compare with rates.
+	roll func() float64
+	// clock times injected latency, see clock.go.
+	clock Clock
+}
+
+// FaultConfig maps TreatDatabase method names, or "*" for every method
+// without its own entry, to the faults injected into their calls.
+type FaultConfig map[string]Fault
+
+// Fault is what a faultInjectingDB injects into calls of a method.
+type Fault struct {
+	// ErrorRate is the share of calls, from 0 to 1, that fail with an
+	// injectedFault instead of reaching the database.
+	ErrorRate float64
+	// LatencyRate is the share of calls delayed by Latency before they
+	// are made.
+	LatencyRate float64
+	Latency     time.Duration
+}
+
+// injectedFault is the error of a call a faultInjectingDB failed.
+type injectedFault struct {
+	method string
+}
+
+func (f injectedFault) Error() string {
+	return "injected fault in " + f.method
+}
+
+// injectedFaults counts the faults injected, by method and kind, such as
+// "GetTreat error". Served at /debug/vars.
+var injectedFaults = expvar.NewMap("injectedFaults")
+
+var _ TreatDatabase = &faultInjectingDB{}
+
+func newFaultInjectingDB(db TreatDatabase) *faultInjectingDB {
+	f := &faultInjectingDB{TreatDatabase: db, roll: rand.Float64, clock: systemClock{}}
+	f.faults.Store(FaultConfig{})
+	return f
+}
+
+// config returns the current configuration.
+func (db *faultInjectingDB) config() FaultConfig {
+	return db.faults.Load().(FaultConfig)
+}
+
+// inject delays or fails a call of the given method, as configured. It
+// returns the error the call should fail with, if any.
+func (db *faultInjectingDB) inject(ctx context.Context, method string) error {
+	c := db.config()
+	f, ok := c[method]
+	if !ok {
+		f = c["*"]
+	}
+	if f.Latency > 0 && db.roll() < f.LatencyRate {
+		injectedFaults.Add(method+" latency", 1)
+		select {
+		case <-db.clock.After(f.Latency):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if db.roll() < f.ErrorRate {
+		injectedFaults.Add(method+" error", 1)
+		return injectedFault{method}
+	}
+	return nil
+}
+
+func (db *faultInjectingDB) ListTreats(ctx context.Context, opts ListOptions) ([]*Treat, error) {
+	if err := db.inject(ctx, "ListTreats"); err != nil {
+		return nil, err
+	}
+	return db.TreatDatabase.ListTreats(ctx, opts)
+}
+
+func (db *faultInjectingDB) EachTreat(ctx context.Context, opts ListOptions, fn func(*Treat) error) error {
+	if err := db.inject(ctx, "EachTreat"); err != nil {
+		return err
+	}
+	return db.TreatDatabase.EachTreat(ctx, opts, fn)
+}
+
+func (db *faultInjectingDB) GetTreat(ctx context.Context, id string) (*Treat, error) {
+	if err := db.inject(ctx, "GetTreat"); err != nil {
+		return nil, err
+	}
+	return db.TreatDatabase.GetTreat(ctx, id)
+}
+
+func (db *faultInjectingDB) GetTreats(ctx context.Context, ids []string) ([]*Treat, error) {
+	if err := db.inject(ctx, "GetTreats"); err != nil {
+		return nil, err
+	}
+	return db.TreatDatabase.GetTreats(ctx, ids)
+}
+
+func (db *faultInjectingDB) AddTreat(ctx context.Context, t *Treat) (string, error) {
+	if err := db.inject(ctx, "AddTreat"); err != nil {
+		return "", err
+	}
+	return db.TreatDatabase.AddTreat(ctx, t)
+}
+
+func (db *faultInjectingDB) DeleteTreat(ctx context.Context, id string) error {
+	if err := db.inject(ctx, "DeleteTreat"); err != nil {
+		return err
+	}
+	return db.TreatDatabase.DeleteTreat(ctx, id)
+}
+
+func (db *faultInjectingDB) UpdateTreat(ctx context.Context, t *Treat) error {
+	if err := db.inject(ctx, "UpdateTreat"); err != nil {
+		return err
+	}
+	return db.TreatDatabase.UpdateTreat(ctx, t)
+}
+
+func (db *faultInjectingDB) SaveTreats(ctx context.Context, treats []*Treat) error {
+	if err := db.inject(ctx, "SaveTreats"); err != nil {
+		return err
+	}
+	return db.TreatDatabase.SaveTreats(ctx, treats)
+}
+
+func (db *faultInjectingDB) UpdateTreatFields(ctx context.Context, t *Treat, fields []string) error {
+	if err := db.inject(ctx, "UpdateTreatFields"); err != nil {
+		return err
+	}
+	return db.TreatDatabase.UpdateTreatFields(ctx, t, fields)
+}
+
+func (db *faultInjectingDB) AdjustQuantity(ctx context.Context, id string, delta int) (*Treat, error) {
+	if err := db.inject(ctx, "AdjustQuantity"); err != nil {
+		return nil, err
+	}
+	return db.TreatDatabase.AdjustQuantity(ctx, id, delta)
+}
+
+func (db *faultInjectingDB) ChangeTreat(ctx context.Context, id string, change func(*Treat) ([]string, error)) (*Treat, error) {
+	if err := db.inject(ctx, "ChangeTreat"); err != nil {
+		return nil, err
+	}
+	return db.TreatDatabase.ChangeTreat(ctx, id, change)
+}
+
+func (db *faultInjectingDB) ListClaims(ctx context.Context, treatID string) ([]*Claim, error) {
+	if err := db.inject(ctx, "ListClaims"); err != nil {
+		return nil, err
+	}
+	return db.TreatDatabase.ListClaims(ctx, treatID)
+}
+
+func (db *faultInjectingDB) ClaimTreat(ctx context.Context, treatID string, c *Claim) (string, error) {
+	if err := db.inject(ctx, "ClaimTreat"); err != nil {
+		return "", err
+	}
+	return db.TreatDatabase.ClaimTreat(ctx, treatID, c)
+}
+
+func (db *faultInjectingDB) ReleaseClaim(ctx context.Context, treatID, claimID string) error {
+	if err := db.inject(ctx, "ReleaseClaim"); err != nil {
+		return err
+	}
+	return db.TreatDatabase.ReleaseClaim(ctx, treatID, claimID)
+}
+
+func (db *faultInjectingDB) AnonymizeClaims(ctx context.Context, user, name string) (int, error) {
+	if err := db.inject(ctx, "AnonymizeClaims"); err != nil {
+		return 0, err
+	}
+	return db.TreatDatabase.AnonymizeClaims(ctx, user, name)
+}
+
+func (db *faultInjectingDB) ArchiveExpired(ctx context.Context, now time.Time) (int, error) {
+	if err := db.inject(ctx, "ArchiveExpired"); err != nil {
+		return 0, err
+	}
+	return db.TreatDatabase.ArchiveExpired(ctx, now)
+}
+
+func (db *faultInjectingDB) ReplaceTags(ctx context.Context, from []string, to string, progress func(done, total int)) (int, error) {
+	if err := db.inject(ctx, "ReplaceTags"); err != nil {
+		return 0, err
+	}
+	return db.TreatDatabase.ReplaceTags(ctx, from, to, progress)
+}
+
+func (db *faultInjectingDB) SoftDeleteTreats(ctx context.Context, ids []string, token string, at time.Time) error {
+	if err := db.inject(ctx, "SoftDeleteTreats"); err != nil {
+		return err
+	}
+	return db.TreatDatabase.SoftDeleteTreats(ctx, ids, token, at)
+}
+
+func (db *faultInjectingDB) RestoreTreats(ctx context.Context, token string, after time.Time) (int, error) {
+	if err := db.inject(ctx, "RestoreTreats"); err != nil {
+		return 0, err
+	}
+	return db.TreatDatabase.RestoreTreats(ctx, token, after)
+}
+
+func (db *faultInjectingDB) ListDeletedTreats(ctx context.Context, before time.Time) ([]*Treat, error) {
+	if err := db.inject(ctx, "ListDeletedTreats"); err != nil {
+		return nil, err
+	}
+	return db.TreatDatabase.ListDeletedTreats(ctx, before)
+}
+
+func (db *faultInjectingDB) PurgeDeletedTreats(ctx context.Context, before time.Time) (int, error) {
+	if err := db.inject(ctx, "PurgeDeletedTreats"); err != nil {
+		return 0, err
+	}
+	return db.TreatDatabase.PurgeDeletedTreats(ctx, before)
+}
+
+// rateFromForm parses an optional rate form value from 0 to 1.
+func rateFromForm(r *http.Request, name string) (float64, error) {
+	s := r.FormValue(name)
+	if s == "" {
+		return 0, nil
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || f < 0 || f > 1 {
+		return 0, fmt.Errorf("%s must be a number from 0 to 1, got %q", name, s)
+	}
+	return f, nil
+}
+
+// faultsHandler shows the faults injected by this instance, and on POST
+// sets those of the method in the "method" parameter ("*" if empty) from
+// the errorRate, latency and latencyRate parameters, removes them if none
+// is given, or removes every method's with clear=1.
+func (t *Treatshelf) faultsHandler(w http.ResponseWriter, r *http.Request) *appError {
+	if t.faults == nil {
+		err := fmt.Errorf("fault injection is off: set FAULT_INJECTION to enable it")
+		return t.appErrorCodef(r, http.StatusNotFound, err, "%v", err)
+	}
+	if r.Method == "POST" {
+		c := FaultConfig{}
+		if r.FormValue("clear") == "" {
+			for m, f := range t.faults.config() {
+				c[m] = f
+			}
+			method := r.FormValue("method")
+			if method == "" {
+				method = "*"
+			}
+			if _, ok := reflect.TypeOf((*TreatDatabase)(nil)).Elem().MethodByName(method); !ok && method != "*" {
+				err := fmt.Errorf("%q is not a TreatDatabase method", method)
+				return t.appErrorCodef(r, http.StatusBadRequest, err, "%v", err)
+			}
+			var f Fault
+			var err error
+			if f.ErrorRate, err = rateFromForm(r, "errorRate"); err != nil {
+				return t.appErrorCodef(r, http.StatusBadRequest, err, "%v", err)
+			}
+			if f.LatencyRate, err = rateFromForm(r, "latencyRate"); err != nil {
+				return t.appErrorCodef(r, http.StatusBadRequest, err, "%v", err)
+			}
+			if s := r.FormValue("latency"); s != "" {
+				if f.Latency, err = time.ParseDuration(s); err != nil || f.Latency < 0 {
+					err := fmt.Errorf("latency must be a duration such as 250ms, got %q", s)
+					return t.appErrorCodef(r, http.StatusBadRequest, err, "%v", err)
+				}
+				if r.FormValue("latencyRate") == "" {
+					f.LatencyRate = 1
+				}
+			}
+			delete(c, method)
+			if f != (Fault{}) {
+				c[method] = f
+			}
+		}
+		t.faults.faults.Store(c)
+		fmt.Fprintf(t.logWriter, "Fault injection set by %s: %v\n", t.currentUser(r), c)
+	}
+
+	type fault struct {
+		ErrorRate   float64
+		LatencyRate float64
+		Latency     string
+	}
+	out := struct {
+		Faults   map[string]fault
+		Injected json.RawMessage
+	}{make(map[string]fault), json.RawMessage(injectedFaults.String())}
+	for m, f := range t.faults.config() {
+		out.Faults[m] = fault{f.ErrorRate, f.LatencyRate, f.Latency.String()}
+	}
+	writeJSON(w, http.StatusOK, out)
+	return nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// API clients on slow connections, such as the mobile app, can ask for
+// only the fields of treats they show, as JSON:API's sparse fieldsets do:
+// GET /api/v1/treats?fields=title,thumbnailURL. Field names are those of
+// the Treat JSON, in any case. ID is always included.
+
+var (
+	treatFieldsOnce sync.Once
+	// treatFields maps the lowercased names of the fields of the Treat JSON
+	// to their names.
+	treatFields map[string]string
+)
+
+// treatFieldNames returns treatFields, filling it on first use.
+func treatFieldNames() map[string]string {
+	treatFieldsOnce.Do(func() {
+		b, err := json.Marshal(&Treat{})
+		if err != nil {
+			panic(err)
+		}
+		var m map[string]json.RawMessage
+		if err := json.Unmarshal(b, &m); err != nil {
+			panic(err)
+		}
+		treatFields = make(map[string]string, len(m))
+		for name := range m {
+			treatFields[strings.ToLower(name)] = name
+		}
+	})
+	return treatFields
+}
+
+// treatFieldName returns the name of the field of the Treat JSON named s,
+// in any case.
+func treatFieldName(s string) (string, bool) {
+	name, ok := treatFieldNames()[strings.ToLower(strings.TrimSpace(s))]
+	return name, ok
+}
+
+// fieldsFromRequest returns the Treat fields named by r's "fields"
+// parameter, or nil if it has none.
+func fieldsFromRequest(r *http.Request) ([]string, error) {
+	s := strings.TrimSpace(r.FormValue("fields"))
+	if s == "" {
+		return nil, nil
+	}
+	fields := []string{"ID"}
+	for _, f := range strings.Split(s, ",") {
+		name, ok := treatFieldName(f)
+		if !ok {
+			return nil, fmt.Errorf("unknown field %q", strings.TrimSpace(f))
+		}
+		fields = append(fields, name)
+	}
+	return fields, nil
+}
+
+// sparseTreat returns the given fields of treat as a JSON object, as API
+// version v represents it (see apiversion.go), or all of them if fields is
+// nil.
+func sparseTreat(v *apiVersion, treat *Treat, fields []string) (interface{}, error) {
+	if fields == nil && v == apiV1 {
+		return treat, nil
+	}
+	all, err := v.encodeTreat(treat)
+	if err != nil || fields == nil {
+		return all, err
+	}
+	sparse := make(map[string]json.RawMessage, len(fields))
+	for _, f := range fields {
+		if raw, ok := all[f]; ok {
+			sparse[f] = raw
+		}
+	}
+	return sparse, nil
+}
+
+// sparseTreats is sparseTreat for a list of treats.
+func sparseTreats(v *apiVersion, treats []*Treat, fields []string) (interface{}, error) {
+	if fields == nil && v == apiV1 {
+		return treats, nil
+	}
+	sparse := make([]interface{}, len(treats))
+	for i, treat := range treats {
+		s, err := sparseTreat(v, treat, fields)
+		if err != nil {
+			return nil, err
+		}
+		sparse[i] = s
+	}
+	return sparse, nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+// templateFuncs are available to every template, see parseTemplate.
+var templateFuncs = template.FuncMap{
+	"asset":      asset,
+	"bundle":     bundle,
+	"truncate":   truncate,
+	"formatDate": formatDate,
+	"pluralize":  pluralize,
+	"img":        img,
+	"route":      route,
+}
+
+// truncate shortens s to at most n characters, ending in an ellipsis if it
+// was cut: {{.Description | truncate 80}}.
+func truncate(n int, s string) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	if n <= 1 {
+		return "…"
+	}
+	r := []rune(s)
+	return strings.TrimRight(string(r[:n-1]), " ") + "…"
+}
+
+// dateLayouts are the layouts formatDate accepts by name.
+var dateLayouts = map[string]string{
+	"short": "Jan 2 15:04",
+	"day":   "Jan 2",
+	"long":  "2006-01-02 15:04 MST",
+	"input": datetimeLocalLayout,
+}
+
+// formatDate formats t with the named layout, one of dateLayouts, or
+// returns "" if t is zero: {{.Created | formatDate "long"}}.
+func formatDate(layout string, t time.Time) (string, error) {
+	l, ok := dateLayouts[layout]
+	if !ok {
+		return "", fmt.Errorf("formatDate: unknown layout %q", layout)
+	}
+	if t.IsZero() {
+		return "", nil
+	}
+	return t.Format(l), nil
+}
+
+// pluralize returns the number n followed by singular or plural, as n
+// needs: {{pluralize .Quantity "treat" "treats"}}. n may be any integer
+// type.
+func pluralize(n interface{}, singular, plural string) string {
+	s := fmt.Sprint(n)
+	if s == "1" {
+		return s + " " + singular
+	}
+	return s + " " + plural
+}
+
+// placeholderImage is shown for treats without a picture, at the width and
+// height of the preset, see img.
+const placeholderImage = "https://placekitten.com/g/%d/%d"
+
+// routes is the router that route builds URLs with, set by Handler. The
+// templates are shared by every Treatshelf, so route uses the last one set
+// up.
+var routes atomic.Value // namedRoutes
+
+type namedRoutes struct {
+	router   *mux.Router
+	basePath string
+}
+
+// setRoutes makes the named routes of router available to route.
+func setRoutes(router *mux.Router, basePath string) {
+	routes.Store(namedRoutes{router, basePath})
+}
+
+// route returns the path of the named route with the given variables,
+// relative to the <base> of the page, as links in templates are:
+// {{route "treat" "id" .ID}}.
+func route(name string, pairs ...interface{}) (string, error) {
+	rs, ok := routes.Load().(namedRoutes)
+	if !ok {
+		return "", fmt.Errorf("route %q: no routes set", name)
+	}
+	vars := make([]string, len(pairs))
+	for i, p := range pairs {
+		vars[i] = fmt.Sprint(p)
+	}
+	path, err := routePath(rs.router, name, vars)
+	if err != nil {
+		return "", err
+	}
+	path = strings.TrimPrefix(strings.TrimPrefix(path, rs.basePath), "/")
+	if first := strings.SplitN(path, "/", 2)[0]; strings.Contains(first, ":") {
+		// Such as "treats:batchDelete", which would otherwise read as a
+		// URL scheme and be rejected by html/template.
+		path = "./" + path
+	}
+	return path, nil
+}
+
+// routePath returns the absolute path of the named route of router with the
+// given variables, as name, value pairs.
+func routePath(router *mux.Router, name string, pairs []string) (string, error) {
+	rt := router.Get(name)
+	if rt == nil {
+		return "", fmt.Errorf("no route named %q", name)
+	}
+	u, err := rt.URLPath(pairs...)
+	if err != nil {
+		return "", fmt.Errorf("route %q: %v", name, err)
+	}
+	return u.Path, nil
+}
+
+// routeURL returns the path of the named route with the given variables,
+// including the base path, for redirects:
+// http.Redirect(w, r, t.routeURL("treat", "id", id), http.StatusFound).
+// Route names are constants, so it panics if the route can't be built.
+func (t *Treatshelf) routeURL(name string, pairs ...string) string {
+	path, err := routePath(t.routes, name, pairs)
+	if err != nil {
+		panic(err)
+	}
+	return path
+}
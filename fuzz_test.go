@@ -0,0 +1,161 @@
+//go:build go1.18
+// +build go1.18
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"unicode"
+	"unicode/utf8"
+)
+
+// The fuzz targets below run their seeds with go test; fuzz one with
+//
+//	go test -run NONE -fuzz FuzzTreatFromForm -fuzztime 1m
+//
+// and commit the inputs of any failures it writes to testdata/fuzz, so that
+// they are checked from then on.
+
+// weirdTitles are titles seen in the wild, or close to them, that have
+// broken something somewhere.
+var weirdTitles = []string{
+	"Brownie",
+	"🍫🍪 Cookie Monster's 🍪🍫",
+	"\U0001F469\u200d\U0001F469\u200d\U0001F467 family-size pie",
+	"עוגת שוקולד",
+	"كعكة الشوكولاتة",
+	"Brownie \u202eeikooc\u202c",
+	"Crème brûlée",
+	"Cre\u0300me bru\u0302le\u0301e",
+	"<script>alert(1)</script>",
+	`"><img src=x onerror=alert(1)>`,
+	"Robert'); DROP TABLE treats;--",
+	"{{.InternalNotes}}",
+	"../../etc/passwd",
+	"tab\there\x00nul",
+	"\ufeffBOM\u200b",
+	"\xff\xfe invalid UTF-8",
+	"   ",
+	"",
+}
+
+// hasControl reports whether s has control or bidi control characters.
+func hasControl(s string) bool {
+	return strings.IndexFunc(s, func(r rune) bool {
+		return unicode.IsControl(r) || isBidiControl(r)
+	}) >= 0
+}
+
+func FuzzTreatFromForm(f *testing.F) {
+	for _, title := range weirdTitles {
+		f.Add(title, title, "chocolate, "+title, "3", "")
+	}
+	f.Add("Long", strings.Repeat("Fudgy, with walnuts. ", 500), "a,b,,A, a ,b", "12", "51.5,-0.12")
+	f.Add("Negative", "", "", "-1", "91,0")
+	f.Add("Huge", "", "", "99999999999999999999", "nan,nan")
+	shelf := &Treatshelf{logWriter: ioutil.Discard, admins: make(map[string]bool), keyring: randomKeyring()}
+	f.Fuzz(func(t *testing.T, title, description, tags, quantity, coords string) {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		for k, v := range map[string]string{
+			"title":            title,
+			"altText":          title,
+			"description":      description,
+			"tags":             tags,
+			"quantity":         quantity,
+			"placeCoordinates": coords,
+		} {
+			mw.WriteField(k, v)
+		}
+		mw.Close()
+		r := httptest.NewRequest("POST", "/treats", &body)
+		r.Header.Set("Content-Type", mw.FormDataContentType())
+		treat, err := shelf.treatFromForm(r)
+		if err != nil {
+			return
+		}
+		for _, s := range []string{treat.Title, treat.AltText} {
+			if hasControl(s) || !utf8.ValidString(s) || s != strings.TrimSpace(s) {
+				t.Errorf("line %q was not cleaned", s)
+			}
+		}
+		if !utf8.ValidString(treat.Description) || strings.Contains(treat.Description, "\r") {
+			t.Errorf("description %q was not cleaned", treat.Description)
+		}
+		if treat.Quantity != nil && *treat.Quantity < 0 {
+			t.Errorf("negative quantity %d", *treat.Quantity)
+		}
+		if !reflect.DeepEqual(treat.Tags, parseTags(strings.Join(treat.Tags, ","))) {
+			t.Errorf("tags %q are not normalized", treat.Tags)
+		}
+		// Validating again must change nothing.
+		again := *treat
+		if err := again.validate(); err != nil || !reflect.DeepEqual(&again, treat) {
+			t.Errorf("validate is not idempotent: %v\n%+v\n%+v", err, treat, &again)
+		}
+	})
+}
+
+// FuzzParseTags fuzzes tag normalization. Treats have no slugs; tags are
+// the nearest thing, appearing in ?tag= links and admin tag edits.
+func FuzzParseTags(f *testing.F) {
+	for _, title := range weirdTitles {
+		f.Add(title)
+	}
+	f.Add("Vegan, vegan ,VEGAN,gluten  free,,")
+	f.Add(strings.Repeat("tag,", 2000))
+	f.Fuzz(func(t *testing.T, s string) {
+		tags := parseTags(s)
+		seen := make(map[string]bool)
+		for _, tag := range tags {
+			switch {
+			case tag == "", strings.Contains(tag, ","), tag != normalizeTag(tag):
+				t.Errorf("tag %q of %q is not normalized", tag, s)
+			case hasControl(tag):
+				t.Errorf("tag %q of %q has control characters", tag, s)
+			case seen[tag]:
+				t.Errorf("tag %q of %q is repeated", tag, s)
+			}
+			seen[tag] = true
+		}
+		if again := parseTags(strings.Join(tags, ",")); !reflect.DeepEqual(again, tags) {
+			t.Errorf("parseTags(%q) = %q, but again gives %q", s, tags, again)
+		}
+	})
+}
+
+// treatIDPattern is the pattern of {id} in treat routes.
+var treatIDPattern = regexp.MustCompile(`^[0-9a-zA-Z_\-]+$`)
+
+// FuzzTreatID requests treats by arbitrary IDs from the web UI and the API,
+// which must neither fail nor echo IDs the routes don't allow.
+func FuzzTreatID(f *testing.F) {
+	for _, id := range []string{"1", "2", "abc_-", "..", ".", "__name__", "1/edit", "1%2Fedit", "<b>x</b>", "1?x=1", "１", "a b"} {
+		f.Add(id)
+	}
+	for _, title := range weirdTitles {
+		f.Add(title)
+	}
+	h := brownieShelf(f).Handler()
+	f.Fuzz(func(t *testing.T, id string) {
+		// JSON escapes quotes, and writeJSON the rest of these.
+		for path, unsafe := range map[string]string{"/treats/": `<>"'&`, "/api/v1/treats/": "<>&"} {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest("GET", path+url.PathEscape(id), nil))
+			if w.Code >= 500 {
+				t.Errorf("GET %s%q: %d: %s", path, id, w.Code, w.Body)
+			}
+			if !treatIDPattern.MatchString(id) && strings.ContainsAny(id, unsafe) && strings.Contains(w.Body.String(), id) {
+				t.Errorf("GET %s%q echoed the ID unescaped", path, id)
+			}
+		}
+	})
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Place is where a treat can be picked up.
+type Place struct {
+	Address string // free text, e.g. "3rd floor kitchen".
+	Lat     float64
+	Lng     float64
+
+	// Geohash encodes Lat/Lng so that nearby places share a prefix, which
+	// lets proximity queries use plain range filters.
+	Geohash string
+}
+
+// HasCoordinates reports whether the place has been located on a map.
+func (p *Place) HasCoordinates() bool {
+	return p.Geohash != ""
+}
+
+// normalize checks the place's coordinates and recomputes its geohash from
+// them, so that it can't disagree with Lat/Lng. A place at 0,0 is taken to
+// have no coordinates.
+func (p *Place) normalize() error {
+	if p.Lat == 0 && p.Lng == 0 {
+		p.Geohash = ""
+		return nil
+	}
+	if math.IsNaN(p.Lat) || math.IsNaN(p.Lng) || p.Lat < -90 || p.Lat > 90 || p.Lng < -180 || p.Lng > 180 {
+		return fmt.Errorf("invalid coordinates %f,%f", p.Lat, p.Lng)
+	}
+	p.Geohash = geohash(LatLng{Lat: p.Lat, Lng: p.Lng}, geohashPrecision)
+	return nil
+}
+
+// MapEmbedURL returns an OpenStreetMap embed URL centered on the place.
+func (p *Place) MapEmbedURL() string {
+	const d = 0.005 // degrees of padding around the marker.
+	v := url.Values{}
+	v.Set("bbox", fmt.Sprintf("%f,%f,%f,%f", p.Lng-d, p.Lat-d, p.Lng+d, p.Lat+d))
+	v.Set("layer", "mapnik")
+	v.Set("marker", fmt.Sprintf("%f,%f", p.Lat, p.Lng))
+	return "https://www.openstreetmap.org/export/embed.html?" + v.Encode()
+}
+
+// LatLng is a point on the globe, in degrees.
+type LatLng struct {
+	Lat, Lng float64
+}
+
+// parseLatLng parses a "lat,lng" pair such as "51.5,-0.12".
+func parseLatLng(s string) (*LatLng, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid coordinates %q, want lat,lng", s)
+	}
+	lat, err1 := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	lng, err2 := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+	if err1 != nil || err2 != nil || lat < -90 || lat > 90 || lng < -180 || lng > 180 {
+		return nil, fmt.Errorf("invalid coordinates %q", s)
+	}
+	return &LatLng{Lat: lat, Lng: lng}, nil
+}
+
+const earthRadiusKm = 6371.0
+
+// distanceKm returns the great-circle distance between two points.
+func distanceKm(a, b LatLng) float64 {
+	rad := math.Pi / 180
+	dLat := (b.Lat - a.Lat) * rad
+	dLng := (b.Lng - a.Lng) * rad
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(a.Lat*rad)*math.Cos(b.Lat*rad)*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadiusKm * math.Asin(math.Sqrt(h))
+}
+
+const (
+	geohashAlphabet  = "0123456789bcdefghjkmnpqrstuvwxyz"
+	geohashPrecision = 9 // about 5m x 5m.
+)
+
+// geohash encodes a point as a geohash of the given precision.
+// See https://en.wikipedia.org/wiki/Geohash.
+func geohash(p LatLng, precision int) string {
+	latLo, latHi := -90.0, 90.0
+	lngLo, lngHi := -180.0, 180.0
+	var b strings.Builder
+	bit, ch, even := 0, 0, true
+	for b.Len() < precision {
+		if even {
+			mid := (lngLo + lngHi) / 2
+			if p.Lng >= mid {
+				ch = ch<<1 | 1
+				lngLo = mid
+			} else {
+				ch <<= 1
+				lngHi = mid
+			}
+		} else {
+			mid := (latLo + latHi) / 2
+			if p.Lat >= mid {
+				ch = ch<<1 | 1
+				latLo = mid
+			} else {
+				ch <<= 1
+				latHi = mid
+			}
+		}
+		even = !even
+		if bit++; bit == 5 {
+			b.WriteByte(geohashAlphabet[ch])
+			bit, ch = 0, 0
+		}
+	}
+	return b.String()
+}
+
+// geohashRange is an inclusive range of geohashes sharing a prefix.
+type geohashRange struct {
+	start, end string
+}
+
+// geohashRanges returns geohash ranges that together cover every point
+// within radiusKm of center. Callers must still filter by exact distance.
+func geohashRanges(center LatLng, radiusKm float64) []geohashRange {
+	dLat := radiusKm / (earthRadiusKm * math.Pi / 180)
+	dLng := dLat / math.Max(math.Cos(center.Lat*math.Pi/180), 0.01)
+
+	// Use the longest prefix whose cells are at least as big as the search
+	// box, so the box overlaps at most two cells in each direction and the
+	// cells containing its corners cover it.
+	precision := 1
+	for p := geohashPrecision; p > 1; p-- {
+		lngBits := (5*p + 1) / 2
+		latBits := 5 * p / 2
+		if 360/math.Pow(2, float64(lngBits)) >= 2*dLng && 180/math.Pow(2, float64(latBits)) >= 2*dLat {
+			precision = p
+			break
+		}
+	}
+
+	seen := make(map[string]bool)
+	var ranges []geohashRange
+	for _, p := range []LatLng{
+		center,
+		{center.Lat - dLat, center.Lng - dLng},
+		{center.Lat - dLat, center.Lng + dLng},
+		{center.Lat + dLat, center.Lng - dLng},
+		{center.Lat + dLat, center.Lng + dLng},
+	} {
+		p.Lat = math.Max(-90, math.Min(90, p.Lat))
+		p.Lng = math.Mod(p.Lng+540, 360) - 180
+		h := geohash(p, precision)
+		if seen[h] {
+			continue
+		}
+		seen[h] = true
+		ranges = append(ranges, geohashRange{start: h, end: h + "~"})
+	}
+	return ranges
+}
+
+// Geocoder looks up the coordinates of a free-text address.
+type Geocoder interface {
+	Geocode(ctx context.Context, address string) (LatLng, error)
+}
+
+// errNoGeocodeResults is returned when an address could not be found.
+var errNoGeocodeResults = errors.New("address not found")
+
+// mapsGeocoder uses the Google Maps Geocoding API.
+// See https://developers.google.com/maps/documentation/geocoding.
+type mapsGeocoder struct {
+	key    string
+	client *http.Client
+}
+
+// Geocode looks up the first match for address.
+func (g *mapsGeocoder) Geocode(ctx context.Context, address string) (LatLng, error) {
+	u := "https://maps.googleapis.com/maps/api/geocode/json?" + url.Values{
+		"address": {address},
+		"key":     {g.key},
+	}.Encode()
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return LatLng{}, err
+	}
+	resp, err := g.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return LatLng{}, fmt.Errorf("geocode: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		Status  string `json:"status"`
+		Results []struct {
+			Geometry struct {
+				Location struct {
+					Lat float64 `json:"lat"`
+					Lng float64 `json:"lng"`
+				} `json:"location"`
+			} `json:"geometry"`
+		} `json:"results"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return LatLng{}, fmt.Errorf("geocode: could not decode response: %v", err)
+	}
+	switch body.Status {
+	case "OK":
+	case "ZERO_RESULTS":
+		return LatLng{}, errNoGeocodeResults
+	default:
+		return LatLng{}, fmt.Errorf("geocode: status %s", body.Status)
+	}
+	loc := body.Results[0].Geometry.Location
+	return LatLng{Lat: loc.Lat, Lng: loc.Lng}, nil
+}
+
+// placeFromForm populates a Place from form values (see templates/edit.html),
+// geocoding the address if no coordinates were given. It returns nil if no
+// place was given.
+func (t *Treatshelf) placeFromForm(ctx context.Context, r *http.Request) (*Place, error) {
+	p := &Place{Address: strings.TrimSpace(r.FormValue("placeAddress"))}
+	coords := strings.TrimSpace(r.FormValue("placeCoordinates"))
+	if p.Address == "" && coords == "" {
+		return nil, nil
+	}
+
+	var ll LatLng
+	switch {
+	case coords != "":
+		c, err := parseLatLng(coords)
+		if err != nil {
+			return nil, err
+		}
+		ll = *c
+	case t.geocoder != nil:
+		c, err := t.geocoder.Geocode(ctx, p.Address)
+		if err == errNoGeocodeResults {
+			return p, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		ll = c
+	default:
+		return p, nil
+	}
+	p.Lat, p.Lng = ll.Lat, ll.Lng
+	p.Geohash = geohash(ll, geohashPrecision)
+	return p, nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// The pages below are rendered from fixed data and compared with the HTML in
+// testdata/golden, so that changes to templates, or to the data handlers
+// give them, show up in review as changes to those files. After an intended
+// change, rewrite them with
+//
+//	go test -run TestGoldenPages -update
+//
+// and check the diff.
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata/golden")
+
+// goldenShelf returns a Treatshelf backed by a memoryDB holding fixed
+// treats, with admin@example.com as its admin and a fake clock.
+func goldenShelf(t *testing.T) *Treatshelf {
+	shelf, db := newTestShelf(t, withAdmin("admin@example.com"), withAllDatabases())
+	ctx := context.Background()
+	if _, err := db.AddLocation(ctx, &Location{Name: "Kitchen", Timezone: "UTC"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, treat := range []*Treat{{
+		ID:            "brownie",
+		Title:         "Brownie",
+		Author:        "Erica",
+		PublishedDate: "2020-03-14",
+		ImageURL:      "https://example.com/brownie.jpg",
+		ThumbnailURL:  "https://example.com/brownie-thumb.jpg",
+		AltText:       "A square of fudge brownie",
+		Description:   "Fudgy, with walnuts.\nKeep <cool> & dry.",
+		Nutrition:     &Nutrition{ServingSize: 50, Calories: 200, Sugar: 10, Fat: 5},
+		Allergens:     []string{"eggs", "nuts"},
+		Tags:          []string{"chocolate", "gluten free"},
+		Quantity:      intp(3),
+		Price:         &Price{Amount: 250, Currency: "USD"},
+		LocationID:    "1",
+		Place:         &Place{Address: "1 Main St", Lat: 51.5, Lng: -0.12, Geohash: "gcpvj0"},
+		ExpiresAt:     time.Date(2099, 1, 2, 15, 4, 0, 0, time.UTC),
+		CreatedBy:     "admin@example.com",
+		InternalNotes: "Supplier: Acme Bakery",
+	}, {
+		ID:    "pie",
+		Title: `Apple pie "à la mode"`,
+	}} {
+		if err := db.UpdateTreat(ctx, treat); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return shelf
+}
+
+func TestGoldenPages(t *testing.T) {
+	shelf := goldenShelf(t)
+	pages := []struct {
+		name string
+		h    appHandler
+		id   string
+	}{
+		{"list", shelf.listHandler, ""},
+		{"detail", shelf.detailHandler, "brownie"},
+		{"detail-minimal", shelf.detailHandler, "pie"},
+		{"edit", shelf.editFormHandler, "brownie"},
+		{"add", shelf.addFormHandler, ""},
+		{"about", shelf.addAboutHandler, ""},
+		{"error", func(w http.ResponseWriter, r *http.Request) *appError {
+			err := errors.New(`could not find treat "<nope>"`)
+			shelf.appErrorCodef(r, http.StatusNotFound, err, "%v", err).writePage(w, "request-1")
+			return nil
+		}, ""},
+	}
+	for _, p := range pages {
+		t.Run(p.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.Header.Set(iapEmailHeader, "accounts.google.com:admin@example.com")
+			r = mux.SetURLVars(r, map[string]string{"id": p.id})
+			w := httptest.NewRecorder()
+			p.h.ServeHTTP(w, r)
+			checkGolden(t, p.name, w.Body.String())
+		})
+	}
+}
+
+// checkGolden compares got with testdata/golden/<name>.html, or rewrites
+// that file with -update.
+func checkGolden(t *testing.T, name, got string) {
+	path := filepath.Join("testdata", "golden", name+".html")
+	if *update {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(got), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v; run with -update to create it", err)
+	}
+	if want := string(b); got != want {
+		gotLines, wantLines := strings.Split(got, "\n"), strings.Split(want, "\n")
+		for i := 0; i < len(gotLines) || i < len(wantLines); i++ {
+			var g, w string
+			if i < len(gotLines) {
+				g = gotLines[i]
+			}
+			if i < len(wantLines) {
+				w = wantLines[i]
+			}
+			if g != w {
+				t.Fatalf("%s differs from the page at line %d:\ngot:  %s\nwant: %s\nRun with -update if the change is intended.", path, i+1, g, w)
+			}
+		}
+	}
+}
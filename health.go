@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// Components that the app can run without, in degraded mode.
+const (
+	componentStorage        = "storage"         // picture uploads are disabled.
+	componentErrorReporting = "error reporting" // errors are only logged.
+)
+
+// Bounds for retrying degraded components in the background.
+const (
+	minRecoverBackoff = 5 * time.Second
+	maxRecoverBackoff = 5 * time.Minute
+)
+
+// degrade records that component is unavailable because of err, and starts
+// retrying it in the background.
+func (t *Treatshelf) degrade(component string, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	fmt.Fprintf(t.logWriter, "Running without %s: %v\n", component, err)
+	if t.degraded == nil {
+		t.degraded = make(map[string]error)
+	}
+	t.degraded[component] = err
+	if !t.recovering {
+		t.recovering = true
+		go t.recoverDegraded()
+	}
+}
+
+// degradedComponents returns the unavailable components and why, sorted by
+// component.
+func (t *Treatshelf) degradedComponents() []string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	var ds []string
+	for c, err := range t.degraded {
+		ds = append(ds, fmt.Sprintf("%s: %v", c, err))
+	}
+	sort.Strings(ds)
+	return ds
+}
+
+// recoverDegraded retries degraded components until they are all
+// available, backing off between attempts.
+func (t *Treatshelf) recoverDegraded() {
+	ctx := context.Background()
+	for backoff := minRecoverBackoff; ; backoff *= 2 {
+		if backoff > maxRecoverBackoff {
+			backoff = maxRecoverBackoff
+		}
+		time.Sleep(backoff)
+
+		t.mu.RLock()
+		_, needStorage := t.degraded[componentStorage]
+		_, needErrors := t.degraded[componentErrorReporting]
+		t.mu.RUnlock()
+
+		if needStorage {
+			t.recover(componentStorage, t.recoverStorage(ctx))
+		}
+		if needErrors {
+			t.recover(componentErrorReporting, t.recoverErrorReporting(ctx))
+		}
+
+		t.mu.Lock()
+		if len(t.degraded) == 0 {
+			t.recovering = false
+			t.mu.Unlock()
+			return
+		}
+		t.mu.Unlock()
+	}
+}
+
+// recover clears the degraded state of component if err is nil, or else
+// updates the reason it is degraded.
+func (t *Treatshelf) recover(component string, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if err != nil {
+		t.degraded[component] = err
+		return
+	}
+	delete(t.degraded, component)
+	fmt.Fprintf(t.logWriter, "Recovered %s\n", component)
+}
+
+// recoverStorage creates the storage client if it is missing and checks the
+// buckets are usable.
+func (t *Treatshelf) recoverStorage(ctx context.Context) error {
+	t.mu.RLock()
+	haveClient := t.storageClient != nil
+	t.mu.RUnlock()
+
+	if !haveClient {
+		if err := t.newStorageClient(ctx); err != nil {
+			return err
+		}
+	}
+	return t.checkBuckets(ctx)
+}
+
+// storageReady connects to Cloud Storage on first use, waiting for it
+// until ctx is done at most. The connection carries on if ctx is done
+// first; until it succeeds, storage is degraded.
+func (t *Treatshelf) storageReady(ctx context.Context) error {
+	if t.connectStorage == nil {
+		return nil
+	}
+	err := t.storageInit.wait(ctx, func() error {
+		err := t.newStorageClient(context.Background())
+		if err != nil {
+			t.degrade(componentStorage, err)
+		}
+		return err
+	})
+	if err != nil && err == ctx.Err() {
+		return fmt.Errorf("still connecting to Cloud Storage: %v", err)
+	}
+	return err
+}
+
+// newStorageClient makes the storage client and bucket handles.
+func (t *Treatshelf) newStorageClient(ctx context.Context) error {
+	if t.connectStorage == nil {
+		return errors.New("no storage client")
+	}
+	c, err := t.connectStorage(ctx)
+	if err != nil {
+		return fmt.Errorf("storage.NewClient: %v", err)
+	}
+	t.mu.Lock()
+	t.storageClient = c
+	t.setBucketsLocked(t.buckets)
+	t.mu.Unlock()
+	return nil
+}
+
+// recoverErrorReporting makes the Error Reporting client.
+func (t *Treatshelf) recoverErrorReporting(ctx context.Context) error {
+	if t.connectErrors == nil {
+		return errors.New("no Error Reporting client")
+	}
+	c, err := t.connectErrors(ctx)
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	t.errorClient = c
+	t.mu.Unlock()
+	return nil
+}
+
+// pictureBucket returns the bucket for uploaded pictures and its name, or
+// an error if storage is degraded.
+func (t *Treatshelf) pictureBucket() (*storage.BucketHandle, string, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	if err, ok := t.degraded[componentStorage]; ok {
+		return nil, "", fmt.Errorf("picture uploads are unavailable while storage is degraded: %v", err)
+	}
+	if t.StorageBucket == nil {
+		return nil, "", errors.New("picture uploads are unavailable: no storage bucket")
+	}
+	return t.StorageBucket, t.StorageBucketName, nil
+}
+
+// thumbnailBucket returns the bucket for thumbnails of uploaded pictures
+// and its name, or an error if storage is degraded.
+func (t *Treatshelf) thumbnailBucket() (*storage.BucketHandle, string, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	if err, ok := t.degraded[componentStorage]; ok {
+		return nil, "", fmt.Errorf("thumbnails are unavailable while storage is degraded: %v", err)
+	}
+	if t.ThumbnailBucket == nil {
+		return nil, "", errors.New("thumbnails are unavailable: no thumbnail bucket")
+	}
+	return t.ThumbnailBucket, t.ThumbnailBucketName, nil
+}
+
+// backupBucket returns the bucket holding exports and cold storage, see
+// coldstorage.go. It may be the public picture bucket, so write to it with
+// privateWriter.
+func (t *Treatshelf) backupBucket() (*storage.BucketHandle, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	if err, ok := t.degraded[componentStorage]; ok {
+		return nil, fmt.Errorf("cold storage is unavailable while storage is degraded: %v", err)
+	}
+	if t.BackupBucket == nil {
+		return nil, errors.New("cold storage is unavailable: no backup bucket")
+	}
+	return t.BackupBucket, nil
+}
+
+// privateWriter returns a writer of obj that only the project can read,
+// whatever the ACL of its bucket.
+func privateWriter(ctx context.Context, obj *storage.ObjectHandle) *storage.Writer {
+	w := obj.NewWriter(ctx)
+	w.PredefinedACL = "projectPrivate"
+	return w
+}
+
+// errorReporter returns the ErrorReporter, or nil if Error Reporting is
+// unavailable. The first call starts connecting to it in the background,
+// without waiting: errors are only logged until it has.
+func (t *Treatshelf) errorReporter() ErrorReporter {
+	if t.connectErrors != nil {
+		t.errorsInit.start(func() error {
+			err := t.recoverErrorReporting(context.Background())
+			if err != nil {
+				t.degrade(componentErrorReporting, err)
+			}
+			return err
+		})
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.errorClient
+}
+
+// healthzHandler reports whether the app is healthy. It responds 200 even
+// when degraded, since the app can still serve requests; the body says
+// which components are unavailable.
+func (t *Treatshelf) healthzHandler(w http.ResponseWriter, r *http.Request) *appError {
+	status := struct {
+		Status   string   `json:"status"`
+		Degraded []string `json:"degraded,omitempty"`
+
+		// ErrorReportsDropped counts server errors that were logged but
+		// not sent to Error Reporting because its queue was full.
+		ErrorReportsDropped int64 `json:"errorReportsDropped,omitempty"`
+	}{
+		Status:              "ok",
+		Degraded:            t.degradedComponents(),
+		ErrorReportsDropped: t.droppedErrorReports(),
+	}
+	if len(status.Degraded) > 0 {
+		status.Status = "degraded"
+	}
+	writeJSON(w, http.StatusOK, status)
+	return nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+const (
+	idempotencyKeyHeader = "Idempotency-Key"
+
+	// idempotencyTTL is how long responses are kept for replay.
+	idempotencyTTL = 24 * time.Hour
+
+	// maxIdempotencyKeyLen bounds the keys clients may send.
+	maxIdempotencyKeyLen = 255
+)
+
+// IdempotentRequest records a write made with an Idempotency-Key header and,
+// once it has completed, the response to replay for retries.
+type IdempotentRequest struct {
+	Key string
+
+	// Fingerprint identifies the request, so that a key reused for a
+	// different request can be rejected.
+	Fingerprint string
+
+	// Status is the response status code, or 0 while the request is in flight.
+	Status      int
+	ContentType string
+	Location    string
+	Body        []byte
+
+	ExpiresAt time.Time
+}
+
+// IdempotencyDatabase stores IdempotentRequests. It must be shared by every
+// instance serving the API.
+type IdempotencyDatabase interface {
+	// ReserveIdempotencyKey stores req unless an unexpired request with the
+	// same key exists, in which case that request is returned instead.
+	ReserveIdempotencyKey(ctx context.Context, req *IdempotentRequest) (*IdempotentRequest, error)
+
+	// CompleteIdempotencyKey stores the response recorded in req.
+	CompleteIdempotencyKey(ctx context.Context, req *IdempotentRequest) error
+
+	// ReleaseIdempotencyKey forgets the request stored under key, so that it
+	// can be retried.
+	ReleaseIdempotencyKey(ctx context.Context, key string) error
+}
+
+// fingerprint hashes the parts of a request that make it the same request.
+func fingerprint(r *http.Request, body []byte) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s %s\n", r.Method, r.URL.RequestURI())
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// responseRecorder captures the response written by a handler while passing
+// it through to the client.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *responseRecorder) WriteHeader(code int) {
+	rec.status = code
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+// idempotent wraps a write handler so that requests carrying an
+// Idempotency-Key header are performed at most once. Retries with the same
+// key replay the original response; reusing a key for a different request
+// is rejected. Keys are scoped to the signed-in user.
+func (t *Treatshelf) idempotent(h http.Handler) appHandler {
+	return func(w http.ResponseWriter, r *http.Request) *appError {
+		key := r.Header.Get(idempotencyKeyHeader)
+		if key == "" || t.Idempotency == nil {
+			h.ServeHTTP(w, r)
+			return nil
+		}
+		if len(key) > maxIdempotencyKeyLen {
+			err := fmt.Errorf("%s must be at most %d characters", idempotencyKeyHeader, maxIdempotencyKeyLen)
+			return t.appErrorCodef(r, http.StatusBadRequest, err, "%v", err)
+		}
+
+		ctx := r.Context()
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return t.appErrorCodef(r, http.StatusBadRequest, err, "could not read request: %v", err)
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		req := &IdempotentRequest{
+			Key:         t.currentUser(r) + ":" + key,
+			Fingerprint: fingerprint(r, body),
+			ExpiresAt:   t.now().Add(idempotencyTTL),
+		}
+		prev, err := t.Idempotency.ReserveIdempotencyKey(ctx, req)
+		if err != nil {
+			return t.appErrorf(r, err, "could not reserve idempotency key: %v", err)
+		}
+		if prev != nil {
+			switch {
+			case prev.Fingerprint != req.Fingerprint:
+				err := errors.New("idempotency key was already used for a different request")
+				return t.appErrorCodef(r, http.StatusUnprocessableEntity, err, "%v", err).withProblemType("idempotency-key-reused")
+			case prev.Status == 0:
+				err := errors.New("a request with this idempotency key is still in progress")
+				return t.appErrorCodef(r, http.StatusConflict, err, "%v", err).withProblemType("idempotency-key-in-progress")
+			}
+			if prev.ContentType != "" {
+				w.Header().Set("Content-Type", prev.ContentType)
+			}
+			if prev.Location != "" {
+				w.Header().Set("Location", prev.Location)
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(prev.Status)
+			w.Write(prev.Body)
+			return nil
+		}
+
+		rec := &responseRecorder{ResponseWriter: w}
+		h.ServeHTTP(rec, r)
+
+		// Server errors may succeed on retry, so don't hold on to them.
+		if rec.status == 0 || rec.status >= 500 {
+			if err := t.Idempotency.ReleaseIdempotencyKey(ctx, req.Key); err != nil {
+				fmt.Fprintf(t.logWriter, "Could not release idempotency key: %v\n", err)
+			}
+			return nil
+		}
+		req.Status = rec.status
+		req.ContentType = rec.Header().Get("Content-Type")
+		req.Location = rec.Header().Get("Location")
+		req.Body = rec.body.Bytes()
+		if err := t.Idempotency.CompleteIdempotencyKey(ctx, req); err != nil {
+			fmt.Fprintf(t.logWriter, "Could not store idempotent response: %v\n", err)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/gofrs/uuid"
+)
+
+// IDGenerator makes the IDs of new records, and the names of uploaded
+// pictures. Kind is what the ID is for, such as "treats" or "pictures":
+// generators that count, like sequenceIDs, count each kind apart.
+//
+// Set ID_FORMAT=ulid to make IDs that sort by when they were made, in
+// Firestore and in picture names. Otherwise Firestore names its documents,
+// and pictures are named by random UUIDs. The memoryDB numbers records
+// from 1, for tests.
+//
+// Secrets such as undo tokens and session IDs don't come from an
+// IDGenerator: they must be random whatever the ID format.
+type IDGenerator interface {
+	NewID(kind string) string
+}
+
+// idGeneratorFromEnv returns the IDGenerator for the given ID_FORMAT, or
+// nil for the default.
+func idGeneratorFromEnv(format string, clock Clock) (IDGenerator, error) {
+	switch format {
+	case "":
+		return nil, nil
+	case "uuid":
+		return uuidIDs{}, nil
+	case "ulid":
+		return newULIDs(clock), nil
+	}
+	return nil, fmt.Errorf("unknown ID format %q: want uuid or ulid", format)
+}
+
+// uuidIDs makes random (version 4) UUIDs.
+type uuidIDs struct{}
+
+func (uuidIDs) NewID(string) string {
+	return uuid.Must(uuid.NewV4()).String()
+}
+
+// ulidIDs makes ULIDs (https://github.com/ulid/spec): a millisecond
+// timestamp then 80 random bits, as 26 characters of Crockford's base32.
+// IDs made by one ulidIDs sort in the order they were made, even within a
+// millisecond, where the random part of each is one more than the last's.
+type ulidIDs struct {
+	clock Clock
+
+	mu   sync.Mutex
+	last [16]byte // the last ULID made.
+}
+
+func newULIDs(clock Clock) *ulidIDs {
+	return &ulidIDs{clock: clock}
+}
+
+// crockford is Crockford's base32 alphabet, in which ULIDs are written.
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+func (g *ulidIDs) NewID(string) string {
+	ms := uint64(g.clock.Now().UnixNano() / 1e6)
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var id [16]byte
+	binary.BigEndian.PutUint64(id[:8], ms<<16)
+	if ms == binary.BigEndian.Uint64(g.last[:8])>>16 {
+		copy(id[6:], g.last[6:])
+		for i := 15; i >= 6; i-- {
+			if id[i]++; id[i] != 0 {
+				break
+			}
+		}
+	} else if _, err := rand.Read(id[6:]); err != nil {
+		panic(fmt.Sprintf("ulidIDs: could not read random bits: %v", err))
+	}
+	g.last = id
+	return encodeULID(id)
+}
+
+// encodeULID writes the 128 bits of id as 26 base32 characters, the first
+// holding only the top 3 bits.
+func encodeULID(id [16]byte) string {
+	hi, lo := binary.BigEndian.Uint64(id[:8]), binary.BigEndian.Uint64(id[8:])
+	var b [26]byte
+	for i := 25; i >= 0; i-- {
+		b[i] = crockford[lo&31]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(b[:])
+}
+
+// sequenceIDs numbers each kind of record from 1, so that tests know the
+// IDs they will get.
+type sequenceIDs struct {
+	mu   sync.Mutex
+	last map[string]int64 // maps from kind to the last ID given.
+}
+
+func newSequenceIDs() *sequenceIDs {
+	return &sequenceIDs{last: make(map[string]int64)}
+}
+
+func (g *sequenceIDs) NewID(kind string) string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.last[kind]++
+	return strconv.FormatInt(g.last[kind], 10)
+}
+
+// reset numbers every kind from 1 again, see testhooks.go.
+func (g *sequenceIDs) reset() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.last = make(map[string]int64)
+}
+
+// newID returns a new ID of the given kind from t's IDGenerator, or a
+// random UUID if it has none.
+func (t *Treatshelf) newID(kind string) string {
+	if t.ids == nil {
+		return uuidIDs{}.NewID(kind)
+	}
+	return t.ids.NewID(kind)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestULIDs(t *testing.T) {
+	clock := newFakeClock()
+	g := newULIDs(clock)
+	var ids []string
+	for i := 0; i < 100; i++ {
+		// Several IDs a millisecond, then the clock moves on.
+		if i%7 == 0 {
+			clock.Advance(time.Millisecond)
+		}
+		id := g.NewID("treats")
+		if len(id) != 26 || strings.Trim(id, crockford) != "" {
+			t.Fatalf("NewID() = %q, not a ULID", id)
+		}
+		ids = append(ids, id)
+	}
+	if !sort.StringsAreSorted(ids) {
+		t.Errorf("ULIDs made in order don't sort in order: %q", ids)
+	}
+	for i := 1; i < len(ids); i++ {
+		if ids[i] == ids[i-1] {
+			t.Fatalf("NewID() made %q twice", ids[i])
+		}
+	}
+	// The first 10 characters are the time in milliseconds,
+	// 2024-03-14T12:00:00.001Z.
+	if got, want := ids[0][:10], "01HRYDAQG1"; got != want {
+		t.Errorf("ULID made at %v starts %s, want %s", testEpoch.Add(time.Millisecond), got, want)
+	}
+}
+
+func TestEncodeULID(t *testing.T) {
+	var max [16]byte
+	for i := range max {
+		max[i] = 0xff
+	}
+	for _, tt := range []struct {
+		id   [16]byte
+		want string
+	}{
+		{[16]byte{}, "00000000000000000000000000"},
+		{max, "7ZZZZZZZZZZZZZZZZZZZZZZZZZ"},
+		{[16]byte{15: 1}, "00000000000000000000000001"},
+		{[16]byte{15: 32}, "00000000000000000000000010"},
+	} {
+		if got := encodeULID(tt.id); got != tt.want {
+			t.Errorf("encodeULID(%x) = %s, want %s", tt.id, got, tt.want)
+		}
+	}
+}
+
+func TestSequenceIDs(t *testing.T) {
+	g := newSequenceIDs()
+	for _, tt := range []struct{ kind, want string }{
+		{"treats", "1"},
+		{"treats", "2"},
+		{"locations", "1"},
+		{"treats", "3"},
+	} {
+		if got := g.NewID(tt.kind); got != tt.want {
+			t.Errorf("NewID(%q) = %q, want %q", tt.kind, got, tt.want)
+		}
+	}
+	g.reset()
+	if got := g.NewID("treats"); got != "1" {
+		t.Errorf("NewID after reset = %q, want 1", got)
+	}
+}
+
+func TestIDGeneratorFromEnv(t *testing.T) {
+	for _, format := range []string{"", "uuid", "ulid"} {
+		if _, err := idGeneratorFromEnv(format, systemClock{}); err != nil {
+			t.Errorf("ID_FORMAT=%s: %v", format, err)
+		}
+	}
+	if _, err := idGeneratorFromEnv("serial", systemClock{}); err == nil {
+		t.Error("ID_FORMAT=serial: no error")
+	}
+}
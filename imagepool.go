@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"image"
+	"io"
+	"sync/atomic"
+)
+
+// Decoding a picture takes memory in proportion to its pixels whatever
+// the size of its file: a 12 megapixel photo decodes to about 48 MB, and
+// a small PNG may claim to be far larger. So that a burst of uploads can't
+// run a small instance out of memory, pictures are processed by an
+// imagePool, which processes at most IMAGE_WORKERS at once and refuses
+// those that would take more than IMAGE_MEMORY_MB to decode. Pictures
+// beyond that wait, up to imageQueuePerWorker for each worker, until their
+// request's context is done; more are refused with errImagesBusy.
+//
+// Pictures that are refused are still stored, without a thumbnail, as
+// when their format can't be decoded.
+
+const (
+	// defaultImageWorkers is how many pictures are processed at once
+	// unless IMAGE_WORKERS is set.
+	defaultImageWorkers = 2
+	// defaultImageMemory is the most bytes a picture may take to decode
+	// unless IMAGE_MEMORY_MB is set: 32 megapixels.
+	defaultImageMemory = 128 << 20
+	// imageQueuePerWorker is how many pictures may wait for each worker.
+	imageQueuePerWorker = 4
+	// decodedBytesPerPixel is what a decoded pixel takes at most, as RGBA.
+	// 16-bit PNGs take twice that, but are rare among photos.
+	decodedBytesPerPixel = 4
+)
+
+// errImagesBusy is returned for pictures refused because too many are
+// waiting already.
+var errImagesBusy = errors.New("too many pictures are being processed: try again shortly")
+
+// imagesRefused counts pictures refused by imagePools, by reason.
+var imagesRefused = expvar.NewMap("imagesRefused")
+
+// imageTooLargeError is returned for pictures that would take more than
+// an imagePool's memory budget to decode.
+type imageTooLargeError struct {
+	width, height int
+	budget        int64
+}
+
+func (e imageTooLargeError) Error() string {
+	return fmt.Sprintf("%dx%d picture is too large to process: it would take more than %d MB", e.width, e.height, e.budget>>20)
+}
+
+// imagePool bounds the pictures processed at once, and the memory each
+// takes. A nil imagePool doesn't.
+type imagePool struct {
+	slots   chan struct{} // holds a value for each picture being processed.
+	budget  int64         // the most bytes a picture may take to decode.
+	pending int32         // pictures being processed or waiting, atomically.
+	max     int32         // the most pictures that may be pending.
+}
+
+func newImagePool(workers int, budget int64) *imagePool {
+	return &imagePool{
+		slots:  make(chan struct{}, workers),
+		budget: budget,
+		max:    int32(workers * (1 + imageQueuePerWorker)),
+	}
+}
+
+// thumbnail makes a thumbnail of the picture in r with makeThumbnail,
+// once the pool has room for it.
+func (p *imagePool) thumbnail(ctx context.Context, r io.ReadSeeker) ([]byte, error) {
+	return p.process(ctx, r, makeThumbnail)
+}
+
+// process calls f with the picture in r once the pool has room for it.
+func (p *imagePool) process(ctx context.Context, r io.ReadSeeker, f func(io.Reader) ([]byte, error)) ([]byte, error) {
+	if p == nil {
+		return f(r)
+	}
+	if err := p.check(r); err != nil {
+		return nil, err
+	}
+	release, err := p.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return f(r)
+}
+
+// check returns an imageTooLargeError if the picture in r would take more
+// than p's budget to decode, reading only its header, and rewinds r.
+func (p *imagePool) check(r io.ReadSeeker) error {
+	cfg, _, err := image.DecodeConfig(r)
+	if err != nil {
+		return err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if int64(cfg.Width)*int64(cfg.Height)*decodedBytesPerPixel > p.budget {
+		imagesRefused.Add("tooLarge", 1)
+		return imageTooLargeError{width: cfg.Width, height: cfg.Height, budget: p.budget}
+	}
+	return nil
+}
+
+// acquire waits for a worker until ctx is done, and returns a func to
+// release it. It returns errImagesBusy at once if the queue is full.
+func (p *imagePool) acquire(ctx context.Context) (release func(), err error) {
+	if atomic.AddInt32(&p.pending, 1) > p.max {
+		atomic.AddInt32(&p.pending, -1)
+		imagesRefused.Add("busy", 1)
+		return nil, errImagesBusy
+	}
+	select {
+	case p.slots <- struct{}{}:
+		return func() {
+			<-p.slots
+			atomic.AddInt32(&p.pending, -1)
+		}, nil
+	case <-ctx.Done():
+		atomic.AddInt32(&p.pending, -1)
+		imagesRefused.Add("timeout", 1)
+		return nil, fmt.Errorf("waited too long to process picture: %v", ctx.Err())
+	}
+}
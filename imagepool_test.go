@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/png"
+	"testing"
+)
+
+// testPNG returns a w by h PNG.
+func testPNG(t *testing.T, w, h int) []byte {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, w, h))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestImagePoolBudget(t *testing.T) {
+	ctx := context.Background()
+	pic := testPNG(t, 300, 200)
+	p := newImagePool(1, 300*200*decodedBytesPerPixel)
+	if _, err := p.thumbnail(ctx, bytes.NewReader(pic)); err != nil {
+		t.Errorf("picture within budget: %v", err)
+	}
+
+	p = newImagePool(1, 300*200*decodedBytesPerPixel-1)
+	_, err := p.thumbnail(ctx, bytes.NewReader(pic))
+	if _, ok := err.(imageTooLargeError); !ok {
+		t.Errorf("picture over budget: got %v, want an imageTooLargeError", err)
+	}
+}
+
+func TestImagePoolQueue(t *testing.T) {
+	p := newImagePool(1, defaultImageMemory)
+	release, err := p.acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Pictures wait for the worker until their context is done.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := p.acquire(ctx); err == nil || err == errImagesBusy {
+		t.Errorf("acquire with the worker busy and ctx done: got %v, want ctx's error", err)
+	}
+
+	// Once the queue is full, they are refused at once.
+	p.max = 1
+	if _, err := p.acquire(context.Background()); err != errImagesBusy {
+		t.Errorf("acquire with the queue full: got %v, want errImagesBusy", err)
+	}
+
+	release()
+	release, err = p.acquire(context.Background())
+	if err != nil {
+		t.Errorf("acquire after release: %v", err)
+	} else {
+		release()
+	}
+	if p.pending != 0 {
+		t.Errorf("%d pictures pending after releasing them all, want 0", p.pending)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Admins can view the app as another user, to debug what that user can
+// see and do. While they do, currentUser is that user, every page carries
+// a banner with a button to stop (see base.html), and nothing can be
+// changed. Each impersonation is recorded in the security log, as a
+// sign-in of the user by the admin, and ends by itself after
+// impersonationDuration.
+
+const (
+	// impersonationCookie remembers whom an admin is viewing the app as.
+	impersonationCookie = "treatshelf_view_as"
+
+	// impersonationDuration bounds how long an impersonation lasts.
+	impersonationDuration = time.Hour
+
+	// impersonationMethod is the SignIn.Method of impersonations.
+	impersonationMethod = "impersonation"
+)
+
+// impersonation is what impersonationCookie holds.
+type impersonation struct {
+	Admin   string    `json:"admin"`
+	User    string    `json:"user"`
+	Expires time.Time `json:"exp"`
+}
+
+// impersonationBy returns the impersonation in effect for r, made by the
+// authenticated user admin, or nil if there is none. Impersonations only
+// apply while admin is still an admin, and never to API requests.
+func (t *Treatshelf) impersonationBy(r *http.Request, admin string) *impersonation {
+	if !t.adminEmail(r, admin) || tokenFrom(r) != nil {
+		return nil
+	}
+	var v impersonation
+	if _, err := t.signedCookie(r, impersonationCookie, &v); err != nil {
+		return nil
+	}
+	if v.Admin != admin || v.User == "" || t.now().After(v.Expires) {
+		return nil
+	}
+	return &v
+}
+
+// impersonating returns the impersonation in effect for r, or nil.
+func (t *Treatshelf) impersonating(r *http.Request) *impersonation {
+	return t.impersonationBy(r, t.authenticatedUser(r))
+}
+
+// impersonateHandler starts viewing the app as the user in the "user" form
+// value.
+func (t *Treatshelf) impersonateHandler(w http.ResponseWriter, r *http.Request) *appError {
+	admin := t.authenticatedUser(r)
+	user := strings.ToLower(strings.TrimSpace(r.FormValue("user")))
+	if !strings.Contains(user, "@") || user == admin {
+		err := fmt.Errorf("can't view the app as %q: enter another user's email address", user)
+		return t.appErrorCodef(r, http.StatusBadRequest, err, "%v", err)
+	}
+	v := impersonation{Admin: admin, User: user, Expires: t.now().Add(impersonationDuration)}
+	if err := t.setSignedCookie(w, impersonationCookie, v, impersonationDuration); err != nil {
+		return t.appErrorf(r, err, "could not set cookie: %v", err)
+	}
+	fmt.Fprintf(t.logWriter, "%s is viewing the app as %s\n", admin, user)
+	if t.SignIns != nil {
+		now := t.now()
+		err := t.SignIns.AddSignIn(r.Context(), &SignIn{
+			User:      user,
+			By:        admin,
+			Method:    impersonationMethod,
+			IP:        remoteIP(r),
+			UserAgent: r.UserAgent(),
+			OK:        true,
+			At:        now,
+			ExpiresAt: now.Add(signInKeep),
+		})
+		if err != nil {
+			// Don't impersonate without a record of it.
+			http.SetCookie(w, &http.Cookie{Name: impersonationCookie, Path: "/", MaxAge: -1})
+			return t.appErrorf(r, err, "could not record impersonation: %v", err)
+		}
+	}
+	setFlash(w, &flash{Message: fmt.Sprintf("You are viewing the app as %s.", user)})
+	http.Redirect(w, r, t.routeURL("treats"), http.StatusFound)
+	return nil
+}
+
+// stopImpersonatingHandler goes back to viewing the app as oneself. It needs
+// no permission: it only clears a cookie.
+func (t *Treatshelf) stopImpersonatingHandler(w http.ResponseWriter, r *http.Request) *appError {
+	next := t.routeURL("treats")
+	if v := t.impersonating(r); v != nil {
+		fmt.Fprintf(t.logWriter, "%s stopped viewing the app as %s\n", v.Admin, v.User)
+		setFlash(w, &flash{Message: fmt.Sprintf("Stopped viewing the app as %s.", v.User)})
+		next = t.routeURL("securityLog")
+	}
+	http.SetCookie(w, &http.Cookie{Name: impersonationCookie, Path: "/", MaxAge: -1})
+	http.Redirect(w, r, next, http.StatusFound)
+	return nil
+}
+
+// impersonationReadOnly is middleware that rejects changes made while
+// impersonating, other than stopping or signing out.
+func (t *Treatshelf) impersonationReadOnly(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET", "HEAD", "OPTIONS":
+			h.ServeHTTP(w, r)
+			return
+		}
+		if r.URL.Path == t.routeURL("stopImpersonating") || r.URL.Path == t.routeURL("logout") {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if v := t.impersonating(r); v != nil {
+			err := errors.New("you are viewing the app as " + v.User + ": stop to make changes")
+			serveError(w, r, t.appErrorCodef(r, http.StatusForbidden, err, "%v", err))
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// Treats can be created by dropping files into the inbox/ folder of a
+// bucket (INBOX_BUCKET): a picture, then a JSON sidecar naming it,
+//
+//	inbox/brownie.jpg
+//	inbox/brownie.json  {"Title": "Brownie", "Quantity": 12, "Image": "brownie.jpg"}
+//
+// The bucket notifies a Pub/Sub topic, whose push subscription posts to
+// /integrations/gcs-inbox with the INBOX_PUSH_TOKEN, which may name a
+// secret, see secrets.go:
+//
+//	gsutil notification create -t treat-inbox -f json -e OBJECT_FINALIZE -p inbox/ gs://BUCKET
+//	gcloud pubsub subscriptions create treat-inbox-push --topic treat-inbox \
+//	    --push-endpoint 'https://APP/integrations/gcs-inbox?token=TOKEN'
+//
+// Each sidecar creates a treat, with the picture uploaded as if through the
+// form, and both files move to processed/. A sidecar that can't become a
+// treat moves to quarantine/ with its picture and a .error.txt saying why.
+// Pub/Sub retries failures on our side, such as the database being down,
+// and sidecars whose picture hasn't arrived yet, for up to inboxImageWait.
+// Pub/Sub delivers at least once, so a sidecar's treat has an ID derived
+// from the sidecar, and redeliveries don't create it twice.
+
+const (
+	// inboxPrefix, processedPrefix and quarantinePrefix are the folders of
+	// the inbox bucket files move through.
+	inboxPrefix      = "inbox/"
+	processedPrefix  = "processed/"
+	quarantinePrefix = "quarantine/"
+
+	// maxSidecarBytes and maxInboxImageBytes bound the files read.
+	maxSidecarBytes    = 64 << 10
+	maxInboxImageBytes = 32 << 20
+
+	// inboxImageWait is how long after its sidecar a picture may arrive.
+	inboxImageWait = 10 * time.Minute
+)
+
+// pushEnvelope is the body of a Pub/Sub push request.
+type pushEnvelope struct {
+	Message struct {
+		Attributes  map[string]string
+		PublishTime time.Time
+	}
+}
+
+// inboxSidecar is the JSON file describing a treat in the inbox. Image
+// names the picture, in the same folder.
+type inboxSidecar struct {
+	Treat
+	Image string
+}
+
+// quarantineError is a problem with the files dropped into the inbox,
+// which retrying won't fix.
+type quarantineError struct{ error }
+
+var (
+	// errImageNotArrived is returned while a sidecar's picture is missing.
+	errImageNotArrived = errors.New("the picture has not arrived yet")
+	// errSidecarGone is returned for sidecars an earlier delivery of the
+	// notification moved out of the inbox.
+	errSidecarGone = errors.New("the sidecar has been handled already")
+)
+
+// requireInbox returns a 404 appError unless the inbox is enabled. The
+// inbox route uses it through guard.
+func (t *Treatshelf) requireInbox(r *http.Request) *appError {
+	if t.inboxBucket == "" || t.inboxPushToken == "" {
+		err := errors.New("the Cloud Storage inbox is not enabled")
+		return t.appErrorCodef(r, http.StatusNotFound, err, "%v", err)
+	}
+	return nil
+}
+
+// inboxBucketHandle returns the inbox bucket, or an error if storage is
+// degraded.
+func (t *Treatshelf) inboxBucketHandle() (*storage.BucketHandle, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	if err, ok := t.degraded[componentStorage]; ok {
+		return nil, fmt.Errorf("the inbox is unavailable while storage is degraded: %v", err)
+	}
+	if t.storageClient == nil {
+		return nil, errors.New("the inbox is unavailable: no storage client")
+	}
+	return t.storageClient.Bucket(t.inboxBucket), nil
+}
+
+// parseInboxSidecar parses a sidecar, returning its treat and the name of
+// its picture, "" if none.
+func parseInboxSidecar(b []byte) (*Treat, string, error) {
+	s := &inboxSidecar{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(s); err != nil {
+		return nil, "", fmt.Errorf("invalid JSON: %v", err)
+	}
+	if s.Image != "" && (s.Image != path.Base(s.Image) || strings.HasPrefix(s.Image, ".")) {
+		return nil, "", fmt.Errorf("Image must name a file next to the sidecar, not %q", s.Image)
+	}
+	if s.ID != "" || s.ImageURL != "" || s.ThumbnailURL != "" {
+		return nil, "", errors.New("ID, ImageURL and ThumbnailURL are set by the inbox")
+	}
+	treat := &s.Treat
+	if err := checkAPITreat(treat); err != nil {
+		return nil, "", err
+	}
+	return treat, s.Image, nil
+}
+
+// inboxTreatID returns the ID of the treat created from the given version
+// of a sidecar.
+func inboxTreatID(object, generation string) string {
+	sum := sha256.Sum256([]byte(object + "#" + generation))
+	return "inbox-" + hex.EncodeToString(sum[:8])
+}
+
+// inboxHandler handles a Cloud Storage notification pushed by Pub/Sub. It
+// answers 2xx for anything Pub/Sub shouldn't retry.
+func (t *Treatshelf) inboxHandler(w http.ResponseWriter, r *http.Request) *appError {
+	ctx := r.Context()
+	token, err := t.secrets.resolve(ctx, t.inboxPushToken)
+	if err != nil {
+		return t.appErrorf(r, err, "could not read INBOX_PUSH_TOKEN: %v", err)
+	}
+	if subtle.ConstantTimeCompare([]byte(r.FormValue("token")), []byte(token)) != 1 {
+		err := errors.New("invalid push token")
+		return t.appErrorCodef(r, http.StatusUnauthorized, err, "%v", err)
+	}
+	env := &pushEnvelope{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxWebhookBytes)).Decode(env); err != nil {
+		return t.appErrorCodef(r, http.StatusBadRequest, err, "invalid push request: %v", err)
+	}
+	a := env.Message.Attributes
+	object := a["objectId"]
+	if a["eventType"] != "OBJECT_FINALIZE" || a["bucketId"] != t.inboxBucket ||
+		!strings.HasPrefix(object, inboxPrefix) || path.Ext(object) != ".json" {
+		// Pictures, and files moved out of the inbox, need nothing done.
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+
+	bucket, err := t.inboxBucketHandle()
+	if err != nil {
+		return t.appErrorCodef(r, http.StatusServiceUnavailable, err, "%v", err)
+	}
+	id := inboxTreatID(object, a["objectGeneration"])
+	image, err := t.ingestSidecar(ctx, bucket, object, id, env.Message.PublishTime)
+	q, quarantine := err.(quarantineError)
+	switch {
+	case err == errSidecarGone:
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	case err == errImageNotArrived:
+		return t.appErrorCodef(r, http.StatusServiceUnavailable, err, "%s: %v", object, err)
+	case quarantine:
+		fmt.Fprintf(t.logWriter, "Inbox: quarantining %s: %v\n", object, q.error)
+		if m, ok := q.error.(malwareError); ok {
+			t.recordMalware(r, "inbox", m)
+		}
+		if err := t.quarantineInbox(ctx, bucket, object, image, q.error); err != nil {
+			return t.appErrorf(r, err, "could not quarantine %s: %v", object, err)
+		}
+		writeJSON(w, http.StatusOK, struct{ Quarantined, Error string }{object, q.Error()})
+		return nil
+	case err != nil:
+		return t.appErrorf(r, err, "%s: %v", object, err)
+	}
+	for _, name := range []string{object, image} {
+		if err := moveObject(ctx, bucket, name, processedPrefix); err != nil {
+			return t.appErrorf(r, err, "%v", err)
+		}
+	}
+	fmt.Fprintf(t.logWriter, "Inbox: created treat %s from %s\n", id, object)
+	writeJSON(w, http.StatusOK, struct{ TreatID string }{id})
+	return nil
+}
+
+// ingestSidecar creates the treat with the given ID from a sidecar in the
+// inbox, which arrived at the given time, unless it exists already. It
+// returns the name of the sidecar's picture, if any.
+func (t *Treatshelf) ingestSidecar(ctx context.Context, bucket *storage.BucketHandle, object, id string, arrived time.Time) (string, error) {
+	b, _, err := readObject(ctx, bucket, object, maxSidecarBytes)
+	if err == storage.ErrObjectNotExist {
+		return "", errSidecarGone
+	}
+	if err != nil {
+		return "", err
+	}
+	treat, image, err := parseInboxSidecar(b)
+	if err != nil {
+		return "", quarantineError{err}
+	}
+	if image != "" {
+		image = path.Join(path.Dir(object), image)
+	}
+	olds, err := t.DB.GetTreats(ctx, []string{id})
+	if err != nil {
+		return image, fmt.Errorf("GetTreats: %v", err)
+	}
+	if olds[0] != nil {
+		return image, nil
+	}
+
+	if image != "" {
+		pic, contentType, err := readObject(ctx, bucket, image, maxInboxImageBytes)
+		switch {
+		case err == storage.ErrObjectNotExist && t.now().Sub(arrived) < inboxImageWait:
+			return image, errImageNotArrived
+		case err == storage.ErrObjectNotExist:
+			return image, quarantineError{fmt.Errorf("%s did not arrive within %v", image, inboxImageWait)}
+		case err != nil:
+			return image, err
+		case !strings.HasPrefix(contentType, "image/"):
+			return image, quarantineError{fmt.Errorf("%s is %q, not a picture", image, contentType)}
+		}
+		treat.ImageURL, err = t.uploadFile(ctx, bytes.NewReader(pic), image, contentType)
+		if _, ok := err.(malwareError); ok {
+			return image, quarantineError{err}
+		}
+		if err != nil {
+			return image, err
+		}
+		// The picture is usable without a thumbnail, as with uploads.
+		thumb, err := t.images.thumbnail(ctx, bytes.NewReader(pic))
+		if err == nil {
+			treat.ThumbnailURL, err = t.uploadThumbnail(ctx, treat.ImageURL, thumb)
+		}
+		if err != nil {
+			fmt.Fprintf(t.logWriter, "No thumbnail for %q: %v\n", image, err)
+		}
+	}
+	treat.ID = id
+	treat.CreatedBy = "inbox"
+	if err := t.DB.UpdateTreat(ctx, treat); err != nil {
+		return image, fmt.Errorf("UpdateTreat: %v", err)
+	}
+	return image, nil
+}
+
+// readObject reads an object of at most max bytes, returning it and its
+// content type.
+func readObject(ctx context.Context, bucket *storage.BucketHandle, name string, max int64) ([]byte, string, error) {
+	rd, err := bucket.Object(name).NewReader(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rd.Close()
+	if rd.Attrs.Size > max {
+		return nil, "", quarantineError{fmt.Errorf("%s is larger than %d bytes", name, max)}
+	}
+	b, err := ioutil.ReadAll(rd)
+	if err != nil {
+		return nil, "", fmt.Errorf("could not read %s: %v", name, err)
+	}
+	return b, rd.Attrs.ContentType, nil
+}
+
+// moveObject moves the named object from the inbox to the folder with the
+// given prefix. Objects that are gone already, or "", are skipped.
+func moveObject(ctx context.Context, bucket *storage.BucketHandle, name, prefix string) error {
+	if name == "" {
+		return nil
+	}
+	src := bucket.Object(name)
+	dst := bucket.Object(prefix + strings.TrimPrefix(name, inboxPrefix))
+	if _, err := dst.CopierFrom(src).Run(ctx); err != nil {
+		if err == storage.ErrObjectNotExist {
+			return nil
+		}
+		return fmt.Errorf("could not move %s to %s: %v", name, prefix, err)
+	}
+	if err := src.Delete(ctx); err != nil && err != storage.ErrObjectNotExist {
+		return fmt.Errorf("could not delete %s: %v", name, err)
+	}
+	return nil
+}
+
+// quarantineInbox moves a sidecar and its picture to quarantine/, next to
+// a .error.txt file holding cause.
+func (t *Treatshelf) quarantineInbox(ctx context.Context, bucket *storage.BucketHandle, object, image string, cause error) error {
+	name := quarantinePrefix + strings.TrimPrefix(strings.TrimSuffix(object, ".json"), inboxPrefix) + ".error.txt"
+	w := bucket.Object(name).NewWriter(ctx)
+	w.ContentType = "text/plain; charset=utf-8"
+	fmt.Fprintf(w, "%s: %v\n", object, cause)
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("could not write %s: %v", name, err)
+	}
+	for _, n := range []string{object, image} {
+		if err := moveObject(ctx, bucket, n, quarantinePrefix); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cookies the app must be able to trust, the login, OAuth state and
+// session cookies, are signed by a Keyring. Its keys are configured with
+// SIGNING_KEYS, which may name a secret (see secrets.go). Values name the
+// key that signed them, and any key in the ring verifies them, so keys can
+// be rotated without signing anyone out:
+//
+//  1. Add the new key to the end of SIGNING_KEYS. Wait for every instance
+//     to load it (keyringRefresh, or a deploy).
+//  2. Move it to the front, making it the primary key. Cookies signed with
+//     another key are signed again with the primary key when next seen.
+//  3. To re-issue every cookie, whichever key signed it, press Re-issue at
+//     /admin/keys.
+//  4. Remove the old key once loginDuration has passed. /admin/keys shows
+//     how often each key still verifies cookies.
+//
+// Other values aren't signed: flash messages only reach the browser that
+// set them, idempotency keys are chosen by clients, undo tokens are random
+// and checked against the database, and sameOrigin stops cross-site
+// requests without tokens.
+
+// keyringRefresh is how often instances reload their keys and the
+// KeyringConfig.
+const keyringRefresh = time.Minute
+
+// signedVersion starts signed values.
+const signedVersion = "v1"
+
+// signingKeyUses counts the values each key verified on this instance,
+// shown at /admin/keys. Served at /debug/vars.
+var signingKeyUses = expvar.NewMap("signingKeyUses")
+
+// keyIDPattern matches valid key IDs, which must not contain the separator
+// of signed values.
+var keyIDPattern = regexp.MustCompile(`^[A-Za-z0-9_\-]+$`)
+
+// signingKey is a key in a Keyring.
+type signingKey struct {
+	ID     string
+	secret []byte
+}
+
+// KeyringConfig controls re-issuance. It is shared by every instance
+// through a KeyringConfigStore.
+type KeyringConfig struct {
+	// ReissueBefore re-issues values signed before it when they are next
+	// seen.
+	ReissueBefore time.Time
+}
+
+// KeyringConfigStore persists the KeyringConfig.
+type KeyringConfigStore interface {
+	GetKeyringConfig(ctx context.Context) (KeyringConfig, error)
+	SetKeyringConfig(ctx context.Context, c KeyringConfig) error
+}
+
+// Keyring signs and verifies values with HMAC-SHA256. The first key is the
+// primary one, which signs; every key verifies.
+type Keyring struct {
+	// source is the configured SIGNING_KEYS, reloaded through secrets if
+	// it names a secret.
+	source  string
+	secrets *secretCache
+
+	mu     sync.RWMutex
+	keys   []signingKey
+	loaded string
+	config KeyringConfig
+}
+
+// parseKeyPairs parses comma-separated ID:KEY pairs, where KEY is
+// base64-encoded, returning the IDs in order.
+func parseKeyPairs(s string) ([]string, map[string][]byte, error) {
+	var ids []string
+	keys := make(map[string][]byte)
+	for _, pair := range strings.Split(s, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), ":", 2)
+		if len(parts) != 2 || !keyIDPattern.MatchString(parts[0]) {
+			return nil, nil, fmt.Errorf("invalid key %q, want ID:KEY with an ID of letters, digits, _ and -", pair)
+		}
+		key, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			return nil, nil, fmt.Errorf("key %q is not base64-encoded", parts[0])
+		}
+		if _, ok := keys[parts[0]]; ok {
+			return nil, nil, fmt.Errorf("duplicate key %q", parts[0])
+		}
+		ids = append(ids, parts[0])
+		keys[parts[0]] = key
+	}
+	return ids, keys, nil
+}
+
+// parseSigningKeys parses SIGNING_KEYS: comma-separated ID:KEY pairs,
+// where KEY is at least 32 base64-encoded bytes. The first is the primary
+// key.
+func parseSigningKeys(s string) ([]signingKey, error) {
+	ids, secrets, err := parseKeyPairs(s)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]signingKey, len(ids))
+	for i, id := range ids {
+		if len(secrets[id]) < 32 {
+			return nil, fmt.Errorf("key %q must be at least 32 bytes", id)
+		}
+		keys[i] = signingKey{ID: id, secret: secrets[id]}
+	}
+	return keys, nil
+}
+
+// newKeyring returns a Keyring with the given keys, the first primary.
+func newKeyring(keys ...signingKey) *Keyring {
+	return &Keyring{keys: keys}
+}
+
+// randomKeyring returns a Keyring with a random key. Values it signs can't
+// be verified by other instances, or after a restart.
+func randomKeyring() *Keyring {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err)
+	}
+	return newKeyring(signingKey{ID: "random", secret: secret})
+}
+
+// loadKeyring returns a Keyring with the keys in source, as configured
+// with SIGNING_KEYS, which may name a secret.
+func loadKeyring(ctx context.Context, source string, secrets *secretCache) (*Keyring, error) {
+	k := &Keyring{source: source, secrets: secrets}
+	if err := k.reload(ctx); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// reload parses the keys in k.source again, if they changed.
+func (k *Keyring) reload(ctx context.Context) error {
+	if k.source == "" {
+		return nil
+	}
+	s, err := k.secrets.resolve(ctx, k.source)
+	if err != nil {
+		return err
+	}
+	k.mu.RLock()
+	changed := s != k.loaded
+	k.mu.RUnlock()
+	if !changed {
+		return nil
+	}
+	keys, err := parseSigningKeys(s)
+	if err != nil {
+		return err
+	}
+	k.mu.Lock()
+	k.keys, k.loaded = keys, s
+	k.mu.Unlock()
+	return nil
+}
+
+// refresh reloads the keys and the KeyringConfig from store, if not nil,
+// every keyringRefresh on clock until ctx is done.
+func (k *Keyring) refresh(ctx context.Context, store KeyringConfigStore, clock Clock, log io.Writer) {
+	for {
+		if err := k.reload(ctx); err != nil {
+			fmt.Fprintf(log, "Could not reload signing keys: %v\n", err)
+		}
+		if store != nil {
+			if c, err := store.GetKeyringConfig(ctx); err != nil {
+				fmt.Fprintf(log, "Could not load keyring config: %v\n", err)
+			} else {
+				k.setConfig(c)
+			}
+		}
+		select {
+		case <-clock.After(keyringRefresh):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// setConfig applies c on this instance.
+func (k *Keyring) setConfig(c KeyringConfig) {
+	k.mu.Lock()
+	k.config = c
+	k.mu.Unlock()
+}
+
+// Config returns the current configuration.
+func (k *Keyring) Config() KeyringConfig {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.config
+}
+
+// KeyIDs returns the IDs of the keys, the primary first.
+func (k *Keyring) KeyIDs() []string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	ids := make([]string, len(k.keys))
+	for i, key := range k.keys {
+		ids[i] = key.ID
+	}
+	return ids
+}
+
+// mac returns the HMAC of a signed value's fields under key. The purpose,
+// such as the name of a cookie, is included so that a value signed for one
+// purpose can't be used for another.
+func mac(key []byte, purpose, fields string) []byte {
+	m := hmac.New(sha256.New, key)
+	io.WriteString(m, purpose)
+	m.Write([]byte{0})
+	io.WriteString(m, fields)
+	return m.Sum(nil)
+}
+
+// Sign returns v signed for purpose with the primary key, along with the
+// key's ID and now, which should be on the clock KeyringConfig.ReissueBefore
+// is set by.
+func (k *Keyring) Sign(purpose string, v []byte, now time.Time) string {
+	k.mu.RLock()
+	key := k.keys[0]
+	k.mu.RUnlock()
+	fields := strings.Join([]string{
+		signedVersion,
+		key.ID,
+		strconv.FormatInt(now.Unix(), 36),
+		base64.RawURLEncoding.EncodeToString(v),
+	}, ".")
+	return fields + "." + base64.RawURLEncoding.EncodeToString(mac(key.secret, purpose, fields))
+}
+
+// Verify returns the value s holds if it was signed for purpose by a key in
+// the ring. Stale values, signed by a key other than the primary one or
+// before KeyringConfig.ReissueBefore, should be signed again.
+func (k *Keyring) Verify(purpose, s string) (v []byte, stale bool, err error) {
+	parts := strings.Split(s, ".")
+	if len(parts) != 5 || parts[0] != signedVersion {
+		return nil, false, errors.New("not signed")
+	}
+	k.mu.RLock()
+	var key *signingKey
+	for i := range k.keys {
+		if k.keys[i].ID == parts[1] {
+			key = &k.keys[i]
+			break
+		}
+	}
+	primary := len(k.keys) > 0 && k.keys[0].ID == parts[1]
+	reissueBefore := k.config.ReissueBefore
+	k.mu.RUnlock()
+	if key == nil {
+		return nil, false, fmt.Errorf("unknown key %q", parts[1])
+	}
+	sum, err := base64.RawURLEncoding.DecodeString(parts[4])
+	if err != nil {
+		return nil, false, err
+	}
+	if !hmac.Equal(sum, mac(key.secret, purpose, strings.Join(parts[:4], "."))) {
+		return nil, false, errors.New("bad signature")
+	}
+	issued, err := strconv.ParseInt(parts[2], 36, 64)
+	if err != nil {
+		return nil, false, err
+	}
+	if v, err = base64.RawURLEncoding.DecodeString(parts[3]); err != nil {
+		return nil, false, err
+	}
+	signingKeyUses.Add(key.ID, 1)
+	stale = !primary || time.Unix(issued, 0).Before(reissueBefore)
+	return v, stale, nil
+}
+
+// reissueCookies is middleware that signs the login and session cookies
+// again with the primary key when they are stale, see Keyring.Verify.
+func (t *Treatshelf) reissueCookies(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var l login
+		if stale, err := t.signedCookie(r, loginCookie, &l); err == nil && stale {
+			if left := l.Expires.Sub(t.now()); left > 0 {
+				t.setSignedCookie(w, loginCookie, l, left)
+			}
+		}
+		var s session
+		if stale, err := t.signedCookie(r, sessionCookie, &s); err == nil && stale && s.ID != "" {
+			t.saveSession(w, &s)
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// signingKeysHandler shows the signing keys and how often each was used on
+// this instance, with the re-issue form.
+func (t *Treatshelf) signingKeysHandler(w http.ResponseWriter, r *http.Request) *appError {
+	type keyUse struct {
+		ID      string
+		Primary bool
+		Uses    string
+	}
+	var keys []keyUse
+	for i, id := range t.keyring.KeyIDs() {
+		uses := "0"
+		if v := signingKeyUses.Get(id); v != nil {
+			uses = v.String()
+		}
+		keys = append(keys, keyUse{ID: id, Primary: i == 0, Uses: uses})
+	}
+	return keysTmpl.Execute(t, w, r, struct {
+		Keys          []keyUse
+		ReissueBefore time.Time
+		Shared        bool
+	}{keys, t.keyring.Config().ReissueBefore, t.keyringConfig != nil})
+}
+
+// reissueHandler re-issues every signed cookie, on every instance, when it
+// is next seen.
+func (t *Treatshelf) reissueHandler(w http.ResponseWriter, r *http.Request) *appError {
+	c := KeyringConfig{ReissueBefore: t.now()}
+	if t.keyringConfig != nil {
+		if err := t.keyringConfig.SetKeyringConfig(r.Context(), c); err != nil {
+			return t.appErrorf(r, err, "SetKeyringConfig: %v", err)
+		}
+	}
+	t.keyring.setConfig(c)
+	setFlash(w, &flash{Message: "Signed cookies will be re-issued with the primary key."})
+	http.Redirect(w, r, t.routeURL("signingKeys"), http.StatusFound)
+	return nil
+}
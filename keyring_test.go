@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testKey returns a signing key with the given ID and a secret made of b.
+func testKey(id string, b byte) signingKey {
+	return signingKey{ID: id, secret: bytes.Repeat([]byte{b}, 32)}
+}
+
+func TestParseSigningKeys(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+	short := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 31))
+	tests := []struct {
+		in      string
+		wantIDs []string
+		wantErr string
+	}{
+		{"a:" + key, []string{"a"}, ""},
+		{"new:" + key + ", old_1:" + key, []string{"new", "old_1"}, ""},
+		{"a:" + short, nil, "at least 32 bytes"},
+		{"a:not base64!", nil, "not base64-encoded"},
+		{"a.b:" + key, nil, "invalid key"},
+		{key, nil, "invalid key"},
+		{"a:" + key + ",a:" + key, nil, "duplicate key"},
+	}
+	for _, tt := range tests {
+		keys, err := parseSigningKeys(tt.in)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("parseSigningKeys(%q) = %v, want an error containing %q", tt.in, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseSigningKeys(%q): %v", tt.in, err)
+			continue
+		}
+		var ids []string
+		for _, k := range keys {
+			ids = append(ids, k.ID)
+		}
+		if strings.Join(ids, ",") != strings.Join(tt.wantIDs, ",") {
+			t.Errorf("parseSigningKeys(%q) IDs = %v, want %v", tt.in, ids, tt.wantIDs)
+		}
+	}
+}
+
+func TestKeyringVerify(t *testing.T) {
+	issued := testEpoch
+	signed := newKeyring(testKey("new", 1)).Sign("cookie", []byte("value"), issued)
+	byOld := newKeyring(testKey("old", 2)).Sign("cookie", []byte("value"), issued)
+	i := strings.LastIndex(signed, ".") + 1
+	flipped := "A"
+	if signed[i] == 'A' {
+		flipped = "B"
+	}
+	tampered := signed[:i] + flipped + signed[i+1:]
+
+	tests := []struct {
+		name          string
+		ring          *Keyring
+		reissueBefore time.Time
+		purpose       string
+		value         string
+		wantStale     bool
+		wantErr       string
+	}{
+		{"primary", newKeyring(testKey("new", 1), testKey("old", 2)), time.Time{}, "cookie", signed, false, ""},
+		{"non-primary", newKeyring(testKey("new", 1), testKey("old", 2)), time.Time{}, "cookie", byOld, true, ""},
+		{"issued before ReissueBefore", newKeyring(testKey("new", 1)), issued.Add(time.Second), "cookie", signed, true, ""},
+		{"issued at ReissueBefore", newKeyring(testKey("new", 1)), issued, "cookie", signed, false, ""},
+		{"wrong purpose", newKeyring(testKey("new", 1)), time.Time{}, "other", signed, false, "bad signature"},
+		{"unknown key", newKeyring(testKey("new", 1)), time.Time{}, "cookie", byOld, false, "unknown key"},
+		{"same ID, other secret", newKeyring(testKey("new", 3)), time.Time{}, "cookie", signed, false, "bad signature"},
+		{"tampered MAC", newKeyring(testKey("new", 1)), time.Time{}, "cookie", tampered, false, "bad signature"},
+		{"tampered value", newKeyring(testKey("new", 1)), time.Time{}, "cookie", strings.Replace(signed, base64.RawURLEncoding.EncodeToString([]byte("value")), base64.RawURLEncoding.EncodeToString([]byte("admin")), 1), false, "bad signature"},
+		{"not signed", newKeyring(testKey("new", 1)), time.Time{}, "cookie", "value", false, "not signed"},
+	}
+	for _, tt := range tests {
+		tt.ring.setConfig(KeyringConfig{ReissueBefore: tt.reissueBefore})
+		v, stale, err := tt.ring.Verify(tt.purpose, tt.value)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: Verify() = %v, want an error containing %q", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: Verify(): %v", tt.name, err)
+			continue
+		}
+		if string(v) != "value" || stale != tt.wantStale {
+			t.Errorf("%s: Verify() = %q, stale %v, want %q, stale %v", tt.name, v, stale, "value", tt.wantStale)
+		}
+	}
+}
+
+func TestReissueCookies(t *testing.T) {
+	tests := []struct {
+		name          string
+		signedBy      signingKey
+		reissueBefore time.Time
+		wantReissued  bool
+	}{
+		{"current", testKey("new", 1), time.Time{}, false},
+		{"rotated out", testKey("old", 2), time.Time{}, true},
+		{"before ReissueBefore", testKey("new", 1), testEpoch.Add(time.Second), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			shelf, _ := newTestShelf(t)
+			shelf.keyring = newKeyring(tt.signedBy)
+			w := httptest.NewRecorder()
+			if err := shelf.saveSession(w, &session{ID: "s1"}); err != nil {
+				t.Fatal(err)
+			}
+			cookie := w.Result().Cookies()[0]
+
+			shelf.keyring = newKeyring(testKey("new", 1), testKey("old", 2))
+			shelf.keyring.setConfig(KeyringConfig{ReissueBefore: tt.reissueBefore})
+			r := httptest.NewRequest("GET", "/", nil)
+			r.AddCookie(cookie)
+			w = httptest.NewRecorder()
+			shelf.reissueCookies(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})).ServeHTTP(w, r)
+
+			cookies := w.Result().Cookies()
+			if !tt.wantReissued {
+				if len(cookies) > 0 {
+					t.Errorf("re-issued %v, want nothing", cookies)
+				}
+				return
+			}
+			if len(cookies) != 1 || cookies[0].Name != sessionCookie {
+				t.Fatalf("set cookies %v, want the session re-issued", cookies)
+			}
+			if !strings.HasPrefix(cookies[0].Value, signedVersion+".new.") {
+				t.Errorf("re-issued %q, want it signed by the primary key", cookies[0].Value)
+			}
+			r = httptest.NewRequest("GET", "/", nil)
+			r.AddCookie(cookies[0])
+			if got := shelf.session(r).ID; got != "s1" {
+				t.Errorf("re-issued session ID = %q, want %q", got, "s1")
+			}
+		})
+	}
+}
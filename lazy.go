@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// initTimeout bounds how long startup waits for slow dependencies, such as
+// the metadata server when looking up credentials. Components that aren't
+// ready by then are degraded and retried in the background, see health.go.
+const initTimeout = 20 * time.Second
+
+// lazyInit runs an initialization once, on first use, in the background,
+// so that callers can stop waiting for it without cancelling it: clients
+// keep the context they are made with, so it must outlive the call.
+type lazyInit struct {
+	once sync.Once
+	done chan struct{}
+	err  error
+}
+
+// start runs init in the background unless it has been started already,
+// and returns a channel that is closed once it has returned.
+func (l *lazyInit) start(init func() error) <-chan struct{} {
+	l.once.Do(func() {
+		l.done = make(chan struct{})
+		go func() {
+			defer close(l.done)
+			l.err = init()
+		}()
+	})
+	return l.done
+}
+
+// wait starts init if need be, and returns its error once it has
+// returned, or ctx's error if ctx is done first.
+func (l *lazyInit) wait(ctx context.Context, init func() error) error {
+	select {
+	case <-l.start(init):
+		return l.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
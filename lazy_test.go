@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/errorreporting"
+	"cloud.google.com/go/storage"
+)
+
+// nopReporter is an ErrorReporter that drops what it's given.
+type nopReporter struct{}
+
+func (nopReporter) Report(errorreporting.Entry) {}
+func (nopReporter) Flush()                      {}
+
+func TestErrorReporterConnectsOnce(t *testing.T) {
+	var connects int32
+	release := make(chan struct{})
+	shelf := &Treatshelf{logWriter: ioutil.Discard}
+	shelf.connectErrors = func(context.Context) (ErrorReporter, error) {
+		atomic.AddInt32(&connects, 1)
+		<-release
+		return nopReporter{}, nil
+	}
+
+	// Nothing waits for the connection, so errors are only logged until
+	// it's made.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if r := shelf.errorReporter(); r != nil {
+				t.Errorf("errorReporter() = %v before connecting, want nil", r)
+			}
+		}()
+	}
+	wg.Wait()
+	close(release)
+	<-shelf.errorsInit.done
+
+	if r := shelf.errorReporter(); r == nil {
+		t.Error("errorReporter() = nil after connecting")
+	}
+	if n := atomic.LoadInt32(&connects); n != 1 {
+		t.Errorf("connected %d times, want 1", n)
+	}
+}
+
+func TestStorageReadyTimeout(t *testing.T) {
+	release := make(chan struct{})
+	shelf := &Treatshelf{logWriter: ioutil.Discard}
+	shelf.connectStorage = func(context.Context) (*storage.Client, error) {
+		<-release
+		return nil, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := shelf.storageReady(ctx); err == nil {
+		t.Fatal("storageReady returned nil while still connecting")
+	}
+
+	// The connection carries on after the caller gives up on it.
+	close(release)
+	if err := shelf.storageReady(context.Background()); err != nil {
+		t.Errorf("storageReady after connecting: %v", err)
+	}
+}
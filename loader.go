@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+)
+
+// treatLoader resolves treats by ID for a single request. Each treat is
+// fetched at most once, and the treats missing from a Load are fetched in
+// one GetTreats call, so that pages showing many treats (claims, favorites)
+// don't make a query per treat. Loaded treats are not refreshed, so don't
+// use it for treats the request changes.
+type treatLoader struct {
+	db TreatDatabase
+
+	mu     sync.Mutex
+	treats map[string]*Treat // nil for IDs that don't exist.
+}
+
+func newTreatLoader(db TreatDatabase) *treatLoader {
+	return &treatLoader{db: db, treats: make(map[string]*Treat)}
+}
+
+// Load returns the treats with the given IDs in order, nil for IDs that
+// don't exist.
+func (l *treatLoader) Load(ctx context.Context, ids []string) ([]*Treat, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var missing []string
+	seen := make(map[string]bool)
+	for _, id := range ids {
+		if _, ok := l.treats[id]; !ok && !seen[id] {
+			seen[id] = true
+			missing = append(missing, id)
+		}
+	}
+	if len(missing) > 0 {
+		treats, err := l.db.GetTreats(ctx, missing)
+		if err != nil {
+			return nil, err
+		}
+		for i, id := range missing {
+			l.treats[id] = treats[i]
+		}
+	}
+
+	treats := make([]*Treat, len(ids))
+	for i, id := range ids {
+		treats[i] = l.treats[id]
+	}
+	return treats, nil
+}
+
+// Prime records treats the request has already fetched, such as those
+// from ListTreats, so that Load doesn't fetch them again.
+func (l *treatLoader) Prime(treats ...*Treat) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, t := range treats {
+		l.treats[t.ID] = t
+	}
+}
+
+// loaderKey is the context key for a request's treatLoader.
+type loaderKey struct{}
+
+// withTreatLoader is mux middleware giving each request a treatLoader, see
+// loader.
+func (t *Treatshelf) withTreatLoader(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), loaderKey{}, newTreatLoader(t.DB))
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// loader returns the request's treatLoader, or a new one if ctx has none.
+func (t *Treatshelf) loader(ctx context.Context) *treatLoader {
+	if l, ok := ctx.Value(loaderKey{}).(*treatLoader); ok {
+		return l
+	}
+	return newTreatLoader(t.DB)
+}
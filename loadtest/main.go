@@ -0,0 +1,220 @@
+// Command loadtest seeds a Treatshelf with synthetic treats through the API
+// and then drives a mix of list, detail and create requests at a fixed rate,
+// reporting latency percentiles per endpoint:
+//
+//	go run ./loadtest -url http://localhost:8080 -seed 500 -rps 50 -duration 1m
+//
+// Run it against a test deployment: the treats it creates are not removed.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/cjnorman87/cloudTings/client"
+)
+
+var (
+	baseURL  = flag.String("url", "http://localhost:8080", "base URL of the Treatshelf")
+	seed     = flag.Int("seed", 100, "number of synthetic treats to create before the run")
+	rps      = flag.Float64("rps", 20, "requests per second to send")
+	duration = flag.Duration("duration", 30*time.Second, "how long to send requests for")
+	mix      = flag.String("mix", "list=6,detail=3,create=1", "relative weights of the list, detail and create endpoints")
+	workers  = flag.Int("workers", 50, "most requests in flight at once")
+)
+
+// op is an endpoint under test.
+type op struct {
+	name string
+	do   func(ctx context.Context, c *client.Client, ids []string) error
+}
+
+var ops = map[string]op{
+	"list": {"list", func(ctx context.Context, c *client.Client, _ []string) error {
+		_, err := c.ListTreats(ctx, &client.ListOptions{PageSize: 20}).Next()
+		return err
+	}},
+	"detail": {"detail", func(ctx context.Context, c *client.Client, ids []string) error {
+		if len(ids) == 0 {
+			return errors.New("no seeded treats")
+		}
+		_, err := c.GetTreat(ctx, ids[rand.Intn(len(ids))])
+		return err
+	}},
+	"create": {"create", func(ctx context.Context, c *client.Client, _ []string) error {
+		_, err := c.CreateTreat(ctx, syntheticTreat(rand.Int()))
+		return err
+	}},
+}
+
+func main() {
+	flag.Parse()
+	if *rps <= 0 || *workers <= 0 {
+		log.Fatal("-rps and -workers must be positive")
+	}
+	weighted, err := parseMix(*mix)
+	if err != nil {
+		log.Fatalf("-mix: %v", err)
+	}
+	// Retries would hide the latency and errors being measured.
+	c, err := client.New(*baseURL, client.WithRetryPolicy(client.RetryPolicy{MaxAttempts: 1}))
+	if err != nil {
+		log.Fatal(err)
+	}
+	ctx := context.Background()
+
+	log.Printf("Seeding %d treats", *seed)
+	ids := make([]string, 0, *seed)
+	for i := 0; i < *seed; i++ {
+		t, err := c.CreateTreat(ctx, syntheticTreat(i))
+		if err != nil {
+			log.Fatalf("Could not seed treat %d: %v", i, err)
+		}
+		ids = append(ids, t.ID)
+	}
+
+	log.Printf("Sending %g requests per second for %v", *rps, *duration)
+	results := run(ctx, c, ids, weighted)
+	report(results)
+}
+
+// parseMix parses "name=weight,..." into a slice holding each op weight
+// times, to pick from at random.
+func parseMix(s string) ([]op, error) {
+	var weighted []op
+	for _, part := range strings.Split(s, ",") {
+		kv := strings.SplitN(part, "=", 2)
+		o, ok := ops[kv[0]]
+		if !ok || len(kv) != 2 {
+			return nil, fmt.Errorf("want name=weight with name one of list, detail, create; got %q", part)
+		}
+		w, err := strconv.Atoi(kv[1])
+		if err != nil || w < 0 {
+			return nil, fmt.Errorf("invalid weight %q", kv[1])
+		}
+		for i := 0; i < w; i++ {
+			weighted = append(weighted, o)
+		}
+	}
+	if len(weighted) == 0 {
+		return nil, errors.New("no endpoints to test")
+	}
+	return weighted, nil
+}
+
+// syntheticTreat returns a plausible treat numbered n.
+func syntheticTreat(n int) *client.Treat {
+	flavors := []string{"Chocolate", "Lemon", "Carrot", "Coffee", "Ginger"}
+	kinds := []string{"cake", "cookies", "brownies", "muffins", "flapjacks"}
+	return &client.Treat{
+		Title:       fmt.Sprintf("%s %s #%d", flavors[n%len(flavors)], kinds[n/len(flavors)%len(kinds)], n),
+		Author:      "loadtest",
+		Description: "Created by the load test.",
+		Tags:        []string{"loadtest"},
+		Quantity:    client.Int(1 + n%12),
+		Price:       &client.Price{Amount: int64(100 + n%400), Currency: "GBP"},
+	}
+}
+
+// result is the outcome of one request.
+type result struct {
+	op      string
+	latency time.Duration
+	err     error
+}
+
+// run sends requests at *rps for *duration and returns their results.
+// Requests that can't start because *workers are busy are counted as
+// errors rather than delaying the schedule.
+func run(ctx context.Context, c *client.Client, ids []string, weighted []op) []result {
+	var (
+		mu      sync.Mutex
+		results []result
+		wg      sync.WaitGroup
+	)
+	record := func(r result) {
+		mu.Lock()
+		results = append(results, r)
+		mu.Unlock()
+	}
+	slots := make(chan struct{}, *workers)
+	tick := time.NewTicker(time.Duration(float64(time.Second) / *rps))
+	defer tick.Stop()
+	deadline := time.After(*duration)
+	for {
+		select {
+		case <-deadline:
+			wg.Wait()
+			return results
+		case <-tick.C:
+		}
+		o := weighted[rand.Intn(len(weighted))]
+		select {
+		case slots <- struct{}{}:
+		default:
+			record(result{op: o.name, err: errors.New("too many requests in flight")})
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer func() { <-slots; wg.Done() }()
+			start := time.Now()
+			err := o.do(ctx, c, ids)
+			record(result{op: o.name, latency: time.Since(start), err: err})
+		}()
+	}
+}
+
+// report prints request counts, errors and latency percentiles by endpoint.
+func report(results []result) {
+	byOp := make(map[string][]time.Duration)
+	errs := make(map[string]int)
+	firstErr := make(map[string]error)
+	for _, r := range results {
+		if r.err != nil {
+			if errs[r.op]++; firstErr[r.op] == nil {
+				firstErr[r.op] = r.err
+			}
+			continue
+		}
+		byOp[r.op] = append(byOp[r.op], r.latency)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "endpoint\tok\terrors\tp50\tp90\tp99\tmax\t")
+	for _, name := range []string{"list", "detail", "create"} {
+		l := byOp[name]
+		if len(l) == 0 && errs[name] == 0 {
+			continue
+		}
+		sort.Slice(l, func(i, j int) bool { return l[i] < l[j] })
+		fmt.Fprintf(w, "%s\t%d\t%d\t%v\t%v\t%v\t%v\t\n", name, len(l), errs[name],
+			percentile(l, 50), percentile(l, 90), percentile(l, 99), percentile(l, 100))
+	}
+	w.Flush()
+	for name, err := range firstErr {
+		fmt.Printf("First %s error: %v\n", name, err)
+	}
+}
+
+// percentile returns the pth percentile of sorted latencies.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := (len(sorted)*p + 99) / 100
+	if i < 1 {
+		i = 1
+	}
+	return sorted[i-1].Round(time.Microsecond)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Location is an office or kitchen with its own shelf of treats.
+type Location struct {
+	ID       string
+	Name     string
+	Address  string
+	Timezone string // IANA time zone name, e.g. "Europe/London".
+}
+
+// LocationDatabase provides thread-safe access to a database of locations.
+type LocationDatabase interface {
+	// ListLocations returns a list of Locations, ordered by name.
+	ListLocations(context.Context) ([]*Location, error)
+
+	// GetLocation retrieves a Location by its ID.
+	GetLocation(ctx context.Context, id string) (*Location, error)
+
+	// AddLocation saves a given Location, assigning it a new ID.
+	AddLocation(ctx context.Context, l *Location) (id string, err error)
+
+	// DeleteLocation removes a given Location by its ID.
+	DeleteLocation(ctx context.Context, id string) error
+}
+
+// allLocations is the location switcher value for showing every shelf.
+const allLocations = "all"
+
+// locationFromForm populates the fields of a Location from form values
+// (see templates/locations.html).
+func locationFromForm(r *http.Request) (*Location, error) {
+	l := &Location{
+		Name:     cleanLine(r.FormValue("name")),
+		Address:  strings.TrimSpace(r.FormValue("address")),
+		Timezone: strings.TrimSpace(r.FormValue("timezone")),
+	}
+	if l.Name == "" {
+		return nil, errors.New("location name is required")
+	}
+	if l.Timezone == "" {
+		l.Timezone = "UTC"
+	}
+	if _, err := time.LoadLocation(l.Timezone); err != nil {
+		return nil, fmt.Errorf("unknown time zone %q", l.Timezone)
+	}
+	return l, nil
+}
+
+// locationsHandler lists the locations, with a form to add one.
+func (t *Treatshelf) locationsHandler(w http.ResponseWriter, r *http.Request) *appError {
+	locations, err := t.Locations.ListLocations(r.Context())
+	if err != nil {
+		return t.appErrorf(r, err, "could not list locations: %v", err)
+	}
+	return locationsTmpl.Execute(t, w, r, struct {
+		Locations []*Location
+		Admin     bool
+	}{
+		Locations: locations,
+		Admin:     t.isAdmin(r),
+	})
+}
+
+// createLocationHandler adds a location. It is routed for admins only.
+func (t *Treatshelf) createLocationHandler(w http.ResponseWriter, r *http.Request) *appError {
+	l, err := locationFromForm(r)
+	if err != nil {
+		return t.appErrorf(r, err, "could not parse location from form: %v", err)
+	}
+	if _, err := t.Locations.AddLocation(r.Context(), l); err != nil {
+		return t.appErrorf(r, err, "could not save location: %v", err)
+	}
+	http.Redirect(w, r, t.routeURL("locations"), http.StatusFound)
+	return nil
+}
+
+// deleteLocationHandler deletes a location. It is routed for admins only.
+func (t *Treatshelf) deleteLocationHandler(w http.ResponseWriter, r *http.Request) *appError {
+	if err := t.Locations.DeleteLocation(r.Context(), mux.Vars(r)["id"]); err != nil {
+		return t.appErrorf(r, err, "DeleteLocation: %v", err)
+	}
+	http.Redirect(w, r, t.routeURL("locations"), http.StatusFound)
+	return nil
+}
+
+// selectLocationHandler remembers the location picked in the header switcher
+// and returns the user to the list.
+func (t *Treatshelf) selectLocationHandler(w http.ResponseWriter, r *http.Request) *appError {
+	s := t.session(r)
+	s.LocationID = r.FormValue("location")
+	if s.LocationID == allLocations {
+		s.LocationID = ""
+	}
+	if err := t.saveSession(w, s); err != nil {
+		return t.appErrorf(r, err, "could not save session: %v", err)
+	}
+	http.Redirect(w, r, t.routeURL("treats"), http.StatusFound)
+	return nil
+}
@@ -3,19 +3,22 @@ package main
 import (
 	"context"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
 	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
 
 	"cloud.google.com/go/errorreporting"
 	"cloud.google.com/go/firestore"
 	"cloud.google.com/go/storage"
-	"github.com/gofrs/uuid"
-	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 )
 
@@ -25,9 +28,44 @@ var (
 	editTmpl   = parseTemplate("edit.html")
 	aboutTmpl  = parseTemplate("about.html")
 	detailTmpl = parseTemplate("detail.html")
+
+	locationsTmpl = parseTemplate("locations.html")
+	settingsTmpl  = parseTemplate("settings.html")
+	tagsTmpl      = parseTemplate("tags.html")
+	dashboardTmpl = parseTemplate("dashboard.html")
+	sloTmpl       = parseTemplate("slo.html")
+
+	coldStorageTmpl = parseTemplate("coldstorage.html")
+	deadLettersTmpl = parseTemplate("deadletters.html")
+	dualWriteTmpl   = parseTemplate("dualwrite.html")
+	reviewTmpl      = parseTemplate("review.html")
+	operationsTmpl  = parseTemplate("operations.html")
+	webhooksTmpl    = parseTemplate("webhooks.html")
+	sheetsTmpl      = parseTemplate("sheets.html")
+
+	tokensTmpl     = parseTemplate("tokens.html")
+	loginTmpl      = parseTemplate("login.html")
+	profileTmpl    = parseTemplate("profile.html")
+	userExportTmpl = parseTemplate("userexport.html")
+	signInsTmpl    = parseTemplate("signins.html")
+	keysTmpl       = parseTemplate("keys.html")
+
+	errorTmpl   = parseTemplate("error.html")
+	offlineTmpl = parseTemplate("offline.html")
 )
 
 func main() {
+	flag.Parse()
+	// "asset-manifest" writes the asset manifest at build time, see
+	// assets.go.
+	if len(os.Args) == 2 && os.Args[1] == "asset-manifest" {
+		m, err := writeAssetManifest(staticDir)
+		if err != nil {
+			log.Fatalf("asset-manifest: %v", err)
+		}
+		log.Printf("Wrote the names of %d static files to %s", len(m), path.Join(staticDir, assetManifestFile))
+		return
+	}
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8080"
@@ -43,65 +81,810 @@ func main() {
 	if err != nil {
 		log.Fatalf("firestore.NewClient: %v", err)
 	}
-	db, err := newFirestoreDB(client)
+	db, err := newFirestoreDB(client, os.Getenv("FIRESTORE_PREFIX"), os.Getenv("FIRESTORE_COLLECTION"))
 	if err != nil {
 		log.Fatalf("newFirestoreDB: %v", err)
 	}
-	t, err := NewTreatshelf(projectID, db)
+	// New documents, and uploaded pictures, are named in the ID_FORMAT if
+	// it is set, see ids.go.
+	ids, err := idGeneratorFromEnv(os.Getenv("ID_FORMAT"), systemClock{})
+	if err != nil {
+		log.Fatalf("ID_FORMAT: %v", err)
+	}
+	db.ids = ids
+
+	// "copy-collection FROM TO" migrates treats between collections, see
+	// copyCollection.
+	if len(os.Args) == 4 && os.Args[1] == "copy-collection" {
+		n, err := db.copyCollection(ctx, os.Args[2], os.Args[3])
+		if err != nil {
+			log.Fatalf("Copied %d treats before failing: %v", n, err)
+		}
+		log.Printf("Copied %d treats from %q to %q", n, os.Args[2], os.Args[3])
+		return
+	}
+	// "replay-outbox SINCE" sends the notifications written since the given
+	// RFC 3339 time again, once the app dispatches the outbox.
+	if len(os.Args) == 3 && os.Args[1] == "replay-outbox" {
+		since, err := time.Parse(time.RFC3339, os.Args[2])
+		if err != nil {
+			log.Fatalf("replay-outbox: %v", err)
+		}
+		n, err := db.ReplayEvents(ctx, since)
+		if err != nil {
+			log.Fatalf("Replayed %d events before failing: %v", n, err)
+		}
+		log.Printf("Replayed %d events written since %v", n, since)
+		return
+	}
+	// Secret configuration values may name secrets in Secret Manager
+	// instead, see secrets.go.
+	secrets := newSecretCache(&secretManager{project: projectID}, systemClock{})
+	secretEnv := func(name string) string {
+		v, err := secrets.resolve(ctx, os.Getenv(name))
+		if err != nil {
+			log.Fatalf("%s: %v", name, err)
+		}
+		return v
+	}
+
+	// Pages may read from a replica in a nearer region, see consistency.go.
+	if p := os.Getenv("FIRESTORE_REPLICA_PROJECT"); p != "" {
+		replica, err := firestore.NewClient(ctx, p)
+		if err != nil {
+			log.Fatalf("firestore.NewClient (replica): %v", err)
+		}
+		db.replica = replica
+	}
+	// While migrating to another collection, write to both and shift reads
+	// over gradually, see dualwrite.go.
+	var treats TreatDatabase = db
+	var dual *dualDB
+	if c := os.Getenv("DUAL_WRITE_COLLECTION"); c != "" {
+		secondary, err := newFirestoreDB(client, os.Getenv("FIRESTORE_PREFIX"), c)
+		if err != nil {
+			log.Fatalf("newFirestoreDB (dual-write): %v", err)
+		}
+		secondary.ids = ids
+		dual = newDualDB(db, secondary, os.Stderr)
+		go dual.refreshConfig(ctx, db)
+		treats = dual
+	}
+	// Sensitive fields are encrypted with a key in Cloud KMS, or with local
+	// keys, see encryption.go.
+	var encrypted *encryptedDB
+	if k := os.Getenv("FIELD_ENCRYPTION_KMS_KEY"); k != "" {
+		encrypted = newEncryptedDB(treats, &kmsWrapper{key: k})
+	} else if s := secretEnv("FIELD_ENCRYPTION_KEYS"); s != "" {
+		keys, err := parseLocalKeys(s)
+		if err != nil {
+			log.Fatalf("FIELD_ENCRYPTION_KEYS: %v", err)
+		}
+		encrypted = newEncryptedDB(treats, keys)
+	}
+	if encrypted != nil {
+		treats = encrypted
+	}
+	// Outside production, database calls can be made to fail or slow down,
+	// see faults.go.
+	var faults *faultInjectingDB
+	if os.Getenv("FAULT_INJECTION") != "" {
+		faults = newFaultInjectingDB(treats)
+		treats = faults
+	}
+	// "reencrypt-fields" rewrites the sensitive fields of every treat under
+	// the primary key, after rotating keys or enabling encryption.
+	if len(os.Args) == 2 && os.Args[1] == "reencrypt-fields" {
+		if encrypted == nil {
+			log.Fatal("reencrypt-fields: set FIELD_ENCRYPTION_KMS_KEY or FIELD_ENCRYPTION_KEYS")
+		}
+		n, err := encrypted.reencrypt(ctx)
+		if err != nil {
+			log.Fatalf("Re-encrypted %d treats before failing: %v", n, err)
+		}
+		log.Printf("Re-encrypted %d treats", n)
+		return
+	}
+	// Don't let slow dependencies hold up startup, see lazy.go.
+	initCtx, cancelInit := context.WithTimeout(ctx, initTimeout)
+	defer cancelInit()
+	t, err := NewTreatshelf(initCtx, projectID, treats)
 	if err != nil {
 		log.Fatalf("NewTreatshelf: %v", err)
 	}
+	t.dual, t.dualConfig = dual, db
+	t.ids = ids
+	t.faults = faults
+	t.encrypted = encrypted
+	t.secrets = secrets
+
+	t.Locations = db
+	t.Preferences = db
+	t.Idempotency = db
+	t.Tokens = db
+	t.Profiles = db
+	t.SignIns = db
+	t.Reports = db
+	t.SavedSearches = db
+	t.Uploads = db
+	t.Operations = db
+	t.Stats = db
+	t.Deliveries = db
+	t.SheetSync = db
+	t.sheets = &googleSheets{}
+	t.Outbox = db
+	t.Locks = db
+	t.admins = parseAdmins(os.Getenv("ADMIN_EMAILS"))
+	t.iapAudience = os.Getenv("IAP_AUDIENCE")
+	t.trustIAPHeader = os.Getenv("TRUST_IAP_HEADER") == "true"
+	t.requireAPIToken = os.Getenv("REQUIRE_API_TOKEN") == "true"
+	t.optionalIfMatch = os.Getenv("REQUIRE_IF_MATCH") == "false"
+	t.moderation = os.Getenv("MODERATION") == "true"
+	t.collation = os.Getenv("COLLATION_LOCALE")
+	t.a11yAudit = os.Getenv("A11Y_AUDIT") == "true"
+	t.requireAltText = os.Getenv("REQUIRE_ALT_TEXT") == "true"
+	if s := os.Getenv("SEARCH_FUZZINESS"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			log.Fatalf("SEARCH_FUZZINESS must be a number of edits, not %q", s)
+		}
+		t.searchFuzziness = n
+	}
+	if s := os.Getenv("REPORT_HIDE_THRESHOLD"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			log.Fatalf("REPORT_HIDE_THRESHOLD must be a positive number of reports, not %q", s)
+		}
+		t.reportHideAt = n
+	}
+	if s := secretEnv("AUTH_PROVIDERS"); s != "" {
+		t.authProviders, err = parseAuthProviders(ctx, http.DefaultClient, s)
+		if err != nil {
+			log.Fatalf("AUTH_PROVIDERS: %v", err)
+		}
+	}
+	// SIGNING_KEYS sign cookies, see keyring.go. Without them, people are
+	// signed out and lose their sessions whenever the instance restarts,
+	// and between instances. A LOGIN_KEY, which signed the login cookie
+	// before, is used as the only key.
+	if keys := os.Getenv("SIGNING_KEYS"); keys != "" {
+		t.keyring, err = loadKeyring(ctx, keys, secrets)
+		if err != nil {
+			log.Fatalf("SIGNING_KEYS: %v", err)
+		}
+	} else if key := secretEnv("LOGIN_KEY"); len(key) >= 32 {
+		t.keyring = newKeyring(signingKey{ID: "login", secret: []byte(key)})
+	} else {
+		log.Print("SIGNING_KEYS is unset: signing cookies with a random key")
+	}
+	t.keyringConfig = db
+	go t.keyring.refresh(ctx, db, t.clock, os.Stderr)
+	if t.iapAudience == "" && !t.trustIAPHeader && len(t.authProviders) == 0 {
+		log.Print("None of IAP_AUDIENCE, TRUST_IAP_HEADER or AUTH_PROVIDERS is set: all requests are anonymous")
+	}
+	if url := secretEnv("NOTIFY_WEBHOOK_URL"); url != "" {
+		t.notifier = &webhookNotifier{url: url, client: http.DefaultClient}
+	}
+	if s := os.Getenv("ALERT_ERROR_RATE"); s != "" {
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil || f <= 0 || f > 1 {
+			log.Fatalf("ALERT_ERROR_RATE must be a fraction of requests such as 0.05, not %q", s)
+		}
+		t.alerts.ErrorRate = f
+	}
+	if s := os.Getenv("ALERT_P95_LATENCY"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || latencyBound(d) < 0 {
+			log.Fatalf("ALERT_P95_LATENCY must be one of %v, not %q", latencyBounds, s)
+		}
+		t.alerts.P95 = d
+	}
+	t.alerts.Cooldown = defaultAlertCooldown
+	if s := os.Getenv("ALERT_COOLDOWN"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d < 0 {
+			log.Fatalf("ALERT_COOLDOWN must be a duration such as 30m, not %q", s)
+		}
+		t.alerts.Cooldown = d
+	}
+	if t.alerts.ErrorRate > 0 || t.alerts.P95 > 0 {
+		t.requests = newRequestWindow(alertWindow, alertWindowBuckets)
+		go t.runAlerts(ctx)
+	}
+	if s := os.Getenv("SLOS"); s != "" {
+		slos, err := parseSLOs(s)
+		if err != nil {
+			log.Fatalf("SLOS: %v", err)
+		}
+		window := defaultSLOWindow
+		if s := os.Getenv("SLO_WINDOW"); s != "" {
+			window, err = time.ParseDuration(s)
+			if err != nil || window < time.Hour {
+				log.Fatalf("SLO_WINDOW must be a duration of an hour or more, such as 24h, not %q", s)
+			}
+		}
+		t.slos = newSLOTracker(slos, window)
+		t.sloBanner = os.Getenv("SLO_BANNER") == "true"
+		t.publishSLOs()
+	}
+	if s := os.Getenv("WEBHOOK_SECRETS"); s != "" {
+		t.webhookSecrets, err = parseWebhookSecrets(s)
+		if err != nil {
+			log.Fatalf("WEBHOOK_SECRETS: %v", err)
+		}
+	}
+	t.inboxBucket = os.Getenv("INBOX_BUCKET")
+	t.inboxPushToken = os.Getenv("INBOX_PUSH_TOKEN")
+	t.emailInToken = os.Getenv("EMAIL_IN_TOKEN")
+	t.slackSigningSecret = os.Getenv("SLACK_SIGNING_SECRET")
+	if s := os.Getenv("UNDO_WINDOW"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			log.Fatalf("UNDO_WINDOW: %v", err)
+		}
+		t.undoWindow = d
+	}
+	if s := os.Getenv("API_SUNSET"); s != "" {
+		d, err := time.Parse("2006-01-02", s)
+		if err != nil {
+			log.Fatalf("API_SUNSET must be a date such as 2027-06-30, not %q", s)
+		}
+		t.apiSunset = d
+	}
+	if s := os.Getenv("COLD_STORAGE_AFTER_YEARS"); s != "" {
+		years, err := strconv.Atoi(s)
+		if err != nil || years < 1 {
+			log.Fatalf("COLD_STORAGE_AFTER_YEARS must be a whole number of years, got %q", s)
+		}
+		t.coldAfter = time.Duration(years) * 365 * 24 * time.Hour
+	}
+	if p := strings.Trim(os.Getenv("BASE_PATH"), "/"); p != "" {
+		t.basePath = "/" + p
+	}
+	t.canonicalHostName = os.Getenv("CANONICAL_HOST")
+	if s := os.Getenv("REQUEST_TIMEOUT"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			log.Fatalf("REQUEST_TIMEOUT: %v", err)
+		}
+		t.requestTimeout = d
+	}
+	t.accessLog.Apache = os.Getenv("ACCESS_LOG_FORMAT") == "apache"
+	if s := os.Getenv("ACCESS_LOG_SAMPLE"); s != "" {
+		rate, err := strconv.ParseFloat(s, 64)
+		if err != nil || rate < 0 || rate > 1 {
+			log.Fatalf("ACCESS_LOG_SAMPLE must be a number between 0 and 1, got %q", s)
+		}
+		t.accessLog.SampleRate = rate
+	}
+	workers, budget := defaultImageWorkers, int64(defaultImageMemory)
+	if s := os.Getenv("IMAGE_WORKERS"); s != "" {
+		workers, err = strconv.Atoi(s)
+		if err != nil || workers < 1 {
+			log.Fatalf("IMAGE_WORKERS must be a positive number of pictures, not %q", s)
+		}
+	}
+	if s := os.Getenv("IMAGE_MEMORY_MB"); s != "" {
+		mb, err := strconv.Atoi(s)
+		if err != nil || mb < 1 {
+			log.Fatalf("IMAGE_MEMORY_MB must be a positive number of megabytes, not %q", s)
+		}
+		budget = int64(mb) << 20
+	}
+	t.images = newImagePool(workers, budget)
+	if s := os.Getenv("IMAGE_PRESETS"); s != "" {
+		t.imagePresets, err = parseImagePresets(s)
+		if err != nil {
+			log.Fatalf("IMAGE_PRESETS: %v", err)
+		}
+	}
+	if addr := os.Getenv("CLAMD_ADDRESS"); addr != "" {
+		t.scanner = clamdScanner{addr: addr}
+	}
+	if os.Getenv("DEV_BUNDLE") == "true" {
+		// Pages work without the bundles, so a failure isn't fatal.
+		if err := runBundler(ctx, os.Stderr); err != nil {
+			log.Printf("DEV_BUNDLE: %v", err)
+		}
+	}
+	if p := os.Getenv("CAPTCHA_PROVIDER"); p != "" {
+		// The secret is read when verifying, so that it can be rotated.
+		t.captcha, err = newCaptchaVerifier(p, os.Getenv("CAPTCHA_SITE_KEY"), os.Getenv("CAPTCHA_SECRET"), t.secrets, http.DefaultClient)
+		if err != nil {
+			log.Fatalf("CAPTCHA_PROVIDER: %v", err)
+		}
+	}
+	if key := secretEnv("GEOCODING_API_KEY"); key != "" {
+		t.geocoder = &mapsGeocoder{key: key, client: http.DefaultClient}
+	}
+
+	// Storage connects lazily, so an outage shows up here rather than in
+	// NewTreatshelf. Start without uploads and keep checking, see health.go.
+	t.setBuckets(bucketsFromEnv(projectID))
+	if err := t.checkBuckets(initCtx); err != nil {
+		t.degrade(componentStorage, err)
+	}
+	// Demos and end-to-end tests start from the seed data, see seed.go.
+	if *seedFlag {
+		n, err := t.seed(ctx, seedDir)
+		if err != nil {
+			log.Fatalf("-seed: %v", err)
+		}
+		log.Printf("Seeded %d treats from %s", n, seedDir)
+	}
+
+	// Keep derived state, such as /events, up to date with writes from
+	// every instance, see changes.go. With PUBSUB_TOPIC set, one instance
+	// watches and relays the changes to the others, see relay.go.
+	if topic := os.Getenv("PUBSUB_TOPIC"); topic != "" {
+		relay, err := newChangeRelay(ctx, projectID, topic, t.instance)
+		if err != nil {
+			log.Fatalf("newChangeRelay: %v", err)
+		}
+		go t.relayChanges(ctx, db, relay)
+	} else {
+		go t.watchChanges(ctx, db, t.changes.publish)
+	}
+	go t.runOutbox(ctx)
 
-	t.registerHandlers()
+	if os.Getenv("PROFILER") == "true" {
+		if err := startProfiler(projectID); err != nil {
+			log.Printf("Could not start profiler: %v", err)
+		}
+	}
 
-	log.Printf("Listening on localhost:%s", port)
-	if err := http.ListenAndServe(":"+port, nil); err != nil {
+	// Serve HTTPS directly if configured, see tls.go.
+	if err := tlsFromEnv().listenAndServe(port, t.Handler()); err != nil {
 		log.Fatal(err)
 	}
 }
 
-func (t *Treatshelf) registerHandlers() {
+// Handler returns the handler serving the app under t.basePath, for
+// serving directly or mounting in a larger service. It doesn't register
+// anything with http.DefaultServeMux.
+func (t *Treatshelf) Handler() http.Handler {
 	// Use gorilla/mux for rich routing.
 	// See https://www.gorillatoolkit.org/pkg/mux.
-	r := mux.NewRouter()
+	root := mux.NewRouter()
+	r := root
+	if t.basePath != "" {
+		root.Handle(t.basePath, http.RedirectHandler(t.url("/treats"), http.StatusFound)).Name("base")
+		r = root.PathPrefix(t.basePath).Subrouter()
+	}
 
-	r.Handle("/", http.RedirectHandler("/treats", http.StatusFound))
+	r.Handle("/", http.RedirectHandler(t.url("/treats"), http.StatusFound)).Name("home")
+	// Unrouted paths may be misspellings of routed ones, see canonical.go.
+	root.NotFoundHandler = appHandler(t.notFound)
 
+	// Caching policies are in cache.go.
+	noStore := withCache(cacheNoStore)
 	r.Methods("GET").Path("/treats").
-		Handler(appHandler(t.listHandler))
+		Handler(withCache(cacheList)(appHandler(t.listHandler))).Name("treats")
 	r.Methods("GET").Path("/treats/add").
-		Handler(appHandler(t.addFormHandler))
+		Handler(noStore(appHandler(t.addFormHandler))).Name("addTreat")
 	r.Methods("GET").Path("/about").
-		Handler(appHandler(t.addAboutHandler))
+		Handler(appHandler(t.addAboutHandler)).Name("about")
+	r.Methods("GET").Path("/offline").
+		Handler(appHandler(t.offlineHandler)).Name("offline")
+	// The web app manifest, service worker, icons and styles, see pwa.go
+	// and assets.go.
+	r.Methods("GET").PathPrefix("/static/").
+		Handler(withCache(cacheStatic)(t.staticHandler())).Name("static")
+	r.Methods("GET").Path("/images/{preset:[a-z]+}/{bucket}/{name:.+}").
+		Handler(withCache(cacheImages)(appHandler(t.imageHandler))).Name("image")
 	r.Methods("GET").Path("/treats/{id:[0-9a-zA-Z_\\-]+}").
-		Handler(appHandler(t.detailHandler))
+		Handler(appHandler(t.detailHandler)).Name("treat")
 	r.Methods("GET").Path("/treats/{id:[0-9a-zA-Z_\\-]+}/edit").
-		Handler(appHandler(t.editFormHandler))
+		Handler(noStore(strongReads(appHandler(t.editFormHandler)))).Name("editTreat")
 
 	r.Methods("POST").Path("/treats").
-		Handler(appHandler(t.createHandler))
-	r.Methods("POST", "PUT").Path("/treats/{id:[0-9a-zA-Z_\\-]+}").
-		Handler(appHandler(t.updateHandler))
+		Handler(appHandler(t.createHandler)).Name("createTreat")
+	r.Methods("PUT").Path("/treats/{id:[0-9a-zA-Z_\\-]+}").
+		Handler(appHandler(t.updateHandler)).Name("updateTreat")
+	r.Methods("DELETE").Path("/treats/{id:[0-9a-zA-Z_\\-]+}").
+		Handler(appHandler(t.deleteHandler)).Name("deleteTreat")
+	r.Methods("POST").Path("/treats:batchDelete").
+		Handler(appHandler(t.batchDeleteHandler)).Name("batchDelete")
+	r.Methods("POST").Path("/undo").
+		Handler(appHandler(t.undoHandler)).Name("undo")
+	r.Methods("POST").Path("/treats/{id:[0-9a-zA-Z_\\-]+}:increment").
+		Handler(appHandler(t.adjustQuantityHandler(1))).Name("incrementTreat")
+	r.Methods("POST").Path("/treats/{id:[0-9a-zA-Z_\\-]+}:decrement").
+		Handler(appHandler(t.adjustQuantityHandler(-1))).Name("decrementTreat")
+	r.Methods("POST").Path("/treats/{id:[0-9a-zA-Z_\\-]+}:claim").
+		Handler(appHandler(t.claimHandler)).Name("claimTreat")
+	r.Methods("POST").Path("/treats/{id:[0-9a-zA-Z_\\-]+}:report").
+		Handler(appHandler(t.reportHandler)).Name("reportTreat")
+	r.Methods("DELETE").Path("/treats/{id:[0-9a-zA-Z_\\-]+}/claims/{claimID:[0-9a-zA-Z_\\-]+}").
+		Handler(appHandler(t.releaseClaimHandler)).Name("releaseClaim")
+
+	r.Methods("GET").Path("/locations").
+		Handler(appHandler(t.locationsHandler)).Name("locations")
+	r.Methods("POST").Path("/locations").
+		Handler(appHandler(t.createLocationHandler)).Name("createLocation")
+	r.Methods("DELETE").Path("/locations/{id:[0-9a-zA-Z_\\-]+}").
+		Handler(appHandler(t.deleteLocationHandler)).Name("deleteLocation")
+	r.Methods("GET").Path("/settings").
+		Handler(noStore(appHandler(t.settingsHandler))).Name("settings")
+	r.Methods("POST").Path("/settings").
+		Handler(appHandler(t.saveSettingsHandler)).Name("saveSettings")
+	r.Methods("POST").Path("/settings/theme").
+		Handler(appHandler(t.toggleThemeHandler)).Name("toggleTheme")
+	tokens := r.PathPrefix("/settings/tokens").Subrouter()
+	tokens.Use(guard(t.requireTokens))
+	tokens.Methods("GET").Path("").
+		Handler(noStore(appHandler(t.tokensHandler))).Name("tokens")
+	tokens.Methods("POST").Path("").
+		Handler(noStore(appHandler(t.createTokenHandler))).Name("createToken")
+	tokens.Methods("DELETE").Path("/{id:[0-9a-zA-Z_\\-]+}").
+		Handler(appHandler(t.revokeTokenHandler)).Name("revokeToken")
+	shelves := r.PathPrefix("/shelves").Subrouter()
+	shelves.Use(guard(t.requireSavedSearches))
+	shelves.Methods("POST").Path("").
+		Handler(appHandler(t.saveShelfHandler)).Name("saveShelf")
+	shelves.Methods("GET").Path("/{id:[0-9a-zA-Z_\\-]+}").
+		Handler(appHandler(t.shelfHandler)).Name("shelf")
+	shelves.Methods("DELETE").Path("/{id:[0-9a-zA-Z_\\-]+}").
+		Handler(appHandler(t.deleteShelfHandler)).Name("deleteShelf")
+	account := r.PathPrefix("/settings").Subrouter()
+	account.Use(guard(t.requireProfiles))
+	account.Methods("GET").Path("/profile").
+		Handler(noStore(appHandler(t.profileHandler))).Name("profile")
+	account.Methods("POST").Path("/profile").
+		Handler(appHandler(t.saveProfileHandler)).Name("saveProfile")
+	account.Methods("DELETE").Path("/account").
+		Handler(appHandler(t.deleteAccountHandler)).Name("deleteAccount")
+	account.Methods("GET").Path("/export").
+		Handler(noStore(appHandler(t.exportPageHandler))).Name("userExport")
+	account.Methods("POST").Path("/export").
+		Handler(appHandler(t.startExportHandler)).Name("startUserExport")
+	account.Methods("GET").Path("/export/{name:[0-9TZ]+\\.zip}").
+		Handler(noStore(appHandler(t.downloadExportHandler))).Name("downloadUserExport")
+	account.Methods("GET").Path("/sign-ins").
+		Handler(noStore(appHandler(t.signInsHandler))).Name("signIns")
+	r.Methods("GET").Path("/login").
+		Handler(noStore(appHandler(t.loginHandler))).Name("login")
+	r.Methods("GET").Path("/login/{provider}").
+		Handler(noStore(appHandler(t.loginStartHandler))).Name("loginStart")
+	r.Methods("GET").Path("/login/{provider}/callback").
+		Handler(noStore(appHandler(t.loginCallbackHandler))).Name("loginCallback")
+	r.Methods("POST").Path("/logout").
+		Handler(appHandler(t.logoutHandler)).Name("logout")
+	r.Methods("POST").Path("/impersonate:stop").
+		Handler(appHandler(t.stopImpersonatingHandler)).Name("stopImpersonating")
+	r.Methods("POST").Path("/session/location").
+		Handler(appHandler(t.selectLocationHandler)).Name("selectLocation")
+	r.Methods("DELETE").Path("/session/recent").
+		Handler(appHandler(t.clearRecentHandler)).Name("clearRecent")
+
+	admin := r.PathPrefix("/admin").Subrouter()
+	stats := guard(t.requireStats)
+	admin.Methods("GET").Path("").
+		Handler(stats(appHandler(t.dashboardHandler))).Name("dashboard")
+	admin.Methods("GET").Path("/stats.csv").
+		Handler(stats(appHandler(t.statsCSVHandler))).Name("statsCSV")
+	admin.Methods("GET").Path("/slo").
+		Handler(guard(t.requireSLOs)(noStore(appHandler(t.sloHandler)))).Name("slo")
+	admin.Methods("GET").Path("/treats").
+		Handler(appHandler(t.allTreatsHandler)).Name("allTreats")
+	admin.Methods("GET").Path("/export.jsonl").
+		Handler(appHandler(t.exportHandler)).Name("export")
+	admin.Methods("GET").Path("/tags").
+		Handler(appHandler(t.tagsAdminHandler)).Name("tags")
+	admin.Methods("GET").Path("/tags.json").
+		Handler(appHandler(t.tagsJSONHandler)).Name("tagsJSON")
+	admin.Methods("POST").Path("/tags:rename").
+		Handler(appHandler(t.tagEditHandler("rename"))).Name("renameTags")
+	admin.Methods("POST").Path("/tags:merge").
+		Handler(appHandler(t.tagEditHandler("merge"))).Name("mergeTags")
+	admin.Methods("POST").Path("/tags:delete").
+		Handler(appHandler(t.tagEditHandler("delete"))).Name("deleteTags")
+	admin.Methods("GET").Path("/dead-letters").
+		Handler(appHandler(t.deadLettersHandler)).Name("deadLetters")
+	admin.Methods("POST").Path("/dead-letters/{id:[0-9a-zA-Z_\\-]+}:redrive").
+		Handler(appHandler(t.deadLetterActionHandler("redrive"))).Name("redriveDeadLetter")
+	admin.Methods("DELETE").Path("/dead-letters/{id:[0-9a-zA-Z_\\-]+}").
+		Handler(appHandler(t.deadLetterActionHandler("discard"))).Name("discardDeadLetter")
+	admin.Methods("GET", "POST").Path("/dual-write").
+		Handler(noStore(appHandler(t.dualWriteHandler))).Name("dualWrite")
+	admin.Methods("GET").Path("/security").
+		Handler(noStore(appHandler(t.securityLogHandler))).Name("securityLog")
+	admin.Methods("POST").Path("/impersonate").
+		Handler(appHandler(t.impersonateHandler)).Name("impersonate")
+	admin.Methods("GET").Path("/keys").
+		Handler(noStore(appHandler(t.signingKeysHandler))).Name("signingKeys")
+	admin.Methods("POST").Path("/keys:reissue").
+		Handler(appHandler(t.reissueHandler)).Name("reissueCookies")
+	admin.Methods("GET").Path("/cold-storage").
+		Handler(appHandler(t.coldStorageAdminHandler)).Name("coldStorage")
+	admin.Methods("POST").Path("/cold-storage/{name:[0-9A-Za-z_.\\-]+}:restore").
+		Handler(appHandler(t.coldRestoreHandler)).Name("coldRestore")
+	admin.Methods("GET").Path("/review").
+		Handler(noStore(appHandler(t.reviewQueueHandler))).Name("reviewQueue")
+	admin.Methods("POST").Path("/review/{id:[0-9a-zA-Z_\\-]+}:approve").
+		Handler(appHandler(t.reviewHandler(true))).Name("approveTreat")
+	admin.Methods("POST").Path("/review/{id:[0-9a-zA-Z_\\-]+}:reject").
+		Handler(appHandler(t.reviewHandler(false))).Name("rejectTreat")
+	admin.Methods("POST").Path("/reports/{id:[0-9a-zA-Z_\\-]+}:dismiss").
+		Handler(appHandler(t.dismissReportsHandler)).Name("dismissReports")
+	ops := guard(t.requireOperations)
+	admin.Methods("GET").Path("/operations").
+		Handler(ops(noStore(appHandler(t.operationsHandler)))).Name("operations")
+	admin.Methods("POST").Path("/operations").
+		Handler(ops(appHandler(t.startOperationHandler))).Name("startOperation")
+	admin.Methods("GET").Path("/webhooks").
+		Handler(guard(t.requireWebhooks)(noStore(appHandler(t.webhooksHandler)))).Name("webhooks")
+	sheetSync := guard(t.requireSheets)
+	admin.Methods("GET", "POST").Path("/sheets").
+		Handler(sheetSync(noStore(appHandler(t.sheetsHandler)))).Name("sheets")
+	admin.Methods("POST").Path("/sheets:sync").
+		Handler(sheetSync(appHandler(t.syncSheetHandler))).Name("syncSheet")
+
+	// Deprecated aliases of the routes above, from before HTML forms could
+	// send PUT and DELETE (see methodOverride).
+	r.Methods("POST").Path("/treats/{id:[0-9a-zA-Z_\\-]+}").
+		Handler(deprecated(appHandler(t.updateHandler))).Name("updateTreatPost")
 	r.Methods("POST").Path("/treats/{id:[0-9a-zA-Z_\\-]+}:delete").
-		Handler(appHandler(t.deleteHandler)).Name("delete")
+		Handler(deprecated(appHandler(t.deleteHandler))).Name("deleteTreatPost")
+	r.Methods("POST").Path("/treats/{id:[0-9a-zA-Z_\\-]+}/claims/{claimID:[0-9a-zA-Z_\\-]+}:release").
+		Handler(deprecated(appHandler(t.releaseClaimHandler))).Name("releaseClaimPost")
+	r.Methods("POST").Path("/locations/{id:[0-9a-zA-Z_\\-]+}:delete").
+		Handler(deprecated(appHandler(t.deleteLocationHandler))).Name("deleteLocationPost")
+	admin.Methods("POST").Path("/dead-letters/{id:[0-9a-zA-Z_\\-]+}:discard").
+		Handler(deprecated(appHandler(t.deadLetterActionHandler("discard")))).Name("discardDeadLetterPost")
+
+	t.registerAPIHandlers(r)
+
+	// Scheduled tasks, see cron.yaml.
+	tasks := r.PathPrefix("/tasks").Subrouter()
+	tasks.Use(t.oneRegion)
+	tasks.Methods("GET").Path("/archive-expired").
+		Handler(appHandler(t.archiveExpiredHandler)).Name("archiveExpiredTask")
+	tasks.Methods("GET").Path("/purge-deleted").
+		Handler(appHandler(t.purgeDeletedHandler)).Name("purgeDeletedTask")
+	tasks.Methods("GET").Path("/dispatch-outbox").
+		Handler(appHandler(t.dispatchOutboxHandler)).Name("dispatchOutboxTask")
+	tasks.Methods("GET").Path("/cold-storage").
+		Handler(appHandler(t.coldStorageHandler)).Name("coldStorageTask")
+	tasks.Methods("GET").Path("/sync-sheet").
+		Handler(guard(t.requireSheets)(appHandler(t.syncSheetTaskHandler))).Name("syncSheetTask")
+
+	// Inbound integrations, see webhooks.go, inbox.go, email.go and
+	// slack.go.
+	integrations := r.PathPrefix("/integrations").Subrouter()
+	integrations.Methods("POST").Path("/webhooks/{source:[0-9A-Za-z_\\-]+}").
+		Handler(guard(t.requireWebhooks)(appHandler(t.inboundWebhookHandler))).Name("inboundWebhook")
+	integrations.Methods("POST").Path("/gcs-inbox").
+		Handler(guard(t.requireInbox)(appHandler(t.inboxHandler))).Name("gcsInbox")
+	integrations.Methods("POST").Path("/email").
+		Handler(guard(t.requireEmailIn)(appHandler(t.emailInHandler))).Name("emailIn")
+	integrations.Methods("POST").Path("/slack/command").
+		Handler(guard(t.requireSlack)(appHandler(t.slackCommandHandler))).Name("slackCommand")
 
-	r.Methods("GET").Path("/logs").Handler(appHandler(t.sendLog))
-	r.Methods("GET").Path("/errors").Handler(appHandler(t.sendError))
+	r.Methods("GET").Path("/events").Handler(appHandler(t.eventsHandler)).Name("events")
+	r.Methods("GET").Path("/oembed").Handler(appHandler(t.oembedHandler)).Name("oembed")
+	r.Methods("GET").Path("/healthz").Handler(appHandler(t.healthzHandler)).Name("healthz")
+	// App Engine sends warmup requests to /_ah/ whatever the base path.
+	root.Methods("GET").Path("/_ah/warmup").Handler(appHandler(t.warmupHandler)).Name("warmup")
+	root.Methods("GET").Path("/favicon.ico").
+		Handler(withCache(cacheStatic)(http.HandlerFunc(t.faviconHandler))).Name("favicon")
+	r.Methods("GET").Path("/logs").Handler(appHandler(t.sendLog)).Name("logs")
+	r.Methods("GET").Path("/errors").Handler(appHandler(t.sendError)).Name("errors")
 
-	// Delegate all of the HTTP routing and serving to the gorilla/mux router.
-	// Log all requests using the standard Apache format.
-	http.Handle("/", handlers.CombinedLoggingHandler(t.logWriter, r))
+	t.registerDebugHandlers(r)
+
+	// Every route is named, so that handlers (t.routeURL) and templates
+	// (route) can link to them without hardcoding paths.
+	t.routes = root
+	setRoutes(root, t.basePath)
+	imagePresets.Store(t.presets())
+	staticAssets.Store(t.assets())
+
+	// Delegate all of the HTTP routing and serving to the gorilla/mux router,
+	// wrapped in the middleware every request needs (see middleware.go).
+	// The router is served directly rather than through
+	// http.DefaultServeMux, where net/http/pprof registers unguarded debug
+	// handlers.
+	// Who may use each route is in policy.go.
+	r.Use(recordRoute, t.countRequests, cacheDefaults, t.readConsistency, t.withTreatLoader, t.reissueCookies, t.impersonationReadOnly, t.authorize(routePolicy, allVersionsPolicy()))
+	mw := []Middleware{withSessionUsers, t.logRequests, t.recoverPanics, securityHeaders, t.canonicalHost, t.sameOrigin, t.methodOverride, withTimeout(t.requestTimeout)}
+	return chain(root, append(mw, t.middleware...)...)
 }
 
 // listHandler displays a list with summaries of treats in the database.
 func (t *Treatshelf) listHandler(w http.ResponseWriter, r *http.Request) *appError {
+	return t.showList(w, r, nil)
+}
+
+// showList renders the list page for the filters in r's query, those of
+// shelf if it isn't nil (see shelves.go).
+func (t *Treatshelf) showList(w http.ResponseWriter, r *http.Request, shelf *SavedSearch) *appError {
 	ctx := r.Context()
-	treats, err := t.DB.ListTreats(ctx)
+	prefs := t.preferences(r)
+	opts, err := t.listOptionsFromRequest(r, prefs)
+	if err != nil {
+		return t.appErrorf(r, err, "invalid list options: %v", err)
+	}
+	treats, err := t.DB.ListTreats(ctx, opts)
 	if err != nil {
 		return t.appErrorf(r, err, "could not list treats: %v", err)
 	}
 
-	return listTmpl.Execute(t, w, r, treats)
+	recent, err := t.recentTreats(ctx, r)
+	if err != nil {
+		return t.appErrorf(r, err, "could not get recently viewed treats: %v", err)
+	}
+
+	page, err := pageFromForm(r)
+	if err != nil {
+		return t.appErrorCodef(r, http.StatusBadRequest, err, "%v", err)
+	}
+	var prevURL, nextURL string
+	treats, more := pageOf(treats, page, prefs.PageSize)
+	if more {
+		nextURL = pageURL(r, page+1)
+	}
+	if page > 1 {
+		prevURL = pageURL(r, page-1)
+	}
+
+	return listTmpl.Execute(t, w, r, struct {
+		Treats     []*Treat
+		Recent     []*Treat
+		Options    ListOptions
+		Query      url.Values
+		Locale     string
+		Currencies []string
+		Admin      bool
+
+		// Shelf is the smart shelf being shown, if any. CanSave is
+		// whether the filters, SaveQuery, can be saved as one.
+		Shelf        *SavedSearch
+		CanSave      bool
+		SaveQuery    string
+		MaxShelfName int
+
+		PrevURL, NextURL string
+
+		// Now is the time on t's clock, which the template shows
+		// visibility and expiry at. It changes every request, so it is
+		// left out of the render key.
+		Now time.Time `json:"-"`
+	}{
+		Now:          t.now(),
+		Admin:        t.isAdmin(r),
+		Shelf:        shelf,
+		CanSave:      shelf == nil && t.SavedSearches != nil && t.currentUser(r) != "",
+		SaveQuery:    shelfQuery(r.URL.Query()),
+		MaxShelfName: maxShelfName,
+		Treats:       treats,
+		Recent:       recent,
+		Options:      opts,
+		Query:        r.URL.Query(),
+		Locale:       prefs.localeFor(r),
+		Currencies:   currencyCodes,
+		PrevURL:      prevURL,
+		NextURL:      nextURL,
+	})
+}
+
+// maxPage bounds the page parameter of list pages.
+const maxPage = 10000
+
+// pageFromForm parses the 1-based page parameter, which defaults to 1.
+func pageFromForm(r *http.Request) (int, error) {
+	page, err := intFromForm(r, "page")
+	if err != nil {
+		return 0, err
+	}
+	if page > maxPage {
+		return 0, fmt.Errorf("page must be at most %d", maxPage)
+	}
+	if page == 0 {
+		page = 1
+	}
+	return page, nil
+}
+
+// pageOf returns the given 1-based page of treats and whether there are
+// more pages after it.
+func pageOf(treats []*Treat, page, size int) ([]*Treat, bool) {
+	if page < 1 || size < 1 || page-1 >= (len(treats)+size-1)/size {
+		return nil, false
+	}
+	start := (page - 1) * size
+	if end := start + size; end < len(treats) {
+		return treats[start:end], true
+	}
+	return treats[start:], false
+}
+
+// url returns the URL path of the given path within the app, which is
+// served under t.basePath.
+func (t *Treatshelf) url(path string) string {
+	return t.basePath + path
+}
+
+// pageURL returns the current URL with its page parameter replaced.
+func pageURL(r *http.Request, page int) string {
+	q := r.URL.Query()
+	q.Set("page", strconv.Itoa(page))
+	u := *r.URL
+	u.RawQuery = q.Encode()
+	return u.RequestURI()
+}
+
+// Bounds for the "treats near me" search radius.
+const (
+	defaultRadiusKm = 2
+	maxRadiusKm     = 100
+)
+
+// listOptionsFromRequest parses the list filters from query parameters
+// (see templates/list.html), falling back to the given preferences.
+func (t *Treatshelf) listOptionsFromRequest(r *http.Request, prefs *Preferences) (ListOptions, error) {
+	opts := ListOptions{
+		Available:        r.FormValue("available") != "",
+		IncludeExpired:   r.FormValue("expired") != "",
+		IncludeHidden:    t.previewing(r),
+		LocationID:       r.FormValue("location"),
+		Tag:              normalizeTag(r.FormValue("tag")),
+		Query:            cleanLine(r.FormValue("q")),
+		Fuzziness:        t.searchFuzziness,
+		ExcludeAllergens: prefs.HiddenAllergens,
+		Sort:             r.FormValue("sort"),
+		Collation:        t.collationFor(r, prefs),
+		Consistency:      consistencyFrom(r.Context()),
+	}
+	if opts.Sort == "" {
+		opts.Sort = prefs.Sort
+	}
+	// Default to the shelf picked in the header's location switcher.
+	switch opts.LocationID {
+	case "":
+		opts.LocationID = t.session(r).LocationID
+	case allLocations:
+		opts.LocationID = ""
+	}
+	switch opts.Sort {
+	case "", sortByTitle, sortByPrice, sortByPriceDesc:
+	default:
+		return opts, fmt.Errorf("unknown sort order %q", opts.Sort)
+	}
+
+	if near := r.FormValue("near"); near != "" {
+		ll, err := parseLatLng(near)
+		if err != nil {
+			return opts, err
+		}
+		opts.Near, opts.RadiusKm = ll, defaultRadiusKm
+		if radius := r.FormValue("radius"); radius != "" {
+			km, err := strconv.ParseFloat(radius, 64)
+			if err != nil || km <= 0 || km > maxRadiusKm {
+				return opts, fmt.Errorf("radius must be between 0 and %gkm", float64(maxRadiusKm))
+			}
+			opts.RadiusKm = km
+		}
+	}
+
+	if opts.Currency = r.FormValue("currency"); opts.Currency == "" {
+		return opts, nil
+	}
+	if min := r.FormValue("minPrice"); min != "" {
+		p, err := parsePrice(min, opts.Currency)
+		if err != nil {
+			return opts, err
+		}
+		opts.MinPrice = p.Amount
+	}
+	if max := r.FormValue("maxPrice"); max != "" {
+		p, err := parsePrice(max, opts.Currency)
+		if err != nil {
+			return opts, err
+		}
+		opts.MaxPrice = p.Amount
+	}
+	return opts, nil
 }
 
 // treatFromRequest retrieves a treat from the database given a treat ID in the
@@ -116,29 +899,128 @@ func (t *Treatshelf) treatFromRequest(r *http.Request) (*Treat, error) {
 	if err != nil {
 		return nil, fmt.Errorf("could not find treat: %v", err)
 	}
+	if treat.Deleted() {
+		return nil, fmt.Errorf("could not find treat: %q was deleted", id)
+	}
 	return treat, nil
 }
 
+// previewing reports whether an admin asked to see treats outside their
+// visibility window.
+func (t *Treatshelf) previewing(r *http.Request) bool {
+	return r.FormValue("preview") != "" && t.isAdmin(r)
+}
+
 // detailHandler displays the details of a given treat.
 func (t *Treatshelf) detailHandler(w http.ResponseWriter, r *http.Request) *appError {
 	treat, err := t.treatFromRequest(r)
 	if err != nil {
-		return t.appErrorf(r, err, "%v", err)
+		return t.appErrorCodef(r, http.StatusNotFound, err, "%v", err)
+	}
+	if (!treat.VisibleAt(t.now()) && !t.previewing(r)) || !t.maySee(r, treat) {
+		err := errors.New("treat not found")
+		return t.appErrorCodef(r, http.StatusNotFound, err, "%v", err)
+	}
+	claims, err := t.DB.ListClaims(r.Context(), treat.ID)
+	if err != nil {
+		return t.appErrorf(r, err, "could not list claims: %v", err)
 	}
+	t.recordView(w, r, treat.ID)
 
-	return detailTmpl.Execute(t, w, r, treat)
+	var location *Location
+	if treat.LocationID != "" {
+		// The location may have been deleted since; show the treat anyway.
+		location, _ = t.Locations.GetLocation(r.Context(), treat.LocationID)
+	}
+
+	data := struct {
+		*Treat
+		Claims []*Claim
+		// Releasable are the IDs of the claims the user may release.
+		Releasable map[string]bool
+		Locale     string
+		Location   *Location
+		Admin      bool
+		// ReportReasons are offered in the report form, shown unless
+		// reports are disabled.
+		ReportReasons    []struct{ ID, Description string }
+		MaxReportDetails int
+		// OEmbedURL is advertised for link unfurls, see oembed.go.
+		OEmbedURL string
+		// Now is the time on t's clock, as in showList.
+		Now time.Time `json:"-"`
+	}{
+		Now:              t.now(),
+		Treat:            treat,
+		Claims:           claims,
+		Releasable:       make(map[string]bool),
+		Locale:           t.locale(r),
+		Location:         location,
+		Admin:            t.isAdmin(r),
+		MaxReportDetails: maxReportDetails,
+		OEmbedURL:        t.oembedURL(r, absoluteURL(r, t.routeURL("treat", "id", treat.ID))),
+	}
+	for _, c := range claims {
+		data.Releasable[c.ID] = t.mayRelease(r, c)
+	}
+	if t.Reports != nil {
+		data.ReportReasons = reportReasons
+	}
+	return detailTmpl.Execute(t, w, r, data)
 }
 
 // addFormHandler displays a form that captures details of a new treat to add to
 // the database.
 func (t *Treatshelf) addFormHandler(w http.ResponseWriter, r *http.Request) *appError {
-	return editTmpl.Execute(t, w, r, nil)
+	return t.executeEditForm(w, r, &Treat{
+		LocationID: t.session(r).LocationID,
+	})
 }
 
 // addFormHandler displays a form that captures details of a new treat to add to
 // the database.
 func (t *Treatshelf) addAboutHandler(w http.ResponseWriter, r *http.Request) *appError {
-	return about.Execute(t, w, r, nil)
+	return aboutTmpl.Execute(t, w, r, nil)
+}
+
+// editForm is the data for templates/edit.html. Treat has an empty ID when
+// adding a new treat.
+type editForm struct {
+	*Treat
+	Currencies []string
+	Locations  []*Location
+	Allergens  []string
+	// Captcha is the challenge to show when adding a treat, if any.
+	Captcha *CaptchaWidget
+	// Admin shows the internal notes.
+	Admin      bool
+	MaxAltText int
+	MaxCaption int
+	// RequireAltText marks the picture description required.
+	RequireAltText bool
+}
+
+// executeEditForm renders templates/edit.html for the given treat.
+func (t *Treatshelf) executeEditForm(w http.ResponseWriter, r *http.Request, treat *Treat) *appError {
+	locations, err := t.Locations.ListLocations(r.Context())
+	if err != nil {
+		return t.appErrorf(r, err, "could not list locations: %v", err)
+	}
+	form := editForm{
+		Treat:      treat,
+		Currencies: currencyCodes,
+		Locations:  locations,
+		MaxAltText: maxAltText,
+		MaxCaption: maxCaption,
+		Allergens:  allergens,
+		Admin:      t.isAdmin(r),
+
+		RequireAltText: t.requireAltText,
+	}
+	if treat.ID == "" {
+		form.Captcha = t.captchaWidget(r)
+	}
+	return editTmpl.Execute(t, w, r, form)
 }
 
 // editFormHandler displays a form that allows the user to edit the details of
@@ -148,64 +1030,185 @@ func (t *Treatshelf) editFormHandler(w http.ResponseWriter, r *http.Request) *ap
 	if err != nil {
 		return t.appErrorf(r, err, "%v", err)
 	}
+	if !t.maySee(r, treat) {
+		err := errors.New("treat not found")
+		return t.appErrorCodef(r, http.StatusNotFound, err, "%v", err)
+	}
 
-	return editTmpl.Execute(t, w, r, treat)
+	return t.executeEditForm(w, r, treat)
 }
 
 // treatFromForm populates the fields of a Treat from form values
 // (see templates/edit.html).
 func (t *Treatshelf) treatFromForm(r *http.Request) (*Treat, error) {
 	ctx := r.Context()
-	imageURL, err := t.uploadFileFromForm(ctx, r)
+	if err := t.checkAltText(r); err != nil {
+		return nil, err
+	}
+	imageURL, thumbnailURL, err := t.uploadPictureFromForm(ctx, r, "image")
+	if _, ok := err.(malwareError); ok {
+		return nil, err
+	}
 	if err != nil {
 		return nil, fmt.Errorf("could not upload file: %v", err)
 	}
 	if imageURL == "" {
-		imageURL = r.FormValue("imageURL")
+		imageURL, thumbnailURL = r.FormValue("imageURL"), r.FormValue("thumbnailURL")
+	}
+	nutrition, err := nutritionFromForm(r)
+	if err != nil {
+		return nil, fmt.Errorf("invalid nutrition facts: %v", err)
+	}
+	// An empty quantity means the portions aren't counted.
+	var quantity *int
+	if strings.TrimSpace(r.FormValue("quantity")) != "" {
+		n, err := intFromForm(r, "quantity")
+		if err != nil {
+			return nil, err
+		}
+		quantity = &n
+	}
+	lowStockThreshold, err := intFromForm(r, "lowStockThreshold")
+	if err != nil {
+		return nil, err
+	}
+	place, err := t.placeFromForm(ctx, r)
+	if err != nil {
+		return nil, fmt.Errorf("could not locate treat: %v", err)
+	}
+	price, err := priceFromForm(r)
+	if err != nil {
+		return nil, fmt.Errorf("invalid price: %v", err)
+	}
+	expiresAt, err := timeFromForm(r, "expiresAt")
+	if err != nil {
+		return nil, err
+	}
+	visibleFrom, err := timeFromForm(r, "visibleFrom")
+	if err != nil {
+		return nil, err
+	}
+	visibleUntil, err := timeFromForm(r, "visibleUntil")
+	if err != nil {
+		return nil, err
 	}
-
 	treat := &Treat{
 		Title:         r.FormValue("title"),
 		Author:        r.FormValue("author"),
 		PublishedDate: r.FormValue("publishedDate"),
 		ImageURL:      imageURL,
+		ThumbnailURL:  thumbnailURL,
+		AltText:       r.FormValue("altText"),
+		Caption:       r.FormValue("caption"),
 		Description:   r.FormValue("description"),
-	}
+		LocationID:    r.FormValue("locationID"),
+		Nutrition:     nutrition,
+		Allergens:     r.Form["allergens"],
+		Tags:          parseTags(r.FormValue("tags")),
 
+		Quantity:          quantity,
+		LowStockThreshold: lowStockThreshold,
+		Price:             price,
+		Place:             place,
+		ExpiresAt:         expiresAt,
+		VisibleFrom:       visibleFrom,
+		VisibleUntil:      visibleUntil,
+	}
+	if t.isAdmin(r) {
+		treat.InternalNotes = strings.TrimSpace(r.FormValue("internalNotes"))
+	}
+	if err := treat.validate(); err != nil {
+		return nil, err
+	}
 	return treat, nil
 }
 
-// uploadFileFromForm uploads a file if it's present in the "image" form field.
-func (t *Treatshelf) uploadFileFromForm(ctx context.Context, r *http.Request) (url string, err error) {
-	f, fh, err := r.FormFile("image")
+// datetimeLocalLayout is the format of datetime-local inputs.
+const datetimeLocalLayout = "2006-01-02T15:04"
+
+// timeFromForm parses an optional datetime-local form value as UTC.
+func timeFromForm(r *http.Request, name string) (time.Time, error) {
+	s := strings.TrimSpace(r.FormValue(name))
+	if s == "" {
+		return time.Time{}, nil
+	}
+	tm, err := time.Parse(datetimeLocalLayout, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid %s time %q", name, s)
+	}
+	return tm, nil
+}
+
+// intFromForm parses an optional non-negative integer form value.
+func intFromForm(r *http.Request, name string) (int, error) {
+	s := strings.TrimSpace(r.FormValue(name))
+	if s == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%s must be a non-negative whole number, got %q", name, s)
+	}
+	return n, nil
+}
+
+// publicURL is the URL of an uploaded picture, given its bucket and name.
+const publicURL = "https://storage.googleapis.com/%s/%s"
+
+// uploadFileFromForm uploads a file if it's present in the given form field,
+// such as "image".
+func (t *Treatshelf) uploadFileFromForm(ctx context.Context, r *http.Request, field string) (url string, err error) {
+	f, fh, err := r.FormFile(field)
 	if err == http.ErrMissingFile {
 		return "", nil
 	}
 	if err != nil {
 		return "", err
 	}
+	defer f.Close()
+	return t.uploadFile(ctx, f, fh.Filename, fh.Header.Get("Content-Type"))
+}
 
-	if t.StorageBucket == nil {
-		return "", errors.New("storage bucket is missing: check treat.go")
+// uploadFile uploads the contents of f, a file with the given name and
+// content type, to the picture bucket under a new name and returns its URL.
+// It returns a malwareError if f is infected, see scan.go.
+func (t *Treatshelf) uploadFile(ctx context.Context, f io.ReadSeeker, filename, contentType string) (url string, err error) {
+	// new name, see ids.go, retaining the existing extension.
+	name := t.newID("pictures") + path.Ext(filename)
+	if err := t.scanUpload(ctx, f, filename, name, contentType); err != nil {
+		return "", err
+	}
+	if t.Uploads != nil {
+		// Identical pictures are stored once, see dedup.go.
+		return t.putUpload(ctx, f, name, contentType)
 	}
-	if _, err := t.StorageBucket.Attrs(ctx); err != nil {
+	return t.putPicture(ctx, f, name, contentType, nil)
+}
+
+// putPicture stores the contents of f, of the given content type and with
+// the given metadata, in the picture bucket under the given name and
+// returns its URL.
+func (t *Treatshelf) putPicture(ctx context.Context, f io.Reader, name, contentType string, metadata map[string]string) (url string, err error) {
+	bucket, bucketName, err := t.pictureBucket()
+	if err != nil {
+		return "", err
+	}
+	if _, err := bucket.Attrs(ctx); err != nil {
 		if err == storage.ErrBucketNotExist {
-			return "", fmt.Errorf("bucket %q does not exist: check treat.go", t.StorageBucketName)
+			return "", fmt.Errorf("bucket %q does not exist: set STORAGE_BUCKET or run with BOOTSTRAP=true", bucketName)
 		}
 		return "", fmt.Errorf("could not get bucket: %v", err)
 	}
 
-	// random filename, retaining existing extension.
-	name := uuid.Must(uuid.NewV4()).String() + path.Ext(fh.Filename)
-
-	w := t.StorageBucket.Object(name).NewWriter(ctx)
+	w := bucket.Object(name).NewWriter(ctx)
 
 	// Warning: storage.AllUsers gives public read access to anyone.
 	w.ACL = []storage.ACLRule{{Entity: storage.AllUsers, Role: storage.RoleReader}}
-	w.ContentType = fh.Header.Get("Content-Type")
+	w.ContentType = contentType
+	w.Metadata = metadata
 
-	// Entries are immutable, be aggressive about caching (1 day).
-	w.CacheControl = "public, max-age=86400"
+	// Entries are immutable, be aggressive about caching.
+	w.CacheControl = cacheImmutable
 
 	if _, err := io.Copy(w, f); err != nil {
 		return "", err
@@ -214,53 +1217,95 @@ func (t *Treatshelf) uploadFileFromForm(ctx context.Context, r *http.Request) (u
 		return "", err
 	}
 
-	const publicURL = "https://storage.googleapis.com/%s/%s"
-	return fmt.Sprintf(publicURL, t.StorageBucketName, name), nil
+	return fmt.Sprintf(publicURL, bucketName, name), nil
 }
 
-// createHandler adds a treat to the database.
+// createHandler adds a treat to the database. Anonymous visitors must pass
+// a challenge first, if one is configured, and the treat may be held for
+// review, see moderation.go.
 func (t *Treatshelf) createHandler(w http.ResponseWriter, r *http.Request) *appError {
 	ctx := r.Context()
+	if e := t.checkCaptcha(r); e != nil {
+		return e
+	}
 	treat, err := t.treatFromForm(r)
 	if err != nil {
-		return t.appErrorf(r, err, "could not parse treat from form: %v", err)
+		return t.uploadErrorf(r, err, "could not parse treat from form: %v", err)
 	}
-	id, err := t.DB.AddTreat(ctx, treat)
-	if err != nil {
+	treat.CreatedBy = t.currentUser(r)
+	t.submitForReview(r, treat)
+	if _, err := t.DB.AddTreat(ctx, treat); err != nil {
 		return t.appErrorf(r, err, "could not save treat: %v", err)
 	}
-	http.Redirect(w, r, fmt.Sprintf("/treats/%s", id), http.StatusFound)
+	t.redirectToTreat(w, r, treat)
 	return nil
 }
 
 // updateHandler updates the details of a given treat.
 func (t *Treatshelf) updateHandler(w http.ResponseWriter, r *http.Request) *appError {
 	ctx := r.Context()
-	id := mux.Vars(r)["id"]
-	if id == "" {
-		return t.appErrorf(r, errors.New("no treat with empty ID"), "no treat with empty ID")
+	old, err := t.treatFromRequest(r)
+	if err != nil {
+		return t.appErrorCodef(r, http.StatusNotFound, err, "%v", err)
 	}
 	treat, err := t.treatFromForm(r)
 	if err != nil {
-		return t.appErrorf(r, err, "could not parse treat from form: %v", err)
+		return t.uploadErrorf(r, err, "could not parse treat from form: %v", err)
+	}
+	treat.ID = old.ID
+	notes := treat.InternalNotes
+	keepServerFields(treat, old)
+	unarchive(treat, t.now())
+	// Unlike the API, the form lets admins edit internal notes.
+	if t.isAdmin(r) {
+		treat.InternalNotes = notes
 	}
-	treat.ID = id
+	t.submitForReview(r, treat)
 
 	if err := t.DB.UpdateTreat(ctx, treat); err != nil {
 		return t.appErrorf(r, err, "UpdateTreat: %v", err)
 	}
-	http.Redirect(w, r, fmt.Sprintf("/treats/%s", treat.ID), http.StatusFound)
+	t.redirectToTreat(w, r, treat)
 	return nil
 }
 
-// deleteHandler deletes a given treat.
-func (t *Treatshelf) deleteHandler(w http.ResponseWriter, r *http.Request) *appError {
-	ctx := r.Context()
-	id := mux.Vars(r)["id"]
-	if err := t.DB.DeleteTreat(ctx, id); err != nil {
-		return t.appErrorf(r, err, "DeleteTreat: %v", err)
+// adjustQuantityHandler returns a handler that changes the Quantity of a given
+// treat by delta times the optional "amount" form value (default 1).
+func (t *Treatshelf) adjustQuantityHandler(delta int) appHandler {
+	return func(w http.ResponseWriter, r *http.Request) *appError {
+		ctx := r.Context()
+		id := mux.Vars(r)["id"]
+		amount, err := intFromForm(r, "amount")
+		if err != nil {
+			return t.appErrorf(r, err, "%v", err)
+		}
+		if amount == 0 {
+			amount = 1
+		}
+		treat, err := t.DB.AdjustQuantity(ctx, id, delta*amount)
+		if err == errNotEnoughPortions {
+			return t.appErrorCodef(r, http.StatusConflict, err, "could not take %d portions: %v", amount, err)
+		}
+		if err != nil {
+			return t.appErrorf(r, err, "AdjustQuantity: %v", err)
+		}
+		if delta < 0 {
+			t.kickOutbox()
+		}
+		http.Redirect(w, r, t.routeURL("treat", "id", treat.ID), http.StatusFound)
+		return nil
+	}
+}
+
+// archiveExpiredHandler archives expired treats. It is run by App Engine
+// cron, see cron.yaml.
+func (t *Treatshelf) archiveExpiredHandler(w http.ResponseWriter, r *http.Request) *appError {
+	n, err := t.DB.ArchiveExpired(r.Context(), t.now())
+	if err != nil {
+		return t.appErrorf(r, err, "ArchiveExpired: %v", err)
 	}
-	http.Redirect(w, r, "/treats", http.StatusFound)
+	fmt.Fprintf(t.logWriter, "Archived %d expired treats\n", n)
+	fmt.Fprintf(w, "Archived %d expired treats\n", n)
 	return nil
 }
 
@@ -294,20 +1339,42 @@ type appError struct {
 	req     *http.Request
 	t       *Treatshelf
 	stack   []byte
+
+	// problemType is the RFC 7807 problem type, see problem.go.
+	problemType string
+	// invalidParams are the fields that failed validation, see schema.go.
+	invalidParams []invalidParam
 }
 
 func (fn appHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if e := fn(w, r); e != nil { // e is *appError, not os.Error.
-		fmt.Fprintf(e.t.logWriter, "Handler error (reported to Error Reporting): status code: %d, message: %s, underlying err: %+v\n", e.code, e.message, e.err)
-		w.WriteHeader(e.code)
-		fmt.Fprint(w, e.message)
+		id := requestID(r)
+		fmt.Fprintf(e.t.logWriter, "Handler error: request ID: %s, status code: %d, message: %s, underlying err: %+v\n", id, e.code, e.message, e.err)
+		w.Header().Set("X-Request-Id", id)
+		w.Header().Set("Cache-Control", cacheNoStore)
+		w.Header().Del("Vary")
+		w.Header().Del("ETag")
+		w.Header().Del("Content-Disposition")
+		switch {
+		case e.t.wantsProblem(r):
+			e.writeProblem(w, id)
+		case strings.Contains(r.Header.Get("Accept"), "text/html"):
+			e.writePage(w, id)
+		default:
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.WriteHeader(e.code)
+			fmt.Fprint(w, e.message)
+		}
 
-		e.t.errorClient.Report(errorreporting.Entry{
-			Error: e.err,
-			Req:   r,
-			Stack: e.stack,
-		})
-		e.t.errorClient.Flush()
+		// Client errors are expected, only report server errors. Reports
+		// are sent in the background, see asyncReporter.
+		if c := e.t.errorReporter(); c != nil && e.code >= 500 {
+			c.Report(errorreporting.Entry{
+				Error: e.err,
+				Req:   r,
+				Stack: e.stack,
+			})
+		}
 	}
 }
 
@@ -320,4 +1387,11 @@ func (t *Treatshelf) appErrorf(r *http.Request, err error, format string, v ...i
 		t:       t,
 		stack:   debug.Stack(),
 	}
-}
\ No newline at end of file
+}
+
+// appErrorCodef is like appErrorf but responds with the given status code.
+func (t *Treatshelf) appErrorCodef(r *http.Request, code int, err error, format string, v ...interface{}) *appError {
+	e := t.appErrorf(r, err, format, v...)
+	e.code = code
+	return e
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Middleware wraps a handler with behavior shared by many routes.
+type Middleware func(http.Handler) http.Handler
+
+// chain wraps h in the given middleware, the first outermost.
+func chain(h http.Handler, mw ...Middleware) http.Handler {
+	for i := len(mw) - 1; i >= 0; i-- {
+		h = mw[i](h)
+	}
+	return h
+}
+
+// Use adds middleware that wraps every request, inside the logging,
+// recovery, CSRF, method override and timeout middleware that Handler
+// always applies. It
+// must be called before Handler.
+func (t *Treatshelf) Use(mw ...Middleware) {
+	t.middleware = append(t.middleware, mw...)
+}
+
+// serveError responds to r with e, as if a handler had returned it.
+func serveError(w http.ResponseWriter, r *http.Request, e *appError) {
+	appHandler(func(http.ResponseWriter, *http.Request) *appError { return e }).ServeHTTP(w, r)
+}
+
+// guard returns middleware that serves the error returned by check instead
+// of the request, if there is one. It is used to protect groups of routes,
+// e.g. guard(t.requireTokens). Who may use routes is decided by
+// authorize instead, see policy.go.
+func guard(check func(*http.Request) *appError) mux.MiddlewareFunc {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if e := check(r); e != nil {
+				serveError(w, r, e)
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+// recoverPanics turns a panic in h into a 500 error response, which is
+// logged and reported like any other server error.
+func (t *Treatshelf) recoverPanics(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			if p == http.ErrAbortHandler {
+				panic(p)
+			}
+			err := fmt.Errorf("panic: %v", p)
+			serveError(w, r, t.appErrorf(r, err, "internal server error"))
+		}()
+		h.ServeHTTP(w, r)
+	})
+}
+
+// withTimeout returns middleware that cancels each request's context after
+// d, so that slow database calls give up rather than holding the request.
+func withTimeout(d time.Duration) Middleware {
+	return func(h http.Handler) http.Handler {
+		if d <= 0 {
+			return h
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithTimeout(r.Context(), d)
+			defer cancel()
+			h.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// sameOrigin rejects cross-site writes (CSRF): a POST, PUT, PATCH or DELETE
+// whose Origin, or failing that Referer, is another host. Browsers send
+// Origin with every cross-site write; requests with neither header come from
+// other clients and are allowed.
+func (t *Treatshelf) sameOrigin(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET", "HEAD", "OPTIONS":
+			h.ServeHTTP(w, r)
+			return
+		}
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			origin = r.Referer()
+		}
+		if origin != "" {
+			if u, err := url.Parse(origin); err != nil || u.Host != r.Host {
+				err := fmt.Errorf("cross-site request from %q rejected", origin)
+				serveError(w, r, t.appErrorCodef(r, http.StatusForbidden, err, "%v", err))
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// methodOverrideHeader lets clients that can only POST send other methods,
+// like the _method form field does for HTML forms.
+const methodOverrideHeader = "X-HTTP-Method-Override"
+
+// methodOverride lets a POST stand for a PUT, PATCH or DELETE, named by its
+// _method form field or X-HTTP-Method-Override header, so that HTML forms
+// can use the same routes as the API. The form is only read for form
+// submissions, leaving JSON bodies to the handlers.
+func (t *Treatshelf) methodOverride(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		method := r.Header.Get(methodOverrideHeader)
+		ct := r.Header.Get("Content-Type")
+		if method == "" && (strings.HasPrefix(ct, "application/x-www-form-urlencoded") || strings.HasPrefix(ct, "multipart/form-data")) {
+			r.ParseMultipartForm(32 << 20)
+			method = r.PostFormValue("_method")
+		}
+		switch method = strings.ToUpper(method); method {
+		case "":
+		case "PUT", "PATCH", "DELETE":
+			r.Method = method
+		default:
+			err := fmt.Errorf("cannot override POST with %q", method)
+			serveError(w, r, t.appErrorCodef(r, http.StatusBadRequest, err, "%v", err))
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// securityHeaders sets headers that stop browsers from second-guessing
+// responses: error messages are served as text/plain and may quote what
+// was submitted, which mustn't be sniffed as HTML.
+func securityHeaders(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		h.ServeHTTP(w, r)
+	})
+}
+
+// deprecated marks the responses of a route kept as an alias of a newer
+// one with a Deprecation header, for clients to move on.
+func deprecated(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", "true")
+		h.ServeHTTP(w, r)
+	})
+}
+
+// Request metrics, served with the other expvars at /debug/vars.
+var (
+	requestCounts  = expvar.NewMap("requests")         // by route and status.
+	requestLatency = expvar.NewMap("requestLatencyMs") // total, by route.
+)
+
+// streamingRoutes are the routes whose responses stay open, such as the
+// event stream, and so have no latency to alert on.
+var streamingRoutes = map[string]bool{"events": true}
+
+// countRequests is mux middleware that counts requests and their latency by
+// route, in requestCounts and requestLatency, and in t.requests and t.slos
+// for alerts and SLOs. Streaming routes are left out of t.requests and
+// t.slos.
+func (t *Treatshelf) countRequests(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route, streaming := "unknown", false
+		if cr := mux.CurrentRoute(r); cr != nil {
+			if tpl, err := cr.GetPathTemplate(); err == nil {
+				route = tpl
+			}
+			streaming = streamingRoutes[cr.GetName()]
+		}
+		start := time.Now()
+		lw := &loggingResponseWriter{ResponseWriter: w}
+		h.ServeHTTP(lw, r)
+		if lw.status == 0 {
+			lw.status = http.StatusOK
+		}
+		latency := time.Since(start)
+		requestCounts.Add(r.Method+" "+route+" "+strconv.Itoa(lw.status), 1)
+		requestLatency.Add(r.Method+" "+route, int64(latency/time.Millisecond))
+		now := t.now()
+		if t.requests != nil && !streaming {
+			t.requests.observe(now, lw.status, latency)
+		}
+		if t.slos != nil && !streaming {
+			t.slos.observe(now, lw.status, latency)
+		}
+	})
+}
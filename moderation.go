@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// With moderation on (MODERATION=true), treats added or edited by anyone
+// but an admin are held for review: they are shown only to admins and to
+// whoever added them until an admin approves them at /admin/review.
+// Admins may instead reject a treat, giving a reason, which is shown on
+// the treat's page; editing it submits it for review again. Submitters who
+// were signed in are notified of the decision through the outbox.
+//
+// Treats that were reported enough are held for review too, whether or
+// not moderation is on, see reports.go.
+
+// Review states of a Treat, see Treat.Review.
+const (
+	reviewPending  = "pending"
+	reviewRejected = "rejected"
+)
+
+// maxReviewReason bounds the length of rejection reasons, in characters.
+const maxReviewReason = 500
+
+// reviewQueueOptions selects the treats awaiting review, and
+// reportedOptions the public treats with open reports, see reports.go.
+var (
+	reviewQueueOptions = ListOptions{
+		IncludeExpired:    true,
+		IncludeArchived:   true,
+		IncludeHidden:     true,
+		IncludeUnreviewed: true,
+		PendingReview:     true,
+	}
+	reportedOptions = ListOptions{
+		IncludeExpired:  true,
+		IncludeArchived: true,
+		IncludeHidden:   true,
+		Reported:        true,
+	}
+)
+
+// reviewItem is a treat in the review queue, with its open reports.
+type reviewItem struct {
+	*Treat
+	OpenReports []*Report
+}
+
+// UnderReview reports whether the treat is awaiting review or was
+// rejected, and so isn't public.
+func (t *Treat) UnderReview() bool {
+	return t.Review != ""
+}
+
+// submitForReview holds treat for review if r, which added or changed it,
+// needs approval.
+func (t *Treatshelf) submitForReview(r *http.Request, treat *Treat) {
+	if t.moderation && !t.isAdmin(r) {
+		treat.Review, treat.ReviewReason = reviewPending, ""
+	}
+}
+
+// maySee reports whether r may see treat: anyone may see public treats,
+// but only admins and whoever added it may see a treat under review.
+func (t *Treatshelf) maySee(r *http.Request, treat *Treat) bool {
+	if !treat.UnderReview() || t.isAdmin(r) {
+		return true
+	}
+	u := t.currentUser(r)
+	return u != "" && u == treat.CreatedBy
+}
+
+// redirectToTreat redirects to treat after it was added or changed, saying
+// if it awaits review. Anonymous visitors can't see treats awaiting review,
+// so they are sent to the list instead.
+func (t *Treatshelf) redirectToTreat(w http.ResponseWriter, r *http.Request, treat *Treat) {
+	next := t.routeURL("treat", "id", treat.ID)
+	if treat.Review == reviewPending {
+		setFlash(w, &flash{Message: fmt.Sprintf("Thanks! %q will be shown once an admin approves it.", treat.Title)})
+		if !t.maySee(r, treat) {
+			next = t.routeURL("treats")
+		}
+	}
+	http.Redirect(w, r, next, http.StatusFound)
+}
+
+// reviewQueueHandler lists the treats awaiting review, by title, with
+// forms to approve or reject them, then the public treats that were
+// reported, with forms to dismiss the reports.
+func (t *Treatshelf) reviewQueueHandler(w http.ResponseWriter, r *http.Request) *appError {
+	pending, err := t.reviewItems(r.Context(), reviewQueueOptions)
+	if err != nil {
+		return t.appErrorf(r, err, "could not list treats: %v", err)
+	}
+	var reported []reviewItem
+	if t.Reports != nil {
+		if reported, err = t.reviewItems(r.Context(), reportedOptions); err != nil {
+			return t.appErrorf(r, err, "could not list treats: %v", err)
+		}
+	}
+	return reviewTmpl.Execute(t, w, r, struct {
+		Pending    []reviewItem
+		Reported   []reviewItem
+		Moderation bool
+		MaxReason  int
+		HideAt     int
+	}{pending, reported, t.moderation, maxReviewReason, t.reportHideAt})
+}
+
+// reviewItems returns the treats matching opts with their open reports.
+func (t *Treatshelf) reviewItems(ctx context.Context, opts ListOptions) ([]reviewItem, error) {
+	treats, err := t.DB.ListTreats(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	items := make([]reviewItem, len(treats))
+	for i, treat := range treats {
+		items[i].Treat = treat
+		if t.Reports == nil || treat.Reports == 0 {
+			continue
+		}
+		if items[i].OpenReports, err = t.Reports.ListReports(ctx, treat.ID); err != nil {
+			return nil, err
+		}
+	}
+	return items, nil
+}
+
+// reviewHandler returns a handler that approves or rejects the treat in
+// the route, with the "reason" form value, and tells whoever added it.
+func (t *Treatshelf) reviewHandler(approve bool) appHandler {
+	return func(w http.ResponseWriter, r *http.Request) *appError {
+		treat, err := t.treatFromRequest(r)
+		if err != nil {
+			return t.appErrorCodef(r, http.StatusNotFound, err, "%v", err)
+		}
+		if treat.Review != reviewPending {
+			err := fmt.Errorf("%q is not awaiting review", treat.Title)
+			return t.appErrorCodef(r, http.StatusConflict, err, "%v", err)
+		}
+		reason := strings.TrimSpace(r.FormValue("reason"))
+		switch {
+		case approve:
+			treat.Review, treat.ReviewReason = "", ""
+		case reason == "":
+			err := errors.New("give a reason for rejecting the treat")
+			return t.appErrorCodef(r, http.StatusBadRequest, err, "%v", err)
+		case len([]rune(reason)) > maxReviewReason:
+			err := fmt.Errorf("reason must be at most %d characters", maxReviewReason)
+			return t.appErrorCodef(r, http.StatusBadRequest, err, "%v", err)
+		default:
+			treat.Review, treat.ReviewReason = reviewRejected, reason
+		}
+		// The decision answers any reports of the treat.
+		if t.Reports != nil && treat.Reports > 0 {
+			if err := t.Reports.ClearReports(r.Context(), treat.ID); err != nil {
+				return t.appErrorf(r, err, "could not close reports: %v", err)
+			}
+			treat.Reports = 0
+		}
+		if err := t.DB.UpdateTreat(r.Context(), treat); err != nil {
+			return t.appErrorf(r, err, "UpdateTreat: %v", err)
+		}
+
+		verb := "Approved"
+		if !approve {
+			verb = "Rejected"
+		}
+		fmt.Fprintf(t.logWriter, "%s %s treat %s %q\n", t.currentUser(r), strings.ToLower(verb), treat.ID, treat.Title)
+		t.notifyReview(r.Context(), treat)
+		setFlash(w, &flash{Message: fmt.Sprintf("%s %q.", verb, treat.Title)})
+		http.Redirect(w, r, t.routeURL("reviewQueue"), http.StatusFound)
+		return nil
+	}
+}
+
+// notifyReview tells whoever added treat that it was reviewed. Treats added
+// by anonymous visitors, or by deleted accounts, have nobody to tell.
+func (t *Treatshelf) notifyReview(ctx context.Context, treat *Treat) {
+	if t.Outbox == nil || treat.CreatedBy == "" || treat.CreatedBy == deletedAccount {
+		return
+	}
+	ev := newEvent(t.now(), fmt.Sprintf("%s was approved", treat.Title),
+		fmt.Sprintf("%q (ID %s) is now on the shelf.", treat.Title, treat.ID))
+	if treat.Review == reviewRejected {
+		ev = newEvent(t.now(), fmt.Sprintf("%s was not approved", treat.Title),
+			fmt.Sprintf("%q (ID %s) was rejected: %s. Edit it to submit it again.", treat.Title, treat.ID, treat.ReviewReason))
+	}
+	ev.To = treat.CreatedBy
+	if _, err := t.Outbox.AddEvent(ctx, ev); err != nil {
+		fmt.Fprintf(t.logWriter, "Could not notify %s of review of %s: %v\n", treat.CreatedBy, treat.ID, err)
+		return
+	}
+	t.kickOutbox()
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// Notifier delivers short operational messages, such as a treat running out,
+// to the people who care about them.
+type Notifier interface {
+	Notify(ctx context.Context, subject, body string) error
+}
+
+// UserNotifier is implemented by Notifiers that can reach a given user.
+// Notifications for a user are sent to the audience of other Notifiers,
+// naming the user.
+type UserNotifier interface {
+	NotifyUser(ctx context.Context, user, subject, body string) error
+}
+
+// logNotifier writes notifications to a log.
+type logNotifier struct {
+	w io.Writer
+}
+
+// Notify writes the notification to the log.
+func (n *logNotifier) Notify(_ context.Context, subject, body string) error {
+	_, err := fmt.Fprintf(n.w, "Notification: %s: %s\n", subject, body)
+	return err
+}
+
+// NotifyUser writes the notification to the log, naming user.
+func (n *logNotifier) NotifyUser(_ context.Context, user, subject, body string) error {
+	_, err := fmt.Fprintf(n.w, "Notification for %s: %s: %s\n", user, subject, body)
+	return err
+}
+
+// webhookNotifier posts notifications to an incoming webhook, such as a Slack
+// or Google Chat room.
+type webhookNotifier struct {
+	url    string
+	client *http.Client
+}
+
+// Notify posts the notification as a JSON {"text": ...} payload.
+func (n *webhookNotifier) Notify(ctx context.Context, subject, body string) error {
+	payload, err := json.Marshal(map[string]string{
+		"text": fmt.Sprintf("*%s*\n%s", subject, body),
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", n.url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := n.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("webhook: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook: unexpected status %s", resp.Status)
+	}
+	return nil
+}
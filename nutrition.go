@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Nutrition holds optional nutrition facts for a single serving of a treat.
+// All masses are stored in grams.
+type Nutrition struct {
+	ServingSize float64 // grams per serving, 0 if unknown.
+	Calories    float64 // kcal per serving.
+	Sugar       float64 // grams per serving.
+	Fat         float64 // grams per serving.
+}
+
+// massUnit is a unit of mass accepted on the edit form.
+type massUnit string
+
+const (
+	grams  massUnit = "g"
+	ounces massUnit = "oz"
+
+	gramsPerOunce = 28.349523125
+)
+
+// convertMass converts v from one mass unit to another.
+func convertMass(v float64, from, to massUnit) (float64, error) {
+	var g float64
+	switch from {
+	case grams:
+		g = v
+	case ounces:
+		g = v * gramsPerOunce
+	default:
+		return 0, fmt.Errorf("unknown mass unit %q", from)
+	}
+	switch to {
+	case grams:
+		return g, nil
+	case ounces:
+		return g / gramsPerOunce, nil
+	default:
+		return 0, fmt.Errorf("unknown mass unit %q", to)
+	}
+}
+
+// per100g scales a per-serving amount to an amount per 100g of the treat.
+func per100g(perServing, servingSize float64) float64 {
+	if servingSize <= 0 {
+		return 0
+	}
+	return perServing * 100 / servingSize
+}
+
+// ServingSizeOz returns the serving size in ounces.
+func (n *Nutrition) ServingSizeOz() float64 {
+	oz, _ := convertMass(n.ServingSize, grams, ounces)
+	return oz
+}
+
+// Per100g returns the nutrition facts scaled to 100g of the treat, or nil if
+// the serving size is unknown.
+func (n *Nutrition) Per100g() *Nutrition {
+	if n.ServingSize <= 0 {
+		return nil
+	}
+	return &Nutrition{
+		ServingSize: 100,
+		Calories:    per100g(n.Calories, n.ServingSize),
+		Sugar:       per100g(n.Sugar, n.ServingSize),
+		Fat:         per100g(n.Fat, n.ServingSize),
+	}
+}
+
+// validate reports whether the nutrition facts are plausible.
+func (n *Nutrition) validate() error {
+	for _, f := range []struct {
+		name string
+		v    float64
+	}{
+		{"serving size", n.ServingSize},
+		{"calories", n.Calories},
+		{"sugar", n.Sugar},
+		{"fat", n.Fat},
+	} {
+		if math.IsNaN(f.v) || math.IsInf(f.v, 0) || f.v < 0 {
+			return fmt.Errorf("%s must be a non-negative number", f.name)
+		}
+	}
+	if n.ServingSize > 0 && n.Sugar+n.Fat > n.ServingSize {
+		return errors.New("sugar and fat cannot exceed the serving size")
+	}
+	return nil
+}
+
+// nutritionFromForm populates Nutrition from form values
+// (see templates/edit.html). It returns nil if no nutrition fields are set.
+func nutritionFromForm(r *http.Request) (*Nutrition, error) {
+	unit := massUnit(r.FormValue("nutritionUnit"))
+	if unit == "" {
+		unit = grams
+	}
+
+	n := &Nutrition{}
+	set := false
+	for _, f := range []struct {
+		name string
+		dst  *float64
+		mass bool
+	}{
+		{"servingSize", &n.ServingSize, true},
+		{"calories", &n.Calories, false},
+		{"sugar", &n.Sugar, true},
+		{"fat", &n.Fat, true},
+	} {
+		s := strings.TrimSpace(r.FormValue(f.name))
+		if s == "" {
+			continue
+		}
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q", f.name, s)
+		}
+		if f.mass {
+			if v, err = convertMass(v, unit, grams); err != nil {
+				return nil, err
+			}
+		}
+		*f.dst = v
+		set = true
+	}
+	if !set {
+		return nil, nil
+	}
+	if err := n.validate(); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
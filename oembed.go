@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Treat pages are unfurled by Slack, Notion and other oEmbed consumers
+// (https://oembed.com): they find /oembed?url=<treat URL> in the page's
+// <link rel="alternate"> and show the title, description and thumbnail it
+// returns. The treat is looked up as GET /api/v1/treats/{id} does, so only
+// treats the API shows anonymous visitors unfurl.
+
+const (
+	// oembedProvider is the provider_name of oEmbed responses.
+	oembedProvider = "Ericas Treats"
+
+	// oembedCacheAge is how long consumers may cache a response, in
+	// seconds.
+	oembedCacheAge = 3600
+
+	// maxOEmbedDescription bounds the description, in characters.
+	maxOEmbedDescription = 300
+)
+
+// oEmbed is an oEmbed response of type "link". Description isn't part of
+// the spec, but consumers such as Notion show it.
+type oEmbed struct {
+	Type            string `json:"type"`
+	Version         string `json:"version"`
+	Title           string `json:"title"`
+	AuthorName      string `json:"author_name,omitempty"`
+	ProviderName    string `json:"provider_name"`
+	ProviderURL     string `json:"provider_url"`
+	CacheAge        int    `json:"cache_age"`
+	Description     string `json:"description,omitempty"`
+	ThumbnailURL    string `json:"thumbnail_url,omitempty"`
+	ThumbnailWidth  int    `json:"thumbnail_width,omitempty"`
+	ThumbnailHeight int    `json:"thumbnail_height,omitempty"`
+}
+
+// oembedURL returns the absolute URL of the oEmbed response for the page
+// at the absolute URL page.
+func (t *Treatshelf) oembedURL(r *http.Request, page string) string {
+	return absoluteURL(r, t.routeURL("oembed")+"?url="+url.QueryEscape(page))
+}
+
+// oembedHandler returns the oEmbed response for the treat page in the
+// "url" parameter. Only JSON is supported, as the spec allows.
+func (t *Treatshelf) oembedHandler(w http.ResponseWriter, r *http.Request) *appError {
+	if f := r.FormValue("format"); f != "" && f != "json" {
+		err := fmt.Errorf("format %q is not supported, only json", f)
+		return t.appErrorCodef(r, http.StatusNotImplemented, err, "%v", err)
+	}
+	maxWidth, err := intFromForm(r, "maxwidth")
+	if err != nil {
+		return t.appErrorCodef(r, http.StatusBadRequest, err, "%v", err)
+	}
+	maxHeight, err := intFromForm(r, "maxheight")
+	if err != nil {
+		return t.appErrorCodef(r, http.StatusBadRequest, err, "%v", err)
+	}
+
+	u, err := url.Parse(r.FormValue("url"))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") ||
+		!(strings.EqualFold(u.Host, r.Host) || strings.EqualFold(u.Host, t.canonicalHostName)) {
+		err := errors.New("url must be a treat page of this site")
+		return t.appErrorCodef(r, http.StatusNotFound, err, "%v", err)
+	}
+	page := r.WithContext(r.Context())
+	page.Method, page.URL = "GET", &url.URL{Path: u.Path}
+	var m mux.RouteMatch
+	if !t.routes.Match(page, &m) || m.MatchErr != nil || m.Route.GetName() != "treat" {
+		err := errors.New("url must be a treat page of this site")
+		return t.appErrorCodef(r, http.StatusNotFound, err, "%v", err)
+	}
+	// Unfurls are public, so the treat is looked up as anyone would see it.
+	anon := r.WithContext(r.Context())
+	anon.Header = http.Header{}
+	anon.Form = url.Values{}
+	treat, e := t.visibleTreat(mux.SetURLVars(anon, m.Vars))
+	if e != nil {
+		return e
+	}
+
+	o := &oEmbed{
+		Type:         "link",
+		Version:      "1.0",
+		Title:        treat.Title,
+		AuthorName:   treat.Author,
+		ProviderName: oembedProvider,
+		ProviderURL:  absoluteURL(r, t.routeURL("treats")),
+		CacheAge:     oembedCacheAge,
+	}
+	if d := []rune(treat.Description); len(d) > maxOEmbedDescription {
+		o.Description = string(d[:maxOEmbedDescription-1]) + "…"
+	} else {
+		o.Description = treat.Description
+	}
+	// Thumbnails fit in a square of thumbnailSize pixels; consumers asking
+	// for less get none, as the spec requires.
+	if treat.ThumbnailURL != "" && (maxWidth == 0 || maxWidth >= thumbnailSize) && (maxHeight == 0 || maxHeight >= thumbnailSize) {
+		o.ThumbnailURL = treat.ThumbnailURL
+		o.ThumbnailWidth, o.ThumbnailHeight = thumbnailSize, thumbnailSize
+	}
+	w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(oembedCacheAge))
+	writeJSON(w, http.StatusOK, o)
+	return nil
+}
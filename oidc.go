@@ -0,0 +1,445 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Besides IAP, people can sign in with any OAuth 2.0 or OpenID Connect
+// provider configured in AUTH_PROVIDERS, such as Okta, Azure AD or GitHub.
+// The provider is asked for the user's claims after the code exchange, from
+// its userinfo endpoint, so ID tokens needn't be verified. The user is then
+// remembered in a signed cookie, see loginUser.
+
+// AuthProvider configures signing in with an OAuth 2.0 or OpenID Connect
+// provider. AUTH_PROVIDERS holds a JSON list of them, such as
+//
+//	[{"name": "okta", "title": "Okta", "issuer": "https://example.okta.com",
+//	  "clientID": "...", "clientSecret": "..."},
+//	 {"name": "github", "clientID": "...", "clientSecret": "..."}]
+//
+// The app's redirect URL, to register with the provider, is
+// /login/{name}/callback under its base path.
+type AuthProvider struct {
+	// Name identifies the provider in URLs. "github" and "google" come
+	// with their endpoints and claims filled in.
+	Name string `json:"name"`
+
+	// Title is shown on the sign-in button, Name if empty.
+	Title string `json:"title"`
+
+	// Issuer is the URL of an OpenID Connect provider, whose endpoints are
+	// discovered from it. Providers that don't support discovery, such as
+	// GitHub, set the endpoints instead.
+	Issuer string `json:"issuer"`
+
+	AuthURL     string `json:"authURL"`
+	TokenURL    string `json:"tokenURL"`
+	UserInfoURL string `json:"userInfoURL"`
+
+	ClientID string `json:"clientID"`
+	// ClientSecret may name a secret in Secret Manager, see secrets.go.
+	ClientSecret string `json:"clientSecret"`
+
+	// Scopes are requested when signing in, "openid email" if empty.
+	Scopes []string `json:"scopes"`
+
+	// EmailClaim is the userinfo claim holding the user's email address,
+	// "email" if empty. Users are identified by it, as they are by IAP.
+	EmailClaim string `json:"emailClaim"`
+
+	// VerifiedEmails says that the provider's userinfo only holds
+	// verified addresses, so it needn't have an "email_verified" claim, as
+	// with GitHub's public email. Other providers must set the claim to
+	// true.
+	VerifiedEmails bool `json:"verifiedEmails"`
+}
+
+// wellKnownProviders fill in the providers of the same name.
+var wellKnownProviders = map[string]AuthProvider{
+	"github": {
+		Title:       "GitHub",
+		AuthURL:     "https://github.com/login/oauth/authorize",
+		TokenURL:    "https://github.com/login/oauth/access_token",
+		UserInfoURL: "https://api.github.com/user",
+		Scopes:      []string{"read:user", "user:email"},
+		// GitHub only lets people make verified addresses public.
+		VerifiedEmails: true,
+	},
+	"google": {
+		Title:  "Google",
+		Issuer: "https://accounts.google.com",
+	},
+}
+
+// parseAuthProviders parses AUTH_PROVIDERS and fills in each provider's
+// defaults, discovering the endpoints of OpenID Connect providers.
+func parseAuthProviders(ctx context.Context, client *http.Client, s string) ([]*AuthProvider, error) {
+	var providers []*AuthProvider
+	if err := json.Unmarshal([]byte(s), &providers); err != nil {
+		return nil, fmt.Errorf("could not parse AUTH_PROVIDERS: %v", err)
+	}
+	seen := make(map[string]bool)
+	for _, p := range providers {
+		if p.Name == "" || seen[p.Name] || strings.ContainsAny(p.Name, "/?#") {
+			return nil, fmt.Errorf("provider names must be unique, non-empty path segments, got %q", p.Name)
+		}
+		seen[p.Name] = true
+		if p.ClientID == "" {
+			return nil, fmt.Errorf("provider %q: clientID must be set", p.Name)
+		}
+		if known, ok := wellKnownProviders[p.Name]; ok {
+			p.fillFrom(known)
+		}
+		if p.Issuer != "" && (p.AuthURL == "" || p.TokenURL == "" || p.UserInfoURL == "") {
+			if err := p.discover(ctx, client); err != nil {
+				return nil, fmt.Errorf("provider %q: %v", p.Name, err)
+			}
+		}
+		if p.AuthURL == "" || p.TokenURL == "" || p.UserInfoURL == "" {
+			return nil, fmt.Errorf("provider %q: set issuer, or authURL, tokenURL and userInfoURL", p.Name)
+		}
+		if p.Title == "" {
+			p.Title = p.Name
+		}
+		if len(p.Scopes) == 0 {
+			p.Scopes = []string{"openid", "email"}
+		}
+		if p.EmailClaim == "" {
+			p.EmailClaim = "email"
+		}
+	}
+	return providers, nil
+}
+
+// fillFrom sets the unset fields of p from known.
+func (p *AuthProvider) fillFrom(known AuthProvider) {
+	set := func(s *string, v string) {
+		if *s == "" {
+			*s = v
+		}
+	}
+	set(&p.Title, known.Title)
+	set(&p.Issuer, known.Issuer)
+	set(&p.AuthURL, known.AuthURL)
+	set(&p.TokenURL, known.TokenURL)
+	set(&p.UserInfoURL, known.UserInfoURL)
+	if len(p.Scopes) == 0 {
+		p.Scopes = known.Scopes
+	}
+	p.VerifiedEmails = p.VerifiedEmails || known.VerifiedEmails
+}
+
+// discover fills in the endpoints of p from its issuer's OpenID Connect
+// discovery document.
+func (p *AuthProvider) discover(ctx context.Context, client *http.Client) error {
+	u := strings.TrimSuffix(p.Issuer, "/") + "/.well-known/openid-configuration"
+	var doc struct {
+		AuthURL     string `json:"authorization_endpoint"`
+		TokenURL    string `json:"token_endpoint"`
+		UserInfoURL string `json:"userinfo_endpoint"`
+	}
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return err
+	}
+	if err := getJSON(client, req.WithContext(ctx), &doc); err != nil {
+		return fmt.Errorf("could not discover endpoints: %v", err)
+	}
+	p.fillFrom(AuthProvider{AuthURL: doc.AuthURL, TokenURL: doc.TokenURL, UserInfoURL: doc.UserInfoURL})
+	return nil
+}
+
+// getJSON sends req and decodes the JSON response into v.
+func getJSON(client *http.Client, req *http.Request, v interface{}) error {
+	req.Header.Set("Accept", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, b)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// authProvider returns the configured provider with the given name, or nil.
+func (t *Treatshelf) authProvider(name string) *AuthProvider {
+	for _, p := range t.authProviders {
+		if p.Name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+const (
+	// loginCookie holds the signed-in user, see loginUser.
+	loginCookie = "treatshelf_login"
+
+	// loginDuration is how long people stay signed in.
+	loginDuration = 30 * 24 * time.Hour
+
+	// oauthStateCookie holds the state of a sign-in in progress, see
+	// oauthState.
+	oauthStateCookie = "treatshelf_oauth"
+
+	// oauthStateDuration is how long people have to sign in with the
+	// provider.
+	oauthStateDuration = 10 * time.Minute
+)
+
+// oauthState is remembered between sending someone to a provider and their
+// return, to check that they return from the sign-in the app started.
+type oauthState struct {
+	State    string `json:"state"`
+	Provider string `json:"provider"`
+	// Next is the path to return to once signed in.
+	Next string `json:"next"`
+}
+
+// login is what loginCookie holds.
+type login struct {
+	Email   string    `json:"email"`
+	Expires time.Time `json:"exp"`
+}
+
+// setSignedCookie sets a signed cookie holding v as JSON.
+func (t *Treatshelf) setSignedCookie(w http.ResponseWriter, name string, v interface{}, maxAge time.Duration) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    t.keyring.Sign(name, b, t.now()),
+		Path:     "/",
+		MaxAge:   int(maxAge.Seconds()),
+		HttpOnly: true,
+		// Lax, so that the cookie comes back with the provider's redirect.
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// signedCookie decodes the signed cookie of the given name into v. It
+// reports whether the cookie is stale and should be signed again, see
+// Keyring.Verify.
+func (t *Treatshelf) signedCookie(r *http.Request, name string, v interface{}) (stale bool, err error) {
+	c, err := r.Cookie(name)
+	if err != nil {
+		return false, err
+	}
+	b, stale, err := t.keyring.Verify(name, c.Value)
+	if err != nil {
+		return false, err
+	}
+	return stale, json.Unmarshal(b, v)
+}
+
+// loginUser returns the user signed in through an AuthProvider, or "".
+func (t *Treatshelf) loginUser(r *http.Request) string {
+	if len(t.authProviders) == 0 {
+		return ""
+	}
+	var l login
+	if _, err := t.signedCookie(r, loginCookie, &l); err != nil || t.now().After(l.Expires) {
+		return ""
+	}
+	return l.Email
+}
+
+// loginHandler lists the providers to sign in with.
+func (t *Treatshelf) loginHandler(w http.ResponseWriter, r *http.Request) *appError {
+	if len(t.authProviders) == 0 {
+		err := errors.New("signing in is not enabled")
+		return t.appErrorCodef(r, http.StatusNotFound, err, "%v", err)
+	}
+	return loginTmpl.Execute(t, w, r, struct {
+		Providers []*AuthProvider
+		Next      string
+	}{t.authProviders, safeNext(r.FormValue("next"))})
+}
+
+// safeNext returns next if it is a path on this site, or "" otherwise, so
+// that sign-in can't be used to redirect people elsewhere.
+func safeNext(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return ""
+	}
+	return next
+}
+
+// callbackURL returns the absolute URL the provider redirects back to.
+func (t *Treatshelf) callbackURL(r *http.Request, p *AuthProvider) string {
+	return absoluteURL(r, t.routeURL("loginCallback", "provider", p.Name))
+}
+
+// absoluteURL returns the absolute URL of path on the host r was sent to.
+func absoluteURL(r *http.Request, path string) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + path
+}
+
+// loginStartHandler sends the user to the provider to sign in.
+func (t *Treatshelf) loginStartHandler(w http.ResponseWriter, r *http.Request) *appError {
+	p := t.authProvider(mux.Vars(r)["provider"])
+	if p == nil {
+		err := errors.New("unknown sign-in provider")
+		return t.appErrorCodef(r, http.StatusNotFound, err, "%v", err)
+	}
+	if e := t.checkSignInLock(w, r, ""); e != nil {
+		return e
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return t.appErrorf(r, err, "could not start signing in: %v", err)
+	}
+	st := oauthState{
+		State:    base64.RawURLEncoding.EncodeToString(b),
+		Provider: p.Name,
+		Next:     safeNext(r.FormValue("next")),
+	}
+	if err := t.setSignedCookie(w, oauthStateCookie, st, oauthStateDuration); err != nil {
+		return t.appErrorf(r, err, "could not start signing in: %v", err)
+	}
+	q := url.Values{
+		"response_type": {"code"},
+		"client_id":     {p.ClientID},
+		"redirect_uri":  {t.callbackURL(r, p)},
+		"scope":         {strings.Join(p.Scopes, " ")},
+		"state":         {st.State},
+	}
+	sep := "?"
+	if strings.Contains(p.AuthURL, "?") {
+		sep = "&"
+	}
+	http.Redirect(w, r, p.AuthURL+sep+q.Encode(), http.StatusFound)
+	return nil
+}
+
+// loginCallbackHandler completes signing in once the provider redirects
+// back: it exchanges the code for an access token, reads the user's email
+// from the provider's userinfo endpoint and remembers it in loginCookie.
+// Attempts are recorded, see recordSignIn.
+func (t *Treatshelf) loginCallbackHandler(w http.ResponseWriter, r *http.Request) *appError {
+	method := mux.Vars(r)["provider"]
+	if e := t.checkSignInLock(w, r, ""); e != nil {
+		return e
+	}
+	p := t.authProvider(method)
+	var st oauthState
+	_, err := t.signedCookie(r, oauthStateCookie, &st)
+	http.SetCookie(w, &http.Cookie{Name: oauthStateCookie, Path: "/", MaxAge: -1})
+	if p == nil || err != nil || st.Provider != p.Name ||
+		!hmac.Equal([]byte(st.State), []byte(r.FormValue("state"))) {
+		t.recordSignIn(r, "", method, "bad state")
+		err := errors.New("sign-in expired or was not started here, please try again")
+		return t.appErrorCodef(r, http.StatusBadRequest, err, "%v", err)
+	}
+	if e := r.FormValue("error"); e != "" {
+		t.recordSignIn(r, "", method, "provider error: "+e)
+		err := fmt.Errorf("%s did not sign you in: %s", p.Title, e)
+		return t.appErrorCodef(r, http.StatusForbidden, err, "%v", err)
+	}
+
+	email, err := t.exchangeLogin(r, p, r.FormValue("code"))
+	if err != nil {
+		t.recordSignIn(r, email, method, err.Error())
+		return t.appErrorCodef(r, http.StatusBadGateway, err, "could not sign in with %s: %v", p.Title, err)
+	}
+	if e := t.checkSignInLock(w, r, email); e != nil {
+		t.recordSignIn(r, email, method, "locked")
+		return e
+	}
+	t.recordSignIn(r, email, method, "")
+	if err := t.setSignedCookie(w, loginCookie, login{Email: email, Expires: t.now().Add(loginDuration)}, loginDuration); err != nil {
+		return t.appErrorf(r, err, "could not sign in: %v", err)
+	}
+	next := st.Next
+	if next == "" {
+		next = t.routeURL("treats")
+	}
+	setFlash(w, &flash{Message: "Signed in as " + email + "."})
+	http.Redirect(w, r, next, http.StatusFound)
+	return nil
+}
+
+// exchangeLogin exchanges code for an access token from p and returns the
+// email address of the user it belongs to. The address is also returned
+// with the error if it isn't verified: the "email_verified" claim must be
+// true unless p.VerifiedEmails is set.
+func (t *Treatshelf) exchangeLogin(r *http.Request, p *AuthProvider, code string) (string, error) {
+	secret, err := t.secrets.resolve(r.Context(), p.ClientSecret)
+	if err != nil {
+		return "", fmt.Errorf("client secret: %v", err)
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {t.callbackURL(r, p)},
+		"client_id":     {p.ClientID},
+		"client_secret": {secret},
+	}
+	req, err := http.NewRequest("POST", p.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	var tok struct {
+		AccessToken string `json:"access_token"`
+		Error       string `json:"error"`
+	}
+	if err := getJSON(http.DefaultClient, req.WithContext(r.Context()), &tok); err != nil {
+		return "", fmt.Errorf("token exchange: %v", err)
+	}
+	if tok.AccessToken == "" {
+		return "", fmt.Errorf("token exchange: no access token (%s)", tok.Error)
+	}
+
+	req, err = http.NewRequest("GET", p.UserInfoURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+tok.AccessToken)
+	claims := make(map[string]interface{})
+	if err := getJSON(http.DefaultClient, req.WithContext(r.Context()), &claims); err != nil {
+		return "", fmt.Errorf("userinfo: %v", err)
+	}
+	email, _ := claims[p.EmailClaim].(string)
+	if email == "" {
+		return "", fmt.Errorf("no %q claim; is your email address public?", p.EmailClaim)
+	}
+	email = strings.ToLower(email)
+	if verified, _ := claims["email_verified"].(bool); !verified && !p.VerifiedEmails {
+		return email, errors.New("your email address is not verified")
+	}
+	return email, nil
+}
+
+// logoutHandler signs out people signed in through an AuthProvider.
+func (t *Treatshelf) logoutHandler(w http.ResponseWriter, r *http.Request) *appError {
+	http.SetCookie(w, &http.Cookie{Name: loginCookie, Path: "/", MaxAge: -1})
+	http.SetCookie(w, &http.Cookie{Name: impersonationCookie, Path: "/", MaxAge: -1})
+	setFlash(w, &flash{Message: "Signed out."})
+	http.Redirect(w, r, t.routeURL("treats"), http.StatusFound)
+	return nil
+}
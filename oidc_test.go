@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestExchangeLoginNeedsVerifiedEmail(t *testing.T) {
+	var claims map[string]interface{}
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			json.NewEncoder(w).Encode(map[string]string{"access_token": "secret"})
+			return
+		}
+		json.NewEncoder(w).Encode(claims)
+	}))
+	defer provider.Close()
+
+	shelf := &Treatshelf{logWriter: ioutil.Discard}
+	shelf.Handler()
+	r := httptest.NewRequest("GET", "/login/okta/callback", nil)
+	p := &AuthProvider{Name: "okta", TokenURL: provider.URL + "/token", UserInfoURL: provider.URL + "/userinfo", EmailClaim: "email"}
+
+	for _, tt := range []struct {
+		claims         map[string]interface{}
+		verifiedEmails bool
+		ok             bool
+	}{
+		{map[string]interface{}{"email": "a@example.com", "email_verified": true}, false, true},
+		{map[string]interface{}{"email": "a@example.com", "email_verified": false}, false, false},
+		// A missing claim isn't taken as verified.
+		{map[string]interface{}{"email": "a@example.com"}, false, false},
+		{map[string]interface{}{"email": "a@example.com"}, true, true},
+	} {
+		claims, p.VerifiedEmails = tt.claims, tt.verifiedEmails
+		email, err := shelf.exchangeLogin(r, p, "code")
+		if (err == nil) != tt.ok || email != "a@example.com" {
+			t.Errorf("exchangeLogin with %v, VerifiedEmails %v = %q, %v; want ok %v", tt.claims, tt.verifiedEmails, email, err, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// openAPISpec is the part of openapi.yaml the tests below check: the
+// operations under paths, as "METHOD /path", and the properties of the Treat
+// schema. openapi.yaml is written by hand with two-space indentation, so it
+// is scanned line by line rather than parsed.
+type openAPISpec struct {
+	operations      map[string]bool
+	treatProperties map[string]bool
+}
+
+func readOpenAPISpec(t *testing.T) *openAPISpec {
+	f, err := os.Open("openapi.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	spec := &openAPISpec{
+		operations:      make(map[string]bool),
+		treatProperties: make(map[string]bool),
+	}
+	var section, path, schema string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimRight(s.Text(), " ")
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		indent := len(line) - len(strings.TrimLeft(line, " "))
+		// Keys end with ": " or the line, as paths such as
+		// /treats:batchCreate may contain colons.
+		key := strings.TrimSpace(line) + " "
+		if i := strings.Index(key, ": "); i >= 0 {
+			key = key[:i]
+		}
+		key = strings.TrimSpace(key)
+		switch {
+		case indent == 0:
+			section = key
+		case section == "paths" && indent == 2:
+			path = key
+		case section == "paths" && indent == 4:
+			switch key {
+			case "get", "put", "post", "patch", "delete":
+				spec.operations[strings.ToUpper(key)+" "+path] = true
+			}
+		case section == "components" && indent == 4:
+			schema = key
+		case section == "components" && schema == "Treat" && indent == 8:
+			spec.treatProperties[key] = true
+		}
+	}
+	if err := s.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return spec
+}
+
+// routeVar matches path variables with a pattern, such as {id:[0-9]+}.
+var routeVar = regexp.MustCompile(`\{(\w+):[^}]*\}`)
+
+func TestOpenAPIDescribesRoutes(t *testing.T) {
+	spec := readOpenAPISpec(t)
+
+	r := mux.NewRouter()
+	(&Treatshelf{}).registerAPIHandlers(r)
+	routed := make(map[string]bool)
+	err := r.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		tpl, err := route.GetPathTemplate()
+		if err != nil || !strings.HasPrefix(tpl, "/api/v1/") {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+		path := routeVar.ReplaceAllString(strings.TrimPrefix(tpl, "/api/v1"), "{$1}")
+		for _, m := range methods {
+			routed[m+" "+path] = true
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for op := range routed {
+		if !spec.operations[op] {
+			t.Errorf("%s is routed but not described in openapi.yaml", op)
+		}
+	}
+	for op := range spec.operations {
+		if !routed[op] {
+			t.Errorf("%s is described in openapi.yaml but not routed", op)
+		}
+	}
+}
+
+func TestOpenAPIDescribesTreat(t *testing.T) {
+	spec := readOpenAPISpec(t)
+
+	fields := make(map[string]bool)
+	typ := reflect.TypeOf(Treat{})
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		if f.PkgPath != "" || f.Tag.Get("json") == "-" {
+			continue
+		}
+		fields[f.Name] = true
+	}
+
+	for f := range fields {
+		if !spec.treatProperties[f] {
+			t.Errorf("Treat.%s is not described in openapi.yaml", f)
+		}
+	}
+	for p := range spec.treatProperties {
+		if !fields[p] {
+			t.Errorf("openapi.yaml describes Treat property %s, which Treat doesn't have", p)
+		}
+	}
+}
@@ -0,0 +1,524 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Imports, re-indexing and backups take longer than a request should, so
+// admins start them as operations, which run in the background and are
+// stored with their progress. Starting one returns it with a 202 and a
+// Location to poll, /api/v1/operations/{id}, until Done is set:
+//
+//	{"ID": "...", "Kind": "import", "Status": "running", "Progress": 40, ...}
+//
+// The admin page, /admin/operations, lists recent operations and starts
+// new ones.
+
+// Operation is a long-running task and its progress.
+type Operation struct {
+	ID   string
+	Kind string // opImport, opReindex, opBackup or opAltText.
+	// User is the admin who started the operation.
+	User   string
+	Status string // opRunning, opSucceeded or opFailed.
+	Done   bool
+	// Processed of Total treats have been handled; Progress is that as a
+	// percentage.
+	Processed int
+	Total     int
+	Progress  int
+	// Errors lists the treats that couldn't be handled, and why the
+	// operation failed if it did. At most maxOperationErrors are kept.
+	Errors []string
+	// Result describes what the operation did, such as the file a backup
+	// was written to.
+	Result  string
+	Started time.Time
+	Updated time.Time
+}
+
+// Kinds of Operation.
+const (
+	opImport  = "import"
+	opReindex = "reindex"
+	opBackup  = "backup"
+	opAltText = "alttext"
+)
+
+// Statuses of an Operation.
+const (
+	opRunning   = "running"
+	opSucceeded = "succeeded"
+	opFailed    = "failed"
+)
+
+const (
+	// maxOperationErrors bounds Operation.Errors.
+	maxOperationErrors = 100
+
+	// maxListedOperations is how many recent operations are listed.
+	maxListedOperations = 20
+
+	// operationTimeout bounds how long an operation runs.
+	operationTimeout = 30 * time.Minute
+
+	// operationSaveEvery is how often a running operation's progress is
+	// stored. One not stored for operationStale has died with its
+	// instance, and is reported as failed.
+	operationSaveEvery = 2 * time.Second
+	operationStale     = time.Minute
+
+	// maxImportBytes bounds the size of an import.
+	maxImportBytes = 32 << 20
+)
+
+// OperationDatabase stores Operations.
+type OperationDatabase interface {
+	// SetOperation stores op under op.ID, replacing any earlier version.
+	SetOperation(ctx context.Context, op *Operation) error
+
+	// GetOperation returns the operation with the given ID, or nil if
+	// there is none.
+	GetOperation(ctx context.Context, id string) (*Operation, error)
+
+	// ListOperations returns the most recently started operations, newest
+	// first, at most limit.
+	ListOperations(ctx context.Context, limit int) ([]*Operation, error)
+}
+
+// requireOperations returns a 404 appError unless operations are
+// enabled. The operation routes use it through guard.
+func (t *Treatshelf) requireOperations(r *http.Request) *appError {
+	if t.Operations == nil {
+		err := errors.New("operations are not enabled")
+		return t.appErrorCodef(r, http.StatusNotFound, err, "%v", err)
+	}
+	return nil
+}
+
+// checkStale marks op failed if it is running but hasn't been stored for
+// operationStale before now, as happens when its instance is shut down.
+func checkStale(op *Operation, now time.Time) {
+	if op != nil && !op.Done && now.Sub(op.Updated) > operationStale {
+		op.Status, op.Done = opFailed, true
+		op.Errors = append(op.Errors, "interrupted: the server running it stopped")
+	}
+}
+
+// operationRun is a running operation. Its methods are safe to call from
+// the operation while the progress is being stored.
+type operationRun struct {
+	mu sync.Mutex
+	op Operation
+}
+
+// setTotal records how many treats the operation handles.
+func (run *operationRun) setTotal(n int) {
+	run.mu.Lock()
+	defer run.mu.Unlock()
+	run.op.Total = n
+}
+
+// processed records that n more treats have been handled.
+func (run *operationRun) processed(n int) {
+	run.mu.Lock()
+	defer run.mu.Unlock()
+	run.op.Processed += n
+	if run.op.Total > 0 {
+		run.op.Progress = 100 * run.op.Processed / run.op.Total
+	}
+}
+
+// fail records an error, keeping the first maxOperationErrors.
+func (run *operationRun) fail(format string, args ...interface{}) {
+	run.mu.Lock()
+	defer run.mu.Unlock()
+	if len(run.op.Errors) < maxOperationErrors {
+		run.op.Errors = append(run.op.Errors, fmt.Sprintf(format, args...))
+	}
+}
+
+// setResult sets the operation's Result.
+func (run *operationRun) setResult(format string, args ...interface{}) {
+	run.mu.Lock()
+	defer run.mu.Unlock()
+	run.op.Result = fmt.Sprintf(format, args...)
+}
+
+// snapshot returns a copy of the operation, updated now.
+func (run *operationRun) snapshot(now time.Time) *Operation {
+	run.mu.Lock()
+	defer run.mu.Unlock()
+	run.op.Updated = now
+	op := run.op
+	op.Errors = append([]string(nil), run.op.Errors...)
+	return &op
+}
+
+// startOperation stores a new operation of the given kind and runs fn in
+// the background, storing its progress as it goes. The operation fails if
+// fn returns an error.
+func (t *Treatshelf) startOperation(r *http.Request, kind string, fn func(context.Context, *operationRun) error) (*Operation, error) {
+	now := t.now()
+	run := &operationRun{op: Operation{
+		ID:      t.newID("operations"),
+		Kind:    kind,
+		User:    t.currentUser(r),
+		Status:  opRunning,
+		Started: now,
+		Updated: now,
+	}}
+	op := run.snapshot(now)
+	if err := t.Operations.SetOperation(r.Context(), op); err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(t.logWriter, "Operation %s: %s started by %q\n", op.ID, kind, op.User)
+
+	go func() {
+		// The operation outlives the request that started it.
+		ctx, cancel := context.WithTimeout(context.Background(), operationTimeout)
+		defer cancel()
+
+		done := make(chan error, 1)
+		go func() {
+			defer func() {
+				if p := recover(); p != nil {
+					done <- fmt.Errorf("panic: %v", p)
+				}
+			}()
+			done <- fn(ctx, run)
+		}()
+		var err error
+	wait:
+		for {
+			select {
+			case <-t.after(operationSaveEvery):
+				if err := t.Operations.SetOperation(ctx, run.snapshot(t.now())); err != nil {
+					fmt.Fprintf(t.logWriter, "Operation %s: SetOperation: %v\n", op.ID, err)
+				}
+			case err = <-done:
+				break wait
+			}
+		}
+		run.mu.Lock()
+		run.op.Done, run.op.Status = true, opSucceeded
+		if err != nil {
+			run.op.Status = opFailed
+			run.op.Errors = append(run.op.Errors, err.Error())
+		}
+		run.mu.Unlock()
+		final := run.snapshot(t.now())
+		// Store the outcome even if the operation ran out of time.
+		ctx, cancel = context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := t.Operations.SetOperation(ctx, final); err != nil {
+			fmt.Fprintf(t.logWriter, "Operation %s: SetOperation: %v\n", op.ID, err)
+		}
+		fmt.Fprintf(t.logWriter, "Operation %s: %s %s, %d/%d treats, %d errors\n",
+			final.ID, final.Kind, final.Status, final.Processed, final.Total, len(final.Errors))
+	}()
+	return op, nil
+}
+
+// startKind starts an operation of the given kind for r: an import of the
+// JSON lines in r's body or "file" upload, a re-index, a backup or an alt
+// text backfill.
+func (t *Treatshelf) startKind(r *http.Request, kind string) (*Operation, *appError) {
+	var fn func(context.Context, *operationRun) error
+	switch kind {
+	case opImport:
+		lines, err := importLines(r)
+		if err != nil {
+			return nil, t.appErrorCodef(r, http.StatusBadRequest, err, "%v", err)
+		}
+		fn = func(ctx context.Context, run *operationRun) error {
+			return t.importTreats(ctx, run, lines)
+		}
+	case opReindex:
+		fn = t.reindexTreats
+	case opBackup:
+		fn = t.backupTreats
+	case opAltText:
+		fn = t.backfillAltText
+	default:
+		err := fmt.Errorf("unknown operation %q", kind)
+		return nil, t.appErrorCodef(r, http.StatusBadRequest, err, "%v", err)
+	}
+	op, err := t.startOperation(r, kind, fn)
+	if err != nil {
+		return nil, t.appErrorf(r, err, "could not start the %s: %v", kind, err)
+	}
+	return op, nil
+}
+
+// importLines returns the lines of the import in r: the "file"
+// upload of a form, or else the body.
+func importLines(r *http.Request) ([][]byte, error) {
+	var body io.Reader
+	f, _, err := r.FormFile("file")
+	switch err {
+	case nil:
+		defer f.Close()
+		body = f
+	case http.ErrMissingFile, http.ErrNotMultipart:
+		body = r.Body
+	default:
+		return nil, err
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(body, maxImportBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > maxImportBytes {
+		return nil, fmt.Errorf("imports are at most %d MB", maxImportBytes>>20)
+	}
+	var lines [][]byte
+	s := bufio.NewScanner(bytes.NewReader(b))
+	s.Buffer(nil, maxImportBytes)
+	for s.Scan() {
+		lines = append(lines, s.Bytes())
+	}
+	if len(lines) == 0 {
+		return nil, errors.New("nothing to import: send treats as JSON lines, as exported")
+	}
+	return lines, nil
+}
+
+// importTreats adds or replaces the treats in lines, JSON lines as
+// exported (see exportHandler), maxBatchWrites at a time. Treats with an
+// ID replace the treat with that ID, so that an export can be restored,
+// keeping the fields exports leave out (see keepServerFields); those
+// without are added. Lines that aren't valid treats are skipped and
+// reported. Blank lines count as processed.
+func (t *Treatshelf) importTreats(ctx context.Context, run *operationRun, lines [][]byte) error {
+	run.setTotal(len(lines))
+	imported := 0
+	var batch []*Treat
+	flush := func() error {
+		if len(batch) > 0 {
+			if err := t.keepImportedServerFields(ctx, batch); err != nil {
+				return fmt.Errorf("imported %d treats: %v", imported, err)
+			}
+			if err := t.DB.SaveTreats(ctx, batch); err != nil {
+				return fmt.Errorf("imported %d treats: SaveTreats: %v", imported, err)
+			}
+			imported += len(batch)
+			run.processed(len(batch))
+			batch = nil
+		}
+		return nil
+	}
+	for i, line := range lines {
+		if len(bytes.TrimSpace(line)) == 0 {
+			run.processed(1)
+			continue
+		}
+		treat := &Treat{}
+		err := json.Unmarshal(line, treat)
+		if err == nil && treat.Title == "" {
+			err = errors.New("title is required")
+		}
+		if err == nil {
+			err = treat.validate()
+		}
+		if err != nil {
+			run.fail("line %d: %v", i+1, err)
+			run.processed(1)
+			continue
+		}
+		// Deleted treats come back undeleted, as from cold storage.
+		treat.DeletedAt, treat.UndoToken = time.Time{}, ""
+		batch = append(batch, treat)
+		if len(batch) == maxBatchWrites {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+	run.setResult("Imported %d treats.", imported)
+	return nil
+}
+
+// keepImportedServerFields copies the fields the server maintains from
+// the treats that imported treats replace.
+func (t *Treatshelf) keepImportedServerFields(ctx context.Context, treats []*Treat) error {
+	var ids []string
+	var replacing []*Treat
+	for _, treat := range treats {
+		if treat.ID != "" {
+			ids = append(ids, treat.ID)
+			replacing = append(replacing, treat)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	existing, err := t.DB.GetTreats(ctx, ids)
+	if err != nil {
+		return fmt.Errorf("GetTreats: %v", err)
+	}
+	for i, old := range existing {
+		if old != nil {
+			keepServerFields(replacing[i], old)
+		}
+	}
+	return nil
+}
+
+// reindexTreats recomputes what is derived from every treat, such as its
+// normalized tags and place, by validating and saving it again. Treats
+// that no longer validate are reported and left alone; those that are
+// unchanged aren't written.
+func (t *Treatshelf) reindexTreats(ctx context.Context, run *operationRun) error {
+	treats, err := t.DB.ListTreats(ctx, allTreatsOptions)
+	if err != nil {
+		return fmt.Errorf("ListTreats: %v", err)
+	}
+	run.setTotal(len(treats))
+	updated := 0
+	var batch []*Treat
+	flush := func(handled int) error {
+		if len(batch) > 0 {
+			if err := t.DB.SaveTreats(ctx, batch); err != nil {
+				return fmt.Errorf("re-indexed %d treats: SaveTreats: %v", updated, err)
+			}
+			updated += len(batch)
+			batch = nil
+		}
+		run.processed(handled)
+		return nil
+	}
+	handled := 0
+	for _, treat := range treats {
+		before, err := json.Marshal(treat)
+		if err == nil {
+			err = treat.validate()
+		}
+		if err != nil {
+			run.fail("treat %s: %v", treat.ID, err)
+		} else if after, err := json.Marshal(treat); err == nil && !bytes.Equal(before, after) {
+			batch = append(batch, treat)
+		}
+		handled++
+		if len(batch) == maxBatchWrites || handled == maxBatchWrites {
+			if err := flush(handled); err != nil {
+				return err
+			}
+			handled = 0
+		}
+	}
+	if err := flush(handled); err != nil {
+		return err
+	}
+	run.setResult("Re-indexed %d treats, %d of which changed.", len(treats), updated)
+	return nil
+}
+
+// backupTreats writes every treat to a cold storage file (see
+// coldstorage.go), from which it can be restored.
+func (t *Treatshelf) backupTreats(ctx context.Context, run *operationRun) error {
+	treats, err := t.DB.ListTreats(ctx, allTreatsOptions)
+	if err != nil {
+		return fmt.Errorf("ListTreats: %v", err)
+	}
+	run.setTotal(len(treats))
+	name, err := t.writeCold(ctx, "backup", treats)
+	if err != nil {
+		return err
+	}
+	run.processed(len(treats))
+	run.setResult("Backed up %d treats to %s%s.", len(treats), coldPrefix, name)
+	return nil
+}
+
+// apiStartOperationHandler returns a handler starting an operation of the
+// given kind, which responds with the operation and where to poll it.
+func (t *Treatshelf) apiStartOperationHandler(kind string) appHandler {
+	return func(w http.ResponseWriter, r *http.Request) *appError {
+		op, e := t.startKind(r, kind)
+		if e != nil {
+			return e
+		}
+		w.Header().Set("Location", t.apiURL(r, "apiGetOperation", "id", op.ID))
+		writeJSON(w, http.StatusAccepted, op)
+		return nil
+	}
+}
+
+// apiGetOperationHandler returns an operation by ID.
+func (t *Treatshelf) apiGetOperationHandler(w http.ResponseWriter, r *http.Request) *appError {
+	id := mux.Vars(r)["id"]
+	op, err := t.Operations.GetOperation(r.Context(), id)
+	if err != nil {
+		return t.appErrorf(r, err, "GetOperation: %v", err)
+	}
+	if op == nil {
+		err := fmt.Errorf("could not find operation %q", id)
+		return t.appErrorCodef(r, http.StatusNotFound, err, "%v", err)
+	}
+	checkStale(op, t.now())
+	writeJSON(w, http.StatusOK, op)
+	return nil
+}
+
+// apiListOperationsHandler lists the most recent operations, newest first.
+func (t *Treatshelf) apiListOperationsHandler(w http.ResponseWriter, r *http.Request) *appError {
+	ops, err := t.Operations.ListOperations(r.Context(), maxListedOperations)
+	if err != nil {
+		return t.appErrorf(r, err, "ListOperations: %v", err)
+	}
+	now := t.now()
+	for _, op := range ops {
+		checkStale(op, now)
+	}
+	if ops == nil {
+		ops = []*Operation{}
+	}
+	writeJSON(w, http.StatusOK, ops)
+	return nil
+}
+
+// operationsHandler shows the most recent operations, with forms to start
+// new ones. The page reloads itself while any is running.
+func (t *Treatshelf) operationsHandler(w http.ResponseWriter, r *http.Request) *appError {
+	ops, err := t.Operations.ListOperations(r.Context(), maxListedOperations)
+	if err != nil {
+		return t.appErrorf(r, err, "ListOperations: %v", err)
+	}
+	running, now := false, t.now()
+	for _, op := range ops {
+		checkStale(op, now)
+		running = running || !op.Done
+	}
+	return operationsTmpl.Execute(t, w, r, struct {
+		Operations []*Operation
+		Running    bool
+	}{ops, running})
+}
+
+// startOperationHandler starts the operation of the posted "kind" and
+// goes back to the operations page.
+func (t *Treatshelf) startOperationHandler(w http.ResponseWriter, r *http.Request) *appError {
+	op, e := t.startKind(r, r.FormValue("kind"))
+	if e != nil {
+		return e
+	}
+	setFlash(w, &flash{Message: fmt.Sprintf("Started the %s.", op.Kind)})
+	http.Redirect(w, r, t.routeURL("operations"), http.StatusFound)
+	return nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestImportKeepsServerFields(t *testing.T) {
+	shelf, db := newTestShelf(t)
+	ctx := context.Background()
+	id, err := db.AddTreat(ctx, &Treat{
+		Title:         "Brownie",
+		CreatedBy:     "owner@example.com",
+		InternalNotes: "Supplier: Bakery Ltd",
+		Review:        reviewPending,
+		Reports:       1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	run := &operationRun{}
+	lines := [][]byte{
+		[]byte(`{"ID": "` + id + `", "Title": "Fudge brownie"}`),
+		[]byte(`{"Title": "Flapjack"}`),
+	}
+	if err := shelf.importTreats(ctx, run, lines); err != nil {
+		t.Fatal(err)
+	}
+	if len(run.op.Errors) > 0 {
+		t.Fatalf("import failed: %v", run.op.Errors)
+	}
+
+	got, err := db.GetTreat(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Title != "Fudge brownie" {
+		t.Errorf("Title = %q, want the imported one", got.Title)
+	}
+	if got.CreatedBy != "owner@example.com" || got.InternalNotes != "Supplier: Bakery Ltd" || got.Review != reviewPending || got.Reports != 1 {
+		t.Errorf("import replaced the server's fields: %+v", got)
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Event is a notification or background task waiting in the outbox.
+// Notifications are written in the same transaction as the change they
+// announce, so that a crash between the write and the notification can't
+// lose it, and are then delivered to the Notifier by dispatchOutbox.
+//
+// Delivery is at least once: an event may be sent twice if two dispatchers
+// race or one crashes after sending but before marking it delivered.
+type Event struct {
+	ID      string
+	Subject string
+	Body    string
+	Created time.Time
+
+	// To is the user a notification is for, such as whoever added a treat
+	// that was reviewed, or "" for the people the Notifier reaches.
+	To string
+
+	// Task, if set, names the background task to run (see
+	// backgroundTasks) instead of sending a notification.
+	Task string
+
+	// Delivered is when the event was sent, or zero while it is pending.
+	Delivered time.Time
+
+	// NextAttempt is when the event is next due, or nil once it has been
+	// delivered or dead-lettered. Failed events are retried with backoff,
+	// see retryAfter.
+	NextAttempt *time.Time
+
+	// Attempts counts failed deliveries, the last of which failed with
+	// LastError.
+	Attempts  int
+	LastError string
+
+	// DeadLettered is when the event was given up on after
+	// maxEventAttempts, or zero. Admins can redrive or discard it at
+	// /admin/dead-letters.
+	DeadLettered time.Time
+}
+
+// newEvent returns a notification event created now, and due then.
+func newEvent(now time.Time, subject, body string) *Event {
+	return &Event{Subject: subject, Body: body, Created: now, NextAttempt: &now}
+}
+
+// OutboxDatabase stores the events written by TreatDatabase mutations.
+type OutboxDatabase interface {
+	// AddEvent adds an event outside of any other write, assigning it a
+	// new ID.
+	AddEvent(ctx context.Context, ev *Event) (id string, err error)
+
+	// PendingEvents returns up to limit events due by now, earliest due
+	// first.
+	PendingEvents(ctx context.Context, now time.Time, limit int) ([]*Event, error)
+
+	// MarkEventDelivered records that an event was sent at the given time.
+	MarkEventDelivered(ctx context.Context, id string, at time.Time) error
+
+	// RecordEventFailure saves ev's Attempts, LastError, NextAttempt and
+	// DeadLettered after a failed delivery.
+	RecordEventFailure(ctx context.Context, ev *Event) error
+
+	// ReplayEvents marks the events created since the given time pending
+	// again, so that they are sent again, and returns how many there were.
+	ReplayEvents(ctx context.Context, since time.Time) (int, error)
+
+	// DeadEvents returns the dead-lettered events, most recent first.
+	DeadEvents(ctx context.Context) ([]*Event, error)
+
+	// RedriveEvent makes a dead-lettered event due now, with its attempts
+	// reset.
+	RedriveEvent(ctx context.Context, id string) error
+
+	// DiscardEvent deletes an event.
+	DiscardEvent(ctx context.Context, id string) error
+}
+
+// ranOutEvent returns the event announcing that taking the given number of
+// portions left treat out of stock, or nil if it didn't. Databases call it
+// with their time and the updated treat from within the transaction taking
+// the portions.
+func ranOutEvent(now time.Time, treat *Treat, taken int) *Event {
+	if treat.Available() || *treat.Quantity+taken <= 0 {
+		return nil
+	}
+	return newEvent(now, fmt.Sprintf("%s has run out", treat.Title),
+		fmt.Sprintf("The last portion of %q (ID %s) was taken.", treat.Title, treat.ID))
+}
+
+const (
+	// maxEventAttempts is how many times an event is tried before it is
+	// dead-lettered.
+	maxEventAttempts = 8
+
+	// Retries wait minEventBackoff, doubling with each attempt up to
+	// maxEventBackoff.
+	minEventBackoff = 30 * time.Second
+	maxEventBackoff = time.Hour
+)
+
+// retryAfter returns how long to wait before retrying an event that has
+// failed the given number of times.
+func retryAfter(attempts int) time.Duration {
+	d := minEventBackoff
+	for i := 1; i < attempts && d < maxEventBackoff; i++ {
+		d *= 2
+	}
+	if d > maxEventBackoff {
+		d = maxEventBackoff
+	}
+	return d
+}
+
+// backgroundTasks are the tasks events can run, by Event.Task.
+var backgroundTasks = map[string]func(*Treatshelf, context.Context) error{
+	"purge-deleted": func(t *Treatshelf, ctx context.Context) error {
+		_, err := t.purgeDeleted(ctx)
+		return err
+	},
+}
+
+// retryTask records a background task that failed outside the outbox, so
+// that it is retried with backoff and dead-lettered if it keeps failing.
+func (t *Treatshelf) retryTask(ctx context.Context, task string, taskErr error) {
+	if t.Outbox == nil {
+		return
+	}
+	ev := newEvent(t.now(), "Background task "+task, taskErr.Error())
+	ev.Task = task
+	next := ev.Created.Add(retryAfter(1))
+	ev.NextAttempt, ev.Attempts, ev.LastError = &next, 1, taskErr.Error()
+	if _, err := t.Outbox.AddEvent(ctx, ev); err != nil {
+		fmt.Fprintf(t.logWriter, "Could not record failed task %s: %v\n", task, err)
+	}
+}
+
+// deliver sends ev, or runs its task.
+func (t *Treatshelf) deliver(ctx context.Context, ev *Event) error {
+	if ev.Task == "" && ev.To != "" {
+		if n, ok := t.notifier.(UserNotifier); ok {
+			return n.NotifyUser(ctx, ev.To, ev.Subject, ev.Body)
+		}
+		return t.notifier.Notify(ctx, ev.Subject+" (for "+ev.To+")", ev.Body)
+	}
+	if ev.Task == "" {
+		return t.notifier.Notify(ctx, ev.Subject, ev.Body)
+	}
+	task, ok := backgroundTasks[ev.Task]
+	if !ok {
+		return fmt.Errorf("unknown task %q", ev.Task)
+	}
+	return task(t, ctx)
+}
+
+const (
+	// outboxBatch is how many events dispatchOutbox sends at a time.
+	outboxBatch = 50
+
+	// outboxInterval is how often runOutbox checks for events that weren't
+	// kicked, e.g. written by an instance that stopped before sending them.
+	outboxInterval = time.Minute
+)
+
+// kickOutbox asks runOutbox to send pending events now, after a write that
+// may have added some.
+func (t *Treatshelf) kickOutbox() {
+	select {
+	case t.outboxKick <- struct{}{}:
+	default:
+	}
+}
+
+// runOutbox dispatches the outbox whenever it is kicked, and every
+// outboxInterval, until ctx is done.
+func (t *Treatshelf) runOutbox(ctx context.Context) {
+	for {
+		select {
+		case <-t.outboxKick:
+		case <-t.after(outboxInterval):
+		case <-ctx.Done():
+			return
+		}
+		if _, err := t.dispatchOutbox(ctx); err != nil {
+			fmt.Fprintf(t.logWriter, "Could not dispatch outbox: %v\n", err)
+		}
+	}
+}
+
+// dispatchOutbox delivers due events, earliest due first, and returns how
+// many were delivered. Events that fail are retried later, see retryAfter,
+// and dead-lettered after maxEventAttempts.
+func (t *Treatshelf) dispatchOutbox(ctx context.Context) (int, error) {
+	if t.Outbox == nil || t.notifier == nil {
+		return 0, nil
+	}
+	sent := 0
+	for {
+		now := t.now()
+		events, err := t.Outbox.PendingEvents(ctx, now, outboxBatch)
+		if err != nil {
+			return sent, err
+		}
+		for _, ev := range events {
+			if err := t.deliver(ctx, ev); err != nil {
+				if err := t.Outbox.RecordEventFailure(ctx, failedDelivery(ev, err, now)); err != nil {
+					return sent, err
+				}
+				fmt.Fprintf(t.logWriter, "Could not deliver event %s %q (attempt %d): %v\n", ev.ID, ev.Subject, ev.Attempts, err)
+				continue
+			}
+			if err := t.Outbox.MarkEventDelivered(ctx, ev.ID, t.now()); err != nil {
+				return sent, err
+			}
+			sent++
+		}
+		// Failed events are no longer due, so the next batch is new ones.
+		if len(events) < outboxBatch {
+			return sent, nil
+		}
+	}
+}
+
+// failedDelivery updates ev after a failed delivery at now: it is retried
+// later, or dead-lettered once it has been tried maxEventAttempts times.
+func failedDelivery(ev *Event, err error, now time.Time) *Event {
+	ev.Attempts++
+	ev.LastError = err.Error()
+	if ev.Attempts >= maxEventAttempts {
+		ev.NextAttempt, ev.DeadLettered = nil, now
+		return ev
+	}
+	next := now.Add(retryAfter(ev.Attempts))
+	ev.NextAttempt = &next
+	return ev
+}
+
+// dispatchOutboxHandler sends pending events. It is run by App Engine cron,
+// see cron.yaml.
+func (t *Treatshelf) dispatchOutboxHandler(w http.ResponseWriter, r *http.Request) *appError {
+	n, err := t.dispatchOutbox(r.Context())
+	if err != nil {
+		return t.appErrorf(r, err, "could not dispatch outbox after %d events: %v", n, err)
+	}
+	fmt.Fprintf(w, "Sent %d events\n", n)
+	return nil
+}
+
+// sortEvents orders events by when they are due, earliest first.
+func sortEvents(events []*Event) {
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].NextAttempt.Before(*events[j].NextAttempt)
+	})
+}
+
+// deadLettersHandler lists the dead-lettered events, with forms to redrive
+// or discard them.
+func (t *Treatshelf) deadLettersHandler(w http.ResponseWriter, r *http.Request) *appError {
+	if t.Outbox == nil {
+		err := errors.New("no outbox configured")
+		return t.appErrorCodef(r, http.StatusNotFound, err, "%v", err)
+	}
+	events, err := t.Outbox.DeadEvents(r.Context())
+	if err != nil {
+		return t.appErrorf(r, err, "DeadEvents: %v", err)
+	}
+	return deadLettersTmpl.Execute(t, w, r, struct {
+		Events      []*Event
+		MaxAttempts int
+	}{events, maxEventAttempts})
+}
+
+// deadLetterActionHandler returns a handler that redrives or discards the
+// given dead-lettered event.
+func (t *Treatshelf) deadLetterActionHandler(action string) appHandler {
+	return func(w http.ResponseWriter, r *http.Request) *appError {
+		if t.Outbox == nil {
+			err := errors.New("no outbox configured")
+			return t.appErrorCodef(r, http.StatusNotFound, err, "%v", err)
+		}
+		id := mux.Vars(r)["id"]
+		var err error
+		msg := fmt.Sprintf("Discarded event %s.", id)
+		if action == "redrive" {
+			err = t.Outbox.RedriveEvent(r.Context(), id)
+			msg = fmt.Sprintf("Event %s will be retried shortly.", id)
+			t.kickOutbox()
+		} else {
+			err = t.Outbox.DiscardEvent(r.Context(), id)
+		}
+		if err != nil {
+			return t.appErrorf(r, err, "could not %s event: %v", action, err)
+		}
+		setFlash(w, &flash{Message: msg})
+		http.Redirect(w, r, t.routeURL("deadLetters"), http.StatusFound)
+		return nil
+	}
+}
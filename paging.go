@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// The API's lists are paged by cursors, which name the treat a page
+// starts after or ends before, so that treats added or removed elsewhere
+// in the list don't shift later pages by one. Clients follow the cursor
+// links in the Link header, or ask for an envelope with ?envelope=1, which
+// v2 always returns (see apiversion.go):
+//
+//	{"items": [...], "nextCursor": "...", "prevCursor": "...", "pageSize": 50, "totalCount": 123}
+//
+// The older ?page=N still works. totalCount is the number of treats
+// matching the filters when the page was fetched.
+
+// cursor is a position in a list of treats.
+type cursor struct {
+	// After or Before is the ID of the treat the page starts after or ends
+	// before.
+	After  string `json:"a,omitempty"`
+	Before string `json:"b,omitempty"`
+	// Offset is where the page started or ended when the cursor was made,
+	// used if that treat is no longer in the list.
+	Offset int `json:"o"`
+}
+
+// String encodes c for use in URLs.
+func (c *cursor) String() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// parseCursor decodes a cursor made by cursor.String.
+func parseCursor(s string) (*cursor, error) {
+	errInvalid := errors.New("invalid cursor")
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errInvalid
+	}
+	c := &cursor{}
+	if err := json.Unmarshal(b, c); err != nil || c.Offset < 0 || (c.After == "") == (c.Before == "") {
+		return nil, errInvalid
+	}
+	return c, nil
+}
+
+// paging is how a request asks for a page of a list.
+type paging struct {
+	size     int
+	page     int     // 1-based page number, if cursor is nil.
+	cursor   *cursor // nil for the first page.
+	envelope bool    // whether to wrap the page in a treatPage.
+}
+
+// pagingFromRequest reads the "cursor", "page", "pageSize" and "envelope"
+// parameters of r.
+func pagingFromRequest(r *http.Request) (*paging, error) {
+	p := &paging{envelope: r.FormValue("envelope") == "1"}
+	var err error
+	if p.page, err = pageFromForm(r); err != nil {
+		return nil, err
+	}
+	if p.size, err = intFromForm(r, "pageSize"); err != nil {
+		return nil, err
+	}
+	if p.size <= 0 || p.size > maxAPIPageSize {
+		p.size = defaultAPIPageSize
+	}
+	if s := strings.TrimSpace(r.FormValue("cursor")); s != "" {
+		if p.cursor, err = parseCursor(s); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// of returns the page of treats p asks for and the cursors of the pages
+// before and after it, which are nil at the ends of the list.
+func (p *paging) of(treats []*Treat) (page []*Treat, prev, next *cursor) {
+	var start, end int
+	switch c := p.cursor; {
+	case c != nil && c.Before != "":
+		end = cursorIndex(treats, c.Before, c.Offset)
+		start = end - p.size
+		if start < 0 {
+			start = 0
+		}
+	default:
+		if c == nil {
+			start = (p.page - 1) * p.size
+		} else {
+			start = cursorIndex(treats, c.After, c.Offset-1) + 1
+		}
+		if start > len(treats) {
+			start = len(treats)
+		}
+		end = start + p.size
+		if end > len(treats) {
+			end = len(treats)
+		}
+	}
+	page = treats[start:end]
+	if start > 0 && len(page) > 0 {
+		prev = &cursor{Before: page[0].ID, Offset: start}
+	}
+	if end < len(treats) && len(page) > 0 {
+		next = &cursor{After: page[len(page)-1].ID, Offset: end}
+	}
+	return page, prev, next
+}
+
+// cursorIndex returns the position in treats of the treat with the given
+// ID, or offset, at most the end of treats, if it is gone.
+func cursorIndex(treats []*Treat, id string, offset int) int {
+	for i, treat := range treats {
+		if treat.ID == id {
+			return i
+		}
+	}
+	if offset > len(treats) {
+		return len(treats)
+	}
+	return offset
+}
+
+// treatPage is a page of treats in an envelope, see above.
+type treatPage struct {
+	Items      interface{} `json:"items"`
+	NextCursor string      `json:"nextCursor,omitempty"`
+	PrevCursor string      `json:"prevCursor,omitempty"`
+	PageSize   int         `json:"pageSize"`
+	TotalCount int         `json:"totalCount"`
+}
+
+// writeTreatPage writes the page of treats r asks for, with the given
+// fields (see fields.go), and links to the pages around it.
+func (t *Treatshelf) writeTreatPage(w http.ResponseWriter, r *http.Request, treats []*Treat, fields []string) *appError {
+	p, err := pagingFromRequest(r)
+	if err != nil {
+		return t.appErrorCodef(r, http.StatusBadRequest, err, "%v", err)
+	}
+	page, prev, next := p.of(treats)
+	var links []string
+	if next != nil {
+		links = append(links, fmt.Sprintf("<%s>; rel=\"next\"", cursorURL(r, next)))
+	}
+	if prev != nil {
+		links = append(links, fmt.Sprintf("<%s>; rel=\"prev\"", cursorURL(r, prev)))
+	}
+	if len(links) > 0 {
+		// Deprecated API versions have set a successor link already.
+		w.Header().Add("Link", strings.Join(links, ", "))
+	}
+	if len(page) == 0 {
+		page = []*Treat{}
+	}
+	v := apiVersionOf(r)
+	items, err := sparseTreats(v, page, fields)
+	if err != nil {
+		return t.appErrorf(r, err, "could not select fields: %v", err)
+	}
+	if !p.envelope && !v.envelope {
+		writeJSON(w, http.StatusOK, items)
+		return nil
+	}
+	env := &treatPage{Items: items, PageSize: p.size, TotalCount: len(treats)}
+	if next != nil {
+		env.NextCursor = next.String()
+	}
+	if prev != nil {
+		env.PrevCursor = prev.String()
+	}
+	writeJSON(w, http.StatusOK, env)
+	return nil
+}
+
+// cursorURL returns the current URL with its page replaced by cursor c.
+func cursorURL(r *http.Request, c *cursor) string {
+	q := r.URL.Query()
+	q.Del("page")
+	q.Set("cursor", c.String())
+	u := *r.URL
+	u.RawQuery = q.Encode()
+	return u.RequestURI()
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// PATCH /api/v1/treats/{id} changes only some fields of a treat, named
+// Google-style in the updateMask parameter:
+//
+//	PATCH /api/v1/treats/1?updateMask=quantity,expiresAt
+//	{"Quantity": 3}
+//
+// Masked fields missing from the body are cleared, so a client can clear a
+// field explicitly; fields not in the mask are left alone whatever the
+// body says. Without updateMask, the fields present in the body are
+// changed, and updateMask=* replaces every field as PUT does. Field names
+// are those of the Treat JSON, in any case. Fields the server maintains,
+// such as Archived, can't be masked.
+
+// readOnlyFields are the Treat fields PATCH can't change.
+var readOnlyFields = map[string]bool{
+	"ID":           true,
+	"Archived":     true,
+	"DeletedAt":    true,
+	"Review":       true,
+	"ReviewReason": true,
+}
+
+// updateMask returns the Treat fields r's "updateMask" parameter names,
+// or those in body, the JSON object of the request, if it has none. Read-only
+// fields in body, as GET returns them, are then left out rather than
+// refused.
+func updateMask(r *http.Request, body map[string]json.RawMessage) ([]string, error) {
+	var names []string
+	switch s := strings.TrimSpace(r.FormValue("updateMask")); s {
+	case "":
+		for name := range body {
+			if n, ok := treatFieldName(name); !ok || !readOnlyFields[n] {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+	case "*":
+		for _, name := range treatFieldNames() {
+			if !readOnlyFields[name] {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+	default:
+		names = strings.Split(s, ",")
+	}
+	if len(names) == 0 {
+		return nil, errors.New("nothing to update: name fields in updateMask or the body")
+	}
+	seen := make(map[string]bool)
+	var mask []string
+	for _, n := range names {
+		name, ok := treatFieldName(n)
+		switch {
+		case strings.Contains(n, "."):
+			return nil, fmt.Errorf("cannot update %q: updateMask names whole fields", strings.TrimSpace(n))
+		case !ok:
+			return nil, fmt.Errorf("unknown field %q", strings.TrimSpace(n))
+		case readOnlyFields[name]:
+			return nil, fmt.Errorf("field %q cannot be changed", name)
+		}
+		if !seen[name] {
+			seen[name] = true
+			mask = append(mask, name)
+		}
+	}
+	return mask, nil
+}
+
+// copyTreatFields copies the given fields of src to dst.
+func copyTreatFields(dst, src *Treat, fields []string) {
+	d, s := reflect.ValueOf(dst).Elem(), reflect.ValueOf(src).Elem()
+	for _, f := range fields {
+		d.FieldByName(f).Set(s.FieldByName(f))
+	}
+}
+
+// treatFieldValue returns the value of the given field of t.
+func treatFieldValue(t *Treat, field string) interface{} {
+	return reflect.ValueOf(t).Elem().FieldByName(field).Interface()
+}
+
+// apiPatchHandler changes the fields of a given treat named by updateMask
+// to those in the request body, if it matches If-Match, and returns it.
+func (t *Treatshelf) apiPatchHandler(w http.ResponseWriter, r *http.Request) *appError {
+	old, err := t.treatFromRequest(r)
+	if err != nil {
+		return t.appErrorCodef(r, http.StatusNotFound, err, "%v", err)
+	}
+	// Fail early, before reading the body; ChangeTreat checks again.
+	if e := t.ifMatchError(r, t.ifMatch(r, old)); e != nil {
+		return e
+	}
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return t.appErrorCodef(r, http.StatusBadRequest, err, "could not read body: %v", err)
+	}
+	var body map[string]json.RawMessage
+	patch := &Treat{}
+	if err = json.Unmarshal(b, &body); err != nil {
+		return t.appErrorCodef(r, http.StatusBadRequest, err, "invalid JSON: %v", err)
+	}
+	if ps := treatPatchSchema.check(b); len(ps) > 0 {
+		return t.validationError(r, ps)
+	}
+	if err = json.Unmarshal(b, patch); err != nil {
+		return t.appErrorCodef(r, http.StatusBadRequest, err, "invalid JSON: %v", err)
+	}
+	mask, err := updateMask(r, body)
+	if err != nil {
+		return t.appErrorCodef(r, http.StatusBadRequest, err, "invalid updateMask: %v", err)
+	}
+
+	// The patch applies to the treat as ChangeTreat reads it, so it is
+	// checked there, with invalid set if it leaves the treat invalid.
+	var invalid error
+	treat, err := t.DB.ChangeTreat(r.Context(), old.ID, func(current *Treat) ([]string, error) {
+		if err := t.ifMatch(r, current); err != nil {
+			return nil, err
+		}
+		before := *current
+		copyTreatFields(current, patch, mask)
+		if invalid = checkAPITreat(current); invalid != nil {
+			return nil, invalid
+		}
+		keepServerFields(current, &before)
+		unarchive(current, t.now())
+		t.submitForReview(r, current)
+		fields := mask[:len(mask):len(mask)]
+		if current.Archived != before.Archived {
+			fields = append(fields, "Archived")
+		}
+		if current.Review != before.Review || current.ReviewReason != before.ReviewReason {
+			fields = append(fields, "Review", "ReviewReason")
+		}
+		return fields, nil
+	})
+	if invalid != nil {
+		return t.appErrorCodef(r, http.StatusBadRequest, invalid, "%v", invalid)
+	}
+	if e := t.ifMatchError(r, err); e != nil {
+		return e
+	}
+	if err != nil {
+		return t.appErrorf(r, err, "UpdateTreatFields: %v", err)
+	}
+	setETag(w, treat)
+	return t.writeTreat(w, r, http.StatusOK, treat)
+}
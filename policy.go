@@ -0,0 +1,282 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// Who may use each route is decided in one place, the policy tables below,
+// rather than by checks in handlers. Routes are named for their action,
+// such as createTreat, and each name maps to a Rule. The authorize
+// middleware evaluates the Rule of the route serving a request and logs
+// the decision; routes without a Rule are refused. policy_test.go checks
+// that every route has one.
+//
+// Handlers still check whether features are enabled (see guard) and may
+// show admins more, such as internal notes.
+
+// Rule names what a request must satisfy to use a route.
+type Rule string
+
+const (
+	// ruleAnyone allows every request.
+	ruleAnyone Rule = "anyone"
+	// ruleSignedIn allows signed-in users.
+	ruleSignedIn Rule = "signed-in"
+	// ruleAdmin allows admins, see isAdmin.
+	ruleAdmin Rule = "admin"
+	// ruleOwner allows the signed-in user who added the treat in the
+	// route's {id}, and admins. Treats nobody signed in added may be
+	// changed by anyone.
+	ruleOwner Rule = "owner"
+	// ruleCron allows App Engine cron, see requireCron.
+	ruleCron Rule = "cron"
+	// ruleDebug allows admins and requests from this machine.
+	ruleDebug Rule = "debug"
+)
+
+// routePolicy maps the names of the app's routes to their Rules.
+var routePolicy = map[string]Rule{
+	"base":  ruleAnyone,
+	"home":  ruleAnyone,
+	"about": ruleAnyone,
+
+	"offline": ruleAnyone,
+	"static":  ruleAnyone,
+	"favicon": ruleAnyone,
+	"image":   ruleAnyone,
+
+	"treats":           ruleAnyone,
+	"addTreat":         ruleAnyone,
+	"treat":            ruleAnyone,
+	"editTreat":        ruleOwner,
+	"createTreat":      ruleAnyone,
+	"updateTreat":      ruleOwner,
+	"updateTreatPost":  ruleOwner,
+	"deleteTreat":      ruleOwner,
+	"deleteTreatPost":  ruleOwner,
+	"batchDelete":      ruleAnyone, // per treat, see mayChange.
+	"undo":             ruleAnyone,
+	"incrementTreat":   ruleAnyone,
+	"decrementTreat":   ruleAnyone,
+	"claimTreat":       ruleAnyone,
+	"reportTreat":      ruleAnyone,
+	"releaseClaim":     ruleAnyone, // per claim, see mayRelease.
+	"releaseClaimPost": ruleAnyone, // per claim, see mayRelease.
+
+	"locations":          ruleAnyone,
+	"createLocation":     ruleAdmin,
+	"deleteLocation":     ruleAdmin,
+	"deleteLocationPost": ruleAdmin,
+	"selectLocation":     ruleAnyone,
+	"clearRecent":        ruleAnyone,
+
+	"settings":           ruleAnyone,
+	"saveSettings":       ruleAnyone,
+	"toggleTheme":        ruleAnyone,
+	"tokens":             ruleSignedIn,
+	"createToken":        ruleSignedIn,
+	"revokeToken":        ruleSignedIn,
+	"profile":            ruleSignedIn,
+	"saveProfile":        ruleSignedIn,
+	"deleteAccount":      ruleSignedIn,
+	"userExport":         ruleSignedIn,
+	"startUserExport":    ruleSignedIn,
+	"downloadUserExport": ruleSignedIn,
+	"signIns":            ruleSignedIn,
+	"saveShelf":          ruleSignedIn,
+	"shelf":              ruleSignedIn,
+	"deleteShelf":        ruleSignedIn,
+
+	"login":             ruleAnyone,
+	"loginStart":        ruleAnyone,
+	"loginCallback":     ruleAnyone,
+	"logout":            ruleAnyone,
+	"stopImpersonating": ruleAnyone,
+
+	"dashboard":             ruleAdmin,
+	"statsCSV":              ruleAdmin,
+	"slo":                   ruleAdmin,
+	"allTreats":             ruleAdmin,
+	"export":                ruleAdmin,
+	"tags":                  ruleAdmin,
+	"tagsJSON":              ruleAdmin,
+	"renameTags":            ruleAdmin,
+	"mergeTags":             ruleAdmin,
+	"deleteTags":            ruleAdmin,
+	"deadLetters":           ruleAdmin,
+	"redriveDeadLetter":     ruleAdmin,
+	"discardDeadLetter":     ruleAdmin,
+	"discardDeadLetterPost": ruleAdmin,
+	"dualWrite":             ruleAdmin,
+	"securityLog":           ruleAdmin,
+	"impersonate":           ruleAdmin,
+	"signingKeys":           ruleAdmin,
+	"reissueCookies":        ruleAdmin,
+	"coldStorage":           ruleAdmin,
+	"coldRestore":           ruleAdmin,
+	"reviewQueue":           ruleAdmin,
+	"approveTreat":          ruleAdmin,
+	"rejectTreat":           ruleAdmin,
+	"dismissReports":        ruleAdmin,
+	"operations":            ruleAdmin,
+	"startOperation":        ruleAdmin,
+	"webhooks":              ruleAdmin,
+	"sheets":                ruleAdmin,
+	"syncSheet":             ruleAdmin,
+
+	"archiveExpiredTask": ruleCron,
+	"purgeDeletedTask":   ruleCron,
+	"dispatchOutboxTask": ruleCron,
+	"coldStorageTask":    ruleCron,
+	"syncSheetTask":      ruleCron,
+
+	// Inbound integrations check their own signatures or tokens.
+	"inboundWebhook": ruleAnyone,
+	"gcsInbox":       ruleAnyone,
+	"emailIn":        ruleAnyone,
+	"slackCommand":   ruleAnyone,
+
+	"openAPI":   ruleAnyone,
+	"apiDocs":   ruleAnyone,
+	"apiSchema": ruleAnyone,
+	"events":    ruleAnyone,
+	"healthz":   ruleAnyone,
+	"warmup":    ruleAnyone,
+	"oembed":    ruleAnyone,
+	"logs":      ruleAnyone,
+	"errors":    ruleAnyone,
+
+	"pprof":        ruleDebug,
+	"pprofCmdline": ruleDebug,
+	"pprofProfile": ruleDebug,
+	"pprofSymbol":  ruleDebug,
+	"pprofTrace":   ruleDebug,
+	"debugVars":    ruleDebug,
+	"faults":       ruleDebug,
+	"testReset":    ruleDebug,
+}
+
+// apiRoutePolicy maps the names of the JSON API's routes to their Rules.
+// They are evaluated by the API router, after apiTokens has found the
+// token's user; token scopes are checked by apiTokens.
+var apiRoutePolicy = map[string]Rule{
+	"apiListTreats":   ruleAnyone,
+	"apiWindowTreats": ruleAnyone,
+	"apiGetTreat":     ruleAnyone,
+	"apiCreateTreat":  ruleAnyone,
+	// Who may change each treat of a batch update is checked per treat,
+	// see mayChange.
+	"apiBatchCreateTreats": ruleAnyone,
+	"apiBatchUpdateTreats": ruleAnyone,
+	"apiUpdateTreat":       ruleOwner,
+	"apiPatchTreat":        ruleOwner,
+	"apiDeleteTreat":       ruleOwner,
+	"apiClearRecent":       ruleAnyone,
+	"apiCommands":          ruleAnyone,
+
+	"apiListShelves": ruleSignedIn,
+	"apiCreateShelf": ruleSignedIn,
+	"apiShelfTreats": ruleSignedIn,
+	"apiDeleteShelf": ruleSignedIn,
+
+	"apiImportTreats":    ruleAdmin,
+	"apiReindexTreats":   ruleAdmin,
+	"apiBackupTreats":    ruleAdmin,
+	"apiBackfillAltText": ruleAdmin,
+	"apiStats":           ruleAdmin,
+	"apiListOperations":  ruleAdmin,
+	"apiGetOperation":    ruleAdmin,
+}
+
+// policyDenials counts refused requests by route. Served at /debug/vars.
+var policyDenials = expvar.NewMap("policyDenials")
+
+// authorize returns mux middleware that refuses requests the Rule of their
+// route in policy doesn't allow. Routes not in policy are left alone if
+// skip has them, and refused otherwise.
+func (t *Treatshelf) authorize(policy, skip map[string]Rule) mux.MiddlewareFunc {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			name := ""
+			if route := mux.CurrentRoute(r); route != nil {
+				name = route.GetName()
+			}
+			if _, ok := skip[name]; ok {
+				h.ServeHTTP(w, r)
+				return
+			}
+			rule, ok := policy[name]
+			var e *appError
+			if !ok {
+				err := fmt.Errorf("no policy for route %q", name)
+				e = t.appErrorCodef(r, http.StatusForbidden, err, "access denied")
+			} else {
+				e = t.evaluate(rule, r)
+			}
+			if e != nil {
+				policyDenials.Add(name, 1)
+				fmt.Fprintf(t.logWriter, "Policy: denied %s %s (%s) to %q: %v\n", r.Method, name, rule, t.currentUser(r), e.err)
+				serveError(w, r, e)
+				return
+			}
+			if rule != ruleAnyone {
+				fmt.Fprintf(t.logWriter, "Policy: allowed %s %s (%s) to %q\n", r.Method, name, rule, t.currentUser(r))
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+// evaluate returns an appError unless r satisfies rule.
+func (t *Treatshelf) evaluate(rule Rule, r *http.Request) *appError {
+	switch rule {
+	case ruleAnyone:
+		return nil
+	case ruleSignedIn:
+		if t.currentUser(r) != "" {
+			return nil
+		}
+		err := errors.New("sign in to continue")
+		return t.appErrorCodef(r, http.StatusUnauthorized, err, "%v", err)
+	case ruleAdmin:
+		return t.requireAdmin(r)
+	case ruleOwner:
+		return t.requireOwner(r)
+	case ruleCron:
+		return t.requireCron(r)
+	case ruleDebug:
+		if t.isAdmin(r) || isLocalRequest(r) {
+			return nil
+		}
+		err := errors.New("debug endpoints are restricted to admins")
+		return t.appErrorCodef(r, http.StatusForbidden, err, "%v", err)
+	}
+	err := fmt.Errorf("unknown rule %q", rule)
+	return t.appErrorf(r, err, "%v", err)
+}
+
+// mayChange reports whether r may change treat, as ruleOwner describes.
+func (t *Treatshelf) mayChange(r *http.Request, treat *Treat) bool {
+	if treat.CreatedBy == "" || t.isAdmin(r) {
+		return true
+	}
+	u := t.currentUser(r)
+	return u != "" && u == treat.CreatedBy
+}
+
+// requireOwner returns a 403 appError unless the treat in the route's {id}
+// was added by the current user, or by nobody signed in, or the request was
+// made by an admin. Treats that can't be found are left to the handler.
+func (t *Treatshelf) requireOwner(r *http.Request) *appError {
+	treat, err := t.treatFromRequest(r)
+	if err != nil || t.mayChange(r, treat) {
+		return nil
+	}
+	err = errors.New("only the person who added this treat, or an admin, can change it")
+	return t.appErrorCodef(r, http.StatusForbidden, err, "%v", err)
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// policyShelf returns a Treatshelf backed by a memoryDB holding a treat
+// added by owner@example.com and one added by nobody signed in, with
+// admin@example.com as its admin.
+func policyShelf(t *testing.T) (shelf *Treatshelf, owned, anonymous string) {
+	shelf, db := newTestShelf(t, withAdmin("admin@example.com"))
+	ctx := context.Background()
+	owned, err := db.AddTreat(ctx, &Treat{Title: "Owned", CreatedBy: "owner@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	anonymous, err = db.AddTreat(ctx, &Treat{Title: "Anonymous"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return shelf, owned, anonymous
+}
+
+func TestEveryRouteHasPolicy(t *testing.T) {
+	// A base path adds the "base" route.
+	shelf := &Treatshelf{basePath: "/shelf", logWriter: ioutil.Discard}
+	shelf.Handler()
+
+	routed := make(map[string]bool)
+	err := shelf.routes.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		name := route.GetName()
+		if name == "" {
+			return nil
+		}
+		routed[name] = true
+		tpl, _ := route.GetPathTemplate()
+		_, app := routePolicy[name]
+		// The routes of every API version share apiRoutePolicy.
+		inAPI, api := false, false
+		for _, v := range apiVersions {
+			if strings.HasPrefix(tpl, "/shelf/api/"+v.Name+"/") {
+				inAPI = true
+				_, api = v.policy(apiRoutePolicy)[name]
+			}
+		}
+		switch {
+		case app && api:
+			t.Errorf("route %q is in both routePolicy and apiRoutePolicy", name)
+		case inAPI && !api:
+			t.Errorf("API route %q (%s) has no policy in apiRoutePolicy", name, tpl)
+		case !inAPI && !app:
+			t.Errorf("route %q (%s) has no policy in routePolicy", name, tpl)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, policy := range []map[string]Rule{routePolicy, apiRoutePolicy} {
+		for name := range policy {
+			if !routed[name] {
+				t.Errorf("policy for %q, which is not a route", name)
+			}
+		}
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	shelf, owned, anonymous := policyShelf(t)
+	anonymized, err := shelf.DB.AddTreat(context.Background(), &Treat{Title: "Anonymized", CreatedBy: deletedAccount})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		rule   Rule
+		user   string
+		cron   bool
+		treat  string
+		status int
+	}{
+		{rule: ruleAnyone},
+		{rule: ruleAnyone, user: "someone@example.com"},
+
+		{rule: ruleSignedIn, status: http.StatusUnauthorized},
+		{rule: ruleSignedIn, user: "someone@example.com"},
+
+		{rule: ruleAdmin, status: http.StatusForbidden},
+		{rule: ruleAdmin, user: "someone@example.com", status: http.StatusForbidden},
+		{rule: ruleAdmin, user: "admin@example.com"},
+
+		{rule: ruleOwner, treat: owned, status: http.StatusForbidden},
+		{rule: ruleOwner, treat: owned, user: "someone@example.com", status: http.StatusForbidden},
+		{rule: ruleOwner, treat: owned, user: "owner@example.com"},
+		{rule: ruleOwner, treat: owned, user: "admin@example.com"},
+		{rule: ruleOwner, treat: anonymous},
+		{rule: ruleOwner, treat: anonymous, user: "someone@example.com"},
+		{rule: ruleOwner, treat: anonymized, status: http.StatusForbidden},
+		{rule: ruleOwner, treat: anonymized, user: "someone@example.com", status: http.StatusForbidden},
+		{rule: ruleOwner, treat: anonymized, user: "admin@example.com"},
+		// Handlers report treats that don't exist.
+		{rule: ruleOwner, treat: "missing"},
+
+		{rule: ruleCron, status: http.StatusForbidden},
+		{rule: ruleCron, user: "admin@example.com", status: http.StatusForbidden},
+		{rule: ruleCron, cron: true},
+
+		{rule: ruleDebug, status: http.StatusForbidden},
+		{rule: ruleDebug, user: "someone@example.com", status: http.StatusForbidden},
+		{rule: ruleDebug, user: "admin@example.com"},
+
+		{rule: "unknown", user: "admin@example.com", status: http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		if tt.user != "" {
+			r.Header.Set(iapEmailHeader, "accounts.google.com:"+tt.user)
+		}
+		if tt.cron {
+			r.Header.Set("X-Appengine-Cron", "true")
+		}
+		if tt.treat != "" {
+			r = mux.SetURLVars(r, map[string]string{"id": tt.treat})
+		}
+		status := 0
+		if e := shelf.evaluate(tt.rule, r); e != nil {
+			status = e.code
+		}
+		if status != tt.status {
+			t.Errorf("evaluate(%s) for user %q, cron %v, treat %q: got status %d, want %d", tt.rule, tt.user, tt.cron, tt.treat, status, tt.status)
+		}
+	}
+}
+
+func TestEveryAPIVersionAuthorized(t *testing.T) {
+	shelf, owned, _ := policyShelf(t)
+	h := shelf.Handler()
+	for _, v := range apiVersions {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/api/"+v.Name+"/treats/"+owned, nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("API %s: got status %d, want %d: %s", v.Name, w.Code, http.StatusOK, w.Body)
+		}
+	}
+}
+
+func TestBatchDeleteChecksOwners(t *testing.T) {
+	shelf, owned, _ := policyShelf(t)
+	h := shelf.Handler()
+	tests := []struct {
+		user   string
+		status int
+	}{
+		{"", http.StatusForbidden},
+		{"someone@example.com", http.StatusForbidden},
+		{"owner@example.com", http.StatusFound},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", "/treats:batchDelete", strings.NewReader("id="+owned))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if tt.user != "" {
+			r.Header.Set(iapEmailHeader, "accounts.google.com:"+tt.user)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tt.status {
+			t.Errorf("user %q: got status %d, want %d: %s", tt.user, w.Code, tt.status, w.Body)
+		}
+		treat, err := shelf.DB.GetTreat(context.Background(), owned)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if deleted := tt.status == http.StatusFound; treat.Deleted() != deleted {
+			t.Errorf("user %q: treat deleted = %v, want %v", tt.user, treat.Deleted(), deleted)
+		}
+	}
+}
+
+func TestProviderSignInsAreNotAdminsBehindIAP(t *testing.T) {
+	shelf, _, _ := policyShelf(t)
+	shelf.authProviders = []*AuthProvider{{Name: "okta"}}
+	w := httptest.NewRecorder()
+	if err := shelf.setSignedCookie(w, loginCookie, login{Email: "admin@example.com", Expires: shelf.now().Add(time.Hour)}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(w.Result().Cookies()[0])
+	if u := shelf.currentUser(r); u != "admin@example.com" {
+		t.Fatalf("currentUser() = %q, want the provider's user", u)
+	}
+	if shelf.isAdmin(r) {
+		t.Error("isAdmin() = true for a provider sign-in behind IAP, want false")
+	}
+
+	// IAP's user comes before the provider's.
+	r.Header.Set(iapEmailHeader, "accounts.google.com:someone@example.com")
+	if u := shelf.currentUser(r); u != "someone@example.com" {
+		t.Errorf("currentUser() = %q, want IAP's user", u)
+	}
+}
+
+func TestSessionUsersResolvedOnce(t *testing.T) {
+	shelf, _, _ := policyShelf(t)
+	var users []string
+	h := withSessionUsers(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		users = append(users, shelf.currentUser(r))
+		// Later checks use the user first resolved.
+		r.Header.Set(iapEmailHeader, "accounts.google.com:someone@example.com")
+		users = append(users, shelf.currentUser(r))
+	}))
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set(iapEmailHeader, "accounts.google.com:admin@example.com")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	for _, u := range users {
+		if u != "admin@example.com" {
+			t.Errorf("currentUser() = %q, want admin@example.com", u)
+		}
+	}
+}
+
+func TestReleaseClaimChecksClaimant(t *testing.T) {
+	shelf, owned, _ := policyShelf(t)
+	h := shelf.Handler()
+	w := httptest.NewRecorder()
+	if err := shelf.saveSession(w, &session{ID: "claimant"}); err != nil {
+		t.Fatal(err)
+	}
+	claimantSession := w.Result().Cookies()[0]
+
+	tests := []struct {
+		user    string
+		session bool
+		status  int
+	}{
+		{"", false, http.StatusForbidden},
+		{"other@example.com", false, http.StatusForbidden},
+		{"someone@example.com", false, http.StatusFound},
+		{"", true, http.StatusFound},
+		{"admin@example.com", false, http.StatusFound},
+	}
+	ctx := context.Background()
+	for _, tt := range tests {
+		id, err := shelf.DB.ClaimTreat(ctx, owned, &Claim{Name: "Sam", Portions: 1, ClaimedBy: "someone@example.com", Session: "claimant"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := httptest.NewRequest("DELETE", "/treats/"+owned+"/claims/"+id, nil)
+		if tt.user != "" {
+			r.Header.Set(iapEmailHeader, "accounts.google.com:"+tt.user)
+		}
+		if tt.session {
+			r.AddCookie(claimantSession)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tt.status {
+			t.Errorf("user %q, claimant's session %v: got status %d, want %d: %s", tt.user, tt.session, w.Code, tt.status, w.Body)
+		}
+		if tt.status != http.StatusFound {
+			shelf.DB.ReleaseClaim(ctx, owned, id)
+		}
+	}
+}
+
+func TestClaimChecksVisibility(t *testing.T) {
+	shelf, db := newTestShelf(t, withAdmin("admin@example.com"))
+	h := shelf.Handler()
+	ctx := context.Background()
+	tests := []struct {
+		name   string
+		treat  *Treat
+		user   string
+		status int
+	}{
+		{"visible", &Treat{Title: "Brownie", Quantity: intp(2)}, "", http.StatusFound},
+		{"not yet visible", &Treat{Title: "Brownie", Quantity: intp(2), VisibleFrom: testEpoch.Add(time.Hour)}, "", http.StatusNotFound},
+		{"no longer visible", &Treat{Title: "Brownie", Quantity: intp(2), VisibleUntil: testEpoch}, "admin@example.com", http.StatusNotFound},
+		{"under review", &Treat{Title: "Brownie", Quantity: intp(2), Review: reviewPending, CreatedBy: "owner@example.com"}, "", http.StatusNotFound},
+		{"under review, by its owner", &Treat{Title: "Brownie", Quantity: intp(2), Review: reviewPending, CreatedBy: "owner@example.com"}, "owner@example.com", http.StatusFound},
+	}
+	for _, tt := range tests {
+		id, err := db.AddTreat(ctx, tt.treat)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := httptest.NewRequest("POST", "/treats/"+id+":claim", strings.NewReader("name=Sam&portions=1"))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if tt.user != "" {
+			r.Header.Set(iapEmailHeader, "accounts.google.com:"+tt.user)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tt.status {
+			t.Errorf("%s: got status %d, want %d: %s", tt.name, w.Code, tt.status, w.Body)
+		}
+		claims, err := db.ListClaims(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if claimed := len(claims) > 0; claimed != (tt.status == http.StatusFound) {
+			t.Errorf("%s: claims = %+v", tt.name, claims)
+		}
+	}
+}
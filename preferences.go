@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// Preferences are per-user (or, for anonymous visitors, per-session) display
+// settings, edited on the /settings page.
+type Preferences struct {
+	PageSize int    // treats per list page.
+	Sort     string // default list order, see ListOptions.Sort.
+	Theme    string // "light" or "dark".
+	Locale   string // overrides Accept-Language when set.
+
+	// HiddenAllergens are left out of lists, see Treat.Allergens.
+	HiddenAllergens []string
+}
+
+const (
+	defaultPageSize = 25
+	maxPageSize     = 100
+)
+
+// defaultPreferences returns the preferences of someone who has not changed
+// any settings.
+func defaultPreferences() *Preferences {
+	return &Preferences{
+		PageSize: defaultPageSize,
+		Sort:     sortByTitle,
+		Theme:    "light",
+	}
+}
+
+// Hides reports whether treats containing allergen are hidden.
+func (p *Preferences) Hides(allergen string) bool {
+	for _, a := range p.HiddenAllergens {
+		if a == allergen {
+			return true
+		}
+	}
+	return false
+}
+
+// PreferencesDatabase provides thread-safe access to stored preferences.
+type PreferencesDatabase interface {
+	// GetPreferences retrieves the preferences stored under key, or nil if
+	// there are none.
+	GetPreferences(ctx context.Context, key string) (*Preferences, error)
+
+	// SetPreferences stores preferences under key.
+	SetPreferences(ctx context.Context, key string, p *Preferences) error
+
+	// DeletePreferences removes the preferences stored under key, if any.
+	DeletePreferences(ctx context.Context, key string) error
+}
+
+// preferencesKey identifies whose preferences apply to the request: the
+// signed-in user if there is one, otherwise the browser session.
+func (t *Treatshelf) preferencesKey(r *http.Request) string {
+	if u := t.currentUser(r); u != "" {
+		return "user:" + u
+	}
+	return "session:" + t.session(r).ID
+}
+
+// preferences returns the preferences for the request, falling back to the
+// defaults if none are stored or they cannot be read.
+func (t *Treatshelf) preferences(r *http.Request) *Preferences {
+	if t.Preferences == nil {
+		return defaultPreferences()
+	}
+	p, err := t.Preferences.GetPreferences(r.Context(), t.preferencesKey(r))
+	if err != nil {
+		fmt.Fprintf(t.logWriter, "Could not load preferences: %v\n", err)
+	}
+	if p == nil {
+		return defaultPreferences()
+	}
+	return p
+}
+
+// locale returns the locale to format the response in.
+func (t *Treatshelf) locale(r *http.Request) string {
+	return t.preferences(r).localeFor(r)
+}
+
+// localeFor returns the preferred locale, or the best match for the
+// request's Accept-Language header if there is none.
+func (p *Preferences) localeFor(r *http.Request) string {
+	if p.Locale != "" {
+		return p.Locale
+	}
+	return localeFromRequest(r)
+}
+
+// preferencesFromForm populates Preferences from form values
+// (see templates/settings.html).
+func preferencesFromForm(r *http.Request) (*Preferences, error) {
+	p := defaultPreferences()
+	if s := r.FormValue("pageSize"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxPageSize {
+			return nil, fmt.Errorf("page size must be between 1 and %d", maxPageSize)
+		}
+		p.PageSize = n
+	}
+	switch s := r.FormValue("sort"); s {
+	case sortByTitle, sortByPrice, sortByPriceDesc:
+		p.Sort = s
+	case "":
+	default:
+		return nil, fmt.Errorf("unknown sort order %q", s)
+	}
+	switch s := r.FormValue("theme"); s {
+	case "light", "dark":
+		p.Theme = s
+	case "":
+	default:
+		return nil, fmt.Errorf("unknown theme %q", s)
+	}
+	if s := r.FormValue("locale"); s != "" {
+		if _, ok := localeFormats[s]; !ok {
+			return nil, fmt.Errorf("unsupported locale %q", s)
+		}
+		p.Locale = s
+	}
+	for _, a := range r.Form["hiddenAllergens"] {
+		if !isAllergen(a) {
+			return nil, fmt.Errorf("unknown allergen %q", a)
+		}
+		p.HiddenAllergens = append(p.HiddenAllergens, a)
+	}
+	return p, nil
+}
+
+// settingsHandler displays the preferences form.
+func (t *Treatshelf) settingsHandler(w http.ResponseWriter, r *http.Request) *appError {
+	var locales []string
+	for l := range localeFormats {
+		locales = append(locales, l)
+	}
+	sort.Strings(locales)
+	return settingsTmpl.Execute(t, w, r, struct {
+		*Preferences
+		Locales   []string
+		Allergens []string
+	}{
+		Preferences: t.preferences(r),
+		Locales:     locales,
+		Allergens:   allergens,
+	})
+}
+
+// saveSettingsHandler stores the preferences from the settings form.
+func (t *Treatshelf) saveSettingsHandler(w http.ResponseWriter, r *http.Request) *appError {
+	p, err := preferencesFromForm(r)
+	if err != nil {
+		return t.appErrorf(r, err, "invalid settings: %v", err)
+	}
+	// Anonymous preferences are keyed by session, so make sure the browser
+	// keeps the session the preferences are stored under.
+	s := t.session(r)
+	if err := t.saveSession(w, s); err != nil {
+		return t.appErrorf(r, err, "could not save session: %v", err)
+	}
+	key := "session:" + s.ID
+	if u := t.currentUser(r); u != "" {
+		key = "user:" + u
+	}
+	if err := t.Preferences.SetPreferences(r.Context(), key, p); err != nil {
+		return t.appErrorf(r, err, "could not save settings: %v", err)
+	}
+	http.Redirect(w, r, t.routeURL("settings"), http.StatusFound)
+	return nil
+}
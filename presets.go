@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"cloud.google.com/go/storage"
+	"github.com/gorilla/mux"
+)
+
+// Pictures are shown at a few sizes, named image presets, rather than
+// at any size a template asks for: {{img "thumb" .ImageURL}}. Pictures in
+// the app's buckets are resized by imageHandler, which serves registered
+// presets only, so that nobody can make it render pictures at arbitrary
+// sizes. Other pictures are shown as they are, and treats without one get
+// a placeholder of the preset's size.
+//
+// IMAGE_PRESETS changes or adds presets: thumb=64x64,hero=1200x800:png.
+
+// imagePreset is the box a picture is scaled down to fit in, and the
+// format it is served in.
+type imagePreset struct {
+	Width, Height int
+	// Format is "jpeg" or "png".
+	Format string
+}
+
+// defaultImagePresets are the presets the templates use.
+var defaultImagePresets = map[string]imagePreset{
+	"thumb": {Width: 64, Height: 64, Format: "jpeg"},
+	"card":  {Width: 200, Height: 300, Format: "jpeg"},
+	"hero":  {Width: 800, Height: 600, Format: "jpeg"},
+}
+
+const (
+	// maxPresetSize is the most pixels a preset may be wide or tall.
+	maxPresetSize = 2000
+	// maxResizeBytes bounds the pictures imageHandler reads.
+	maxResizeBytes = 32 << 20
+)
+
+// parseImagePresets returns the default presets changed by s, a
+// comma-separated list of name=WIDTHxHEIGHT, optionally followed by
+// :jpeg or :png.
+func parseImagePresets(s string) (map[string]imagePreset, error) {
+	presets := make(map[string]imagePreset, len(defaultImagePresets))
+	for name, p := range defaultImagePresets {
+		presets[name] = p
+	}
+	for _, spec := range strings.Split(s, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		eq := strings.Index(spec, "=")
+		if eq < 1 {
+			return nil, fmt.Errorf("preset %q: want name=WIDTHxHEIGHT", spec)
+		}
+		name, size := spec[:eq], spec[eq+1:]
+		if strings.Trim(name, "abcdefghijklmnopqrstuvwxyz") != "" {
+			return nil, fmt.Errorf("preset %q: names are lower case letters", spec)
+		}
+		p := imagePreset{Format: "jpeg"}
+		if i := strings.Index(size, ":"); i >= 0 {
+			size, p.Format = size[:i], size[i+1:]
+		}
+		if p.Format != "jpeg" && p.Format != "png" {
+			return nil, fmt.Errorf("preset %q: format must be jpeg or png", spec)
+		}
+		x := strings.Index(size, "x")
+		if x < 0 {
+			return nil, fmt.Errorf("preset %q: want name=WIDTHxHEIGHT", spec)
+		}
+		var err error
+		if p.Width, err = strconv.Atoi(size[:x]); err != nil || p.Width < 1 || p.Width > maxPresetSize {
+			return nil, fmt.Errorf("preset %q: width must be 1 to %d pixels", spec, maxPresetSize)
+		}
+		if p.Height, err = strconv.Atoi(size[x+1:]); err != nil || p.Height < 1 || p.Height > maxPresetSize {
+			return nil, fmt.Errorf("preset %q: height must be 1 to %d pixels", spec, maxPresetSize)
+		}
+		presets[name] = p
+	}
+	return presets, nil
+}
+
+// imagePresets holds the presets of the last Treatshelf whose Handler was
+// set up, for img, which like route is shared by every Treatshelf.
+var imagePresets atomic.Value // map[string]imagePreset
+
+// presets returns t's image presets.
+func (t *Treatshelf) presets() map[string]imagePreset {
+	if t.imagePresets == nil {
+		return defaultImagePresets
+	}
+	return t.imagePresets
+}
+
+// img returns the URL to show the picture at url at the named preset:
+// {{img "thumb" .ImageURL}}. It fails for unknown presets, so that typos
+// show up when the template is executed.
+func img(preset, url string) (string, error) {
+	presets, _ := imagePresets.Load().(map[string]imagePreset)
+	if presets == nil {
+		presets = defaultImagePresets
+	}
+	p, ok := presets[preset]
+	if !ok {
+		return "", fmt.Errorf("img: unknown preset %q", preset)
+	}
+	if url == "" {
+		return fmt.Sprintf(placeholderImage, p.Width, p.Height), nil
+	}
+	rest := strings.TrimPrefix(url, strings.TrimSuffix(fmt.Sprintf(publicURL, "", ""), "/"))
+	slash := strings.Index(rest, "/")
+	if rest == url || slash < 1 || slash == len(rest)-1 {
+		return url, nil
+	}
+	return route("image", "preset", preset, "bucket", rest[:slash], "name", rest[slash+1:])
+}
+
+// imageHandler serves a picture in the picture or thumbnail bucket at a
+// registered preset. Pictures that can't be resized, such as those in
+// other buckets or in formats the standard library can't decode, are
+// redirected to as they are.
+func (t *Treatshelf) imageHandler(w http.ResponseWriter, r *http.Request) *appError {
+	vars := mux.Vars(r)
+	p, ok := t.presets()[vars["preset"]]
+	if !ok {
+		err := fmt.Errorf("no image preset %q", vars["preset"])
+		return t.appErrorCodef(r, http.StatusNotFound, err, "%v", err)
+	}
+	name := vars["name"]
+	original := fmt.Sprintf(publicURL, vars["bucket"], name)
+	bucket, ok := t.imageBucket(vars["bucket"])
+	if !ok {
+		http.Redirect(w, r, original, http.StatusFound)
+		return nil
+	}
+	b, _, err := readObject(r.Context(), bucket, name, maxResizeBytes)
+	if err == storage.ErrObjectNotExist {
+		return t.appErrorCodef(r, http.StatusNotFound, err, "no picture %q", name)
+	}
+	if err != nil {
+		return t.appErrorf(r, err, "could not read picture: %v", err)
+	}
+
+	out, err := t.images.process(r.Context(), bytes.NewReader(b), p.render)
+	if err == errImagesBusy {
+		w.Header().Set("Retry-After", "5")
+		return t.appErrorCodef(r, http.StatusServiceUnavailable, err, "%v", err)
+	}
+	if err != nil {
+		fmt.Fprintf(t.logWriter, "Serving %q as it is: %v\n", name, err)
+		http.Redirect(w, r, original, http.StatusFound)
+		return nil
+	}
+	w.Header().Set("Content-Type", "image/"+p.Format)
+	w.Write(out)
+	return nil
+}
+
+// imageBucket returns the picture or thumbnail bucket with the given
+// name, or false if it is neither.
+func (t *Treatshelf) imageBucket(name string) (*storage.BucketHandle, bool) {
+	for _, get := range []func() (*storage.BucketHandle, string, error){t.pictureBucket, t.thumbnailBucket} {
+		if b, n, err := get(); err == nil && n == name {
+			return b, true
+		}
+	}
+	return nil, false
+}
+
+// render decodes the picture in r and returns it scaled down to fit p, in
+// p's format.
+func (p imagePreset) render(r io.Reader) ([]byte, error) {
+	src, _, err := image.Decode(r)
+	if err != nil {
+		return nil, err
+	}
+	dst, err := scaleToFit(src, p.Width, p.Height)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if p.Format == "png" {
+		err = png.Encode(&buf, dst)
+	} else {
+		err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: thumbnailQuality})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	_ "image/jpeg"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseImagePresets(t *testing.T) {
+	presets, err := parseImagePresets("thumb=32x32, banner=1200x400:png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]imagePreset{
+		"thumb":  {Width: 32, Height: 32, Format: "jpeg"},
+		"card":   defaultImagePresets["card"],
+		"banner": {Width: 1200, Height: 400, Format: "png"},
+	} {
+		if got := presets[name]; got != want {
+			t.Errorf("preset %s = %+v, want %+v", name, got, want)
+		}
+	}
+	for _, s := range []string{"thumb", "Thumb=1x1", "thumb=64", "thumb=0x10", "thumb=10x9999", "thumb=10x10:webp"} {
+		if _, err := parseImagePresets(s); err == nil {
+			t.Errorf("parseImagePresets(%q) succeeded", s)
+		}
+	}
+}
+
+func TestImg(t *testing.T) {
+	goldenShelf(t)
+	for _, tt := range []struct {
+		preset, url, want string
+	}{
+		{"thumb", "", "https://placekitten.com/g/64/64"},
+		{"card", "https://example.com/cake.jpg", "https://example.com/cake.jpg"},
+		{"hero", "https://storage.googleapis.com/pics/1.png", "images/hero/pics/1.png"},
+		{"card", "https://storage.googleapis.com/pics/thumbnails/1.jpg", "images/card/pics/thumbnails/1.jpg"},
+	} {
+		got, err := img(tt.preset, tt.url)
+		if err != nil || got != tt.want {
+			t.Errorf("img(%q, %q) = %q, %v; want %q", tt.preset, tt.url, got, err, tt.want)
+		}
+	}
+	if _, err := img("huge", ""); err == nil {
+		t.Error("img with an unknown preset succeeded")
+	}
+}
+
+func TestImageHandler(t *testing.T) {
+	shelf := goldenShelf(t)
+	h := shelf.Handler()
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+
+	// Only registered presets are served, whatever the picture.
+	if w := get("/images/giant/pics/1.png"); w.Code != http.StatusNotFound {
+		t.Errorf("unknown preset: got status %d, want %d", w.Code, http.StatusNotFound)
+	}
+	// Pictures in other buckets are shown as they are.
+	w := get("/images/thumb/pics/1.png")
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "https://storage.googleapis.com/pics/1.png" {
+		t.Errorf("other bucket: got status %d to %q, want a redirect to the picture", w.Code, w.Header().Get("Location"))
+	}
+}
+
+func TestPresetRender(t *testing.T) {
+	p := imagePreset{Width: 200, Height: 300, Format: "jpeg"}
+	out, err := p.render(bytes.NewReader(testPNG(t, 1000, 500)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if format != "jpeg" || cfg.Width != 200 || cfg.Height != 100 {
+		t.Errorf("rendered a %dx%d %s, want a 200x100 jpeg", cfg.Width, cfg.Height, format)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Price is an amount of money in a given currency.
+type Price struct {
+	Amount   int64  // in minor units of Currency, e.g. cents.
+	Currency string // ISO 4217 code, e.g. "USD".
+}
+
+// currencyInfo describes how to store and display a currency.
+type currencyInfo struct {
+	digits int    // number of minor unit digits.
+	symbol string // display symbol.
+}
+
+// currencies lists the currencies a price may be given in.
+var currencies = map[string]currencyInfo{
+	"USD": {2, "$"},
+	"CAD": {2, "CA$"},
+	"AUD": {2, "A$"},
+	"EUR": {2, "€"},
+	"GBP": {2, "£"},
+	"CHF": {2, "CHF"},
+	"JPY": {0, "¥"},
+	"KRW": {0, "₩"},
+	"INR": {2, "₹"},
+}
+
+// currencyCodes is the sorted list of supported currency codes, for forms.
+var currencyCodes = []string{"AUD", "CAD", "CHF", "EUR", "GBP", "INR", "JPY", "KRW", "USD"}
+
+// localeFormat describes how a locale writes amounts of money.
+type localeFormat struct {
+	decimal     string
+	group       string
+	symbolAfter bool // "12,50 €" rather than "€12.50".
+}
+
+var (
+	defaultLocale = "en-US"
+
+	localeFormats = map[string]localeFormat{
+		"en-US": {".", ",", false},
+		"en-GB": {".", ",", false},
+		"en-IN": {".", ",", false},
+		"ja-JP": {".", ",", false},
+		"de-DE": {",", ".", true},
+		"es-ES": {",", ".", true},
+		"fr-FR": {",", " ", true},
+		"it-IT": {",", ".", true},
+		"de-CH": {".", "’", false},
+	}
+)
+
+// localeFromRequest picks the best supported locale from the request's
+// Accept-Language header.
+func localeFromRequest(r *http.Request) string {
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		tag := strings.TrimSpace(strings.SplitN(part, ";", 2)[0])
+		if tag == "" {
+			continue
+		}
+		if l, ok := matchLocale(tag); ok {
+			return l
+		}
+	}
+	return defaultLocale
+}
+
+// matchLocale matches a BCP 47 language tag against the supported locales,
+// falling back to the first supported locale for the same language.
+func matchLocale(tag string) (string, bool) {
+	for l := range localeFormats {
+		if strings.EqualFold(l, tag) {
+			return l, true
+		}
+	}
+	lang := strings.ToLower(strings.SplitN(tag, "-", 2)[0])
+	best := ""
+	for l := range localeFormats {
+		if strings.HasPrefix(l, lang+"-") && (best == "" || l < best) {
+			best = l
+		}
+	}
+	return best, best != ""
+}
+
+// parsePrice parses a decimal amount such as "12.50" in the given currency
+// into a Price stored as minor units.
+func parsePrice(amount, currency string) (*Price, error) {
+	currency = strings.ToUpper(strings.TrimSpace(currency))
+	info, ok := currencies[currency]
+	if !ok {
+		return nil, fmt.Errorf("unsupported currency %q", currency)
+	}
+
+	amount = strings.TrimSpace(amount)
+	parts := strings.SplitN(amount, ".", 2)
+	whole, frac := parts[0], ""
+	if len(parts) == 2 {
+		frac = parts[1]
+	}
+	if len(frac) > info.digits {
+		return nil, fmt.Errorf("%s amounts have at most %d decimal places, got %q", currency, info.digits, amount)
+	}
+	frac += strings.Repeat("0", info.digits-len(frac))
+
+	if whole == "" {
+		whole = "0"
+	}
+	minor, err := strconv.ParseInt(whole+frac, 10, 64)
+	if err != nil || strings.HasPrefix(whole, "-") || strings.HasPrefix(whole, "+") {
+		return nil, fmt.Errorf("invalid amount %q", amount)
+	}
+	return &Price{Amount: minor, Currency: currency}, nil
+}
+
+// validate checks a price that did not come from parsePrice, such as one
+// decoded from JSON.
+func (p *Price) validate() error {
+	if _, ok := currencies[p.Currency]; !ok {
+		return fmt.Errorf("unsupported currency %q", p.Currency)
+	}
+	if p.Amount < 0 {
+		return fmt.Errorf("invalid amount %d", p.Amount)
+	}
+	return nil
+}
+
+// priceFromForm parses the optional price form fields
+// (see templates/edit.html). It returns nil if no price was given.
+func priceFromForm(r *http.Request) (*Price, error) {
+	amount := strings.TrimSpace(r.FormValue("price"))
+	if amount == "" {
+		return nil, nil
+	}
+	return parsePrice(amount, r.FormValue("currency"))
+}
+
+// Decimal returns the amount as a plain decimal string, e.g. "12.50".
+func (p *Price) Decimal() string {
+	return p.digits(".", "")
+}
+
+// Format renders the price for display in the given locale, e.g. "$1,234.50"
+// for en-US or "1.234,50 €" for de-DE.
+func (p *Price) Format(locale string) string {
+	f, ok := localeFormats[locale]
+	if !ok {
+		f = localeFormats[defaultLocale]
+	}
+	sym := p.Currency
+	if info, ok := currencies[p.Currency]; ok {
+		sym = info.symbol
+	}
+	n := p.digits(f.decimal, f.group)
+	if f.symbolAfter {
+		return n + " " + sym
+	}
+	return sym + n
+}
+
+// String renders the price in the default locale.
+func (p *Price) String() string {
+	return p.Format(defaultLocale)
+}
+
+// digits formats the amount with the given decimal and grouping separators.
+func (p *Price) digits(decimal, group string) string {
+	d := currencies[p.Currency].digits
+	s := strconv.FormatInt(p.Amount, 10)
+	if len(s) <= d {
+		s = strings.Repeat("0", d-len(s)+1) + s
+	}
+	whole, frac := s[:len(s)-d], s[len(s)-d:]
+
+	if group != "" {
+		var b strings.Builder
+		for i, c := range whole {
+			if i > 0 && (len(whole)-i)%3 == 0 {
+				b.WriteString(group)
+			}
+			b.WriteRune(c)
+		}
+		whole = b.String()
+	}
+	if d == 0 {
+		return whole
+	}
+	return whole + decimal + frac
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/gofrs/uuid"
+)
+
+// problem is an RFC 7807 problem details object, the body of API error
+// responses. See https://tools.ietf.org/html/rfc7807.
+type problem struct {
+	// Type identifies the kind of problem. It is "about:blank" unless the
+	// handler gave a more specific type (see withProblemType).
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Detail    string `json:"detail,omitempty"`
+	Instance  string `json:"instance,omitempty"`
+	RequestID string `json:"requestId,omitempty"`
+	// InvalidParams are the fields of a request body that failed
+	// validation, see schema.go.
+	InvalidParams []invalidParam `json:"invalid-params,omitempty"`
+}
+
+const problemContentType = "application/problem+json"
+
+// problemTypeBase prefixes specific problem types. Types are relative URIs
+// so they resolve against whichever host served the error.
+const problemTypeBase = "/problems/"
+
+// withProblemType sets a specific problem type for e, such as
+// "idempotency-key-reused", for clients to switch on.
+func (e *appError) withProblemType(slug string) *appError {
+	e.problemType = problemTypeBase + slug
+	return e
+}
+
+// problem returns the problem details describing e, for the request with
+// the given ID.
+func (e *appError) problem(requestID string) *problem {
+	p := &problem{
+		Type:      e.problemType,
+		Title:     http.StatusText(e.code),
+		Status:    e.code,
+		Detail:    e.message,
+		Instance:  e.req.URL.Path,
+		RequestID: requestID,
+
+		InvalidParams: e.invalidParams,
+	}
+	if p.Type == "" {
+		p.Type = "about:blank"
+	}
+	return p
+}
+
+// wantsProblem reports whether the error response to r should be problem
+// details rather than plain text: API requests always get them, and other
+// requests get them if they accept JSON.
+func (t *Treatshelf) wantsProblem(r *http.Request) bool {
+	if strings.HasPrefix(r.URL.Path, t.url("/api/")) {
+		return true
+	}
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, problemContentType) || strings.Contains(accept, "application/json")
+}
+
+// writeProblem writes e as problem details.
+func (e *appError) writeProblem(w http.ResponseWriter, requestID string) {
+	w.Header().Set("Content-Type", problemContentType)
+	w.WriteHeader(e.code)
+	json.NewEncoder(w).Encode(e.problem(requestID))
+}
+
+// requestID returns an ID for r that can be matched against the logs: the
+// Cloud Trace ID that App Engine assigns, the X-Request-Id header if the
+// client sent one, or else a new random ID.
+func requestID(r *http.Request) string {
+	if tc := r.Header.Get("X-Cloud-Trace-Context"); tc != "" {
+		return strings.SplitN(tc, "/", 2)[0]
+	}
+	if id := r.Header.Get("X-Request-Id"); id != "" {
+		return id
+	}
+	return uuid.Must(uuid.NewV4()).String()
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// Profile is how a signed-in user appears to others.
+type Profile struct {
+	DisplayName string
+	// AvatarURL is a picture uploaded to the picture bucket, or "".
+	AvatarURL string
+	Updated   time.Time
+}
+
+// maxDisplayName bounds the length of display names, in characters.
+const maxDisplayName = 60
+
+// ProfileDatabase stores Profiles by user.
+type ProfileDatabase interface {
+	// GetProfile returns the profile of user, or nil if there is none.
+	GetProfile(ctx context.Context, user string) (*Profile, error)
+
+	// SetProfile stores the profile of user.
+	SetProfile(ctx context.Context, user string, p *Profile) error
+
+	// DeleteProfile removes the profile of user, if any.
+	DeleteProfile(ctx context.Context, user string) error
+}
+
+// requireProfiles returns a 404 appError unless profiles are enabled. The
+// account pages use it through guard; who may use them is in routePolicy.
+func (t *Treatshelf) requireProfiles(r *http.Request) *appError {
+	if t.Profiles == nil {
+		err := errors.New("accounts are not enabled")
+		return t.appErrorCodef(r, http.StatusNotFound, err, "%v", err)
+	}
+	return nil
+}
+
+// profile returns the profile of the signed-in user, or an empty one.
+func (t *Treatshelf) profile(r *http.Request) (*Profile, error) {
+	p, err := t.Profiles.GetProfile(r.Context(), t.currentUser(r))
+	if err != nil || p != nil {
+		return p, err
+	}
+	return &Profile{}, nil
+}
+
+// profileHandler shows the signed-in user's profile, with the account
+// deletion form.
+func (t *Treatshelf) profileHandler(w http.ResponseWriter, r *http.Request) *appError {
+	p, err := t.profile(r)
+	if err != nil {
+		return t.appErrorf(r, err, "GetProfile: %v", err)
+	}
+	return profileTmpl.Execute(t, w, r, struct {
+		*Profile
+		Email string
+	}{p, t.currentUser(r)})
+}
+
+// saveProfileHandler stores the display name and, if one was uploaded, the
+// avatar from the profile form.
+func (t *Treatshelf) saveProfileHandler(w http.ResponseWriter, r *http.Request) *appError {
+	p, err := t.profile(r)
+	if err != nil {
+		return t.appErrorf(r, err, "GetProfile: %v", err)
+	}
+	name := cleanLine(r.FormValue("displayName"))
+	if len([]rune(name)) > maxDisplayName {
+		err := fmt.Errorf("display names are at most %d characters", maxDisplayName)
+		return t.appErrorCodef(r, http.StatusBadRequest, err, "%v", err)
+	}
+	p.DisplayName = name
+	avatar, err := t.uploadFileFromForm(r.Context(), r, "avatar")
+	if err != nil {
+		return t.uploadErrorf(r, err, "could not upload avatar: %v", err)
+	}
+	if avatar != "" {
+		t.deleteUpload(r.Context(), p.AvatarURL)
+		p.AvatarURL = avatar
+	} else if r.FormValue("removeAvatar") == "on" {
+		t.deleteUpload(r.Context(), p.AvatarURL)
+		p.AvatarURL = ""
+	}
+	p.Updated = t.now()
+	if err := t.Profiles.SetProfile(r.Context(), t.currentUser(r), p); err != nil {
+		return t.appErrorf(r, err, "SetProfile: %v", err)
+	}
+	setFlash(w, &flash{Message: "Saved your profile."})
+	http.Redirect(w, r, t.routeURL("profile"), http.StatusFound)
+	return nil
+}
+
+const (
+	// formerMember replaces the author of anonymized treats.
+	formerMember = "A former member"
+
+	// deletedAccount replaces the owner of anonymized treats, so that only
+	// admins can change them, see mayChange.
+	deletedAccount = "deleted-account"
+)
+
+// deleteAccountHandler deletes the signed-in user's account: their profile,
+// avatar, preferences, API tokens and sign-ins. The treats they added are
+// deleted, or kept without anything identifying them if the "treats" form
+// value is "anonymize". Their claims stay, since they account for portions
+// taken, but under formerMember. The user must confirm by typing their email
+// address.
+//
+// People signed in with an AuthProvider are also signed out; others would
+// have to remove their account with the identity provider in front of IAP.
+func (t *Treatshelf) deleteAccountHandler(w http.ResponseWriter, r *http.Request) *appError {
+	ctx := r.Context()
+	user := t.currentUser(r)
+	if !strings.EqualFold(strings.TrimSpace(r.FormValue("confirm")), user) {
+		err := errors.New("type your email address to confirm deleting your account")
+		return t.appErrorCodef(r, http.StatusBadRequest, err, "%v", err)
+	}
+	anonymize := r.FormValue("treats") == "anonymize"
+	p, err := t.profile(r)
+	if err != nil {
+		return t.appErrorf(r, err, "GetProfile: %v", err)
+	}
+
+	n, err := t.removeUserTreats(ctx, user, p.DisplayName, anonymize)
+	if err != nil {
+		return t.appErrorf(r, err, "could not remove your treats, after %d: %v", n, err)
+	}
+	if _, err := t.DB.AnonymizeClaims(ctx, user, formerMember); err != nil {
+		return t.appErrorf(r, err, "AnonymizeClaims: %v", err)
+	}
+	if t.Tokens != nil {
+		tokens, err := t.Tokens.ListTokens(ctx, user)
+		if err != nil {
+			return t.appErrorf(r, err, "ListTokens: %v", err)
+		}
+		for _, tok := range tokens {
+			if err := t.Tokens.DeleteToken(ctx, user, tok.ID); err != nil {
+				return t.appErrorf(r, err, "DeleteToken: %v", err)
+			}
+		}
+	}
+	if t.SavedSearches != nil {
+		saved, err := t.SavedSearches.ListSavedSearches(ctx, user)
+		if err != nil {
+			return t.appErrorf(r, err, "ListSavedSearches: %v", err)
+		}
+		for _, s := range saved {
+			if err := t.SavedSearches.DeleteSavedSearch(ctx, user, s.ID); err != nil {
+				return t.appErrorf(r, err, "DeleteSavedSearch: %v", err)
+			}
+		}
+	}
+	if t.SignIns != nil {
+		if err := t.SignIns.DeleteSignIns(ctx, user); err != nil {
+			return t.appErrorf(r, err, "DeleteSignIns: %v", err)
+		}
+		if err := t.SignIns.ResetSignInFailures(ctx, "user:"+user); err != nil {
+			return t.appErrorf(r, err, "ResetSignInFailures: %v", err)
+		}
+	}
+	if t.Preferences != nil {
+		if err := t.Preferences.DeletePreferences(ctx, "user:"+user); err != nil {
+			return t.appErrorf(r, err, "DeletePreferences: %v", err)
+		}
+	}
+	t.deleteUpload(ctx, p.AvatarURL)
+	if err := t.Profiles.DeleteProfile(ctx, user); err != nil {
+		return t.appErrorf(r, err, "DeleteProfile: %v", err)
+	}
+
+	http.SetCookie(w, &http.Cookie{Name: loginCookie, Path: "/", MaxAge: -1})
+	setFlash(w, &flash{Message: "Deleted your account."})
+	http.Redirect(w, r, t.routeURL("treats"), http.StatusFound)
+	return nil
+}
+
+// removeUserTreats deletes the treats user added, or, if anonymize is set,
+// gives them to deletedAccount and replaces the author if it names them. It returns
+// how many treats it changed.
+func (t *Treatshelf) removeUserTreats(ctx context.Context, user, displayName string, anonymize bool) (int, error) {
+	var mine []*Treat
+	err := t.DB.EachTreat(ctx, allTreatsOptions, func(tr *Treat) error {
+		if tr.CreatedBy == user {
+			mine = append(mine, tr)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for i, tr := range mine {
+		if !anonymize {
+			err = t.DB.DeleteTreat(ctx, tr.ID)
+		} else {
+			tr.CreatedBy = deletedAccount
+			if a := strings.TrimSpace(tr.Author); strings.EqualFold(a, user) || (displayName != "" && strings.EqualFold(a, displayName)) {
+				tr.Author = formerMember
+			}
+			err = t.DB.UpdateTreat(ctx, tr)
+		}
+		if err != nil {
+			return i, err
+		}
+	}
+	return len(mine), nil
+}
+
+// uploadObject returns the bucket and object name of a picture uploaded by
+// uploadFileFromForm, given its URL, or false if it wasn't uploaded to the
+// picture bucket.
+func (t *Treatshelf) uploadObject(url string) (*storage.BucketHandle, string, bool) {
+	bucket, bucketName, err := t.pictureBucket()
+	if url == "" || err != nil {
+		return nil, "", false
+	}
+	name := strings.TrimPrefix(url, fmt.Sprintf(publicURL, bucketName, ""))
+	if name == url || name == "" || strings.Contains(name, "/") {
+		return nil, "", false
+	}
+	return bucket, name, true
+}
+
+// deleteUpload deletes a picture uploaded by uploadFileFromForm, given its
+// URL, unless other uploads share it (see dedup.go). Failures are logged:
+// the picture is only left behind.
+func (t *Treatshelf) deleteUpload(ctx context.Context, url string) {
+	bucket, name, ok := t.uploadObject(url)
+	if !ok || !t.unrefUpload(ctx, bucket.Object(name)) {
+		return
+	}
+	if err := bucket.Object(name).Delete(ctx); err != nil {
+		fmt.Fprintf(t.logWriter, "Could not delete upload %q: %v\n", name, err)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDeleteAccountForgetsClaimsAndSignIns(t *testing.T) {
+	shelf, db := newTestShelf(t, withAdmin("admin@example.com"), withAllDatabases())
+	ctx := context.Background()
+	const user = "leaver@example.com"
+	id, err := db.AddTreat(ctx, &Treat{Title: "Brownie", Quantity: intp(5), CreatedBy: user})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ClaimTreat(ctx, id, &Claim{Name: "Lee", Portions: 1, ClaimedBy: user, Session: "s"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ClaimTreat(ctx, id, &Claim{Name: "Sam", Portions: 1, ClaimedBy: "stayer@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range []string{user, "stayer@example.com"} {
+		if err := db.AddSignIn(ctx, &SignIn{User: u, Method: "token", OK: true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := httptest.NewRequest("DELETE", "/settings/account", strings.NewReader("confirm="+user+"&treats=anonymize"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set(iapEmailHeader, "accounts.google.com:"+user)
+	w := httptest.NewRecorder()
+	shelf.Handler().ServeHTTP(w, r)
+	if w.Code != http.StatusFound {
+		t.Fatalf("got status %d, want %d: %s", w.Code, http.StatusFound, w.Body)
+	}
+
+	treat, err := db.GetTreat(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if treat.CreatedBy != deletedAccount {
+		t.Errorf("anonymized treat's CreatedBy = %q, want %q", treat.CreatedBy, deletedAccount)
+	}
+	claims, err := db.ListClaims(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range claims {
+		if c.ClaimedBy == user || c.Name == "Lee" || c.Session == "s" {
+			t.Errorf("claim %+v still identifies %s", c, user)
+		}
+	}
+	if len(claims) != 2 || claims[1].ClaimedBy != "stayer@example.com" {
+		t.Errorf("claims = %+v, want the other user's claim kept", claims)
+	}
+	signIns, err := db.ListSignIns(ctx, "", signInListLimit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(signIns) != 1 || signIns[0].User != "stayer@example.com" {
+		t.Errorf("sign-ins = %+v, want only the other user's", signIns)
+	}
+}
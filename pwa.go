@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"path"
+	"strings"
+)
+
+// The app can be installed as a Progressive Web App. Its web app manifest
+// and service worker are served from static/, see staticHandler and
+// assets.go. The
+// service worker (static/sw.js) keeps the treat list as last seen for use
+// offline and shows the offline page for everything else.
+
+// staticDir holds the files served under /static/.
+const staticDir = "static"
+
+// staticHandler serves the files in staticDir, under their hashed names
+// for good (see assets.go) and their logical names with the route's
+// policy. The service worker is allowed to control the whole app, not just
+// /static/, and the manifest gets the type browsers expect, which Go
+// doesn't know.
+func (t *Treatshelf) staticHandler() http.Handler {
+	files := http.StripPrefix(t.url("/static/"), http.FileServer(http.Dir(staticDir)))
+	assets := t.assets()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Don't list the directory.
+		if strings.HasSuffix(r.URL.Path, "/") {
+			http.NotFound(w, r)
+			return
+		}
+		if name, ok := assets.logical(path.Base(r.URL.Path)); ok {
+			w.Header().Set("Cache-Control", cacheImmutable)
+			u := *r.URL
+			u.Path = path.Join(path.Dir(u.Path), name)
+			r2 := *r
+			r2.URL = &u
+			r = &r2
+		}
+		switch path.Ext(r.URL.Path) {
+		case ".webmanifest":
+			w.Header().Set("Content-Type", "application/manifest+json")
+		case ".js":
+			w.Header().Set("Content-Type", "application/javascript; charset=utf-8")
+		}
+		if path.Base(r.URL.Path) == "sw.js" {
+			w.Header().Set("Service-Worker-Allowed", t.url("/"))
+		}
+		files.ServeHTTP(w, r)
+	})
+}
+
+// offlineHandler displays the page the service worker shows for pages it
+// can't fetch.
+func (t *Treatshelf) offlineHandler(w http.ResponseWriter, r *http.Request) *appError {
+	return offlineTmpl.Execute(t, w, r, nil)
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// The tests below change treats they passed to databases, or got back from
+// them, while other goroutines use the same databases, to check that no
+// memory is shared. Run them with the race detector:
+//
+//	go test -race -run 'Copies|Concurrent'
+
+func TestCopyTreatCopies(t *testing.T) {
+	// Set every pointer and slice field, so that fields added later are
+	// checked too.
+	orig := &Treat{}
+	v := reflect.ValueOf(orig).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		switch f := v.Field(i); f.Kind() {
+		case reflect.Ptr:
+			f.Set(reflect.New(f.Type().Elem()))
+		case reflect.Slice:
+			f.Set(reflect.MakeSlice(f.Type(), 1, 1))
+		case reflect.Map:
+			t.Fatalf("copyTreat doesn't copy maps, like Treat.%s", v.Type().Field(i).Name)
+		}
+	}
+	c := reflect.ValueOf(copyTreat(orig)).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		switch f := v.Field(i); f.Kind() {
+		case reflect.Ptr, reflect.Slice:
+			if f.Pointer() == c.Field(i).Pointer() {
+				t.Errorf("copyTreat shares Treat.%s", v.Type().Field(i).Name)
+			}
+		}
+	}
+	if !reflect.DeepEqual(copyTreat(orig), orig) {
+		t.Errorf("copyTreat(%+v) = %+v", orig, copyTreat(orig))
+	}
+}
+
+func TestMemoryDBCopies(t *testing.T) {
+	db := newMemoryDB()
+	ctx := context.Background()
+	treat := &Treat{Title: "Brownie", Tags: []string{"chocolate"}, Price: &Price{Amount: 100, Currency: "USD"}}
+	id, err := db.AddTreat(ctx, treat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	treat.Tags[0], treat.Price.Amount = "changed", 1
+	got, err := db.GetTreat(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got.Title = "Changed"
+	listed, err := db.ListTreats(ctx, ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	listed[0].Tags[0] = "changed"
+	again, err := db.GetTreat(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Title != "Brownie" || again.Tags[0] != "chocolate" || again.Price.Amount != 100 {
+		t.Errorf("stored treat changed through its copies: %+v", again)
+	}
+
+	prefs := &Preferences{HiddenAllergens: []string{"nuts"}}
+	if err := db.SetPreferences(ctx, "p", prefs); err != nil {
+		t.Fatal(err)
+	}
+	prefs.HiddenAllergens[0] = "changed"
+	if got, _ := db.GetPreferences(ctx, "p"); got.HiddenAllergens[0] != "nuts" {
+		t.Errorf("stored preferences changed through their copy: %+v", got)
+	}
+}
+
+// hammerWorkers and hammerRounds size hammerTreats.
+const (
+	hammerWorkers = 8
+	hammerRounds  = 20
+)
+
+// hammerTreats adds, updates, lists and gets treats from db on several
+// goroutines, changing every treat it passes in or gets back, then checks
+// that the stored treats didn't change.
+func hammerTreats(t *testing.T, db TreatDatabase) {
+	ctx := context.Background()
+	scribble := func(treats ...*Treat) {
+		for _, tr := range treats {
+			if tr == nil {
+				continue
+			}
+			tr.Title = "scribbled"
+			tr.Tags[0] = "scribbled"
+			tr.Nutrition.Calories = -1
+			if tr.Quantity != nil {
+				*tr.Quantity = -1
+			}
+		}
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, hammerWorkers)
+	for w := 0; w < hammerWorkers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			errs <- func() error {
+				for i := 0; i < hammerRounds; i++ {
+					treat := &Treat{Title: fmt.Sprintf("Treat %d-%d", w, i), Tags: []string{"hammer"}, Nutrition: &Nutrition{Calories: 100}, Quantity: intp(10)}
+					id, err := db.AddTreat(ctx, treat)
+					if err != nil {
+						return err
+					}
+					scribble(treat)
+					treat = &Treat{ID: id, Title: fmt.Sprintf("Treat %d-%d", w, i), Tags: []string{"hammer"}, Nutrition: &Nutrition{Calories: 100}, Quantity: intp(10)}
+					if err := db.UpdateTreat(ctx, treat); err != nil {
+						return err
+					}
+					scribble(treat)
+					got, err := db.GetTreat(ctx, id)
+					if err != nil {
+						return err
+					}
+					scribble(got)
+					adjusted, err := db.AdjustQuantity(ctx, id, -1)
+					if err != nil {
+						return err
+					}
+					scribble(adjusted)
+					listed, err := db.ListTreats(ctx, ListOptions{})
+					if err != nil {
+						return err
+					}
+					scribble(listed...)
+					batch, err := db.GetTreats(ctx, []string{id, "nope"})
+					if err != nil {
+						return err
+					}
+					scribble(batch...)
+				}
+				return nil
+			}()
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	treats, err := db.ListTreats(ctx, ListOptions{IncludeExpired: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(treats) != hammerWorkers*hammerRounds {
+		t.Errorf("%d treats stored, want %d", len(treats), hammerWorkers*hammerRounds)
+	}
+	for _, tr := range treats {
+		if tr.Title == "scribbled" || tr.Tags[0] != "hammer" || tr.Nutrition.Calories != 100 || *tr.Quantity != 9 {
+			t.Fatalf("stored treat changed through a copy: %+v", tr)
+		}
+	}
+}
+
+func TestConcurrentMemoryDB(t *testing.T) {
+	hammerTreats(t, newMemoryDB())
+}
+
+func TestConcurrentEncryptedDB(t *testing.T) {
+	w := &localWrapper{primary: "test", keys: map[string][]byte{"test": make([]byte, 32)}}
+	hammerTreats(t, newEncryptedDB(newMemoryDB(), w))
+}
+
+func TestConcurrentDualDB(t *testing.T) {
+	db := newDualDB(newMemoryDB(), newMemoryDB(), ioutil.Discard)
+	db.setConfig(DualConfig{ReadPercent: 50, Compare: true})
+	hammerTreats(t, db)
+}
+
+func TestConcurrentFaultInjectingDB(t *testing.T) {
+	hammerTreats(t, newFaultInjectingDB(newMemoryDB()))
+}
+
+func TestConcurrentTreatLoader(t *testing.T) {
+	db := newMemoryDB()
+	ctx := context.Background()
+	var ids []string
+	for i := 0; i < 10; i++ {
+		id, err := db.AddTreat(ctx, &Treat{Title: fmt.Sprint("Treat ", i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	l := newTreatLoader(db)
+	var wg sync.WaitGroup
+	for w := 0; w < hammerWorkers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < hammerRounds; i++ {
+				treats, err := l.Load(ctx, []string{ids[(w+i)%len(ids)], ids[i%len(ids)], "nope"})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if treats[0] == nil || treats[2] != nil {
+					t.Errorf("Load gave %v", treats)
+					return
+				}
+				if i%10 == 0 {
+					listed, err := db.ListTreats(ctx, ListOptions{})
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					l.Prime(listed...)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+}
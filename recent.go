@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+// The treats a browser viewed last are kept in its session cookie, newest
+// first, and shown in a "Recently viewed" strip on the list page. Keeping
+// them in the session rather than the database costs no write per view
+// and works the same for anonymous visitors; they are per browser, not per
+// user.
+
+// maxRecent is how many recently viewed treats are remembered.
+const maxRecent = 8
+
+// recordView adds the treat with the given ID to the front of the
+// session's recently viewed treats.
+func (t *Treatshelf) recordView(w http.ResponseWriter, r *http.Request, id string) {
+	s := t.session(r)
+	if len(s.Recent) > 0 && s.Recent[0] == id {
+		return
+	}
+	recent := []string{id}
+	for _, v := range s.Recent {
+		if v != id && len(recent) < maxRecent {
+			recent = append(recent, v)
+		}
+	}
+	s.Recent = recent
+	if err := t.saveSession(w, s); err != nil {
+		fmt.Fprintf(t.logWriter, "Could not save recently viewed treats: %v\n", err)
+	}
+}
+
+// recentTreats returns the session's recently viewed treats that r may
+// still see, newest first.
+func (t *Treatshelf) recentTreats(ctx context.Context, r *http.Request) ([]*Treat, error) {
+	ids := t.session(r).Recent
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	treats, err := t.DB.GetTreats(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	recent := treats[:0]
+	for _, treat := range treats {
+		if treat != nil && !treat.Deleted() && (treat.VisibleAt(t.now()) || t.previewing(r)) && t.maySee(r, treat) {
+			recent = append(recent, treat)
+		}
+	}
+	return recent, nil
+}
+
+// clearRecent forgets the session's recently viewed treats.
+func (t *Treatshelf) clearRecent(w http.ResponseWriter, r *http.Request) error {
+	s := t.session(r)
+	if len(s.Recent) == 0 {
+		return nil
+	}
+	s.Recent = nil
+	return t.saveSession(w, s)
+}
+
+// clearRecentHandler forgets the recently viewed treats and returns to the
+// list.
+func (t *Treatshelf) clearRecentHandler(w http.ResponseWriter, r *http.Request) *appError {
+	if err := t.clearRecent(w, r); err != nil {
+		return t.appErrorf(r, err, "could not save session: %v", err)
+	}
+	http.Redirect(w, r, t.routeURL("treats"), http.StatusFound)
+	return nil
+}
+
+// apiClearRecentHandler forgets the recently viewed treats of the session
+// the request was made in.
+func (t *Treatshelf) apiClearRecentHandler(w http.ResponseWriter, r *http.Request) *appError {
+	if err := t.clearRecent(w, r); err != nil {
+		return t.appErrorf(r, err, "could not save session: %v", err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
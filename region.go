@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// The app can run in several regions at once against the same Firestore
+// database. Each instance names itself after its region, so that logs show
+// where a request was served; cron tasks take a lock so that only one
+// region runs them; and changes to treats can be relayed to every region
+// through Pub/Sub, see relay.go.
+
+// instanceName returns "<region>/<instance>" for this instance. The region
+// comes from REGION, and the instance from App Engine or Cloud Run, or else
+// the host name.
+func instanceName() string {
+	instance := os.Getenv("GAE_INSTANCE")
+	if instance == "" {
+		instance = os.Getenv("K_REVISION")
+	}
+	if instance == "" {
+		instance, _ = os.Hostname()
+	}
+	if region := os.Getenv("REGION"); region != "" {
+		return region + "/" + instance
+	}
+	return instance
+}
+
+// LockDatabase provides leases shared by every instance in every region.
+type LockDatabase interface {
+	// AcquireLock takes the named lock for holder until ttl from now, and
+	// reports whether it did. It fails to if another holder has the lock
+	// and it hasn't expired. A holder may acquire a lock it holds again to
+	// extend it.
+	AcquireLock(ctx context.Context, name, holder string, ttl time.Duration) (bool, error)
+}
+
+// taskLockTTL is how long a cron task's lock is held. The lock isn't
+// released when the task ends, since the same task scheduled in another
+// region fires a little later; it must outlast that skew yet expire before
+// the task is next due.
+const taskLockTTL = 2 * time.Minute
+
+// oneRegion is mux middleware for the cron tasks: a task runs only on the
+// instance that takes its lock, and is skipped, successfully, elsewhere.
+func (t *Treatshelf) oneRegion(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if t.Locks == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+		name := "task" + strings.Replace(strings.TrimPrefix(r.URL.Path, t.basePath), "/", "-", -1)
+		ok, err := t.Locks.AcquireLock(r.Context(), name, t.instance, taskLockTTL)
+		if err != nil {
+			serveError(w, r, t.appErrorf(r, err, "could not lock %s: %v", name, err))
+			return
+		}
+		if !ok {
+			fmt.Fprintf(w, "Skipped: %s ran elsewhere\n", name)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+// changeRelay fans changes to treats out to every instance, in every
+// region, through a Pub/Sub topic (PUBSUB_TOPIC). Only one instance, the
+// holder of watcherLock, watches Firestore and publishes what it sees;
+// every instance receives from its own subscription into t.changes. That
+// keeps Firestore listen costs flat however many instances run.
+type changeRelay struct {
+	client *pubsub.Client
+	topic  *pubsub.Topic
+	sub    *pubsub.Subscription
+}
+
+const (
+	// watcherLock is held by the instance that watches Firestore for the
+	// relay, see relayChanges.
+	watcherLock = "change-watcher"
+
+	// watcherLease is how long the watcher holds watcherLock between
+	// renewals; another instance takes over within this long if it stops.
+	watcherLease = 30 * time.Second
+
+	// relaySubscriptionExpiry deletes the subscriptions of instances that
+	// are gone.
+	relaySubscriptionExpiry = 24 * time.Hour
+)
+
+// subscriptionChars matches characters not allowed in subscription IDs.
+var subscriptionChars = regexp.MustCompile(`[^A-Za-z0-9_.~+%-]`)
+
+// newChangeRelay connects to the given topic, which must exist, and
+// subscribes this instance to it.
+func newChangeRelay(ctx context.Context, projectID, topicID, instance string) (*changeRelay, error) {
+	client, err := pubsub.NewClient(ctx, projectID)
+	if err != nil {
+		return nil, fmt.Errorf("pubsub.NewClient: %v", err)
+	}
+	topic := client.Topic(topicID)
+	if ok, err := topic.Exists(ctx); err != nil || !ok {
+		client.Close()
+		return nil, fmt.Errorf("topic %q does not exist, create it with\n"+
+			"    gcloud pubsub topics create %s\n(err: %v)", topicID, topicID, err)
+	}
+
+	subID := topicID + "-" + subscriptionChars.ReplaceAllString(instance, "-")
+	sub := client.Subscription(subID)
+	if ok, err := sub.Exists(ctx); err != nil || !ok {
+		sub, err = client.CreateSubscription(ctx, subID, pubsub.SubscriptionConfig{
+			Topic: topic,
+			// Changes are only useful while fresh.
+			RetentionDuration: 10 * time.Minute,
+			ExpirationPolicy:  relaySubscriptionExpiry,
+		})
+		if err != nil {
+			client.Close()
+			return nil, fmt.Errorf("could not subscribe to %q: %v", topicID, err)
+		}
+	}
+	return &changeRelay{client: client, topic: topic, sub: sub}, nil
+}
+
+// relayMessage is the Pub/Sub message for a TreatChange.
+type relayMessage struct {
+	Kind  ChangeKind
+	ID    string
+	Treat *Treat `json:",omitempty"`
+}
+
+// publish sends c to every instance. Failures are logged, since the
+// watcher can't wait for Pub/Sub.
+func (rl *changeRelay) publish(ctx context.Context, c TreatChange, log func(error)) {
+	data, err := json.Marshal(relayMessage{Kind: c.Kind, ID: c.ID, Treat: c.Treat})
+	if err != nil {
+		log(err)
+		return
+	}
+	res := rl.topic.Publish(ctx, &pubsub.Message{Data: data})
+	go func() {
+		if _, err := res.Get(ctx); err != nil {
+			log(err)
+		}
+	}()
+}
+
+// receive calls fn with each change published to the topic until ctx is
+// done.
+func (rl *changeRelay) receive(ctx context.Context, fn func(TreatChange)) error {
+	return rl.sub.Receive(ctx, func(_ context.Context, m *pubsub.Message) {
+		m.Ack()
+		var msg relayMessage
+		if err := json.Unmarshal(m.Data, &msg); err != nil {
+			return
+		}
+		fn(TreatChange{Kind: msg.Kind, ID: msg.ID, Treat: msg.Treat})
+	})
+}
+
+// relayChanges keeps t.changes up to date through rl until ctx is done:
+// it receives the relayed changes and, while this instance holds
+// watcherLock, watches w and publishes its changes.
+func (t *Treatshelf) relayChanges(ctx context.Context, w ChangeWatcher, rl *changeRelay) {
+	logErr := func(err error) {
+		fmt.Fprintf(t.logWriter, "Could not relay treat change: %v\n", err)
+	}
+	go func() {
+		for ctx.Err() == nil {
+			if err := rl.receive(ctx, t.changes.publish); err != nil {
+				logErr(err)
+				time.Sleep(time.Second)
+			}
+		}
+	}()
+
+	var stopWatching context.CancelFunc
+	for {
+		ok, err := t.Locks.AcquireLock(ctx, watcherLock, t.instance, watcherLease)
+		if err != nil {
+			fmt.Fprintf(t.logWriter, "Could not take the watcher lock: %v\n", err)
+		}
+		switch {
+		case ok && stopWatching == nil:
+			var watchCtx context.Context
+			watchCtx, stopWatching = context.WithCancel(ctx)
+			go t.watchChanges(watchCtx, w, func(c TreatChange) {
+				rl.publish(watchCtx, c, logErr)
+			})
+		case !ok && stopWatching != nil:
+			// Another instance took over, e.g. while this one was paused.
+			stopWatching()
+			stopWatching = nil
+		}
+		select {
+		case <-t.after(watcherLease / 3):
+		case <-ctx.Done():
+			if stopWatching != nil {
+				stopWatching()
+			}
+			return
+		}
+	}
+}
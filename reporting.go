@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"cloud.google.com/go/errorreporting"
+)
+
+// ErrorReporter receives the server errors returned by handlers, see
+// appHandler.ServeHTTP. *errorreporting.Client implements it.
+type ErrorReporter interface {
+	// Report queues e to be reported. It must not block on the network.
+	Report(e errorreporting.Entry)
+
+	// Flush sends any queued reports.
+	Flush()
+}
+
+const (
+	// errorSampleWindow is how long repeats of an error are not reported
+	// for, see sampledReporter.
+	errorSampleWindow = time.Minute
+
+	// maxSampledErrors bounds the errors sampledReporter remembers.
+	maxSampledErrors = 1000
+
+	// errorQueueSize bounds the reports waiting for asyncReporter.
+	errorQueueSize = 100
+)
+
+// logReporter writes errors to a log instead of reporting them. It is used
+// for local runs (ERROR_REPORTING=local) and tests.
+type logReporter struct {
+	w io.Writer
+}
+
+// Report writes the error and its stack to the log.
+func (l *logReporter) Report(e errorreporting.Entry) {
+	fmt.Fprintf(l.w, "Error: %v\n%s", e.Error, e.Stack)
+}
+
+// Flush does nothing: reports are written immediately.
+func (l *logReporter) Flush() {}
+
+// sampledReporter passes errors on to another ErrorReporter, reporting an
+// error from a given path at most once per window so that a failing hot
+// endpoint doesn't use up the Error Reporting quota. The next report after
+// the window says how many were skipped.
+type sampledReporter struct {
+	r      ErrorReporter
+	window time.Duration
+	clock  Clock // tells the window, see clock.go.
+
+	mu      sync.Mutex
+	last    map[string]time.Time // when each error was last reported.
+	skipped map[string]int
+}
+
+func newSampledReporter(r ErrorReporter, window time.Duration, clock Clock) *sampledReporter {
+	return &sampledReporter{
+		r:       r,
+		window:  window,
+		clock:   clock,
+		last:    make(map[string]time.Time),
+		skipped: make(map[string]int),
+	}
+}
+
+// Report reports e unless the same error was reported within the window.
+func (s *sampledReporter) Report(e errorreporting.Entry) {
+	key := fmt.Sprint(e.Error)
+	if e.Req != nil {
+		key = e.Req.URL.Path + " " + key
+	}
+	now := s.clock.Now()
+
+	s.mu.Lock()
+	if last, ok := s.last[key]; ok && now.Sub(last) < s.window {
+		s.skipped[key]++
+		s.mu.Unlock()
+		return
+	}
+	if len(s.last) >= maxSampledErrors {
+		s.forgetBefore(now.Add(-s.window))
+	}
+	s.last[key] = now
+	skipped := s.skipped[key]
+	delete(s.skipped, key)
+	s.mu.Unlock()
+
+	if skipped > 0 {
+		e.Error = fmt.Errorf("%v (and %d more like it not reported)", e.Error, skipped)
+	}
+	s.r.Report(e)
+}
+
+// forgetBefore drops errors last reported before the given time, or every
+// error if that doesn't make room. s.mu must be held.
+func (s *sampledReporter) forgetBefore(before time.Time) {
+	for k, last := range s.last {
+		if last.Before(before) {
+			delete(s.last, k)
+			delete(s.skipped, k)
+		}
+	}
+	if len(s.last) >= maxSampledErrors {
+		s.last = make(map[string]time.Time)
+		s.skipped = make(map[string]int)
+	}
+}
+
+// Flush flushes the underlying reporter.
+func (s *sampledReporter) Flush() {
+	s.r.Flush()
+}
+
+// asyncReporter passes errors on to another ErrorReporter from a background
+// worker, so that handlers never wait for Error Reporting. Reports are
+// dropped, and counted, if the queue is full.
+type asyncReporter struct {
+	dropped int64 // accessed atomically; first for 64-bit alignment.
+	r       ErrorReporter
+	queue   chan errorreporting.Entry
+}
+
+func newAsyncReporter(r ErrorReporter, size int) *asyncReporter {
+	a := &asyncReporter{r: r, queue: make(chan errorreporting.Entry, size)}
+	go a.run()
+	return a
+}
+
+// Report queues e, or drops it if the queue is full.
+func (a *asyncReporter) Report(e errorreporting.Entry) {
+	select {
+	case a.queue <- e:
+	default:
+		atomic.AddInt64(&a.dropped, 1)
+	}
+}
+
+// Flush flushes the underlying reporter. The worker also flushes whenever
+// it empties the queue.
+func (a *asyncReporter) Flush() {
+	a.r.Flush()
+}
+
+// Dropped returns how many reports were dropped because the queue was full.
+func (a *asyncReporter) Dropped() int64 {
+	return atomic.LoadInt64(&a.dropped)
+}
+
+// run reports queued errors, flushing when it runs out. It never returns.
+func (a *asyncReporter) run() {
+	for e := range a.queue {
+		a.r.Report(e)
+		if len(a.queue) == 0 {
+			a.r.Flush()
+		}
+	}
+}
+
+// newErrorReporter returns the ErrorReporter configured by ERROR_REPORTING:
+// "local" logs errors to stderr, and anything else reports them to Error
+// Reporting for the project, sampled on clock, from a background worker.
+func newErrorReporter(ctx context.Context, projectID string, clock Clock) (ErrorReporter, error) {
+	if os.Getenv("ERROR_REPORTING") == "local" {
+		return &logReporter{w: os.Stderr}, nil
+	}
+	c, err := errorreporting.NewClient(ctx, projectID, errorreporting.Config{
+		ServiceName: "Treatshelf",
+		OnError: func(err error) {
+			fmt.Fprintf(os.Stderr, "Could not log error: %v", err)
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("errorreporting.NewClient: %v", err)
+	}
+	return newAsyncReporter(newSampledReporter(c, errorSampleWindow, clock), errorQueueSize), nil
+}
+
+// droppedErrorReports returns how many error reports were dropped because
+// the reporting queue was full.
+func (t *Treatshelf) droppedErrorReports() int64 {
+	if a, ok := t.errorReporter().(*asyncReporter); ok {
+		return a.Dropped()
+	}
+	return 0
+}
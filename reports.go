@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Anyone can report a treat that shouldn't be on the shelf, once. Reports
+// are listed for admins in the review queue (see moderation.go), and a
+// treat with reportHideAt open reports is held for review until an admin
+// approves or rejects it. Either decision, or dismissing the reports,
+// closes them.
+
+// defaultReportHideAt is how many open reports hold a treat for review,
+// unless REPORT_HIDE_THRESHOLD is set.
+const defaultReportHideAt = 3
+
+// maxReportDetails bounds the length of Report.Details, in characters.
+const maxReportDetails = 500
+
+// reportReasons are the reasons a treat can be reported for, with their
+// descriptions.
+var reportReasons = []struct{ ID, Description string }{
+	{"spam", "Spam or advertising"},
+	{"offensive", "Offensive or inappropriate"},
+	{"unsafe", "Unsafe to eat"},
+	{"wrong", "Wrong or misleading details"},
+	{"other", "Something else"},
+}
+
+// Report records someone asking admins to look at a treat.
+type Report struct {
+	// ID identifies the reporter, so that each reporter counts once, see
+	// reportID.
+	ID      string
+	TreatID string
+	// Reason is one of reportReasons.
+	Reason  string
+	Details string
+	// User is who made the report, or "" if they weren't signed in.
+	User    string
+	Created time.Time
+}
+
+// errAlreadyReported is returned by ReportTreat when the reporter already
+// has an open report of the treat.
+var errAlreadyReported = errors.New("you already reported this treat")
+
+// ReportDatabase stores reports of treats. Open reports are counted by
+// Treat.Reports.
+type ReportDatabase interface {
+	// ReportTreat records rep against a treat and returns how many
+	// reports of it are open. It returns errAlreadyReported if one with
+	// rep's ID is open. The treat is held for review, in the same
+	// transaction, if hideAt reports are open.
+	ReportTreat(ctx context.Context, treatID string, rep *Report, hideAt int) (open int, err error)
+
+	// ListReports returns the open reports of a treat, oldest first.
+	ListReports(ctx context.Context, treatID string) ([]*Report, error)
+
+	// ClearReports closes the reports of a treat.
+	ClearReports(ctx context.Context, treatID string) error
+}
+
+// reportID returns the ID of reports made by r: signed-in users are told
+// apart by their email address, others by their IP address.
+func (t *Treatshelf) reportID(r *http.Request) string {
+	key := "ip:" + remoteIP(r)
+	if u := t.currentUser(r); u != "" {
+		key = "user:" + u
+	}
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:16])
+}
+
+// reportFromForm populates the fields of a Report from form values (see
+// templates/detail.html).
+func (t *Treatshelf) reportFromForm(r *http.Request) (*Report, error) {
+	rep := &Report{
+		ID:      t.reportID(r),
+		Reason:  r.FormValue("reason"),
+		Details: strings.TrimSpace(r.FormValue("details")),
+		User:    t.currentUser(r),
+		Created: t.now(),
+	}
+	known := false
+	for _, reason := range reportReasons {
+		known = known || reason.ID == rep.Reason
+	}
+	if !known {
+		return nil, fmt.Errorf("unknown reason %q", rep.Reason)
+	}
+	if len([]rune(rep.Details)) > maxReportDetails {
+		return nil, fmt.Errorf("details must be at most %d characters", maxReportDetails)
+	}
+	return rep, nil
+}
+
+// reportHandler reports the treat in the route.
+func (t *Treatshelf) reportHandler(w http.ResponseWriter, r *http.Request) *appError {
+	if t.Reports == nil {
+		err := errors.New("reports are not enabled")
+		return t.appErrorCodef(r, http.StatusNotFound, err, "%v", err)
+	}
+	treat, err := t.treatFromRequest(r)
+	if err != nil || !t.maySee(r, treat) {
+		err := errors.New("treat not found")
+		return t.appErrorCodef(r, http.StatusNotFound, err, "%v", err)
+	}
+	rep, err := t.reportFromForm(r)
+	if err != nil {
+		return t.appErrorCodef(r, http.StatusBadRequest, err, "could not parse report from form: %v", err)
+	}
+	open, err := t.Reports.ReportTreat(r.Context(), treat.ID, rep, t.reportHideAt)
+	if err == errAlreadyReported {
+		return t.appErrorCodef(r, http.StatusConflict, err, "%v", err)
+	}
+	if err != nil {
+		return t.appErrorf(r, err, "could not report treat: %v", err)
+	}
+	fmt.Fprintf(t.logWriter, "Treat %s reported for %s (%d open reports)\n", treat.ID, rep.Reason, open)
+	if open >= t.reportHideAt && !treat.UnderReview() {
+		treat.Review = reviewPending
+	}
+	next := t.routeURL("treat", "id", treat.ID)
+	if !t.maySee(r, treat) {
+		next = t.routeURL("treats")
+	}
+	setFlash(w, &flash{Message: "Thanks for the report. An admin will look at it."})
+	http.Redirect(w, r, next, http.StatusFound)
+	return nil
+}
+
+// dismissReportsHandler closes the reports of the treat in the route,
+// leaving the treat as it is.
+func (t *Treatshelf) dismissReportsHandler(w http.ResponseWriter, r *http.Request) *appError {
+	if t.Reports == nil {
+		err := errors.New("reports are not enabled")
+		return t.appErrorCodef(r, http.StatusNotFound, err, "%v", err)
+	}
+	id := mux.Vars(r)["id"]
+	if err := t.Reports.ClearReports(r.Context(), id); err != nil {
+		return t.appErrorf(r, err, "could not dismiss reports: %v", err)
+	}
+	fmt.Fprintf(t.logWriter, "%s dismissed the reports of treat %s\n", t.currentUser(r), id)
+	setFlash(w, &flash{Message: "Dismissed the reports."})
+	http.Redirect(w, r, t.routeURL("reviewQueue"), http.StatusFound)
+	return nil
+}
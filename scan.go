@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Uploaded files are scanned for malware before they are stored, if
+// CLAMD_ADDRESS is set to the host:port of a ClamAV daemon, such as a
+// sidecar container listening on localhost:3310. Another scanner, such as
+// a cloud scanning API, only needs to implement MalwareScanner.
+//
+// Infected files are refused, stored under quarantine/ in the picture
+// bucket without public access, for admins to look at, and recorded in
+// the security log. Files that can't be scanned are refused, so that a
+// scanner outage doesn't let malware through.
+
+// MalwareScanner scans files for malware.
+type MalwareScanner interface {
+	// Scan reads the file in r and returns the name of the malware found
+	// in it, or "" if it is clean.
+	Scan(ctx context.Context, r io.Reader) (threat string, err error)
+}
+
+// uploadScanMethod is the SignIn.Method of infected uploads in the
+// security log.
+const uploadScanMethod = "upload"
+
+// malwareError is returned for uploads found to be infected.
+type malwareError struct {
+	filename, threat string
+	// quarantined is where the file is kept, or "" if it couldn't be.
+	quarantined string
+}
+
+func (e malwareError) Error() string {
+	return fmt.Sprintf("%s contains malware (%s) and was refused", e.filename, e.threat)
+}
+
+// scanUpload scans f, which is about to be uploaded as name, and rewinds
+// it. It returns a malwareError if f is infected, after quarantining it.
+func (t *Treatshelf) scanUpload(ctx context.Context, f io.ReadSeeker, filename, name, contentType string) error {
+	if t.scanner == nil {
+		return nil
+	}
+	threat, err := t.scanner.Scan(ctx, f)
+	if err != nil {
+		return fmt.Errorf("could not scan %s for malware: %v", filename, err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if threat == "" {
+		return nil
+	}
+	m := malwareError{filename: filename, threat: threat}
+	fmt.Fprintf(t.logWriter, "Refusing upload %q: %s\n", filename, threat)
+	if err := t.quarantineUpload(ctx, f, quarantinePrefix+name, contentType, m); err != nil {
+		fmt.Fprintf(t.logWriter, "Could not quarantine upload %q: %v\n", filename, err)
+	} else {
+		m.quarantined = quarantinePrefix + name
+	}
+	return m
+}
+
+// quarantineUpload stores an infected file in the picture bucket under
+// the given name, readable only by the project's members.
+func (t *Treatshelf) quarantineUpload(ctx context.Context, f io.Reader, name, contentType string, m malwareError) error {
+	bucket, _, err := t.pictureBucket()
+	if err != nil {
+		return err
+	}
+	w := bucket.Object(name).NewWriter(ctx)
+	w.ContentType = contentType
+	w.Metadata = map[string]string{"filename": m.filename, "threat": m.threat}
+	// The picture bucket's objects are public by default.
+	w.PredefinedACL = "projectPrivate"
+	if _, err := io.Copy(w, f); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// recordMalware adds an infected upload by user, made with r, to the
+// security log.
+func (t *Treatshelf) recordMalware(r *http.Request, user string, m malwareError) {
+	if t.SignIns == nil {
+		return
+	}
+	reason := "malware: " + m.threat + " in " + m.filename
+	if m.quarantined != "" {
+		reason += ", quarantined as " + m.quarantined
+	}
+	now := t.now()
+	err := t.SignIns.AddSignIn(r.Context(), &SignIn{
+		User:      user,
+		Method:    uploadScanMethod,
+		IP:        remoteIP(r),
+		UserAgent: r.UserAgent(),
+		Reason:    reason,
+		At:        now,
+		ExpiresAt: now.Add(signInKeep),
+	})
+	if err != nil {
+		fmt.Fprintf(t.logWriter, "Could not record infected upload %q: %v\n", m.filename, err)
+	}
+}
+
+// uploadErrorf is like appErrorf for errors uploading files, but responds
+// 422 to infected files and records them in the security log.
+func (t *Treatshelf) uploadErrorf(r *http.Request, err error, format string, v ...interface{}) *appError {
+	if m, ok := err.(malwareError); ok {
+		t.recordMalware(r, t.currentUser(r), m)
+		return t.appErrorCodef(r, http.StatusUnprocessableEntity, err, "%v", err)
+	}
+	if err == errAltTextRequired {
+		return t.appErrorCodef(r, http.StatusBadRequest, err, "%v", err)
+	}
+	return t.appErrorf(r, err, format, v...)
+}
+
+// clamdScanner scans files with a ClamAV daemon, clamd, using its INSTREAM
+// command. See https://docs.clamav.net/manual/Usage/Scanning.html.
+type clamdScanner struct {
+	// addr is clamd's host:port.
+	addr string
+}
+
+// clamdChunk is the most bytes sent to clamd at once.
+const clamdChunk = 32 << 10
+
+func (s clamdScanner) Scan(ctx context.Context, r io.Reader) (string, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	// The file is sent as chunks, each preceded by its length, ending with
+	// an empty one.
+	if _, err := io.WriteString(conn, "zINSTREAM\x00"); err != nil {
+		return "", err
+	}
+	buf := make([]byte, 4+clamdChunk)
+	for {
+		n, err := r.Read(buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf, uint32(n))
+			if _, err := conn.Write(buf[:4+n]); err != nil {
+				return "", err
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return "", err
+	}
+
+	// clamd replies "stream: OK", "stream: <threat> FOUND" or
+	// "<problem> ERROR".
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	reply = strings.TrimSuffix(reply, "\x00")
+	switch {
+	case reply == "stream: OK":
+		return "", nil
+	case strings.HasPrefix(reply, "stream: ") && strings.HasSuffix(reply, " FOUND"):
+		return strings.TrimSuffix(strings.TrimPrefix(reply, "stream: "), " FOUND"), nil
+	}
+	return "", fmt.Errorf("clamd: %s", reply)
+}
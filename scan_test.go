@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// eicar is the EICAR test file, which scanners report as malware.
+const eicar = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+// fakeClamd serves clamd's INSTREAM command, reporting the EICAR test
+// file, and returns its address and a func to stop it.
+func fakeClamd(t *testing.T) (addr string, stop func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				if cmd, err := r.ReadString(0); err != nil || cmd != "zINSTREAM\x00" {
+					io.WriteString(conn, "UNKNOWN COMMAND ERROR\x00")
+					return
+				}
+				var file bytes.Buffer
+				for {
+					var n uint32
+					if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+						return
+					}
+					if n == 0 {
+						break
+					}
+					if _, err := io.CopyN(&file, r, int64(n)); err != nil {
+						return
+					}
+				}
+				if strings.Contains(file.String(), "EICAR-STANDARD-ANTIVIRUS-TEST-FILE") {
+					io.WriteString(conn, "stream: Eicar-Test-Signature FOUND\x00")
+					return
+				}
+				io.WriteString(conn, "stream: OK\x00")
+			}()
+		}
+	}()
+	return l.Addr().String(), func() { l.Close() }
+}
+
+func TestClamdScanner(t *testing.T) {
+	addr, stop := fakeClamd(t)
+	defer stop()
+	s := clamdScanner{addr: addr}
+	ctx := context.Background()
+	for _, tt := range []struct {
+		file, want string
+	}{
+		{file: "", want: ""},
+		{file: "just a picture", want: ""},
+		{file: eicar, want: "Eicar-Test-Signature"},
+		// Files span chunks.
+		{file: strings.Repeat("x", clamdChunk+1) + eicar, want: "Eicar-Test-Signature"},
+	} {
+		got, err := s.Scan(ctx, strings.NewReader(tt.file))
+		if err != nil || got != tt.want {
+			t.Errorf("Scan(%.20q...) = %q, %v; want %q", tt.file, got, err, tt.want)
+		}
+	}
+
+	s = clamdScanner{addr: "127.0.0.1:1"}
+	if _, err := s.Scan(ctx, strings.NewReader(eicar)); err == nil {
+		t.Error("Scan with clamd down succeeded")
+	}
+}
+
+func TestInfectedUpload(t *testing.T) {
+	shelf := goldenShelf(t)
+	addr, stop := fakeClamd(t)
+	defer stop()
+	shelf.scanner = clamdScanner{addr: addr}
+	h := shelf.Handler()
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("title", "Totally a cake")
+	fw, err := mw.CreateFormFile("image", "cake.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(fw, eicar)
+	mw.Close()
+	r := httptest.NewRequest("POST", "/treats", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("got status %d, want %d: %s", w.Code, http.StatusUnprocessableEntity, w.Body)
+	}
+
+	signIns, err := shelf.SignIns.ListSignIns(context.Background(), "", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(signIns) != 1 || signIns[0].Method != uploadScanMethod || !strings.Contains(signIns[0].Reason, "Eicar-Test-Signature") {
+		t.Errorf("security log has %+v, want the infected upload", signIns)
+	}
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// API request bodies are checked against JSON Schemas before they are
+// decoded, so that clients are told which fields are wrong, and why, before
+// anything reaches the database: a failing request is answered 400 with
+// problem type "validation-failed" and an "invalid-params" member listing
+// each field, as in RFC 7807:
+//
+//	{"type": "/problems/validation-failed", ...,
+//	 "invalid-params": [{"name": "Nutrition.Calories", "reason": "must be at least 0"}]}
+//
+// The schemas are served at /api/schemas/{name}.json for clients to check
+// against too. Only the parts of JSON Schema they use are implemented.
+// Property names match in any case, as encoding/json matches them, and
+// read-only properties are accepted, so that clients can send back what
+// they fetched, but ignored. Checks that need more than one field, such as
+// that sugar and fat fit in the serving size, are left to Treat.validate.
+
+// schema is a JSON Schema, see https://json-schema.org/draft/2020-12.
+type schema struct {
+	// Schema is the dialect, set only on the documents served.
+	Schema      string `json:"$schema,omitempty"`
+	ID          string `json:"$id,omitempty"`
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+
+	// Type is the JSON type of the value, with "null" also allowed if
+	// Nullable.
+	Type     string `json:"-"`
+	Nullable bool   `json:"-"`
+
+	Properties           map[string]*schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	AdditionalProperties *bool              `json:"additionalProperties,omitempty"`
+	Items                *schema            `json:"items,omitempty"`
+	MinItems             *int               `json:"minItems,omitempty"`
+	MaxItems             *int               `json:"maxItems,omitempty"`
+	Enum                 []string           `json:"enum,omitempty"`
+	MinLength            *int               `json:"minLength,omitempty"`
+	MaxLength            *int               `json:"maxLength,omitempty"`
+	Pattern              string             `json:"pattern,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Minimum              *float64           `json:"minimum,omitempty"`
+	Maximum              *float64           `json:"maximum,omitempty"`
+	ReadOnly             bool               `json:"readOnly,omitempty"`
+}
+
+// MarshalJSON adds the type, as ["type", "null"] if s is nullable.
+func (s *schema) MarshalJSON() ([]byte, error) {
+	type plain schema
+	b, err := json.Marshal((*plain)(s))
+	if err != nil || s.Type == "" {
+		return b, err
+	}
+	var typ interface{} = s.Type
+	if s.Nullable {
+		typ = []string{s.Type, "null"}
+	}
+	t, err := json.Marshal(map[string]interface{}{"type": typ})
+	if err != nil {
+		return nil, err
+	}
+	if string(b) == "{}" {
+		return t, nil
+	}
+	return append(t[:len(t)-1], append([]byte{','}, b[1:]...)...), nil
+}
+
+// invalidParam is a member of the "invalid-params" of a validation
+// problem: a field of the request body, such as "Tags[2]", and what is
+// wrong with it.
+type invalidParam struct {
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+}
+
+// patterns caches the compiled patterns of schemas.
+var patterns sync.Map
+
+func matchPattern(pattern, s string) bool {
+	re, ok := patterns.Load(pattern)
+	if !ok {
+		re, _ = patterns.LoadOrStore(pattern, regexp.MustCompile(pattern))
+	}
+	return re.(*regexp.Regexp).MatchString(s)
+}
+
+// check returns what is wrong with the JSON document b as s describes it,
+// or nil if nothing is. b must be valid JSON.
+func (s *schema) check(b []byte) []invalidParam {
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return []invalidParam{{Name: "body", Reason: "must be JSON"}}
+	}
+	return s.checkValue(v, "", nil)
+}
+
+// checkValue appends to ps what is wrong with v, a value decoded with
+// UseNumber at the given field name, and returns them.
+func (s *schema) checkValue(v interface{}, name string, ps []invalidParam) []invalidParam {
+	fail := func(format string, args ...interface{}) []invalidParam {
+		n := name
+		if n == "" {
+			n = "body"
+		}
+		return append(ps, invalidParam{Name: n, Reason: fmt.Sprintf(format, args...)})
+	}
+	if v == nil {
+		if s.Nullable || s.Type == "" {
+			return ps
+		}
+		return fail("must be %s, not null", typeName(s.Type))
+	}
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if s.Type != "object" && s.Type != "" {
+			return fail("must be %s", typeName(s.Type))
+		}
+		return s.checkObject(v, name, ps)
+	case []interface{}:
+		if s.Type != "array" && s.Type != "" {
+			return fail("must be %s", typeName(s.Type))
+		}
+		if s.MinItems != nil && len(v) < *s.MinItems {
+			return fail("must have at least %s", pluralize(*s.MinItems, "item", "items"))
+		}
+		if s.MaxItems != nil && len(v) > *s.MaxItems {
+			return fail("must have at most %s", pluralize(*s.MaxItems, "item", "items"))
+		}
+		if s.Items != nil {
+			for i, item := range v {
+				ps = s.Items.checkValue(item, fmt.Sprintf("%s[%d]", name, i), ps)
+			}
+		}
+		return ps
+	case string:
+		if s.Type != "string" && s.Type != "" {
+			return fail("must be %s", typeName(s.Type))
+		}
+		n := len([]rune(v))
+		switch {
+		case s.MinLength != nil && n < *s.MinLength && *s.MinLength == 1:
+			return fail("is required")
+		case s.MinLength != nil && n < *s.MinLength:
+			return fail("must be at least %d characters", *s.MinLength)
+		case s.MaxLength != nil && n > *s.MaxLength:
+			return fail("must be at most %d characters", *s.MaxLength)
+		case len(s.Enum) > 0 && !contains(s.Enum, v):
+			return fail("must be one of %s", strings.Join(quoteAll(s.Enum), ", "))
+		case s.Pattern != "" && !matchPattern(s.Pattern, v):
+			return fail("is not in the expected form")
+		case s.Format == "date-time" && !isDateTime(v):
+			return fail("must be an RFC 3339 date and time, such as 2024-12-25T09:00:00Z")
+		}
+		return ps
+	case json.Number:
+		if s.Type != "number" && s.Type != "integer" && s.Type != "" {
+			return fail("must be %s", typeName(s.Type))
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return fail("is out of range")
+		}
+		if s.Type == "integer" {
+			if _, err := strconv.ParseInt(v.String(), 10, 64); err != nil {
+				return fail("must be a whole number")
+			}
+		}
+		switch {
+		case s.Minimum != nil && f < *s.Minimum:
+			return fail("must be at least %v", *s.Minimum)
+		case s.Maximum != nil && f > *s.Maximum:
+			return fail("must be at most %v", *s.Maximum)
+		}
+		return ps
+	case bool:
+		if s.Type != "boolean" && s.Type != "" {
+			return fail("must be %s", typeName(s.Type))
+		}
+		return ps
+	}
+	return fail("has an unexpected type")
+}
+
+// checkObject is checkValue for objects.
+func (s *schema) checkObject(v map[string]interface{}, name string, ps []invalidParam) []invalidParam {
+	prefix := name
+	if prefix != "" {
+		prefix += "."
+	}
+	// Check fields in a stable order, so problems are listed in one.
+	keys := make([]string, 0, len(v))
+	for k := range v {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	present := make(map[string]bool)
+	for _, k := range keys {
+		p, prop := s.property(k)
+		switch {
+		case prop != nil:
+			present[p] = true
+			ps = prop.checkValue(v[k], prefix+p, ps)
+		case s.AdditionalProperties != nil && !*s.AdditionalProperties:
+			ps = append(ps, invalidParam{Name: prefix + k, Reason: "is not a known field"})
+		}
+	}
+	for _, p := range s.Required {
+		if !present[p] {
+			ps = append(ps, invalidParam{Name: prefix + p, Reason: "is required"})
+		}
+	}
+	return ps
+}
+
+// property returns the property of s named k, in any case, and its name.
+func (s *schema) property(k string) (string, *schema) {
+	if p, ok := s.Properties[k]; ok {
+		return k, p
+	}
+	for name, p := range s.Properties {
+		if strings.EqualFold(name, k) {
+			return name, p
+		}
+	}
+	return "", nil
+}
+
+// typeName returns a JSON type with its article, for reasons.
+func typeName(typ string) string {
+	switch typ {
+	case "object", "array", "integer":
+		return "an " + typ
+	case "number":
+		return "a number"
+	}
+	return "a " + typ
+}
+
+func isDateTime(s string) bool {
+	_, err := time.Parse(time.RFC3339Nano, s)
+	return err == nil
+}
+
+func quoteAll(ss []string) []string {
+	q := make([]string, len(ss))
+	for i, s := range ss {
+		q[i] = strconv.Quote(s)
+	}
+	return q
+}
+
+// Helpers for schema literals.
+
+func intp(n int) *int           { return &n }
+func floatp(f float64) *float64 { return &f }
+func boolp(b bool) *bool        { return &b }
+
+var (
+	// treatSchema describes the Treat in the body of create and update
+	// requests, as checkAPITreat would accept it.
+	treatSchema = &schema{
+		ID:                   "treat.json",
+		Title:                "Treat",
+		Type:                 "object",
+		Required:             []string{"Title"},
+		Properties:           treatProperties(),
+		AdditionalProperties: boolp(false),
+	}
+
+	// treatPatchSchema describes the body of PATCH requests: any fields of
+	// a Treat.
+	treatPatchSchema = &schema{
+		ID:                   "treat-patch.json",
+		Title:                "Treat fields",
+		Type:                 "object",
+		Properties:           treatProperties(),
+		AdditionalProperties: boolp(false),
+	}
+
+	// batchSchema describes the body of batch requests. Its treats are
+	// checked one at a time, see batchFromJSON.
+	batchSchema = &schema{
+		ID:       "batch.json",
+		Title:    "Batch",
+		Type:     "object",
+		Required: []string{"Treats"},
+		Properties: map[string]*schema{
+			"Treats": {Type: "array", MinItems: intp(1), MaxItems: intp(maxBatchWrites), Items: treatSchema},
+		},
+		AdditionalProperties: boolp(false),
+	}
+
+	// shelfSchema describes the body of shelf create requests.
+	shelfSchema = &schema{
+		ID:       "shelf.json",
+		Title:    "Shelf",
+		Type:     "object",
+		Required: []string{"Name"},
+		Properties: map[string]*schema{
+			"ID":      {Type: "string", ReadOnly: true},
+			"Name":    {Type: "string", MinLength: intp(1), MaxLength: intp(maxShelfName)},
+			"Query":   {Type: "string", Description: "The list page's query string, such as tag=vegan&q=brownie."},
+			"Created": {Type: "string", Format: "date-time", ReadOnly: true},
+		},
+		AdditionalProperties: boolp(false),
+	}
+
+	// apiSchemas are the schemas served, by name.
+	apiSchemas = map[string]*schema{
+		"treat":       treatSchema,
+		"treat-patch": treatPatchSchema,
+		"batch":       batchSchema,
+		"shelf":       shelfSchema,
+	}
+)
+
+// treatProperties returns the properties of treatSchema, which must be the
+// fields of Treat in its JSON.
+func treatProperties() map[string]*schema {
+	str := func() *schema { return &schema{Type: "string"} }
+	line := func(max int) *schema { return &schema{Type: "string", MaxLength: intp(max)} }
+	url := func() *schema { return &schema{Type: "string", Pattern: `^(https?://[^/?#\s]+.*)?$`} }
+	when := func() *schema { return &schema{Type: "string", Format: "date-time"} }
+	count := func() *schema { return &schema{Type: "integer", Minimum: floatp(0)} }
+	mass := func() *schema { return &schema{Type: "number", Minimum: floatp(0)} }
+	return map[string]*schema{
+		"ID":            {Type: "string", ReadOnly: true},
+		"Title":         {Type: "string", MinLength: intp(1)},
+		"Author":        str(),
+		"PublishedDate": str(),
+		"ImageURL":      url(),
+		"AltText":       line(maxAltText),
+		"Caption":       line(maxCaption),
+		"Description":   str(),
+		"ThumbnailURL":  url(),
+		"Nutrition": {
+			Type:     "object",
+			Nullable: true,
+			Properties: map[string]*schema{
+				"ServingSize": mass(),
+				"Calories":    mass(),
+				"Sugar":       mass(),
+				"Fat":         mass(),
+			},
+			AdditionalProperties: boolp(false),
+		},
+		"Allergens":         {Type: "array", Nullable: true, Items: &schema{Type: "string", Enum: allergens}},
+		"Tags":              {Type: "array", Nullable: true, Items: str()},
+		"Quantity":          {Type: "integer", Minimum: floatp(0), Nullable: true},
+		"LowStockThreshold": count(),
+		"Price": {
+			Type:     "object",
+			Nullable: true,
+			Required: []string{"Currency"},
+			Properties: map[string]*schema{
+				"Amount":   count(),
+				"Currency": {Type: "string", Enum: currencyCodes},
+			},
+			AdditionalProperties: boolp(false),
+		},
+		"LocationID": str(),
+		"Place": {
+			Type:     "object",
+			Nullable: true,
+			Properties: map[string]*schema{
+				"Address": str(),
+				"Lat":     {Type: "number", Minimum: floatp(-90), Maximum: floatp(90)},
+				"Lng":     {Type: "number", Minimum: floatp(-180), Maximum: floatp(180)},
+				"Geohash": {Type: "string", ReadOnly: true},
+			},
+			AdditionalProperties: boolp(false),
+		},
+		"ExpiresAt":    when(),
+		"Archived":     {Type: "boolean", ReadOnly: true},
+		"DeletedAt":    {Type: "string", Format: "date-time", ReadOnly: true},
+		"VisibleFrom":  when(),
+		"VisibleUntil": when(),
+		"Review":       {Type: "string", ReadOnly: true},
+		"ReviewReason": {Type: "string", ReadOnly: true},
+	}
+}
+
+// validationError returns the 400 appError for a request body with the
+// given problems.
+func (t *Treatshelf) validationError(r *http.Request, ps []invalidParam) *appError {
+	reasons := make([]string, len(ps))
+	for i, p := range ps {
+		reasons[i] = p.Name + " " + p.Reason
+	}
+	err := fmt.Errorf("invalid request: %s", strings.Join(reasons, "; "))
+	e := t.appErrorCodef(r, http.StatusBadRequest, err, "%v", err).withProblemType("validation-failed")
+	e.invalidParams = ps
+	return e
+}
+
+// decodeJSON reads the JSON body of r, checks it against s and decodes it
+// into v.
+func (t *Treatshelf) decodeJSON(r *http.Request, s *schema, v interface{}) *appError {
+	var b json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&b); err != nil {
+		return t.appErrorCodef(r, http.StatusBadRequest, err, "invalid JSON: %v", err)
+	}
+	if ps := s.check(b); len(ps) > 0 {
+		return t.validationError(r, ps)
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return t.appErrorCodef(r, http.StatusBadRequest, err, "invalid JSON: %v", err)
+	}
+	return nil
+}
+
+// apiSchemaHandler serves the JSON Schema named in the route.
+func (t *Treatshelf) apiSchemaHandler(w http.ResponseWriter, r *http.Request) *appError {
+	s, ok := apiSchemas[mux.Vars(r)["name"]]
+	if !ok {
+		err := fmt.Errorf("no schema %q", mux.Vars(r)["name"])
+		return t.appErrorCodef(r, http.StatusNotFound, err, "%v", err)
+	}
+	doc := *s
+	doc.Schema = "https://json-schema.org/draft/2020-12/schema"
+	doc.ID = t.url("/api/schemas/" + s.ID)
+	b, err := json.MarshalIndent(&doc, "", "  ")
+	if err != nil {
+		return t.appErrorf(r, err, "could not encode schema: %v", err)
+	}
+	w.Header().Set("Content-Type", "application/schema+json")
+	w.Write(b)
+	return nil
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestTreatSchemaDescribesTreat(t *testing.T) {
+	typ := reflect.TypeOf(Treat{})
+	fields := make(map[string]bool)
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		if f.PkgPath != "" || f.Tag.Get("json") == "-" {
+			continue
+		}
+		fields[f.Name] = true
+		if treatSchema.Properties[f.Name] == nil {
+			t.Errorf("Treat.%s is not in treatSchema", f.Name)
+		}
+	}
+	for p := range treatSchema.Properties {
+		if !fields[p] {
+			t.Errorf("treatSchema has property %s, which Treat doesn't have", p)
+		}
+	}
+	for name, s := range apiSchemas {
+		if _, err := json.Marshal(s); err != nil {
+			t.Errorf("schema %s: %v", name, err)
+		}
+	}
+}
+
+func TestSchemaCheck(t *testing.T) {
+	for _, tt := range []struct {
+		body string
+		want []string // "name reason"
+	}{
+		{`{"Title": "Brownie"}`, nil},
+		{`{"title": "Brownie", "quantity": 3, "Nutrition": null, "Tags": null}`, nil},
+		{`{"Title": "Brownie", "ExpiresAt": "0001-01-01T00:00:00Z", "Review": "pending"}`, nil},
+		{`{}`, []string{"Title is required"}},
+		{`[]`, []string{"body must be an object"}},
+		{`{"Title": ""}`, []string{"Title is required"}},
+		{`{"Title": "B", "Titel": "B"}`, []string{"Titel is not a known field"}},
+		{`{"Title": "B", "Quantity": -1}`, []string{"Quantity must be at least 0"}},
+		{`{"Title": "B", "Quantity": 1.5}`, []string{"Quantity must be a whole number"}},
+		{`{"Title": "B", "Quantity": "3"}`, []string{"Quantity must be an integer"}},
+		{`{"Title": "B", "Tags": ["a", 2]}`, []string{"Tags[1] must be a string"}},
+		{`{"Title": "B", "Allergens": ["nuts", "glitter"]}`, []string{`Allergens[1] must be one of "dairy", "eggs", "gluten", "nuts", "peanuts", "sesame", "soy"`}},
+		{`{"Title": "B", "ImageURL": "javascript:alert(1)"}`, []string{"ImageURL is not in the expected form"}},
+		{`{"Title": "B", "VisibleFrom": "tomorrow"}`, []string{"VisibleFrom must be an RFC 3339 date and time, such as 2024-12-25T09:00:00Z"}},
+		{`{"Title": "B", "Nutrition": {"Calories": -5}, "Price": {"Amount": 100}}`, []string{"Nutrition.Calories must be at least 0", "Price.Currency is required"}},
+		{`{"Title": "B", "Place": {"Lat": 91}}`, []string{"Place.Lat must be at most 90"}},
+	} {
+		var got []string
+		for _, p := range treatSchema.check([]byte(tt.body)) {
+			got = append(got, p.Name+" "+p.Reason)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("check(%s) = %q, want %q", tt.body, got, tt.want)
+		}
+	}
+}
+
+// fuzzRuns is how many documents each fuzz test below sends.
+const fuzzRuns = 300
+
+// generate returns a random value that s accepts.
+func (s *schema) generate(rnd *rand.Rand) interface{} {
+	if s.Nullable && rnd.Intn(4) == 0 {
+		return nil
+	}
+	switch s.Type {
+	case "object":
+		v := make(map[string]interface{})
+		for _, name := range sortedProperties(s) {
+			if contains(s.Required, name) || rnd.Intn(3) == 0 {
+				v[name] = s.Properties[name].generate(rnd)
+			}
+		}
+		return v
+	case "array":
+		n := rnd.Intn(4)
+		if s.MinItems != nil && n < *s.MinItems {
+			n = *s.MinItems
+		}
+		v := make([]interface{}, n)
+		for i := range v {
+			v[i] = s.Items.generate(rnd)
+		}
+		return v
+	case "integer", "number":
+		lo, hi := -1000.0, 1000.0
+		if s.Minimum != nil {
+			lo = *s.Minimum
+		}
+		if s.Maximum != nil {
+			hi = *s.Maximum
+		}
+		f := lo + rnd.Float64()*(hi-lo)
+		if s.Type == "integer" {
+			return int64(f)
+		}
+		return f
+	case "boolean":
+		return rnd.Intn(2) == 0
+	}
+	switch {
+	case len(s.Enum) > 0:
+		return s.Enum[rnd.Intn(len(s.Enum))]
+	case s.Format == "date-time":
+		return time.Unix(rnd.Int63n(4e9), 0).UTC().Format(time.RFC3339)
+	case s.Pattern != "":
+		return []string{"", "https://example.com/brownie.jpg"}[rnd.Intn(2)]
+	}
+	words := []string{"Brownie", "🍫", "שוקולד", "<b>", "a\u0000b", `"quoted"`, "  "}
+	str := words[rnd.Intn(len(words))]
+	if s.MinLength != nil && *s.MinLength > 0 {
+		str = "Treat " + str
+	}
+	if s.MaxLength != nil && len([]rune(str)) > *s.MaxLength {
+		str = string([]rune(str)[:*s.MaxLength])
+	}
+	return str
+}
+
+// breakValue changes a random field of v, a value of s, so that s refuses
+// it, and returns the changed value.
+func (s *schema) breakValue(rnd *rand.Rand, v map[string]interface{}) map[string]interface{} {
+	names := sortedProperties(s)
+	name := names[rnd.Intn(len(names))]
+	p := s.Properties[name]
+	switch {
+	case rnd.Intn(5) == 0:
+		v[name+"Typo"] = "x"
+	case p.Type == "string" && p.MaxLength != nil:
+		v[name] = strings.Repeat("x", *p.MaxLength+1)
+	case p.Type == "integer" && p.Minimum != nil:
+		v[name] = *p.Minimum - 1
+	case p.Type == "string":
+		v[name] = []string{"not", "a string"}
+	default:
+		v[name] = "not a " + p.Type
+	}
+	return v
+}
+
+func sortedProperties(s *schema) []string {
+	var names []string
+	for name := range s.Properties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// checkFuzzed fails t if a handler returned a server error, or answered a
+// document s refuses without saying which fields are wrong, or one it
+// accepts with a validation problem.
+func checkFuzzed(t *testing.T, body []byte, valid bool, code int, e *appError) {
+	switch {
+	case e == nil && !valid:
+		t.Errorf("%s: accepted, with status %d", body, code)
+	case e == nil:
+	case e.code >= 500:
+		t.Errorf("%s: %d: %s", body, e.code, e.message)
+	case !valid && (e.code != http.StatusBadRequest || len(e.invalidParams) == 0):
+		t.Errorf("%s: %d %s, want validation-failed", body, e.code, e.message)
+	case valid && len(e.invalidParams) > 0:
+		t.Errorf("%s: refused valid document: %s", body, e.message)
+	}
+}
+
+func TestFuzzCreateTreat(t *testing.T) {
+	shelf := brownieShelf(t)
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < fuzzRuns; i++ {
+		v := treatSchema.generate(rnd).(map[string]interface{})
+		valid := i%2 == 0
+		if !valid {
+			v = treatSchema.breakValue(rnd, v)
+		}
+		body, _ := json.Marshal(v)
+		if got := len(treatSchema.check(body)) == 0; got != valid {
+			t.Fatalf("%s: generated valid=%v, but check says %v", body, valid, got)
+		}
+		w := httptest.NewRecorder()
+		e := shelf.apiCreateHandler(w, httptest.NewRequest("POST", "/api/v1/treats", bytes.NewReader(body)))
+		checkFuzzed(t, body, valid, w.Code, e)
+	}
+}
+
+func TestFuzzPatchTreat(t *testing.T) {
+	shelf := brownieShelf(t)
+	rnd := rand.New(rand.NewSource(2))
+	for i := 0; i < fuzzRuns; i++ {
+		v := treatPatchSchema.generate(rnd).(map[string]interface{})
+		valid := i%2 == 0
+		if !valid {
+			v = treatPatchSchema.breakValue(rnd, v)
+		}
+		if len(v) == 0 {
+			continue
+		}
+		body, _ := json.Marshal(v)
+		r := httptest.NewRequest("PATCH", "/api/v1/treats/1", bytes.NewReader(body))
+		r.Header.Set("If-Match", "*")
+		r = mux.SetURLVars(r, map[string]string{"id": "1"})
+		w := httptest.NewRecorder()
+		e := shelf.apiPatchHandler(w, r)
+		if e != nil && e.code == http.StatusBadRequest && strings.HasPrefix(e.message, "invalid updateMask") {
+			// Only read-only fields were generated.
+			continue
+		}
+		checkFuzzed(t, body, valid, w.Code, e)
+	}
+}
+
+func TestFuzzBatchCreate(t *testing.T) {
+	shelf := brownieShelf(t)
+	rnd := rand.New(rand.NewSource(3))
+	for i := 0; i < fuzzRuns/10; i++ {
+		var treats []interface{}
+		broken := make(map[int]bool)
+		for j := 0; j < 10; j++ {
+			v := treatSchema.generate(rnd).(map[string]interface{})
+			if rnd.Intn(3) == 0 {
+				v, broken[j] = treatSchema.breakValue(rnd, v), true
+			}
+			treats = append(treats, v)
+		}
+		body, _ := json.Marshal(map[string]interface{}{"Treats": treats})
+		w := httptest.NewRecorder()
+		e := shelf.apiBatchCreateHandler(w, httptest.NewRequest("POST", "/api/v1/treats:batchCreate", bytes.NewReader(body)))
+		if e != nil {
+			t.Fatalf("%s: %d: %s", body, e.code, e.message)
+		}
+		var resp struct{ Results []*batchResult }
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		for j, res := range resp.Results {
+			if broken[j] != (len(res.InvalidParams) > 0) {
+				t.Errorf("%s: treat %d (broken: %v): %s", body, j, broken[j], fmt.Sprint(res.Status, " ", res.Error))
+			}
+		}
+	}
+}
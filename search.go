@@ -0,0 +1,145 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// The search box matches treats whose title, author or tags contain every
+// word of the query. Words are compared without case or accents, and
+// tolerate typos: "brwonie" finds "brownie". Each query word may be at most
+// ListOptions.Fuzziness edits (insertions, deletions, substitutions or
+// swaps of neighbouring letters) from a word of the treat, fewer for short
+// words, so that "tart" doesn't find "part". Matches are ranked, exact
+// prefixes first, then other substrings, then typos.
+
+// defaultSearchFuzziness is the most edits a query word may be from the
+// word it matches, unless SEARCH_FUZZINESS is set.
+const defaultSearchFuzziness = 2
+
+// maxSearchTerms bounds the number of words in a query that are matched.
+const maxSearchTerms = 8
+
+// Ranks of a query word's match, better first.
+const (
+	matchPrefix = iota
+	matchSubstring
+	matchTypo
+	noMatch
+)
+
+// searchTerms splits query into the words that are matched.
+func searchTerms(query string) []string {
+	terms := strings.Fields(foldText(query))
+	if len(terms) > maxSearchTerms {
+		terms = terms[:maxSearchTerms]
+	}
+	return terms
+}
+
+// foldText lowercases s and removes its accents, so that "Éclair" reads
+// "eclair".
+func foldText(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.Is(unicode.Mn, r) {
+			return -1
+		}
+		return unicode.ToLower(r)
+	}, norm.NFD.String(cleanLine(s)))
+}
+
+// searchWords returns the folded words of the fields of t that are
+// searched.
+func searchWords(t *Treat) []string {
+	text := t.Title + " " + t.Author + " " + strings.Join(t.Tags, " ")
+	return strings.FieldsFunc(foldText(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// searchRank returns how well t matches every one of terms, lower being
+// better, and whether it matches at all. fuzziness is the most edits a term
+// may be from a word.
+func searchRank(t *Treat, terms []string, fuzziness int) (rank int, ok bool) {
+	words := searchWords(t)
+	for _, term := range terms {
+		best := noMatch
+		for _, w := range words {
+			if m := matchWord(term, w, fuzziness); m < best {
+				best = m
+			}
+		}
+		if best == noMatch {
+			return 0, false
+		}
+		rank += best
+	}
+	return rank, true
+}
+
+// matchWord returns how well term matches word.
+func matchWord(term, word string, fuzziness int) int {
+	switch {
+	case strings.HasPrefix(word, term):
+		return matchPrefix
+	case strings.Contains(word, term):
+		return matchSubstring
+	}
+	t, w := []rune(term), []rune(word)
+	// Allow one edit per four letters of the term, so that short words
+	// don't match most others.
+	if max := len(t) / 4; max < fuzziness {
+		fuzziness = max
+	}
+	if fuzziness == 0 {
+		return noMatch
+	}
+	// Compare with the word's prefix too, so that misspelt words match
+	// while they are still being typed.
+	if editDistance(t, w) <= fuzziness ||
+		(len(w) > len(t) && editDistance(t, w[:len(t)]) <= fuzziness) {
+		return matchTypo
+	}
+	return noMatch
+}
+
+// editDistance returns the optimal string alignment distance between a and
+// b: the number of insertions, deletions, substitutions and swaps of
+// adjacent runes that turn one into the other, editing no rune twice.
+func editDistance(a, b []rune) int {
+	// d[i][j] is the distance between a[:i] and b[:j]; only the last three
+	// rows are kept.
+	prev2 := make([]int, len(b)+1)
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] && prev2[j-2]+1 < cur[j] {
+				cur[j] = prev2[j-2] + 1
+			}
+		}
+		prev2, prev, cur = prev, cur, prev2
+	}
+	return prev[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
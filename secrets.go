@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	secretmanager "google.golang.org/api/secretmanager/v1"
+)
+
+// Configuration values that are secrets, such as API keys and client
+// secrets, can name a secret in Secret Manager instead of holding it: a
+// value of "sm://NAME" is replaced by the latest version of the secret
+// NAME in the app's project. Values are cached for secretRefresh, so that
+// rotated secrets are picked up without a restart by whatever reads them at
+// the time of use, such as OIDC client secrets.
+
+// secretPrefix starts configuration values naming a secret.
+const secretPrefix = "sm://"
+
+// secretRefresh is how long secret values are cached for.
+const secretRefresh = 5 * time.Minute
+
+// SecretProvider reads secrets.
+type SecretProvider interface {
+	// AccessSecret returns the latest version of the named secret.
+	AccessSecret(ctx context.Context, name string) (string, error)
+}
+
+// secretManager reads secrets from Google Secret Manager. It connects on
+// first use, so that apps without secrets don't need the API enabled.
+// See https://cloud.google.com/secret-manager/docs.
+type secretManager struct {
+	project string
+
+	once sync.Once
+	svc  *secretmanager.Service
+	err  error
+}
+
+// AccessSecret returns the latest version of the named secret.
+func (m *secretManager) AccessSecret(ctx context.Context, name string) (string, error) {
+	m.once.Do(func() {
+		m.svc, m.err = secretmanager.NewService(context.Background())
+	})
+	if m.err != nil {
+		return "", fmt.Errorf("could not connect to Secret Manager: %v", m.err)
+	}
+	version := fmt.Sprintf("projects/%s/secrets/%s/versions/latest", m.project, name)
+	resp, err := m.svc.Projects.Secrets.Versions.Access(version).Context(ctx).Do()
+	if err != nil {
+		return "", fmt.Errorf("could not access secret %q: %v", name, err)
+	}
+	if resp.Payload == nil {
+		return "", fmt.Errorf("secret %q has no payload", name)
+	}
+	b, err := base64.StdEncoding.DecodeString(resp.Payload.Data)
+	if err != nil {
+		return "", fmt.Errorf("could not decode secret %q: %v", name, err)
+	}
+	return string(b), nil
+}
+
+// secretCache resolves configuration values, caching the secrets they name.
+// A nil secretCache resolves values not naming a secret only.
+type secretCache struct {
+	provider SecretProvider
+	clock    Clock // tells when secrets are due a refresh, see clock.go.
+
+	mu     sync.Mutex
+	values map[string]cachedSecret
+}
+
+type cachedSecret struct {
+	value   string
+	fetched time.Time
+}
+
+func newSecretCache(p SecretProvider, clock Clock) *secretCache {
+	return &secretCache{provider: p, clock: clock, values: make(map[string]cachedSecret)}
+}
+
+// resolve returns value, or the secret it names if it starts with
+// secretPrefix. Should refreshing a cached secret fail, the cached value is
+// returned: it is more likely still valid than not.
+func (c *secretCache) resolve(ctx context.Context, value string) (string, error) {
+	if !strings.HasPrefix(value, secretPrefix) {
+		return value, nil
+	}
+	if c == nil {
+		return "", errors.New("secrets are not available")
+	}
+	name := strings.TrimPrefix(value, secretPrefix)
+
+	c.mu.Lock()
+	cached, ok := c.values[name]
+	c.mu.Unlock()
+	if ok && c.clock.Now().Sub(cached.fetched) < secretRefresh {
+		return cached.value, nil
+	}
+
+	v, err := c.provider.AccessSecret(ctx, name)
+	if err != nil {
+		if ok {
+			return cached.value, nil
+		}
+		return "", err
+	}
+	c.mu.Lock()
+	c.values[name] = cachedSecret{value: v, fetched: c.clock.Now()}
+	c.mu.Unlock()
+	return v, nil
+}
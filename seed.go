@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"path"
+	"path/filepath"
+)
+
+// Seed data is a curated set of treats, with pictures, for demos,
+// screenshots and end-to-end tests to start from. Run the app with -seed to
+// load it into whichever database is configured before serving:
+//
+//	go run . -seed
+//
+// Seeding again resets the seeded treats, which have fixed IDs, and leaves
+// the others alone. Pictures are stored under names derived from their
+// contents, so they are replaced rather than copied.
+
+// seedFlag loads the seed data at startup.
+var seedFlag = flag.Bool("seed", false, "load the treats in "+seedDir+" before serving")
+
+// seedDir holds the seed data: treats.json, and the pictures it names.
+const seedDir = "testdata/seed"
+
+// seedTreat is a treat in treats.json. Location is the name of the
+// location it is on, added if there is none by that name, and Picture the
+// file of its picture, in the same directory.
+type seedTreat struct {
+	Treat
+	Location string
+	Picture  string
+}
+
+// seed loads the seed data in dir and returns the number of treats it
+// saved. Without a picture bucket, treats are saved without pictures.
+func (t *Treatshelf) seed(ctx context.Context, dir string) (int, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, "treats.json"))
+	if err != nil {
+		return 0, err
+	}
+	var fixtures []*seedTreat
+	if err := json.Unmarshal(b, &fixtures); err != nil {
+		return 0, fmt.Errorf("%s: %v", filepath.Join(dir, "treats.json"), err)
+	}
+
+	locations := make(map[string]string) // maps from name to ID.
+	existing, err := t.Locations.ListLocations(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("could not list locations: %v", err)
+	}
+	for _, l := range existing {
+		locations[l.Name] = l.ID
+	}
+
+	var treats []*Treat
+	for _, f := range fixtures {
+		treat := f.Treat
+		if treat.ID == "" {
+			return 0, fmt.Errorf("seed treat %q has no ID", treat.Title)
+		}
+		if f.Location != "" {
+			id, ok := locations[f.Location]
+			if !ok {
+				if id, err = t.Locations.AddLocation(ctx, &Location{Name: f.Location, Timezone: "UTC"}); err != nil {
+					return 0, fmt.Errorf("could not add location %q: %v", f.Location, err)
+				}
+				locations[f.Location] = id
+			}
+			treat.LocationID = id
+		}
+		if f.Picture != "" {
+			treat.ImageURL, treat.ThumbnailURL, err = t.seedPicture(ctx, dir, f.Picture)
+			if err != nil {
+				fmt.Fprintf(t.logWriter, "No picture for seed treat %q: %v\n", treat.ID, err)
+			}
+		}
+		if err := treat.validate(); err != nil {
+			return 0, fmt.Errorf("seed treat %q: %v", treat.ID, err)
+		}
+		treats = append(treats, &treat)
+	}
+	if err := t.DB.SaveTreats(ctx, treats); err != nil {
+		return 0, fmt.Errorf("could not save seed treats: %v", err)
+	}
+	return len(treats), nil
+}
+
+// seedPicture stores the picture in the named file of dir, and a thumbnail
+// of it, under names derived from its contents.
+func (t *Treatshelf) seedPicture(ctx context.Context, dir, file string) (url, thumbnailURL string, err error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, file))
+	if err != nil {
+		return "", "", err
+	}
+	sum := sha256.Sum256(b)
+	name := "seed-" + hex.EncodeToString(sum[:8]) + path.Ext(file)
+	url, err = t.putPicture(ctx, bytes.NewReader(b), name, mime.TypeByExtension(path.Ext(file)), nil)
+	if err != nil {
+		return "", "", err
+	}
+	// The picture is usable without a thumbnail, as on upload.
+	thumb, err := t.images.thumbnail(ctx, bytes.NewReader(b))
+	if err == nil {
+		thumbnailURL, err = t.uploadThumbnail(ctx, url, thumb)
+	}
+	if err != nil {
+		fmt.Fprintf(t.logWriter, "No thumbnail for %q: %v\n", file, err)
+	}
+	return url, thumbnailURL, nil
+}
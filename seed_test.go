@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSeed(t *testing.T) {
+	db := newMemoryDB()
+	shelf := &Treatshelf{DB: db, Locations: db, logWriter: ioutil.Discard}
+	useFakeClock(shelf, db)
+	ctx := context.Background()
+	if _, err := db.AddTreat(ctx, &Treat{Title: "Mine"}); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := shelf.seed(ctx, seedDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n == 0 {
+		t.Fatal("no treats seeded")
+	}
+	seeded, err := db.GetTreat(ctx, "seed-brownie")
+	if err != nil {
+		t.Fatal(err)
+	}
+	seeded.Title = "Changed"
+	if err := db.UpdateTreat(ctx, seeded); err != nil {
+		t.Fatal(err)
+	}
+
+	// Seeding again resets the seeded treats and adds nothing else.
+	again, err := shelf.seed(ctx, seedDir)
+	if err != nil || again != n {
+		t.Fatalf("seeding again: %d, %v; want %d", again, err, n)
+	}
+	if got, _ := db.GetTreat(ctx, "seed-brownie"); got == nil || got.Title != "Fudge brownie" {
+		t.Errorf("seeding again left %+v", got)
+	}
+	treats, err := db.ListTreats(ctx, ListOptions{IncludeExpired: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(treats) != n+1 {
+		t.Errorf("%d treats after seeding twice, want %d", len(treats), n+1)
+	}
+	locations, err := db.ListLocations(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(locations) != 2 {
+		t.Errorf("%d locations after seeding twice, want 2", len(locations))
+	}
+}
+
+func TestSeedPictures(t *testing.T) {
+	pictures, err := filepath.Glob(filepath.Join(seedDir, "*.png"))
+	if err != nil || len(pictures) == 0 {
+		t.Fatalf("no pictures in %s: %v", seedDir, err)
+	}
+	for _, p := range pictures {
+		f, err := os.Open(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := makeThumbnail(f); err != nil {
+			t.Errorf("%s: %v", p, err)
+		}
+		f.Close()
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gofrs/uuid"
+)
+
+// sessionCookie is the name of the cookie holding the session.
+const sessionCookie = "treatshelf_session"
+
+// session holds per-browser state that persists across requests.
+type session struct {
+	// ID identifies the browser for per-session storage.
+	ID string `json:"id"`
+	// LocationID is the location selected in the header, or "" for all.
+	LocationID string `json:"loc,omitempty"`
+	// Recent are the IDs of the treats viewed last, newest first, see
+	// recent.go.
+	Recent []string `json:"recent,omitempty"`
+}
+
+// sessionMaxAge is how long browsers keep the session cookie.
+const sessionMaxAge = 365 * 24 * time.Hour
+
+// session returns the session carried by the request, or a new session if
+// there is none or it isn't signed by t.keyring. The session is signed so
+// that nobody can take over another's session ID, and with it their
+// preferences.
+func (t *Treatshelf) session(r *http.Request) *session {
+	s := &session{}
+	if _, err := t.signedCookie(r, sessionCookie, s); err == nil && s.ID != "" {
+		return s
+	}
+	return &session{ID: uuid.Must(uuid.NewV4()).String()}
+}
+
+// saveSession writes s to the response as a signed cookie.
+func (t *Treatshelf) saveSession(w http.ResponseWriter, s *session) error {
+	return t.setSignedCookie(w, sessionCookie, s, sessionMaxAge)
+}
+
+// flashCookie is the name of the cookie holding a one-time flash message.
+const flashCookie = "treatshelf_flash"
+
+// flash is a message shown once, on the next page rendered.
+type flash struct {
+	Message string `json:"msg"`
+	// UndoToken, if set, offers an Undo button for the action the message
+	// describes (see undo.go).
+	UndoToken string `json:"undo,omitempty"`
+}
+
+// setFlash arranges for f to be shown on the next page rendered.
+func setFlash(w http.ResponseWriter, f *flash) error {
+	b, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     flashCookie,
+		Value:    base64.RawURLEncoding.EncodeToString(b),
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// takeFlash returns the pending flash message, if any, and clears it.
+func takeFlash(w http.ResponseWriter, r *http.Request) *flash {
+	c, err := r.Cookie(flashCookie)
+	if err != nil {
+		return nil
+	}
+	http.SetCookie(w, &http.Cookie{Name: flashCookie, Path: "/", MaxAge: -1})
+	f := &flash{}
+	b, err := base64.RawURLEncoding.DecodeString(c.Value)
+	if err != nil || json.Unmarshal(b, f) != nil {
+		return nil
+	}
+	return f
+}
@@ -0,0 +1,486 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/api/option"
+	sheets "google.golang.org/api/sheets/v4"
+)
+
+// An admin can link a Google Sheet at /admin/sheets, which is then synced
+// both ways every 15 minutes (see cron.yaml), or on demand: rows added to
+// the sheet become treats, rows edited there change their treat, and
+// treats added or changed in the app are written to the sheet. The sheet
+// must be shared with the app's service account.
+//
+// The sheet has a header row of sheetColumns. Its last column, SyncHash,
+// holds a hash of the row as last synced, so that a sync can tell which
+// side changed a row since: if both did, SheetSync.Prefer decides which
+// wins, and the conflict is listed on the status page. Treats deleted in
+// the app are left in the sheet, and reported.
+
+// sheetColumns are the header row of a synced sheet.
+var sheetColumns = []string{"ID", "Title", "Author", "Description", "Quantity", "Tags", "ExpiresAt", "SyncHash"}
+
+// syncedColumns is the number of columns holding treat fields.
+var syncedColumns = len(sheetColumns) - 1
+
+// Sides of a sync, for SheetSync.Prefer.
+const (
+	preferApp   = "app"
+	preferSheet = "sheet"
+)
+
+// maxSheetMessages bounds SheetSync.Conflicts and Errors.
+const maxSheetMessages = 50
+
+// SheetSync is the linked sheet and the outcome of its last sync. It is
+// shared by every instance through a SheetSyncStore.
+type SheetSync struct {
+	// SpreadsheetID and Sheet, the name of the tab, are the linked sheet.
+	// Nothing is synced if SpreadsheetID is "".
+	SpreadsheetID string
+	Sheet         string
+	// Prefer is the side, preferApp or preferSheet, whose change is kept
+	// when a row changed on both since the last sync.
+	Prefer   string
+	LinkedBy string
+	Linked   time.Time
+
+	LastRun   time.Time
+	LastError string
+	// Pulled treats were changed from the sheet, and Added from new rows.
+	// Pushed rows were changed from the app, and Appended for new treats.
+	Pulled, Added, Pushed, Appended int
+	Conflicts                       []string
+	Errors                          []string
+}
+
+// SheetSyncStore persists the SheetSync.
+type SheetSyncStore interface {
+	GetSheetSync(ctx context.Context) (SheetSync, error)
+	SetSheetSync(ctx context.Context, s SheetSync) error
+}
+
+// SheetsClient reads and writes the rows of a sheet, as strings.
+type SheetsClient interface {
+	// ReadRows returns the rows of the sheet, starting with the header.
+	ReadRows(ctx context.Context, spreadsheetID, sheet string) ([][]string, error)
+
+	// WriteRows replaces the rows with the given 1-based numbers.
+	WriteRows(ctx context.Context, spreadsheetID, sheet string, rows map[int][]string) error
+
+	// AppendRows adds rows after the last row with values.
+	AppendRows(ctx context.Context, spreadsheetID, sheet string, rows [][]string) error
+}
+
+// googleSheets is a SheetsClient for the Google Sheets API. It connects on
+// first use, as secretManager does.
+type googleSheets struct {
+	once sync.Once
+	svc  *sheets.Service
+	err  error
+}
+
+func (g *googleSheets) service() (*sheets.Service, error) {
+	g.once.Do(func() {
+		g.svc, g.err = sheets.NewService(context.Background(), option.WithScopes(sheets.SpreadsheetsScope))
+	})
+	if g.err != nil {
+		return nil, fmt.Errorf("could not connect to Google Sheets: %v", g.err)
+	}
+	return g.svc, nil
+}
+
+// sheetRange returns the A1 notation of the synced columns of rows from to
+// to of sheet. to may be 0 for every row after from.
+func sheetRange(sheet string, from, to int) string {
+	last := string(rune('A' + len(sheetColumns) - 1))
+	r := fmt.Sprintf("'%s'!A%d:%s", strings.Replace(sheet, "'", "''", -1), from, last)
+	if to > 0 {
+		r += strconv.Itoa(to)
+	}
+	return r
+}
+
+// ReadRows returns the rows of the sheet, starting with the header.
+func (g *googleSheets) ReadRows(ctx context.Context, spreadsheetID, sheet string) ([][]string, error) {
+	svc, err := g.service()
+	if err != nil {
+		return nil, err
+	}
+	vr, err := svc.Spreadsheets.Values.Get(spreadsheetID, sheetRange(sheet, 1, 0)).
+		ValueRenderOption("FORMATTED_VALUE").Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("could not read the sheet: %v", err)
+	}
+	rows := make([][]string, len(vr.Values))
+	for i, vs := range vr.Values {
+		rows[i] = make([]string, len(vs))
+		for j, v := range vs {
+			rows[i][j] = fmt.Sprint(v)
+		}
+	}
+	return rows, nil
+}
+
+// values converts a row to what the Sheets API takes.
+func values(row []string) []interface{} {
+	vs := make([]interface{}, len(row))
+	for i, v := range row {
+		vs[i] = v
+	}
+	return vs
+}
+
+// WriteRows replaces the rows with the given 1-based numbers.
+func (g *googleSheets) WriteRows(ctx context.Context, spreadsheetID, sheet string, rows map[int][]string) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	svc, err := g.service()
+	if err != nil {
+		return err
+	}
+	req := &sheets.BatchUpdateValuesRequest{ValueInputOption: "RAW"}
+	for n, row := range rows {
+		req.Data = append(req.Data, &sheets.ValueRange{
+			Range:  sheetRange(sheet, n, n),
+			Values: [][]interface{}{values(row)},
+		})
+	}
+	if _, err := svc.Spreadsheets.Values.BatchUpdate(spreadsheetID, req).Context(ctx).Do(); err != nil {
+		return fmt.Errorf("could not write to the sheet: %v", err)
+	}
+	return nil
+}
+
+// AppendRows adds rows after the last row with values.
+func (g *googleSheets) AppendRows(ctx context.Context, spreadsheetID, sheet string, rows [][]string) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	svc, err := g.service()
+	if err != nil {
+		return err
+	}
+	vr := &sheets.ValueRange{}
+	for _, row := range rows {
+		vr.Values = append(vr.Values, values(row))
+	}
+	_, err = svc.Spreadsheets.Values.Append(spreadsheetID, sheetRange(sheet, 1, 0), vr).
+		ValueInputOption("RAW").InsertDataOption("INSERT_ROWS").Context(ctx).Do()
+	if err != nil {
+		return fmt.Errorf("could not append to the sheet: %v", err)
+	}
+	return nil
+}
+
+// requireSheets returns a 404 appError unless sheet sync is available.
+// The sheet routes use it through guard.
+func (t *Treatshelf) requireSheets(r *http.Request) *appError {
+	if t.SheetSync == nil || t.sheets == nil {
+		err := errors.New("Google Sheets sync is not enabled")
+		return t.appErrorCodef(r, http.StatusNotFound, err, "%v", err)
+	}
+	return nil
+}
+
+// treatRow returns the synced columns of treat.
+func treatRow(treat *Treat) []string {
+	expires := ""
+	if e := treat.ExpiresAt.UTC(); !e.IsZero() {
+		expires = e.Format(time.RFC3339)
+		if e.Equal(e.Truncate(24 * time.Hour)) {
+			expires = e.Format("2006-01-02")
+		}
+	}
+	quantity := ""
+	if treat.Quantity != nil {
+		quantity = strconv.Itoa(*treat.Quantity)
+	}
+	return []string{
+		treat.ID, treat.Title, treat.Author, treat.Description,
+		quantity, strings.Join(treat.Tags, ", "), expires,
+	}
+}
+
+// applyRow sets the fields of treat from the synced columns of row, and
+// validates it.
+func applyRow(treat *Treat, row []string) error {
+	treat.Title = strings.TrimSpace(row[1])
+	treat.Author = strings.TrimSpace(row[2])
+	treat.Description = row[3]
+	treat.Quantity = nil
+	if s := strings.TrimSpace(row[4]); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return fmt.Errorf("Quantity must be a whole number, not %q", s)
+		}
+		treat.Quantity = &n
+	}
+	treat.Tags = parseTags(row[5])
+	treat.ExpiresAt = time.Time{}
+	if s := strings.TrimSpace(row[6]); s != "" {
+		e, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			e, err = time.Parse("2006-01-02", s)
+		}
+		if err != nil {
+			return fmt.Errorf("ExpiresAt must be a date such as 2030-12-31, not %q", s)
+		}
+		treat.ExpiresAt = e
+	}
+	if treat.Title == "" {
+		return errors.New("Title is required")
+	}
+	return treat.validate()
+}
+
+// rowHash returns the SyncHash of the synced columns of a row.
+func rowHash(row []string) string {
+	sum := sha256.Sum256([]byte(strings.Join(row, "\x1f")))
+	return hex.EncodeToString(sum[:12])
+}
+
+// syncedRow returns row with its SyncHash.
+func syncedRow(row []string) []string {
+	return append(append([]string(nil), row...), rowHash(row))
+}
+
+// syncSheet syncs treats with the sheet of s both ways, as described
+// above, and records the outcome in s.
+func (t *Treatshelf) syncSheet(ctx context.Context, s *SheetSync) error {
+	s.LastRun = t.now()
+	s.Pulled, s.Added, s.Pushed, s.Appended = 0, 0, 0, 0
+	s.Conflicts, s.Errors = nil, nil
+	note := func(list *[]string, format string, args ...interface{}) {
+		if len(*list) < maxSheetMessages {
+			*list = append(*list, fmt.Sprintf(format, args...))
+		}
+	}
+
+	rows, err := t.sheets.ReadRows(ctx, s.SpreadsheetID, s.Sheet)
+	if err != nil {
+		return err
+	}
+	writes := make(map[int][]string)
+	if len(rows) == 0 {
+		writes[1] = append([]string(nil), sheetColumns...)
+		rows = [][]string{sheetColumns}
+	}
+	if got := strings.Join(rows[0], ","); got != strings.Join(sheetColumns, ",") {
+		return fmt.Errorf("the first row of the sheet must be %s, not %s", strings.Join(sheetColumns, ","), got)
+	}
+	all, err := t.DB.ListTreats(ctx, allTreatsOptions)
+	if err != nil {
+		return fmt.Errorf("ListTreats: %v", err)
+	}
+	byID := make(map[string]*Treat, len(all))
+	for _, treat := range all {
+		if !treat.Deleted() {
+			byID[treat.ID] = treat
+		}
+	}
+
+	var saves []*Treat
+	added := make(map[int]*Treat) // new treats by row number.
+	inSheet := make(map[string]bool)
+	for i, row := range rows[1:] {
+		n := i + 2
+		for len(row) < len(sheetColumns) {
+			row = append(row, "")
+		}
+		vals, hash := row[:syncedColumns], row[syncedColumns]
+		if strings.TrimSpace(strings.Join(vals, "")) == "" {
+			continue
+		}
+		id := strings.TrimSpace(vals[0])
+		if id == "" {
+			treat := &Treat{CreatedBy: "sheets"}
+			if err := applyRow(treat, vals); err != nil {
+				note(&s.Errors, "row %d: %v", n, err)
+				continue
+			}
+			saves = append(saves, treat)
+			added[n] = treat
+			continue
+		}
+		treat, ok := byID[id]
+		if !ok {
+			note(&s.Errors, "row %d: treat %s was deleted from the app", n, id)
+			continue
+		}
+		inSheet[id] = true
+		appRow := treatRow(treat)
+		sheetChanged := rowHash(vals) != hash
+		appChanged := rowHash(appRow) != hash
+		pull := sheetChanged && !appChanged
+		if sheetChanged && appChanged && rowHash(vals) != rowHash(appRow) {
+			pull = s.Prefer == preferSheet
+			kept := "the app's"
+			if pull {
+				kept = "the sheet's"
+			}
+			note(&s.Conflicts, "row %d (%s): changed in both, kept %s", n, treat.Title, kept)
+		}
+		switch {
+		case pull:
+			c := *treat
+			if err := applyRow(&c, vals); err != nil {
+				note(&s.Errors, "row %d: %v", n, err)
+				continue
+			}
+			saves = append(saves, &c)
+			writes[n] = syncedRow(treatRow(&c))
+			s.Pulled++
+		case sheetChanged || appChanged:
+			writes[n] = syncedRow(appRow)
+			s.Pushed++
+		}
+	}
+
+	for len(saves) > 0 {
+		batch := saves
+		if len(batch) > maxBatchWrites {
+			batch = batch[:maxBatchWrites]
+		}
+		if err := t.DB.SaveTreats(ctx, batch); err != nil {
+			return fmt.Errorf("SaveTreats: %v", err)
+		}
+		saves = saves[len(batch):]
+	}
+	for n, treat := range added {
+		writes[n] = syncedRow(treatRow(treat))
+		s.Added++
+	}
+	var appends [][]string
+	for _, treat := range all {
+		if !treat.Deleted() && !inSheet[treat.ID] {
+			appends = append(appends, syncedRow(treatRow(treat)))
+		}
+	}
+	if err := t.sheets.WriteRows(ctx, s.SpreadsheetID, s.Sheet, writes); err != nil {
+		return err
+	}
+	if err := t.sheets.AppendRows(ctx, s.SpreadsheetID, s.Sheet, appends); err != nil {
+		return err
+	}
+	s.Appended = len(appends)
+	return nil
+}
+
+// runSheetSync syncs the linked sheet, if any, and stores the outcome.
+func (t *Treatshelf) runSheetSync(ctx context.Context) (*SheetSync, error) {
+	s, err := t.SheetSync.GetSheetSync(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("GetSheetSync: %v", err)
+	}
+	if s.SpreadsheetID == "" {
+		return &s, nil
+	}
+	s.LastError = ""
+	if err := t.syncSheet(ctx, &s); err != nil {
+		s.LastError = err.Error()
+	}
+	fmt.Fprintf(t.logWriter, "Sheet sync: pulled %d, added %d, pushed %d, appended %d, %d conflicts, %d errors %s\n",
+		s.Pulled, s.Added, s.Pushed, s.Appended, len(s.Conflicts), len(s.Errors), s.LastError)
+	if err := t.SheetSync.SetSheetSync(ctx, s); err != nil {
+		return nil, fmt.Errorf("SetSheetSync: %v", err)
+	}
+	return &s, nil
+}
+
+// syncSheetTaskHandler syncs the linked sheet. It is run by App Engine
+// cron, see cron.yaml.
+func (t *Treatshelf) syncSheetTaskHandler(w http.ResponseWriter, r *http.Request) *appError {
+	s, err := t.runSheetSync(r.Context())
+	if err != nil {
+		return t.appErrorf(r, err, "%v", err)
+	}
+	switch {
+	case s.SpreadsheetID == "":
+		fmt.Fprintln(w, "No sheet is linked")
+	case s.LastError != "":
+		fmt.Fprintf(w, "Sheet sync failed: %s\n", s.LastError)
+	default:
+		fmt.Fprintf(w, "Synced the sheet: pulled %d, added %d, pushed %d, appended %d\n", s.Pulled, s.Added, s.Pushed, s.Appended)
+	}
+	return nil
+}
+
+// spreadsheetURLPattern finds the ID in the URL of a spreadsheet.
+var spreadsheetURLPattern = regexp.MustCompile(`/spreadsheets/d/([0-9A-Za-z_\-]+)`)
+
+// sheetsHandler shows the linked sheet and the outcome of its last sync,
+// and links another sheet, or unlinks it if the posted ID is empty.
+func (t *Treatshelf) sheetsHandler(w http.ResponseWriter, r *http.Request) *appError {
+	ctx := r.Context()
+	s, err := t.SheetSync.GetSheetSync(ctx)
+	if err != nil {
+		return t.appErrorf(r, err, "GetSheetSync: %v", err)
+	}
+	if r.Method == "POST" {
+		id := strings.TrimSpace(r.FormValue("spreadsheet"))
+		if m := spreadsheetURLPattern.FindStringSubmatch(id); m != nil {
+			id = m[1]
+		}
+		prefer := r.FormValue("prefer")
+		if prefer != preferApp && prefer != preferSheet {
+			err := fmt.Errorf("conflicts must prefer %q or %q", preferApp, preferSheet)
+			return t.appErrorCodef(r, http.StatusBadRequest, err, "%v", err)
+		}
+		sheet := strings.TrimSpace(r.FormValue("sheet"))
+		if sheet == "" {
+			sheet = "Treats"
+		}
+		msg := "Unlinked the sheet."
+		if id != s.SpreadsheetID || sheet != s.Sheet {
+			s = SheetSync{LinkedBy: t.currentUser(r), Linked: t.now()}
+			if id != "" {
+				msg = "Linked the sheet. It is synced within 15 minutes, or sync it now."
+			}
+		} else {
+			msg = "Saved."
+		}
+		if id != "" {
+			s.SpreadsheetID, s.Sheet = id, sheet
+		}
+		s.Prefer = prefer
+		if err := t.SheetSync.SetSheetSync(ctx, s); err != nil {
+			return t.appErrorf(r, err, "SetSheetSync: %v", err)
+		}
+		setFlash(w, &flash{Message: msg})
+		http.Redirect(w, r, t.routeURL("sheets"), http.StatusFound)
+		return nil
+	}
+	if s.Prefer == "" {
+		s.Prefer = preferApp
+	}
+	return sheetsTmpl.Execute(t, w, r, s)
+}
+
+// syncSheetHandler syncs the linked sheet now, from the sheets page.
+func (t *Treatshelf) syncSheetHandler(w http.ResponseWriter, r *http.Request) *appError {
+	s, err := t.runSheetSync(r.Context())
+	if err != nil {
+		return t.appErrorf(r, err, "%v", err)
+	}
+	msg := "Synced the sheet."
+	if s.LastError != "" {
+		msg = "The sheet could not be synced: " + s.LastError
+	}
+	setFlash(w, &flash{Message: msg})
+	http.Redirect(w, r, t.routeURL("sheets"), http.StatusFound)
+	return nil
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Signed-in users can save the filters and search of the list page as a
+// named smart shelf, listed in the header. A shelf stores the query, not
+// the treats, so viewing it lists whatever matches now.
+
+// SavedSearch is a smart shelf: a named list query of a user.
+type SavedSearch struct {
+	ID   string
+	User string `json:"-"`
+	Name string
+	// Query is the list page's query string, such as "tag=vegan&q=brownie",
+	// holding only the parameters in shelfParams.
+	Query   string
+	Created time.Time
+}
+
+const (
+	// maxSavedSearches bounds the number of shelves a user can save.
+	maxSavedSearches = 20
+
+	// maxShelfName bounds the length of SavedSearch.Name, in characters.
+	maxShelfName = 50
+)
+
+// shelfParams are the list page's query parameters that a shelf saves.
+// Paging and previewing aren't part of what a shelf shows.
+var shelfParams = []string{
+	"available", "expired", "location", "tag", "q",
+	"currency", "minPrice", "maxPrice", "sort", "near", "radius",
+}
+
+// errTooManyShelves is returned by addSavedSearch when the user has
+// maxSavedSearches shelves.
+var errTooManyShelves = fmt.Errorf("you can save at most %d shelves", maxSavedSearches)
+
+// SavedSearchDatabase stores SavedSearches.
+type SavedSearchDatabase interface {
+	// AddSavedSearch stores s under s.ID.
+	AddSavedSearch(ctx context.Context, s *SavedSearch) error
+
+	// GetSavedSearch returns the saved search of user with the given ID,
+	// or nil if user has none.
+	GetSavedSearch(ctx context.Context, user, id string) (*SavedSearch, error)
+
+	// ListSavedSearches returns the saved searches of user, by name.
+	ListSavedSearches(ctx context.Context, user string) ([]*SavedSearch, error)
+
+	// DeleteSavedSearch removes a saved search of user. Those of other
+	// users are left alone.
+	DeleteSavedSearch(ctx context.Context, user, id string) error
+}
+
+// requireSavedSearches returns a 404 appError unless smart shelves are
+// enabled. The shelf routes use it through guard.
+func (t *Treatshelf) requireSavedSearches(r *http.Request) *appError {
+	if t.SavedSearches == nil {
+		err := errors.New("smart shelves are not enabled")
+		return t.appErrorCodef(r, http.StatusNotFound, err, "%v", err)
+	}
+	return nil
+}
+
+// shelfQuery returns the parameters of q that a shelf saves, encoded.
+func shelfQuery(q url.Values) string {
+	saved := url.Values{}
+	for _, p := range shelfParams {
+		if v := q.Get(p); v != "" {
+			saved.Set(p, v)
+		}
+	}
+	return saved.Encode()
+}
+
+// shelfRequest returns a copy of r that asks for the list of s, keeping
+// r's paging and fields.
+func shelfRequest(r *http.Request, s *SavedSearch) (*http.Request, error) {
+	q, err := url.ParseQuery(s.Query)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range []string{"page", "pageSize", "cursor", "envelope", "fields"} {
+		if v := r.FormValue(p); v != "" {
+			q.Set(p, v)
+		}
+	}
+	u := *r.URL
+	u.RawQuery = q.Encode()
+	sr := *r
+	sr.URL, sr.Form = &u, q
+	return &sr, nil
+}
+
+// newSavedSearch returns a saved search of the current user from the
+// list query q, checking that it is one the list page accepts.
+func (t *Treatshelf) newSavedSearch(r *http.Request, name string, q url.Values) (*SavedSearch, error) {
+	name = cleanLine(name)
+	if name == "" {
+		return nil, errors.New("name the shelf")
+	}
+	if len([]rune(name)) > maxShelfName {
+		return nil, fmt.Errorf("shelf names are at most %d characters", maxShelfName)
+	}
+	s := &SavedSearch{
+		ID:      t.newID("savedSearches"),
+		User:    t.currentUser(r),
+		Name:    name,
+		Query:   shelfQuery(q),
+		Created: t.now(),
+	}
+	sr, err := shelfRequest(r, s)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := t.listOptionsFromRequest(sr, t.preferences(r)); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// addSavedSearch stores s, or returns errTooManyShelves if its user has
+// maxSavedSearches already.
+func (t *Treatshelf) addSavedSearch(ctx context.Context, s *SavedSearch) error {
+	saved, err := t.SavedSearches.ListSavedSearches(ctx, s.User)
+	if err != nil {
+		return err
+	}
+	if len(saved) >= maxSavedSearches {
+		return errTooManyShelves
+	}
+	return t.SavedSearches.AddSavedSearch(ctx, s)
+}
+
+// savedSearches returns the current user's shelves for the header, or nil
+// if they can't be listed.
+func (t *Treatshelf) savedSearches(r *http.Request) []*SavedSearch {
+	u := t.currentUser(r)
+	if t.SavedSearches == nil || u == "" {
+		return nil
+	}
+	saved, err := t.SavedSearches.ListSavedSearches(r.Context(), u)
+	if err != nil {
+		fmt.Fprintf(t.logWriter, "Could not list saved searches: %v\n", err)
+	}
+	return saved
+}
+
+// shelfHandler lists the treats matching the shelf in the route.
+func (t *Treatshelf) shelfHandler(w http.ResponseWriter, r *http.Request) *appError {
+	s, err := t.SavedSearches.GetSavedSearch(r.Context(), t.currentUser(r), mux.Vars(r)["id"])
+	if err != nil {
+		return t.appErrorf(r, err, "GetSavedSearch: %v", err)
+	}
+	if s == nil {
+		err := errors.New("shelf not found")
+		return t.appErrorCodef(r, http.StatusNotFound, err, "%v", err)
+	}
+	sr, err := shelfRequest(r, s)
+	if err != nil {
+		return t.appErrorf(r, err, "could not read shelf: %v", err)
+	}
+	return t.showList(w, sr, s)
+}
+
+// saveShelfHandler saves the list query in the "query" form value as a
+// shelf named by the "name" form value.
+func (t *Treatshelf) saveShelfHandler(w http.ResponseWriter, r *http.Request) *appError {
+	q, err := url.ParseQuery(r.FormValue("query"))
+	if err != nil {
+		return t.appErrorCodef(r, http.StatusBadRequest, err, "invalid query: %v", err)
+	}
+	s, err := t.newSavedSearch(r, r.FormValue("name"), q)
+	if err != nil {
+		return t.appErrorCodef(r, http.StatusBadRequest, err, "%v", err)
+	}
+	err = t.addSavedSearch(r.Context(), s)
+	if err == errTooManyShelves {
+		return t.appErrorCodef(r, http.StatusConflict, err, "%v", err)
+	}
+	if err != nil {
+		return t.appErrorf(r, err, "could not save shelf: %v", err)
+	}
+	setFlash(w, &flash{Message: fmt.Sprintf("Saved %q. It's in the header.", s.Name)})
+	http.Redirect(w, r, t.routeURL("shelf", "id", s.ID), http.StatusFound)
+	return nil
+}
+
+// deleteShelfHandler removes the shelf in the route.
+func (t *Treatshelf) deleteShelfHandler(w http.ResponseWriter, r *http.Request) *appError {
+	if err := t.SavedSearches.DeleteSavedSearch(r.Context(), t.currentUser(r), mux.Vars(r)["id"]); err != nil {
+		return t.appErrorf(r, err, "DeleteSavedSearch: %v", err)
+	}
+	setFlash(w, &flash{Message: "Deleted the shelf."})
+	http.Redirect(w, r, t.routeURL("treats"), http.StatusFound)
+	return nil
+}
+
+// apiListShelvesHandler returns the current user's shelves.
+func (t *Treatshelf) apiListShelvesHandler(w http.ResponseWriter, r *http.Request) *appError {
+	saved, err := t.SavedSearches.ListSavedSearches(r.Context(), t.currentUser(r))
+	if err != nil {
+		return t.appErrorf(r, err, "ListSavedSearches: %v", err)
+	}
+	if saved == nil {
+		saved = []*SavedSearch{}
+	}
+	writeJSON(w, http.StatusOK, saved)
+	return nil
+}
+
+// apiCreateShelfHandler saves the shelf in the request body, a SavedSearch
+// of which only Name and Query are read, and returns it.
+func (t *Treatshelf) apiCreateShelfHandler(w http.ResponseWriter, r *http.Request) *appError {
+	in := &SavedSearch{}
+	if e := t.decodeJSON(r, shelfSchema, in); e != nil {
+		return e
+	}
+	q, err := url.ParseQuery(in.Query)
+	if err != nil {
+		return t.appErrorCodef(r, http.StatusBadRequest, err, "invalid query: %v", err)
+	}
+	s, err := t.newSavedSearch(r, in.Name, q)
+	if err != nil {
+		return t.appErrorCodef(r, http.StatusBadRequest, err, "%v", err)
+	}
+	err = t.addSavedSearch(r.Context(), s)
+	if err == errTooManyShelves {
+		return t.appErrorCodef(r, http.StatusConflict, err, "%v", err)
+	}
+	if err != nil {
+		return t.appErrorf(r, err, "could not save shelf: %v", err)
+	}
+	w.Header().Set("Location", t.apiURL(r, "apiShelfTreats", "id", s.ID))
+	writeJSON(w, http.StatusCreated, s)
+	return nil
+}
+
+// apiShelfTreatsHandler lists a page of the treats matching the shelf in
+// the route, like apiListHandler.
+func (t *Treatshelf) apiShelfTreatsHandler(w http.ResponseWriter, r *http.Request) *appError {
+	s, err := t.SavedSearches.GetSavedSearch(r.Context(), t.currentUser(r), mux.Vars(r)["id"])
+	if err != nil {
+		return t.appErrorf(r, err, "GetSavedSearch: %v", err)
+	}
+	if s == nil {
+		err := errors.New("shelf not found")
+		return t.appErrorCodef(r, http.StatusNotFound, err, "%v", err)
+	}
+	sr, err := shelfRequest(r, s)
+	if err != nil {
+		return t.appErrorf(r, err, "could not read shelf: %v", err)
+	}
+	return t.apiListHandler(w, sr)
+}
+
+// apiDeleteShelfHandler removes the shelf in the route.
+func (t *Treatshelf) apiDeleteShelfHandler(w http.ResponseWriter, r *http.Request) *appError {
+	if err := t.SavedSearches.DeleteSavedSearch(r.Context(), t.currentUser(r), mux.Vars(r)["id"]); err != nil {
+		return t.appErrorf(r, err, "DeleteSavedSearch: %v", err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Sign-ins through an AuthProvider, and failed uses of API tokens, are
+// recorded, so that people can review the recent activity on their account
+// and admins can look for attacks. Repeated failures from one address, or
+// for one user, lock sign-in for that address or user for a while. People
+// signing in through IAP are recorded by IAP instead.
+
+// SignIn is an attempt to sign in or to use an API token.
+type SignIn struct {
+	ID string
+	// User is the user signing in, or "" if they aren't known, such as
+	// when an unknown API token was used.
+	User string
+	// Method is how they signed in: "token", the name of the
+	// AuthProvider, or impersonationMethod. Infected uploads are recorded
+	// too, with uploadScanMethod, see scan.go.
+	Method string
+	// By is the admin who viewed the app as User, for impersonations.
+	By        string
+	IP        string
+	UserAgent string
+	OK        bool
+	// Reason is why a failed attempt failed.
+	Reason string
+	At     time.Time
+	// ExpiresAt is when the record may be deleted, see signInKeep.
+	ExpiresAt time.Time
+}
+
+// SignInDatabase stores SignIns and counts failures for lockouts.
+type SignInDatabase interface {
+	// AddSignIn records an attempt, assigning it a new ID.
+	AddSignIn(ctx context.Context, s *SignIn) error
+
+	// ListSignIns returns up to limit attempts of user, or of everyone if
+	// user is "", newest first.
+	ListSignIns(ctx context.Context, user string, limit int) ([]*SignIn, error)
+
+	// DeleteSignIns deletes the attempts of user.
+	DeleteSignIns(ctx context.Context, user string) error
+
+	// AddSignInFailure counts a failure against key at the given time and
+	// returns the number of failures since the count was last reset. The
+	// count resets once window has passed since the first failure counted.
+	AddSignInFailure(ctx context.Context, key string, at time.Time, window time.Duration) (int, error)
+
+	// SignInFailures returns the number of failures counted against key
+	// within the window, as of the given time.
+	SignInFailures(ctx context.Context, key string, at time.Time, window time.Duration) (int, error)
+
+	// ResetSignInFailures clears the failures counted against key.
+	ResetSignInFailures(ctx context.Context, key string) error
+}
+
+// signInFailureCount is what SignInDatabase stores per key.
+type signInFailureCount struct {
+	Failures int
+	Since    time.Time
+}
+
+const (
+	// maxSignInFailures is how many failures from one address, or for one
+	// user, lock sign-in for them until signInWindow has passed since the
+	// first.
+	maxSignInFailures = 10
+	signInWindow      = 15 * time.Minute
+
+	// signInKeep is how long sign-ins are kept for. The signIns collection
+	// should have a TTL policy on ExpiresAt, see
+	// https://cloud.google.com/firestore/docs/ttl.
+	signInKeep = 90 * 24 * time.Hour
+
+	// signInListLimit bounds the sign-ins listed on a page.
+	signInListLimit = 100
+)
+
+// errSignInLocked is returned when too many attempts have failed.
+var errSignInLocked = errors.New("too many failed sign-in attempts, try again later")
+
+// signInKeys returns the keys failures of r, for user, are counted against.
+func signInKeys(r *http.Request, user string) []string {
+	keys := []string{"ip:" + remoteIP(r)}
+	if user != "" {
+		keys = append(keys, "user:"+user)
+	}
+	return keys
+}
+
+// checkSignInLock returns an appError if sign-in is locked for the address
+// of r, or for user if set.
+func (t *Treatshelf) checkSignInLock(w http.ResponseWriter, r *http.Request, user string) *appError {
+	if t.SignIns == nil {
+		return nil
+	}
+	for _, key := range signInKeys(r, user) {
+		n, err := t.SignIns.SignInFailures(r.Context(), key, t.now(), signInWindow)
+		if err != nil {
+			// Don't lock everyone out while the database is unavailable.
+			fmt.Fprintf(t.logWriter, "Could not check sign-in failures: %v\n", err)
+			continue
+		}
+		if n >= maxSignInFailures {
+			w.Header().Set("Retry-After", strconv.Itoa(int(signInWindow.Seconds())))
+			return t.appErrorCodef(r, http.StatusTooManyRequests, errSignInLocked, "%v", errSignInLocked)
+		}
+	}
+	return nil
+}
+
+// recordSignIn records an attempt to sign in as user with method, which
+// failed with reason unless it is "". Failures count towards locking the
+// address and the user; success resets the user's count. Errors are logged:
+// signing in shouldn't fail because it couldn't be recorded.
+func (t *Treatshelf) recordSignIn(r *http.Request, user, method, reason string) {
+	if t.SignIns == nil {
+		return
+	}
+	ctx := r.Context()
+	now := t.now()
+	s := &SignIn{
+		User:      user,
+		Method:    method,
+		IP:        remoteIP(r),
+		UserAgent: r.UserAgent(),
+		OK:        reason == "",
+		Reason:    reason,
+		At:        now,
+		ExpiresAt: now.Add(signInKeep),
+	}
+	if err := t.SignIns.AddSignIn(ctx, s); err != nil {
+		fmt.Fprintf(t.logWriter, "Could not record sign-in: %v\n", err)
+	}
+	if s.OK {
+		if err := t.SignIns.ResetSignInFailures(ctx, "user:"+user); err != nil {
+			fmt.Fprintf(t.logWriter, "Could not reset sign-in failures: %v\n", err)
+		}
+		return
+	}
+	for _, key := range signInKeys(r, user) {
+		n, err := t.SignIns.AddSignInFailure(ctx, key, now, signInWindow)
+		if err != nil {
+			fmt.Fprintf(t.logWriter, "Could not count sign-in failure: %v\n", err)
+		}
+		if n == maxSignInFailures {
+			fmt.Fprintf(t.logWriter, "Locked sign-in for %s after %d failures\n", key, n)
+		}
+	}
+}
+
+// signInsHandler lists the signed-in user's recent sign-ins.
+func (t *Treatshelf) signInsHandler(w http.ResponseWriter, r *http.Request) *appError {
+	return t.showSignIns(w, r, t.currentUser(r))
+}
+
+// securityLogHandler lists everyone's recent sign-ins, for admins.
+func (t *Treatshelf) securityLogHandler(w http.ResponseWriter, r *http.Request) *appError {
+	return t.showSignIns(w, r, "")
+}
+
+// showSignIns renders the recent sign-ins of user, or of everyone if user
+// is "".
+func (t *Treatshelf) showSignIns(w http.ResponseWriter, r *http.Request, user string) *appError {
+	if t.SignIns == nil {
+		err := errors.New("sign-ins are not recorded")
+		return t.appErrorCodef(r, http.StatusNotFound, err, "%v", err)
+	}
+	signIns, err := t.SignIns.ListSignIns(r.Context(), user, signInListLimit)
+	if err != nil {
+		return t.appErrorf(r, err, "ListSignIns: %v", err)
+	}
+	return signInsTmpl.Execute(t, w, r, struct {
+		SignIns []*SignIn
+		All     bool
+	}{signIns, user == ""})
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The /treat Slack slash command adds and finds treats from Slack:
+//
+//	/treat add Brownie
+//	/treat find chocolate
+//
+// The Slack app's slash command posts to /integrations/slack/command, and
+// requests are verified with the app's signing secret
+// (SLACK_SIGNING_SECRET, which may name a secret, see secrets.go). Treats
+// added from Slack belong to "slack:<user ID>", and are held for review if
+// MODERATION is on, as those of anyone but admins are.
+
+const (
+	// slackTolerance is how far the time Slack signed a request may be
+	// from now.
+	slackTolerance = 5 * time.Minute
+
+	// maxSlackBytes bounds the size of a slash command request.
+	maxSlackBytes = 64 << 10
+
+	// slackResults is the most treats "find" replies with.
+	slackResults = 5
+
+	// slackUsage is the reply to "help", and to commands not understood.
+	slackUsage = "Try `/treat add Brownie` to add a treat, or `/treat find chocolate` to find some."
+)
+
+// slackReply is the reply to a slash command, see
+// https://api.slack.com/interactivity/slash-commands#responding_to_commands.
+type slackReply struct {
+	// ResponseType is "ephemeral", shown only to whoever ran the command,
+	// or "in_channel".
+	ResponseType string       `json:"response_type"`
+	Text         string       `json:"text"`
+	Blocks       []slackBlock `json:"blocks,omitempty"`
+}
+
+// slackBlock is a section or divider block of a reply.
+type slackBlock struct {
+	Type      string      `json:"type"`
+	Text      *slackText  `json:"text,omitempty"`
+	Accessory *slackImage `json:"accessory,omitempty"`
+}
+
+// slackText is a mrkdwn text object.
+type slackText struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+// slackImage is an image element, shown next to a section.
+type slackImage struct {
+	Type     string `json:"type"`
+	ImageURL string `json:"image_url"`
+	AltText  string `json:"alt_text"`
+}
+
+// slackEscaper escapes text for mrkdwn.
+var slackEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// section returns a section block of mrkdwn text.
+func section(text string) slackBlock {
+	return slackBlock{Type: "section", Text: &slackText{Type: "mrkdwn", Text: text}}
+}
+
+// requireSlack returns a 404 appError unless the slash command is enabled.
+// The Slack route uses it through guard.
+func (t *Treatshelf) requireSlack(r *http.Request) *appError {
+	if t.slackSigningSecret == "" {
+		err := errors.New("the Slack command is not enabled")
+		return t.appErrorCodef(r, http.StatusNotFound, err, "%v", err)
+	}
+	return nil
+}
+
+// checkSlackSignature returns an error unless sig is Slack's signature of
+// body, sent at the Unix time ts, made with secret within slackTolerance
+// of now, see https://api.slack.com/authentication/verifying-requests-from-slack.
+func checkSlackSignature(sig, ts string, body []byte, secret string, now time.Time) error {
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil || !strings.HasPrefix(sig, "v0=") {
+		return errors.New("missing or malformed Slack signature")
+	}
+	if d := now.Sub(time.Unix(sec, 0)); d > slackTolerance || d < -slackTolerance {
+		return errors.New("signature timestamp is too old or in the future")
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("v0:" + ts + ":"))
+	mac.Write(body)
+	got, err := hex.DecodeString(strings.TrimPrefix(sig, "v0="))
+	if err != nil || !hmac.Equal(got, mac.Sum(nil)) {
+		return errors.New("signature does not match")
+	}
+	return nil
+}
+
+// slackCommandHandler runs a signed /treat command from Slack. Slack shows
+// replies with any status but 200 as a failure, so problems with the
+// command itself are replied to with 200.
+func (t *Treatshelf) slackCommandHandler(w http.ResponseWriter, r *http.Request) *appError {
+	ctx := r.Context()
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxSlackBytes))
+	if err != nil {
+		return t.appErrorCodef(r, http.StatusRequestEntityTooLarge, err, "slash commands are at most %d bytes", maxSlackBytes)
+	}
+	secret, err := t.secrets.resolve(ctx, t.slackSigningSecret)
+	if err != nil {
+		return t.appErrorf(r, err, "could not read SLACK_SIGNING_SECRET: %v", err)
+	}
+	err = checkSlackSignature(r.Header.Get("X-Slack-Signature"), r.Header.Get("X-Slack-Request-Timestamp"), body, secret, t.now())
+	if err != nil {
+		return t.appErrorCodef(r, http.StatusUnauthorized, err, "%v", err)
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		return t.appErrorCodef(r, http.StatusBadRequest, err, "invalid slash command: %v", err)
+	}
+
+	verb, arg := strings.TrimSpace(form.Get("text")), ""
+	if i := strings.IndexAny(verb, " \t\n"); i >= 0 {
+		verb, arg = verb[:i], strings.TrimSpace(verb[i:])
+	}
+	var reply *slackReply
+	switch strings.ToLower(verb) {
+	case "add":
+		reply, err = t.slackAdd(r, "slack:"+form.Get("user_id"), arg)
+	case "find", "search":
+		reply, err = t.slackFind(r, arg)
+	default:
+		reply = &slackReply{ResponseType: "ephemeral", Text: slackUsage}
+	}
+	if err != nil {
+		return t.appErrorf(r, err, "%v", err)
+	}
+	writeJSON(w, http.StatusOK, reply)
+	return nil
+}
+
+// slackAdd adds a treat with the given title for user.
+func (t *Treatshelf) slackAdd(r *http.Request, user, title string) (*slackReply, error) {
+	treat := &Treat{Title: title, CreatedBy: user}
+	if err := treat.validate(); err != nil || treat.Title == "" {
+		return &slackReply{ResponseType: "ephemeral", Text: "Say what to add, as in `/treat add Brownie`."}, nil
+	}
+	if t.moderation {
+		// Slack users are never admins, see submitForReview.
+		treat.Review = reviewPending
+	}
+	id, err := t.DB.AddTreat(r.Context(), treat)
+	if err != nil {
+		return nil, fmt.Errorf("AddTreat: %v", err)
+	}
+	treat.ID = id
+	link := fmt.Sprintf("<%s|%s>", absoluteURL(r, t.routeURL("treat", "id", id)), slackEscaper.Replace(treat.Title))
+	if treat.UnderReview() {
+		return &slackReply{ResponseType: "ephemeral", Text: "Added " + link + ". It will be shown once an admin has reviewed it."}, nil
+	}
+	return &slackReply{ResponseType: "in_channel", Text: "<@" + strings.TrimPrefix(user, "slack:") + "> added " + link + " to the shelf."}, nil
+}
+
+// slackFind replies with the treats best matching query.
+func (t *Treatshelf) slackFind(r *http.Request, query string) (*slackReply, error) {
+	query = cleanLine(query)
+	if query == "" {
+		return &slackReply{ResponseType: "ephemeral", Text: "Say what to find, as in `/treat find chocolate`."}, nil
+	}
+	treats, err := t.DB.ListTreats(r.Context(), ListOptions{Query: query, Fuzziness: t.searchFuzziness})
+	if err != nil {
+		return nil, fmt.Errorf("ListTreats: %v", err)
+	}
+	reply := &slackReply{ResponseType: "ephemeral"}
+	if len(treats) == 0 {
+		reply.Text = fmt.Sprintf("No treats match %q.", query)
+		return reply, nil
+	}
+	reply.Text = fmt.Sprintf("%d treats match %q.", len(treats), query)
+	for i, treat := range treats {
+		if i == slackResults {
+			more := absoluteURL(r, t.routeURL("treats")+"?q="+url.QueryEscape(query))
+			reply.Blocks = append(reply.Blocks, section(fmt.Sprintf("<%s|and %d more>", more, len(treats)-i)))
+			break
+		}
+		stock := "Available"
+		if treat.Quantity != nil {
+			stock = fmt.Sprintf("%d left", *treat.Quantity)
+		}
+		text := fmt.Sprintf("*<%s|%s>*\n%s", absoluteURL(r, t.routeURL("treat", "id", treat.ID)),
+			slackEscaper.Replace(treat.Title), stock)
+		if d := []rune(treat.Description); len(d) > 0 {
+			if len(d) > 140 {
+				d = append(d[:140], '…')
+			}
+			text += "\n" + slackEscaper.Replace(string(d))
+		}
+		b := section(text)
+		if img := treat.ThumbnailURL; img != "" || treat.ImageURL != "" {
+			if img == "" {
+				img = treat.ImageURL
+			}
+			b.Accessory = &slackImage{Type: "image", ImageURL: img, AltText: treat.Title}
+			if treat.AltText != "" {
+				b.Accessory.AltText = treat.AltText
+			}
+		}
+		reply.Blocks = append(reply.Blocks, b)
+	}
+	return reply, nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// slackSignature returns Slack's signature of body, sent at the Unix time
+// ts, made with secret.
+func slackSignature(secret, ts, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "v0:%s:%s", ts, body)
+	return "v0=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestCheckSlackSignature(t *testing.T) {
+	now := testEpoch
+	body := "command=%2Ftreat&text=brownie"
+	ts := strconv.FormatInt(now.Unix(), 10)
+	at := func(d time.Duration) string { return strconv.FormatInt(now.Add(d).Unix(), 10) }
+	tests := []struct {
+		name    string
+		sig, ts string
+		wantErr string
+	}{
+		{"valid", slackSignature("secret", ts, body), ts, ""},
+		{"edge of tolerance", slackSignature("secret", at(-slackTolerance), body), at(-slackTolerance), ""},
+		{"missing signature", "", ts, "missing or malformed"},
+		{"missing timestamp", slackSignature("secret", ts, body), "", "missing or malformed"},
+		{"other version", "v1=" + strings.TrimPrefix(slackSignature("secret", ts, body), "v0="), ts, "missing or malformed"},
+		{"too old", slackSignature("secret", at(-slackTolerance-time.Second), body), at(-slackTolerance - time.Second), "too old or in the future"},
+		{"in the future", slackSignature("secret", at(slackTolerance+time.Second), body), at(slackTolerance + time.Second), "too old or in the future"},
+		{"other secret", slackSignature("other", ts, body), ts, "does not match"},
+		{"other timestamp", slackSignature("secret", at(-time.Second), body), ts, "does not match"},
+		{"not hex", "v0=zz", ts, "does not match"},
+	}
+	for _, tt := range tests {
+		err := checkSlackSignature(tt.sig, tt.ts, []byte(body), "secret", now)
+		if tt.wantErr == "" && err != nil {
+			t.Errorf("%s: checkSlackSignature(): %v", tt.name, err)
+		}
+		if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("%s: checkSlackSignature() = %v, want an error containing %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Service level objectives are set in SLOS, as a comma-separated list of
+// the fraction of requests, in percent, that should succeed or be quick:
+//
+//	SLOS=availability:99.5,latency@500ms:95
+//
+// says that 99.5% of requests should not fail with a 5xx, and 95% should
+// be answered within 500ms, which must be one of latencyBounds. Each is
+// measured over the last SLO_WINDOW (24h by default) of requests to this
+// instance, counted as for alerts (see alerts.go) and leaving out
+// streaming routes; an instance that restarts starts afresh.
+//
+// The burn rate is how fast the error budget, the requests allowed to miss
+// the objective, is being spent: at 1 it lasts exactly the window, at 10
+// it is gone in a tenth of it. Burn rates over the last hour and the whole
+// window are served with the other expvars at /debug/vars, as "slo", and
+// shown to admins at /admin/slo. With SLO_BANNER=true, every page shows
+// a banner while an error budget is exhausted.
+
+// Bounds of the windows SLOs are measured over.
+const (
+	defaultSLOWindow = 24 * time.Hour
+	sloWindowBuckets = 96
+	sloShortWindow   = time.Hour
+	sloShortBuckets  = 60
+	// sloMinRequests is how many requests a window needs before its
+	// budget can be exhausted, so that a first failure isn't an outage.
+	sloMinRequests = 100
+)
+
+// sloStatus publishes the SLOs' reports by name, see publishSLOs.
+var sloStatus = expvar.NewMap("slo")
+
+// SLO is a service level objective.
+type SLO struct {
+	Name string
+	// Target is the fraction of requests that should meet the objective.
+	Target float64
+	// Latency is the most time a request should take, for a latency
+	// objective. If it is zero, requests should not fail instead.
+	Latency time.Duration
+}
+
+// Percent returns the target in percent, for templates.
+func (slo SLO) Percent() float64 {
+	return 100 * slo.Target
+}
+
+// parseSLOs parses SLOS, see above.
+func parseSLOs(s string) ([]SLO, error) {
+	var slos []SLO
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		i := strings.LastIndex(f, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("SLO %q is not name:percent", f)
+		}
+		percent, err := strconv.ParseFloat(f[i+1:], 64)
+		if err != nil || percent <= 0 || percent >= 100 {
+			return nil, fmt.Errorf("SLO %q must be a percentage between 0 and 100", f)
+		}
+		slo := SLO{Name: f[:i], Target: percent / 100}
+		switch {
+		case slo.Name == "availability":
+		case strings.HasPrefix(slo.Name, "latency@"):
+			d, err := time.ParseDuration(strings.TrimPrefix(slo.Name, "latency@"))
+			if err != nil || latencyBound(d) < 0 {
+				return nil, fmt.Errorf("SLO %q must be within one of %v", f, latencyBounds)
+			}
+			slo.Latency = d
+		default:
+			return nil, fmt.Errorf("unknown SLO %q, want availability or latency@duration", f)
+		}
+		slos = append(slos, slo)
+	}
+	return slos, nil
+}
+
+// missed returns how many requests of s missed slo.
+func (s requestSummary) missed(slo SLO) int {
+	if slo.Latency == 0 {
+		return s.Errors
+	}
+	return s.slowerThan(slo.Latency)
+}
+
+// burnRate returns how fast the requests of s spend the error budget of
+// slo, or 0 if there were none.
+func (s requestSummary) burnRate(slo SLO) float64 {
+	if s.Requests == 0 {
+		return 0
+	}
+	return float64(s.missed(slo)) / float64(s.Requests) / (1 - slo.Target)
+}
+
+// sloTracker measures SLOs over a short window and the whole SLO window.
+type sloTracker struct {
+	slos   []SLO
+	window time.Duration
+	short  *requestWindow
+	long   *requestWindow
+}
+
+// newSLOTracker returns a sloTracker measuring slos over window.
+func newSLOTracker(slos []SLO, window time.Duration) *sloTracker {
+	return &sloTracker{
+		slos:   slos,
+		window: window,
+		short:  newRequestWindow(sloShortWindow, sloShortBuckets),
+		long:   newRequestWindow(window, sloWindowBuckets),
+	}
+}
+
+// observe counts a request, as requestWindow.observe does.
+func (st *sloTracker) observe(now time.Time, status int, latency time.Duration) {
+	st.short.observe(now, status, latency)
+	st.long.observe(now, status, latency)
+}
+
+// SLOReport is how an SLO is doing at a time.
+type SLOReport struct {
+	SLO
+	Requests int
+	Missed   int
+	// BurnRateShort and BurnRate are over the last hour and the whole
+	// window.
+	BurnRateShort float64
+	BurnRate      float64
+	// BudgetLeft is the fraction of the error budget left, below zero if
+	// it is overspent.
+	BudgetLeft float64
+	Exhausted  bool
+}
+
+// BudgetLeftPercent returns the budget left in percent, for templates.
+func (r SLOReport) BudgetLeftPercent() float64 {
+	return 100 * r.BudgetLeft
+}
+
+// reports returns how each SLO is doing at now.
+func (st *sloTracker) reports(now time.Time) []SLOReport {
+	short, long := st.short.summary(now), st.long.summary(now)
+	var reports []SLOReport
+	for _, slo := range st.slos {
+		burn := long.burnRate(slo)
+		reports = append(reports, SLOReport{
+			SLO:           slo,
+			Requests:      long.Requests,
+			Missed:        long.missed(slo),
+			BurnRateShort: short.burnRate(slo),
+			BurnRate:      burn,
+			BudgetLeft:    1 - burn,
+			Exhausted:     long.Requests >= sloMinRequests && burn >= 1,
+		})
+	}
+	return reports
+}
+
+// publishSLOs serves the SLOs' reports as the "slo" expvar.
+func (t *Treatshelf) publishSLOs() {
+	for i, slo := range t.slos.slos {
+		i := i
+		sloStatus.Set(slo.Name, expvar.Func(func() interface{} {
+			return t.slos.reports(t.now())[i]
+		}))
+	}
+}
+
+// budgetExhausted reports whether the banner is on and an SLO's error
+// budget is exhausted.
+func (t *Treatshelf) budgetExhausted() bool {
+	if t.slos == nil || !t.sloBanner {
+		return false
+	}
+	for _, r := range t.slos.reports(t.now()) {
+		if r.Exhausted {
+			return true
+		}
+	}
+	return false
+}
+
+// requireSLOs returns a 404 appError unless SLOs are set. The SLO page
+// uses it through guard.
+func (t *Treatshelf) requireSLOs(r *http.Request) *appError {
+	if t.slos == nil {
+		err := errors.New("no SLOs are set")
+		return t.appErrorCodef(r, http.StatusNotFound, err, "%v", err)
+	}
+	return nil
+}
+
+// sloHandler shows admins how the SLOs are doing.
+func (t *Treatshelf) sloHandler(w http.ResponseWriter, r *http.Request) *appError {
+	return sloTmpl.Execute(t, w, r, struct {
+		Window  time.Duration
+		Reports []SLOReport
+	}{t.slos.window, t.slos.reports(t.now())})
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestParseSLOs(t *testing.T) {
+	slos, err := parseSLOs("availability:99.5, latency@500ms:95")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []SLO{{Name: "availability", Target: 0.995}, {Name: "latency@500ms", Target: 0.95, Latency: 500 * time.Millisecond}}
+	if len(slos) != len(want) || slos[0] != want[0] || slos[1] != want[1] {
+		t.Errorf("parseSLOs() = %+v, want %+v", slos, want)
+	}
+	for _, s := range []string{"availability", "availability:100", "latency@300ms:95", "uptime:99"} {
+		if _, err := parseSLOs(s); err == nil {
+			t.Errorf("parseSLOs(%q) succeeded, want an error", s)
+		}
+	}
+}
+
+func TestSLOReports(t *testing.T) {
+	c := newFakeClock()
+	shelf := &Treatshelf{
+		clock:     c,
+		slos:      newSLOTracker([]SLO{{Name: "availability", Target: 0.99}, {Name: "latency@1s", Target: 0.9, Latency: time.Second}}, defaultSLOWindow),
+		sloBanner: true,
+	}
+	// 2% failing spends the 1% budget twice over; 5% slow spends half of
+	// the 10% budget.
+	for i := 0; i < sloMinRequests; i++ {
+		status, latency := 200, 100*time.Millisecond
+		if i < 2 {
+			status = 500
+		} else if i < 7 {
+			latency = 2 * time.Second
+		}
+		shelf.slos.observe(c.Now(), status, latency)
+	}
+	reports := shelf.slos.reports(c.Now())
+	if r := reports[0]; r.Missed != 2 || r.BurnRate < 1.99 || r.BurnRate > 2.01 || !r.Exhausted {
+		t.Errorf("availability = %+v, want burn rate 2, exhausted", r)
+	}
+	if r := reports[1]; r.Missed != 5 || r.BudgetLeft < 0.49 || r.BudgetLeft > 0.51 || r.Exhausted {
+		t.Errorf("latency = %+v, want half the budget left", r)
+	}
+	if !shelf.budgetExhausted() {
+		t.Error("budgetExhausted() = false, want true")
+	}
+
+	// The hour's burn rate forgets the failures before the window's does.
+	c.Advance(2 * time.Hour)
+	if r := shelf.slos.reports(c.Now())[0]; r.BurnRateShort != 0 || r.BurnRate == 0 {
+		t.Errorf("two hours later, availability = %+v, want only the long burn rate", r)
+	}
+}
+
+func TestSLOsSkipStreams(t *testing.T) {
+	shelf := &Treatshelf{
+		clock: newFakeClock(),
+		slos:  newSLOTracker([]SLO{{Name: "latency@1s", Target: 0.9, Latency: time.Second}}, defaultSLOWindow),
+	}
+	r := mux.NewRouter()
+	r.Use(shelf.countRequests)
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	r.Path("/events").Handler(ok).Name("events")
+	r.Path("/treats").Handler(ok).Name("treats")
+	for _, path := range []string{"/events", "/treats"} {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+	if rep := shelf.slos.reports(shelf.now())[0]; rep.Requests != 1 {
+		t.Errorf("report = %+v, want only the request to /treats", rep)
+	}
+}
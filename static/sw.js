@@ -0,0 +1,45 @@
+// The service worker, registered by templates/base.html. Pages are fetched
+// from the network when possible. The treat list is kept in a cache as it
+// was last seen, to be shown offline, and other pages fall back to the
+// offline page. URLs are relative to this file, which is served from
+// static/ under the app's base path.
+
+var CACHE = "treats-v1";
+var LIST = new URL("../treats", self.location).pathname;
+var OFFLINE = new URL("../offline", self.location).href;
+
+self.addEventListener("install", function(event) {
+  event.waitUntil(caches.open(CACHE).then(function(cache) {
+    return cache.addAll([OFFLINE, LIST]);
+  }).then(function() { return self.skipWaiting(); }));
+});
+
+self.addEventListener("activate", function(event) {
+  event.waitUntil(caches.keys().then(function(keys) {
+    return Promise.all(keys.filter(function(key) { return key !== CACHE; }).map(function(key) {
+      return caches.delete(key);
+    }));
+  }).then(function() { return self.clients.claim(); }));
+});
+
+self.addEventListener("fetch", function(event) {
+  var req = event.request;
+  if (req.method !== "GET" || req.mode !== "navigate") {
+    return;
+  }
+  var list = new URL(req.url).pathname === LIST;
+  event.respondWith(fetch(req).then(function(resp) {
+    if (list && resp.ok) {
+      var copy = resp.clone();
+      caches.open(CACHE).then(function(cache) { cache.put(req, copy); });
+    }
+    return resp;
+  }).catch(function() {
+    // The list with other filters falls back to the unfiltered one.
+    return caches.match(req).then(function(resp) {
+      return resp || (list && caches.match(LIST));
+    }).then(function(resp) {
+      return resp || caches.match(OFFLINE);
+    });
+  }));
+});
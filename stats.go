@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Admins see how the shelf grows at GET /api/v2/stats: how many treats
+// there are, by tag and by author, and how many were added each month.
+//
+//	{"Total": 240, "ByTag": {"vegan": 31}, "ByAuthor": {"Erica": 12}, "AddedByMonth": {"2026-09": 18}, "Undated": 0, "Computed": "..."}
+//
+// Firestore's count, sum and average aggregation queries need a newer
+// client library than the app uses, so the Firestore database computes
+// the statistics in one pass over the treats, reading only the fields
+// they need. That is a read per treat, so statistics are kept for
+// statsMaxAge.
+
+// TreatStats are statistics of the treats that aren't deleted.
+type TreatStats struct {
+	Total int
+	// ByTag and ByAuthor count the treats with each tag and by each
+	// author. Treats without an author aren't counted in ByAuthor.
+	ByTag    map[string]int
+	ByAuthor map[string]int
+	// AddedByMonth counts the treats added in each month, by year and
+	// month in UTC, such as "2026-09". Undated counts those whose database
+	// doesn't know when they were added.
+	AddedByMonth map[string]int
+	Undated      int
+	// Computed is when the statistics were computed.
+	Computed time.Time
+}
+
+// StatsDatabase computes TreatStats.
+type StatsDatabase interface {
+	// TreatStats returns statistics of the treats that aren't deleted,
+	// computed now.
+	TreatStats(ctx context.Context, now time.Time) (*TreatStats, error)
+}
+
+// statsMaxAge is how long statistics are kept before being computed
+// again.
+const statsMaxAge = 5 * time.Minute
+
+// statsMonth is the layout of the keys of TreatStats.AddedByMonth.
+const statsMonth = "2006-01"
+
+func newTreatStats(now time.Time) *TreatStats {
+	return &TreatStats{
+		ByTag:        make(map[string]int),
+		ByAuthor:     make(map[string]int),
+		AddedByMonth: make(map[string]int),
+		Computed:     now,
+	}
+}
+
+// add counts treat, which was added at created, or at an unknown time if
+// created is zero. Deleted treats aren't counted.
+func (s *TreatStats) add(treat *Treat, created time.Time) {
+	if treat.Deleted() {
+		return
+	}
+	s.Total++
+	for _, tag := range treat.Tags {
+		s.ByTag[tag]++
+	}
+	if treat.Author != "" {
+		s.ByAuthor[treat.Author]++
+	}
+	if created.IsZero() {
+		s.Undated++
+	} else {
+		s.AddedByMonth[created.UTC().Format(statsMonth)]++
+	}
+}
+
+// statsCache keeps the last TreatStats computed.
+type statsCache struct {
+	mu    sync.Mutex
+	stats *TreatStats
+}
+
+// requireStats returns a 404 appError unless statistics are enabled. The
+// stats route uses it through guard.
+func (t *Treatshelf) requireStats(r *http.Request) *appError {
+	if t.Stats == nil {
+		err := errors.New("statistics are not enabled")
+		return t.appErrorCodef(r, http.StatusNotFound, err, "%v", err)
+	}
+	return nil
+}
+
+// treatStats returns the statistics computed within statsMaxAge, or
+// computes them again.
+func (t *Treatshelf) treatStats(ctx context.Context) (*TreatStats, error) {
+	t.statsCache.mu.Lock()
+	defer t.statsCache.mu.Unlock()
+	now := t.now()
+	if s := t.statsCache.stats; s != nil && now.Sub(s.Computed) < statsMaxAge {
+		return s, nil
+	}
+	s, err := t.Stats.TreatStats(ctx, now)
+	if err != nil {
+		return nil, err
+	}
+	t.statsCache.stats = s
+	return s, nil
+}
+
+// apiStatsHandler returns the statistics of the shelf, see above.
+func (t *Treatshelf) apiStatsHandler(w http.ResponseWriter, r *http.Request) *appError {
+	s, err := t.treatStats(r.Context())
+	if err != nil {
+		return t.appErrorf(r, err, "could not compute statistics: %v", err)
+	}
+	writeJSON(w, http.StatusOK, s)
+	return nil
+}
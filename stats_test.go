@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTreatStats(t *testing.T) {
+	shelf, _, _ := policyShelf(t)
+	db := shelf.DB.(*memoryDB)
+	shelf.Stats = db
+	ctx := context.Background()
+	for _, treat := range []*Treat{
+		{Title: "Brownie", Author: "Erica", Tags: []string{"chocolate", "vegan"}},
+		{Title: "Cookie", Author: "Erica", Tags: []string{"chocolate"}},
+		{Title: "Gone", Author: "Erica", Tags: []string{"chocolate"}, DeletedAt: time.Now()},
+	} {
+		if _, err := db.AddTreat(ctx, treat); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h := shelf.Handler()
+	get := func(user string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/api/v2/stats", nil)
+		if user != "" {
+			r.Header.Set(iapEmailHeader, "accounts.google.com:"+user)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := get("someone@example.com"); w.Code != http.StatusForbidden {
+		t.Errorf("non-admin: got status %d, want %d", w.Code, http.StatusForbidden)
+	}
+	w := get("admin@example.com")
+	var s TreatStats
+	if err := json.Unmarshal(w.Body.Bytes(), &s); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("got status %d, %v: %s", w.Code, err, w.Body)
+	}
+	// policyShelf adds two treats without tags or authors.
+	month := shelf.now().UTC().Format(statsMonth)
+	if s.Total != 4 || s.ByTag["chocolate"] != 2 || s.ByTag["vegan"] != 1 || s.ByAuthor["Erica"] != 2 || s.AddedByMonth[month] != 4 || s.Undated != 0 {
+		t.Errorf("got %s", w.Body)
+	}
+
+	// Statistics are kept for a while.
+	if _, err := db.AddTreat(ctx, &Treat{Title: "Pie"}); err != nil {
+		t.Fatal(err)
+	}
+	if again, err := shelf.treatStats(ctx); err != nil || again.Total != 4 {
+		t.Errorf("treatStats within statsMaxAge = %+v, %v; want the same 4 treats", again, err)
+	}
+}
+
+func TestAddedSeries(t *testing.T) {
+	s := newTreatStats(time.Date(2026, 2, 14, 0, 0, 0, 0, time.UTC))
+	s.AddedByMonth = map[string]int{"2025-11": 3, "2026-02": 1}
+	tests := []struct {
+		months int
+		want   string
+	}{
+		{3, "[{2025-12 0} {2026-01 0} {2026-02 1}]"},
+		{0, "[{2025-11 3} {2025-12 0} {2026-01 0} {2026-02 1}]"},
+	}
+	for _, tt := range tests {
+		if got := fmt.Sprint(s.addedSeries(tt.months)); got != tt.want {
+			t.Errorf("addedSeries(%d) = %s, want %s", tt.months, got, tt.want)
+		}
+	}
+}
+
+func TestStatsCSV(t *testing.T) {
+	shelf, _, _ := policyShelf(t)
+	db := shelf.DB.(*memoryDB)
+	shelf.Stats = db
+	for _, treat := range []*Treat{
+		{Title: "Brownie", Tags: []string{"chocolate", "vegan"}},
+		{Title: "Cookie", Tags: []string{"chocolate"}},
+	} {
+		if _, err := db.AddTreat(context.Background(), treat); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h := shelf.Handler()
+	month := shelf.now().UTC().Format(statsMonth)
+	tests := []struct {
+		query string
+		code  int
+		want  string
+	}{
+		{"series=tags", http.StatusOK, "tag,treats\nchocolate,2\nvegan,1\n"},
+		{"series=added&months=1", http.StatusOK, "month,added\n" + month + ",4\n"},
+		{"series=views", http.StatusBadRequest, ""},
+		{"series=added&months=-1", http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/admin/stats.csv?"+tt.query, nil)
+		r.Header.Set(iapEmailHeader, "accounts.google.com:admin@example.com")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tt.code || (tt.want != "" && w.Body.String() != tt.want) {
+			t.Errorf("%s: got status %d, %q; want %d, %q", tt.query, w.Code, w.Body, tt.code, tt.want)
+		}
+	}
+}
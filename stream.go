@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"time"
+)
+
+// flushEvery is how many rows streaming handlers write between flushes.
+const flushEvery = 100
+
+// allTreatsTmpl renders the streamed admin view of every treat.
+var allTreatsTmpl = template.Must(template.New("alltreats.html").Funcs(templateFuncs).ParseFiles("templates/alltreats.html"))
+
+// allTreatsOptions selects every treat, for admins.
+var allTreatsOptions = ListOptions{
+	IncludeExpired:    true,
+	IncludeArchived:   true,
+	IncludeHidden:     true,
+	IncludeUnreviewed: true,
+	Consistency:       ConsistencyEventual,
+}
+
+// flusher returns a function flushing w, if it can be flushed.
+func flusher(w http.ResponseWriter) func() {
+	if f, ok := w.(http.Flusher); ok {
+		return f.Flush
+	}
+	return func() {}
+}
+
+// allTreatsHandler shows a table of every treat, including hidden, expired,
+// archived and unreviewed ones. Rows are written as they are read, so that the page
+// starts showing at once and memory stays flat however many treats there
+// are.
+func (t *Treatshelf) allTreatsHandler(w http.ResponseWriter, r *http.Request) *appError {
+	flush := flusher(w)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := allTreatsTmpl.ExecuteTemplate(w, "header", struct{ BasePath string }{t.basePath}); err != nil {
+		return t.appErrorf(r, err, "could not write template: %v", err)
+	}
+
+	n := 0
+	now := t.now()
+	err := t.DB.EachTreat(r.Context(), allTreatsOptions, func(treat *Treat) error {
+		row := struct {
+			*Treat
+			Now time.Time
+		}{treat, now}
+		if err := allTreatsTmpl.ExecuteTemplate(w, "row", row); err != nil {
+			return err
+		}
+		if n++; n%flushEvery == 0 {
+			flush()
+		}
+		return nil
+	})
+	if err != nil {
+		// The page has started, so the error can't change the status code.
+		// Log it and end the page where it stopped.
+		fmt.Fprintf(t.logWriter, "Could not stream treats: %v\n", err)
+	}
+	allTreatsTmpl.ExecuteTemplate(w, "footer", struct{ Count int }{n})
+	return nil
+}
+
+// exportHandler streams every treat as JSON, one object per line.
+func (t *Treatshelf) exportHandler(w http.ResponseWriter, r *http.Request) *appError {
+	flush := flusher(w)
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", `attachment; filename="treats.jsonl"`)
+
+	enc := json.NewEncoder(w)
+	n := 0
+	err := t.DB.EachTreat(r.Context(), allTreatsOptions, func(treat *Treat) error {
+		if err := enc.Encode(treat); err != nil {
+			return err
+		}
+		if n++; n%flushEvery == 0 {
+			flush()
+		}
+		return nil
+	})
+	if err != nil {
+		// Truncate the export visibly rather than ending it cleanly.
+		fmt.Fprintf(t.logWriter, "Could not export treats after %d: %v\n", n, err)
+		enc.Encode(map[string]string{"error": err.Error()})
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// normalizeTag lowercases a tag, collapses its whitespace and drops other
+// control characters, as cleanLine does.
+func normalizeTag(tag string) string {
+	tag = strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return ' '
+		}
+		return r
+	}, tag)
+	return strings.Join(strings.Fields(cleanLine(strings.ToLower(tag))), " ")
+}
+
+// parseTags parses a comma-separated list of tags, dropping duplicates.
+func parseTags(s string) []string {
+	var tags []string
+	seen := make(map[string]bool)
+	for _, tag := range strings.Split(s, ",") {
+		tag = normalizeTag(tag)
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+	}
+	return tags
+}
+
+// replaceTags returns tags with every tag in from replaced by to, or removed
+// if to is empty, and whether anything changed.
+func replaceTags(tags, from []string, to string) ([]string, bool) {
+	replace := make(map[string]bool)
+	for _, f := range from {
+		replace[f] = true
+	}
+	var out []string
+	seen := make(map[string]bool)
+	changed := false
+	for _, tag := range tags {
+		if replace[tag] {
+			changed = true
+			tag = to
+		}
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		out = append(out, tag)
+	}
+	return out, changed
+}
+
+// TagCount is a tag and the number of treats carrying it.
+type TagCount struct {
+	Tag   string `json:"tag"`
+	Count int    `json:"count"`
+}
+
+// tagCounts counts the tags across the given treats, most used first.
+func tagCounts(treats []*Treat) []TagCount {
+	counts := make(map[string]int)
+	for _, t := range treats {
+		for _, tag := range t.Tags {
+			counts[tag]++
+		}
+	}
+	tcs := make([]TagCount, 0, len(counts))
+	for tag, n := range counts {
+		tcs = append(tcs, TagCount{Tag: tag, Count: n})
+	}
+	sort.Slice(tcs, func(i, j int) bool {
+		if tcs[i].Count != tcs[j].Count {
+			return tcs[i].Count > tcs[j].Count
+		}
+		return tcs[i].Tag < tcs[j].Tag
+	})
+	return tcs
+}
+
+// tagsAdminHandler displays the bulk tag editor. The page fetches its data
+// from tagsJSONHandler.
+func (t *Treatshelf) tagsAdminHandler(w http.ResponseWriter, r *http.Request) *appError {
+	return tagsTmpl.Execute(t, w, r, nil)
+}
+
+// tagsJSONHandler returns every tag with its usage count as JSON.
+func (t *Treatshelf) tagsJSONHandler(w http.ResponseWriter, r *http.Request) *appError {
+	treats, err := t.DB.ListTreats(r.Context(), ListOptions{
+		IncludeArchived:   true,
+		IncludeExpired:    true,
+		IncludeHidden:     true,
+		IncludeUnreviewed: true,
+	})
+	if err != nil {
+		return t.appErrorf(r, err, "could not list treats: %v", err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(tagCounts(treats)); err != nil {
+		return t.appErrorf(r, err, "could not encode tags: %v", err)
+	}
+	return nil
+}
+
+// tagEdit is the body of a bulk tag edit request. Rename and merge replace
+// every tag in From with To; delete leaves To empty.
+type tagEdit struct {
+	From []string `json:"from"`
+	To   string   `json:"to"`
+}
+
+// tagEditHandler returns a handler applying a bulk tag edit across all
+// treats. Progress is streamed back as one JSON object per line, e.g.
+// {"done":500,"total":1200}, ending with {"done":1200,"total":1200,"finished":true}.
+func (t *Treatshelf) tagEditHandler(op string) appHandler {
+	return func(w http.ResponseWriter, r *http.Request) *appError {
+		var edit tagEdit
+		if err := json.NewDecoder(r.Body).Decode(&edit); err != nil {
+			return t.appErrorCodef(r, http.StatusBadRequest, err, "could not decode tag edit: %v", err)
+		}
+		var from []string
+		for _, f := range edit.From {
+			if f = normalizeTag(f); f != "" {
+				from = append(from, f)
+			}
+		}
+		to := normalizeTag(edit.To)
+		switch {
+		case len(from) == 0:
+			err := errors.New("no tags to edit")
+			return t.appErrorCodef(r, http.StatusBadRequest, err, "%v", err)
+		case op == "delete" && to != "":
+			err := errors.New("delete does not take a replacement tag")
+			return t.appErrorCodef(r, http.StatusBadRequest, err, "%v", err)
+		case op != "delete" && to == "":
+			err := fmt.Errorf("%s needs a replacement tag", op)
+			return t.appErrorCodef(r, http.StatusBadRequest, err, "%v", err)
+		case op == "rename" && len(from) != 1:
+			err := errors.New("rename takes exactly one tag, use merge for several")
+			return t.appErrorCodef(r, http.StatusBadRequest, err, "%v", err)
+		}
+
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		enc := json.NewEncoder(w)
+		flusher, _ := w.(http.Flusher)
+		progress := func(done, total int) {
+			enc.Encode(map[string]int{"done": done, "total": total})
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		n, err := t.DB.ReplaceTags(r.Context(), from, to, progress)
+		if err != nil {
+			// The response has started, so report the failure in the stream.
+			fmt.Fprintf(t.logWriter, "ReplaceTags(%q, %q): %v\n", from, to, err)
+			enc.Encode(map[string]interface{}{"error": err.Error(), "done": n})
+			return nil
+		}
+		enc.Encode(map[string]interface{}{"done": n, "total": n, "finished": true})
+		return nil
+	}
+}
@@ -1,16 +1,28 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"html/template"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
 )
 
 // parseTemplate applies a given file to the body of the base template.
 func parseTemplate(filename string) *appTemplate {
-	tmpl := template.Must(template.ParseFiles("templates/base.html"))
+	tmpl := template.Must(template.New("base.html").Funcs(templateFuncs).ParseFiles("templates/base.html"))
+
+	// Make shared components (see templates/partials) available to every page.
+	template.Must(tmpl.ParseGlob("templates/partials/*.html"))
 
 	// Put the named file into a template called "body"
 	path := filepath.Join("templates", filename)
@@ -20,24 +32,309 @@ func parseTemplate(filename string) *appTemplate {
 	}
 	template.Must(tmpl.New("body").Parse(string(t)))
 
-	return &appTemplate{tmpl.Lookup("base.html")}
+	at := &appTemplate{name: filename, t: tmpl.Lookup("base.html")}
+	appTemplates = append(appTemplates, at)
+	return at
 }
 
+// appTemplates are the templates made by parseTemplate, for warmup.go.
+var appTemplates []*appTemplate
+
 // appTemplate is an appError-aware wrapper for a html/template.
 type appTemplate struct {
-	t *template.Template
+	name string
+	t    *template.Template
+}
+
+// pageData is what the base template is executed with; the page's own data
+// is in Data.
+type pageData struct {
+	Data interface{}
+
+	// Locations and LocationID drive the location switcher in the
+	// header (see templates/base.html).
+	Locations  []*Location
+	LocationID string
+
+	// Theme is the user's preferred color theme.
+	Theme string
+
+	// Flash is a one-time message left by the previous request.
+	Flash *flash
+
+	// Degraded lists unavailable components, shown to admins only.
+	Degraded []string
+
+	// BudgetExhausted shows everyone a banner while an SLO's error budget
+	// is exhausted, see slo.go.
+	BudgetExhausted bool
+
+	// User is the signed-in user, and SignIn whether people can sign in
+	// with an AuthProvider, for the sign-in links in the header.
+	User   string
+	SignIn bool
+
+	// Shelves are the user's smart shelves, for the header, see
+	// shelves.go.
+	Shelves []*SavedSearch
+
+	// Impersonator is the admin viewing the app as User, if any, for the
+	// banner in base.html.
+	Impersonator string
+
+	// BasePath is the path the app is served under. Links in templates
+	// are relative to it, see the <base> element in base.html.
+	BasePath string
+}
+
+// pageDataPool and bufferPool save allocating a pageData and a buffer for
+// every page view.
+var (
+	pageDataPool = sync.Pool{New: func() interface{} { return new(pageData) }}
+	bufferPool   = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
+)
+
+// maxPooledBuffer is the size above which buffers are dropped rather than
+// pooled, so that one huge page doesn't keep its memory in use.
+const maxPooledBuffer = 1 << 20
+
+func getBuffer() *bytes.Buffer {
+	return bufferPool.Get().(*bytes.Buffer)
+}
+
+func putBuffer(b *bytes.Buffer) {
+	if b.Cap() > maxPooledBuffer {
+		return
+	}
+	b.Reset()
+	bufferPool.Put(b)
 }
 
-// Execute writes the template using the provided data.
+// Execute writes the template using the provided data. The page is
+// rendered into a buffer and written only once it is complete, so that a
+// failing template produces an error page rather than half a page.
+//
+// Rendered pages are cached for renderCacheTTL, or until a treat changes,
+// by a hash of the template name and everything they are rendered from,
+// which also serves as their ETag.
 func (tmpl *appTemplate) Execute(t *Treatshelf, w http.ResponseWriter, r *http.Request, data interface{}) *appError {
-	d := struct {
-		Data interface{}
-	}{
-		Data: data,
+	d := pageDataPool.Get().(*pageData)
+	defer func() {
+		*d = pageData{}
+		pageDataPool.Put(d)
+	}()
+	*d = pageData{
+		Data:       data,
+		Flash:      takeFlash(w, r),
+		LocationID: t.session(r).LocationID,
+		Theme:      t.preferences(r).Theme,
+		User:       t.currentUser(r),
+		SignIn:     len(t.authProviders) > 0,
+		BasePath:   t.basePath,
+		Shelves:    t.savedSearches(r),
+
+		BudgetExhausted: t.budgetExhausted(),
+	}
+	if t.isAdmin(r) {
+		d.Degraded = t.degradedComponents()
+	}
+	if v := t.impersonating(r); v != nil {
+		d.Impersonator = v.Admin
+	}
+	if t.Locations != nil {
+		locations, err := t.Locations.ListLocations(r.Context())
+		if err != nil {
+			return t.appErrorf(r, err, "could not list locations: %v", err)
+		}
+		d.Locations = locations
+	}
+
+	// Pages served no-store, such as the one showing a new API token,
+	// aren't cached here either.
+	key := ""
+	if w.Header().Get("Cache-Control") != cacheNoStore {
+		key = tmpl.renderKey(d)
+	}
+	if key != "" {
+		w.Header().Set("ETag", `"`+key+`"`)
+		if r.Method == "GET" && r.Header.Get("If-None-Match") == `"`+key+`"` {
+			w.WriteHeader(http.StatusNotModified)
+			return nil
+		}
+		// Browsers that just wrote read their writes, see readConsistency,
+		// so don't serve them pages cached before the write.
+		_, err := r.Cookie(wroteCookie)
+		if page, ok := t.renders.get(key); ok && err != nil {
+			w.Write(page)
+			return nil
+		}
 	}
 
-	if err := tmpl.t.Execute(w, d); err != nil {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	if err := tmpl.t.Execute(buf, d); err != nil {
+		w.Header().Del("ETag")
 		return t.appErrorf(r, err, "could not write template: %v", err)
 	}
+	if t.a11yAudit {
+		for _, p := range auditHTML(buf.String()) {
+			fmt.Fprintf(t.logWriter, "A11y: %s: %s\n", tmpl.name, p)
+		}
+	}
+	if key != "" {
+		t.renders.put(key, buf.Bytes())
+	}
+	w.Write(buf.Bytes())
 	return nil
 }
+
+// writePage writes e as an error page for browsers, for the request with
+// the given ID, or as plain text if the page can't be rendered. The page
+// is rendered without the handler's data or the database, either of which
+// may be what failed.
+func (e *appError) writePage(w http.ResponseWriter, requestID string) {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	err := errorTmpl.t.Execute(buf, &pageData{
+		Data: struct {
+			Title, Message, RequestID string
+			Code                      int
+		}{http.StatusText(e.code), e.message, requestID, e.code},
+		BasePath: e.t.basePath,
+	})
+	if err != nil {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(e.code)
+		fmt.Fprint(w, e.message)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(e.code)
+	w.Write(buf.Bytes())
+}
+
+// renderKey hashes the template name and d, or returns "" if d can't be
+// hashed, in which case the page isn't cached.
+func (tmpl *appTemplate) renderKey(d *pageData) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n", tmpl.name)
+	if err := json.NewEncoder(h).Encode(d); err != nil {
+		return ""
+	}
+	hashServerFields(h, reflect.ValueOf(d))
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// treatType is the type hashServerFields looks for.
+var treatType = reflect.TypeOf(Treat{})
+
+// hashServerFields writes to w the fields of the treats in v that JSON
+// leaves out, since pages show them to admins and owners. v must have
+// encoded as JSON, so that it has no cycles.
+func hashServerFields(w io.Writer, v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if !v.IsNil() {
+			hashServerFields(w, v.Elem())
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			hashServerFields(w, v.Index(i))
+		}
+	case reflect.Map:
+		// In key order, as JSON does, so that keys are stable.
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool {
+			return fmt.Sprint(keys[i].Interface()) < fmt.Sprint(keys[j].Interface())
+		})
+		for _, k := range keys {
+			hashServerFields(w, v.MapIndex(k))
+		}
+	case reflect.Struct:
+		if v.Type() == treatType {
+			fmt.Fprintf(w, "%q %q %d\n", v.FieldByName("CreatedBy").String(), v.FieldByName("InternalNotes").String(), v.FieldByName("Reports").Int())
+			return
+		}
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).PkgPath == "" {
+				hashServerFields(w, v.Field(i))
+			}
+		}
+	}
+}
+
+const (
+	// renderCacheSize bounds how many pages renderCache holds.
+	renderCacheSize = 500
+
+	// renderCacheTTL bounds how long a page is cached for, since pages also
+	// depend on the time, such as whether a treat has expired.
+	renderCacheTTL = 30 * time.Second
+)
+
+// renderCache holds rendered pages by renderKey. The methods of a nil
+// renderCache do nothing.
+type renderCache struct {
+	clock Clock // tells when pages expire, see clock.go.
+
+	mu    sync.Mutex
+	pages map[string]renderedPage
+}
+
+type renderedPage struct {
+	body    []byte
+	expires time.Time
+}
+
+func newRenderCache(clock Clock) *renderCache {
+	return &renderCache{clock: clock, pages: make(map[string]renderedPage)}
+}
+
+// get returns the page cached under key, if it hasn't expired.
+func (c *renderCache) get(key string) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p, ok := c.pages[key]
+	if !ok || c.clock.Now().After(p.expires) {
+		return nil, false
+	}
+	return p.body, true
+}
+
+// put caches a copy of page under key, first dropping expired pages, or
+// every page, if the cache is full.
+func (c *renderCache) put(key string, page []byte) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.clock.Now()
+	if len(c.pages) >= renderCacheSize {
+		for k, p := range c.pages {
+			if now.After(p.expires) {
+				delete(c.pages, k)
+			}
+		}
+		if len(c.pages) >= renderCacheSize {
+			c.pages = make(map[string]renderedPage)
+		}
+	}
+	c.pages[key] = renderedPage{
+		body:    append([]byte(nil), page...),
+		expires: now.Add(renderCacheTTL),
+	}
+}
+
+// clear drops every cached page.
+func (c *renderCache) clear() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pages = make(map[string]renderedPage)
+}
@@ -0,0 +1,37 @@
+package main
+
+import "testing"
+
+func TestRenderKeyCoversServerFields(t *testing.T) {
+	tmpl := &appTemplate{name: "detail.html"}
+	key := func(treat *Treat) string {
+		return tmpl.renderKey(&pageData{Data: struct {
+			Treats []*Treat
+			Admin  bool
+		}{[]*Treat{treat}, true}})
+	}
+	base := Treat{ID: "1", Title: "Brownie", CreatedBy: "owner@example.com", InternalNotes: "Supplier: Bakery Ltd", Reports: 1}
+	want := key(&base)
+	if want == "" {
+		t.Fatal("renderKey() = \"\", want a key")
+	}
+
+	tests := []struct {
+		name   string
+		change func(*Treat)
+	}{
+		{"CreatedBy", func(tr *Treat) { tr.CreatedBy = deletedAccount }},
+		{"InternalNotes", func(tr *Treat) { tr.InternalNotes = "Supplier: Cake Co" }},
+		{"Reports", func(tr *Treat) { tr.Reports = 2 }},
+	}
+	for _, tt := range tests {
+		changed := base
+		tt.change(&changed)
+		if got := key(&changed); got == want {
+			t.Errorf("changing %s kept the key %s", tt.name, got)
+		}
+	}
+	if got := key(&base); got != want {
+		t.Errorf("renderKey() = %s, then %s for the same data", want, got)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Test hooks let the end-to-end tests in e2e_test.go, which drive a browser
+// against the app, put it back in a known state between flows:
+//
+//	curl -X POST localhost:8080/debug/reset
+//
+// empties the database and loads the seed data (see seed.go), so that the
+// seeded treats have the IDs in treats.json and treats added afterwards are
+// numbered from 1, as are pictures if the app shares the database's
+// IDGenerator (see ids.go). The hooks are off unless testHooks is set,
+// which only tests serving a memoryDB do; the app never empties a real
+// database.
+
+// resetter is implemented by databases that can be emptied, see
+// memoryDB.reset, and by IDGenerators that count.
+type resetter interface {
+	reset()
+}
+
+// resetHandler resets the app for the next end-to-end test and replies with
+// the number of treats seeded.
+func (t *Treatshelf) resetHandler(w http.ResponseWriter, r *http.Request) *appError {
+	if !t.testHooks {
+		err := errors.New("test hooks are off")
+		return t.appErrorCodef(r, http.StatusNotFound, err, "%v", err)
+	}
+	n, err := t.reset(r.Context())
+	if err != nil {
+		return t.appErrorf(r, err, "could not reset: %v", err)
+	}
+	if err := writeJSON(w, http.StatusOK, map[string]int{"seeded": n}); err != nil {
+		return t.appErrorf(r, err, "could not write response: %v", err)
+	}
+	return nil
+}
+
+// reset empties the database, including locations and everything else kept
+// with the treats, and loads the seed data.
+func (t *Treatshelf) reset(ctx context.Context) (int, error) {
+	db, ok := t.DB.(resetter)
+	if !ok {
+		return 0, fmt.Errorf("%T can't be reset", t.DB)
+	}
+	db.reset()
+	t.renders.clear()
+	return t.seed(ctx, seedDir)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestMemoryDBReset(t *testing.T) {
+	db := newMemoryDB()
+	ctx := context.Background()
+	if _, err := db.AddTreat(ctx, &Treat{Title: "Brownie"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.AddLocation(ctx, &Location{Name: "Kitchen"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetPreferences(ctx, "p", &Preferences{}); err != nil {
+		t.Fatal(err)
+	}
+	db.reset()
+	if !reflect.DeepEqual(db, newMemoryDB()) {
+		t.Errorf("reset left %+v", db)
+	}
+	if id, err := db.AddTreat(ctx, &Treat{Title: "Cookie"}); err != nil || id != "1" {
+		t.Errorf("AddTreat after reset = %q, %v; want 1", id, err)
+	}
+}
+
+func TestResetHandler(t *testing.T) {
+	shelf := goldenShelf(t)
+	h := shelf.Handler()
+	reset := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/debug/reset", nil)
+		r.Header.Set(iapEmailHeader, "accounts.google.com:admin@example.com")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := reset(); w.Code != http.StatusNotFound {
+		t.Fatalf("reset with test hooks off: got status %d, want %d", w.Code, http.StatusNotFound)
+	}
+	if _, err := shelf.DB.GetTreat(context.Background(), "brownie"); err != nil {
+		t.Fatalf("reset with test hooks off emptied the database: %v", err)
+	}
+
+	shelf.testHooks = true
+	if w := reset(); w.Code != http.StatusOK {
+		t.Fatalf("reset: got status %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	ctx := context.Background()
+	if _, err := shelf.DB.GetTreat(ctx, "brownie"); err == nil {
+		t.Error("reset kept treat brownie")
+	}
+	if _, err := shelf.DB.GetTreat(ctx, "seed-brownie"); err != nil {
+		t.Errorf("reset didn't seed: %v", err)
+	}
+	if id, err := shelf.DB.AddTreat(ctx, &Treat{Title: "New"}); err != nil || id != "1" {
+		t.Errorf("AddTreat after reset = %q, %v; want 1", id, err)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+)
+
+// testShelfOption configures the Treatshelf newTestShelf returns.
+type testShelfOption func(shelf *Treatshelf, db *memoryDB)
+
+// newTestShelf returns a Treatshelf backed by an empty memoryDB, without any
+// Google Cloud clients, on a fake clock and with no admins. Its routes are
+// set up, so that handlers called directly can link to them. Options, such
+// as withAdmin, change it from there; fixtures then add their data to db.
+func newTestShelf(tb testing.TB, opts ...testShelfOption) (*Treatshelf, *memoryDB) {
+	tb.Helper()
+	db := newMemoryDB()
+	shelf := &Treatshelf{
+		DB:          db,
+		Locations:   db,
+		Preferences: db,
+		logWriter:   ioutil.Discard,
+		admins:      make(map[string]bool),
+		changes:     newChangeHub(),
+		keyring:     randomKeyring(),
+	}
+	useFakeClock(shelf, db)
+	for _, opt := range opts {
+		opt(shelf, db)
+	}
+	shelf.Handler()
+	return shelf, db
+}
+
+// withAdmin makes email an admin, and trusts IAP's header, with which
+// tests sign requests in.
+func withAdmin(email string) testShelfOption {
+	return func(shelf *Treatshelf, _ *memoryDB) {
+		shelf.admins[email] = true
+		shelf.trustIAPHeader = true
+	}
+}
+
+// withAllDatabases stores tokens, profiles, sign-ins, reports, saved
+// searches and statistics in the memoryDB too, turning on the features
+// that need them.
+func withAllDatabases() testShelfOption {
+	return func(shelf *Treatshelf, db *memoryDB) {
+		shelf.Tokens = db
+		shelf.Profiles = db
+		shelf.SignIns = db
+		shelf.Reports = db
+		shelf.SavedSearches = db
+		shelf.Stats = db
+		shelf.reportHideAt = defaultReportHideAt
+	}
+}
+
+// withSystemClock leaves the shelf on the real clock, for tests whose
+// clients, such as browsers, keep their own time.
+func withSystemClock() testShelfOption {
+	return func(shelf *Treatshelf, db *memoryDB) {
+		shelf.clock, db.clock = nil, systemClock{}
+	}
+}
+
+// brownieShelf returns a test shelf holding treat "1", a brownie, for tests
+// that request and change a treat, such as the fuzz tests.
+func brownieShelf(tb testing.TB) *Treatshelf {
+	shelf, db := newTestShelf(tb)
+	if err := db.UpdateTreat(context.Background(), &Treat{ID: "1", Title: "Brownie"}); err != nil {
+		tb.Fatal(err)
+	}
+	return shelf
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"unicode"
+
+	"golang.org/x/text/collate"
+	"golang.org/x/text/language"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Text people enter is cleaned before it is stored: it is normalized to
+// NFC, so that "É" typed as one character or as "E" and a combining accent
+// compares equal, and control characters are removed, including the bidi
+// controls that can make a title display differently from how it reads.
+// Templates escape everything they show (html/template), so cleaning is
+// about consistency and spoofing, not markup.
+//
+// Titles are listed in the order of a collation (see
+// golang.org/x/text/collate), so that "Éclair" sorts next to "Eclair"
+// rather than after "Zabaglione", whatever the database's own order.
+
+// isBidiControl reports whether r overrides or isolates the direction of
+// the text around it.
+func isBidiControl(r rune) bool {
+	return (r >= '\u202a' && r <= '\u202e') || (r >= '\u2066' && r <= '\u2069')
+}
+
+// cleanLine cleans single-line text such as titles: control characters,
+// including line breaks, are removed and surrounding space trimmed.
+func cleanLine(s string) string {
+	return strings.TrimSpace(strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || isBidiControl(r) {
+			return -1
+		}
+		return r
+	}, norm.NFC.String(s)))
+}
+
+// cleanText cleans multi-line text such as descriptions, like cleanLine
+// but keeping line breaks and tabs. Line breaks are normalized to "\n".
+func cleanText(s string) string {
+	s = strings.Replace(norm.NFC.String(s), "\r\n", "\n", -1)
+	return strings.TrimSpace(strings.Map(func(r rune) rune {
+		if (unicode.IsControl(r) && r != '\n' && r != '\t') || isBidiControl(r) {
+			return -1
+		}
+		return r
+	}, s))
+}
+
+// collators holds a pool of Collators per locale, since a Collator can't be
+// used concurrently. collatorsMu guards it.
+var (
+	collatorsMu sync.Mutex
+	collators   = make(map[string]*sync.Pool)
+)
+
+// collatorPool returns the pool of Collators for locale, a BCP 47 tag. The
+// root collation, which suits most languages, is used for "" and tags that
+// don't parse.
+func collatorPool(locale string) *sync.Pool {
+	collatorsMu.Lock()
+	defer collatorsMu.Unlock()
+	if p, ok := collators[locale]; ok {
+		return p
+	}
+	tag, err := language.Parse(locale)
+	if err != nil {
+		tag = language.Und
+	}
+	p := &sync.Pool{New: func() interface{} {
+		return collate.New(tag, collate.Numeric)
+	}}
+	collators[locale] = p
+	return p
+}
+
+// withCollator calls fn with a Collator for locale, which fn must not keep.
+func withCollator(locale string, fn func(*collate.Collator)) {
+	p := collatorPool(locale)
+	c := p.Get().(*collate.Collator)
+	defer p.Put(c)
+	fn(c)
+}
+
+// collationFor returns the locale titles are collated by for r: the
+// reader's chosen locale, or else the site's collation (COLLATION_LOCALE),
+// or else the best match for their Accept-Language header.
+func (t *Treatshelf) collationFor(r *http.Request, prefs *Preferences) string {
+	if prefs.Locale != "" {
+		return prefs.Locale
+	}
+	if t.collation != "" {
+		return t.collation
+	}
+	return localeFromRequest(r)
+}
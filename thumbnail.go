@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+
+	// Decoders for the picture formats thumbnails are made of.
+	_ "image/gif"
+	_ "image/png"
+
+	"cloud.google.com/go/storage"
+)
+
+// Treat pictures are stored as uploaded, which is wasteful for lists on
+// phones. A small JPEG copy of each, its thumbnail, is made on upload and
+// stored in the thumbnail bucket (THUMBNAIL_BUCKET) as ThumbnailURL.
+// Pictures in formats the standard library can't decode get none, as do
+// those too large to process (see imagepool.go), and lists fall back to
+// the picture itself.
+
+const (
+	// thumbnailSize is the most pixels a thumbnail is wide or tall.
+	thumbnailSize = 200
+	// thumbnailQuality is the JPEG quality thumbnails are encoded with.
+	thumbnailQuality = 80
+	// thumbnailPrefix is where thumbnails are stored in their bucket, which
+	// may also hold the pictures.
+	thumbnailPrefix = "thumbnails/"
+)
+
+// uploadPictureFromForm uploads the picture in the given form field, if
+// present, and a thumbnail of it. thumbnailURL is "" if no thumbnail could
+// be made.
+func (t *Treatshelf) uploadPictureFromForm(ctx context.Context, r *http.Request, field string) (url, thumbnailURL string, err error) {
+	f, fh, err := r.FormFile(field)
+	if err == http.ErrMissingFile {
+		return "", "", nil
+	}
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+	url, err = t.uploadFile(ctx, f, fh.Filename, fh.Header.Get("Content-Type"))
+	if err != nil {
+		return "", "", err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", "", err
+	}
+	// The picture is usable without a thumbnail, so failures are logged.
+	thumb, err := t.images.thumbnail(ctx, f)
+	if err == nil {
+		thumbnailURL, err = t.uploadThumbnail(ctx, url, thumb)
+	}
+	if err != nil {
+		fmt.Fprintf(t.logWriter, "No thumbnail for %q: %v\n", fh.Filename, err)
+	}
+	return url, thumbnailURL, nil
+}
+
+// uploadThumbnail stores thumb, a JPEG made by makeThumbnail, as the
+// thumbnail of the picture with the given URL and returns its URL.
+func (t *Treatshelf) uploadThumbnail(ctx context.Context, url string, thumb []byte) (string, error) {
+	bucket, bucketName, err := t.thumbnailBucket()
+	if err != nil {
+		return "", err
+	}
+	name := thumbnailPrefix + strings.TrimSuffix(path.Base(url), path.Ext(url)) + ".jpg"
+	w := bucket.Object(name).NewWriter(ctx)
+	w.ACL = []storage.ACLRule{{Entity: storage.AllUsers, Role: storage.RoleReader}}
+	w.ContentType = "image/jpeg"
+	w.CacheControl = cacheImmutable
+	if _, err := w.Write(thumb); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf(publicURL, bucketName, name), nil
+}
+
+// makeThumbnail decodes the picture in r and returns it as a JPEG scaled
+// down to fit in thumbnailSize pixels square. Smaller pictures are only
+// re-encoded.
+func makeThumbnail(r io.Reader) ([]byte, error) {
+	src, _, err := image.Decode(r)
+	if err != nil {
+		return nil, err
+	}
+	dst, err := scaleToFit(src, thumbnailSize, thumbnailSize)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, dst, &jpeg.Options{Quality: thumbnailQuality}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// scaleToFit returns src scaled down, keeping its aspect ratio, to fit in
+// maxW by maxH pixels, or as it is if it fits already, as an opaque image:
+// transparent areas become white, as JPEG has no alpha.
+func scaleToFit(src image.Image, maxW, maxH int) (*image.RGBA, error) {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w == 0 || h == 0 {
+		return nil, fmt.Errorf("empty picture")
+	}
+	if w > maxW || h > maxH {
+		if w*maxH >= h*maxW {
+			w, h = maxW, max1(h*maxW/w)
+		} else {
+			w, h = max1(w*maxH/h), maxH
+		}
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	// Each scaled pixel is the average of the pixels it covers.
+	for y := 0; y < h; y++ {
+		y0, y1 := b.Min.Y+y*b.Dy()/h, b.Min.Y+(y+1)*b.Dy()/h
+		for x := 0; x < w; x++ {
+			x0, x1 := b.Min.X+x*b.Dx()/w, b.Min.X+(x+1)*b.Dx()/w
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r, g, bl, a, n = r+uint64(cr), g+uint64(cg), bl+uint64(cb), a+uint64(ca), n+1
+				}
+			}
+			white := 0xffff*n - a
+			dst.Set(x, y, color.RGBA64{
+				R: uint16((r + white) / n),
+				G: uint16((g + white) / n),
+				B: uint16((bl + white) / n),
+				A: 0xffff,
+			})
+		}
+	}
+	return dst, nil
+}
+
+// max1 returns n, or 1 if n is smaller.
+func max1(n int) int {
+	if n < 1 {
+		return 1
+	}
+	return n
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// ServeTLS configures serving HTTPS directly, for self-hosting. It isn't
+// needed on App Engine, whose front end terminates TLS.
+type ServeTLS struct {
+	// CertFile and KeyFile hold a certificate to serve (TLS_CERT_FILE,
+	// TLS_KEY_FILE).
+	CertFile, KeyFile string
+
+	// AutocertDomains are domains to get certificates for from Let's
+	// Encrypt instead (AUTOCERT_DOMAINS, comma-separated). Certificates
+	// are cached in AutocertCache (AUTOCERT_CACHE, default "autocert"),
+	// and Let's Encrypt may email AutocertEmail (AUTOCERT_EMAIL) about
+	// them.
+	AutocertDomains []string
+	AutocertCache   string
+	AutocertEmail   string
+
+	// RedirectPort is the port to redirect plain HTTP requests to HTTPS
+	// from (HTTP_REDIRECT_PORT, default "80"), or "off".
+	RedirectPort string
+}
+
+// tlsFromEnv reads the TLS configuration from the environment.
+func tlsFromEnv() ServeTLS {
+	c := ServeTLS{
+		CertFile:      os.Getenv("TLS_CERT_FILE"),
+		KeyFile:       os.Getenv("TLS_KEY_FILE"),
+		AutocertCache: os.Getenv("AUTOCERT_CACHE"),
+		AutocertEmail: os.Getenv("AUTOCERT_EMAIL"),
+		RedirectPort:  os.Getenv("HTTP_REDIRECT_PORT"),
+	}
+	for _, d := range strings.Split(os.Getenv("AUTOCERT_DOMAINS"), ",") {
+		if d = strings.TrimSpace(d); d != "" {
+			c.AutocertDomains = append(c.AutocertDomains, d)
+		}
+	}
+	if c.AutocertCache == "" {
+		c.AutocertCache = "autocert"
+	}
+	if c.RedirectPort == "" {
+		c.RedirectPort = "80"
+	}
+	return c
+}
+
+// Enabled reports whether HTTPS is configured.
+func (c ServeTLS) Enabled() bool {
+	return c.CertFile != "" || len(c.AutocertDomains) > 0
+}
+
+// listenAndServe serves h on port, over HTTPS if c is enabled. Plain HTTP
+// requests to c.RedirectPort are then redirected to HTTPS, and answer Let's
+// Encrypt's challenges when using autocert.
+func (c ServeTLS) listenAndServe(port string, h http.Handler) error {
+	if !c.Enabled() {
+		log.Printf("Listening on localhost:%s", port)
+		return http.ListenAndServe(":"+port, h)
+	}
+	if c.CertFile != "" && len(c.AutocertDomains) > 0 {
+		return errors.New("set either TLS_CERT_FILE or AUTOCERT_DOMAINS, not both")
+	}
+	if c.CertFile != "" && c.KeyFile == "" {
+		return errors.New("TLS_CERT_FILE is set but TLS_KEY_FILE is not")
+	}
+
+	srv := &http.Server{Addr: ":" + port, Handler: hsts(h)}
+	redirect := redirectToHTTPS(port)
+	if len(c.AutocertDomains) > 0 {
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			Cache:      autocert.DirCache(c.AutocertCache),
+			HostPolicy: autocert.HostWhitelist(c.AutocertDomains...),
+			Email:      c.AutocertEmail,
+		}
+		srv.TLSConfig = m.TLSConfig()
+		redirect = m.HTTPHandler(redirect)
+	}
+
+	if c.RedirectPort != "off" {
+		go func() {
+			log.Printf("Redirecting HTTP on localhost:%s to HTTPS", c.RedirectPort)
+			if err := http.ListenAndServe(":"+c.RedirectPort, redirect); err != nil {
+				log.Printf("Could not serve HTTP redirects: %v", err)
+			}
+		}()
+	}
+	log.Printf("Listening with TLS on localhost:%s", port)
+	return srv.ListenAndServeTLS(c.CertFile, c.KeyFile)
+}
+
+// redirectToHTTPS redirects requests to the same URL over HTTPS on the given
+// port.
+func redirectToHTTPS(port string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
+
+// hsts tells browsers to keep using HTTPS for this host.
+func hsts(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Strict-Transport-Security", "max-age=31536000")
+		h.ServeHTTP(w, r)
+	})
+}
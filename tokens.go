@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// APIToken is a personal access token, with which a user calls the JSON
+// API without going through the browser. Only a hash of the token is
+// stored; the token itself is shown once, when it is created.
+type APIToken struct {
+	// ID is the hex SHA-256 hash of the token.
+	ID     string
+	User   string
+	Name   string
+	Scopes []string
+
+	Created  time.Time
+	LastUsed time.Time
+}
+
+// Token scopes. Each grants the ones before it.
+const (
+	scopeRead  = "read"  // GET requests.
+	scopeWrite = "write" // creating, changing and deleting treats.
+	scopeAdmin = "admin" // acting as an admin, if the user is one.
+)
+
+var tokenScopes = []string{scopeRead, scopeWrite, scopeAdmin}
+
+// Has reports whether the token grants scope.
+func (tok *APIToken) Has(scope string) bool {
+	for _, s := range tok.Scopes {
+		if s == scope || s == scopeAdmin || (s == scopeWrite && scope == scopeRead) {
+			return true
+		}
+	}
+	return false
+}
+
+// TokenDatabase stores APITokens.
+type TokenDatabase interface {
+	// AddToken stores tok under tok.ID.
+	AddToken(ctx context.Context, tok *APIToken) error
+
+	// GetToken returns the token with the given ID, or nil if there is none.
+	GetToken(ctx context.Context, id string) (*APIToken, error)
+
+	// ListTokens returns the tokens of user, newest first.
+	ListTokens(ctx context.Context, user string) ([]*APIToken, error)
+
+	// TouchToken records that the token was used at the given time.
+	TouchToken(ctx context.Context, id string, at time.Time) error
+
+	// DeleteToken revokes a token of user. Tokens of other users are left
+	// alone.
+	DeleteToken(ctx context.Context, user, id string) error
+}
+
+const (
+	// tokenPrefix starts every token, so that leaked tokens are easy to
+	// spot, e.g. by secret scanners.
+	tokenPrefix = "tsk_"
+
+	// tokenTouchInterval is how stale LastUsed may get, so that busy tokens
+	// don't cost a write per request.
+	tokenTouchInterval = time.Minute
+)
+
+// newAPIToken returns a new token for user, created at the given time, and
+// its record.
+func newAPIToken(user, name string, scopes []string, now time.Time) (string, *APIToken, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", nil, err
+	}
+	token := tokenPrefix + base64.RawURLEncoding.EncodeToString(b)
+	return token, &APIToken{
+		ID:      tokenID(token),
+		User:    user,
+		Name:    name,
+		Scopes:  scopes,
+		Created: now,
+	}, nil
+}
+
+// tokenID returns the ID a token is stored under.
+func tokenID(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// tokenKey is the context key for the APIToken a request was made with.
+type tokenKey struct{}
+
+// tokenFrom returns the APIToken the request was made with, or nil.
+func tokenFrom(r *http.Request) *APIToken {
+	tok, _ := r.Context().Value(tokenKey{}).(*APIToken)
+	return tok
+}
+
+// apiTokens is mux middleware for the JSON API that authenticates requests
+// made with an "Authorization: Bearer" token and checks that the token's
+// scopes allow the request. The token's user is then the current user, see
+// currentUser. Requests without a token are left to IAP, unless
+// t.requireAPIToken is set (REQUIRE_API_TOKEN=true). Invalid tokens count
+// towards locking out the address they came from, see signins.go.
+func (t *Treatshelf) apiTokens(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") {
+			if t.requireAPIToken {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				err := errors.New("an API token is required, create one at /settings/tokens")
+				serveError(w, r, t.appErrorCodef(r, http.StatusUnauthorized, err, "%v", err))
+				return
+			}
+			h.ServeHTTP(w, r)
+			return
+		}
+		if e := t.checkSignInLock(w, r, ""); e != nil {
+			serveError(w, r, e)
+			return
+		}
+		tok, e := t.authenticateToken(r, strings.TrimPrefix(auth, "Bearer "))
+		if e != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			serveError(w, r, e)
+			return
+		}
+		scope := scopeWrite
+		if r.Method == "GET" || r.Method == "HEAD" {
+			scope = scopeRead
+		}
+		if !tok.Has(scope) {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_scope", scope=%q`, scope))
+			err := fmt.Errorf("token lacks the %s scope", scope)
+			serveError(w, r, t.appErrorCodef(r, http.StatusForbidden, err, "%v", err))
+			return
+		}
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tokenKey{}, tok)))
+	})
+}
+
+// authenticateToken looks up token and records its use.
+func (t *Treatshelf) authenticateToken(r *http.Request, token string) (*APIToken, *appError) {
+	if t.Tokens == nil {
+		err := errors.New("API tokens are not enabled")
+		return nil, t.appErrorCodef(r, http.StatusUnauthorized, err, "%v", err)
+	}
+	tok, err := t.Tokens.GetToken(r.Context(), tokenID(strings.TrimSpace(token)))
+	if err != nil {
+		return nil, t.appErrorf(r, err, "GetToken: %v", err)
+	}
+	if tok == nil {
+		t.recordSignIn(r, "", "token", "invalid or revoked token")
+		err := errors.New("invalid or revoked API token")
+		return nil, t.appErrorCodef(r, http.StatusUnauthorized, err, "%v", err)
+	}
+	if now := t.now(); now.Sub(tok.LastUsed) > tokenTouchInterval {
+		if err := t.Tokens.TouchToken(r.Context(), tok.ID, now); err != nil {
+			fmt.Fprintf(t.logWriter, "Could not record use of API token: %v\n", err)
+		}
+	}
+	return tok, nil
+}
+
+// requireTokens returns a 404 appError unless API tokens are enabled. The
+// token pages use it through guard; who may use them is in routePolicy.
+func (t *Treatshelf) requireTokens(r *http.Request) *appError {
+	if t.Tokens == nil {
+		err := errors.New("API tokens are not enabled")
+		return t.appErrorCodef(r, http.StatusNotFound, err, "%v", err)
+	}
+	return nil
+}
+
+// tokensHandler lists the signed-in user's API tokens, with a form to create
+// one.
+func (t *Treatshelf) tokensHandler(w http.ResponseWriter, r *http.Request) *appError {
+	return t.showTokens(w, r, "")
+}
+
+// showTokens renders the tokens page, showing token if one was just
+// created.
+func (t *Treatshelf) showTokens(w http.ResponseWriter, r *http.Request, token string) *appError {
+	tokens, err := t.Tokens.ListTokens(r.Context(), t.currentUser(r))
+	if err != nil {
+		return t.appErrorf(r, err, "ListTokens: %v", err)
+	}
+	return tokensTmpl.Execute(t, w, r, struct {
+		Tokens   []*APIToken
+		Scopes   []string
+		NewToken string
+	}{tokens, tokenScopes, token})
+}
+
+// createTokenHandler creates an API token and shows it, once. The page is
+// rendered rather than redirected to, so the token is never stored.
+func (t *Treatshelf) createTokenHandler(w http.ResponseWriter, r *http.Request) *appError {
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" {
+		err := errors.New("name the token after where it will be used")
+		return t.appErrorCodef(r, http.StatusBadRequest, err, "%v", err)
+	}
+	scope := r.FormValue("scope")
+	if !contains(tokenScopes, scope) {
+		err := fmt.Errorf("unknown scope %q", scope)
+		return t.appErrorCodef(r, http.StatusBadRequest, err, "%v", err)
+	}
+	if scope == scopeAdmin && !t.isAdmin(r) {
+		err := errors.New("only admins can create admin tokens")
+		return t.appErrorCodef(r, http.StatusForbidden, err, "%v", err)
+	}
+	token, tok, err := newAPIToken(t.currentUser(r), name, []string{scope}, t.now())
+	if err != nil {
+		return t.appErrorf(r, err, "could not create token: %v", err)
+	}
+	if err := t.Tokens.AddToken(r.Context(), tok); err != nil {
+		return t.appErrorf(r, err, "AddToken: %v", err)
+	}
+	return t.showTokens(w, r, token)
+}
+
+// revokeTokenHandler deletes one of the signed-in user's API tokens.
+func (t *Treatshelf) revokeTokenHandler(w http.ResponseWriter, r *http.Request) *appError {
+	if err := t.Tokens.DeleteToken(r.Context(), t.currentUser(r), mux.Vars(r)["id"]); err != nil {
+		return t.appErrorf(r, err, "DeleteToken: %v", err)
+	}
+	setFlash(w, &flash{Message: "Revoked the token."})
+	http.Redirect(w, r, t.routeURL("tokens"), http.StatusFound)
+	return nil
+}
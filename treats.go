@@ -2,12 +2,19 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"net/url"
 	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
-	"cloud.google.com/go/errorreporting"
 	"cloud.google.com/go/storage"
+	"github.com/gorilla/mux"
+	"golang.org/x/text/collate"
 )
 
 // Treat holds metadata about a treat.
@@ -17,17 +24,406 @@ type Treat struct {
 	Author        string
 	PublishedDate string
 	ImageURL      string
+	AltText       string // describes the picture; "" if it is decorative.
+	Caption       string // is shown under the picture; "" for none.
 	Description   string
+
+	// ThumbnailURL is a small copy of the picture, or "" if none was made,
+	// see thumbnail.go.
+	ThumbnailURL string
+
+	// Nutrition is nil when no nutrition facts were provided.
+	Nutrition *Nutrition
+	// Allergens lists the allergens the treat contains, see allergens.
+	Allergens []string
+	// Tags are normalized free-form labels, see normalizeTag.
+	Tags []string
+
+	// Quantity is the number of portions remaining, or nil if they aren't
+	// counted, in which case the treat is always available.
+	Quantity *int
+	// LowStockThreshold is the Quantity at or below which the treat is
+	// considered low on stock. Zero means defaultLowStockThreshold.
+	LowStockThreshold int
+
+	// Price is nil for treats that are free or not for sale.
+	Price *Price
+
+	// LocationID is the office or kitchen whose shelf the treat is on, or ""
+	// if it is not on any particular shelf.
+	LocationID string
+
+	// Place is nil when the treat has no pickup location.
+	Place *Place
+
+	// ExpiresAt is when the treat goes off, or zero if it keeps.
+	ExpiresAt time.Time
+	// Archived treats are hidden from lists but can still be viewed.
+	Archived bool
+
+	// DeletedAt is when the treat was deleted. Deleted treats can be
+	// restored with UndoToken until they are purged (see undo.go).
+	DeletedAt time.Time
+	UndoToken string `json:"-"`
+
+	// VisibleFrom and VisibleUntil bound when the treat is shown, for
+	// seasonal items. A zero time leaves that end of the window open.
+	VisibleFrom  time.Time
+	VisibleUntil time.Time
+
+	// CreatedBy is the signed-in user who added the treat, if any. It
+	// isn't shown through the API; it lets people remove their treats
+	// along with their account, see profile.go.
+	CreatedBy string `json:"-"`
+
+	// InternalNotes are for admins only, such as supplier contacts. They
+	// are encrypted at rest (see encryption.go) and not shown through the
+	// API.
+	InternalNotes string `json:"-"`
+
+	// Review is reviewPending while the treat awaits an admin's approval,
+	// or reviewRejected, with ReviewReason, if an admin turned it down. It
+	// is empty for public treats. See moderation.go.
+	Review       string
+	ReviewReason string
+
+	// Reports counts the open reports of the treat, see reports.go.
+	Reports int `json:"-"`
+}
+
+// Deleted reports whether the treat is awaiting purge.
+func (t *Treat) Deleted() bool {
+	return !t.DeletedAt.IsZero()
+}
+
+// VisibleAt reports whether now is within the treat's visibility window.
+func (t *Treat) VisibleAt(now time.Time) bool {
+	if !t.VisibleFrom.IsZero() && now.Before(t.VisibleFrom) {
+		return false
+	}
+	if !t.VisibleUntil.IsZero() && !now.Before(t.VisibleUntil) {
+		return false
+	}
+	return true
+}
+
+// ExpiredAt reports whether the treat has passed its expiry time by now.
+func (t *Treat) ExpiredAt(now time.Time) bool {
+	return !t.ExpiresAt.IsZero() && !t.ExpiresAt.After(now)
+}
+
+// validate checks the fields of a treat that was built from user input and
+// normalizes its text, tags and place. Both the edit form and the API call
+// it.
+func (t *Treat) validate() error {
+	t.Title, t.Author, t.PublishedDate = cleanLine(t.Title), cleanLine(t.Author), cleanLine(t.PublishedDate)
+	t.AltText, t.Caption, t.Description = cleanLine(t.AltText), cleanLine(t.Caption), cleanText(t.Description)
+	if len([]rune(t.AltText)) > maxAltText {
+		return fmt.Errorf("picture descriptions are at most %d characters", maxAltText)
+	}
+	if len([]rune(t.Caption)) > maxCaption {
+		return fmt.Errorf("captions are at most %d characters", maxCaption)
+	}
+	for _, s := range []string{t.ImageURL, t.ThumbnailURL} {
+		if s == "" {
+			continue
+		}
+		if u, err := url.Parse(s); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.New("image URL must be an http or https URL")
+		}
+	}
+	if (t.Quantity != nil && *t.Quantity < 0) || t.LowStockThreshold < 0 {
+		return errors.New("quantity and low stock threshold must not be negative")
+	}
+	if !t.VisibleFrom.IsZero() && !t.VisibleUntil.IsZero() && !t.VisibleUntil.After(t.VisibleFrom) {
+		return errors.New("visibility window must end after it starts")
+	}
+	for _, a := range t.Allergens {
+		if !isAllergen(a) {
+			return fmt.Errorf("unknown allergen %q", a)
+		}
+	}
+	if t.Nutrition != nil {
+		if err := t.Nutrition.validate(); err != nil {
+			return fmt.Errorf("invalid nutrition facts: %v", err)
+		}
+	}
+	if t.Price != nil {
+		if err := t.Price.validate(); err != nil {
+			return fmt.Errorf("invalid price: %v", err)
+		}
+	}
+	if t.Place != nil {
+		if err := t.Place.normalize(); err != nil {
+			return err
+		}
+	}
+	t.Tags = parseTags(strings.Join(t.Tags, ","))
+	return nil
+}
+
+// maxAltText bounds the length of Treat.AltText, in characters. Screen
+// readers read it in one go, so it should be short.
+const maxAltText = 250
+
+// maxCaption bounds the length of Treat.Caption, in characters.
+const maxCaption = 300
+
+// allergens are the allergens a treat can be marked as containing.
+var allergens = []string{"dairy", "eggs", "gluten", "nuts", "peanuts", "sesame", "soy"}
+
+// isAllergen reports whether a is one of the known allergens.
+func isAllergen(a string) bool {
+	for _, b := range allergens {
+		if a == b {
+			return true
+		}
+	}
+	return false
+}
+
+// Contains reports whether the treat contains the given allergen.
+func (t *Treat) Contains(allergen string) bool {
+	for _, a := range t.Allergens {
+		if a == allergen {
+			return true
+		}
+	}
+	return false
+}
+
+// HasTag reports whether the treat carries the given tag.
+func (t *Treat) HasTag(tag string) bool {
+	for _, tt := range t.Tags {
+		if tt == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultLowStockThreshold applies to treats without their own threshold.
+const defaultLowStockThreshold = 3
+
+// Available reports whether any portions of the treat remain, or they
+// aren't counted.
+func (t *Treat) Available() bool {
+	return t.Quantity == nil || *t.Quantity > 0
+}
+
+// LowStock reports whether the treat is available but running low.
+func (t *Treat) LowStock() bool {
+	threshold := t.LowStockThreshold
+	if threshold <= 0 {
+		threshold = defaultLowStockThreshold
+	}
+	return t.Quantity != nil && *t.Quantity > 0 && *t.Quantity <= threshold
+}
+
+// takePortions takes n portions of the treat, or returns -n of them if n
+// is negative, failing with errNotEnoughPortions rather than going below
+// zero. Treats whose portions aren't counted are left alone.
+func (t *Treat) takePortions(n int) error {
+	if t.Quantity == nil {
+		return nil
+	}
+	if *t.Quantity < n {
+		return errNotEnoughPortions
+	}
+	*t.Quantity -= n
+	return nil
+}
+
+// Sort orders accepted by ListOptions.
+const (
+	sortByTitle     = "title"
+	sortByPrice     = "price"
+	sortByPriceDesc = "-price"
+)
+
+// ListOptions narrows and orders the treats returned by ListTreats.
+type ListOptions struct {
+	// Available restricts the list to treats with portions remaining.
+	Available bool
+
+	// IncludeExpired includes treats past their expiry time.
+	IncludeExpired bool
+
+	// IncludeArchived includes archived treats.
+	IncludeArchived bool
+
+	// LocationID restricts the list to a single location's shelf.
+	LocationID string
+
+	// Tag restricts the list to treats with the given tag.
+	Tag string
+
+	// ExcludeAllergens leaves out treats containing any of these allergens.
+	ExcludeAllergens []string
+
+	// IncludeHidden includes treats outside their visibility window, so
+	// admins can preview seasonal items.
+	IncludeHidden bool
+
+	// IncludeUnreviewed includes treats awaiting review or rejected, see
+	// moderation.go, and PendingReview restricts the list to treats
+	// awaiting review.
+	IncludeUnreviewed bool
+	PendingReview     bool
+
+	// Reported restricts the list to treats with open reports.
+	Reported bool
+
+	// Query restricts the list to treats matching every word of it, see
+	// search.go, allowing words up to Fuzziness edits from the treat's.
+	// Matching treats are listed best match first, then by Sort.
+	Query     string
+	Fuzziness int
+
+	// Currency, MinPrice and MaxPrice restrict the list to treats priced in
+	// Currency within the given range of minor units. A zero MaxPrice means
+	// no upper bound.
+	Currency string
+	MinPrice int64
+	MaxPrice int64
+
+	// Near and RadiusKm restrict the list to treats whose Place is within
+	// RadiusKm of Near.
+	Near     *LatLng
+	RadiusKm float64
+
+	// Sort is one of sortByTitle (the default), sortByPrice or
+	// sortByPriceDesc. Treats without a price sort last.
+	Sort string
+
+	// Collation is the BCP 47 locale whose collation orders titles, see
+	// text.go. "" uses the root collation.
+	Collation string
+
+	// Consistency allows the list to be read from a replica, see
+	// consistency.go.
+	Consistency Consistency
+}
+
+// matches reports whether t should be included in a list built with o at
+// the given time.
+func (o ListOptions) matches(t *Treat, now time.Time) bool {
+	if t.Deleted() {
+		return false
+	}
+	if o.Available && !t.Available() {
+		return false
+	}
+	if (!o.IncludeArchived && t.Archived) || (!o.IncludeExpired && t.ExpiredAt(now)) {
+		return false
+	}
+	if !o.IncludeHidden && !t.VisibleAt(now) {
+		return false
+	}
+	if (!o.IncludeUnreviewed && t.UnderReview()) || (o.PendingReview && t.Review != reviewPending) {
+		return false
+	}
+	if o.Reported && t.Reports == 0 {
+		return false
+	}
+	if o.LocationID != "" && t.LocationID != o.LocationID {
+		return false
+	}
+	if o.Tag != "" && !t.HasTag(o.Tag) {
+		return false
+	}
+	if o.Query != "" {
+		if _, ok := searchRank(t, searchTerms(o.Query), o.Fuzziness); !ok {
+			return false
+		}
+	}
+	for _, a := range o.ExcludeAllergens {
+		if t.Contains(a) {
+			return false
+		}
+	}
+	if o.Near != nil {
+		if t.Place == nil || !t.Place.HasCoordinates() {
+			return false
+		}
+		if distanceKm(*o.Near, LatLng{t.Place.Lat, t.Place.Lng}) > o.RadiusKm {
+			return false
+		}
+	}
+	if o.Currency != "" {
+		if t.Price == nil || t.Price.Currency != o.Currency {
+			return false
+		}
+		if t.Price.Amount < o.MinPrice || (o.MaxPrice > 0 && t.Price.Amount > o.MaxPrice) {
+			return false
+		}
+	}
+	return true
+}
+
+// sortTreats orders treats as requested by o.
+func (o ListOptions) sortTreats(treats []*Treat) {
+	withCollator(o.Collation, func(c *collate.Collator) {
+		o.sortWith(c, treats)
+	})
+}
+
+// sortWith orders treats as requested by o, comparing titles with c.
+func (o ListOptions) sortWith(c *collate.Collator, treats []*Treat) {
+	byTitle := func(i, j int) bool {
+		if n := c.CompareString(treats[i].Title, treats[j].Title); n != 0 {
+			return n < 0
+		}
+		return treats[i].Title < treats[j].Title
+	}
+	switch o.Sort {
+	case sortByPrice, sortByPriceDesc:
+		desc := o.Sort == sortByPriceDesc
+		sort.SliceStable(treats, func(i, j int) bool {
+			pi, pj := treats[i].Price, treats[j].Price
+			switch {
+			case pi == nil || pj == nil:
+				return pi != nil && pj == nil
+			case pi.Currency != pj.Currency:
+				return pi.Currency < pj.Currency
+			case pi.Amount != pj.Amount:
+				return (pi.Amount < pj.Amount) != desc
+			}
+			return byTitle(i, j)
+		})
+	default:
+		sort.SliceStable(treats, byTitle)
+	}
+	if terms := searchTerms(o.Query); len(terms) > 0 {
+		ranks := make(map[*Treat]int, len(treats))
+		for _, t := range treats {
+			ranks[t], _ = searchRank(t, terms, o.Fuzziness)
+		}
+		sort.SliceStable(treats, func(i, j int) bool {
+			return ranks[treats[i]] < ranks[treats[j]]
+		})
+	}
 }
 
 // TreatDatabase provides thread-safe access to a database of treats.
 type TreatDatabase interface {
-	// ListTreats returns a list of Treats, ordered by title.
-	ListTreats(context.Context) ([]*Treat, error)
+	// ListTreats returns a list of Treats matching opts, ordered by
+	// opts.Sort.
+	ListTreats(ctx context.Context, opts ListOptions) ([]*Treat, error)
+
+	// EachTreat calls fn with each Treat matching opts, ordered by title
+	// (by code point rather than collated on Firestore), without holding
+	// them all in memory. It stops at the first error fn
+	// returns and returns it.
+	EachTreat(ctx context.Context, opts ListOptions, fn func(*Treat) error) error
 
 	// GetTreat retrieves a Treat by its ID.
 	GetTreat(ctx context.Context, id string) (*Treat, error)
 
+	// GetTreats retrieves the Treats with the given IDs in one call. The
+	// result is in the order of ids, with nil for IDs that don't exist.
+	GetTreats(ctx context.Context, ids []string) ([]*Treat, error)
+
 	// AddTreat saves a given Treat, assigning it a new ID.
 	AddTreat(ctx context.Context, t *Treat) (id string, err error)
 
@@ -36,15 +432,211 @@ type TreatDatabase interface {
 
 	// UpdateTreat updates the entry for a given Treat.
 	UpdateTreat(ctx context.Context, t *Treat) error
+
+	// SaveTreats adds the given Treats that have no ID, assigning them new
+	// IDs, and replaces the others, all at once or not at all. At most
+	// maxBatchWrites Treats can be saved at once.
+	SaveTreats(ctx context.Context, treats []*Treat) error
+
+	// UpdateTreatFields sets the given fields of the stored Treat with ID
+	// t.ID to their values in t, leaving its other fields alone. It fails
+	// if there is no such Treat.
+	UpdateTreatFields(ctx context.Context, t *Treat, fields []string) error
+
+	// AdjustQuantity atomically adds delta to the Quantity of a given Treat
+	// and returns the updated Treat. It returns errNotEnoughPortions if the
+	// Quantity would go below zero. Treats whose portions aren't counted
+	// are left alone, see takePortions.
+	AdjustQuantity(ctx context.Context, id string, delta int) (*Treat, error)
+
+	// ChangeTreat atomically reads a given Treat, lets change modify it,
+	// and writes the fields change returns, or the whole Treat if it
+	// returns none, returning the result. Nothing is written if change
+	// returns an error, which ChangeTreat returns as it is. change may be
+	// called more than once, so it must not have side effects.
+	ChangeTreat(ctx context.Context, id string, change func(t *Treat) (fields []string, err error)) (*Treat, error)
+
+	// ListClaims returns the claims on a given Treat, oldest first.
+	ListClaims(ctx context.Context, treatID string) ([]*Claim, error)
+
+	// ClaimTreat atomically takes c.Portions from a given Treat's Quantity
+	// and records the claim, assigning it a new ID. It returns
+	// errNotEnoughPortions if too few portions remain.
+	ClaimTreat(ctx context.Context, treatID string, c *Claim) (id string, err error)
+
+	// ReleaseClaim atomically removes a claim and returns its portions to
+	// the Treat.
+	ReleaseClaim(ctx context.Context, treatID, claimID string) error
+
+	// AnonymizeClaims replaces the name on every claim user made with
+	// name, and forgets who made them, returning how many it changed.
+	AnonymizeClaims(ctx context.Context, user, name string) (int, error)
+
+	// ArchiveExpired archives all Treats that expired before now and
+	// returns how many were archived.
+	ArchiveExpired(ctx context.Context, now time.Time) (int, error)
+
+	// ReplaceTags replaces every tag in from with to across all Treats, or
+	// removes them if to is empty, and returns how many Treats changed.
+	// Progress is reported as Treats are written, if progress is not nil.
+	ReplaceTags(ctx context.Context, from []string, to string, progress func(done, total int)) (int, error)
+
+	// SoftDeleteTreats marks the given Treats deleted at the given time,
+	// recording token so that RestoreTreats can bring them back.
+	SoftDeleteTreats(ctx context.Context, ids []string, token string, at time.Time) error
+
+	// RestoreTreats restores the Treats soft-deleted with token after the
+	// given time and returns how many were restored. Treats deleted earlier
+	// are left for PurgeDeletedTreats.
+	RestoreTreats(ctx context.Context, token string, after time.Time) (int, error)
+
+	// ListDeletedTreats returns the Treats soft-deleted before the given
+	// time, which PurgeDeletedTreats would remove.
+	ListDeletedTreats(ctx context.Context, before time.Time) ([]*Treat, error)
+
+	// PurgeDeletedTreats permanently removes Treats soft-deleted before the
+	// given time and returns how many were removed.
+	PurgeDeletedTreats(ctx context.Context, before time.Time) (int, error)
 }
 
 // Treatshelf holds a TreatDatabase and storage info.
 type Treatshelf struct {
 	DB TreatDatabase
 
+	projectID string
+
+	// instance names this instance and its region in logs and locks, see
+	// instanceName.
+	instance string
+
+	// Locations stores the offices and kitchens treats are shelved at.
+	Locations LocationDatabase
+
+	// Preferences stores per-user display settings.
+	Preferences PreferencesDatabase
+
+	// Idempotency stores API writes made with an Idempotency-Key header.
+	Idempotency IdempotencyDatabase
+
+	// Tokens stores personal API tokens, see tokens.go. Only IAP
+	// authenticates API requests if it is nil.
+	Tokens TokenDatabase
+
+	// Profiles stores display names and avatars, see profile.go.
+	Profiles ProfileDatabase
+
+	// Reports stores reports of treats, see reports.go. Treats can't be
+	// reported if it is nil. reportHideAt open reports hold a treat for
+	// review (REPORT_HIDE_THRESHOLD).
+	Reports      ReportDatabase
+	reportHideAt int
+
+	// SavedSearches stores smart shelves, see shelves.go. Shelves can't be
+	// saved if it is nil.
+	SavedSearches SavedSearchDatabase
+
+	// Uploads indexes stored pictures by hash, see dedup.go. Identical
+	// uploads are stored again if it is nil.
+	Uploads UploadDatabase
+
+	// Operations stores imports, re-indexing and backups run in the
+	// background, see operations.go. They can't be started if it is nil.
+	Operations OperationDatabase
+
+	// Stats computes the statistics admins see, see stats.go. There are
+	// none if it is nil.
+	Stats StatsDatabase
+
+	// Deliveries records inbound webhook requests, and webhookSecrets
+	// holds the secret of each source (WEBHOOK_SECRETS), see webhooks.go.
+	// Webhooks are refused unless both are set.
+	Deliveries     DeliveryDatabase
+	webhookSecrets map[string]string
+
+	// SheetSync stores the linked Google Sheet, which sheets reads and
+	// writes, see sheets.go. Sheets aren't synced unless both are set.
+	SheetSync SheetSyncStore
+	sheets    SheetsClient
+
+	// inboxBucket is the bucket whose inbox/ folder creates treats, and
+	// inboxPushToken authenticates its notifications (INBOX_BUCKET and
+	// INBOX_PUSH_TOKEN), see inbox.go. The inbox is off unless both are set.
+	inboxBucket    string
+	inboxPushToken string
+
+	// emailInToken authenticates mail posted by SendGrid Inbound Parse
+	// (EMAIL_IN_TOKEN), see email.go. Mail is refused if it is "".
+	emailInToken string
+
+	// slackSigningSecret verifies requests from the Slack app
+	// (SLACK_SIGNING_SECRET), see slack.go. The /treat command is off if it
+	// is "".
+	slackSigningSecret string
+
+	// SignIns records sign-in attempts and counts failures, see
+	// signins.go. Nothing is recorded or locked if it is nil.
+	SignIns SignInDatabase
+
+	// requireAPIToken rejects API requests made without a token
+	// (REQUIRE_API_TOKEN=true).
+	requireAPIToken bool
+
+	// optionalIfMatch lets API writes of a treat omit the If-Match header
+	// (REQUIRE_IF_MATCH=false), see conditional.go.
+	optionalIfMatch bool
+
+	// apiSunset is when deprecated API versions stop being served
+	// (API_SUNSET), or zero if that isn't planned yet, see apiversion.go.
+	apiSunset time.Time
+
+	// Outbox stores notifications written along with treat changes, see
+	// outbox.go. They are not sent if it is nil.
+	Outbox OutboxDatabase
+
+	// dual is set while migrating to another treats collection, and
+	// configured through dualConfig, see dualwrite.go.
+	dual       *dualDB
+	dualConfig DualConfigStore
+
+	// faults is set if FAULT_INJECTION is, see faults.go.
+	faults *faultInjectingDB
+
+	// encrypted is set if sensitive fields are encrypted, see
+	// encryption.go. Cold storage files keep them encrypted with it.
+	encrypted *encryptedDB
+
+	// testHooks enables the routes end-to-end tests use, see testhooks.go.
+	testHooks bool
+
+	// Locks keeps cron tasks to one region, see region.go. Every instance
+	// runs them if it is nil.
+	Locks LockDatabase
+
+	// StorageBucket holds uploaded treat pictures.
 	StorageBucket     *storage.BucketHandle
 	StorageBucketName string
 
+	// ThumbnailBucket and BackupBucket hold resized pictures and backups.
+	// They are the same as StorageBucket unless configured, see Buckets.
+	ThumbnailBucket     *storage.BucketHandle
+	ThumbnailBucketName string
+	BackupBucket        *storage.BucketHandle
+	BackupBucketName    string
+
+	// storageClient is made by connectStorage, and errorClient below by
+	// connectErrors, each once (see lazy.go), or again by health.go after
+	// failing. Both funcs are nil in tests, which set the clients they
+	// need.
+	storageClient  *storage.Client
+	storageInit    lazyInit
+	connectStorage func(context.Context) (*storage.Client, error)
+	errorsInit     lazyInit
+	connectErrors  func(context.Context) (ErrorReporter, error)
+
+	// buckets is the bucket configuration, kept to apply once storage
+	// recovers from degraded mode.
+	buckets Buckets
+
 	// logWriter is used for request logging and can be overridden for tests.
 	//
 	// See https://cloud.google.com/logging/docs/setup/go for how to use the
@@ -52,40 +644,196 @@ type Treatshelf struct {
 	// sent to Cloud Logging when running on App Engine.
 	logWriter io.Writer
 
-	errorClient *errorreporting.Client
-}
+	// accessLog configures request logging, see accesslog.go.
+	accessLog AccessLog
+
+	// routes is the router built by Handler, for routeURL.
+	routes *mux.Router
+
+	// canonicalHostName is the host pages are served from, other hosts
+	// redirect to it (CANONICAL_HOST). See canonical.go.
+	canonicalHostName string
+
+	// basePath is the path the app is served under, e.g. "/shelf", or ""
+	// at the root (BASE_PATH). See Handler.
+	basePath string
+
+	// middleware wraps every request, see Use. requestTimeout, if set,
+	// bounds how long handlers may take.
+	middleware     []Middleware
+	requestTimeout time.Duration
+
+	// errorClient is nil while Error Reporting is degraded, see
+	// reporting.go.
+	errorClient ErrorReporter
+
+	// mu guards the storage and Error Reporting clients and buckets, which
+	// may be created in the background when running degraded.
+	mu sync.RWMutex
+	// degraded maps unavailable components to the reason, see health.go.
+	degraded map[string]error
+	// recovering is set while recoverDegraded is running.
+	recovering bool
+
+	// notifier receives alerts such as a treat running out.
+	notifier Notifier
+	// outboxKick wakes runOutbox.
+	outboxKick chan struct{}
+
+	// requests counts the outcomes of recent requests, and alerts are the
+	// thresholds they are checked against, see alerts.go. alerted holds
+	// when each kind of alert was last sent; only runAlerts uses it.
+	// Requests aren't counted if requests is nil.
+	requests *requestWindow
+	alerts   alertConfig
+	alerted  map[string]time.Time
+
+	// slos measures the service level objectives (SLOS), and sloBanner
+	// shows a banner while one's error budget is exhausted, see slo.go.
+	// There are none if slos is nil.
+	slos      *sloTracker
+	sloBanner bool
+
+	// admins is the set of administrator email addresses, see auth.go.
+	admins map[string]bool
+
+	// iapAudience is the expected audience of IAP's signed assertions, and
+	// trustIAPHeader allows the unsigned email header instead, see
+	// currentUser.
+	iapAudience    string
+	trustIAPHeader bool
+
+	// authProviders are what people can sign in with besides IAP
+	// (AUTH_PROVIDERS), see oidc.go.
+	authProviders []*AuthProvider
+
+	// keyring signs cookies, and keyringConfig shares when to re-issue
+	// them, see keyring.go. Re-issuing applies to this instance only if
+	// keyringConfig is nil.
+	keyring       *Keyring
+	keyringConfig KeyringConfigStore
+
+	// clock tells the time, see clock.go. The system clock is used if it
+	// is nil.
+	clock Clock
+
+	// ids names uploaded pictures, see ids.go. They are named by random
+	// UUIDs if it is nil.
+	ids IDGenerator
+
+	// undoWindow is how long deleted treats can be restored for.
+	undoWindow time.Duration
+
+	// coldAfter is how long after expiring archived treats are moved to
+	// cold storage, see coldstorage.go.
+	coldAfter time.Duration
+
+	// changes fans out changes to treats seen by a ChangeWatcher, see
+	// changes.go.
+	changes *changeHub
 
-// NewTreatshelf creates a new Treatshelf.
-func NewTreatshelf(projectID string, db TreatDatabase) (*Treatshelf, error) {
-	ctx := context.Background()
+	// renders caches rendered pages, see template.go. Pages are rendered
+	// every time if it is nil.
+	renders *renderCache
 
-	// This Cloud Storage bucket must exist to be able to upload treat pictures.
-	// You can create it and make it public by running:
-	//     gsutil mb my-project_bucket
-	//     gsutil defacl set public-read gs://my-project_bucket
-	// replacing my-project with your project ID.
-	bucketName := projectID + "_bucket"
-	storageClient, err := storage.NewClient(ctx)
-	if err != nil {
-		return nil, fmt.Errorf("storage.NewClient: %v", err)
+	// images processes pictures, see imagepool.go. Any number are
+	// processed at once if it is nil.
+	images *imagePool
+
+	// imagePresets are the sizes pictures are shown at, see presets.go,
+	// or defaultImagePresets if it is nil.
+	imagePresets map[string]imagePreset
+
+	// assetManifest names the static files by their contents, see
+	// assets.go.
+	assetManifest assetManifest
+
+	// scanner scans uploads for malware, see scan.go. Uploads aren't
+	// scanned if it is nil.
+	scanner MalwareScanner
+
+	// exporting holds the users whose export archive is being assembled
+	// on this instance, see userexport.go. exportsMu guards it.
+	exportsMu sync.Mutex
+	exporting map[string]bool
+
+	// statsCache keeps the statistics last computed, see stats.go.
+	statsCache statsCache
+
+	// secrets resolves configuration values naming secrets, see
+	// secrets.go.
+	secrets *secretCache
+
+	// moderation holds treats added or changed by anyone but an admin for
+	// review (MODERATION=true), see moderation.go.
+	moderation bool
+
+	// searchFuzziness is the most edits a search word may be from the
+	// word it matches (SEARCH_FUZZINESS), see search.go.
+	searchFuzziness int
+
+	// a11yAudit checks rendered pages for accessibility problems and logs
+	// them (A11Y_AUDIT=true), see a11y.go. It is meant for development.
+	a11yAudit bool
+
+	// requireAltText refuses pictures uploaded without a description
+	// (REQUIRE_ALT_TEXT=true), see alttext.go.
+	requireAltText bool
+
+	// collation is the locale titles are collated by when readers haven't
+	// chosen one (COLLATION_LOCALE), see text.go.
+	collation string
+
+	// captcha, if set, challenges anonymous visitors adding treats
+	// (CAPTCHA_PROVIDER), see captcha.go.
+	captcha CaptchaVerifier
+
+	// geocoder locates treat addresses. It is nil if geocoding is disabled.
+	geocoder Geocoder
+}
+
+// NewTreatshelf creates a new Treatshelf. It waits for Cloud Storage to
+// connect until ctx is done at most, and connects to Error Reporting on
+// first use.
+func NewTreatshelf(ctx context.Context, projectID string, db TreatDatabase) (*Treatshelf, error) {
+	t := &Treatshelf{
+		projectID:       projectID,
+		instance:        instanceName(),
+		logWriter:       os.Stderr,
+		accessLog:       defaultAccessLog,
+		notifier:        &logNotifier{w: os.Stderr},
+		admins:          make(map[string]bool),
+		undoWindow:      defaultUndoWindow,
+		reportHideAt:    defaultReportHideAt,
+		searchFuzziness: defaultSearchFuzziness,
+		coldAfter:       defaultColdAfter,
+		changes:         newChangeHub(),
+		images:          newImagePool(defaultImageWorkers, defaultImageMemory),
+		outboxKick:      make(chan struct{}, 1),
+		keyring:         randomKeyring(),
+		clock:           systemClock{},
+		DB:              db,
 	}
+	t.renders = newRenderCache(t.clock)
 
-	errorClient, err := errorreporting.NewClient(ctx, projectID, errorreporting.Config{
-		ServiceName: "Treatshelf",
-		OnError: func(err error) {
-			fmt.Fprintf(os.Stderr, "Could not log error: %v", err)
-		},
-	})
-	if err != nil {
-		return nil, fmt.Errorf("errorreporting.NewClient: %v", err)
+	t.connectStorage = func(ctx context.Context) (*storage.Client, error) {
+		return storage.NewClient(ctx)
+	}
+	t.connectErrors = func(ctx context.Context) (ErrorReporter, error) {
+		return newErrorReporter(ctx, projectID, t.clock)
 	}
 
-	t := &Treatshelf{
-		logWriter:         os.Stderr,
-		errorClient:       errorClient,
-		DB:                db,
-		StorageBucketName: bucketName,
-		StorageBucket:     storageClient.Bucket(bucketName),
+	// Rendered pages may show any treat, so drop them all on any change.
+	t.changes.Subscribe(func(TreatChange) { t.renders.clear() })
+
+	// The buckets must exist to be able to upload treat pictures. Run once
+	// with BOOTSTRAP=true to create them, see checkBuckets.
+	t.setBuckets(Buckets{Originals: projectID + "_bucket"})
+
+	// Start without storage rather than failing if it is unavailable, or
+	// slow to connect, and keep trying in the background (see health.go).
+	if err := t.storageReady(ctx); err != nil {
+		t.degrade(componentStorage, err)
 	}
 	return t, nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gofrs/uuid"
+)
+
+// defaultUndoWindow is how long deleted treats can be restored for.
+const defaultUndoWindow = 30 * time.Second
+
+// softDelete marks the given treats deleted and schedules them to be purged
+// once the undo window has passed. It returns the token that restores them.
+func (t *Treatshelf) softDelete(ctx context.Context, ids []string) (token string, err error) {
+	token = newUndoToken()
+	if err := t.DB.SoftDeleteTreats(ctx, ids, token, t.now()); err != nil {
+		return "", err
+	}
+	t.schedulePurge()
+	return token, nil
+}
+
+// newUndoToken returns a token that restores the treats soft-deleted with
+// it. Tokens are random, so they can't be guessed.
+func newUndoToken() string {
+	return uuid.Must(uuid.NewV4()).String()
+}
+
+// schedulePurge purges soft-deleted treats from this instance once the
+// undo window closes. If the instance goes away first, the purge-deleted
+// cron task (see cron.yaml) catches up.
+func (t *Treatshelf) schedulePurge() {
+	go func() {
+		<-t.after(t.undoWindow)
+		ctx := context.Background()
+		if _, err := t.purgeDeleted(ctx); err != nil {
+			t.retryTask(ctx, "purge-deleted", err)
+		}
+	}()
+}
+
+// purgeDeleted moves treats whose undo window has passed to cold storage
+// (see coldstorage.go). They stay soft-deleted, and out of lists, while
+// cold storage is unavailable.
+func (t *Treatshelf) purgeDeleted(ctx context.Context) (int, error) {
+	before := t.now().Add(-t.undoWindow)
+	treats, err := t.DB.ListDeletedTreats(ctx, before)
+	if err == nil && len(treats) > 0 {
+		_, err = t.writeCold(ctx, "deleted", treats)
+	}
+	n := 0
+	if err == nil && len(treats) > 0 {
+		n, err = t.DB.PurgeDeletedTreats(ctx, before)
+	}
+	if err != nil {
+		fmt.Fprintf(t.logWriter, "Could not purge deleted treats: %v\n", err)
+	}
+	return n, err
+}
+
+// deleteHandler deletes a given treat, leaving a short window to undo it.
+func (t *Treatshelf) deleteHandler(w http.ResponseWriter, r *http.Request) *appError {
+	treat, err := t.treatFromRequest(r)
+	if err != nil {
+		return t.appErrorf(r, err, "%v", err)
+	}
+	token, err := t.softDelete(r.Context(), []string{treat.ID})
+	if err != nil {
+		return t.appErrorf(r, err, "DeleteTreat: %v", err)
+	}
+	setFlash(w, &flash{
+		Message:   fmt.Sprintf("Deleted %q.", treat.Title),
+		UndoToken: token,
+	})
+	http.Redirect(w, r, t.routeURL("treats"), http.StatusFound)
+	return nil
+}
+
+// batchDeleteHandler deletes the treats selected on the list page, leaving a
+// short window to undo it. Treats r may not change, see mayChange, are
+// left alone.
+func (t *Treatshelf) batchDeleteHandler(w http.ResponseWriter, r *http.Request) *appError {
+	r.ParseMultipartForm(32 << 20)
+	ids := r.Form["id"]
+	if len(ids) == 0 {
+		err := errors.New("no treats selected")
+		return t.appErrorCodef(r, http.StatusBadRequest, err, "%v", err)
+	}
+
+	// Skip treats that have gone since the list was shown.
+	treats, err := t.loader(r.Context()).Load(r.Context(), ids)
+	if err != nil {
+		return t.appErrorf(r, err, "GetTreats: %v", err)
+	}
+	ids = ids[:0]
+	found := 0
+	for _, treat := range treats {
+		if treat == nil || treat.Deleted() {
+			continue
+		}
+		found++
+		if t.mayChange(r, treat) {
+			ids = append(ids, treat.ID)
+		}
+	}
+	if found == 0 {
+		err := errors.New("the selected treats no longer exist")
+		return t.appErrorCodef(r, http.StatusBadRequest, err, "%v", err)
+	}
+	if len(ids) == 0 {
+		err := errors.New("only the person who added these treats, or an admin, can delete them")
+		return t.appErrorCodef(r, http.StatusForbidden, err, "%v", err)
+	}
+
+	token, err := t.softDelete(r.Context(), ids)
+	if err != nil {
+		return t.appErrorf(r, err, "SoftDeleteTreats: %v", err)
+	}
+	setFlash(w, &flash{
+		Message:   fmt.Sprintf("Deleted %d treats.", len(ids)),
+		UndoToken: token,
+	})
+	http.Redirect(w, r, t.routeURL("treats"), http.StatusFound)
+	return nil
+}
+
+// undoHandler restores the treats deleted under the posted undo token.
+func (t *Treatshelf) undoHandler(w http.ResponseWriter, r *http.Request) *appError {
+	n, err := t.DB.RestoreTreats(r.Context(), r.FormValue("token"), t.now().Add(-t.undoWindow))
+	if err != nil {
+		return t.appErrorf(r, err, "RestoreTreats: %v", err)
+	}
+	msg := fmt.Sprintf("Restored %d treats.", n)
+	if n == 0 {
+		msg = "Too late to undo, the treats are gone for good."
+	}
+	setFlash(w, &flash{Message: msg})
+	http.Redirect(w, r, t.routeURL("treats"), http.StatusFound)
+	return nil
+}
+
+// purgeDeletedHandler purges treats whose undo window has passed. It is run
+// by App Engine cron in case an instance stopped before purging.
+func (t *Treatshelf) purgeDeletedHandler(w http.ResponseWriter, r *http.Request) *appError {
+	n, err := t.purgeDeleted(r.Context())
+	if err != nil {
+		return t.appErrorf(r, err, "PurgeDeletedTreats: %v", err)
+	}
+	fmt.Fprintf(w, "Purged %d deleted treats\n", n)
+	return nil
+}
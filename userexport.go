@@ -0,0 +1,307 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/gorilla/mux"
+	"google.golang.org/api/iterator"
+)
+
+// People can download everything the app holds about them from
+// /settings/export. The archive is assembled in the background, since
+// copying their uploads may take a while, into a zip file in the backup
+// bucket, which the page links to once it is ready.
+
+const (
+	// exportPrefix is the folder of the backup bucket holding user exports,
+	// one folder per user, see exportFolder.
+	exportPrefix = "exports/"
+
+	// exportKeep is how long export archives are kept for. Older ones are
+	// deleted when the user next visits the export page.
+	exportKeep = 7 * 24 * time.Hour
+
+	// exportTimeout bounds how long assembling an archive may take.
+	exportTimeout = 10 * time.Minute
+)
+
+// exportFolder returns the folder holding the exports of user. It is named
+// by a hash of the user, so that object names don't hold email addresses.
+func exportFolder(user string) string {
+	sum := sha256.Sum256([]byte(user))
+	return exportPrefix + hex.EncodeToString(sum[:16]) + "/"
+}
+
+// userExport describes an export archive on the export page.
+type userExport struct {
+	Name    string
+	Size    int64
+	Created time.Time
+}
+
+// userExports lists the export archives of user, newest first, deleting
+// those older than exportKeep.
+func (t *Treatshelf) userExports(ctx context.Context, bucket *storage.BucketHandle, user string) ([]userExport, error) {
+	folder := exportFolder(user)
+	var exports []userExport
+	it := bucket.Objects(ctx, &storage.Query{Prefix: folder})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not list exports: %v", err)
+		}
+		if t.now().Sub(attrs.Created) > exportKeep {
+			if err := bucket.Object(attrs.Name).Delete(ctx); err != nil {
+				fmt.Fprintf(t.logWriter, "Could not delete old export %s: %v\n", attrs.Name, err)
+			}
+			continue
+		}
+		exports = append(exports, userExport{
+			Name:    strings.TrimPrefix(attrs.Name, folder),
+			Size:    attrs.Size,
+			Created: attrs.Created,
+		})
+	}
+	// Names start with the time they were written.
+	for i, j := 0, len(exports)-1; i < j; i, j = i+1, j-1 {
+		exports[i], exports[j] = exports[j], exports[i]
+	}
+	return exports, nil
+}
+
+// exportPageHandler lists the signed-in user's export archives, with a form
+// to start a new one.
+func (t *Treatshelf) exportPageHandler(w http.ResponseWriter, r *http.Request) *appError {
+	bucket, err := t.backupBucket()
+	if err != nil {
+		return t.appErrorCodef(r, http.StatusServiceUnavailable, err, "exports are unavailable: %v", err)
+	}
+	user := t.currentUser(r)
+	exports, err := t.userExports(r.Context(), bucket, user)
+	if err != nil {
+		return t.appErrorf(r, err, "%v", err)
+	}
+	return userExportTmpl.Execute(t, w, r, struct {
+		Exports    []userExport
+		InProgress bool
+		KeepDays   int
+	}{exports, t.exportRunning(user), int(exportKeep.Hours() / 24)})
+}
+
+// exportRunning reports whether an export of user is being assembled on this
+// instance.
+func (t *Treatshelf) exportRunning(user string) bool {
+	t.exportsMu.Lock()
+	defer t.exportsMu.Unlock()
+	return t.exporting[user]
+}
+
+// startExportHandler starts assembling an export archive of the signed-in
+// user in the background.
+func (t *Treatshelf) startExportHandler(w http.ResponseWriter, r *http.Request) *appError {
+	bucket, err := t.backupBucket()
+	if err != nil {
+		return t.appErrorCodef(r, http.StatusServiceUnavailable, err, "exports are unavailable: %v", err)
+	}
+	user := t.currentUser(r)
+	p, err := t.profile(r)
+	if err != nil {
+		return t.appErrorf(r, err, "GetProfile: %v", err)
+	}
+	prefs := t.preferences(r)
+
+	t.exportsMu.Lock()
+	if t.exporting == nil {
+		t.exporting = make(map[string]bool)
+	}
+	running := t.exporting[user]
+	t.exporting[user] = true
+	t.exportsMu.Unlock()
+
+	if !running {
+		go func() {
+			defer func() {
+				t.exportsMu.Lock()
+				delete(t.exporting, user)
+				t.exportsMu.Unlock()
+			}()
+			ctx, cancel := context.WithTimeout(context.Background(), exportTimeout)
+			defer cancel()
+			if name, err := t.writeUserExport(ctx, bucket, user, p, prefs); err != nil {
+				fmt.Fprintf(t.logWriter, "Could not export %s: %v\n", name, err)
+			}
+		}()
+	}
+	setFlash(w, &flash{Message: "Preparing your export. Reload this page in a minute to download it."})
+	http.Redirect(w, r, t.routeURL("userExport"), http.StatusFound)
+	return nil
+}
+
+// writeUserExport writes a zip archive of everything held about user to the
+// backup bucket and returns its object name. It holds:
+//
+//	profile.json, preferences.json  their account settings
+//	tokens.json                     their API tokens, without the tokens
+//	shelves.json                    their smart shelves
+//	signins.json                    their recent sign-ins
+//	treats.jsonl                    the treats they added
+//	uploads/                        their avatar and treat pictures
+func (t *Treatshelf) writeUserExport(ctx context.Context, bucket *storage.BucketHandle, user string, p *Profile, prefs *Preferences) (string, error) {
+	name := exportFolder(user) + t.now().UTC().Format("20060102T150405Z") + ".zip"
+	// Canceling the context abandons the upload rather than leave half an
+	// archive.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	w := privateWriter(ctx, bucket.Object(name))
+	w.ContentType = "application/zip"
+	zw := zip.NewWriter(w)
+
+	err := t.writeUserArchive(ctx, zw, user, p, prefs)
+	if err == nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		cancel()
+		w.Close()
+		return name, err
+	}
+	return name, w.Close()
+}
+
+// writeUserArchive writes the files of an export archive to zw.
+func (t *Treatshelf) writeUserArchive(ctx context.Context, zw *zip.Writer, user string, p *Profile, prefs *Preferences) error {
+	writeJSON := func(name string, v interface{}) error {
+		f, err := zw.Create(name)
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+	if err := writeJSON("profile.json", struct {
+		Email string
+		*Profile
+	}{user, p}); err != nil {
+		return err
+	}
+	if err := writeJSON("preferences.json", prefs); err != nil {
+		return err
+	}
+	if t.Tokens != nil {
+		tokens, err := t.Tokens.ListTokens(ctx, user)
+		if err != nil {
+			return fmt.Errorf("ListTokens: %v", err)
+		}
+		if err := writeJSON("tokens.json", tokens); err != nil {
+			return err
+		}
+	}
+	if t.SavedSearches != nil {
+		saved, err := t.SavedSearches.ListSavedSearches(ctx, user)
+		if err != nil {
+			return fmt.Errorf("ListSavedSearches: %v", err)
+		}
+		if err := writeJSON("shelves.json", saved); err != nil {
+			return err
+		}
+	}
+
+	if t.SignIns != nil {
+		signIns, err := t.SignIns.ListSignIns(ctx, user, signInListLimit)
+		if err != nil {
+			return fmt.Errorf("ListSignIns: %v", err)
+		}
+		if err := writeJSON("signins.json", signIns); err != nil {
+			return err
+		}
+	}
+
+	uploads := []string{p.AvatarURL}
+	f, err := zw.Create("treats.jsonl")
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	err = t.DB.EachTreat(ctx, allTreatsOptions, func(treat *Treat) error {
+		if treat.CreatedBy != user {
+			return nil
+		}
+		uploads = append(uploads, treat.ImageURL)
+		return enc.Encode(treat)
+	})
+	if err != nil {
+		return fmt.Errorf("could not export treats: %v", err)
+	}
+
+	for _, url := range uploads {
+		if err := t.copyUpload(ctx, zw, url); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyUpload copies the picture at url into zw under uploads/, if it was
+// uploaded to the picture bucket.
+func (t *Treatshelf) copyUpload(ctx context.Context, zw *zip.Writer, url string) error {
+	bucket, name, ok := t.uploadObject(url)
+	if !ok {
+		return nil
+	}
+	rd, err := bucket.Object(name).NewReader(ctx)
+	if err == storage.ErrObjectNotExist {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not read upload %s: %v", name, err)
+	}
+	defer rd.Close()
+	f, err := zw.Create(path.Join("uploads", name))
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, rd)
+	return err
+}
+
+// downloadExportHandler serves one of the signed-in user's export archives.
+func (t *Treatshelf) downloadExportHandler(w http.ResponseWriter, r *http.Request) *appError {
+	bucket, err := t.backupBucket()
+	if err != nil {
+		return t.appErrorCodef(r, http.StatusServiceUnavailable, err, "exports are unavailable: %v", err)
+	}
+	// The name comes from the route, which only allows names without a
+	// slash, and the folder from the user, so people can only download
+	// their own archives.
+	name := mux.Vars(r)["name"]
+	rd, err := bucket.Object(exportFolder(t.currentUser(r)) + name).NewReader(r.Context())
+	if err == storage.ErrObjectNotExist {
+		err := fmt.Errorf("no export %q", name)
+		return t.appErrorCodef(r, http.StatusNotFound, err, "%v", err)
+	}
+	if err != nil {
+		return t.appErrorf(r, err, "could not read export: %v", err)
+	}
+	defer rd.Close()
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="treatshelf-%s"`, name))
+	if _, err := io.Copy(w, rd); err != nil {
+		fmt.Fprintf(t.logWriter, "Could not send export %s: %v\n", name, err)
+	}
+	return nil
+}
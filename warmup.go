@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// App Engine sends GET /_ah/warmup to new instances before sending them
+// traffic, if app.yaml lists the warmup inbound service. warmupHandler
+// does then what the first requests would otherwise wait for: compiling
+// the templates, connecting to Cloud Storage and Error Reporting, and
+// rendering the list page into the render cache. On Cloud Run, configure
+// the startup probe to GET /_ah/warmup.
+
+// warmupStep is how one part of warming up went.
+type warmupStep struct {
+	Name  string `json:"name"`
+	Ms    int64  `json:"ms"`
+	Error string `json:"error,omitempty"`
+}
+
+// warmupHandler warms up the instance, and reports how each step went and
+// whether the instance is ready. It responds 200 even if a step failed,
+// as healthz does when degraded, since the instance can still serve
+// requests.
+func (t *Treatshelf) warmupHandler(w http.ResponseWriter, r *http.Request) *appError {
+	ctx, cancel := context.WithTimeout(r.Context(), initTimeout)
+	defer cancel()
+
+	status := struct {
+		Status string       `json:"status"`
+		Steps  []warmupStep `json:"steps"`
+	}{Status: "ready"}
+	step := func(name string, f func() error) {
+		start := time.Now()
+		err := f()
+		s := warmupStep{Name: name, Ms: time.Since(start).Nanoseconds() / 1e6}
+		if err != nil {
+			s.Error = err.Error()
+			status.Status = "degraded"
+		}
+		status.Steps = append(status.Steps, s)
+	}
+	step("templates", func() error {
+		warmTemplates(t)
+		return nil
+	})
+	step("storage", func() error { return t.storageReady(ctx) })
+	step("errorReporting", func() error {
+		// Connects in the background, see errorReporter.
+		t.errorReporter()
+		return nil
+	})
+	step("list", func() error { return t.warmList(ctx) })
+
+	fmt.Fprintf(t.logWriter, "Warmup: %s\n", status.Status)
+	if err := writeJSON(w, http.StatusOK, status); err != nil {
+		return t.appErrorf(r, err, "could not write response: %v", err)
+	}
+	return nil
+}
+
+// warmTemplates executes every template once, without data. html/template
+// escapes a template the first time it's executed, which takes longer than
+// executing it; failing for want of data doesn't stop that.
+func warmTemplates(t *Treatshelf) {
+	for _, tmpl := range appTemplates {
+		tmpl.t.Execute(ioutil.Discard, &pageData{BasePath: t.basePath})
+	}
+}
+
+// warmList renders the list page as seen by visitors without a cookie,
+// which reads the treats from the database and caches the page, see
+// appTemplate.Execute.
+func (t *Treatshelf) warmList(ctx context.Context) error {
+	if t.routes == nil {
+		return errors.New("no routes")
+	}
+	r, err := http.NewRequest("GET", t.url("/treats"), nil)
+	if err != nil {
+		return err
+	}
+	w := &warmupWriter{header: make(http.Header)}
+	t.routes.ServeHTTP(w, r.WithContext(ctx))
+	if w.code != 0 && w.code != http.StatusOK {
+		return fmt.Errorf("list page: got status %d", w.code)
+	}
+	return nil
+}
+
+// warmupWriter is a ResponseWriter that keeps only the status code.
+type warmupWriter struct {
+	header http.Header
+	code   int
+}
+
+func (w *warmupWriter) Header() http.Header { return w.header }
+
+func (w *warmupWriter) Write(b []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	return len(b), nil
+}
+
+func (w *warmupWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWarmup(t *testing.T) {
+	shelf := goldenShelf(t)
+	shelf.renders = newRenderCache(shelf.clock)
+	h := shelf.Handler()
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/_ah/warmup", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	var status struct {
+		Status string
+		Steps  []warmupStep
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.Status != "ready" {
+		t.Errorf("status %q, want ready: %+v", status.Status, status.Steps)
+	}
+	if len(status.Steps) != 4 {
+		t.Errorf("got steps %+v, want 4", status.Steps)
+	}
+
+	// The first visitor gets the page warmup rendered.
+	if n := len(shelf.renders.pages); n != 1 {
+		t.Fatalf("render cache holds %d pages after warmup, want 1", n)
+	}
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/treats", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("list: got status %d, want %d", w.Code, http.StatusOK)
+	}
+	if n := len(shelf.renders.pages); n != 1 {
+		t.Errorf("render cache holds %d pages after the first visit, want 1: the visit missed", n)
+	}
+}
@@ -0,0 +1,8 @@
+// The entry point of the app's script bundle, built into
+// static/app.bundle.js by esbuild, see bundle.go. Pages work without it:
+// what's here only enhances them.
+
+import "./app.css";
+import { confirmForms } from "./confirm.js";
+
+confirmForms(document);
@@ -0,0 +1,10 @@
+// confirmForms asks before submitting forms with a data-confirm attribute,
+// such as those that can't be undone, showing the attribute's text.
+export function confirmForms(root) {
+  root.addEventListener("submit", function(event) {
+    var message = event.target.getAttribute("data-confirm");
+    if (message && !window.confirm(message)) {
+      event.preventDefault();
+    }
+  });
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// External systems, such as the bakery's till or a Zapier zap, keep treats
+// up to date by posting signed JSON to /integrations/webhooks/{source}:
+//
+//	{"Event": "treat.upsert", "ExternalID": "sku-123", "Treat": {"Title": "Brownie", "Quantity": 12}}
+//	{"Event": "treat.delete", "ExternalID": "sku-123"}
+//
+// Each source has its own secret (WEBHOOK_SECRETS=pos=sm://pos-webhook,...,
+// which may name secrets, see secrets.go), with which it signs requests in
+// the X-Treatshelf-Signature header, as
+//
+//	t=<unix time>,v1=<hex HMAC-SHA256 of "<unix time>.<body>">
+//
+// Requests signed more than webhookTolerance ago are refused, so captured
+// requests can't be replayed later. A source's treat with ExternalID X has
+// the ID "<source>-X", so upserts are idempotent. Sources are configured by
+// admins, so their treats don't wait for review. Every delivery from a
+// known source is recorded, and shown on /admin/webhooks.
+
+// Delivery is an inbound webhook request and its outcome.
+type Delivery struct {
+	ID         string
+	Source     string
+	Event      string
+	ExternalID string
+	TreatID    string
+	// Status is the HTTP status the source was sent; Error says why it
+	// failed, if it did.
+	Status int
+	Error  string
+	At     time.Time
+	// ExpiresAt is when the record may be deleted, see deliveryKeep.
+	ExpiresAt time.Time
+}
+
+// DeliveryDatabase stores Deliveries.
+type DeliveryDatabase interface {
+	// AddDelivery records a delivery, assigning it a new ID.
+	AddDelivery(ctx context.Context, d *Delivery) error
+
+	// ListDeliveries returns up to limit deliveries, newest first.
+	ListDeliveries(ctx context.Context, limit int) ([]*Delivery, error)
+}
+
+// Webhook events.
+const (
+	eventUpsert = "treat.upsert"
+	eventDelete = "treat.delete"
+)
+
+const (
+	// webhookSignatureHeader holds the signature of a webhook request.
+	webhookSignatureHeader = "X-Treatshelf-Signature"
+
+	// webhookTolerance is how far the time a request was signed may be
+	// from now.
+	webhookTolerance = 5 * time.Minute
+
+	// maxWebhookBytes bounds the size of a webhook request.
+	maxWebhookBytes = 1 << 20
+
+	// deliveryKeep is how long deliveries are kept for. The deliveries
+	// collection should have a TTL policy on ExpiresAt, as signIns does.
+	deliveryKeep = 30 * 24 * time.Hour
+
+	// deliveryListLimit bounds the deliveries listed on the admin page.
+	deliveryListLimit = 100
+)
+
+// externalIDPattern matches valid ExternalIDs, which become part of treat
+// IDs.
+var externalIDPattern = regexp.MustCompile(`^[0-9A-Za-z_\-]{1,100}$`)
+
+// webhookPayload is the body of a webhook request.
+type webhookPayload struct {
+	Event      string
+	ExternalID string
+	Treat      *Treat
+}
+
+// parseWebhookSecrets parses WEBHOOK_SECRETS, comma-separated source=secret
+// pairs, into a map from source to secret.
+func parseWebhookSecrets(s string) (map[string]string, error) {
+	secrets := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		i := strings.Index(pair, "=")
+		if i <= 0 || i == len(pair)-1 {
+			return nil, fmt.Errorf("%q is not source=secret", pair)
+		}
+		source := pair[:i]
+		if !externalIDPattern.MatchString(source) {
+			return nil, fmt.Errorf("invalid source name %q", source)
+		}
+		secrets[source] = pair[i+1:]
+	}
+	return secrets, nil
+}
+
+// requireWebhooks returns a 404 appError unless inbound webhooks are
+// enabled. The webhook routes use it through guard.
+func (t *Treatshelf) requireWebhooks(r *http.Request) *appError {
+	if t.Deliveries == nil || len(t.webhookSecrets) == 0 {
+		err := errors.New("inbound webhooks are not enabled")
+		return t.appErrorCodef(r, http.StatusNotFound, err, "%v", err)
+	}
+	return nil
+}
+
+// checkWebhookSignature returns an error unless header is a valid
+// signature of body made with secret within webhookTolerance of now.
+func checkWebhookSignature(header string, body []byte, secret string, now time.Time) error {
+	var ts string
+	var sigs []string
+	for _, part := range strings.Split(header, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "t":
+			ts = kv[1]
+		case "v1":
+			sigs = append(sigs, kv[1])
+		}
+	}
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil || len(sigs) == 0 {
+		return fmt.Errorf("missing or malformed %s header", webhookSignatureHeader)
+	}
+	if d := now.Sub(time.Unix(sec, 0)); d > webhookTolerance || d < -webhookTolerance {
+		return errors.New("signature timestamp is too old or in the future")
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts + "."))
+	mac.Write(body)
+	want := mac.Sum(nil)
+	// Sources rotating their secret may sign with both.
+	for _, s := range sigs {
+		if got, err := hex.DecodeString(s); err == nil && hmac.Equal(got, want) {
+			return nil
+		}
+	}
+	return errors.New("signature does not match")
+}
+
+// inboundWebhookHandler applies a signed webhook request from a source and
+// records the delivery.
+func (t *Treatshelf) inboundWebhookHandler(w http.ResponseWriter, r *http.Request) *appError {
+	source := mux.Vars(r)["source"]
+	secret, ok := t.webhookSecrets[source]
+	if !ok {
+		err := fmt.Errorf("unknown webhook source %q", source)
+		return t.appErrorCodef(r, http.StatusNotFound, err, "%v", err)
+	}
+	d := &Delivery{Source: source, At: t.now()}
+	e := t.applyWebhook(r, secret, d)
+	d.Status = http.StatusOK
+	if e != nil {
+		d.Status, d.Error = e.code, e.message
+	}
+	d.ExpiresAt = d.At.Add(deliveryKeep)
+	if err := t.Deliveries.AddDelivery(r.Context(), d); err != nil {
+		fmt.Fprintf(t.logWriter, "Webhook from %s: AddDelivery: %v\n", source, err)
+	}
+	if e != nil {
+		return e
+	}
+	writeJSON(w, http.StatusOK, struct{ TreatID string }{d.TreatID})
+	return nil
+}
+
+// applyWebhook checks and applies a webhook request signed with secret,
+// filling in d.
+func (t *Treatshelf) applyWebhook(r *http.Request, secret string, d *Delivery) *appError {
+	ctx := r.Context()
+	body, err := ioutil.ReadAll(http.MaxBytesReader(nil, r.Body, maxWebhookBytes))
+	if err != nil {
+		return t.appErrorCodef(r, http.StatusRequestEntityTooLarge, err, "webhook requests are at most %d bytes", maxWebhookBytes)
+	}
+	secret, err = t.secrets.resolve(ctx, secret)
+	if err != nil {
+		return t.appErrorf(r, err, "could not read the secret of %s: %v", d.Source, err)
+	}
+	if err := checkWebhookSignature(r.Header.Get(webhookSignatureHeader), body, secret, d.At); err != nil {
+		return t.appErrorCodef(r, http.StatusUnauthorized, err, "%v", err)
+	}
+
+	p := &webhookPayload{}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(p); err != nil {
+		return t.appErrorCodef(r, http.StatusBadRequest, err, "invalid payload: %v", err)
+	}
+	d.Event, d.ExternalID = p.Event, p.ExternalID
+	if !externalIDPattern.MatchString(p.ExternalID) {
+		err := errors.New("ExternalID must be 1 to 100 letters, digits, '-' or '_'")
+		return t.appErrorCodef(r, http.StatusBadRequest, err, "invalid payload: %v", err)
+	}
+	d.TreatID = d.Source + "-" + p.ExternalID
+	// GetTreats, unlike GetTreat, finds no treat without failing.
+	olds, err := t.DB.GetTreats(ctx, []string{d.TreatID})
+	if err != nil {
+		return t.appErrorf(r, err, "GetTreats: %v", err)
+	}
+	old := olds[0]
+
+	switch p.Event {
+	case eventUpsert:
+		if p.Treat == nil {
+			err := errors.New("Treat is required")
+			return t.appErrorCodef(r, http.StatusBadRequest, err, "invalid payload: %v", err)
+		}
+		treat := p.Treat
+		if err := checkAPITreat(treat); err != nil {
+			return t.appErrorCodef(r, http.StatusBadRequest, err, "invalid payload: %v", err)
+		}
+		treat.ID = d.TreatID
+		if old != nil && !old.Deleted() {
+			keepServerFields(treat, old)
+		} else {
+			treat.CreatedBy = "webhook:" + d.Source
+		}
+		if err := t.DB.UpdateTreat(ctx, treat); err != nil {
+			return t.appErrorf(r, err, "UpdateTreat: %v", err)
+		}
+	case eventDelete:
+		if p.Treat != nil {
+			err := errors.New("Treat must be empty for " + eventDelete)
+			return t.appErrorCodef(r, http.StatusBadRequest, err, "invalid payload: %v", err)
+		}
+		// Deleting twice isn't an error, so sources can retry.
+		if old != nil && !old.Deleted() {
+			if _, err := t.softDelete(ctx, []string{d.TreatID}); err != nil {
+				return t.appErrorf(r, err, "DeleteTreat: %v", err)
+			}
+		}
+	default:
+		err := fmt.Errorf("unknown Event %q, want %q or %q", p.Event, eventUpsert, eventDelete)
+		return t.appErrorCodef(r, http.StatusBadRequest, err, "invalid payload: %v", err)
+	}
+	fmt.Fprintf(t.logWriter, "Webhook from %s: %s %s\n", d.Source, p.Event, d.TreatID)
+	return nil
+}
+
+// webhooksHandler shows the configured webhook sources and the recent
+// deliveries.
+func (t *Treatshelf) webhooksHandler(w http.ResponseWriter, r *http.Request) *appError {
+	deliveries, err := t.Deliveries.ListDeliveries(r.Context(), deliveryListLimit)
+	if err != nil {
+		return t.appErrorf(r, err, "ListDeliveries: %v", err)
+	}
+	var sources []string
+	for s := range t.webhookSecrets {
+		sources = append(sources, s)
+	}
+	sort.Strings(sources)
+	return webhooksTmpl.Execute(t, w, r, struct {
+		Sources    []string
+		Deliveries []*Delivery
+	}{sources, deliveries})
+}
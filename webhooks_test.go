@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// webhookSignature returns the v1 signature of body, signed with secret at
+// the Unix time ts.
+func webhookSignature(secret string, ts int64, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.%s", ts, body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestCheckWebhookSignature(t *testing.T) {
+	now := testEpoch
+	body := `{"Event": "treat.delete", "ExternalID": "sku-1"}`
+	ts := now.Unix()
+	sig := webhookSignature("secret", ts, body)
+	old := webhookSignature("old secret", ts, body)
+	tests := []struct {
+		name    string
+		header  string
+		wantErr string
+	}{
+		{"valid", fmt.Sprintf("t=%d,v1=%s", ts, sig), ""},
+		{"spaces", fmt.Sprintf("t=%d, v1=%s", ts, sig), ""},
+		{"rotated secret, new second", fmt.Sprintf("t=%d,v1=%s,v1=%s", ts, old, sig), ""},
+		{"rotated secret, new first", fmt.Sprintf("t=%d,v1=%s,v1=%s", ts, sig, old), ""},
+		{"only the old secret", fmt.Sprintf("t=%d,v1=%s", ts, old), "does not match"},
+		{"missing", "", "missing or malformed"},
+		{"no timestamp", "v1=" + sig, "missing or malformed"},
+		{"no signature", fmt.Sprintf("t=%d", ts), "missing or malformed"},
+		{"malformed timestamp", "t=yesterday,v1=" + sig, "missing or malformed"},
+		{"not hex", fmt.Sprintf("t=%d,v1=zz", ts), "does not match"},
+		{"other body", fmt.Sprintf("t=%d,v1=%s", ts, webhookSignature("secret", ts, "{}")), "does not match"},
+		{"other timestamp", fmt.Sprintf("t=%d,v1=%s", ts+1, sig), "does not match"},
+	}
+	for _, tt := range tests {
+		err := checkWebhookSignature(tt.header, []byte(body), "secret", now)
+		if tt.wantErr == "" && err != nil {
+			t.Errorf("%s: checkWebhookSignature(%q): %v", tt.name, tt.header, err)
+		}
+		if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("%s: checkWebhookSignature(%q) = %v, want an error containing %q", tt.name, tt.header, err, tt.wantErr)
+		}
+	}
+
+	for _, d := range []time.Duration{-webhookTolerance - time.Second, webhookTolerance + time.Second} {
+		signed := now.Add(d).Unix()
+		header := fmt.Sprintf("t=%d,v1=%s", signed, webhookSignature("secret", signed, body))
+		if err := checkWebhookSignature(header, []byte(body), "secret", now); err == nil || !strings.Contains(err.Error(), "too old or in the future") {
+			t.Errorf("signed %v from now: checkWebhookSignature() = %v, want it refused", d, err)
+		}
+	}
+	for _, d := range []time.Duration{-webhookTolerance, webhookTolerance} {
+		signed := now.Add(d).Unix()
+		header := fmt.Sprintf("t=%d,v1=%s", signed, webhookSignature("secret", signed, body))
+		if err := checkWebhookSignature(header, []byte(body), "secret", now); err != nil {
+			t.Errorf("signed %v from now: checkWebhookSignature(): %v", d, err)
+		}
+	}
+}
+
+func TestApplyWebhook(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing *Treat
+		body     string
+		unsigned bool
+		want     int
+		check    func(t *testing.T, got *Treat)
+	}{
+		{
+			name: "upsert new",
+			body: `{"Event": "treat.upsert", "ExternalID": "sku-1", "Treat": {"Title": "Brownie", "Quantity": 12}}`,
+			want: http.StatusOK,
+			check: func(t *testing.T, got *Treat) {
+				if got == nil || got.Title != "Brownie" || got.CreatedBy != "webhook:pos" {
+					t.Errorf("upserted %+v, want a Brownie created by webhook:pos", got)
+				}
+			},
+		},
+		{
+			name:     "upsert existing",
+			existing: &Treat{ID: "pos-sku-1", Title: "Brownie", CreatedBy: "owner@example.com", InternalNotes: "Supplier: Bakery Ltd", Reports: 1},
+			body:     `{"Event": "treat.upsert", "ExternalID": "sku-1", "Treat": {"Title": "Fudge brownie"}}`,
+			want:     http.StatusOK,
+			check: func(t *testing.T, got *Treat) {
+				if got.Title != "Fudge brownie" || got.CreatedBy != "owner@example.com" || got.InternalNotes != "Supplier: Bakery Ltd" || got.Reports != 1 {
+					t.Errorf("upserted %+v, want the new title and the server's fields kept", got)
+				}
+			},
+		},
+		{
+			name:     "delete",
+			existing: &Treat{ID: "pos-sku-1", Title: "Brownie"},
+			body:     `{"Event": "treat.delete", "ExternalID": "sku-1"}`,
+			want:     http.StatusOK,
+			check: func(t *testing.T, got *Treat) {
+				if !got.Deleted() {
+					t.Errorf("treat %+v wasn't deleted", got)
+				}
+			},
+		},
+		{
+			name: "delete missing",
+			body: `{"Event": "treat.delete", "ExternalID": "sku-1"}`,
+			want: http.StatusOK,
+		},
+		{
+			name: "delete with a treat",
+			body: `{"Event": "treat.delete", "ExternalID": "sku-1", "Treat": {"Title": "Brownie"}}`,
+			want: http.StatusBadRequest,
+		},
+		{
+			name: "upsert without a treat",
+			body: `{"Event": "treat.upsert", "ExternalID": "sku-1"}`,
+			want: http.StatusBadRequest,
+		},
+		{
+			name: "unknown event",
+			body: `{"Event": "treat.rename", "ExternalID": "sku-1"}`,
+			want: http.StatusBadRequest,
+		},
+		{
+			name: "missing ExternalID",
+			body: `{"Event": "treat.delete"}`,
+			want: http.StatusBadRequest,
+		},
+		{
+			name: "invalid ExternalID",
+			body: `{"Event": "treat.delete", "ExternalID": "../1"}`,
+			want: http.StatusBadRequest,
+		},
+		{
+			name: "unknown field",
+			body: `{"Event": "treat.delete", "ExternalID": "sku-1", "Extra": true}`,
+			want: http.StatusBadRequest,
+		},
+		{
+			name:     "unsigned",
+			body:     `{"Event": "treat.upsert", "ExternalID": "sku-1", "Treat": {"Title": "Brownie"}}`,
+			unsigned: true,
+			want:     http.StatusUnauthorized,
+			check: func(t *testing.T, got *Treat) {
+				if got != nil {
+					t.Errorf("unsigned request saved %+v", got)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			shelf, db := newTestShelf(t)
+			ctx := context.Background()
+			if tt.existing != nil {
+				if err := db.UpdateTreat(ctx, tt.existing); err != nil {
+					t.Fatal(err)
+				}
+			}
+			r := httptest.NewRequest("POST", "/integrations/webhooks/pos", strings.NewReader(tt.body))
+			if !tt.unsigned {
+				ts := shelf.now().Unix()
+				r.Header.Set(webhookSignatureHeader, fmt.Sprintf("t=%d,v1=%s", ts, webhookSignature("secret", ts, tt.body)))
+			}
+			d := &Delivery{Source: "pos", At: shelf.now()}
+			got := http.StatusOK
+			if e := shelf.applyWebhook(r, "secret", d); e != nil {
+				got = e.code
+			}
+			if got != tt.want {
+				t.Fatalf("got status %d, want %d", got, tt.want)
+			}
+			if tt.want == http.StatusOK && d.TreatID != "pos-sku-1" {
+				t.Errorf("TreatID = %q, want %q", d.TreatID, "pos-sku-1")
+			}
+			if tt.check != nil {
+				treats, err := db.GetTreats(ctx, []string{"pos-sku-1"})
+				if err != nil {
+					t.Fatal(err)
+				}
+				tt.check(t, treats[0])
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Infinite scroll over shelves of tens of thousands of treats fetches
+// windows of the list, GET /api/v2/treats:window?offset=1000&limit=100,
+// rather than pages of whole treats. Windows have only what a scrolling
+// list shows of each treat, its ID, Title and ThumbnailURL, and the
+// number of matching treats, so that the client can size its scroll bar
+// up front:
+//
+//	{"offset": 1000, "items": [{"ID": "...", "Title": "...", "ThumbnailURL": "..."}], "totalCount": 23817, "nextCursor": "..."}
+//
+// limit=0 returns only totalCount. Clients that append as they scroll
+// follow nextCursor instead of counting offsets, so that treats added or
+// removed above the window don't shift it, as with paging.go's cursors.
+// The filters are those of the list page.
+
+// Bounds for the limit parameter of windows.
+const (
+	defaultWindowSize = 100
+	maxWindowSize     = 500
+)
+
+// treatSummary is the projection of a Treat in a window.
+type treatSummary struct {
+	ID           string
+	Title        string
+	ThumbnailURL string `json:",omitempty"`
+}
+
+// treatWindow is a window of the list of treats, see above.
+type treatWindow struct {
+	Offset     int            `json:"offset"`
+	Items      []treatSummary `json:"items"`
+	TotalCount int            `json:"totalCount"`
+	NextCursor string         `json:"nextCursor,omitempty"`
+}
+
+// windowFromRequest reads the "offset", "limit" and "cursor" parameters of
+// r. A cursor replaces the offset.
+func windowFromRequest(r *http.Request) (offset, limit int, c *cursor, err error) {
+	if offset, err = intFromForm(r, "offset"); err != nil {
+		return 0, 0, nil, err
+	}
+	limit = defaultWindowSize
+	if s := strings.TrimSpace(r.FormValue("limit")); s != "" {
+		if limit, err = strconv.Atoi(s); err != nil || limit < 0 || limit > maxWindowSize {
+			return 0, 0, nil, fmt.Errorf("limit must be 0 to %d, got %q", maxWindowSize, s)
+		}
+	}
+	if s := strings.TrimSpace(r.FormValue("cursor")); s != "" {
+		if c, err = parseCursor(s); err != nil {
+			return 0, 0, nil, err
+		}
+		if c.After == "" {
+			return 0, 0, nil, errors.New("windows only follow next cursors")
+		}
+	}
+	return offset, limit, c, nil
+}
+
+// window returns the window of treats at offset, or after c if it is set,
+// at most limit long.
+func window(treats []*Treat, offset, limit int, c *cursor) *treatWindow {
+	if c != nil {
+		offset = cursorIndex(treats, c.After, c.Offset-1) + 1
+	}
+	if offset > len(treats) {
+		offset = len(treats)
+	}
+	end := offset + limit
+	if end > len(treats) {
+		end = len(treats)
+	}
+	w := &treatWindow{Offset: offset, Items: make([]treatSummary, 0, end-offset), TotalCount: len(treats)}
+	for _, treat := range treats[offset:end] {
+		w.Items = append(w.Items, treatSummary{ID: treat.ID, Title: treat.Title, ThumbnailURL: treat.ThumbnailURL})
+	}
+	if end > offset && end < len(treats) {
+		w.NextCursor = (&cursor{After: treats[end-1].ID, Offset: end}).String()
+	}
+	return w
+}
+
+// apiWindowHandler returns a window of the treats matching the same
+// filters as the list page, see above.
+func (t *Treatshelf) apiWindowHandler(w http.ResponseWriter, r *http.Request) *appError {
+	offset, limit, c, err := windowFromRequest(r)
+	if err != nil {
+		return t.appErrorCodef(r, http.StatusBadRequest, err, "%v", err)
+	}
+	opts, err := t.listOptionsFromRequest(r, t.preferences(r))
+	if err != nil {
+		return t.appErrorCodef(r, http.StatusBadRequest, err, "invalid list options: %v", err)
+	}
+	treats, err := t.DB.ListTreats(r.Context(), opts)
+	if err != nil {
+		return t.appErrorf(r, err, "could not list treats: %v", err)
+	}
+	writeJSON(w, http.StatusOK, window(treats, offset, limit, c))
+	return nil
+}
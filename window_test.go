@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWindow(t *testing.T) {
+	var treats []*Treat
+	for i := 0; i < 10; i++ {
+		treats = append(treats, &Treat{ID: fmt.Sprint(i), Title: fmt.Sprint("Treat ", i), Description: "left out"})
+	}
+	w := window(treats, 4, 3, nil)
+	if w.Offset != 4 || len(w.Items) != 3 || w.Items[0].ID != "4" || w.TotalCount != 10 || w.NextCursor == "" {
+		t.Fatalf("window(4, 3) = %+v", w)
+	}
+
+	// The next window follows the cursor, even once a treat above it has
+	// gone.
+	c, err := parseCursor(w.NextCursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	treats = append(treats[:1], treats[2:]...)
+	next := window(treats, 0, 3, c)
+	if next.Offset != 6 || next.Items[0].ID != "7" || next.Items[2].ID != "9" || next.NextCursor != "" {
+		t.Errorf("window after %+v = %+v, want 7 to 9 at the end", c, next)
+	}
+
+	if count := window(treats, 0, 0, nil); len(count.Items) != 0 || count.TotalCount != 9 || count.NextCursor != "" {
+		t.Errorf("window(0, 0) = %+v, want only the count", count)
+	}
+	if past := window(treats, 50, 3, nil); past.Offset != 9 || len(past.Items) != 0 {
+		t.Errorf("window past the end = %+v", past)
+	}
+}
+
+func TestWindowHandler(t *testing.T) {
+	h := goldenShelf(t).Handler()
+	get := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/api/v2/treats:window"+query, nil))
+		return w
+	}
+
+	w := get("?limit=1")
+	var win map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &win); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("got status %d, %v: %s", w.Code, err, w.Body)
+	}
+	items, _ := win["items"].([]interface{})
+	if len(items) != 1 || win["totalCount"].(float64) < 1 {
+		t.Fatalf("got %s, want one item and the count", w.Body)
+	}
+	for field := range items[0].(map[string]interface{}) {
+		if field != "ID" && field != "Title" && field != "ThumbnailURL" {
+			t.Errorf("item has field %s", field)
+		}
+	}
+
+	for _, query := range []string{"?limit=501", "?limit=-1", "?offset=x", "?cursor=nope"} {
+		if w := get(query); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: got status %d, want %d", query, w.Code, http.StatusBadRequest)
+		}
+	}
+}